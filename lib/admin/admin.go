@@ -0,0 +1,127 @@
+package admin
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"zircon/lib/apis"
+	"zircon/lib/logging"
+	"zircon/lib/rpc"
+)
+
+// Explanation of the admin server:
+//     A frontend can serve a view of the whole cluster for operators, either under rpc.AdminPath on the address its
+//     twirp handler is published on, through rpc.ServerOptions.Admin, or on an address of its own, so that it can be
+//     kept off the network that clients use. It serves:
+//         TopologyPath     the servers registered in etcd, along with where each chunkserver is, whether it is up or
+//                          draining, and how full it last said its storage was
+//         ReplicationPath  how many chunks have fewer confirmed replicas on live chunkservers than they should
+//         ErrorsPath       the warnings and errors most recently logged by the frontend, if its logger, and that in
+//                          the ServerOptions it is published with, are wrapped by the logging.Recorder it is given
+//     each as JSON, and a page at / that shows all three and refreshes them as it is left open.
+//     Everything is read from etcd and the metadata caches as it is asked for, except that counting replicas means
+//     reading every metadata entry in the cluster, so that is done at most once per ReplicationScanInterval, and the
+//     last count is served in between, along with when it was made.
+
+// The paths that the admin server serves its JSON on.
+const TopologyPath = "/api/topology"
+const ReplicationPath = "/api/replication"
+const ErrorsPath = "/api/errors"
+
+// How many warnings and errors a frontend's logging.Recorder should remember for ErrorsPath.
+const RecentErrors = 100
+
+// How long the count of under-replicated chunks is reused before every metadata entry is read again to update it.
+const ReplicationScanInterval = 30 * time.Second
+
+//go:embed dashboard.html
+var dashboard []byte
+
+type handler struct {
+	etcd     apis.EtcdInterface
+	cache    rpc.ConnectionCache
+	recorder *logging.Recorder
+	mux      *http.ServeMux
+
+	// held for the whole of a scan, so that requests that arrive during one wait for it rather than starting another
+	scanMu  sync.Mutex
+	scanned *ReplicationSummary
+}
+
+// Makes the handler of an admin server, which looks up the cluster through 'etcd', and reads metadata entries from the
+// metadata caches through 'cache'. Shows the messages remembered by 'recorder', which may be nil if there are none.
+// Serve it alongside a frontend, as rpc.ServerOptions.Admin, or on its own with rpc.LaunchEmbeddedHTTP or
+// rpc.LaunchEmbeddedHTTPWithTLS.
+func NewHandler(etcd apis.EtcdInterface, cache rpc.ConnectionCache, recorder *logging.Recorder) http.Handler {
+	h := &handler{
+		etcd:     etcd,
+		cache:    cache,
+		recorder: recorder,
+		mux:      http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/", h.serveDashboard)
+	h.mux.HandleFunc(TopologyPath, func(writer http.ResponseWriter, request *http.Request) {
+		topology, err := ReadTopology(h.etcd)
+		writeJSON(writer, topology, err)
+	})
+	h.mux.HandleFunc(ReplicationPath, func(writer http.ResponseWriter, request *http.Request) {
+		summary, err := h.replication()
+		writeJSON(writer, summary, err)
+	})
+	h.mux.HandleFunc(ErrorsPath, func(writer http.ResponseWriter, request *http.Request) {
+		records := []logging.Record{}
+		if h.recorder != nil {
+			records = h.recorder.Recent()
+		}
+		writeJSON(writer, records, nil)
+	})
+	return h
+}
+
+func (h *handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		http.Error(writer, "the admin server is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	h.mux.ServeHTTP(writer, request)
+}
+
+func (h *handler) serveDashboard(writer http.ResponseWriter, request *http.Request) {
+	if request.URL.Path != "/" {
+		http.NotFound(writer, request)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = writer.Write(dashboard)
+}
+
+// Returns the last count of under-replicated chunks, counting them again first if it is too old.
+func (h *handler) replication() (*ReplicationSummary, error) {
+	h.scanMu.Lock()
+	defer h.scanMu.Unlock()
+	if h.scanned != nil && time.Since(h.scanned.ScannedAt) < ReplicationScanInterval {
+		return h.scanned, nil
+	}
+	summary, err := ScanReplication(h.etcd, h.cache)
+	if err != nil {
+		return nil, err
+	}
+	h.scanned = summary
+	return summary, nil
+}
+
+func writeJSON(writer http.ResponseWriter, value interface{}, err error) {
+	var encoded []byte
+	if err == nil {
+		encoded, err = json.Marshal(value)
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	_, _ = writer.Write(encoded)
+}
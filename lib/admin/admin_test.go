@@ -0,0 +1,313 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"zircon/lib/apis"
+	"zircon/lib/logging"
+	"zircon/lib/metadatacache"
+	"zircon/lib/rpc"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Just enough of etcd for the admin server to look the cluster up in, as seen from the frontend fe0.
+type fakeEtcd struct {
+	apis.EtcdInterface
+	servers  map[apis.ServerType][]apis.ServerName
+	ids      map[apis.ServerName]apis.ServerID
+	down     []apis.ServerName
+	draining []apis.ServerName
+	ring     []apis.ServerName
+	blocks   []apis.MetadataID
+}
+
+func (e *fakeEtcd) GetName() apis.ServerName {
+	return "fe0"
+}
+
+func (e *fakeEtcd) GetAddress(name apis.ServerName, kind apis.ServerType) (apis.ServerAddress, error) {
+	if name == "cs-lost" {
+		return "", errors.New("no address registered")
+	}
+	return apis.ServerAddress(fmt.Sprintf("%s-%d", name, kind)), nil
+}
+
+func (e *fakeEtcd) ListServers(kind apis.ServerType) ([]apis.ServerName, error) {
+	return e.servers[kind], nil
+}
+
+func (e *fakeEtcd) GetIDByName(name apis.ServerName) (apis.ServerID, error) {
+	return e.ids[name], nil
+}
+
+func (e *fakeEtcd) GetFailureDomain(name apis.ServerName) (apis.FailureDomain, error) {
+	return apis.FailureDomain{Zone: "z1", Rack: "r" + string(name)}, nil
+}
+
+func (e *fakeEtcd) GetCapacity(name apis.ServerName) (apis.ServerCapacity, error) {
+	if name == "cs2" {
+		// never reported
+		return apis.ServerCapacity{}, nil
+	}
+	return apis.ServerCapacity{FreeBytes: 250, TotalBytes: 1000, Chunks: 7}, nil
+}
+
+func (e *fakeEtcd) ListDownServers() ([]apis.ServerName, error) {
+	return e.down, nil
+}
+
+func (e *fakeEtcd) ListDraining() ([]apis.ServerName, error) {
+	return e.draining, nil
+}
+
+func (e *fakeEtcd) ListMetadataRing() ([]apis.ServerName, error) {
+	return e.ring, nil
+}
+
+func (e *fakeEtcd) ListAllMetaIDs() ([]apis.MetadataID, error) {
+	return e.blocks, nil
+}
+
+// A metadata cache that serves the entries of the blocks that 'owners' says it owns, and redirects requests for the
+// rest.
+type fakeMetadataCache struct {
+	apis.MetadataCache
+	name    apis.ServerName
+	owners  map[apis.MetadataID]apis.ServerName
+	entries map[apis.ChunkNum]apis.MetadataEntry
+	batches int
+}
+
+func (m *fakeMetadataCache) BatchReadEntry(chunks []apis.ChunkNum) ([]apis.EntryResult, error) {
+	m.batches++
+	results := make([]apis.EntryResult, len(chunks))
+	for i, chunk := range chunks {
+		block := metadatacache.ChunkToBlockID(chunk)
+		if owner := m.owners[block]; owner != m.name {
+			results[i] = apis.EntryResult{Owner: owner, Err: errors.New("not the owner")}
+		} else if entry, found := m.entries[chunk]; found {
+			results[i] = apis.EntryResult{Entry: entry}
+		} else {
+			results[i] = apis.EntryResult{Err: apis.ErrNotFound}
+		}
+	}
+	return results, nil
+}
+
+func prepareCluster() (*fakeEtcd, *rpc.MockCache, map[apis.ServerName]*fakeMetadataCache) {
+	etcd := &fakeEtcd{
+		servers: map[apis.ServerType][]apis.ServerName{
+			apis.FRONTEND:      {"fe0"},
+			apis.METADATACACHE: {"fe0", "fe1"},
+			apis.CHUNKSERVER:   {"cs0", "cs1", "cs2", "cs-lost"},
+		},
+		ids:      map[apis.ServerName]apis.ServerID{"cs0": 1, "cs1": 2, "cs2": 3, "cs-lost": 4},
+		down:     []apis.ServerName{"cs2"},
+		draining: []apis.ServerName{"cs1"},
+		ring:     []apis.ServerName{"fe0"},
+		blocks:   []apis.MetadataID{1, 2},
+	}
+	chunk := func(block apis.MetadataID, index uint32) apis.ChunkNum {
+		return metadatacache.EntryAndBlockToChunkNum(block, index)
+	}
+	// the ring is out of date: block 2 has since been taken on by fe1
+	owners := map[apis.MetadataID]apis.ServerName{1: "fe0", 2: "fe1"}
+	entries := map[apis.ChunkNum]apis.MetadataEntry{
+		// fully replicated
+		chunk(1, 0): {MostRecentVersion: 3, Replicas: []apis.ServerID{1, 2}},
+		// one replica is down
+		chunk(1, 1): {MostRecentVersion: 1, Replicas: []apis.ServerID{1, 3}},
+		// the only replica is down
+		chunk(1, 7): {MostRecentVersion: 1, Replicas: []apis.ServerID{3}, ReplicationFactor: 1},
+		// never written
+		chunk(1, 9): {Replicas: []apis.ServerID{3}},
+		// one replica hasn't caught up
+		chunk(2, 1030): {MostRecentVersion: 5, Replicas: []apis.ServerID{1, 2}, Lagging: []apis.ServerID{2}},
+		// kept on more replicas than usual
+		chunk(2, 32767): {MostRecentVersion: 2, Replicas: []apis.ServerID{1, 2}, ReplicationFactor: 3},
+	}
+	caches := map[apis.ServerName]*fakeMetadataCache{}
+	cache := &rpc.MockCache{MetadataCaches: map[apis.ServerAddress]apis.MetadataCache{}}
+	for _, name := range []apis.ServerName{"fe0", "fe1"} {
+		caches[name] = &fakeMetadataCache{name: name, owners: owners, entries: entries}
+		address, _ := etcd.GetAddress(name, apis.METADATACACHE)
+		cache.MetadataCaches[address] = caches[name]
+	}
+	return etcd, cache, caches
+}
+
+func get(t *testing.T, base string, path string, into interface{}) {
+	response, err := http.Get(base + path)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	require.NoError(t, json.NewDecoder(response.Body).Decode(into))
+}
+
+// Tests that the servers in the cluster are listed along with their state, and that one that can't be looked up is
+// listed with why.
+func TestTopology(t *testing.T) {
+	etcd, cache, _ := prepareCluster()
+	server := httptest.NewServer(NewHandler(etcd, cache, nil))
+	defer server.Close()
+
+	var topology Topology
+	get(t, server.URL, TopologyPath, &topology)
+	assert.Equal(t, []Server{{Name: "fe0", Address: "fe0-0"}}, topology.Frontends)
+	assert.Equal(t, []Server{{Name: "fe0", Address: "fe0-1", InRing: true}, {Name: "fe1", Address: "fe1-1"}}, topology.MetadataCaches)
+	require.Len(t, topology.Chunkservers, 4)
+	assert.Equal(t, Chunkserver{
+		Server:      Server{Name: "cs1", Address: "cs1-2"},
+		ID:          2,
+		Domain:      apis.FailureDomain{Zone: "z1", Rack: "rcs1"},
+		Live:        true,
+		Draining:    true,
+		Capacity:    apis.ServerCapacity{FreeBytes: 250, TotalBytes: 1000, Chunks: 7},
+		Utilization: 0.75,
+	}, topology.Chunkservers[1])
+	assert.False(t, topology.Chunkservers[2].Live)
+	assert.Equal(t, 0.0, topology.Chunkservers[2].Utilization)
+	assert.Equal(t, "no address registered", topology.Chunkservers[3].Error)
+	assert.Equal(t, apis.ServerID(4), topology.Chunkservers[3].ID)
+	// cs2 never said how large its storage is
+	assert.Equal(t, uint64(3000), topology.TotalBytes)
+	assert.Equal(t, uint64(750), topology.FreeBytes)
+}
+
+// Tests that chunks short of replicas on live chunkservers are counted, following redirections to the owners of their
+// entries, and that the count is reused until it is due to be made again.
+func TestReplication(t *testing.T) {
+	etcd, cache, caches := prepareCluster()
+	server := httptest.NewServer(NewHandler(etcd, cache, nil))
+	defer server.Close()
+
+	var summary ReplicationSummary
+	get(t, server.URL, ReplicationPath, &summary)
+	assert.Equal(t, uint64(5), summary.Chunks)
+	assert.Equal(t, uint64(4), summary.UnderReplicated)
+	assert.Equal(t, uint64(1), summary.Unavailable)
+	assert.Equal(t, uint64(1), summary.Lagging)
+	assert.Equal(t, uint64(0), summary.UnreadableBlocks)
+	assert.False(t, summary.ScannedAt.IsZero())
+	// block 2 is only asked for from fe0 once before the rest of it goes straight to fe1
+	blocks := 1 << apis.EntriesPerBlock / apis.MaxBatchSize
+	assert.Equal(t, blocks+1, caches["fe0"].batches)
+	assert.Equal(t, blocks, caches["fe1"].batches)
+
+	var again ReplicationSummary
+	get(t, server.URL, ReplicationPath, &again)
+	assert.Equal(t, summary.ScannedAt.UnixNano(), again.ScannedAt.UnixNano())
+	assert.Equal(t, blocks+1, caches["fe0"].batches)
+
+	// a block that can't be read is left out, rather than failing the whole count
+	delete(cache.MetadataCaches, "fe1-1")
+	summary2, err := ScanReplication(etcd, cache)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), summary2.Chunks)
+	assert.Equal(t, uint64(1), summary2.UnreadableBlocks)
+	assert.Contains(t, summary2.LastError, "metadata block 2")
+}
+
+// Tests that recent warnings and errors are served with their fields, and that the dashboard is served alongside the
+// JSON, but nothing can be changed through it.
+func TestErrorsAndDashboard(t *testing.T) {
+	etcd, cache, _ := prepareCluster()
+	recorder := logging.NewRecorder(10)
+	logger := logging.Component(recorder.Wrap(apis.NoopLogger), "frontend")
+	logger.Logf(apis.INFO, "not remembered")
+	logger.Logf(apis.ERROR, "cannot reach replica %s", "cs2")
+	server := httptest.NewServer(NewHandler(etcd, cache, recorder))
+	defer server.Close()
+
+	var records []logging.Record
+	get(t, server.URL, ErrorsPath, &records)
+	require.Len(t, records, 1)
+	assert.Equal(t, "ERROR", records[0].Level)
+	assert.Equal(t, "cannot reach replica cs2", records[0].Message)
+	assert.Equal(t, map[string]interface{}{"component": "frontend"}, records[0].Fields)
+
+	response, err := http.Get(server.URL + "/")
+	require.NoError(t, err)
+	page, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.True(t, strings.HasPrefix(response.Header.Get("Content-Type"), "text/html"))
+	assert.Contains(t, string(page), "api/replication")
+
+	response, err = http.Get(server.URL + "/nothing")
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	response, err = http.Post(server.URL+ErrorsPath, "application/json", strings.NewReader("[]"))
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+}
+
+// Just enough of a frontend to fail a call by panicking, which the server it is published on reports as an error.
+type panickingFrontend struct {
+	apis.Frontend
+}
+
+func (f *panickingFrontend) New() (apis.ChunkNum, error) {
+	panic("the unexpected happened")
+}
+
+// Tests that a frontend published with the admin handler serves it under rpc.AdminPath, alongside its RPCs, including
+// the errors that the frontend's server logs.
+func TestServedByFrontend(t *testing.T) {
+	etcd, cache, _ := prepareCluster()
+	recorder := logging.NewRecorder(RecentErrors)
+	teardown, address, err := rpc.PublishFrontendWithOptions(&panickingFrontend{}, "127.0.0.1:0", rpc.ServerOptions{
+		Logger: recorder.Wrap(apis.NoopLogger),
+		Admin:  NewHandler(etcd, cache, recorder),
+	})
+	require.NoError(t, err)
+	defer teardown(true)
+	base := "http://" + string(address) + rpc.AdminPath
+
+	var records []logging.Record
+	get(t, base, ErrorsPath, &records)
+	assert.Empty(t, records)
+
+	fe, err := rpc.UncachedSubscribeFrontend(address, nil)
+	require.NoError(t, err)
+	_, err = fe.New()
+	require.Error(t, err)
+
+	get(t, base, ErrorsPath, &records)
+	require.Len(t, records, 1)
+	assert.Equal(t, "ERROR", records[0].Level)
+	assert.Contains(t, records[0].Message, "the unexpected happened")
+
+	var topology Topology
+	get(t, base, TopologyPath, &topology)
+	assert.Len(t, topology.Chunkservers, 4)
+
+	// the dashboard asks for the reports relative to where it is served
+	response, err := http.Get("http://" + string(address) + rpc.AdminPath)
+	require.NoError(t, err)
+	page, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, base+"/", response.Request.URL.String())
+	assert.Contains(t, string(page), "api/errors")
+
+	response, err = http.Get("http://" + string(address) + rpc.LivenessPath)
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+}
@@ -0,0 +1,161 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"zircon/lib/apis"
+	"zircon/lib/chunkupdate"
+	"zircon/lib/frontend"
+	"zircon/lib/metadatacache"
+	"zircon/lib/rpc"
+	"zircon/lib/services"
+)
+
+// How well the chunks in a cluster are replicated, as counted by ScanReplication.
+type ReplicationSummary struct {
+	// the chunks that have been written to, and so should have replicas
+	Chunks uint64 `json:"chunks"`
+	// chunks with fewer confirmed replicas on live chunkservers than they should be kept on, including those with none
+	UnderReplicated uint64 `json:"under-replicated"`
+	// chunks with no confirmed replica on any live chunkserver, which can't be read until one comes back
+	Unavailable uint64 `json:"unavailable"`
+	// chunks with replicas that haven't yet confirmed their latest write; see MetadataEntry.Lagging
+	Lagging uint64 `json:"lagging"`
+	// metadata blocks whose entries couldn't all be read, whose chunks aren't counted at all, and why the last of them
+	// couldn't be
+	UnreadableBlocks uint64    `json:"unreadable-blocks"`
+	LastError        string    `json:"last-error,omitempty"`
+	ScannedAt        time.Time `json:"scanned-at"`
+}
+
+// Reads every metadata entry in the cluster, through whichever metadata caches own them, and counts how many chunks
+// are short of replicas. Chunks are kept on as many replicas as their entries say, or services.MinReplicas if they
+// don't say. Only the metadata is checked, so a replica that a chunkserver has lost without anyone noticing yet is
+// still counted, until the replication service finds out and replaces it.
+func ScanReplication(etcd apis.EtcdInterface, cache rpc.ConnectionCache) (*ReplicationSummary, error) {
+	liveIDs, err := chunkupdate.ListLiveChunkservers(etcd)
+	if err != nil {
+		return nil, err
+	}
+	live := map[apis.ServerID]bool{}
+	for _, id := range liveIDs {
+		live[id] = true
+	}
+	members, err := etcd.ListMetadataRing()
+	if err != nil {
+		return nil, err
+	}
+	ring := apis.NewMetadataRing(members)
+	blocks, err := etcd.ListAllMetaIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &ReplicationSummary{}
+	for _, block := range blocks {
+		counted, err := scanBlock(etcd, cache, ring.BlockOwner(block), block, live)
+		if err != nil {
+			summary.UnreadableBlocks++
+			summary.LastError = fmt.Sprintf("cannot read metadata block %d: %v", block, err)
+			continue
+		}
+		summary.Chunks += counted.Chunks
+		summary.UnderReplicated += counted.UnderReplicated
+		summary.Unavailable += counted.Unavailable
+		summary.Lagging += counted.Lagging
+	}
+	summary.ScannedAt = time.Now()
+	return summary, nil
+}
+
+// Counts the chunks in one metadata block, starting with the metadata cache that the ring says likely owns it.
+func scanBlock(etcd apis.EtcdInterface, cache rpc.ConnectionCache, owner apis.ServerName, block apis.MetadataID, live map[apis.ServerID]bool) (ReplicationSummary, error) {
+	var counted ReplicationSummary
+	for start := 0; start < 1<<apis.EntriesPerBlock; start += apis.MaxBatchSize {
+		var chunks []apis.ChunkNum
+		for i := start; i < start+apis.MaxBatchSize && i < 1<<apis.EntriesPerBlock; i++ {
+			chunks = append(chunks, metadatacache.EntryAndBlockToChunkNum(block, uint32(i)))
+		}
+		var results []apis.EntryResult
+		var err error
+		// the rest of the block is asked for from whichever cache turned out to own it
+		results, owner, err = readEntries(etcd, cache, owner, chunks)
+		if err != nil {
+			return counted, err
+		}
+		for _, result := range results {
+			if errors.Is(result.Err, apis.ErrNotFound) || errors.Is(result.Err, apis.ErrChunkDeleted) {
+				continue
+			} else if result.Err != nil {
+				return counted, result.Err
+			}
+			countEntry(&counted, result.Entry, live)
+		}
+	}
+	return counted, nil
+}
+
+func countEntry(counted *ReplicationSummary, entry apis.MetadataEntry, live map[apis.ServerID]bool) {
+	// chunks that have never been written to have nothing on any chunkserver to replicate
+	if entry.MostRecentVersion == 0 {
+		return
+	}
+	counted.Chunks++
+	target := services.MinReplicas
+	if entry.ReplicationFactor > 0 {
+		target = int(entry.ReplicationFactor)
+	}
+	replicas := 0
+	for _, replica := range entry.Confirmed() {
+		if live[replica] {
+			replicas++
+		}
+	}
+	if replicas < target {
+		counted.UnderReplicated++
+	}
+	if replicas == 0 {
+		counted.Unavailable++
+	}
+	if len(entry.Lagging) > 0 {
+		counted.Lagging++
+	}
+}
+
+// Reads the entries of 'chunks', which are all in one metadata block, from the metadata cache that owns it, starting
+// with 'owner', or the local metadata cache if it is NoRedirect, and following any redirections. Returns the owner that
+// they were read from.
+func readEntries(etcd apis.EtcdInterface, cache rpc.ConnectionCache, owner apis.ServerName, chunks []apis.ChunkNum) ([]apis.EntryResult, apis.ServerName, error) {
+	for tries := 0; tries < frontend.MaxRedirections; tries++ {
+		name := owner
+		if name == apis.NoRedirect {
+			name = etcd.GetName()
+		}
+		address, err := etcd.GetAddress(name, apis.METADATACACHE)
+		if err != nil {
+			return nil, owner, err
+		}
+		mdc, err := cache.SubscribeMetadataCache(address)
+		if err != nil {
+			return nil, owner, err
+		}
+		results, err := mdc.BatchReadEntry(chunks)
+		if err != nil {
+			return nil, owner, err
+		}
+		var redirect apis.ServerName
+		for _, result := range results {
+			if result.Owner != apis.NoRedirect {
+				redirect = result.Owner
+				break
+			}
+		}
+		if redirect == apis.NoRedirect {
+			return results, owner, nil
+		}
+		owner = redirect
+	}
+	return nil, owner, fmt.Errorf("redirected more than %d times", frontend.MaxRedirections)
+}
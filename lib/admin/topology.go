@@ -0,0 +1,123 @@
+package admin
+
+import (
+	"zircon/lib/apis"
+)
+
+// The servers in a cluster, as registered in etcd.
+type Topology struct {
+	Frontends      []Server      `json:"frontends"`
+	MetadataCaches []Server      `json:"metadata-caches"`
+	Chunkservers   []Chunkserver `json:"chunkservers"`
+	// the storage of the chunkservers that reported how large it is, added up
+	TotalBytes uint64 `json:"total-bytes"`
+	FreeBytes  uint64 `json:"free-bytes"`
+}
+
+// A server registered in etcd. If something about it couldn't be looked up, it is left out, and Error says why.
+type Server struct {
+	Name    apis.ServerName    `json:"name"`
+	Address apis.ServerAddress `json:"address,omitempty"`
+	// only set for metadata caches: whether it is a member of the metadata ring, and so takes on metadata blocks
+	InRing bool   `json:"in-ring,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// A chunkserver registered in etcd, along with what it last reported about itself.
+type Chunkserver struct {
+	Server
+	ID     apis.ServerID      `json:"id"`
+	Domain apis.FailureDomain `json:"domain"`
+	// false once it has stopped sending heartbeats for its liveness timeout
+	Live     bool                `json:"live"`
+	Draining bool                `json:"draining"`
+	Capacity apis.ServerCapacity `json:"capacity"`
+	// the fraction of its storage in use, or zero if it hasn't said how large it is; see ServerCapacity.UsedFraction
+	Utilization float64 `json:"utilization"`
+}
+
+// Looks up every server registered in 'etcd'. Fails only if the servers can't be listed; problems with looking up
+// details of any one server are reported on that server.
+func ReadTopology(etcd apis.EtcdInterface) (*Topology, error) {
+	topology := &Topology{}
+	var err error
+	if topology.Frontends, err = readServers(etcd, apis.FRONTEND); err != nil {
+		return nil, err
+	}
+	if topology.MetadataCaches, err = readServers(etcd, apis.METADATACACHE); err != nil {
+		return nil, err
+	}
+	ring, err := etcd.ListMetadataRing()
+	if err != nil {
+		return nil, err
+	}
+	for i := range topology.MetadataCaches {
+		for _, member := range ring {
+			if member == topology.MetadataCaches[i].Name {
+				topology.MetadataCaches[i].InRing = true
+			}
+		}
+	}
+
+	servers, err := readServers(etcd, apis.CHUNKSERVER)
+	if err != nil {
+		return nil, err
+	}
+	down, err := namesIn(etcd.ListDownServers())
+	if err != nil {
+		return nil, err
+	}
+	draining, err := namesIn(etcd.ListDraining())
+	if err != nil {
+		return nil, err
+	}
+	topology.Chunkservers = []Chunkserver{}
+	for _, server := range servers {
+		cs := Chunkserver{Server: server, Live: !down[server.Name], Draining: draining[server.Name]}
+		cs.ID, err = etcd.GetIDByName(server.Name)
+		if err == nil {
+			cs.Domain, err = etcd.GetFailureDomain(server.Name)
+		}
+		if err == nil {
+			cs.Capacity, err = etcd.GetCapacity(server.Name)
+		}
+		if err != nil && cs.Error == "" {
+			cs.Error = err.Error()
+		}
+		cs.Utilization = cs.Capacity.UsedFraction()
+		if cs.Capacity.Known() {
+			topology.TotalBytes += cs.Capacity.TotalBytes
+			topology.FreeBytes += cs.Capacity.FreeBytes
+		}
+		topology.Chunkservers = append(topology.Chunkservers, cs)
+	}
+	return topology, nil
+}
+
+func readServers(etcd apis.EtcdInterface, kind apis.ServerType) ([]Server, error) {
+	names, err := etcd.ListServers(kind)
+	if err != nil {
+		return nil, err
+	}
+	servers := []Server{}
+	for _, name := range names {
+		server := Server{Name: name}
+		server.Address, err = etcd.GetAddress(name, kind)
+		if err != nil {
+			server.Error = err.Error()
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+func namesIn(names []apis.ServerName, err error) (map[apis.ServerName]bool, error) {
+	if err != nil {
+		return nil, err
+	}
+	set := map[apis.ServerName]bool{}
+	for _, name := range names {
+		set[name] = true
+	}
+	return set, nil
+}
@@ -0,0 +1,92 @@
+package apis
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Explanation of chunk ACLs:
+//     A chunk can be given an ACL when it is allocated, through NewOptions, which is then kept in its metadata entry.
+//     Frontends check it against the principal that each request arrives from, and refuse what the ACL doesn't permit
+//     with an error matching ErrPermissionDenied: reading the entry, which is how a client finds out where and at which
+//     version to read the chunk, counts as ReadAccess; committing writes and appends and taking out write leases as
+//     WriteAccess; and deleting the chunk as DeleteAccess.
+//     The principal is only known for requests from clients whose certificates the frontend verified, through mutual
+//     TLS; see rpc.TLSConfiguration. Requests that arrive any other way are Anonymous, which only chunks without an ACL
+//     permit. Requests made within the frontend's own process, such as by the services, aren't checked at all.
+//     Chunkservers know nothing of ACLs. For an ACL to protect a chunk's data, rather than just its metadata, they have
+//     to be published with rpc.ServerOptions.Cluster, so that they only take calls from the cluster's servers, and
+//     from clients presenting a capability that a frontend issued them along with the chunk's entry; see
+//     rpc.Capability. Metadata caches published that way likewise only let the cluster's servers change entries.
+
+// Who a request was made by, as a fingerprint of the common name of the certificate that the caller presented. Only
+// the fingerprint is kept, so that ACLs fit within a metadata entry.
+type Principal uint64
+
+// The principal of requests from callers that were not identified.
+const Anonymous Principal = 0
+
+// Returns the principal for a certificate's common name.
+func PrincipalNamed(name string) Principal {
+	sum := sha256.Sum256([]byte(name))
+	principal := Principal(binary.LittleEndian.Uint64(sum[:]))
+	if principal == Anonymous {
+		// nobody gets to be anonymous by their choice of name
+		principal = 1
+	}
+	return principal
+}
+
+// The kinds of access that an ACL can permit, which can be combined.
+type Access uint8
+
+const (
+	ReadAccess Access = 1 << iota
+	WriteAccess
+	DeleteAccess
+)
+
+// The most principals that an ACL can permit besides its owner.
+const MaxACLPrincipals = 4
+
+// Who can access a chunk. The zero value is no ACL at all, which permits everyone everything.
+type ACL struct {
+	// can do anything to the chunk; Anonymous if the chunk has no ACL
+	Owner Principal
+	// can do what Mode permits, and nothing more
+	Allowed []Principal
+	Mode    Access
+}
+
+// Whether the ACL restricts access at all.
+func (acl ACL) Restricted() bool {
+	return acl.Owner != Anonymous
+}
+
+// Whether 'principal' may access the chunk in the way 'access' asks for.
+func (acl ACL) Permits(principal Principal, access Access) bool {
+	if !acl.Restricted() || principal == acl.Owner {
+		return true
+	}
+	if principal == Anonymous || acl.Mode&access != access {
+		return false
+	}
+	for _, allowed := range acl.Allowed {
+		if allowed == principal {
+			return true
+		}
+	}
+	return false
+}
+
+func (acl ACL) Equals(other ACL) bool {
+	if acl.Owner != other.Owner || acl.Mode != other.Mode || len(acl.Allowed) != len(other.Allowed) {
+		return false
+	}
+	for i, allowed := range acl.Allowed {
+		if other.Allowed[i] != allowed {
+			return false
+		}
+	}
+	return true
+}
@@ -1,5 +1,10 @@
 package apis
 
+import (
+	"fmt"
+	"hash/crc32"
+)
+
 // The version number of a chunk
 type Version uint64
 
@@ -20,6 +25,50 @@ type ChunkVersion struct {
 	Version Version
 }
 
+// A CRC-32C of some chunk data, used to check that it arrived intact.
+type Checksum uint32
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Calculates the checksum of data, for comparison with one returned by ReadWithChecksum.
+func CalculateChecksum(data []byte) Checksum {
+	return Checksum(crc32.Checksum(data, checksumTable))
+}
+
+// Returns an error matching ErrChecksumMismatch unless 'checksum' is the checksum of 'data'.
+func VerifyChecksum(data []byte, checksum Checksum) error {
+	if actual := CalculateChecksum(data); actual != checksum {
+		return fmt.Errorf("checksum of %d bytes is %08x, not %08x: %w", len(data), actual, checksum, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// Extends the checksum of some data to cover the data followed by 'count' zeroes.
+func ExtendChecksumWithZeroes(checksum Checksum, count int) Checksum {
+	var zeroes [4096]byte
+	crc := uint32(checksum)
+	for count > 0 {
+		n := count
+		if n > len(zeroes) {
+			n = len(zeroes)
+		}
+		crc = crc32.Update(crc, checksumTable, zeroes[:n])
+		count -= n
+	}
+	return Checksum(crc)
+}
+
+// A summary of one chunkserver's copy of a chunk, for comparing replicas without transferring their data.
+type ChunkDigest struct {
+	Chunk ChunkNum
+	// The version the chunkserver serves to clients, as last set by UpdateLatestVersion or Add.
+	Latest Version
+	// The checksum of Latest, taken over the whole chunk as Read returns it; see ReadWithChecksum.
+	Checksum Checksum
+	// Every version the chunkserver holds, including Latest, as ListAllChunks would list them.
+	Versions []Version
+}
+
 // note: this API is strongly consistent, because it's a connection to just a single chunkserver
 type Chunkserver interface {
 	ChunkserverSingle
@@ -51,6 +100,17 @@ type ChunkserverSingle interface {
 	// Fails if a copy of this chunk isn't located on this chunkserver.
 	Read(chunk ChunkNum, offset uint32, length uint32, minimum Version) ([]byte, Version, error)
 
+	// Like Read, but reads exactly the given version, which may be one that has been superseded or deleted but is
+	// still within the chunkserver's retention window. Fails with an error matching ErrVersionReclaimed if the version
+	// is older than the latest one and is no longer retained, or ErrNotFound if it is newer or the chunk is unknown.
+	ReadVersion(chunk ChunkNum, offset uint32, length uint32, version Version) ([]byte, error)
+
+	// Like Read, but also returns the checksum of the returned bytes, as computed by CalculateChecksum, so that the
+	// caller can tell whether they were damaged on the way. The chunkserver keeps a checksum of each whole version it
+	// stores, so reading the whole chunk at once doesn't hash it again; a read of part of a chunk returns the checksum
+	// of just that part, which has to be computed for the read.
+	ReadWithChecksum(chunk ChunkNum, offset uint32, length uint32, minimum Version) ([]byte, Version, Checksum, error)
+
 	// Given a chunk reference, send data to be used for a write to this chunk.
 	// This method does not actually perform a write.
 	// The sum of 'offset' and 'len(data)' must not be greater than MaxChunkSize.
@@ -61,8 +121,18 @@ type ChunkserverSingle interface {
 	// Takes existing saved data for oldVersion, apply this cached write, and saved it as newVersion.
 	CommitWrite(chunk ChunkNum, hash CommitHash, oldVersion Version, newVersion Version) error
 
+	// Like StartWrite, but for data to be appended to the chunk, whose offset isn't decided until it is committed.
+	// len(data) must not be greater than MaxChunkSize. The commit hash is computed by CalculateAppendHash.
+	StartAppend(chunk ChunkNum, data []byte) error
+
+	// Like CommitWrite, but for an append staged by StartAppend: the data is placed at the end of the valid data in
+	// oldVersion, which is how much data is stored for it, and that offset is returned. Every replica holds the same
+	// data for oldVersion, so they all place it at the same offset. Fails with an error matching ErrChunkTooLarge if the
+	// data doesn't fit.
+	CommitAppend(chunk ChunkNum, hash CommitHash, oldVersion Version, newVersion Version) (uint32, error)
+
 	// Update the version of this chunk that will be returned to clients.
-	// Deletes any chunk versions older than this new version.
+	// Deletes any chunk versions older than this new version, once the chunkserver's retention window has passed.
 	// If the current version reported to clients is different from the oldVersion, errors.
 	UpdateLatestVersion(chunk ChunkNum, oldVersion Version, newVersion Version) error
 
@@ -73,10 +143,32 @@ type ChunkserverSingle interface {
 	// initialVersion must be positive
 	Add(chunk ChunkNum, initialData []byte, initialVersion Version) error
 
-	// Deletes a chunk stored on this chunkserver with a specific version.
+	// Deletes a chunk stored on this chunkserver with a specific version. If the chunkserver has a retention window,
+	// the data is only reclaimed once the window has passed, and can be restored with Undelete until then.
 	Delete(chunk ChunkNum, version Version) error
 
+	// Restores a version of a chunk that was deleted or superseded within the chunkserver's retention window, and makes
+	// it the version returned to clients. The version it replaces is retained in turn, so this can itself be undone.
+	// Fails with an error matching ErrNotFound if no such version is being retained.
+	// This does not change the chunk's metadata entry, which must be brought into agreement separately.
+	Undelete(chunk ChunkNum, version Version) error
+
+	// Keeps a version of a chunk from being reclaimed, even once it is superseded or deleted and its retention window
+	// has passed, so that ReadVersion can still read it. A version may be pinned more than once, and is only released
+	// once it has been unpinned as many times. Fails with an error matching ErrVersionReclaimed or ErrNotFound if the
+	// version can't be read any more, as with ReadVersion. Pins are only remembered in memory, so they do not last
+	// across a restart of the chunkserver.
+	Pin(chunk ChunkNum, version Version) error
+	// Releases a pin taken by Pin. If the version is no longer the latest one, it is then treated as if it had just been
+	// superseded. Fails with an error matching ErrNotFound if the version is not pinned.
+	Unpin(chunk ChunkNum, version Version) error
+
 	// Requests a list of all chunks currently held by this chunkserver.
 	// There is no guaranteed order for the returned slice.
 	ListAllChunks() ([]ChunkVersion, error)
+
+	// Summarizes this chunkserver's copies of the given chunks, so that replicas can be compared with one another
+	// without reading their data. Chunks that this chunkserver doesn't hold are left out. The digests are in no
+	// particular order.
+	DigestChunks(chunks []ChunkNum) ([]ChunkDigest, error)
 }
@@ -4,27 +4,93 @@ package apis
 type Client interface {
 	// Allocate a new chunk, all zeroed out. The first write must be done with version=0.
 	// The chunk is not considered to exist until that first write is performed.
-	// If this chunk isn't written to before the connection to the server closes, the empty chunk will be deleted.
+	// If this chunk isn't written to before the client is closed, the empty chunk will be deleted then. If the client
+	// goes away without being closed, garbage collection deletes the chunk once it has been left unwritten for long
+	// enough.
 	New() (ChunkNum, error)
 
 	// Read part or all of the contents of a chunk. offset + length cannot exceed MaxChunkSize.
 	// Returns the data read and the version of the data read. The version can be used with Write.
-	// If the chunk does not exist, returns an error.
+	// If the chunk does not exist, returns an error matching ErrNotFound.
 	Read(ref ChunkNum, offset uint32, length uint32) ([]byte, Version, error)
 
+	// Read part or all of the contents of a chunk exactly as of 'version', which may have since been overwritten or
+	// deleted as long as the chunkservers still retain it.
+	// If that version has been reclaimed, returns an error matching ErrVersionReclaimed. If the chunk does not exist,
+	// or has not yet reached that version, returns an error matching ErrNotFound.
+	ReadVersion(ref ChunkNum, offset uint32, length uint32, version Version) ([]byte, error)
+
+	// Like Read, but also returns the chunkserver's checksum of the returned data, as computed by CalculateChecksum,
+	// for callers that keep their own integrity metadata. The data has already been checked against it. See
+	// ChunkserverSingle.ReadWithChecksum for what the checksum covers.
+	ReadWithChecksum(ref ChunkNum, offset uint32, length uint32) ([]byte, Version, Checksum, error)
+
 	// Write part or all of the contents of a chunk. offset + len(data) cannot exceed MaxChunkSize.
 	// Takes a version; if the version is not AnyVersion and doesn't match the latest version of the chunk, the write is
 	// rejected.
 	// Returns the new version, if the request succeeds, or the most recent version number, if the request fails due to
-	// staleness.
-	// If the chunk does not exist, returns an error. If this fails for any reason, there must be no visible change to
+	// staleness. A staleness failure is reported as a VersionStaleError, which also carries the most recent version.
+	// If the chunk does not exist, returns an error matching ErrNotFound. If this fails for any reason, there must be no visible change to
 	// the underlying data. If this fails for a reason besides staleness, the version must be zero.
 	Write(ref ChunkNum, offset uint32, version Version, data []byte) (Version, error)
 
+	// Append data to the end of the valid data in a chunk, which is the end of the furthest write or append so far, and
+	// return the offset the data was placed at along with the new version. Unlike a write, an append is never rejected
+	// for being stale, so concurrent appenders don't have to retry: each one lands after the others, in whichever order
+	// they commit. offset + len(data) cannot exceed MaxChunkSize, which fails with an error matching ErrChunkTooLarge.
+	// If the chunk does not exist, returns an error matching ErrNotFound.
+	Append(ref ChunkNum, data []byte) (uint32, Version, error)
+
 	// Destroy a chunk, given a specific version number. Version checking works the same as for Write.
-	// If the chunk does not exist, returns an error.
+	// If the chunk does not exist, returns an error matching ErrNotFound.
 	Delete(ref ChunkNum, version Version) error
 
 	// Close all connections used by this client.
 	Close() error
 }
+
+// Settings chosen for a chunk when it is allocated. The zero value takes the cluster's defaults.
+type NewOptions struct {
+	// How many replicas the chunk is kept on, which is also how many the replicator restores it to after losing some.
+	// Zero means the cluster-wide default; see EtcdInterface.ReadReplicationFactor.
+	ReplicationFactor int
+	// Who can access the chunk; no ACL if left empty. Its owner must be whoever allocates the chunk. See ACL.
+	ACL ACL
+}
+
+// The most replicas that a metadata entry can record a replication factor for.
+const MaxReplicationFactor = 255
+
+// Read, Write, and Delete all report a chunk that has been deleted with an error matching ErrChunkDeleted, which also
+// matches ErrNotFound. Until its chunk number is handed out again by New, a deleted chunk stays distinguishable from one
+// that never existed.
+
+// What is known about a chunk and each of its replicas, for finding replicas that have fallen behind or lost data.
+type ChunkStatus struct {
+	Chunk               ChunkNum
+	MostRecentVersion   Version
+	LastConsumedVersion Version
+	Replicas            []ReplicaStatus
+}
+
+type ReplicaStatus struct {
+	ID      ServerID
+	Address ServerAddress
+	// whether the metadata entry records that this replica has not yet received MostRecentVersion
+	Lagging bool
+	// the latest version that the replica reports having, if it could be asked
+	Version Version
+	// why the replica's version could not be found, such as it being unreachable or not having the chunk at all
+	Err error
+}
+
+// The replicas that don't serve MostRecentVersion, or couldn't say which version they serve.
+func (s ChunkStatus) Diverged() []ReplicaStatus {
+	var diverged []ReplicaStatus
+	for _, replica := range s.Replicas {
+		if replica.Err != nil || replica.Version != s.MostRecentVersion {
+			diverged = append(diverged, replica)
+		}
+	}
+	return diverged
+}
@@ -0,0 +1,108 @@
+package apis
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Errors that callers may need to distinguish programmatically. These are usually wrapped with more context, so they
+// should be matched with errors.Is or errors.As rather than compared directly.
+var (
+	// The chunk, chunk version, or metadata entry does not exist.
+	ErrNotFound = errors.New("not found")
+	// The version passed to an operation was not the latest version. Errors carrying the latest version are
+	// represented as VersionStaleError, which matches this.
+	ErrVersionStale = errors.New("version is stale")
+	// The offset and length of a request extend past MaxChunkSize.
+	ErrChunkTooLarge = errors.New("request extends past the maximum chunk size")
+	// The chunk or chunk version already exists, and cannot be created again.
+	ErrAlreadyExists = errors.New("already exists")
+	// The chunk is in the process of being deleted, and cannot be used.
+	ErrBeingDeleted = errors.New("chunk is being deleted")
+	// Another holder of a read lock is already upgrading it to a write lock, so upgrading this one as well would
+	// deadlock. Release the read lock and acquire it again to wait for the other writer to finish.
+	ErrLockContended = errors.New("lock access contended")
+	// The chunk's ACL does not permit the caller to access it in the way that the request asked for; see ACL.
+	ErrPermissionDenied = errors.New("permission denied")
+	// The request never received a response, because the server could not be reached. The server may or may not have
+	// acted on it.
+	ErrUnreachable = errors.New("server unreachable")
+	// The requested version of a chunk was superseded or deleted, and its data has since been reclaimed.
+	ErrVersionReclaimed = errors.New("version has been reclaimed")
+	// The request was not sent, because too many other requests to the same server were already in progress, or, as a
+	// RetryAfterError, the server refused it for the same reason.
+	ErrBusy = errors.New("too many requests in progress")
+	// The chunkserver is already holding as much uncommitted write data as it allows, for the chunk or in total. The
+	// write can be tried again once earlier ones have been committed or have expired.
+	ErrStagingFull = errors.New("too much write data staged")
+	// Another writer holds a write lease on the chunk, so it cannot be changed except by that writer until the lease is
+	// released or expires.
+	ErrLeaseHeld = errors.New("chunk is leased by another writer")
+	// The write lease named by the request is no longer held, because it expired or was released. Once it has expired,
+	// another writer may have changed the chunk, so the holder has to acquire a new lease and check the chunk again.
+	ErrLeaseLost = errors.New("write lease is no longer held")
+	// Chunk data did not match the checksum sent along with it, so it was damaged somewhere between where the checksum
+	// was taken and where it was checked. The data is discarded; reading it from another replica, or sending the write
+	// again, may succeed.
+	ErrChecksumMismatch = errors.New("data does not match its checksum")
+)
+
+// The chunk existed, but has since been deleted. Unlike a stale version, this is never worth retrying. It also matches
+// ErrNotFound, for callers that only care whether the chunk exists.
+var ErrChunkDeleted error = chunkDeletedError{}
+
+type chunkDeletedError struct{}
+
+func (chunkDeletedError) Error() string {
+	return "chunk has been deleted"
+}
+
+func (chunkDeletedError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// Returned when an operation is rejected because its version did not match. Current is the latest version, which can
+// be used to retry the operation.
+type VersionStaleError struct {
+	Current Version
+}
+
+func (e VersionStaleError) Error() string {
+	return fmt.Sprintf("version is stale: latest version is %d", e.Current)
+}
+
+func (e VersionStaleError) Is(target error) bool {
+	return target == ErrVersionStale
+}
+
+// Returned by a server that refuses a request because it doesn't have room for it right now, such as a chunkserver
+// that is already holding as much write data as it allows, instead of taking it on and falling further behind. The
+// request was not acted on, so it can be sent again once RetryAfter has passed. Err says what the server ran out of
+// room for, such as ErrStagingFull, and is matched through errors.Is, as is ErrBusy.
+type RetryAfterError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e RetryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %v)", e.Err, e.RetryAfter)
+}
+
+func (e RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+func (e RetryAfterError) Is(target error) bool {
+	return target == ErrBusy
+}
+
+// Returned by a MetadataCache when another server holds the metadata block in question, so the request should be
+// redirected to Owner.
+type ErrOwnerRedirect struct {
+	Owner ServerName
+}
+
+func (e ErrOwnerRedirect) Error() string {
+	return fmt.Sprintf("metadata block is owned by another server: %s", e.Owner)
+}
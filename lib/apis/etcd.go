@@ -20,6 +20,42 @@ const (
 	CHUNKSERVER   ServerType = iota
 )
 
+// Where a server is, for the sake of keeping the replicas of a chunk from all being lost to the same failure. Servers in
+// the same rack are expected to fail together, and so are racks in the same zone; rack names only need to be unique
+// within their zone. Servers that leave a label empty are treated as sharing one unknown zone or rack.
+type FailureDomain struct {
+	Zone string `json:"zone" yaml:"zone"`
+	Rack string `json:"rack" yaml:"rack"`
+}
+
+// How much a chunkserver is storing and how much more it has room for, as it last reported to etcd. Servers that never
+// reported have a capacity of all zeroes, which is treated as unknown rather than full.
+type ServerCapacity struct {
+	// Free space available to the chunkserver's storage, in bytes.
+	FreeBytes uint64 `json:"free-bytes"`
+	// Total size of the chunkserver's storage, in bytes, or zero if the storage cannot say.
+	TotalBytes uint64 `json:"total-bytes"`
+	// The number of chunks the chunkserver holds a replica of.
+	Chunks uint64 `json:"chunks"`
+}
+
+// Reports whether the chunkserver said how large its storage is, so that its free space means something.
+func (c ServerCapacity) Known() bool {
+	return c.TotalBytes > 0
+}
+
+// The fraction of the chunkserver's storage that is in use, between 0 and 1, or 0 if it is not known.
+func (c ServerCapacity) UsedFraction() float64 {
+	if !c.Known() || c.FreeBytes >= c.TotalBytes {
+		return 0
+	}
+	return 1 - float64(c.FreeBytes)/float64(c.TotalBytes)
+}
+
+// How long a chunkserver can go without sending a heartbeat before it is considered down, unless it is configured
+// otherwise; see EtcdInterface.Heartbeat.
+const DefaultLivenessTimeout = 10 * time.Second
+
 type EtcdInterface interface {
 	// Get the name of this server
 	GetName() ServerName
@@ -34,6 +70,25 @@ type EtcdInterface interface {
 	GetIDByName(name ServerName) (ServerID, error)
 	// Lists server names by type of server
 	ListServers(kind ServerType) ([]ServerName, error)
+	// Records the failure domain of this server, alongside its address, so that replicas can be spread across domains.
+	UpdateFailureDomain(domain FailureDomain) error
+	// Get the failure domain of a particular server by name, which is empty if it never recorded one.
+	GetFailureDomain(name ServerName) (FailureDomain, error)
+	// Records how much this server is storing and has room for, so that new replicas can be placed where there is space.
+	UpdateCapacity(capacity ServerCapacity) error
+	// Get the capacity that a particular server last recorded, which is all zeroes if it never recorded one.
+	GetCapacity(name ServerName) (ServerCapacity, error)
+	// Records that this server is alive for the next 'timeout', after which it is considered down unless it sends
+	// another heartbeat first, so it should send them several times per timeout. Servers that have never sent one are
+	// never considered down.
+	Heartbeat(timeout time.Duration) error
+	// Lists the servers that have sent heartbeats before, but whose last one has run out.
+	ListDownServers() ([]ServerName, error)
+	// Marks a chunkserver as draining, or as no longer draining. No new replicas are placed on a draining chunkserver,
+	// and the replicas it holds are moved elsewhere, so that it can be retired once it holds none.
+	SetDraining(name ServerName, draining bool) error
+	// Lists the chunkservers that are draining.
+	ListDraining() ([]ServerName, error)
 
 	// Prepares this interface to accept claims for metadata
 	BeginMetadataLease() error
@@ -44,12 +99,21 @@ type EtcdInterface interface {
 	TryClaimingMetadata(blockid MetadataID) (owner ServerName, err error)
 	// Assuming that this server owns a particular block of metadata, release that metadata back out into the wild.
 	DisclaimMetadata(blockid MetadataID) error
+	// Takes over the claim on a particular block of metadata from the server 'from', which must currently hold it.
+	TransferMetadataClaim(blockid MetadataID, from ServerName) error
 	// Claim some unclaimed metametablock. If everything that exists is claimed, return 0 and no error.
 	LeaseAnyMetametadata() (MetadataID, error)
 	// Lists the MetadataIDs of every metadata block that exists
 	ListAllMetaIDs() ([]MetadataID, error)
 	// Renew the claim on all metadata blocks
 	RenewMetadataClaims() error
+	// Adds this server to the ring of metadata caches, for as long as its metadata lease lasts. Requires
+	// BeginMetadataLease to have been called.
+	JoinMetadataRing() error
+	// Removes this server from the ring of metadata caches, if it was a member.
+	LeaveMetadataRing() error
+	// Lists the members of the ring of metadata caches; see MetadataRing.
+	ListMetadataRing() ([]ServerName, error)
 
 	// Get metametadata for a metadata block; only allowed if this server has a current claim on the block
 	GetMetametadata(blockid MetadataID) (MetadataEntry, error)
@@ -66,6 +130,12 @@ type EtcdInterface interface {
 	// Reads the filesystem root chunk number, or 0 if nonexistent
 	ReadFSRoot() (ChunkNum, error)
 
+	// Sets how many replicas new chunks are placed on when they don't ask for a particular number; 0 clears the setting.
+	WriteReplicationFactor(replicas int) error
+
+	// Reads the cluster-wide replication factor, or 0 if it has never been set, in which case frontends use their own.
+	ReadReplicationFactor() (int, error)
+
 	// tear down this connection
 	Close() error
 }
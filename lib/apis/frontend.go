@@ -12,19 +12,61 @@ type CommitHash string
 type Frontend interface {
 	// Allocates a new chunk, all zeroed out. The version number will be zero, so the only way to access it initially is
 	// with a version of AnyVersion.
-	// If this chunk isn't written to before the connection to the server closes, the empty chunk will be deleted.
+	// If this chunk is never written to, it is deleted through DeleteIncomplete, or by garbage collection once it has been
+	// left unwritten for long enough.
 	New() (ChunkNum, error)
 
+	// Like New, but with the replication factor, and anything else that can be chosen per chunk, taken from 'options'.
+	NewWithOptions(options NewOptions) (ChunkNum, error)
+
+	// Like New, but allocates 'count' chunks at once, each with its own set of replicas, so that a client creating many
+	// chunks only needs a single round trip. 'count' must be between 1 and MaxBatchSize. Either every chunk is
+	// allocated, or none of them are.
+	AllocateChunks(count int) ([]ChunkNum, error)
+
 	// Reads the metadata entry of a particular chunk.
 	ReadMetadataEntry(chunk ChunkNum) (Version, []ServerAddress, error)
 
+	// Reads the whole metadata entry of a particular chunk, including any replicas that are lagging behind, and the
+	// address of each replica in the same order as entry.Replicas. This is for diagnosing problems with a chunk;
+	// accessing it should go through ReadMetadataEntry.
+	ReadFullMetadataEntry(chunk ChunkNum) (MetadataEntry, []ServerAddress, error)
+
 	// Writes metadata for a particular chunk, after each chunkserver has received a preparation message for this write.
 	// Only performs the write if the version matches, or the version is AnyVersion.
 	CommitWrite(chunk ChunkNum, version Version, hash CommitHash) (Version, error)
 
+	// Commits an append, after each chunkserver has received it through StartAppend, against whichever version of the
+	// chunk is current, so that it never fails for being stale. Returns the new version, along with the offset that the
+	// data was placed at.
+	CommitAppend(chunk ChunkNum, hash CommitHash) (Version, uint32, error)
+
 	// Destroys an old chunk, assuming that the metadata version matches. This includes sending messages to all relevant
 	// chunkservers.
 	Delete(chunk ChunkNum, version Version) error
+
+	// Destroys a chunk that was allocated by New but has never been written to, so that its chunk number can be handed
+	// out again. Fails with an error matching ErrVersionStale if the chunk has been written to, or a write to it is in
+	// progress, in which case the chunk is left alone.
+	DeleteIncomplete(chunk ChunkNum) error
+
+	// Acquires a write lease on a chunk, which lasts for WriteLeaseDuration unless it is renewed. Until the lease is
+	// released or expires, every write, append, or delete of the chunk except for CommitLeasedWrite with this lease fails
+	// with an error matching ErrLeaseHeld. Fails with an error matching ErrLeaseHeld if another writer holds a lease.
+	AcquireWriteLease(chunk ChunkNum) (LeaseID, error)
+
+	// Extends a write lease to WriteLeaseDuration from now. Fails with an error matching ErrLeaseLost if the lease has
+	// already expired or been released.
+	RenewWriteLease(chunk ChunkNum, lease LeaseID) error
+
+	// Gives up a write lease, so that others can change the chunk again. Releasing a lease that has already expired or
+	// been released succeeds without doing anything.
+	ReleaseWriteLease(chunk ChunkNum, lease LeaseID) error
+
+	// Like CommitWrite, but on behalf of the holder of a write lease, and committed against whichever version is current,
+	// since nobody else can have changed the chunk while the lease was held. Fails with an error matching ErrLeaseLost if
+	// the lease has expired or been released.
+	CommitLeasedWrite(chunk ChunkNum, lease LeaseID, hash CommitHash) (Version, error)
 }
 
 // Calculates a hash of a write. This is used to ensure that the same data has been replicated to all chunkservers,
@@ -34,3 +76,11 @@ func CalculateCommitHash(offset uint32, data []byte) CommitHash {
 	hashArray := sha256.Sum256([]byte(hashInput))
 	return CommitHash(hex.EncodeToString(hashArray[:]))
 }
+
+// Calculates a hash of an append, which unlike a write has no offset until it is committed. This never matches the hash
+// of a write.
+func CalculateAppendHash(data []byte) CommitHash {
+	hashInput := fmt.Sprintf("append %d %s", len(data), string(data))
+	hashArray := sha256.Sum256([]byte(hashInput))
+	return CommitHash(hex.EncodeToString(hashArray[:]))
+}
@@ -0,0 +1,35 @@
+package apis
+
+// Whether one of the things a server depends on is usable, as reported by its readiness endpoint.
+type DependencyStatus struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	// why the dependency isn't usable; empty if it is
+	Error string `json:"error,omitempty"`
+}
+
+// Implemented by servers that can check the things they depend on, such as their storage or etcd, so that they are only
+// sent requests once those are usable. Servers that don't implement this are ready as soon as they are running.
+type HealthChecker interface {
+	CheckHealth() []DependencyStatus
+}
+
+// What a server's liveness and readiness endpoints respond with, as JSON.
+type HealthReport struct {
+	// HealthOK, or HealthUnavailable if any of the dependencies isn't usable.
+	Status string `json:"status"`
+	// which kind of server this is, such as "chunkserver"
+	Role         string             `json:"role"`
+	Dependencies []DependencyStatus `json:"dependencies,omitempty"`
+}
+
+const HealthOK = "ok"
+const HealthUnavailable = "unavailable"
+
+// Builds the status of a dependency from the error its check returned, if any.
+func CheckDependency(name string, err error) DependencyStatus {
+	if err != nil {
+		return DependencyStatus{Name: name, Error: err.Error()}
+	}
+	return DependencyStatus{Name: name, Healthy: true}
+}
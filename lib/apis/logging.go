@@ -0,0 +1,66 @@
+package apis
+
+import (
+	"fmt"
+	"log"
+)
+
+// How much attention a log message deserves.
+type LogLevel uint8
+
+const (
+	// Details of normal operation, such as requests that had to be retried.
+	DEBUG LogLevel = iota
+	// Notable events that need no action, such as data being reclaimed.
+	INFO LogLevel = iota
+	// Problems that were worked around, but may need attention if they persist.
+	WARN LogLevel = iota
+	// Failures that could not be handled.
+	ERROR LogLevel = iota
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case DEBUG:
+		return "DEBUG"
+	case INFO:
+		return "INFO"
+	case WARN:
+		return "WARN"
+	case ERROR:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LogLevel(%d)", l)
+	}
+}
+
+// Where the cluster components send their diagnostic messages. Must be safe to use from multiple goroutines.
+type Logger interface {
+	Logf(level LogLevel, format string, args ...interface{})
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Logf(LogLevel, string, ...interface{}) {}
+
+// Discards every message. Components use this when they aren't given a Logger.
+var NoopLogger Logger = noopLogger{}
+
+type standardLogger struct {
+	out     *log.Logger
+	minimum LogLevel
+}
+
+// Writes messages at 'minimum' or above to 'out', prefixed with their level.
+func NewStandardLogger(out *log.Logger, minimum LogLevel) Logger {
+	return standardLogger{
+		out:     out,
+		minimum: minimum,
+	}
+}
+
+func (s standardLogger) Logf(level LogLevel, format string, args ...interface{}) {
+	if level >= s.minimum {
+		s.out.Printf("[%v] %s", level, fmt.Sprintf(format, args...))
+	}
+}
@@ -1,5 +1,7 @@
 package apis
 
+import "time"
+
 // Note: the metadata chunk for metadata block N is stored in chunk N
 // Note: this means that there is NO METADATA BLOCK for 0! because that would be metametadata, which is stored in etcd.
 type MetadataID uint64
@@ -12,6 +14,61 @@ type MetadataEntry struct {
 	MostRecentVersion   Version
 	LastConsumedVersion Version
 	Replicas            []ServerID
+	// the subset of Replicas that have not yet confirmed MostRecentVersion, because a write completed on a quorum of
+	// replicas without them. Reads are not routed to these replicas until they catch up.
+	Lagging []ServerID
+	// who can access the chunk, as chosen when it was allocated; see NewOptions
+	ACL ACL
+	// Only set on the tombstone a metadata cache leaves in place of an entry once its chunk has been deleted, which is
+	// what lets it report ErrChunkDeleted rather than ErrNotFound. Tombstones are never returned as entries.
+	Deleted bool
+	// the write lease on the chunk, if anyone has been granted one; see Frontend.AcquireWriteLease
+	Lease WriteLease
+	// how many replicas the chunk should be kept on, as chosen when it was allocated; see NewOptions. Zero for chunks
+	// allocated before this was recorded, which are kept at the replicator's minimum.
+	ReplicationFactor uint8
+}
+
+// Identifies the holder of a write lease. Lease IDs are chosen at random when a lease is granted, so only the holder
+// knows its own.
+type LeaseID uint64
+
+// The holder of a lease that has never been granted, or has been released.
+const NoLease LeaseID = 0
+
+// How long a write lease lasts without being renewed.
+//
+// Expiry times are set by the clock of the frontend that grants or renews a lease, and checked by the clock of whichever
+// frontend handles a later request, so the servers' clocks must agree to well within this; a holder should renew its
+// lease well before it runs out.
+const WriteLeaseDuration = 10 * time.Second
+
+// A write lease on a chunk, as recorded in its metadata entry. While the lease is held, only its holder can change the
+// chunk, which lets it commit a sequence of writes without racing anyone else for versions.
+type WriteLease struct {
+	Holder LeaseID
+	// when the lease runs out unless it is renewed, in Unix nanoseconds
+	Expiry int64
+}
+
+// Whether the lease is in force at 'now': it has been granted, and has not yet expired or been released.
+func (l WriteLease) HeldAt(now time.Time) bool {
+	return l.Holder != NoLease && now.UnixNano() < l.Expiry
+}
+
+// The replicas that are known to hold MostRecentVersion.
+func (me MetadataEntry) Confirmed() []ServerID {
+	var confirmed []ServerID
+	for _, replica := range me.Replicas {
+		lagging := false
+		for _, laggard := range me.Lagging {
+			lagging = lagging || laggard == replica
+		}
+		if !lagging {
+			confirmed = append(confirmed, replica)
+		}
+	}
+	return confirmed
 }
 
 func (me MetadataEntry) Equals(other MetadataEntry) bool {
@@ -29,6 +86,26 @@ func (me MetadataEntry) Equals(other MetadataEntry) bool {
 			return false
 		}
 	}
+	if !me.ACL.Equals(other.ACL) {
+		return false
+	}
+	if me.Deleted != other.Deleted {
+		return false
+	}
+	if me.Lease != other.Lease {
+		return false
+	}
+	if me.ReplicationFactor != other.ReplicationFactor {
+		return false
+	}
+	if len(me.Lagging) != len(other.Lagging) {
+		return false
+	}
+	for i, myLaggard := range me.Lagging {
+		if other.Lagging[i] != myLaggard {
+			return false
+		}
+	}
 	return true
 }
 
@@ -45,6 +122,40 @@ const BitsetSize = 4096
 // trying again on another server.
 const NoRedirect = ""
 
+// How effective a metadata cache has been, as reported by MetadataCache.Stats. The counts are since the cache started.
+type MetadataCacheStats struct {
+	// lookups of metadata blocks that the cache already had loaded
+	Hits uint64
+	// lookups of metadata blocks that had to be loaded from the chunkservers first
+	Misses uint64
+	// requests that were redirected to another cache, since it holds the lease on the block
+	Redirects uint64
+	// how many times the cache lost all of its leases, by failing to renew them in time
+	LeaseExpirations uint64
+	// the metadata blocks that the cache holds the lease on now, and the entries that are allocated in them
+	OwnedBlocks  uint64
+	OwnedEntries uint64
+}
+
+// The most chunks that a single batched metadata request can cover.
+const MaxBatchSize = 1024
+
+// One of the updates made by MetadataCache.BatchUpdateEntry.
+type EntryUpdate struct {
+	Chunk    ChunkNum
+	Previous MetadataEntry
+	Next     MetadataEntry
+}
+
+// The outcome for one chunk of a batched metadata request. If Err is set, the request failed for that chunk, and Owner
+// is set as it would have been by the same request on its own.
+type EntryResult struct {
+	// only set by BatchReadEntry
+	Entry MetadataEntry
+	Owner ServerName
+	Err   error
+}
+
 type MetadataCache interface {
 	// Allocate a new metadata entry and corresponding chunk number
 	NewEntry() (ChunkNum, error)
@@ -57,4 +168,15 @@ type MetadataCache interface {
 	// Delete a metadata entry and allow the garbage collection of the underlying chunks
 	// If another server holds the lease on the metametadata the entry belongs to, returns its name
 	DeleteEntry(chunk ChunkNum, previousEntry MetadataEntry) (ServerName, error)
+	// Takes over the lease on a metadata block from the metadata cache 'from', which is handing it off, and holds back
+	// requests for the block until this returns. Fails if 'from' does not hold the lease.
+	AcceptHandoff(block MetadataID, from ServerName) error
+	// Reports how effective the cache has been; see MetadataCacheStats.
+	Stats() (MetadataCacheStats, error)
+	// Like ReadEntry, for up to MaxBatchSize chunks at once. Returns a result for each chunk, in the same order, which
+	// succeeds or fails on its own; the error is only for the batch as a whole.
+	BatchReadEntry(chunks []ChunkNum) ([]EntryResult, error)
+	// Like UpdateEntry, for up to MaxBatchSize updates at once, which are made in order. Returns a result for each
+	// update, in the same order, which succeeds or fails on its own; the error is only for the batch as a whole.
+	BatchUpdateEntry(updates []EntryUpdate) ([]EntryResult, error)
 }
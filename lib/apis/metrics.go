@@ -0,0 +1,19 @@
+package apis
+
+// A single value that a server reports about its own state, such as how many chunks it holds, each time its metrics are
+// collected.
+type Measurement struct {
+	// a Prometheus metric name, such as "zircon_chunkserver_chunks"
+	Name string
+	// a description of what is measured, shared by every measurement with the same name
+	Help string
+	// distinguishes measurements with the same name from each other; may be nil
+	Labels map[string]string
+	Value  float64
+}
+
+// Implemented by servers that can report on their own state, such as their chunk counts or storage use, alongside the
+// metrics collected for every server about the RPCs it serves.
+type MetricsReporter interface {
+	ReportMetrics() []Measurement
+}
@@ -0,0 +1,94 @@
+package apis
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+// Explanation of the metadata ring:
+//     Every metadata cache that is running is a member of a consistent-hash ring, kept in etcd, which places each cache
+//     at RingPoints points around a circle of 64-bit hashes. Each metadata block hashes to a point on the same circle,
+//     and its likely owner is the member at the first point after it. Since every client can build the same ring from
+//     the same members, frontends send requests straight to the likely owner, rather than to their local cache and
+//     then wherever it redirects them. When a cache joins or leaves the ring, only the blocks next to its own points
+//     change hands, which is about 1/n of them for n caches.
+//     The ring is only advice: leases still decide who actually owns a block, and a cache that is asked about a block
+//     owned by another redirects the request as before. But since a request for a block that nobody holds goes to its
+//     likely owner first, which then claims it, blocks come to be owned as the ring says whenever their owners go away.
+
+// How many points each metadata cache has on the ring. More points spread blocks more evenly between caches.
+const RingPoints = 64
+
+// How long a client keeps using a ring it read from etcd before reading it again.
+const RingRefreshInterval = time.Second
+
+type ringPoint struct {
+	hash   uint64
+	member ServerName
+}
+
+// A consistent-hash ring over the metadata caches, for finding the likely owner of a metadata block.
+type MetadataRing struct {
+	points []ringPoint
+}
+
+// Builds the ring for a set of metadata caches. Every client that builds a ring from the same members gets the same
+// ring, whatever order they are listed in.
+func NewMetadataRing(members []ServerName) *MetadataRing {
+	ring := &MetadataRing{}
+	for _, member := range members {
+		for i := 0; i < RingPoints; i++ {
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(member))
+			var index [4]byte
+			binary.LittleEndian.PutUint32(index[:], uint32(i))
+			_, _ = h.Write(index[:])
+			ring.points = append(ring.points, ringPoint{hash: mix(h.Sum64()), member: member})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		if ring.points[i].hash != ring.points[j].hash {
+			return ring.points[i].hash < ring.points[j].hash
+		}
+		return ring.points[i].member < ring.points[j].member
+	})
+	return ring
+}
+
+// Spreads out hashes of similar inputs, since consecutive block IDs would otherwise land next to each other.
+func mix(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Reports whether the ring has no members.
+func (r *MetadataRing) Empty() bool {
+	return len(r.points) == 0
+}
+
+// Finds the likely owner of a metadata block, or NoRedirect if the ring is empty.
+func (r *MetadataRing) BlockOwner(block MetadataID) ServerName {
+	if len(r.points) == 0 {
+		return NoRedirect
+	}
+	hash := mix(uint64(block))
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+	if i == len(r.points) {
+		// wrap around the circle
+		i = 0
+	}
+	return r.points[i].member
+}
+
+// Finds the likely owner of the metadata block that holds a chunk's entry, or NoRedirect if the ring is empty.
+func (r *MetadataRing) Owner(chunk ChunkNum) ServerName {
+	return r.BlockOwner(MetadataID(chunk >> EntriesPerBlock))
+}
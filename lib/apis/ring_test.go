@@ -0,0 +1,35 @@
+package apis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Tests that the ring doesn't depend on the order of its members, spreads blocks between them, and only moves the
+// blocks of a member that leaves.
+func TestMetadataRing(t *testing.T) {
+	assert.Equal(t, ServerName(NoRedirect), NewMetadataRing(nil).BlockOwner(1))
+
+	ring := NewMetadataRing([]ServerName{"mc0", "mc1", "mc2"})
+	reordered := NewMetadataRing([]ServerName{"mc2", "mc0", "mc1"})
+	shrunk := NewMetadataRing([]ServerName{"mc0", "mc2"})
+
+	counts := map[ServerName]int{}
+	for block := MetadataID(1); block <= 3000; block++ {
+		owner := ring.BlockOwner(block)
+		counts[owner]++
+		assert.Equal(t, owner, reordered.BlockOwner(block))
+		if owner != "mc1" {
+			assert.Equal(t, owner, shrunk.BlockOwner(block))
+		} else {
+			assert.NotEqual(t, ServerName("mc1"), shrunk.BlockOwner(block))
+		}
+	}
+	assert.Equal(t, 3, len(counts))
+	for _, count := range counts {
+		assert.True(t, count > 500, "uneven ring: %v", counts)
+	}
+
+	chunk := ChunkNum(7<<EntriesPerBlock | 12)
+	assert.Equal(t, ring.BlockOwner(7), ring.Owner(chunk))
+}
@@ -1,7 +1,26 @@
 package apis
 
+import (
+	"math"
+	"time"
+)
+
 type SyncID uint64
 
+// Identifies the most recent release of a write lock on a chunk, as reported by AwaitRelease.
+type SyncRevision uint64
+
+// A revision that never identifies a real release, so that passing it to AwaitRelease returns the current revision
+// right away.
+const UnknownRevision SyncRevision = math.MaxUint64
+
+// Identifies an advisory lock taken through AcquireLock.
+type LockID uint64
+
+// How long an advisory lock outlives its last renewal. A holder that stops renewing its lock, such as one that crashed,
+// loses it once this much time has passed.
+const AdvisoryLockTimeout = 2 * time.Second
+
 // syncserver methods that are the same in etcd and from the client's perspective
 type SyncServerDirect interface {
 	// Acquires a read lock on a certain chunk
@@ -15,6 +34,23 @@ type SyncServerDirect interface {
 
 	// Confirms that a sync is still valid -- remember that this has race conditions; avoid its usage
 	ConfirmSync(s SyncID) (write bool, err error)
+
+	// Waits for a write lock on a chunk to be released, so that whatever was changed under it can be noticed without
+	// polling. Returns the revision of the latest release right away if it is not 'seen'; otherwise waits for a newer
+	// one, but gives up after a while and returns 'seen' again, so callers should loop.
+	AwaitRelease(chunk ChunkNum, seen SyncRevision) (SyncRevision, error)
+
+	// Acquires an advisory lock on a chunk, which only excludes other advisory locks, not reads or writes. Any number of
+	// shared locks can be held at once, but an exclusive lock can only be held alone. Waits for conflicting locks that
+	// were requested earlier, but gives up after a while with ErrLockContended, so callers should loop. The lock lasts
+	// for AdvisoryLockTimeout after it is acquired or renewed, unless it is released sooner.
+	AcquireLock(chunk ChunkNum, exclusive bool) (LockID, error)
+
+	// Extends an advisory lock to AdvisoryLockTimeout from now. Fails if the lock has already been lost.
+	RenewLock(lock LockID) error
+
+	// Releases an advisory lock, so that whoever is waiting on it can acquire theirs.
+	ReleaseLock(lock LockID) error
 }
 
 // TODO: we can probably associate some metadata with acquired locks, so that a server can recover its previous operations
@@ -0,0 +1,176 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	"zircon/lib/apis"
+	"zircon/lib/rpc"
+)
+
+// Explanation of auditing:
+//     Operations that change what is stored are recorded in an audit log, one Event for each, saying who did it, what
+//     they did, when, and whether it worked. Operations are recorded once they have finished, whether or not they
+//     succeeded, so that attempts that are refused, such as for want of permission, are recorded too. There are two
+//     places to record them:
+//         frontend.NewAuditedFrontend  records the allocation, committed writes and deletion of chunks, as done by the
+//                                      client that made the call; see CallerOf
+//         filesystem.NewAuditedFilesystem  records renaming and removing files and directories, as done by the user
+//                                          the filesystem is used on behalf of; see filesystem.AsUser
+//     Each event is written to every sink that the Log was opened with, in the order that the events happened, and
+//     the operation doesn't return until they have been. A sink that fails doesn't fail the operation, since it has
+//     already been done by then, but the failure is reported to the Log's logger, so that a log with a gap in it
+//     doesn't go unnoticed.
+
+// One operation, as recorded in an audit log.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Who did it: the client that made the call to a frontend, as given by CallerOf, or the user that a filesystem was
+	// used on behalf of. Empty if it isn't known.
+	Actor string `json:"actor"`
+	// What was done, named after the method that did it, such as "CommitWrite" or "Rename".
+	Operation string `json:"operation"`
+	// What it was done to: a chunk, and for writes and deletions, its version after or before, or one or two paths.
+	Chunk   apis.ChunkNum `json:"chunk,omitempty"`
+	Version apis.Version  `json:"version,omitempty"`
+	Path    string        `json:"path,omitempty"`
+	Dest    string        `json:"dest,omitempty"`
+	// Why it failed, or empty if it succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// Somewhere that events are kept. Sinks are only used by one goroutine at a time.
+type Sink interface {
+	Write(event Event) error
+	Close() error
+}
+
+// Writes events to a set of sinks.
+type Log struct {
+	logger apis.Logger
+
+	mu    sync.Mutex
+	sinks []Sink
+}
+
+// Makes a log that writes every event to each of 'sinks', and reports sinks that fail to 'logger'.
+func NewLog(logger apis.Logger, sinks ...Sink) *Log {
+	return &Log{logger: logger, sinks: sinks}
+}
+
+// Fills in when the event happened, and writes it to every sink.
+func (l *Log) Record(event Event) {
+	event.Time = time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, sink := range l.sinks {
+		if err := sink.Write(event); err != nil {
+			l.logger.Logf(apis.ERROR, "cannot write %s of %s to audit log: %v", event.Operation, event.Actor, err)
+		}
+	}
+}
+
+// Closes every sink, and returns the first error that any of them closed with.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var first error
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	l.sinks = nil
+	return first
+}
+
+// Where a daemon's audit log is kept, as given in its configuration file. Any number of sinks can be given at once.
+// The zero value keeps no audit log.
+type Configuration struct {
+	// A file that each event is appended to, as a line of JSON.
+	File string `yaml:"file"`
+	// A syslog daemon that each event is sent to, as JSON: "local" for the one on this machine, or an address such as
+	// "udp://logs.example.com:514" or "tcp://logs.example.com:514".
+	Syslog string `yaml:"syslog"`
+	// A URL that each event is POSTed to, as JSON.
+	HTTP string `yaml:"http"`
+}
+
+// Whether any audit log is kept.
+func (config Configuration) Enabled() bool {
+	return config.File != "" || config.Syslog != "" || config.HTTP != ""
+}
+
+// Opens the sinks that 'config' asks for, and makes a log that writes to them. Sinks that later fail are reported to
+// 'logger'.
+func (config Configuration) Open(logger apis.Logger) (*Log, error) {
+	var sinks []Sink
+	closeAll := func() {
+		for _, sink := range sinks {
+			_ = sink.Close()
+		}
+	}
+	if config.File != "" {
+		sink, err := OpenFileSink(config.File)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if config.Syslog != "" {
+		sink, err := DialSyslogSink(config.Syslog)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if config.HTTP != "" {
+		sink, err := NewHTTPSink(config.HTTP)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil, errors.New("no audit log configured")
+	}
+	return NewLog(logger, sinks...), nil
+}
+
+// Describes the user that this process runs as, such as "alice@host1", for the events of tools that are run by hand.
+func LocalActor() string {
+	name := fmt.Sprintf("uid %d", os.Getuid())
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return name + "@" + host
+}
+
+// Returns who made the call that 'ctx' belongs to: the principal of the certificate that the client presented, as the
+// fingerprint that apis.Principal is, or the client's address if the server didn't verify one. Returns "" for calls
+// made within the process.
+func CallerOf(ctx context.Context) string {
+	if principal, ok := rpc.CallerPrincipal(ctx); ok && principal != apis.Anonymous {
+		return fmt.Sprintf("%016x", uint64(principal))
+	}
+	return rpc.CallerAddress(ctx)
+}
+
+// Returns the text of an error for an Event, which is empty if there was no error.
+func ErrorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
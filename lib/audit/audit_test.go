@@ -0,0 +1,125 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"zircon/lib/apis"
+	"zircon/lib/logging"
+	"zircon/lib/rpc"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readEvents(t *testing.T, path string) []Event {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	var events []Event
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	require.NoError(t, scanner.Err())
+	return events
+}
+
+// Tests that events are appended to a file as lines of JSON, and that reopening it carries on after what is there.
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := Configuration{File: path}.Open(apis.NoopLogger)
+	require.NoError(t, err)
+	log.Record(Event{Actor: "10.0.0.7:4410", Operation: "CommitWrite", Chunk: 1029, Version: 4})
+	require.NoError(t, log.Close())
+
+	log, err = Configuration{File: path}.Open(apis.NoopLogger)
+	require.NoError(t, err)
+	log.Record(Event{Actor: "uid=1000 gids=[1000]", Operation: "Rename", Path: "/a", Dest: "/b", Error: "permission denied"})
+	require.NoError(t, log.Close())
+
+	events := readEvents(t, path)
+	require.Len(t, events, 2)
+	assert.Equal(t, "CommitWrite", events[0].Operation)
+	assert.Equal(t, apis.ChunkNum(1029), events[0].Chunk)
+	assert.Equal(t, apis.Version(4), events[0].Version)
+	assert.False(t, events[0].Time.IsZero())
+	assert.Equal(t, Event{Time: events[1].Time, Actor: "uid=1000 gids=[1000]", Operation: "Rename", Path: "/a", Dest: "/b",
+		Error: "permission denied"}, events[1])
+	assert.False(t, events[1].Time.Before(events[0].Time))
+}
+
+// Tests that events are POSTed to an HTTP sink, and that those it refuses are reported without keeping them from the
+// other sinks.
+func TestHTTPSink(t *testing.T) {
+	var mu sync.Mutex
+	var received []Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&event) != nil {
+			http.Error(w, "bad event", http.StatusBadRequest)
+			return
+		}
+		if event.Operation == "Delete" {
+			http.Error(w, "full", http.StatusServiceUnavailable)
+			return
+		}
+		mu.Lock()
+		received = append(received, event)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	recorder := logging.NewRecorder(10)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := Configuration{File: path, HTTP: server.URL}.Open(recorder.Wrap(apis.NoopLogger))
+	require.NoError(t, err)
+	log.Record(Event{Actor: "client", Operation: "New", Chunk: 5})
+	log.Record(Event{Actor: "client", Operation: "Delete", Chunk: 5, Version: 1})
+	require.NoError(t, log.Close())
+
+	mu.Lock()
+	require.Len(t, received, 1)
+	assert.Equal(t, "New", received[0].Operation)
+	mu.Unlock()
+	assert.Len(t, readEvents(t, path), 2)
+	records := recorder.Recent()
+	require.Len(t, records, 1)
+	assert.Contains(t, records[0].Message, "cannot write Delete of client to audit log")
+	assert.Contains(t, records[0].Message, "503")
+}
+
+// Tests that configurations that can't be opened are refused.
+func TestConfiguration(t *testing.T) {
+	assert.False(t, Configuration{}.Enabled())
+	_, err := Configuration{}.Open(apis.NoopLogger)
+	assert.Error(t, err)
+	_, err = Configuration{HTTP: "ftp://example.com/audit"}.Open(apis.NoopLogger)
+	assert.Error(t, err)
+	_, err = Configuration{Syslog: "logs.example.com:514"}.Open(apis.NoopLogger)
+	assert.Error(t, err)
+	_, err = Configuration{File: filepath.Join(t.TempDir(), "missing", "audit.log")}.Open(apis.NoopLogger)
+	assert.Error(t, err)
+}
+
+// Tests that the caller of a call is its principal when the server verified the client's certificate, and its address
+// otherwise.
+func TestCallerOf(t *testing.T) {
+	assert.Equal(t, "", CallerOf(context.Background()))
+
+	ctx := rpc.ContextWithCallerAddress(context.Background(), "10.0.0.7:4410")
+	assert.Equal(t, "10.0.0.7:4410", CallerOf(rpc.ContextWithCaller(ctx, apis.Anonymous)))
+	alice := apis.PrincipalNamed("alice")
+	assert.Equal(t, fmt.Sprintf("%016x", uint64(alice)), CallerOf(rpc.ContextWithCaller(ctx, alice)))
+}
@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// How long an HTTP sink waits for each event to be accepted.
+const HTTPTimeout = 5 * time.Second
+
+type fileSink struct {
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// Opens 'path' to append events to, as one line of JSON each, creating it if it doesn't exist. Events already in it
+// are left alone, so a daemon that restarts carries on with the same log.
+func OpenFileSink(path string) (Sink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log: %v", err)
+	}
+	return &fileSink{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (s *fileSink) Write(event Event) error {
+	return s.encoder.Encode(event)
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
+
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// Connects to the syslog daemon at 'address', which is "local" for the one on this machine, or a URL such as
+// "udp://logs.example.com:514", and sends it each event as JSON, as a notice from "zircon-audit".
+func DialSyslogSink(address string) (Sink, error) {
+	var network, host string
+	if address != "local" {
+		parsed, err := url.Parse(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid syslog address %q: %v", address, err)
+		}
+		if (parsed.Scheme != "udp" && parsed.Scheme != "tcp") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid syslog address %q: expected \"local\" or udp:// or tcp://", address)
+		}
+		network, host = parsed.Scheme, parsed.Host
+	}
+	writer, err := syslog.Dial(network, host, syslog.LOG_NOTICE|syslog.LOG_AUTHPRIV, "zircon-audit")
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to syslog: %v", err)
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) Write(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.writer.Notice(string(data))
+}
+
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
+
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+// Makes a sink that POSTs each event to 'target' as JSON, and expects a 2xx response.
+func NewHTTPSink(target string) (Sink, error) {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit URL %q: %v", target, err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid audit URL %q: expected http:// or https://", target)
+	}
+	return &httpSink{url: target, client: &http.Client{Timeout: HTTPTimeout}}, nil
+}
+
+func (s *httpSink) Write(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	response, err := s.client.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	// drained so that the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	_ = response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("audit server responded %s", response.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
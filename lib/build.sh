@@ -22,13 +22,14 @@ go get github.com/vektra/mockery/.../
 go get gopkg.in/yaml.v2
 go get github.com/coreos/etcd/clientv3
 go get github.com/hanwen/go-fuse/fuse
+go get golang.org/x/net/webdav
 
 export PATH="$GOPATH/bin:$(pwd)/protobuf/bin:$PATH"
 
 # generate twirp bindings
 
 echo "Generating twirp bindings"
-protoc --twirp_out=. --go_out=. ./zircon/lib/lib/lib/rpc/twirp/*.proto
+protoc --twirp_out=. --go_out=plugins=grpc:. ./zircon/lib/lib/lib/rpc/twirp/*.proto
 
 # generate mockery mocks
 
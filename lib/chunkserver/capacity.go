@@ -0,0 +1,48 @@
+package chunkserver
+
+import (
+	"time"
+
+	"zircon/lib/apis"
+	"zircon/lib/chunkserver/control"
+	"zircon/lib/logging"
+)
+
+// How often chunkservers report their capacity to etcd, for frontends and the replicator to place replicas by.
+const CapacityReportFreq = 30 * time.Second
+
+// Records the capacity of 'server' in etcd once, and then again every 'interval' on a background goroutine, until the
+// returned function is called. Fails without starting the goroutine if the first report cannot be made; reports that
+// fail after that are logged, and leave the last one in place until the next succeeds.
+func ReportCapacity(server control.CapacityReporter, etcd apis.EtcdInterface, interval time.Duration, logger apis.Logger) (stop func(), err error) {
+	logger = logging.Component(logger, "chunkserver")
+	report := func() error {
+		capacity, err := server.Capacity()
+		if err != nil {
+			return err
+		}
+		return etcd.UpdateCapacity(capacity)
+	}
+	if err := report(); err != nil {
+		return nil, err
+	}
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(interval):
+			}
+			if err := report(); err != nil {
+				logger.Logf(apis.WARN, "could not report chunkserver capacity: %v", err)
+			}
+		}
+	}()
+	return func() {
+		close(stopCh)
+		<-done
+	}, nil
+}
@@ -1,27 +1,99 @@
 package chunkserver
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"zircon/lib/apis"
 	"zircon/lib/rpc"
 	"zircon/lib/util"
 )
 
+// The default number of replicas that StartWriteReplicated forwards a write to at once.
+const DefaultReplicationFanOut = 4
+
 type wrapper struct {
 	Single apis.ChunkserverSingle
 	Cache  rpc.ConnectionCache
+	FanOut int
+	// reported by CheckHealth along with the health of Single; see WithChatterChecks
+	Checks []DependencyCheck
+	// the context that calls to other chunkservers are bound to; nil means context.Background()
+	ctx context.Context
 }
 
 // Supplement a basic chunkserver interface with the ability to connect to other chunkservers
 func WithChatter(server apis.ChunkserverSingle, conncache rpc.ConnectionCache) (apis.Chunkserver, error) {
-	return &wrapper{Single: server, Cache: conncache}, nil
+	return WithChatterFanOut(server, conncache, DefaultReplicationFanOut)
+}
+
+// Like WithChatter, but limits StartWriteReplicated to forwarding a write to at most fanOut replicas at once.
+func WithChatterFanOut(server apis.ChunkserverSingle, conncache rpc.ConnectionCache, fanOut int) (apis.Chunkserver, error) {
+	if fanOut < 1 {
+		return nil, fmt.Errorf("replication fan-out must be positive, not %d", fanOut)
+	}
+	return &wrapper{Single: server, Cache: conncache, FanOut: fanOut}, nil
+}
+
+// Something outside of the chunkserver itself that it needs in order to be usable, such as etcd, and how to check it.
+type DependencyCheck struct {
+	Name  string
+	Check func() error
+}
+
+// Like WithChatterFanOut, but the chunkserver's readiness endpoint also reports the result of each of 'checks', such
+// as the one returned by StartCheckedHeartbeats.
+func WithChatterChecks(server apis.ChunkserverSingle, conncache rpc.ConnectionCache, fanOut int, checks []DependencyCheck) (apis.Chunkserver, error) {
+	cs, err := WithChatterFanOut(server, conncache, fanOut)
+	if err != nil {
+		return nil, err
+	}
+	cs.(*wrapper).Checks = checks
+	return cs, nil
+}
+
+// Returns a copy of this chunkserver whose calls to other chunkservers share ctx's deadline, and fail without being sent
+// once too little of it is left.
+func (w *wrapper) WithContext(ctx context.Context) apis.Chunkserver {
+	return &wrapper{Single: w.Single, Cache: w.Cache, FanOut: w.FanOut, Checks: w.Checks, ctx: ctx}
+}
+
+func (w *wrapper) context() context.Context {
+	if w.ctx == nil {
+		return context.Background()
+	}
+	return w.ctx
+}
+
+// Reports the health of the underlying chunkserver, if it can check it, followed by that of each of Checks.
+func (w *wrapper) CheckHealth() []apis.DependencyStatus {
+	var statuses []apis.DependencyStatus
+	if checker, ok := w.Single.(apis.HealthChecker); ok {
+		statuses = checker.CheckHealth()
+	}
+	for _, dependency := range w.Checks {
+		statuses = append(statuses, apis.CheckDependency(dependency.Name, dependency.Check()))
+	}
+	return statuses
+}
+
+// Reports the metrics of the underlying chunkserver, if it has any.
+func (w *wrapper) ReportMetrics() []apis.Measurement {
+	if reporter, ok := w.Single.(apis.MetricsReporter); ok {
+		return reporter.ReportMetrics()
+	}
+	return nil
 }
 
 func (w *wrapper) ListAllChunks() ([]apis.ChunkVersion, error) {
 	return w.Single.ListAllChunks()
 }
 
+func (w *wrapper) DigestChunks(chunks []apis.ChunkNum) ([]apis.ChunkDigest, error) {
+	return w.Single.DigestChunks(chunks)
+}
+
 func (w *wrapper) Add(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version) error {
 	return w.Single.Add(chunk, initialData, initialVersion)
 }
@@ -30,10 +102,30 @@ func (w *wrapper) Delete(chunk apis.ChunkNum, version apis.Version) error {
 	return w.Single.Delete(chunk, version)
 }
 
+func (w *wrapper) Undelete(chunk apis.ChunkNum, version apis.Version) error {
+	return w.Single.Undelete(chunk, version)
+}
+
+func (w *wrapper) Pin(chunk apis.ChunkNum, version apis.Version) error {
+	return w.Single.Pin(chunk, version)
+}
+
+func (w *wrapper) Unpin(chunk apis.ChunkNum, version apis.Version) error {
+	return w.Single.Unpin(chunk, version)
+}
+
 func (w *wrapper) Read(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, error) {
 	return w.Single.Read(chunk, offset, length, minimum)
 }
 
+func (w *wrapper) ReadWithChecksum(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, apis.Checksum, error) {
+	return w.Single.ReadWithChecksum(chunk, offset, length, minimum)
+}
+
+func (w *wrapper) ReadVersion(chunk apis.ChunkNum, offset uint32, length uint32, version apis.Version) ([]byte, error) {
+	return w.Single.ReadVersion(chunk, offset, length, version)
+}
+
 func (w *wrapper) StartWrite(chunk apis.ChunkNum, offset uint32, data []byte) error {
 	return w.Single.StartWrite(chunk, offset, data)
 }
@@ -42,25 +134,65 @@ func (w *wrapper) CommitWrite(chunk apis.ChunkNum, hash apis.CommitHash, oldVers
 	return w.Single.CommitWrite(chunk, hash, oldVersion, newVersion)
 }
 
+func (w *wrapper) StartAppend(chunk apis.ChunkNum, data []byte) error {
+	return w.Single.StartAppend(chunk, data)
+}
+
+func (w *wrapper) CommitAppend(chunk apis.ChunkNum, hash apis.CommitHash, oldVersion apis.Version, newVersion apis.Version) (uint32, error) {
+	return w.Single.CommitAppend(chunk, hash, oldVersion, newVersion)
+}
+
 func (w *wrapper) UpdateLatestVersion(chunk apis.ChunkNum, oldVersion apis.Version, newVersion apis.Version) error {
 	return w.Single.UpdateLatestVersion(chunk, oldVersion, newVersion)
 }
 
 func (w *wrapper) StartWriteReplicated(chunk apis.ChunkNum, offset uint32, data []byte, replicas []apis.ServerAddress) error {
 	if err := w.Single.StartWrite(chunk, offset, data); err != nil {
-		return fmt.Errorf("[chatter.go/WSW] %v", err)
+		return fmt.Errorf("[chatter.go/WSW] %w", err)
 	}
+	// Forward the write to the replicas concurrently, at most FanOut at a time. The first failure cancels the writes
+	// that are still in flight. Any replica that has already staged the data simply lets it expire, since the write
+	// will never be committed.
+	ctx, cancel := context.WithCancel(w.context())
+	defer cancel()
+	slots := make(chan struct{}, w.FanOut)
+	failures := make(chan error, len(replicas))
+	var wg sync.WaitGroup
 	for _, replica := range replicas {
-		server, err := w.Cache.SubscribeChunkserver(replica)
-		if err != nil {
-			return fmt.Errorf("[chatter.go/CSC] %v", err)
-		}
-		err = server.StartWrite(chunk, offset, data)
-		if err != nil {
-			return fmt.Errorf("[chatter.go/SSW] %v", err)
+		slots <- struct{}{}
+		if ctx.Err() != nil {
+			// something already failed, or the caller gave up; don't bother with the rest
+			<-slots
+			if err := w.context().Err(); err != nil {
+				failures <- fmt.Errorf("[chatter.go/CE] %w", err)
+			}
+			break
 		}
+		wg.Add(1)
+		go func(replica apis.ServerAddress) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			server, err := w.Cache.SubscribeChunkserver(replica)
+			if err != nil {
+				err = fmt.Errorf("[chatter.go/CSC] %w", err)
+			} else if err = rpc.CheckBudget(ctx); err != nil {
+				err = fmt.Errorf("[chatter.go/CB] %w", err)
+			} else if err = rpc.ChunkserverWithContext(ctx, server).StartWrite(chunk, offset, data); err != nil {
+				err = fmt.Errorf("[chatter.go/SSW] %w", err)
+			}
+			if err != nil {
+				failures <- err
+				cancel()
+			}
+		}(replica)
+	}
+	wg.Wait()
+	select {
+	case err := <-failures:
+		return err
+	default:
+		return nil
 	}
-	return nil
 }
 
 func (w *wrapper) Replicate(chunk apis.ChunkNum, serverAddress apis.ServerAddress, required apis.Version) error {
@@ -68,12 +200,20 @@ func (w *wrapper) Replicate(chunk apis.ChunkNum, serverAddress apis.ServerAddres
 	if err != nil {
 		return err
 	}
-	data, version, err := w.Single.Read(chunk, 0, apis.MaxChunkSize, required)
+	// the whole chunk comes with the checksum kept from when it was written, so that a copy damaged in storage isn't
+	// spread to another replica
+	data, version, checksum, err := w.Single.ReadWithChecksum(chunk, 0, apis.MaxChunkSize, required)
 	if err != nil {
 		return err
 	}
 	if version != required {
 		return errors.New("attempt to replicate from non-primary version")
 	}
-	return server.Add(chunk, util.StripTrailingZeroes(data), version)
+	if err := apis.VerifyChecksum(data, checksum); err != nil {
+		return fmt.Errorf("[chatter.go/VRC] version %d/%d is damaged: %w", chunk, version, err)
+	}
+	if err := rpc.CheckBudget(w.context()); err != nil {
+		return err
+	}
+	return rpc.ChunkserverWithContext(w.context(), server).Add(chunk, util.StripTrailingZeroes(data), version)
 }
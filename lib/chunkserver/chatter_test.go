@@ -1,8 +1,11 @@
 package chunkserver
 
 import (
+	"context"
+	"errors"
 	testifyAssert "github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 	"zircon/apis"
 	"zircon/rpc"
 	"zircon/util"
@@ -81,3 +84,103 @@ func TestChatterStartReplicated(t *testing.T) {
 		assert.Equal("hello universe", string(util.StripTrailingZeroes(data)))
 	}
 }
+
+// A chunkserver that takes a while to stage each write, so that forwarding a write to several of these in sequence
+// would be noticeably slower than forwarding it to them all at once.
+type slowChunkserver struct {
+	apis.ChunkserverSingle
+	delay time.Duration
+}
+
+func (s slowChunkserver) StartWrite(chunk apis.ChunkNum, offset uint32, data []byte) error {
+	time.Sleep(s.delay)
+	return s.ChunkserverSingle.StartWrite(chunk, offset, data)
+}
+
+func TestChatterStartReplicatedConcurrent(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+
+	main, _, mainT := NewTestChunkserver(t, cache)
+	defer mainT()
+	assert.NoError(main.Add(73, []byte("hello world"), 2))
+
+	var addresses []apis.ServerAddress
+	for i := 0; i < 3; i++ {
+		alt, _, altT := NewTestChunkserver(t, cache)
+		defer altT()
+		assert.NoError(alt.Add(73, []byte("hello world"), 2))
+		slow, err := WithChatter(slowChunkserver{ChunkserverSingle: alt, delay: 300 * time.Millisecond}, cache)
+		assert.NoError(err)
+		teardown, address, err := rpc.PublishChunkserver(slow, ":0")
+		assert.NoError(err)
+		defer teardown(true)
+		addresses = append(addresses, address)
+	}
+
+	start := time.Now()
+	assert.NoError(main.StartWriteReplicated(73, 6, []byte("universe"), addresses))
+	assert.True(time.Since(start) < 800*time.Millisecond)
+}
+
+func TestChatterStartReplicatedFailure(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+
+	main, _, mainT := NewTestChunkserver(t, cache)
+	defer mainT()
+	assert.NoError(main.Add(73, []byte("hello world"), 2))
+
+	var addresses []apis.ServerAddress
+	for i := 0; i < 4; i++ {
+		alt, _, altT := NewTestChunkserver(t, cache)
+		defer altT()
+		// one of the replicas is missing the chunk entirely, so its StartWrite will fail
+		if i != 2 {
+			assert.NoError(alt.Add(73, []byte("hello world"), 2))
+		}
+		teardown, address, err := rpc.PublishChunkserver(alt, ":0")
+		assert.NoError(err)
+		defer teardown(true)
+		addresses = append(addresses, address)
+	}
+
+	single, err := WithChatterFanOut(main, cache, 2)
+	assert.NoError(err)
+	err = single.StartWriteReplicated(73, 6, []byte("universe"), addresses)
+	assert.True(errors.Is(err, apis.ErrNotFound))
+
+	_, err = WithChatterFanOut(main, cache, 0)
+	assert.Error(err)
+}
+
+func TestChatterChecks(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+
+	main, _, mainT := NewTestChunkserver(t, cache)
+	defer mainT()
+
+	var etcdErr error
+	checked, err := WithChatterChecks(main, cache, DefaultReplicationFanOut, []DependencyCheck{
+		{Name: "etcd", Check: func() error { return etcdErr }},
+	})
+	assert.NoError(err)
+	checker := checked.(apis.HealthChecker)
+	assert.Equal([]apis.DependencyStatus{
+		{Name: "storage", Healthy: true},
+		{Name: "staging", Healthy: true},
+		{Name: "etcd", Healthy: true},
+	}, checker.CheckHealth())
+
+	// checks are kept by copies bound to a context
+	etcdErr = errors.New("no heartbeat has reached etcd for 5s")
+	statuses := checked.(*wrapper).WithContext(context.Background()).(apis.HealthChecker).CheckHealth()
+	assert.Equal(apis.DependencyStatus{Name: "etcd", Error: "no heartbeat has reached etcd for 5s"}, statuses[2])
+}
@@ -0,0 +1,34 @@
+package control
+
+import (
+	"zircon/lib/apis"
+	"zircon/lib/chunkserver/storage"
+)
+
+// Implemented by chunkservers that can say how much they store and how much room they have left; see
+// chunkserver.ReportCapacity.
+type CapacityReporter interface {
+	Capacity() (apis.ServerCapacity, error)
+}
+
+// Measures how many chunks this chunkserver holds, and, if its storage can say, how much space it has left. Storage
+// that can't say is reported with a TotalBytes of zero, which placement treats as unknown.
+func (cs *chunkserver) Capacity() (apis.ServerCapacity, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var capacity apis.ServerCapacity
+	chunks, err := cs.Storage.ListChunksWithLatest()
+	if err != nil {
+		return capacity, err
+	}
+	capacity.Chunks = uint64(len(chunks))
+	if reporter, ok := cs.Storage.(storage.CapacityReporter); ok {
+		free, total, err := reporter.Capacity()
+		if err != nil {
+			return capacity, err
+		}
+		capacity.FreeBytes, capacity.TotalBytes = free, total
+	}
+	return capacity, nil
+}
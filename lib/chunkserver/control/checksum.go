@@ -0,0 +1,71 @@
+package control
+
+import (
+	"fmt"
+
+	"zircon/lib/apis"
+)
+
+// The chunkserver keeps the checksum of each version it writes, taken over the version as Read returns it in full:
+// padded out with zeroes to MaxChunkSize. Because it is taken before the data reaches storage, it also catches damage
+// done in storage, not just in transit. The checksums are only kept in memory; versions written before the chunkserver
+// started have theirs computed the first time they are read in full.
+// Writes are checked along the way as well: a staged write is checked against the checksum taken when it was staged
+// before it is committed, and the version it is applied to is checked against the checksum kept for it, so that a new
+// version never starts out with a fresh checksum over data that was already damaged.
+
+func wholeChunkChecksum(data []byte) apis.Checksum {
+	return apis.ExtendChecksumWithZeroes(apis.CalculateChecksum(data), int(apis.MaxChunkSize)-len(data))
+}
+
+func (cs *chunkserver) writeVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
+	if err := cs.Storage.WriteVersion(chunk, version, data); err != nil {
+		return err
+	}
+	cs.checksums[apis.ChunkVersion{Chunk: chunk, Version: version}] = wholeChunkChecksum(data)
+	return nil
+}
+
+// Reads a version from storage, and checks it against the checksum kept for it, if there is one. Must be called with mu
+// held.
+func (cs *chunkserver) readVerified(chunk apis.ChunkNum, version apis.Version) ([]byte, error) {
+	data, err := cs.Storage.ReadVersion(chunk, version)
+	if err != nil {
+		return nil, err
+	}
+	if expected, found := cs.checksums[apis.ChunkVersion{Chunk: chunk, Version: version}]; found {
+		if actual := wholeChunkChecksum(data); actual != expected {
+			return nil, fmt.Errorf("version %d/%d has checksum %08x in storage instead of %08x: %w",
+				chunk, version, actual, expected, apis.ErrChecksumMismatch)
+		}
+	}
+	return data, nil
+}
+
+func (cs *chunkserver) deleteVersion(chunk apis.ChunkNum, version apis.Version) error {
+	delete(cs.checksums, apis.ChunkVersion{Chunk: chunk, Version: version})
+	return cs.Storage.DeleteVersion(chunk, version)
+}
+
+// Like Read, but also returns a checksum of the data. For a read of the whole chunk, this is the checksum kept from when
+// the version was written; for anything less, it is the checksum of just the returned range, computed here.
+func (cs *chunkserver) ReadWithChecksum(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, apis.Checksum, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	data, version, err := cs.readLatest(chunk, offset, length, minimum)
+	if err != nil {
+		return nil, version, 0, err
+	}
+	result := sliceChunk(data, offset, length)
+	if offset != 0 || length != apis.MaxChunkSize {
+		return result, version, apis.CalculateChecksum(result), nil
+	}
+	key := apis.ChunkVersion{Chunk: chunk, Version: version}
+	checksum, found := cs.checksums[key]
+	if !found {
+		checksum = apis.CalculateChecksum(result)
+		cs.checksums[key] = checksum
+	}
+	return result, version, checksum, nil
+}
@@ -0,0 +1,61 @@
+package control
+
+import (
+	"zircon/lib/apis"
+)
+
+// Summarizes the given chunks as this chunkserver holds them. The checksum of the latest version is the one kept from
+// when it was written, if there is one; otherwise it is computed by reading the version, and kept from then on.
+func (cs *chunkserver) DigestChunks(chunks []apis.ChunkNum) ([]apis.ChunkDigest, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if err := cs.reclaimExpired(); err != nil {
+		return nil, err
+	}
+
+	latestChunks, err := cs.Storage.ListChunksWithLatest()
+	if err != nil {
+		return nil, err
+	}
+	held := map[apis.ChunkNum]bool{}
+	for _, chunk := range latestChunks {
+		held[chunk] = true
+	}
+
+	var digests []apis.ChunkDigest
+	for _, chunk := range chunks {
+		// deleted chunks that are still being retained don't count, as in ListAllChunks
+		if _, deleted := cs.deleted[chunk]; deleted || !held[chunk] {
+			continue
+		}
+		latest, err := cs.Storage.GetLatestVersion(chunk)
+		if err != nil {
+			return nil, err
+		}
+		versions, err := cs.Storage.ListVersions(chunk)
+		if err != nil {
+			return nil, err
+		}
+		digest := apis.ChunkDigest{Chunk: chunk, Latest: latest}
+		for _, version := range versions {
+			if cs.isRetained(chunk, version) || (version != latest && cs.isPinned(chunk, version)) {
+				continue
+			}
+			digest.Versions = append(digest.Versions, version)
+		}
+		key := apis.ChunkVersion{Chunk: chunk, Version: latest}
+		checksum, found := cs.checksums[key]
+		if !found {
+			data, err := cs.readVerified(chunk, latest)
+			if err != nil {
+				return nil, err
+			}
+			checksum = wholeChunkChecksum(data)
+			cs.checksums[key] = checksum
+		}
+		digest.Checksum = checksum
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
@@ -4,32 +4,144 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"zircon/lib/apis"
 	"zircon/lib/chunkserver/storage"
+	"zircon/lib/logging"
 )
 
 // a nullary function to tear down any internal state of a ChunkserverSingle instance
 type Teardown func()
 
+// How long a write staged by StartWrite is kept around waiting for CommitWrite. Writes are never explicitly abandoned,
+// such as when a replicated write fails partway through, so this is what eventually frees their data.
+const StagedWriteLifetime = time.Minute
+
+// The most write data that may be staged at once for a single chunk, and across every chunk, before StartWrite starts
+// failing with ErrStagingFull. This keeps a client that stages writes faster than it commits them from running the
+// chunkserver out of memory.
+const MaxStagedBytesPerChunk = 4 * apis.MaxChunkSize
+const MaxStagedBytes = 64 * apis.MaxChunkSize
+
+// How long writers refused with ErrStagingFull are told to wait before trying again, which the error carries as an
+// apis.RetryAfterError. Staged writes are usually committed within a round trip or two of being staged, which frees
+// their room.
+const StagingRetryAfter = 250 * time.Millisecond
+
 type commit struct {
 	Offset uint32
 	Data   []byte
+	Staged time.Time
+	// whether this was staged by StartAppend, in which case Offset is unused
+	Append bool
+	// of Data, taken when it was staged; see checksum.go
+	Checksum apis.Checksum
+}
+
+type stagedWrite struct {
+	Chunk apis.ChunkNum
+	Hash  apis.CommitHash
 }
 
 // an implementation of apis.ChunkserverSingle
 type chunkserver struct {
 	mu      sync.Mutex
 	Storage storage.ChunkStorage
-	Hashes  map[apis.CommitHash]commit
+	Hashes  map[stagedWrite]commit
+	now     func() time.Time
+
+	// the amount of data in Hashes, for each chunk and in total, and the limits on them
+	stagedPerChunk map[apis.ChunkNum]int
+	stagedTotal    int
+	maxPerChunk    int
+	maxTotal       int
+
+	// see retention.go
+	retention  time.Duration
+	superseded []retainedVersion // in the order they were retained
+	deleted    map[apis.ChunkNum]retainedVersion
+
+	// see pin.go; the number of times each version is pinned
+	pins map[apis.ChunkVersion]int
+
+	// see checksum.go
+	checksums map[apis.ChunkVersion]apis.Checksum
+
+	// see reclaim.go; nil if UpdateLatestVersion retires old versions itself
+	reclaimer *reclaimer
+
+	// see scrub.go; nil if chunks are only scrubbed on demand
+	scrubber   *scrubber
+	scrubStats ScrubStats
+
+	logger apis.Logger
 }
 
 // This includes most of the chunkserver implementation; which it exports through the ChunkserverSingle interface, based
-// on just a storage layer.
+// on just a storage layer. Data is reclaimed as soon as it is no longer needed.
 func ExposeChunkserver(storage storage.ChunkStorage) (apis.ChunkserverSingle, Teardown, error) {
+	return ExposeChunkserverWithOptions(storage, ChunkserverOptions{})
+}
+
+// How a chunkserver exposed with ExposeChunkserverWithOptions behaves. The zero value is a chunkserver like the one
+// that ExposeChunkserver returns.
+type ChunkserverOptions struct {
+	// How long versions of chunks that are superseded by UpdateLatestVersion or removed by Delete are kept before their
+	// data is reclaimed, during which they can be brought back with Undelete; see retention.go. Zero reclaims them
+	// straight away.
+	Retention time.Duration
+	// Where data that is reclaimed and staged writes that are abandoned are reported; nowhere if nil.
+	Logger apis.Logger
+	// Whether UpdateLatestVersion returns as soon as the new version is being served, leaving the versions it replaced
+	// to be retired in the background afterwards; see reclaim.go.
+	AsyncReclaim bool
+	// If positive, every chunk is scrubbed once per interval in the background; see scrub.go.
+	ScrubInterval time.Duration
+}
+
+// Like ExposeChunkserver, but takes all of the options at once, including those that can't be chosen any other way.
+func ExposeChunkserverWithOptions(storage storage.ChunkStorage, options ChunkserverOptions) (apis.ChunkserverSingle, Teardown, error) {
+	if options.Logger == nil {
+		options.Logger = apis.NoopLogger
+	}
 	cs := &chunkserver{
-		Storage: storage,
-		Hashes:  map[apis.CommitHash]commit{},
+		Storage:        storage,
+		Hashes:         map[stagedWrite]commit{},
+		stagedPerChunk: map[apis.ChunkNum]int{},
+		maxPerChunk:    MaxStagedBytesPerChunk,
+		maxTotal:       MaxStagedBytes,
+		now:            time.Now,
+		retention:      options.Retention,
+		deleted:        map[apis.ChunkNum]retainedVersion{},
+		checksums:      map[apis.ChunkVersion]apis.Checksum{},
+		pins:           map[apis.ChunkVersion]int{},
+		logger:         logging.Component(options.Logger, "chunkserver"),
+	}
+	if err := cs.reclaimOrphans(); err != nil {
+		return nil, nil, err
+	}
+	if err := cs.reclaimSuperseded(); err != nil {
+		return nil, nil, err
+	}
+	if err := cs.recoverStagedWrites(); err != nil {
+		return nil, nil, err
+	}
+	if options.AsyncReclaim {
+		cs.reclaimer = &reclaimer{
+			wake: make(chan struct{}, 1),
+			stop: make(chan struct{}),
+			done: make(chan struct{}),
+		}
+		go cs.reclaimInBackground(cs.reclaimer)
+	}
+	if options.ScrubInterval > 0 {
+		cs.scrubber = &scrubber{
+			interval: options.ScrubInterval,
+			stop:     make(chan struct{}),
+			done:     make(chan struct{}),
+		}
+		go cs.scrubInBackground(cs.scrubber)
 	}
 	// TODO: RECOVERY PROCESS
 	return cs, cs.Teardown, nil
@@ -58,15 +170,26 @@ func (cs *chunkserver) ListAllChunks() ([]apis.ChunkVersion, error) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
+	if err := cs.reclaimExpired(); err != nil {
+		return nil, err
+	}
+
 	var result []apis.ChunkVersion
 	latestChunks, err := cs.Storage.ListChunksWithLatest()
 	if err != nil {
 		return nil, err
 	}
-	existingChunks, err := cs.Storage.ListChunksWithData()
+	storedChunks, err := cs.Storage.ListChunksWithData()
 	if err != nil {
 		return nil, err
 	}
+	// deleted chunks that are still being retained don't count
+	var existingChunks []apis.ChunkNum
+	for _, chunk := range storedChunks {
+		if _, deleted := cs.deleted[chunk]; !deleted {
+			existingChunks = append(existingChunks, chunk)
+		}
+	}
 	checkInvariantSameChunks(latestChunks, existingChunks)
 	for _, chunk := range existingChunks {
 		versions, err := cs.Storage.ListVersions(chunk)
@@ -79,6 +202,9 @@ func (cs *chunkserver) ListAllChunks() ([]apis.ChunkVersion, error) {
 		}
 		foundExpected := false
 		for _, version := range versions {
+			if cs.isRetained(chunk, version) || (version != versionExpected && cs.isPinned(chunk, version)) {
+				continue
+			}
 			result = append(result, struct {
 				Chunk   apis.ChunkNum
 				Version apis.Version
@@ -98,20 +224,30 @@ func (cs *chunkserver) Add(chunk apis.ChunkNum, initialData []byte, initialVersi
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
+	if err := cs.reclaimExpired(); err != nil {
+		return err
+	}
+	// a chunk number that is being reused can't have its deleted data restored any more, even if it was pinned
+	if _, deleted := cs.deleted[chunk]; deleted {
+		if err := cs.purgeChunk(chunk); err != nil {
+			return err
+		}
+	}
+
 	versions, err := cs.Storage.ListVersions(chunk)
 	if err != nil {
 		return err
 	}
 	if len(versions) > 0 {
-		return fmt.Errorf("attempt to create duplicate chunk: %d/%d", chunk, initialVersion)
+		return fmt.Errorf("attempt to create duplicate chunk %d/%d: %w", chunk, initialVersion, apis.ErrAlreadyExists)
 	}
-	err = cs.Storage.WriteVersion(chunk, initialVersion, initialData)
+	err = cs.writeVersion(chunk, initialVersion, initialData)
 	if err != nil {
 		return err
 	}
 	err = cs.Storage.SetLatestVersion(chunk, initialVersion)
 	if err != nil {
-		err2 := cs.Storage.DeleteVersion(chunk, initialVersion)
+		err2 := cs.deleteVersion(chunk, initialVersion)
 		if err2 != nil {
 			panic("failed to be able to maintain invariant") // TODO: handle this more gracefully than crashing
 		}
@@ -128,6 +264,10 @@ func (cs *chunkserver) Delete(chunk apis.ChunkNum, version apis.Version) error {
 		return fmt.Errorf("deleted version was not positive: %d/%d", chunk, version)
 	}
 
+	if err := cs.reclaimExpired(); err != nil {
+		return err
+	}
+
 	latest, err := cs.Storage.GetLatestVersion(chunk)
 	if err != nil {
 		return err
@@ -136,23 +276,30 @@ func (cs *chunkserver) Delete(chunk apis.ChunkNum, version apis.Version) error {
 	// if we delete the latest version, we also delete everything newer... and because nothing older will exist at this
 	// point, we delete everything.
 	if latest == version {
-		versions, err := cs.Storage.ListVersions(chunk)
-		if err != nil {
-			return err
-		}
-		// mark the entire chunk as able to be deleted
-		if err := cs.Storage.DeleteLatestVersion(chunk); err != nil {
-			return err
-		}
-		// then delete all versions of the chunk
-		for _, delver := range versions {
-			if err := cs.Storage.DeleteVersion(chunk, delver); err != nil {
-				return err
-			}
-		}
-	} else {
-		// just delete the single version
-		if err := cs.Storage.DeleteVersion(chunk, version); err != nil {
+		return cs.deleteChunk(chunk, version)
+	}
+	// just delete the single version
+	return cs.retireVersion(chunk, version)
+}
+
+// Deletes a chunk whose latest version is 'latest', keeping its data around as long as it is retained or pinned. Must
+// be called with mu held.
+func (cs *chunkserver) deleteChunk(chunk apis.ChunkNum, latest apis.Version) error {
+	versions, err := cs.Storage.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	// mark the entire chunk as able to be deleted
+	if err := cs.Storage.DeleteLatestVersion(chunk); err != nil {
+		return err
+	}
+	if cs.retention > 0 || cs.hasPins(chunk) {
+		cs.deleted[chunk] = retainedVersion{Chunk: chunk, Version: latest, Until: cs.now().Add(cs.retention)}
+		return nil
+	}
+	// then delete all versions of the chunk
+	for _, delver := range versions {
+		if err := cs.deleteVersion(chunk, delver); err != nil {
 			return err
 		}
 	}
@@ -160,12 +307,21 @@ func (cs *chunkserver) Delete(chunk apis.ChunkNum, version apis.Version) error {
 }
 
 func (cs *chunkserver) Teardown() {
+	// must happen before taking mu, which the background goroutine may be waiting for
+	if cs.reclaimer != nil {
+		cs.reclaimer.shutdown()
+	}
+	if cs.scrubber != nil {
+		cs.scrubber.shutdown()
+	}
+
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
 	// wipe away any pending hashes
-	// TODO: have a way to regularly wipe away stale pending hashes
-	cs.Hashes = map[apis.CommitHash]commit{}
+	cs.Hashes = map[stagedWrite]commit{}
+	cs.stagedPerChunk = map[apis.ChunkNum]int{}
+	cs.stagedTotal = 0
 }
 
 // Given a chunk reference, read out part or all of a chunk.
@@ -180,8 +336,17 @@ func (cs *chunkserver) Read(chunk apis.ChunkNum, offset uint32, length uint32, m
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
+	data, version, err := cs.readLatest(chunk, offset, length, minimum)
+	if err != nil {
+		return nil, version, err
+	}
+	return sliceChunk(data, offset, length), version, nil
+}
+
+// Checks that a read is valid, and then reads the entire latest version of the chunk. Must be called with mu held.
+func (cs *chunkserver) readLatest(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, error) {
 	if offset+length > apis.MaxChunkSize {
-		return nil, 0, errors.New("too much data")
+		return nil, 0, apis.ErrChunkTooLarge
 	}
 
 	version, err := cs.Storage.GetLatestVersion(chunk)
@@ -189,12 +354,53 @@ func (cs *chunkserver) Read(chunk apis.ChunkNum, offset uint32, length uint32, m
 		return nil, 0, err
 	}
 	if version < minimum {
-		return nil, version, errors.New("requested newer version than was available")
+		return nil, version, fmt.Errorf("requested newer version than was available: %w", apis.VersionStaleError{Current: version})
 	}
 	data, err := cs.Storage.ReadVersion(chunk, version)
 	if err != nil {
 		return nil, version, err
 	}
+	return data, version, nil
+}
+
+// Read exactly 'version' of a chunk, which is either the latest version or one still being retained after it was
+// superseded or deleted.
+func (cs *chunkserver) ReadVersion(chunk apis.ChunkNum, offset uint32, length uint32, version apis.Version) ([]byte, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if offset+length > apis.MaxChunkSize {
+		return nil, apis.ErrChunkTooLarge
+	}
+	if err := cs.reclaimExpired(); err != nil {
+		return nil, err
+	}
+
+	latest, err := cs.Storage.GetLatestVersion(chunk)
+	if tombstone, deleted := cs.deleted[chunk]; deleted {
+		latest = tombstone.Version
+	} else if err != nil {
+		return nil, err
+	}
+	if version > latest {
+		return nil, fmt.Errorf("version %d/%d has not been written: %w", chunk, version, apis.ErrNotFound)
+	}
+	if version != latest && !cs.isRetained(chunk, version) && !cs.isPinned(chunk, version) {
+		return nil, fmt.Errorf("version %d/%d is no longer retained: %w", chunk, version, apis.ErrVersionReclaimed)
+	}
+	data, err := cs.Storage.ReadVersion(chunk, version)
+	if err != nil {
+		if version != latest && errors.Is(err, apis.ErrNotFound) {
+			// a deleted chunk retains whichever older versions it still had, which need not be all of them
+			return nil, fmt.Errorf("version %d/%d is no longer retained: %w", chunk, version, apis.ErrVersionReclaimed)
+		}
+		return nil, err
+	}
+	return sliceChunk(data, offset, length), nil
+}
+
+// Copies out 'length' bytes from 'offset' in the data of a chunk, padding with zeroes past the end of the stored data.
+func sliceChunk(data []byte, offset uint32, length uint32) []byte {
 	result := make([]byte, length)
 	realEnd := int(offset) + int(length)
 	if realEnd > len(data) {
@@ -203,7 +409,7 @@ func (cs *chunkserver) Read(chunk apis.ChunkNum, offset uint32, length uint32, m
 	if realEnd > int(offset) {
 		copy(result, data[offset:realEnd])
 	}
-	return result, version, nil
+	return result
 }
 
 // Given a chunk reference, send data to be used for a write to this chunk.
@@ -216,52 +422,148 @@ func (cs *chunkserver) StartWrite(chunk apis.ChunkNum, offset uint32, data []byt
 
 	_, err := cs.Storage.GetLatestVersion(chunk)
 	if err != nil {
-		return fmt.Errorf("[handle.go/GLV] %v", err)
+		return fmt.Errorf("[handle.go/GLV] %w", err)
 	}
 
 	if int(offset)+len(data) > int(apis.MaxChunkSize) {
-		return errors.New("too much data to write")
+		return apis.ErrChunkTooLarge
+	}
+
+	key := stagedWrite{Chunk: chunk, Hash: apis.CalculateCommitHash(offset, data)}
+	return cs.stage(key, commit{Offset: offset, Data: data})
+}
+
+// Like StartWrite, but for data to be appended wherever the valid data of the chunk ends once it is committed.
+func (cs *chunkserver) StartAppend(chunk apis.ChunkNum, data []byte) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	_, err := cs.Storage.GetLatestVersion(chunk)
+	if err != nil {
+		return fmt.Errorf("[handle.go/GLV] %w", err)
 	}
 
-	cs.Hashes[apis.CalculateCommitHash(offset, data)] = struct {
-		Offset uint32
-		Data   []byte
-	}{Offset: offset, Data: data}
+	if len(data) > int(apis.MaxChunkSize) {
+		return apis.ErrChunkTooLarge
+	}
+
+	key := stagedWrite{Chunk: chunk, Hash: apis.CalculateAppendHash(data)}
+	return cs.stage(key, commit{Data: data, Append: true})
+}
+
+// Keeps a write around until it is committed, as long as there is room for it. Must be called with mu held.
+func (cs *chunkserver) stage(key stagedWrite, write commit) error {
+	now := cs.now()
+	for key, write := range cs.Hashes {
+		if now.Sub(write.Staged) > StagedWriteLifetime {
+			cs.logger.Logf(apis.DEBUG, "discarding write %s, which was staged at %v but never committed", key.Hash, write.Staged)
+			cs.unstage(key)
+		}
+	}
+	_, restaged := cs.Hashes[key]
+	if !restaged {
+		if cs.stagedPerChunk[key.Chunk]+len(write.Data) > cs.maxPerChunk {
+			return apis.RetryAfterError{
+				Err:        fmt.Errorf("%d bytes already staged for chunk %d: %w", cs.stagedPerChunk[key.Chunk], key.Chunk, apis.ErrStagingFull),
+				RetryAfter: StagingRetryAfter,
+			}
+		}
+		if cs.stagedTotal+len(write.Data) > cs.maxTotal {
+			return apis.RetryAfterError{
+				Err:        fmt.Errorf("%d bytes already staged: %w", cs.stagedTotal, apis.ErrStagingFull),
+				RetryAfter: StagingRetryAfter,
+			}
+		}
+	}
+	write.Staged = now
+	write.Checksum = apis.CalculateChecksum(write.Data)
+	if err := cs.logStagedWrite(key, write); err != nil {
+		return fmt.Errorf("[handle.go/LSW] %w", err)
+	}
+	if !restaged {
+		cs.stagedPerChunk[key.Chunk] += len(write.Data)
+		cs.stagedTotal += len(write.Data)
+	}
+	cs.Hashes[key] = write
 
 	return nil
 }
 
+// Forgets a staged write, and no longer counts it against the limits.
+func (cs *chunkserver) unstage(key stagedWrite) {
+	write, found := cs.Hashes[key]
+	if !found {
+		return
+	}
+	delete(cs.Hashes, key)
+	cs.forgetStagedWrite(key)
+	cs.stagedTotal -= len(write.Data)
+	if cs.stagedPerChunk[key.Chunk] -= len(write.Data); cs.stagedPerChunk[key.Chunk] == 0 {
+		delete(cs.stagedPerChunk, key.Chunk)
+	}
+}
+
 // Commit a write -- persistently store it as the data for a particular version.
 // Takes existing saved data for oldVersion, apply this cached write, and saved it as newVersion.
 func (cs *chunkserver) CommitWrite(chunk apis.ChunkNum, hash apis.CommitHash, oldVersion apis.Version, newVersion apis.Version) error {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
+	_, err := cs.commitStaged(stagedWrite{Chunk: chunk, Hash: hash}, false, oldVersion, newVersion)
+	return err
+}
+
+// Like CommitWrite, but for an append, which is placed at the end of the data stored for oldVersion.
+func (cs *chunkserver) CommitAppend(chunk apis.ChunkNum, hash apis.CommitHash, oldVersion apis.Version, newVersion apis.Version) (uint32, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return cs.commitStaged(stagedWrite{Chunk: chunk, Hash: hash}, true, oldVersion, newVersion)
+}
+
+// Applies a staged write or append to the data for oldVersion and saves it as newVersion, returning the offset the data
+// was placed at. Must be called with mu held.
+func (cs *chunkserver) commitStaged(key stagedWrite, isAppend bool, oldVersion apis.Version, newVersion apis.Version) (uint32, error) {
+	chunk := key.Chunk
 	if newVersion <= oldVersion {
-		return errors.New("cannot rewrite history")
+		return 0, errors.New("cannot rewrite history")
 	}
 
 	latest, err := cs.Storage.GetLatestVersion(chunk)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	if latest != oldVersion {
-		return fmt.Errorf("attempt to write to mismatched version (%d/%d -> %d/%d) when latest is %d/%d",
-			chunk, oldVersion, chunk, newVersion, chunk, latest)
+		return 0, fmt.Errorf("attempt to write to mismatched version (%d/%d -> %d/%d): %w",
+			chunk, oldVersion, chunk, newVersion, apis.VersionStaleError{Current: latest})
 	}
 
-	write, found := cs.Hashes[hash]
-	if !found {
-		return errors.New("could not locate write by commit hash")
+	write, found := cs.Hashes[key]
+	if !found || write.Append != isAppend {
+		return 0, fmt.Errorf("could not locate write by commit hash: %w", apis.ErrNotFound)
+	}
+	if err := apis.VerifyChecksum(write.Data, write.Checksum); err != nil {
+		// it would only be damaged the same way if it were committed again
+		cs.unstage(key)
+		return 0, fmt.Errorf("[handle.go/VSW] staged write %s was damaged: %w", key.Hash, err)
 	}
 
-	data, err := cs.Storage.ReadVersion(chunk, oldVersion)
+	data, err := cs.readVerified(chunk, oldVersion)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	dataLen := int(write.Offset) + len(write.Data)
+	offset := write.Offset
+	if write.Append {
+		if len(data)+len(write.Data) > int(apis.MaxChunkSize) {
+			return 0, fmt.Errorf("cannot append %d bytes after %d bytes of chunk %d: %w",
+				len(write.Data), len(data), chunk, apis.ErrChunkTooLarge)
+		}
+		offset = uint32(len(data))
+	}
+
+	dataLen := int(offset) + len(write.Data)
 	if dataLen < len(data) {
 		dataLen = len(data)
 	}
@@ -271,13 +573,23 @@ func (cs *chunkserver) CommitWrite(chunk apis.ChunkNum, hash apis.CommitHash, ol
 
 	newData := make([]byte, dataLen)
 	copy(newData, data)
-	copy(newData[write.Offset:], write.Data)
+	copy(newData[offset:], write.Data)
+
+	// after an Undelete, a new write may reuse the number of a version that is being retained, and replaces it
+	if index := cs.findSuperseded(chunk, newVersion); index >= 0 {
+		cs.superseded = append(cs.superseded[:index], cs.superseded[index+1:]...)
+	}
 
-	return cs.Storage.WriteVersion(chunk, newVersion, newData)
+	if err := cs.writeVersion(chunk, newVersion, newData); err != nil {
+		return 0, err
+	}
+	// the write can't be committed again, since the new version now exists, so its data is no longer needed
+	cs.unstage(key)
+	return offset, nil
 }
 
 // Update the version of this chunk that will be returned to clients. (Also allowing this chunkserver to delete
-// older versions.)
+// older versions, once its retention window has passed.)
 // If the specified chunk does not exist on this chunkserver, errors.
 // If the current version reported to clients is different from the oldVersion, errors.
 func (cs *chunkserver) UpdateLatestVersion(chunk apis.ChunkNum, oldVersion apis.Version, newVersion apis.Version) error {
@@ -293,8 +605,8 @@ func (cs *chunkserver) UpdateLatestVersion(chunk apis.ChunkNum, oldVersion apis.
 		return err
 	}
 	if latest != oldVersion {
-		return fmt.Errorf("attempt to update to mismatched version (%d/%d -> %d/%d) when latest is %d/%d",
-			chunk, oldVersion, chunk, newVersion, chunk, latest)
+		return fmt.Errorf("attempt to update to mismatched version (%d/%d -> %d/%d): %w",
+			chunk, oldVersion, chunk, newVersion, apis.VersionStaleError{Current: latest})
 	}
 
 	// TODO: have an api to just check, rather than needing to iterate
@@ -307,24 +619,18 @@ func (cs *chunkserver) UpdateLatestVersion(chunk apis.ChunkNum, oldVersion apis.
 		found = found || (ver == newVersion)
 	}
 	if !found {
-		return fmt.Errorf("no write found for version: %d/%d", chunk, newVersion)
+		return fmt.Errorf("no write found for version %d/%d: %w", chunk, newVersion, apis.ErrNotFound)
 	}
 
-	// change the latest version
+	// change the latest version; from here on, everything older is known to be unneeded, even across a restart
 	if err := cs.Storage.SetLatestVersion(chunk, newVersion); err != nil {
 		return err
 	}
 
-	// TODO: be able to recover from a failure in here
-
 	// eliminate everything older
-	for _, ver := range versions {
-		if ver < newVersion {
-			if err := cs.Storage.DeleteVersion(chunk, ver); err != nil {
-				return err
-			}
-		}
+	if cs.reclaimer != nil {
+		cs.reclaimer.enqueue(chunk, newVersion)
+		return nil
 	}
-
-	return nil
+	return cs.retireOlder(chunk, newVersion)
 }
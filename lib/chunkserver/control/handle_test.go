@@ -1,8 +1,14 @@
 package control
 
 import (
+	"errors"
+	"fmt"
 	testifyAssert "github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 	"zircon/apis"
 	"zircon/chunkserver/storage"
 	"zircon/util"
@@ -341,3 +347,754 @@ func TestChunkserverSingle(t *testing.T) {
 		}, chunks)
 	})
 }
+
+// Tests that staged writes that are never committed are eventually discarded, but not before StagedWriteLifetime.
+func TestStagedWriteExpiry(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	chunkStorage, err := storage.ConfigureMemoryStorage()
+	assert.NoError(err)
+	defer chunkStorage.Close()
+	single, teardown, err := ExposeChunkserver(chunkStorage)
+	assert.NoError(err)
+	defer teardown()
+
+	now := time.Unix(1000, 0)
+	cs := single.(*chunkserver)
+	cs.now = func() time.Time {
+		return now
+	}
+
+	assert.NoError(cs.Add(7, []byte("hello world"), 1))
+	assert.NoError(cs.StartWrite(7, 0, []byte("abandoned")))
+	now = now.Add(StagedWriteLifetime / 2)
+	assert.NoError(cs.StartWrite(7, 0, []byte("Jell0")))
+	assert.Equal(2, len(cs.Hashes))
+
+	// the first write is now too old, and is dropped when the next write is staged
+	now = now.Add(StagedWriteLifetime)
+	assert.NoError(cs.StartWrite(7, 0, []byte("Hell")))
+	assert.Equal(2, len(cs.Hashes))
+	assert.Error(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("abandoned")), 1, 2))
+	assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("Hell")), 1, 2))
+}
+
+// Tests that StartWrite refuses to stage more data than the limits for a chunk and in total allow, and that committing
+// writes or letting them expire makes room again.
+func TestStagingLimits(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	chunkStorage, err := storage.ConfigureMemoryStorage()
+	assert.NoError(err)
+	defer chunkStorage.Close()
+	single, teardown, err := ExposeChunkserver(chunkStorage)
+	assert.NoError(err)
+	defer teardown()
+
+	now := time.Unix(1000, 0)
+	cs := single.(*chunkserver)
+	cs.now = func() time.Time {
+		return now
+	}
+	cs.maxPerChunk = 100
+	cs.maxTotal = 250
+
+	for chunk := apis.ChunkNum(1); chunk <= 3; chunk++ {
+		assert.NoError(cs.Add(chunk, []byte("hello world"), 1))
+	}
+	piece := func(i int) []byte {
+		return []byte(fmt.Sprintf("%040d", i))
+	}
+
+	// two 40-byte writes fit in chunk 1, but not a third
+	assert.NoError(cs.StartWrite(1, 0, piece(0)))
+	assert.NoError(cs.StartWrite(1, 0, piece(1)))
+	err = cs.StartWrite(1, 0, piece(2))
+	assert.True(errors.Is(err, apis.ErrStagingFull))
+	// the writer is told to back off for a while
+	var busy apis.RetryAfterError
+	if assert.True(errors.As(err, &busy)) {
+		assert.Equal(StagingRetryAfter, busy.RetryAfter)
+	}
+	assert.True(errors.Is(err, apis.ErrBusy))
+	// staging the same write again takes no more room
+	assert.NoError(cs.StartWrite(1, 0, piece(1)))
+
+	// other chunks still have room, until the total is used up
+	assert.NoError(cs.StartWrite(2, 0, piece(3)))
+	assert.NoError(cs.StartWrite(2, 0, piece(4)))
+	assert.NoError(cs.StartWrite(3, 0, piece(5)))
+	assert.NoError(cs.StartWrite(3, 0, piece(6)))
+	err = cs.StartWrite(2, 0, []byte("hello again"))
+	assert.True(errors.Is(err, apis.ErrStagingFull))
+
+	// committing a write frees its room
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(0, piece(0)), 1, 2))
+	assert.NoError(cs.StartWrite(1, 0, piece(2)))
+	err = cs.StartWrite(1, 0, piece(7))
+	assert.True(errors.Is(err, apis.ErrStagingFull))
+
+	// and so does a write expiring, even when the chunk was full
+	now = now.Add(StagedWriteLifetime + time.Second)
+	for i := 8; i < 10; i++ {
+		assert.NoError(cs.StartWrite(1, 0, piece(i)))
+	}
+	assert.Equal(2, len(cs.Hashes))
+	assert.Equal(80, cs.stagedTotal)
+	assert.Error(cs.CommitWrite(2, apis.CalculateCommitHash(0, piece(3)), 1, 2))
+}
+
+// Tests that appends land at the end of whichever version they are committed against, and can't be mixed up with writes.
+func TestAppend(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	chunkStorage, err := storage.ConfigureMemoryStorage()
+	assert.NoError(err)
+	defer chunkStorage.Close()
+	cs, teardown, err := ExposeChunkserver(chunkStorage)
+	assert.NoError(err)
+	defer teardown()
+
+	assert.NoError(cs.Add(5, []byte("hello"), 1))
+	assert.NoError(cs.StartAppend(5, []byte(" world")))
+	assert.NoError(cs.StartAppend(5, []byte(" again")))
+
+	// an append can only be committed as an append, and a write only as a write
+	err = cs.CommitWrite(5, apis.CalculateAppendHash([]byte(" world")), 1, 2)
+	assert.True(errors.Is(err, apis.ErrNotFound))
+	assert.NoError(cs.StartWrite(5, 0, []byte("jello")))
+	_, err = cs.CommitAppend(5, apis.CalculateCommitHash(0, []byte("jello")), 1, 2)
+	assert.True(errors.Is(err, apis.ErrNotFound))
+
+	offset, err := cs.CommitAppend(5, apis.CalculateAppendHash([]byte(" world")), 1, 2)
+	assert.NoError(err)
+	assert.Equal(uint32(5), offset)
+	assert.NoError(cs.UpdateLatestVersion(5, 1, 2))
+	offset, err = cs.CommitAppend(5, apis.CalculateAppendHash([]byte(" again")), 2, 3)
+	assert.NoError(err)
+	assert.Equal(uint32(11), offset)
+	assert.NoError(cs.UpdateLatestVersion(5, 2, 3))
+
+	data, version, err := cs.Read(5, 0, 20, 3)
+	assert.NoError(err)
+	assert.Equal(apis.Version(3), version)
+	assert.Equal("hello world again\x00\x00\x00", string(data))
+
+	// an append that no longer fits in the chunk can be staged, but not committed
+	big := make([]byte, apis.MaxChunkSize-10)
+	assert.NoError(cs.StartAppend(5, big))
+	_, err = cs.CommitAppend(5, apis.CalculateAppendHash(big), 3, 4)
+	assert.True(errors.Is(err, apis.ErrChunkTooLarge))
+	err = cs.StartAppend(5, make([]byte, apis.MaxChunkSize+1))
+	assert.True(errors.Is(err, apis.ErrChunkTooLarge))
+}
+
+// Tests that with storage that logs staged writes, a write staged before the chunkserver restarts can be committed
+// afterwards, while one that was committed or abandoned stays gone.
+func TestStagedWritesSurviveRestart(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "staging-test-")
+	assert.NoError(err)
+	defer func() {
+		assert.NoError(os.RemoveAll(dir))
+	}()
+	chunkStorage, err := storage.ConfigureDiskStorage(dir)
+	assert.NoError(err)
+	single, teardown, err := ExposeChunkserver(chunkStorage)
+	assert.NoError(err)
+
+	assert.NoError(single.Add(7, []byte("hello world"), 1))
+	assert.NoError(single.StartWrite(7, 0, []byte("Jell0")))
+	assert.NoError(single.StartWrite(7, 6, []byte("there")))
+	assert.NoError(single.StartWrite(7, 0, []byte("committed")))
+	assert.NoError(single.CommitWrite(7, apis.CalculateCommitHash(0, []byte("committed")), 1, 2))
+	assert.NoError(single.Delete(7, 1))
+	assert.NoError(single.Add(8, []byte("hello world"), 1))
+	assert.NoError(single.StartWrite(8, 6, []byte("there")))
+	teardown()
+	chunkStorage.Close()
+
+	chunkStorage, err = storage.ConfigureDiskStorage(dir)
+	assert.NoError(err)
+	defer chunkStorage.Close()
+	single, teardown, err = ExposeChunkserver(chunkStorage)
+	assert.NoError(err)
+	defer teardown()
+
+	// chunk 7 is gone, so its writes are dropped, but the write to chunk 8 is still there to commit
+	cs := single.(*chunkserver)
+	assert.Equal(1, len(cs.Hashes))
+	assert.Equal(5, cs.stagedTotal)
+	assert.NoError(single.CommitWrite(8, apis.CalculateCommitHash(6, []byte("there")), 1, 2))
+	assert.NoError(single.UpdateLatestVersion(8, 1, 2))
+	data, _, err := single.Read(8, 0, 11, 2)
+	assert.NoError(err)
+	assert.Equal("hello there", string(data))
+	staged, err := chunkStorage.(storage.StagingLog).ListStagedWrites()
+	assert.NoError(err)
+	assert.Empty(staged)
+}
+
+// Tests that with a retention window, superseded and deleted versions keep their data and can be restored until the
+// window has passed, and are reclaimed afterwards.
+func TestRetention(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	chunkStorage, err := storage.ConfigureMemoryStorage()
+	assert.NoError(err)
+	defer chunkStorage.Close()
+	single, teardown, err := ExposeChunkserverWithOptions(chunkStorage, ChunkserverOptions{Retention: time.Hour})
+	assert.NoError(err)
+	defer teardown()
+
+	now := time.Unix(1000, 0)
+	cs := single.(*chunkserver)
+	cs.now = func() time.Time {
+		return now
+	}
+	read := func(chunk apis.ChunkNum) string {
+		data, _, err := cs.Read(chunk, 0, 11, apis.AnyVersion)
+		assert.NoError(err)
+		return string(data)
+	}
+	write := func(chunk apis.ChunkNum, data string, version apis.Version) {
+		assert.NoError(cs.StartWrite(chunk, 0, []byte(data)))
+		assert.NoError(cs.CommitWrite(chunk, apis.CalculateCommitHash(0, []byte(data)), version, version+1))
+		assert.NoError(cs.UpdateLatestVersion(chunk, version, version+1))
+	}
+
+	// an overwrite keeps the old version around, without reporting it
+	assert.NoError(cs.Add(7, []byte("hello world"), 1))
+	write(7, "Jell0", 1)
+	versions, err := chunkStorage.ListVersions(7)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{1, 2}, versions)
+	chunks, err := cs.ListAllChunks()
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkVersion{{Chunk: 7, Version: 2}}, chunks)
+
+	// and it can be restored, as can the version it replaced
+	assert.NoError(cs.Undelete(7, 1))
+	assert.Equal("hello world", read(7))
+	assert.NoError(cs.Undelete(7, 2))
+	assert.Equal("Jell0 world", read(7))
+
+	// a deleted chunk can be restored within the window
+	assert.NoError(cs.Delete(7, 2))
+	_, _, err = cs.Read(7, 0, 11, apis.AnyVersion)
+	assert.Error(err)
+	chunks, err = cs.ListAllChunks()
+	assert.NoError(err)
+	assert.Empty(chunks)
+	now = now.Add(30 * time.Minute)
+	assert.NoError(cs.Undelete(7, 2))
+	assert.Equal("Jell0 world", read(7))
+
+	// but not once the window has passed
+	assert.NoError(cs.Delete(7, 2))
+	now = now.Add(59 * time.Minute)
+	versions, err = chunkStorage.ListVersions(7)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{1, 2}, versions)
+	now = now.Add(time.Minute)
+	assert.True(errors.Is(cs.Undelete(7, 2), apis.ErrNotFound))
+	versions, err = chunkStorage.ListVersions(7)
+	assert.NoError(err)
+	assert.Empty(versions)
+
+	// superseded versions expire the same way
+	assert.NoError(cs.Add(8, []byte("hello world"), 1))
+	write(8, "Jell0", 1)
+	now = now.Add(time.Hour)
+	chunks, err = cs.ListAllChunks()
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkVersion{{Chunk: 8, Version: 2}}, chunks)
+	versions, err = chunkStorage.ListVersions(8)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{2}, versions)
+	assert.True(errors.Is(cs.Undelete(8, 1), apis.ErrNotFound))
+
+	// whatever is still retained when the chunkserver restarts is reclaimed
+	assert.NoError(cs.Add(9, []byte("hello world"), 1))
+	assert.NoError(cs.Delete(9, 1))
+	teardown()
+	single, teardown, err = ExposeChunkserverWithOptions(chunkStorage, ChunkserverOptions{Retention: time.Hour})
+	assert.NoError(err)
+	versions, err = chunkStorage.ListVersions(9)
+	assert.NoError(err)
+	assert.Empty(versions)
+	chunks, err = single.ListAllChunks()
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkVersion{{Chunk: 8, Version: 2}}, chunks)
+}
+
+// Storage whose deletions wait for the test to let them through.
+type stallingStorage struct {
+	storage.ChunkStorage
+	deleting chan apis.ChunkVersion
+	release  chan struct{}
+}
+
+func (s *stallingStorage) DeleteVersion(chunk apis.ChunkNum, version apis.Version) error {
+	s.deleting <- apis.ChunkVersion{Chunk: chunk, Version: version}
+	<-s.release
+	return s.ChunkStorage.DeleteVersion(chunk, version)
+}
+
+// Tests that with asynchronous reclamation, a new version is served as soon as UpdateLatestVersion returns, while the
+// version it replaced is only deleted afterwards, and that versions left behind by a crash are reclaimed on restart.
+func TestAsyncReclaim(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	inner, err := storage.ConfigureMemoryStorage()
+	assert.NoError(err)
+	defer inner.Close()
+	stalling := &stallingStorage{
+		ChunkStorage: inner,
+		deleting:     make(chan apis.ChunkVersion),
+		release:      make(chan struct{}),
+	}
+	cs, teardown, err := ExposeChunkserverWithOptions(stalling, ChunkserverOptions{AsyncReclaim: true})
+	assert.NoError(err)
+
+	assert.NoError(cs.Add(7, []byte("hello world"), 1))
+	assert.NoError(cs.StartWrite(7, 0, []byte("Jell0")))
+	assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("Jell0")), 1, 2))
+	// returns even though the deletion of the old version can't go through yet
+	assert.NoError(cs.UpdateLatestVersion(7, 1, 2))
+
+	// the background goroutine is stuck inside the deletion until released, so the storage can be looked at directly
+	select {
+	case deleting := <-stalling.deleting:
+		assert.Equal(apis.ChunkVersion{Chunk: 7, Version: 1}, deleting)
+	case <-time.After(5 * time.Second):
+		t.Fatal("old version was never reclaimed")
+	}
+	latest, err := inner.GetLatestVersion(7)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), latest)
+	versions, err := inner.ListVersions(7)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{1, 2}, versions)
+
+	close(stalling.release)
+	data, version, err := cs.Read(7, 0, 11, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), version)
+	assert.Equal("Jell0 world", string(data))
+	teardown()
+	versions, err = inner.ListVersions(7)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{2}, versions)
+
+	// as if the chunkserver had crashed right after publishing version 3 of another chunk
+	assert.NoError(inner.WriteVersion(8, 2, []byte("two")))
+	assert.NoError(inner.WriteVersion(8, 3, []byte("three")))
+	assert.NoError(inner.WriteVersion(8, 4, []byte("four, not yet published")))
+	assert.NoError(inner.SetLatestVersion(8, 3))
+	cs, teardown, err = ExposeChunkserverWithOptions(inner, ChunkserverOptions{AsyncReclaim: true})
+	assert.NoError(err)
+	defer teardown()
+	versions, err = inner.ListVersions(8)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{3, 4}, versions)
+	data, _, err = cs.Read(8, 0, 5, 3)
+	assert.NoError(err)
+	assert.Equal("three", string(data))
+}
+
+func TestReadVersion(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	chunkStorage, err := storage.ConfigureMemoryStorage()
+	assert.NoError(err)
+	defer chunkStorage.Close()
+	single, teardown, err := ExposeChunkserverWithOptions(chunkStorage, ChunkserverOptions{Retention: time.Hour})
+	assert.NoError(err)
+	defer teardown()
+
+	now := time.Unix(1000, 0)
+	cs := single.(*chunkserver)
+	cs.now = func() time.Time {
+		return now
+	}
+
+	assert.NoError(cs.Add(7, []byte("hello world"), 1))
+	assert.NoError(cs.StartWrite(7, 0, []byte("Jell0")))
+	assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("Jell0")), 1, 2))
+	assert.NoError(cs.UpdateLatestVersion(7, 1, 2))
+
+	// both the latest version and the one it superseded can be read exactly
+	data, err := cs.ReadVersion(7, 0, 11, 2)
+	assert.NoError(err)
+	assert.Equal("Jell0 world", string(data))
+	data, err = cs.ReadVersion(7, 6, 5, 1)
+	assert.NoError(err)
+	assert.Equal("world", string(data))
+	data, err = cs.ReadVersion(7, 0, 11, 1)
+	assert.NoError(err)
+	assert.Equal("hello world", string(data))
+
+	// versions that were never written are not found
+	_, err = cs.ReadVersion(7, 0, 11, 3)
+	assert.True(errors.Is(err, apis.ErrNotFound))
+	_, err = cs.ReadVersion(8, 0, 11, 1)
+	assert.True(errors.Is(err, apis.ErrNotFound))
+
+	// a deleted chunk can still be read at its versions while they are retained
+	assert.NoError(cs.Delete(7, 2))
+	data, err = cs.ReadVersion(7, 0, 11, 2)
+	assert.NoError(err)
+	assert.Equal("Jell0 world", string(data))
+
+	// once the window passes, old versions are reported as reclaimed rather than missing
+	assert.NoError(cs.Undelete(7, 2))
+	now = now.Add(time.Hour)
+	_, err = cs.ReadVersion(7, 0, 11, 1)
+	assert.True(errors.Is(err, apis.ErrVersionReclaimed))
+	assert.False(errors.Is(err, apis.ErrNotFound))
+	data, err = cs.ReadVersion(7, 0, 11, 2)
+	assert.NoError(err)
+	assert.Equal("Jell0 world", string(data))
+}
+
+// Tests that pinned versions outlive being superseded and deleted, with and without a retention window, and are
+// reclaimed once the last pin on them is released.
+func TestPin(t *testing.T) {
+	for _, retention := range []time.Duration{0, time.Hour} {
+		assert := testifyAssert.New(t)
+
+		chunkStorage, err := storage.ConfigureMemoryStorage()
+		assert.NoError(err)
+		single, teardown, err := ExposeChunkserverWithOptions(chunkStorage, ChunkserverOptions{Retention: retention})
+		assert.NoError(err)
+
+		now := time.Unix(1000, 0)
+		cs := single.(*chunkserver)
+		cs.now = func() time.Time {
+			return now
+		}
+		write := func(chunk apis.ChunkNum, data string, version apis.Version) {
+			assert.NoError(cs.StartWrite(chunk, 0, []byte(data)))
+			assert.NoError(cs.CommitWrite(chunk, apis.CalculateCommitHash(0, []byte(data)), version, version+1))
+			assert.NoError(cs.UpdateLatestVersion(chunk, version, version+1))
+		}
+		readVersion := func(chunk apis.ChunkNum, version apis.Version) (string, error) {
+			data, err := cs.ReadVersion(chunk, 0, 11, version)
+			return string(data), err
+		}
+
+		// a version pinned twice survives being superseded, past the retention window, until both pins are released
+		assert.NoError(cs.Add(7, []byte("hello world"), 1))
+		assert.NoError(cs.Pin(7, 1))
+		assert.NoError(cs.Pin(7, 1))
+		write(7, "Jell0", 1)
+		now = now.Add(2 * time.Hour)
+		data, err := readVersion(7, 1)
+		assert.NoError(err)
+		assert.Equal("hello world", data)
+		chunks, err := cs.ListAllChunks()
+		assert.NoError(err)
+		assert.Equal([]apis.ChunkVersion{{Chunk: 7, Version: 2}}, chunks)
+		assert.NoError(cs.Unpin(7, 1))
+		_, err = readVersion(7, 1)
+		assert.NoError(err)
+		assert.NoError(cs.Unpin(7, 1))
+		if retention > 0 {
+			// released versions get a fresh retention window
+			_, err = readVersion(7, 1)
+			assert.NoError(err)
+			now = now.Add(retention)
+		}
+		_, err = readVersion(7, 1)
+		assert.True(errors.Is(err, apis.ErrVersionReclaimed))
+		assert.True(errors.Is(cs.Unpin(7, 1), apis.ErrNotFound))
+		assert.True(errors.Is(cs.Pin(7, 1), apis.ErrVersionReclaimed))
+		assert.True(errors.Is(cs.Pin(7, 3), apis.ErrNotFound))
+
+		// a pinned chunk that is deleted keeps its pinned data until the pin is released
+		assert.NoError(cs.Pin(7, 2))
+		assert.NoError(cs.Delete(7, 2))
+		now = now.Add(2 * time.Hour)
+		_, _, err = cs.Read(7, 0, 11, apis.AnyVersion)
+		assert.Error(err)
+		chunks, err = cs.ListAllChunks()
+		assert.NoError(err)
+		assert.Empty(chunks)
+		data, err = readVersion(7, 2)
+		assert.NoError(err)
+		assert.Equal("Jell0 world", data)
+		assert.NoError(cs.Unpin(7, 2))
+		versions, err := chunkStorage.ListVersions(7)
+		assert.NoError(err)
+		assert.Empty(versions)
+
+		teardown()
+		chunkStorage.Close()
+	}
+}
+
+func TestReadWithChecksum(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	chunkStorage, err := storage.ConfigureMemoryStorage()
+	assert.NoError(err)
+	defer chunkStorage.Close()
+	cs, teardown, err := ExposeChunkserver(chunkStorage)
+	assert.NoError(err)
+	defer teardown()
+
+	castagnoli := crc32.MakeTable(crc32.Castagnoli)
+
+	assert.NoError(cs.Add(7, []byte("hello world"), 1))
+	assert.NoError(cs.StartWrite(7, 0, []byte("Jell0")))
+	assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("Jell0")), 1, 2))
+	assert.NoError(cs.UpdateLatestVersion(7, 1, 2))
+
+	// a range gets the checksum of exactly that range
+	data, version, checksum, err := cs.ReadWithChecksum(7, 3, 6, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), version)
+	assert.Equal("l0 wor", string(data))
+	assert.Equal(apis.Checksum(crc32.Checksum([]byte("l0 wor"), castagnoli)), checksum)
+
+	// the whole chunk gets the checksum kept from the write, which covers the zero padding as well
+	data, _, checksum, err = cs.ReadWithChecksum(7, 0, apis.MaxChunkSize, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Len(data, int(apis.MaxChunkSize))
+	expected := make([]byte, apis.MaxChunkSize)
+	copy(expected, "Jell0 world")
+	assert.Equal(apis.Checksum(crc32.Checksum(expected, castagnoli)), checksum)
+
+	// since that checksum wasn't taken from storage, it shows when storage has changed the data underneath
+	assert.NoError(chunkStorage.DeleteVersion(7, 2))
+	assert.NoError(chunkStorage.WriteVersion(7, 2, []byte("Jell0 w0rld")))
+	data, _, checksum, err = cs.ReadWithChecksum(7, 0, apis.MaxChunkSize, apis.AnyVersion)
+	assert.NoError(err)
+	assert.NotEqual(apis.CalculateChecksum(data), checksum)
+
+	_, version, _, err = cs.ReadWithChecksum(7, 0, 11, 3)
+	assert.True(errors.Is(err, apis.ErrVersionStale))
+	assert.Equal(apis.Version(2), version)
+}
+
+// Tests that digests report the version served, every version held, and a checksum that matches between copies of the
+// same data, whether or not the chunkserver kept it from the write.
+func TestDigestChunks(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	chunkStorage, err := storage.ConfigureMemoryStorage()
+	assert.NoError(err)
+	defer chunkStorage.Close()
+	cs, teardown, err := ExposeChunkserver(chunkStorage)
+	assert.NoError(err)
+
+	// chunk 7 has a second version committed, but not yet served
+	assert.NoError(cs.Add(7, []byte("hello world"), 1))
+	assert.NoError(cs.StartWrite(7, 0, []byte("Jell0")))
+	assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("Jell0")), 1, 2))
+	assert.NoError(cs.Add(8, []byte("hello world"), 3))
+
+	expected := make([]byte, apis.MaxChunkSize)
+	copy(expected, "hello world")
+	checksum := apis.CalculateChecksum(expected)
+
+	check := func() {
+		digests, err := cs.DigestChunks([]apis.ChunkNum{7, 8, 9})
+		assert.NoError(err)
+		assert.Len(digests, 2)
+		byChunk := map[apis.ChunkNum]apis.ChunkDigest{}
+		for _, digest := range digests {
+			byChunk[digest.Chunk] = digest
+		}
+		assert.Equal(apis.Version(1), byChunk[7].Latest)
+		assert.ElementsMatch([]apis.Version{1, 2}, byChunk[7].Versions)
+		assert.Equal(checksum, byChunk[7].Checksum)
+		assert.Equal(apis.Version(3), byChunk[8].Latest)
+		assert.Equal([]apis.Version{3}, byChunk[8].Versions)
+		assert.Equal(checksum, byChunk[8].Checksum)
+	}
+	check()
+
+	// after a restart, the checksums are no longer kept, and have to be computed from storage
+	teardown()
+	cs, teardown, err = ExposeChunkserver(chunkStorage)
+	assert.NoError(err)
+	defer teardown()
+	check()
+
+	assert.NoError(cs.UpdateLatestVersion(7, 1, 2))
+	assert.NoError(cs.Delete(8, 3))
+	digests, err := cs.DigestChunks([]apis.ChunkNum{7, 8})
+	assert.NoError(err)
+	if assert.Len(digests, 1) {
+		assert.Equal(apis.Version(2), digests[0].Latest)
+		assert.Equal([]apis.Version{2}, digests[0].Versions)
+		assert.NotEqual(checksum, digests[0].Checksum)
+	}
+}
+
+// Tests that a commit fails rather than store a write that was damaged after it was staged, or apply a write to a
+// version that was damaged in storage.
+func TestCommitChecksKeptChecksums(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	chunkStorage, err := storage.ConfigureMemoryStorage()
+	assert.NoError(err)
+	defer chunkStorage.Close()
+	cs, teardown, err := ExposeChunkserver(chunkStorage)
+	assert.NoError(err)
+	defer teardown()
+
+	assert.NoError(cs.Add(7, []byte("hello world"), 1))
+	data := []byte("Jell0")
+	assert.NoError(cs.StartWrite(7, 0, data))
+	// the staged write shares its buffer with the caller
+	data[4] = 'o'
+	err = cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("Jell0")), 1, 2)
+	assert.True(errors.Is(err, apis.ErrChecksumMismatch))
+	// and is discarded, so that it can't be committed later on
+	err = cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("Jell0")), 1, 2)
+	assert.True(errors.Is(err, apis.ErrNotFound))
+
+	assert.NoError(chunkStorage.DeleteVersion(7, 1))
+	assert.NoError(chunkStorage.WriteVersion(7, 1, []byte("hello w0rld")))
+	assert.NoError(cs.StartWrite(7, 0, []byte("Jell0")))
+	err = cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("Jell0")), 1, 2)
+	assert.True(errors.Is(err, apis.ErrChecksumMismatch))
+	versions, err := chunkStorage.ListVersions(7)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{1}, versions)
+}
+
+// A storage layer whose listings can be made to fail.
+type failingStorage struct {
+	storage.ChunkStorage
+	err error
+}
+
+func (f *failingStorage) ListChunksWithLatest() ([]apis.ChunkNum, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.ChunkStorage.ListChunksWithLatest()
+}
+
+// Tests that the chunkserver reports its storage as unhealthy once it can't be listed, and its staging area once there is
+// no room left for another write.
+func TestCheckHealth(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	memory, err := storage.ConfigureMemoryStorage()
+	assert.NoError(err)
+	defer memory.Close()
+	failing := &failingStorage{ChunkStorage: memory}
+	single, teardown, err := ExposeChunkserver(failing)
+	assert.NoError(err)
+	defer teardown()
+	cs := single.(*chunkserver)
+
+	assert.Equal([]apis.DependencyStatus{
+		{Name: "storage", Healthy: true},
+		{Name: "staging", Healthy: true},
+	}, cs.CheckHealth())
+
+	cs.maxTotal = apis.MaxChunkSize + 10
+	assert.NoError(cs.Add(1, []byte("hello world"), 1))
+	assert.NoError(cs.StartWrite(1, 0, []byte("hello again")))
+	failing.err = errors.New("disk unplugged")
+
+	health := cs.CheckHealth()
+	if assert.Len(health, 2) {
+		assert.Equal(apis.DependencyStatus{Name: "storage", Error: "disk unplugged"}, health[0])
+		assert.False(health[1].Healthy)
+		assert.Contains(health[1].Error, "already staged")
+	}
+}
+
+// Tests that a chunkserver reports its chunks, stored data, and staged writes as metrics.
+func TestReportMetrics(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	memory, err := storage.ConfigureMemoryStorage()
+	assert.NoError(err)
+	defer memory.Close()
+	single, teardown, err := ExposeChunkserver(memory)
+	assert.NoError(err)
+	defer teardown()
+	cs := single.(*chunkserver)
+
+	assert.NoError(cs.Add(1, []byte("hello world"), 1))
+	assert.NoError(cs.Add(2, []byte("hello"), 1))
+	assert.NoError(cs.StartWrite(1, 0, []byte("jello")))
+
+	values := map[string]float64{}
+	for _, measurement := range cs.ReportMetrics() {
+		assert.NotEmpty(measurement.Help)
+		values[measurement.Name] = measurement.Value
+	}
+	assert.Equal(map[string]float64{
+		"zircon_chunkserver_chunks":        2,
+		"zircon_chunkserver_stored_bytes":  16,
+		"zircon_chunkserver_staged_writes": 1,
+		"zircon_chunkserver_staged_bytes":  5,
+	}, values)
+}
+
+// Tests that scrubbing finds versions that storage has changed underneath the chunkserver, deletes chunks whose latest
+// version is corrupt, and starts checking versions written before the chunkserver started from the first scrub on.
+func TestScrub(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	memory, err := storage.ConfigureMemoryStorage()
+	assert.NoError(err)
+	defer memory.Close()
+	// as if written by an earlier run of the chunkserver
+	assert.NoError(memory.WriteVersion(9, 1, []byte("from before")))
+	assert.NoError(memory.SetLatestVersion(9, 1))
+	single, teardown, err := ExposeChunkserver(memory)
+	assert.NoError(err)
+	defer teardown()
+	cs := single.(*chunkserver)
+
+	assert.NoError(cs.Add(7, []byte("hello world"), 1))
+	assert.NoError(cs.Add(8, []byte("hello world"), 1))
+	assert.NoError(cs.StartWrite(8, 0, []byte("Jell0")))
+	assert.NoError(cs.CommitWrite(8, apis.CalculateCommitHash(0, []byte("Jell0")), 1, 2))
+
+	assert.NoError(cs.Scrub())
+	assert.Equal(ScrubStats{Passes: 1, Checked: 4, Recorded: 1}, cs.ScrubStats())
+
+	// damage the latest version of chunk 7, and the committed but unpublished version of chunk 8
+	assert.NoError(memory.DeleteVersion(7, 1))
+	assert.NoError(memory.WriteVersion(7, 1, []byte("hello w0rld")))
+	assert.NoError(memory.DeleteVersion(8, 2))
+	assert.NoError(memory.WriteVersion(8, 2, []byte("Jell0 w0rld")))
+
+	assert.NoError(cs.Scrub())
+	assert.Equal(ScrubStats{Passes: 2, Checked: 8, Recorded: 1, Corrupt: 2, Dropped: 1}, cs.ScrubStats())
+	chunks, err := cs.ListAllChunks()
+	assert.NoError(err)
+	assert.ElementsMatch([]apis.ChunkVersion{{Chunk: 8, Version: 1}, {Chunk: 9, Version: 1}}, chunks)
+	_, _, err = cs.Read(7, 0, 11, apis.AnyVersion)
+	assert.True(errors.Is(err, apis.ErrNotFound))
+	assert.Error(cs.UpdateLatestVersion(8, 1, 2))
+
+	// the checksum recorded for chunk 9 catches it changing later on
+	assert.NoError(memory.DeleteVersion(9, 1))
+	assert.NoError(memory.WriteVersion(9, 1, []byte("from after")))
+	assert.NoError(cs.Scrub())
+	stats := cs.ScrubStats()
+	assert.Equal(3, stats.Corrupt)
+	assert.Equal(2, stats.Dropped)
+	chunks, err = cs.ListAllChunks()
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkVersion{{Chunk: 8, Version: 1}}, chunks)
+
+	values := map[string]float64{}
+	for _, measurement := range cs.ReportMetrics() {
+		values[measurement.Name] = measurement.Value
+	}
+	assert.Equal(float64(3), values["zircon_chunkserver_corrupt_versions"])
+}
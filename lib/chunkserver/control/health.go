@@ -0,0 +1,25 @@
+package control
+
+import (
+	"fmt"
+
+	"zircon/lib/apis"
+)
+
+// Reports whether the chunkserver's storage can be listed, and whether there is room left to stage another write of a
+// full chunk, since a chunkserver that can't stage writes can't take part in any.
+func (cs *chunkserver) CheckHealth() []apis.DependencyStatus {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	_, err := cs.Storage.ListChunksWithLatest()
+	storage := apis.CheckDependency("storage", err)
+
+	var stagingErr error
+	if cs.stagedTotal+apis.MaxChunkSize > cs.maxTotal {
+		stagingErr = fmt.Errorf("%d of %d bytes already staged: %w", cs.stagedTotal, cs.maxTotal, apis.ErrStagingFull)
+	}
+	staging := apis.CheckDependency("staging", stagingErr)
+
+	return []apis.DependencyStatus{storage, staging}
+}
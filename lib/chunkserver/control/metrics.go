@@ -0,0 +1,58 @@
+package control
+
+import (
+	"zircon/lib/apis"
+	"zircon/lib/chunkserver/storage"
+)
+
+// Reports how many chunks the chunkserver holds, how much data it has staged, what scrubbing has found once it has run,
+// and, if its storage can say, how much chunk data it stores. Measurements that can't be taken are left out, rather than
+// failing the rest.
+func (cs *chunkserver) ReportMetrics() []apis.Measurement {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var measurements []apis.Measurement
+	chunks, err := cs.Storage.ListChunksWithLatest()
+	if err == nil {
+		measurements = append(measurements, apis.Measurement{
+			Name:  "zircon_chunkserver_chunks",
+			Help:  "The number of chunks this chunkserver holds a replica of.",
+			Value: float64(len(chunks)),
+		})
+	} else {
+		cs.logger.Logf(apis.WARN, "could not count chunks for metrics: %v", err)
+	}
+	if usage, ok := cs.Storage.(storage.UsageReporter); ok {
+		stored, err := usage.StoredBytes()
+		if err == nil {
+			measurements = append(measurements, apis.Measurement{
+				Name:  "zircon_chunkserver_stored_bytes",
+				Help:  "The size of every version of every chunk in storage, including retained versions.",
+				Value: float64(stored),
+			})
+		} else {
+			cs.logger.Logf(apis.WARN, "could not measure storage use for metrics: %v", err)
+		}
+	}
+	if cs.scrubStats.Passes > 0 {
+		measurements = append(measurements, apis.Measurement{
+			Name:  "zircon_chunkserver_scrubbed_versions",
+			Help:  "The number of versions of chunks read back and checked against their checksums by scrubbing.",
+			Value: float64(cs.scrubStats.Checked),
+		}, apis.Measurement{
+			Name:  "zircon_chunkserver_corrupt_versions",
+			Help:  "The number of versions of chunks that scrubbing found did not match their checksums.",
+			Value: float64(cs.scrubStats.Corrupt),
+		})
+	}
+	return append(measurements, apis.Measurement{
+		Name:  "zircon_chunkserver_staged_writes",
+		Help:  "The number of writes and appends staged but not yet committed.",
+		Value: float64(len(cs.Hashes)),
+	}, apis.Measurement{
+		Name:  "zircon_chunkserver_staged_bytes",
+		Help:  "The amount of data staged but not yet committed.",
+		Value: float64(cs.stagedTotal),
+	})
+}
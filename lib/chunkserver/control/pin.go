@@ -0,0 +1,79 @@
+package control
+
+import (
+	"fmt"
+
+	"zircon/lib/apis"
+)
+
+// A pinned version is never reclaimed: retireVersion leaves it alone, and a deleted chunk keeps its tombstone while any
+// of its versions are pinned, so that purgeChunk doesn't get to them. Once the last pin on a version is released, it is
+// retired just as it would have been without the pin.
+
+func (cs *chunkserver) isPinned(chunk apis.ChunkNum, version apis.Version) bool {
+	return cs.pins[apis.ChunkVersion{Chunk: chunk, Version: version}] > 0
+}
+
+func (cs *chunkserver) hasPins(chunk apis.ChunkNum) bool {
+	for pinned := range cs.pins {
+		if pinned.Chunk == chunk {
+			return true
+		}
+	}
+	return false
+}
+
+func (cs *chunkserver) Pin(chunk apis.ChunkNum, version apis.Version) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if err := cs.reclaimExpired(); err != nil {
+		return err
+	}
+
+	latest, err := cs.Storage.GetLatestVersion(chunk)
+	if tombstone, deleted := cs.deleted[chunk]; deleted {
+		latest = tombstone.Version
+	} else if err != nil {
+		return err
+	}
+	if version > latest {
+		return fmt.Errorf("version %d/%d has not been written: %w", chunk, version, apis.ErrNotFound)
+	}
+	if version != latest && !cs.isRetained(chunk, version) && !cs.isPinned(chunk, version) {
+		return fmt.Errorf("version %d/%d is no longer retained: %w", chunk, version, apis.ErrVersionReclaimed)
+	}
+	cs.pins[apis.ChunkVersion{Chunk: chunk, Version: version}]++
+	// the version no longer expires, so it doesn't need to stay in line to be reclaimed
+	if index := cs.findSuperseded(chunk, version); index >= 0 {
+		cs.superseded = append(cs.superseded[:index], cs.superseded[index+1:]...)
+	}
+	return nil
+}
+
+func (cs *chunkserver) Unpin(chunk apis.ChunkNum, version apis.Version) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	key := apis.ChunkVersion{Chunk: chunk, Version: version}
+	if cs.pins[key] == 0 {
+		return fmt.Errorf("version %d/%d is not pinned: %w", chunk, version, apis.ErrNotFound)
+	}
+	if cs.pins[key]--; cs.pins[key] > 0 {
+		return nil
+	}
+	delete(cs.pins, key)
+
+	if _, deleted := cs.deleted[chunk]; deleted {
+		// reclaimed along with the rest of the chunk, once its tombstone expires
+		return cs.reclaimExpired()
+	}
+	latest, err := cs.Storage.GetLatestVersion(chunk)
+	if err != nil {
+		return err
+	}
+	if version < latest {
+		return cs.retireVersion(chunk, version)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package control
+
+import (
+	"errors"
+	"sync"
+
+	"zircon/lib/apis"
+)
+
+// Retires the versions that UpdateLatestVersion replaced on a background goroutine, so that a write doesn't wait for
+// their data to be deleted before it returns; see ChunkserverOptions.AsyncReclaim.
+// Nothing extra has to be recorded for this to survive a crash: once the new version is recorded as the latest one,
+// every older version is known to be unneeded, and any that are still stored are reclaimed when the chunkserver is
+// started again.
+type reclaimer struct {
+	// each entry is a chunk and the version that replaced the ones to retire; protected by the chunkserver's mu
+	pending []apis.ChunkVersion
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Deletes every stored version older than the latest version of its chunk. These are left behind when an earlier run
+// of the chunkserver stopped before UpdateLatestVersion got around to them.
+func (cs *chunkserver) reclaimSuperseded() error {
+	chunks, err := cs.Storage.ListChunksWithLatest()
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		latest, err := cs.Storage.GetLatestVersion(chunk)
+		if err != nil {
+			return err
+		}
+		versions, err := cs.Storage.ListVersions(chunk)
+		if err != nil {
+			return err
+		}
+		for _, version := range versions {
+			if version < latest {
+				cs.logger.Logf(apis.INFO, "reclaiming version %d of chunk %d, which was superseded before the chunkserver restarted", version, chunk)
+				if err := cs.deleteVersion(chunk, version); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Retires every version of a chunk older than 'version', and older than the version being served now, in case the
+// chunk changed since 'version' replaced them. Does nothing if the chunk no longer exists. Must be called with mu held.
+func (cs *chunkserver) retireOlder(chunk apis.ChunkNum, version apis.Version) error {
+	if err := cs.reclaimExpired(); err != nil {
+		return err
+	}
+	latest, err := cs.Storage.GetLatestVersion(chunk)
+	if errors.Is(err, apis.ErrNotFound) {
+		// deleted in the meantime, which takes care of every version
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if latest < version {
+		version = latest
+	}
+	versions, err := cs.Storage.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	for _, ver := range versions {
+		if ver < version {
+			if err := cs.retireVersion(chunk, ver); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Queues the versions of a chunk older than 'version' to be retired by the background goroutine. Must be called with mu
+// held.
+func (r *reclaimer) enqueue(chunk apis.ChunkNum, version apis.Version) {
+	r.pending = append(r.pending, apis.ChunkVersion{Chunk: chunk, Version: version})
+	select {
+	case r.wake <- struct{}{}:
+	default:
+		// already woken up, and will find this entry along with the rest
+	}
+}
+
+func (cs *chunkserver) reclaimInBackground(r *reclaimer) {
+	defer close(r.done)
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-r.wake:
+		}
+		cs.mu.Lock()
+		pending := r.pending
+		r.pending = nil
+		for _, entry := range pending {
+			if err := cs.retireOlder(entry.Chunk, entry.Version); err != nil {
+				// the versions are still older than the latest one, so a restart will find them again
+				cs.logger.Logf(apis.WARN, "could not reclaim versions of chunk %d older than %d: %v", entry.Chunk, entry.Version, err)
+			}
+		}
+		cs.mu.Unlock()
+	}
+}
+
+// Stops the background goroutine and waits for it to finish what it was doing. Whatever is still queued is left for
+// the next run of the chunkserver to find.
+func (r *reclaimer) shutdown() {
+	r.once.Do(func() {
+		close(r.stop)
+	})
+	<-r.done
+}
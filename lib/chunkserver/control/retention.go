@@ -0,0 +1,169 @@
+package control
+
+import (
+	"fmt"
+	"time"
+
+	"zircon/lib/apis"
+)
+
+// A version of a chunk that is no longer served, but whose data is kept until a point in time so that it can be
+// restored with Undelete; see ChunkserverOptions.Retention.
+// Which data is being retained is only remembered in memory: anything that was still being retained when a chunkserver
+// stops is reclaimed when it is started again.
+type retainedVersion struct {
+	Chunk   apis.ChunkNum
+	Version apis.Version
+	Until   time.Time
+}
+
+// Reclaims the data of chunks that were deleted while being retained by an earlier run of the chunkserver.
+func (cs *chunkserver) reclaimOrphans() error {
+	withData, err := cs.Storage.ListChunksWithData()
+	if err != nil {
+		return err
+	}
+	withLatest, err := cs.Storage.ListChunksWithLatest()
+	if err != nil {
+		return err
+	}
+	live := map[apis.ChunkNum]bool{}
+	for _, chunk := range withLatest {
+		live[chunk] = true
+	}
+	for _, chunk := range withData {
+		if !live[chunk] {
+			cs.logger.Logf(apis.INFO, "reclaiming chunk %d, which was deleted before the chunkserver restarted", chunk)
+			if err := cs.purgeChunk(chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (cs *chunkserver) isRetained(chunk apis.ChunkNum, version apis.Version) bool {
+	if _, deleted := cs.deleted[chunk]; deleted {
+		return true
+	}
+	return cs.findSuperseded(chunk, version) >= 0
+}
+
+func (cs *chunkserver) findSuperseded(chunk apis.ChunkNum, version apis.Version) int {
+	for i, retained := range cs.superseded {
+		if retained.Chunk == chunk && retained.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// Stops serving a version of a chunk, and either retains it or deletes it right away if there is no retention window.
+// A pinned version is left alone, and retired once it is unpinned instead.
+func (cs *chunkserver) retireVersion(chunk apis.ChunkNum, version apis.Version) error {
+	if cs.isPinned(chunk, version) {
+		return nil
+	}
+	if cs.retention <= 0 {
+		return cs.deleteVersion(chunk, version)
+	}
+	if !cs.isRetained(chunk, version) {
+		cs.superseded = append(cs.superseded, retainedVersion{
+			Chunk:   chunk,
+			Version: version,
+			Until:   cs.now().Add(cs.retention),
+		})
+	}
+	return nil
+}
+
+// Deletes every version of a chunk, and forgets that any of them were being retained.
+func (cs *chunkserver) purgeChunk(chunk apis.ChunkNum) error {
+	versions, err := cs.Storage.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if err := cs.deleteVersion(chunk, version); err != nil {
+			return err
+		}
+	}
+	delete(cs.deleted, chunk)
+	for pinned := range cs.pins {
+		if pinned.Chunk == chunk {
+			delete(cs.pins, pinned)
+		}
+	}
+	kept := cs.superseded[:0]
+	for _, retained := range cs.superseded {
+		if retained.Chunk != chunk {
+			kept = append(kept, retained)
+		}
+	}
+	cs.superseded = kept
+	return nil
+}
+
+// Reclaims the data of every retained version whose retention window has passed.
+func (cs *chunkserver) reclaimExpired() error {
+	now := cs.now()
+	for chunk, retained := range cs.deleted {
+		if !now.Before(retained.Until) && !cs.hasPins(chunk) {
+			cs.logger.Logf(apis.DEBUG, "reclaiming deleted chunk %d", chunk)
+			if err := cs.purgeChunk(chunk); err != nil {
+				return err
+			}
+		}
+	}
+	for i, retained := range cs.superseded {
+		if !now.Before(retained.Until) {
+			cs.logger.Logf(apis.DEBUG, "reclaiming superseded version %d of chunk %d", retained.Version, retained.Chunk)
+			if err := cs.deleteVersion(retained.Chunk, retained.Version); err != nil {
+				cs.superseded = cs.superseded[i:]
+				return err
+			}
+			continue
+		}
+		// entries are retained in order, so everything from here on is still within its window
+		cs.superseded = cs.superseded[i:]
+		return nil
+	}
+	cs.superseded = nil
+	return nil
+}
+
+func (cs *chunkserver) Undelete(chunk apis.ChunkNum, version apis.Version) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if err := cs.reclaimExpired(); err != nil {
+		return err
+	}
+
+	index := cs.findSuperseded(chunk, version)
+	tombstone, deleted := cs.deleted[chunk]
+	if index < 0 && !(deleted && tombstone.Version == version) {
+		return fmt.Errorf("no retained copy of %d/%d: %w", chunk, version, apis.ErrNotFound)
+	}
+	var replaced apis.Version
+	if deleted {
+		replaced = tombstone.Version
+	} else {
+		latest, err := cs.Storage.GetLatestVersion(chunk)
+		if err != nil {
+			return err
+		}
+		replaced = latest
+	}
+	if err := cs.Storage.SetLatestVersion(chunk, version); err != nil {
+		return err
+	}
+	delete(cs.deleted, chunk)
+	if index >= 0 {
+		cs.superseded = append(cs.superseded[:index], cs.superseded[index+1:]...)
+	}
+	if replaced != version {
+		return cs.retireVersion(chunk, replaced)
+	}
+	return nil
+}
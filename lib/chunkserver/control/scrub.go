@@ -0,0 +1,159 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"zircon/lib/apis"
+)
+
+// How often chunkservers should scrub every chunk they hold, when scrubbing in the background.
+const ScrubFreq = 6 * time.Hour
+
+// Explanation of scrubbing:
+//     Storage can damage data long after it was written, and a chunk that nobody reads would keep a damaged replica
+//     until the other replicas are lost as well. Scrubbing reads back every version this chunkserver stores and checks it
+//     against the checksum kept from when it was written (see checksum.go). Versions written before the chunkserver
+//     started have no checksum yet, so the first scrub records one taken from storage, and later scrubs check against it.
+//     A chunk whose latest version is found to be corrupt is deleted from this chunkserver, as Delete would, so that it
+//     is no longer served. Anti-entropy, which compares the versions each replica holds against the chunk's metadata
+//     entry, then drops this replica from the entry, and the replicator replaces it with a copy of a good replica.
+//     A corrupt version newer than the latest one, which was committed but not yet published, is deleted by itself, so
+//     that publishing it fails and the replica is caught up instead. Corrupt versions older than the latest one are
+//     only being kept for Undelete and pinned reads, and are reported but left alone.
+//     Each chunk is scrubbed with the chunkserver locked, but the lock is released between chunks, so that a pass
+//     doesn't hold up reads and writes for longer than it takes to read a single chunk.
+
+// What scrubbing has found, totalled over every pass so far.
+type ScrubStats struct {
+	Passes int
+	// Versions whose data was read back and checked against its checksum.
+	Checked int
+	// Versions that had no checksum to check against, which had one recorded from storage instead.
+	Recorded int
+	// Versions whose data no longer matched its checksum.
+	Corrupt int
+	// Chunks deleted from this chunkserver because their latest version was corrupt.
+	Dropped int
+}
+
+type scrubber struct {
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Scrubs every chunk on this chunkserver once, and deletes those whose latest version turns out to be corrupt. Chunks
+// that are added while the pass is in progress are left for the next one.
+func (cs *chunkserver) Scrub() error {
+	return cs.scrub(nil)
+}
+
+// Like Scrub, but gives up partway through once 'stop' is closed.
+func (cs *chunkserver) scrub(stop <-chan struct{}) error {
+	cs.mu.Lock()
+	chunks, err := cs.Storage.ListChunksWithLatest()
+	cs.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("[scrub.go/LCL] %w", err)
+	}
+	for _, chunk := range chunks {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		if err := cs.scrubChunk(chunk); err != nil {
+			return fmt.Errorf("[scrub.go/SCC] %w", err)
+		}
+	}
+	cs.mu.Lock()
+	cs.scrubStats.Passes++
+	cs.mu.Unlock()
+	return nil
+}
+
+func (cs *chunkserver) ScrubStats() ScrubStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.scrubStats
+}
+
+func (cs *chunkserver) scrubChunk(chunk apis.ChunkNum) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	latest, err := cs.Storage.GetLatestVersion(chunk)
+	if errors.Is(err, apis.ErrNotFound) {
+		// deleted since the pass started
+		return nil
+	} else if err != nil {
+		return err
+	}
+	versions, err := cs.Storage.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		data, err := cs.Storage.ReadVersion(chunk, version)
+		if err != nil {
+			return err
+		}
+		cs.scrubStats.Checked++
+		key := apis.ChunkVersion{Chunk: chunk, Version: version}
+		actual := wholeChunkChecksum(data)
+		expected, found := cs.checksums[key]
+		if !found {
+			cs.scrubStats.Recorded++
+			cs.checksums[key] = actual
+			continue
+		}
+		if actual == expected {
+			continue
+		}
+		cs.scrubStats.Corrupt++
+		switch {
+		case version == latest:
+			cs.logger.Logf(apis.ERROR, "deleting chunk %d, whose latest version %d is corrupt: checksum is %08x instead of %08x", chunk, version, actual, expected)
+			if err := cs.deleteChunk(chunk, latest); err != nil {
+				return err
+			}
+			cs.scrubStats.Dropped++
+			// the rest of the versions went with it
+			return nil
+		case version > latest:
+			cs.logger.Logf(apis.ERROR, "deleting unpublished version %d of chunk %d, which is corrupt: checksum is %08x instead of %08x", version, chunk, actual, expected)
+			if err := cs.deleteVersion(chunk, version); err != nil {
+				return err
+			}
+		default:
+			cs.logger.Logf(apis.WARN, "retained version %d of chunk %d is corrupt: checksum is %08x instead of %08x", version, chunk, actual, expected)
+		}
+	}
+	return nil
+}
+
+func (cs *chunkserver) scrubInBackground(s *scrubber) {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(s.interval):
+		}
+		if err := cs.scrub(s.stop); err != nil {
+			cs.logger.Logf(apis.ERROR, "error during scrub: %v", err)
+		}
+	}
+}
+
+// Stops the background goroutine, and waits for it to finish the chunk it was scrubbing, if any.
+func (s *scrubber) shutdown() {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+}
@@ -0,0 +1,77 @@
+package control
+
+import (
+	"zircon/lib/apis"
+	"zircon/lib/chunkserver/storage"
+)
+
+// When the storage layer can keep a log of staged writes, every write staged by StartWrite is recorded there before
+// StartWrite returns, and forgotten once it is unstaged, so that a write that was staged but not yet committed when the
+// chunkserver went down can still be committed after it comes back up.
+
+// Restages the writes that the storage layer still had logged from before a restart. Must be called before the
+// chunkserver is used.
+func (cs *chunkserver) recoverStagedWrites() error {
+	log, ok := cs.Storage.(storage.StagingLog)
+	if !ok {
+		return nil
+	}
+	writes, err := log.ListStagedWrites()
+	if err != nil {
+		return err
+	}
+	now := cs.now()
+	for _, write := range writes {
+		key := stagedWrite{Chunk: write.Chunk, Hash: write.Hash}
+		_, err := cs.Storage.GetLatestVersion(write.Chunk)
+		full := cs.stagedPerChunk[write.Chunk]+len(write.Data) > cs.maxPerChunk ||
+			cs.stagedTotal+len(write.Data) > cs.maxTotal
+		if err != nil || full {
+			// the chunk is gone, or the limits shrank since the write was staged; either way, it can't be kept
+			cs.logger.Logf(apis.DEBUG, "discarding write %s, which was staged before a restart", key.Hash)
+			if err := log.ForgetStagedWrite(write.Chunk, write.Hash); err != nil {
+				return err
+			}
+			continue
+		}
+		if !write.Append && apis.CalculateCommitHash(write.Offset, write.Data) != write.Hash ||
+			write.Append && apis.CalculateAppendHash(write.Data) != write.Hash {
+			// damaged in the log, and committing it would store the damage
+			cs.logger.Logf(apis.WARN, "discarding write %s, which no longer matches its hash after a restart", key.Hash)
+			if err := log.ForgetStagedWrite(write.Chunk, write.Hash); err != nil {
+				return err
+			}
+			continue
+		}
+		// the write gets a full lifetime from now, since there's no telling how long the chunkserver was down
+		cs.Hashes[key] = commit{Offset: write.Offset, Data: write.Data, Staged: now, Append: write.Append,
+			Checksum: apis.CalculateChecksum(write.Data)}
+		cs.stagedPerChunk[write.Chunk] += len(write.Data)
+		cs.stagedTotal += len(write.Data)
+	}
+	return nil
+}
+
+// Records a staged write in the storage layer's log, if it keeps one.
+func (cs *chunkserver) logStagedWrite(key stagedWrite, write commit) error {
+	if log, ok := cs.Storage.(storage.StagingLog); ok {
+		return log.LogStagedWrite(storage.StagedWrite{
+			Chunk:  key.Chunk,
+			Hash:   key.Hash,
+			Offset: write.Offset,
+			Data:   write.Data,
+			Append: write.Append,
+		})
+	}
+	return nil
+}
+
+// Removes a write from the storage layer's log, if it keeps one.
+func (cs *chunkserver) forgetStagedWrite(key stagedWrite) {
+	if log, ok := cs.Storage.(storage.StagingLog); ok {
+		if err := log.ForgetStagedWrite(key.Chunk, key.Hash); err != nil {
+			// the write is then recovered after a restart, and expires again; nothing is lost
+			cs.logger.Logf(apis.WARN, "could not forget staged write %s: %v", key.Hash, err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package chunkserver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"zircon/lib/apis"
+	"zircon/lib/logging"
+)
+
+// How many heartbeats a chunkserver sends per liveness timeout, so that one or two being slow or lost doesn't get it
+// considered down.
+const HeartbeatsPerTimeout = 4
+
+// Sends a heartbeat to etcd once, and then HeartbeatsPerTimeout times per 'timeout' on a background goroutine, until
+// the returned function is called. If the chunkserver stops sending them for 'timeout', such as because it crashed, it
+// is considered down: no new replicas are placed on it, and its replicas are replaced elsewhere. Fails without starting
+// the goroutine if the first heartbeat cannot be sent.
+func StartHeartbeats(etcd apis.EtcdInterface, timeout time.Duration, logger apis.Logger) (stop func(), err error) {
+	stop, _, err = StartCheckedHeartbeats(etcd, timeout, logger)
+	return stop, err
+}
+
+// Like StartHeartbeats, but also returns a check that fails once heartbeats have failed for long enough that the
+// chunkserver may already be considered down, which can be given to WithChatterChecks as the "etcd" dependency.
+func StartCheckedHeartbeats(etcd apis.EtcdInterface, timeout time.Duration, logger apis.Logger) (stop func(), check func() error, err error) {
+	logger = logging.Component(logger, "chunkserver")
+	if err := etcd.Heartbeat(timeout); err != nil {
+		return nil, nil, err
+	}
+	var mu sync.Mutex
+	lastSent := time.Now()
+	var lastErr error
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(timeout / HeartbeatsPerTimeout):
+			}
+			err := etcd.Heartbeat(timeout)
+			if err != nil {
+				logger.Logf(apis.WARN, "could not send heartbeat: %v", err)
+			}
+			mu.Lock()
+			if err == nil {
+				lastSent = time.Now()
+			}
+			lastErr = err
+			mu.Unlock()
+		}
+	}()
+	check = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		// a single lost heartbeat doesn't get the chunkserver considered down, so it doesn't make it unready either
+		since := time.Since(lastSent)
+		if since < timeout {
+			return nil
+		}
+		if lastErr == nil {
+			// the heartbeat being sent now has taken this long
+			return fmt.Errorf("no heartbeat has reached etcd for %v", since.Round(time.Millisecond))
+		}
+		return fmt.Errorf("no heartbeat has reached etcd for %v: %w", since.Round(time.Millisecond), lastErr)
+	}
+	return func() {
+		close(stopCh)
+		<-done
+	}, check, nil
+}
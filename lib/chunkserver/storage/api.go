@@ -31,7 +31,7 @@ type ChunkStorage interface {
 	ListChunksWithLatest() ([]apis.ChunkNum, error)
 
 	// Get the "latest version" (to report to clients) of a particular chunk.
-	// Returns an error if no version was stored for this chunk.
+	// Returns an error matching apis.ErrNotFound if no version was stored for this chunk.
 	GetLatestVersion(chunk apis.ChunkNum) (apis.Version, error)
 	// Update the "latest version" (to report to clients) of a particular chunk.
 	SetLatestVersion(chunk apis.ChunkNum, latest apis.Version) error
@@ -42,3 +42,40 @@ type ChunkStorage interface {
 	// Use of other methods after call this method is undefined behavior. Calling Close() again has no effect.
 	Close()
 }
+
+// A write that was staged by StartWrite, but has not yet been committed.
+type StagedWrite struct {
+	Chunk  apis.ChunkNum
+	Hash   apis.CommitHash
+	Offset uint32
+	Data   []byte
+	// whether this was staged by StartAppend, in which case Offset is unused
+	Append bool
+}
+
+// Implemented by storage that can keep staged writes across a restart of the chunkserver, so that a write that was
+// staged before a crash can still be committed afterwards. Like ChunkStorage, this is NOT threadsafe.
+type StagingLog interface {
+	// Durably record a staged write, replacing any earlier record of a write with the same chunk and hash.
+	LogStagedWrite(write StagedWrite) error
+	// Drop the record of a staged write, once it has been committed or abandoned. Dropping a write that was never
+	// recorded has no effect. This need not be flushed to disk before it returns.
+	ForgetStagedWrite(chunk apis.ChunkNum, hash apis.CommitHash) error
+	// List every staged write that has been recorded and not yet forgotten, including those from before a restart, in
+	// no particular order.
+	ListStagedWrites() ([]StagedWrite, error)
+}
+
+// Implemented by storage that can cheaply report how much chunk data it holds, so that a chunkserver can include it in
+// its metrics. Like ChunkStorage, this is NOT threadsafe.
+type UsageReporter interface {
+	// The total size of every stored version of every chunk, not counting the storage layer's own overhead.
+	StoredBytes() (uint64, error)
+}
+
+// Implemented by storage that can say how much room it has left, so that a chunkserver can report it and new replicas
+// can be placed where there is space. Like ChunkStorage, this is NOT threadsafe.
+type CapacityReporter interface {
+	// The space still free for storing chunks, and the total size of the storage, both in bytes.
+	Capacity() (free uint64, total uint64, err error)
+}
@@ -0,0 +1,27 @@
+package storage
+
+import "fmt"
+
+// The storage section of a chunkserver's configuration, such as config-example/cs0.yaml.
+type Configuration struct {
+	// One of "disk", "filesystem", "block", or "memory"
+	StorageType string `yaml:"storage-type"`
+	// The directory for disk or filesystem storage, or the device for block storage; unused for memory storage
+	StoragePath string `yaml:"storage-path"`
+}
+
+// Constructs whichever kind of storage a chunkserver's configuration asks for.
+func ConfigureStorage(config Configuration) (ChunkStorage, error) {
+	switch config.StorageType {
+	case "disk":
+		return ConfigureDiskStorage(config.StoragePath)
+	case "filesystem":
+		return ConfigureFilesystemStorage(config.StoragePath)
+	case "block":
+		return ConfigureBlockStorage(config.StoragePath)
+	case "memory":
+		return ConfigureMemoryStorage()
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", config.StorageType)
+	}
+}
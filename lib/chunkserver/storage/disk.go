@@ -0,0 +1,660 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"zircon/lib/apis"
+)
+
+// DiskStorage keeps each version of a chunk in a file of its own, like FilesystemStorage, but is safe against crashes:
+// every file is written under a temporary name, flushed, and only then moved into place, so that after a crash, each
+// version and each latest version is either entirely present or entirely absent. Whatever temporary files a crash
+// leaves behind are removed when the storage is next opened.
+//
+// Staged writes are kept in a write-ahead log, which records each write as it is staged and again once it is no
+// longer needed. When the storage is opened, the log is replayed to find which writes are still staged; a record that
+// was torn by a crash is discarded along with anything after it.
+//
+// The layout of the directory is:
+//
+//	chunks/<chunk>/<version>   the data of each version of each chunk
+//	latest/<chunk>             the latest version of each chunk, in decimal
+//	staging.log                the write-ahead log of staged writes
+type DiskStorage struct {
+	isClosed bool
+	path     string
+
+	log     *os.File
+	logSize int64
+	// where the most recent record of each write that is still staged is in the log, and the total size of those
+	// records, which is how much of the log a compaction would keep
+	staged     map[stagedKey]logRecord
+	stagedSize int64
+}
+
+type stagedKey struct {
+	chunk apis.ChunkNum
+	hash  apis.CommitHash
+}
+
+type logRecord struct {
+	position int64
+	size     int64
+}
+
+const stagingLogName = "staging.log"
+
+// Files are written under this suffix before they are moved into place.
+const tempSuffix = ".tmp"
+
+// The log is compacted once the records it holds for writes that are no longer staged take up more than this, and
+// more than the records for the writes that still are.
+const compactThreshold = apis.MaxChunkSize
+
+// Each record in the log is a header, holding a CRC-32 of the payload and then the length of the payload, followed
+// by the payload: an operation, the chunk, the length of the hash and the hash itself, and then, for a staged write or
+// append, the offset and data of the write.
+const recordHeaderSize = 8
+
+const (
+	opStage  byte = 1
+	opForget byte = 2
+	opAppend byte = 3
+)
+
+// Given a base path for storage of files in a modern filesystem, construct an interface by which a chunkserver can store
+// chunks, which survives crashes and keeps staged writes across restarts. The directory is created if it doesn't exist,
+// and anything left incomplete by a crash is recovered.
+func ConfigureDiskStorage(basepath string) (ChunkStorage, error) {
+	d := &DiskStorage{
+		path:   basepath,
+		staged: map[stagedKey]logRecord{},
+	}
+	for _, dir := range []string{basepath, d.chunksDir(), d.latestDir()} {
+		if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+			return nil, fmt.Errorf("[disk.go/MKD] %w", err)
+		}
+	}
+	if err := d.recoverFiles(); err != nil {
+		return nil, fmt.Errorf("[disk.go/RCF] %w", err)
+	}
+	if err := d.recoverLog(); err != nil {
+		return nil, fmt.Errorf("[disk.go/RCL] %w", err)
+	}
+	return d, nil
+}
+
+func (d *DiskStorage) assertOpen() {
+	if d.isClosed {
+		panic("attempt to use closed DiskStorage")
+	}
+}
+
+func (d *DiskStorage) chunksDir() string {
+	return filepath.Join(d.path, "chunks")
+}
+
+func (d *DiskStorage) latestDir() string {
+	return filepath.Join(d.path, "latest")
+}
+
+func (d *DiskStorage) chunkDir(chunk apis.ChunkNum) string {
+	return filepath.Join(d.chunksDir(), strconv.FormatUint(uint64(chunk), 10))
+}
+
+func (d *DiskStorage) chunkFilename(chunk apis.ChunkNum, version apis.Version) string {
+	return filepath.Join(d.chunkDir(chunk), strconv.FormatUint(uint64(version), 10))
+}
+
+func (d *DiskStorage) latestFilename(chunk apis.ChunkNum) string {
+	return filepath.Join(d.latestDir(), strconv.FormatUint(uint64(chunk), 10))
+}
+
+func (d *DiskStorage) logFilename() string {
+	return filepath.Join(d.path, stagingLogName)
+}
+
+// Flushes the entries of a directory, so that files created, renamed, or removed in it stay that way after a crash.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if err1 := dir.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// Writes out a file under a temporary name next to 'filename', and flushes it to disk.
+func writeTemporary(filename string, data []byte) (string, error) {
+	temp := filename + tempSuffix
+	f, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0644))
+	if err != nil {
+		return "", err
+	}
+	n, err := f.Write(data)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		_ = os.Remove(temp)
+		return "", err
+	}
+	return temp, nil
+}
+
+// Atomically creates 'filename' holding 'data', failing if it already exists. The file is linked into place rather
+// than renamed, because only a link refuses to replace an existing file.
+func createAtomic(filename string, data []byte) error {
+	temp, err := writeTemporary(filename, data)
+	if err != nil {
+		return err
+	}
+	err = os.Link(temp, filename)
+	// if this fails, recovery removes the temporary file later
+	_ = os.Remove(temp)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
+}
+
+// Atomically replaces 'filename' with a file holding 'data'.
+func replaceAtomic(filename string, data []byte) error {
+	temp, err := writeTemporary(filename, data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(temp, filename); err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
+}
+
+// Removes 'filename', and makes sure that it stays removed.
+func removeDurably(filename string) error {
+	if err := os.Remove(filename); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
+}
+
+// Removes any temporary files left behind by a crash, along with directories of chunks that no longer have any
+// versions.
+func (d *DiskStorage) recoverFiles() error {
+	for _, dir := range []string{d.path, d.latestDir()} {
+		if _, err := removeTemporaries(dir); err != nil {
+			return err
+		}
+	}
+	fis, err := ioutil.ReadDir(d.chunksDir())
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		dir := filepath.Join(d.chunksDir(), fi.Name())
+		if !fi.IsDir() {
+			if strings.HasSuffix(fi.Name(), tempSuffix) {
+				if err := os.Remove(dir); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		remaining, err := removeTemporaries(dir)
+		if err != nil {
+			return err
+		}
+		if remaining == 0 {
+			if err := os.Remove(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return syncDir(d.chunksDir())
+}
+
+// Removes the temporary files in a directory, and returns how many other entries it has.
+func removeTemporaries(dir string) (int, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	remaining := 0
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), tempSuffix) {
+			remaining++
+		} else if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+			return 0, err
+		}
+	}
+	if remaining < len(fis) {
+		return remaining, syncDir(dir)
+	}
+	return remaining, nil
+}
+
+// Lists the names in a directory that are decimal numbers, ignoring temporary files.
+func listNumbered(dir string) ([]uint64, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []uint64
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), tempSuffix) {
+			continue
+		}
+		n, err := strconv.ParseUint(fi.Name(), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected file %s in %s: %v", fi.Name(), dir, err)
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
+
+func (d *DiskStorage) ListChunksWithData() ([]apis.ChunkNum, error) {
+	d.assertOpen()
+	numbers, err := listNumbered(d.chunksDir())
+	if err != nil {
+		return nil, err
+	}
+	result := make([]apis.ChunkNum, len(numbers))
+	for i, n := range numbers {
+		result[i] = apis.ChunkNum(n)
+	}
+	return result, nil
+}
+
+func (d *DiskStorage) ListVersions(chunk apis.ChunkNum) ([]apis.Version, error) {
+	d.assertOpen()
+	numbers, err := listNumbered(d.chunkDir(chunk))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var result []apis.Version
+	for _, n := range numbers {
+		result = append(result, apis.Version(n))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+	return result, nil
+}
+
+func (d *DiskStorage) ReadVersion(chunk apis.ChunkNum, version apis.Version) ([]byte, error) {
+	d.assertOpen()
+	data, err := ioutil.ReadFile(d.chunkFilename(chunk, version))
+	return data, translateError(err)
+}
+
+func (d *DiskStorage) WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
+	d.assertOpen()
+	if len(data) > apis.MaxChunkSize {
+		return fmt.Errorf("chunk %d/%d = data[%d]: %w", chunk, version, len(data), apis.ErrChunkTooLarge)
+	}
+	err := os.Mkdir(d.chunkDir(chunk), os.FileMode(0755))
+	if err == nil {
+		err = syncDir(d.chunksDir())
+	} else if os.IsExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	return translateError(createAtomic(d.chunkFilename(chunk, version), data))
+}
+
+func (d *DiskStorage) DeleteVersion(chunk apis.ChunkNum, version apis.Version) error {
+	d.assertOpen()
+	if err := removeDurably(d.chunkFilename(chunk, version)); err != nil {
+		return translateError(err)
+	}
+	// only succeeds once the last version is gone; if a crash leaves the directory behind, recovery removes it
+	if os.Remove(d.chunkDir(chunk)) == nil {
+		return syncDir(d.chunksDir())
+	}
+	return nil
+}
+
+// Reports the space on the filesystem that holds the storage directory, as seen by an unprivileged user.
+func (d *DiskStorage) Capacity() (uint64, uint64, error) {
+	d.assertOpen()
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(d.path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
+
+func (d *DiskStorage) StoredBytes() (uint64, error) {
+	d.assertOpen()
+	chunks, err := d.ListChunksWithData()
+	if err != nil {
+		return 0, err
+	}
+	total := uint64(0)
+	for _, chunk := range chunks {
+		files, err := ioutil.ReadDir(d.chunkDir(chunk))
+		if err != nil {
+			return 0, err
+		}
+		for _, fi := range files {
+			total += uint64(fi.Size())
+		}
+	}
+	return total, nil
+}
+
+func (d *DiskStorage) ListChunksWithLatest() ([]apis.ChunkNum, error) {
+	d.assertOpen()
+	numbers, err := listNumbered(d.latestDir())
+	if err != nil {
+		return nil, err
+	}
+	result := make([]apis.ChunkNum, len(numbers))
+	for i, n := range numbers {
+		result[i] = apis.ChunkNum(n)
+	}
+	return result, nil
+}
+
+func (d *DiskStorage) GetLatestVersion(chunk apis.ChunkNum) (apis.Version, error) {
+	d.assertOpen()
+	data, err := ioutil.ReadFile(d.latestFilename(chunk))
+	if err != nil {
+		return 0, translateError(err)
+	}
+	ver, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return apis.Version(ver), nil
+}
+
+func (d *DiskStorage) SetLatestVersion(chunk apis.ChunkNum, latest apis.Version) error {
+	d.assertOpen()
+	return replaceAtomic(d.latestFilename(chunk), []byte(fmt.Sprintln(latest)))
+}
+
+func (d *DiskStorage) DeleteLatestVersion(chunk apis.ChunkNum) error {
+	d.assertOpen()
+	return translateError(removeDurably(d.latestFilename(chunk)))
+}
+
+func encodeRecord(op byte, chunk apis.ChunkNum, hash apis.CommitHash, offset uint32, data []byte) []byte {
+	size := 1 + 8 + 2 + len(hash)
+	if op != opForget {
+		size += 4 + len(data)
+	}
+	record := make([]byte, recordHeaderSize+size)
+	payload := record[recordHeaderSize:]
+	payload[0] = op
+	binary.LittleEndian.PutUint64(payload[1:], uint64(chunk))
+	binary.LittleEndian.PutUint16(payload[9:], uint16(len(hash)))
+	rest := payload[11+copy(payload[11:], hash):]
+	if op != opForget {
+		binary.LittleEndian.PutUint32(rest, offset)
+		copy(rest[4:], data)
+	}
+	binary.LittleEndian.PutUint32(record[0:], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(record[4:], uint32(size))
+	return record
+}
+
+// Decodes the payload of a record whose checksum has already been verified.
+func decodeRecord(payload []byte) (op byte, write StagedWrite, err error) {
+	if len(payload) < 11 {
+		return 0, write, errors.New("record too short")
+	}
+	op = payload[0]
+	write.Chunk = apis.ChunkNum(binary.LittleEndian.Uint64(payload[1:]))
+	hashEnd := 11 + int(binary.LittleEndian.Uint16(payload[9:]))
+	if hashEnd > len(payload) {
+		return 0, write, errors.New("hash overruns record")
+	}
+	write.Hash = apis.CommitHash(payload[11:hashEnd])
+	switch op {
+	case opStage, opAppend:
+		if hashEnd+4 > len(payload) {
+			return 0, write, errors.New("offset overruns record")
+		}
+		write.Offset = binary.LittleEndian.Uint32(payload[hashEnd:])
+		write.Data = payload[hashEnd+4:]
+		write.Append = op == opAppend
+	case opForget:
+		if hashEnd != len(payload) {
+			return 0, write, errors.New("trailing data in record")
+		}
+	default:
+		return 0, write, fmt.Errorf("unknown operation %d", op)
+	}
+	return op, write, nil
+}
+
+// Replays the log to find out which writes are still staged. The log ends at the first record that is incomplete or
+// fails its checksum, which is where a crash interrupted an append; it is truncated there, so that later records
+// don't end up after it.
+func (d *DiskStorage) recoverLog() error {
+	log, err := os.OpenFile(d.logFilename(), os.O_RDWR|os.O_CREATE, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	d.log = log
+
+	reader := bufio.NewReader(log)
+	var position int64
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			break
+		}
+		size := int64(binary.LittleEndian.Uint32(header[4:]))
+		if size > recordHeaderSize+2*apis.MaxChunkSize {
+			// a length this large can only be garbage, and isn't worth allocating
+			break
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header) {
+			break
+		}
+		op, write, err := decodeRecord(payload)
+		if err != nil {
+			break
+		}
+		record := logRecord{position: position, size: recordHeaderSize + size}
+		d.apply(op, stagedKey{chunk: write.Chunk, hash: write.Hash}, record)
+		position += record.size
+	}
+
+	if err := log.Truncate(position); err != nil {
+		return err
+	}
+	if _, err := log.Seek(position, io.SeekStart); err != nil {
+		return err
+	}
+	d.logSize = position
+	return d.maybeCompact()
+}
+
+// Updates the set of staged writes for a record that was just added to the log.
+func (d *DiskStorage) apply(op byte, key stagedKey, record logRecord) {
+	if old, found := d.staged[key]; found {
+		delete(d.staged, key)
+		d.stagedSize -= old.size
+	}
+	if op != opForget {
+		d.staged[key] = record
+		d.stagedSize += record.size
+	}
+}
+
+func (d *DiskStorage) appendRecord(record []byte, sync bool) (logRecord, error) {
+	_, err := d.log.Write(record)
+	if err == nil && sync {
+		err = d.log.Sync()
+	}
+	if err != nil {
+		// don't leave part of a record behind, since recovery would stop there and lose everything after it
+		if d.log.Truncate(d.logSize) == nil {
+			_, _ = d.log.Seek(d.logSize, io.SeekStart)
+		}
+		return logRecord{}, fmt.Errorf("[disk.go/APP] %w", err)
+	}
+	appended := logRecord{position: d.logSize, size: int64(len(record))}
+	d.logSize += appended.size
+	return appended, nil
+}
+
+func (d *DiskStorage) LogStagedWrite(write StagedWrite) error {
+	d.assertOpen()
+	if int(write.Offset)+len(write.Data) > apis.MaxChunkSize {
+		return fmt.Errorf("staged write %d@%d+%d: %w", write.Chunk, write.Offset, len(write.Data), apis.ErrChunkTooLarge)
+	}
+	op := opStage
+	if write.Append {
+		op = opAppend
+	}
+	record, err := d.appendRecord(encodeRecord(op, write.Chunk, write.Hash, write.Offset, write.Data), true)
+	if err != nil {
+		return err
+	}
+	d.apply(op, stagedKey{chunk: write.Chunk, hash: write.Hash}, record)
+	return d.maybeCompact()
+}
+
+func (d *DiskStorage) ForgetStagedWrite(chunk apis.ChunkNum, hash apis.CommitHash) error {
+	d.assertOpen()
+	key := stagedKey{chunk: chunk, hash: hash}
+	if _, found := d.staged[key]; !found {
+		return nil
+	}
+	// no need to flush: if this is lost, the write is just recovered again, and expires as if it were never committed
+	record, err := d.appendRecord(encodeRecord(opForget, chunk, hash, 0, nil), false)
+	if err != nil {
+		return err
+	}
+	d.apply(opForget, key, record)
+	return d.maybeCompact()
+}
+
+// Reads back the staged write stored in a record of the log.
+func (d *DiskStorage) readRecord(record logRecord) (StagedWrite, error) {
+	data := make([]byte, record.size)
+	if _, err := d.log.ReadAt(data, record.position); err != nil {
+		return StagedWrite{}, fmt.Errorf("[disk.go/RDR] %w", err)
+	}
+	_, write, err := decodeRecord(data[recordHeaderSize:])
+	return write, err
+}
+
+func (d *DiskStorage) ListStagedWrites() ([]StagedWrite, error) {
+	d.assertOpen()
+	var result []StagedWrite
+	for _, record := range d.staged {
+		write, err := d.readRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, write)
+	}
+	return result, nil
+}
+
+// Rewrites the log to hold only the records of writes that are still staged, once the rest take up too much of it.
+func (d *DiskStorage) maybeCompact() error {
+	garbage := d.logSize - d.stagedSize
+	if garbage <= compactThreshold || garbage <= d.stagedSize {
+		return nil
+	}
+	var keys []stagedKey
+	for key := range d.staged {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return d.staged[keys[i]].position < d.staged[keys[j]].position
+	})
+
+	temp := d.logFilename() + tempSuffix
+	compacted, err := os.OpenFile(temp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.FileMode(0644))
+	if err != nil {
+		return fmt.Errorf("[disk.go/CMP] %w", err)
+	}
+	staged := map[stagedKey]logRecord{}
+	var position int64
+	for _, key := range keys {
+		old := d.staged[key]
+		data := make([]byte, old.size)
+		_, err = d.log.ReadAt(data, old.position)
+		if err == nil {
+			_, err = compacted.Write(data)
+		}
+		if err != nil {
+			break
+		}
+		staged[key] = logRecord{position: position, size: old.size}
+		position += old.size
+	}
+	if err == nil {
+		err = compacted.Sync()
+	}
+	if err == nil {
+		err = os.Rename(temp, d.logFilename())
+	}
+	if err == nil {
+		err = syncDir(d.path)
+	}
+	if err != nil {
+		_ = compacted.Close()
+		_ = os.Remove(temp)
+		return fmt.Errorf("[disk.go/CMP] %w", err)
+	}
+	// the compacted log has replaced the old one on disk, so it has to be the one that is appended to from now on
+	_ = d.log.Close()
+	d.log = compacted
+	d.logSize = position
+	d.staged = staged
+	return nil
+}
+
+func (d *DiskStorage) Close() {
+	if d.isClosed {
+		return
+	}
+	d.isClosed = true
+	_ = d.log.Close()
+}
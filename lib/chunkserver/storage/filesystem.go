@@ -95,7 +95,18 @@ func (m *FilesystemStorage) ListVersions(chunk apis.ChunkNum) ([]apis.Version, e
 
 func (m *FilesystemStorage) ReadVersion(chunk apis.ChunkNum, version apis.Version) ([]byte, error) {
 	m.assertOpen()
-	return ioutil.ReadFile(m.chunkFilename(chunk, version))
+	data, err := ioutil.ReadFile(m.chunkFilename(chunk, version))
+	return data, translateError(err)
+}
+
+// Translates errors for missing or duplicate files into the errors used for missing or duplicate chunks.
+func translateError(err error) error {
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%v: %w", err, apis.ErrNotFound)
+	} else if os.IsExist(err) {
+		return fmt.Errorf("%v: %w", err, apis.ErrAlreadyExists)
+	}
+	return err
 }
 
 // based on ioutil.WriteFile
@@ -117,13 +128,13 @@ func writeFileNew(filename string, data []byte, perm os.FileMode) error {
 func (m *FilesystemStorage) WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
 	m.assertOpen()
 	if len(data) > apis.MaxChunkSize {
-		return fmt.Errorf("chunk is too large: %d/%s = data[%d]", chunk, version, len(data))
+		return fmt.Errorf("chunk %d/%d = data[%d]: %w", chunk, version, len(data), apis.ErrChunkTooLarge)
 	}
 	err := os.Mkdir(m.chunkDir(chunk), os.FileMode(0755))
 	if err != nil && !os.IsExist(err) {
 		return err
 	}
-	return writeFileNew(m.chunkFilename(chunk, version), data, os.FileMode(0644))
+	return translateError(writeFileNew(m.chunkFilename(chunk, version), data, os.FileMode(0644)))
 }
 
 func (m *FilesystemStorage) DeleteVersion(chunk apis.ChunkNum, version apis.Version) error {
@@ -133,7 +144,7 @@ func (m *FilesystemStorage) DeleteVersion(chunk apis.ChunkNum, version apis.Vers
 		// we don't care if this succeeds
 		_ = os.Remove(m.chunkDir(chunk))
 	}
-	return err
+	return translateError(err)
 }
 
 func (m *FilesystemStorage) ListChunksWithLatest() ([]apis.ChunkNum, error) {
@@ -159,7 +170,7 @@ func (m *FilesystemStorage) GetLatestVersion(chunk apis.ChunkNum) (apis.Version,
 	m.assertOpen()
 	data, err := ioutil.ReadFile(m.latestFilename(chunk))
 	if err != nil {
-		return 0, err
+		return 0, translateError(err)
 	}
 	ver, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
 	if err != nil {
@@ -175,7 +186,7 @@ func (m *FilesystemStorage) SetLatestVersion(chunk apis.ChunkNum, latest apis.Ve
 
 func (m *FilesystemStorage) DeleteLatestVersion(chunk apis.ChunkNum) error {
 	m.assertOpen()
-	return os.Remove(m.latestFilename(chunk))
+	return translateError(os.Remove(m.latestFilename(chunk)))
 }
 
 func (m *FilesystemStorage) Close() {
@@ -36,6 +36,17 @@ func (m *MemoryStorage) StatsForTesting() int {
 	return entryCount*32 + chunkCount*int(apis.MaxChunkSize)
 }
 
+func (m *MemoryStorage) StoredBytes() (uint64, error) {
+	m.assertOpen()
+	total := uint64(0)
+	for _, versions := range m.chunks {
+		for _, data := range versions {
+			total += uint64(len(data))
+		}
+	}
+	return total, nil
+}
+
 func (m *MemoryStorage) assertOpen() {
 	if m.isClosed {
 		panic("attempt to use closed MemoryStorage")
@@ -78,13 +89,13 @@ func (m *MemoryStorage) ReadVersion(chunk apis.ChunkNum, version apis.Version) (
 			return ndata, nil
 		}
 	}
-	return nil, fmt.Errorf("no such chunk/version combination: %d/%d", chunk, version)
+	return nil, fmt.Errorf("no such chunk/version combination %d/%d: %w", chunk, version, apis.ErrNotFound)
 }
 
 func (m *MemoryStorage) WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
 	m.assertOpen()
 	if len(data) > apis.MaxChunkSize {
-		return fmt.Errorf("chunk is too large: %d/%s = data[%d]", chunk, version, len(data))
+		return fmt.Errorf("chunk %d/%d = data[%d]: %w", chunk, version, len(data), apis.ErrChunkTooLarge)
 	}
 	versionMap := m.chunks[chunk]
 	if versionMap == nil {
@@ -93,7 +104,7 @@ func (m *MemoryStorage) WriteVersion(chunk apis.ChunkNum, version apis.Version,
 	}
 	existing, exists := versionMap[version]
 	if exists {
-		return fmt.Errorf("chunk/version combination already exists: %d/%d = data[%d]", chunk, version, len(existing))
+		return fmt.Errorf("chunk/version combination %d/%d = data[%d]: %w", chunk, version, len(existing), apis.ErrAlreadyExists)
 	}
 	ndata := make([]byte, len(data))
 	copy(ndata, data)
@@ -105,11 +116,11 @@ func (m *MemoryStorage) DeleteVersion(chunk apis.ChunkNum, version apis.Version)
 	m.assertOpen()
 	versionMap := m.chunks[chunk]
 	if versionMap == nil {
-		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, version)
+		return fmt.Errorf("chunk/version combination %d/%d: %w", chunk, version, apis.ErrNotFound)
 	}
 	_, exists := versionMap[version]
 	if !exists {
-		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, version)
+		return fmt.Errorf("chunk/version combination %d/%d: %w", chunk, version, apis.ErrNotFound)
 	}
 	delete(versionMap, version)
 	if len(versionMap) == 0 {
@@ -132,7 +143,7 @@ func (m *MemoryStorage) GetLatestVersion(chunk apis.ChunkNum) (apis.Version, err
 	if version, found := m.latest[chunk]; found {
 		return version, nil
 	}
-	return 0, fmt.Errorf("no latest version for chunk: %d", chunk)
+	return 0, fmt.Errorf("latest version for chunk %d: %w", chunk, apis.ErrNotFound)
 }
 
 func (m *MemoryStorage) SetLatestVersion(chunk apis.ChunkNum, latest apis.Version) error {
@@ -148,7 +159,7 @@ func (m *MemoryStorage) DeleteLatestVersion(chunk apis.ChunkNum) error {
 		delete(m.latest, chunk)
 		return nil
 	} else {
-		return fmt.Errorf("cannot delete nonexistent latest version for chunk: %d", chunk)
+		return fmt.Errorf("cannot delete latest version for chunk %d: %w", chunk, apis.ErrNotFound)
 	}
 }
 
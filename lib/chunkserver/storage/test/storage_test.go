@@ -1,11 +1,14 @@
 package test
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/require"
 	"testing"
+	"zircon/apis"
 	"zircon/chunkserver/storage"
 	"os"
 	"io/ioutil"
+	"path/filepath"
 )
 
 func TestMemoryStorage(t *testing.T) {
@@ -52,6 +55,154 @@ func TestFilesystemStorage(t *testing.T) {
 	TestVersionStorage(openStorage, closeStorage, resetStorage, t)
 }
 
+func TestDiskStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk-test-")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			t.Log("failed to clean up:", err)
+		}
+	}()
+	working := dir + "/test"
+	openStorage := func() storage.ChunkStorage {
+		cs, err := storage.ConfigureDiskStorage(working)
+		require.NoError(t, err)
+		return cs
+	}
+	closeStorage := func(storage storage.ChunkStorage) {
+		storage.Close()
+	}
+	resetStorage := func() {
+		require.NoError(t, os.RemoveAll(working))
+	}
+	TestChunkStorage(openStorage, closeStorage, resetStorage, t)
+	TestVersionStorage(openStorage, closeStorage, resetStorage, t)
+}
+
+// Tests that DiskStorage cleans up after a crash: files that were being written when it happened are discarded, and
+// staged writes are recovered from the log, up to a record that was torn partway through being appended.
+func TestDiskStorageRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk-test-")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			t.Log("failed to clean up:", err)
+		}
+	}()
+	open := func() (storage.ChunkStorage, storage.StagingLog) {
+		s, err := storage.ConfigureDiskStorage(dir)
+		require.NoError(t, err)
+		return s, s.(storage.StagingLog)
+	}
+
+	s, log := open()
+	require.NoError(t, s.WriteVersion(1, 1, []byte("hello")))
+	require.NoError(t, s.SetLatestVersion(1, 1))
+	first := storage.StagedWrite{Chunk: 1, Hash: "first", Offset: 0, Data: []byte("abandoned")}
+	second := storage.StagedWrite{Chunk: 1, Hash: "second", Offset: 3, Data: []byte("p!")}
+	require.NoError(t, log.LogStagedWrite(first))
+	require.NoError(t, log.LogStagedWrite(second))
+	require.NoError(t, log.ForgetStagedWrite(1, "first"))
+	s.Close()
+
+	// leave behind what a crash partway through WriteVersion, SetLatestVersion, DeleteVersion, and LogStagedWrite would
+	require.NoError(t, ioutil.WriteFile(dir+"/chunks/1/2.tmp", []byte("hel"), 0644))
+	require.NoError(t, ioutil.WriteFile(dir+"/latest/1.tmp", []byte("2\n"), 0644))
+	require.NoError(t, os.Mkdir(dir+"/chunks/5", 0755))
+	f, err := os.OpenFile(dir+"/staging.log", os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0x12, 0x34, 0x56, 0x78, 100, 0, 0, 0, 1, 1})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, log = open()
+	chunks, err := s.ListChunksWithData()
+	require.NoError(t, err)
+	require.Equal(t, []apis.ChunkNum{1}, chunks)
+	versions, err := s.ListVersions(1)
+	require.NoError(t, err)
+	require.Equal(t, []apis.Version{1}, versions)
+	latest, err := s.GetLatestVersion(1)
+	require.NoError(t, err)
+	require.Equal(t, apis.Version(1), latest)
+	for _, pattern := range []string{"/latest/*.tmp", "/chunks/*/*.tmp"} {
+		leftovers, err := filepath.Glob(dir + pattern)
+		require.NoError(t, err)
+		require.Empty(t, leftovers)
+	}
+	staged, err := log.ListStagedWrites()
+	require.NoError(t, err)
+	require.Equal(t, []storage.StagedWrite{second}, staged)
+
+	// records appended after recovery don't end up behind the torn one
+	third := storage.StagedWrite{Chunk: 1, Hash: "third", Offset: 1, Data: []byte("ELL")}
+	require.NoError(t, log.LogStagedWrite(third))
+	s.Close()
+	s, log = open()
+	defer s.Close()
+	staged, err = log.ListStagedWrites()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []storage.StagedWrite{second, third}, staged)
+}
+
+// Tests that the staging log of a DiskStorage is compacted, rather than growing forever, as writes are staged and
+// forgotten.
+func TestDiskStorageCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk-test-")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			t.Log("failed to clean up:", err)
+		}
+	}()
+	s, err := storage.ConfigureDiskStorage(dir)
+	require.NoError(t, err)
+	log := s.(storage.StagingLog)
+
+	kept := storage.StagedWrite{Chunk: 2, Hash: "kept", Offset: 0, Data: []byte("still staged")}
+	require.NoError(t, log.LogStagedWrite(kept))
+	data := make([]byte, 1024*1024)
+	for i := 0; i < 40; i++ {
+		hash := apis.CommitHash(fmt.Sprintf("hash-%d", i))
+		require.NoError(t, log.LogStagedWrite(storage.StagedWrite{Chunk: 3, Hash: hash, Data: data}))
+		require.NoError(t, log.ForgetStagedWrite(3, hash))
+	}
+	fi, err := os.Stat(dir + "/staging.log")
+	require.NoError(t, err)
+	require.True(t, fi.Size() <= 2*apis.MaxChunkSize, "log was not compacted: %d bytes", fi.Size())
+
+	s.Close()
+	s, err = storage.ConfigureDiskStorage(dir)
+	require.NoError(t, err)
+	defer s.Close()
+	staged, err := s.(storage.StagingLog).ListStagedWrites()
+	require.NoError(t, err)
+	require.Equal(t, []storage.StagedWrite{kept}, staged)
+}
+
+// Tests that a DiskStorage reports the free space of the filesystem that it is on.
+func TestDiskStorageCapacity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk-test-")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			t.Log("failed to clean up:", err)
+		}
+	}()
+	s, err := storage.ConfigureDiskStorage(dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	free, total, err := s.(storage.CapacityReporter).Capacity()
+	require.NoError(t, err)
+	require.True(t, total > 0)
+	require.True(t, free <= total, "%d bytes free out of %d", free, total)
+}
+
 /*
 func TestBlockStorage(t *testing.T) {
 	// TODO once we figure out how to make test block devices
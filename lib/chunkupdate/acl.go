@@ -0,0 +1,34 @@
+package chunkupdate
+
+// Chunk ACLs are kept in metadata entries, so they are checked here, against the entry that each update reads anyway,
+// rather than by the frontend ahead of time. See apis.ACL for what each kind of access covers.
+
+import (
+	"errors"
+	"fmt"
+	"zircon/lib/apis"
+)
+
+// Checks that the ACL recorded in 'entry' permits the updater's caller the access that it asks for. Updaters that
+// weren't bound to the context of an RPC have no caller, and are trusted with everything.
+func (f *updater) checkAccess(chunk apis.ChunkNum, entry apis.MetadataEntry, access apis.Access) error {
+	if f.identified && !entry.ACL.Permits(f.caller, access) {
+		return fmt.Errorf("cannot access chunk %d: %w", chunk, apis.ErrPermissionDenied)
+	}
+	return nil
+}
+
+// Checks that the updater's caller may give a new chunk 'acl'. Only the owner of an ACL can set it up, so that nobody
+// can allocate chunks on someone else's behalf.
+func (f *updater) checkNewACL(acl apis.ACL) error {
+	if len(acl.Allowed) > apis.MaxACLPrincipals {
+		return fmt.Errorf("cannot allow %d principals; at most %d fit", len(acl.Allowed), apis.MaxACLPrincipals)
+	}
+	if !acl.Restricted() && len(acl.Allowed) > 0 {
+		return errors.New("cannot allow principals without an owner")
+	}
+	if f.identified && acl.Restricted() && acl.Owner != f.caller {
+		return fmt.Errorf("cannot allocate a chunk owned by someone else: %w", apis.ErrPermissionDenied)
+	}
+	return nil
+}
@@ -20,6 +20,34 @@ func ListChunkservers(etcd apis.EtcdInterface) ([]apis.ServerID, error) {
 	return ids, nil
 }
 
+// Like ListChunkservers, but leaves out chunkservers that have stopped sending heartbeats.
+func ListLiveChunkservers(etcd apis.EtcdInterface) ([]apis.ServerID, error) {
+	down, err := etcd.ListDownServers()
+	if err != nil {
+		return nil, err
+	}
+	isDown := map[apis.ServerName]bool{}
+	for _, name := range down {
+		isDown[name] = true
+	}
+	names, err := etcd.ListServers(apis.CHUNKSERVER)
+	if err != nil {
+		return nil, err
+	}
+	var ids []apis.ServerID
+	for _, name := range names {
+		if isDown[name] {
+			continue
+		}
+		id, err := etcd.GetIDByName(name)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
 func AddressForChunkserver(etcd apis.EtcdInterface, chunkserver apis.ServerID) (apis.ServerAddress, error) {
 	name, err := etcd.GetNameByID(chunkserver)
 	if err != nil {
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"sort"
+	"time"
 )
 
 func TestListChunkservers(t *testing.T) {
@@ -46,6 +47,40 @@ func TestListChunkservers(t *testing.T) {
 	}, names)
 }
 
+func TestListLiveChunkservers(t *testing.T) {
+	etcds, teardown := etcd.PrepareSubscribeForTesting(t)
+	defer teardown()
+
+	for i := 0; i < 3; i++ {
+		etcdn, teardown2 := etcds(apis.ServerName(fmt.Sprintf("chunkserver-%d", i)))
+		defer teardown2()
+		assert.NoError(t, etcdn.UpdateAddress(apis.ServerAddress(fmt.Sprintf("testaddress-%d", i)), apis.CHUNKSERVER))
+		// chunkserver-0 never sends heartbeats, and chunkserver-1 only sends one, which runs out
+		if i == 1 {
+			assert.NoError(t, etcdn.Heartbeat(time.Second))
+		} else if i == 2 {
+			assert.NoError(t, etcdn.Heartbeat(time.Minute))
+		}
+	}
+	time.Sleep(time.Second * 5 / 2)
+
+	etcdn, teardown3 := etcds("test")
+	defer teardown3()
+	ids, err := ListLiveChunkservers(etcdn)
+	assert.NoError(t, err)
+	var names []string
+	for _, id := range ids {
+		name, err := etcdn.GetNameByID(id)
+		assert.NoError(t, err)
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string {
+		"chunkserver-0",
+		"chunkserver-2",
+	}, names)
+}
+
 func TestAddressForChunkserver(t *testing.T) {
 	etcds, teardown := etcd.PrepareSubscribeForTesting(t)
 	defer teardown()
@@ -0,0 +1,145 @@
+package chunkupdate
+
+// Write leases let a single writer commit a sequence of writes to a chunk without racing anyone else for versions. The
+// lease is kept in the chunk's metadata entry, so it is granted and checked by whichever frontend handles a request,
+// through the same compare-and-swap on the entry that guards every other change to the chunk.
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+	"zircon/lib/apis"
+)
+
+// Checks that the write lease recorded in 'entry' allows a change to the chunk on behalf of 'lease': either it is the
+// lease in force, or it is NoLease and nobody holds the lease.
+func checkLease(chunk apis.ChunkNum, entry apis.MetadataEntry, lease apis.LeaseID, now time.Time) error {
+	if lease != apis.NoLease {
+		if entry.Lease.Holder != lease || !entry.Lease.HeldAt(now) {
+			return fmt.Errorf("cannot change chunk %d: %w", chunk, apis.ErrLeaseLost)
+		}
+	} else if entry.Lease.HeldAt(now) {
+		return fmt.Errorf("cannot change chunk %d: %w", chunk, apis.ErrLeaseHeld)
+	}
+	return nil
+}
+
+// Returned by the 'change' passed to changeLease to look at the entry again after ReserveRetryInterval.
+var errCommitInProgress = errors.New("a commit to the chunk is in progress")
+
+// Replaces the write lease in a chunk's metadata entry with the one returned by 'change', which is given the current
+// entry. Nothing is written if the lease is left as it was. Chunks that are being deleted are left alone, since
+// deletion has to be able to remove their entries exactly as it marked them.
+func (f *updater) changeLease(chunk apis.ChunkNum, change func(entry apis.MetadataEntry, now time.Time) (apis.WriteLease, error)) error {
+	metadata := f.boundMetadata()
+	for {
+		entry, err := metadata.ReadEntry(chunk)
+		if err != nil {
+			return fmt.Errorf("while fetching metadata entry: %w", err)
+		}
+		if err := f.checkAccess(chunk, entry, apis.WriteAccess); err != nil {
+			return err
+		}
+		if entry.MostRecentVersion > entry.LastConsumedVersion {
+			return fmt.Errorf("cannot lease chunk %d: %w", chunk, apis.ErrBeingDeleted)
+		}
+		lease, err := change(entry, time.Now())
+		if err == errCommitInProgress {
+			time.Sleep(ReserveRetryInterval)
+			continue
+		} else if err != nil {
+			return err
+		}
+		if lease == entry.Lease {
+			return nil
+		}
+		next := entry
+		next.Lease = lease
+		err = metadata.UpdateEntry(chunk, entry, next)
+		if !errors.Is(err, apis.ErrVersionStale) {
+			return err
+		}
+		// a commit or another lease request changed the entry first; look at it again
+	}
+}
+
+// Acquires a write lease on a chunk for apis.WriteLeaseDuration, as long as nobody else holds one. A commit that has
+// already reserved a version is waited for, the same way CommitAppend waits for one, so that it can't land once the
+// lease is held.
+func (f *updater) AcquireWriteLease(chunk apis.ChunkNum) (apis.LeaseID, error) {
+	holder := apis.NoLease
+	for holder == apis.NoLease {
+		holder = apis.LeaseID(rand.Uint64())
+	}
+	attempts := 0
+	err := f.changeLease(chunk, func(entry apis.MetadataEntry, now time.Time) (apis.WriteLease, error) {
+		if entry.Lease.HeldAt(now) {
+			return apis.WriteLease{}, fmt.Errorf("cannot lease chunk %d: %w", chunk, apis.ErrLeaseHeld)
+		}
+		if entry.LastConsumedVersion > entry.MostRecentVersion && attempts < AppendReserveAttempts {
+			// a commit that is still in progress after this long is taken to have been abandoned
+			attempts++
+			return apis.WriteLease{}, errCommitInProgress
+		}
+		return apis.WriteLease{Holder: holder, Expiry: now.Add(f.leaseDuration).UnixNano()}, nil
+	})
+	if err != nil {
+		return apis.NoLease, err
+	}
+	return holder, nil
+}
+
+// Extends a write lease to apis.WriteLeaseDuration from now, as long as it hasn't already expired.
+func (f *updater) RenewWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error {
+	return f.changeLease(chunk, func(entry apis.MetadataEntry, now time.Time) (apis.WriteLease, error) {
+		if err := checkLease(chunk, entry, lease, now); err != nil {
+			return apis.WriteLease{}, err
+		}
+		return apis.WriteLease{Holder: lease, Expiry: now.Add(f.leaseDuration).UnixNano()}, nil
+	})
+}
+
+// Gives up a write lease. If another lease has been granted since this one expired, it is left in place.
+func (f *updater) ReleaseWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error {
+	return f.changeLease(chunk, func(entry apis.MetadataEntry, now time.Time) (apis.WriteLease, error) {
+		if lease == apis.NoLease || entry.Lease.Holder != lease {
+			return entry.Lease, nil
+		}
+		return apis.WriteLease{}, nil
+	})
+}
+
+// Commits a write on behalf of the holder of a write lease, against whichever version is current. The only commits
+// that can race it are the holder's own, so like an append, it simply reserves the version after theirs.
+func (f *updater) CommitLeasedWrite(chunk apis.ChunkNum, lease apis.LeaseID, hash apis.CommitHash) (apis.Version, error) {
+	if lease == apis.NoLease {
+		return 0, errors.New("a leased write requires a lease")
+	}
+	committed, _, err := f.commit(chunk, apis.AnyVersion, lease, AppendReserveAttempts, func(replica apis.Chunkserver, oldVersion apis.Version, newVersion apis.Version) (uint32, error) {
+		return 0, replica.CommitWrite(chunk, hash, oldVersion, newVersion)
+	})
+	return committed, err
+}
+
+// Replaces 'previous' with 'next' in a chunk's metadata entry, like UpdateEntry. Acquiring, renewing, or releasing the
+// write lease doesn't touch anything else in the entry, so if that is all that has happened since 'previous' was read,
+// 'next' is applied on top of the new lease rather than failing. Returns the entries that were actually swapped.
+func (f *updater) updateKeepingLease(chunk apis.ChunkNum, previous apis.MetadataEntry, next apis.MetadataEntry) (apis.MetadataEntry, apis.MetadataEntry, error) {
+	for {
+		err := f.metadata.UpdateEntry(chunk, previous, next)
+		if !errors.Is(err, apis.ErrVersionStale) {
+			return previous, next, err
+		}
+		current, readErr := f.metadata.ReadEntry(chunk)
+		if readErr != nil {
+			return previous, next, err
+		}
+		unleased := current
+		unleased.Lease = previous.Lease
+		if !unleased.Equals(previous) {
+			return previous, next, err
+		}
+		previous, next.Lease = current, current.Lease
+	}
+}
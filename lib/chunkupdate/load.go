@@ -0,0 +1,109 @@
+package chunkupdate
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"zircon/lib/apis"
+)
+
+// How much a read that failed counts against a replica, as if it had taken this long to answer. A replica that keeps
+// failing is doubled past this each time, so it is only tried once the others have become as slow.
+const FailurePenalty = 100 * time.Millisecond
+
+// How much each new measurement moves a replica's estimated latency, out of 1. Lower values smooth over occasional slow
+// reads; higher values follow changes in load more quickly.
+const latencyWeight = 0.25
+
+// Tracks how many reads each chunkserver is in the middle of, and how quickly it has answered recent reads, so that
+// reads can be sent to whichever replica is likely to answer first instead of to a random one. This spreads the reads
+// of a hot chunk across its replicas in proportion to how fast each one is keeping up. Safe for concurrent use; a
+// single LoadTracker should be shared by everything that reads through the same connections.
+type LoadTracker struct {
+	mu       sync.Mutex
+	replicas map[apis.ServerAddress]*replicaLoad
+	// rotated on every call to order, so that replicas that look equally good take turns
+	rotation int
+}
+
+type replicaLoad struct {
+	inFlight int
+	// zero until a read has finished
+	latency time.Duration
+}
+
+func NewLoadTracker() *LoadTracker {
+	return &LoadTracker{
+		replicas: map[apis.ServerAddress]*replicaLoad{},
+	}
+}
+
+func (t *LoadTracker) load(address apis.ServerAddress) *replicaLoad {
+	load, ok := t.replicas[address]
+	if !ok {
+		load = &replicaLoad{}
+		t.replicas[address] = load
+	}
+	return load
+}
+
+// The expected wait for a new read: the replica's latency, once for each read ahead of it and once for the new one.
+// Replicas that have never been measured cost nothing, so that each one gets tried, unless they have yet to answer the
+// reads they were already sent, each of which is then counted as a failure.
+func (l *replicaLoad) cost() time.Duration {
+	if l.latency == 0 {
+		return time.Duration(l.inFlight) * FailurePenalty
+	}
+	return time.Duration(l.inFlight+1) * l.latency
+}
+
+// Returns the indices of 'replicas' from the cheapest to the most expensive to read from. Replicas that cost the same,
+// such as when none has been measured yet, are taken in round-robin order.
+func (t *LoadTracker) order(replicas []apis.ServerAddress) []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	order := make([]int, len(replicas))
+	costs := make([]time.Duration, len(replicas))
+	for i, address := range replicas {
+		order[i] = (i + t.rotation) % len(replicas)
+		costs[i] = t.load(address).cost()
+	}
+	t.rotation++
+	sort.SliceStable(order, func(i, j int) bool {
+		return costs[order[i]] < costs[order[j]]
+	})
+	return order
+}
+
+// Records that a read from 'address' has started, and returns the function to call with its result once it finishes.
+func (t *LoadTracker) begin(address apis.ServerAddress) func(err error) {
+	t.mu.Lock()
+	t.load(address).inFlight++
+	t.mu.Unlock()
+	start := time.Now()
+	return func(err error) {
+		elapsed := time.Since(start)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		load := t.load(address)
+		load.inFlight--
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			// abandoned by the caller, which says nothing about the replica
+			return
+		}
+		if err != nil {
+			elapsed = 2 * load.latency
+			if elapsed < FailurePenalty {
+				elapsed = FailurePenalty
+			}
+			load.latency = elapsed
+		} else if load.latency == 0 {
+			load.latency = elapsed
+		} else {
+			load.latency += time.Duration(latencyWeight * float64(elapsed-load.latency))
+		}
+	}
+}
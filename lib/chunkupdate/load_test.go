@@ -0,0 +1,57 @@
+package chunkupdate
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	"zircon/apis"
+)
+
+// Tests that replicas nobody has read from yet take turns, that faster and less busy replicas are preferred once they
+// have been measured, and that failures push a replica to the back.
+func TestLoadTracker(t *testing.T) {
+	replicas := []apis.ServerAddress{"cs0", "cs1", "cs2"}
+	tracker := NewLoadTracker()
+
+	firsts := map[int]int{}
+	for i := 0; i < 30; i++ {
+		firsts[tracker.order(replicas)[0]]++
+	}
+	assert.Equal(t, map[int]int{0: 10, 1: 10, 2: 10}, firsts)
+
+	// a replica that is still working on its first read goes last
+	stalled := tracker.begin("cs0")
+	assert.Equal(t, 0, tracker.order(replicas)[2])
+	stalled(context.Canceled)
+
+	tracker.load("cs0").latency = 3 * time.Millisecond
+	tracker.load("cs1").latency = time.Millisecond
+	tracker.load("cs2").latency = 2 * time.Millisecond
+	assert.Equal(t, []int{1, 2, 0}, tracker.order(replicas))
+
+	// three reads in progress on cs1 make it the slowest to answer a fourth
+	var dones []func(error)
+	for i := 0; i < 3; i++ {
+		dones = append(dones, tracker.begin("cs1"))
+	}
+	assert.Equal(t, []int{2, 0, 1}, tracker.order(replicas))
+	for _, done := range dones {
+		done(context.Canceled)
+	}
+	assert.Equal(t, time.Millisecond, tracker.load("cs1").latency, "abandoned reads should not be measured")
+	assert.Equal(t, []int{1, 2, 0}, tracker.order(replicas))
+
+	tracker.begin("cs1")(errors.New("unreachable"))
+	assert.Equal(t, FailurePenalty, tracker.load("cs1").latency)
+	assert.Equal(t, []int{2, 0, 1}, tracker.order(replicas))
+	tracker.begin("cs1")(errors.New("unreachable"))
+	assert.Equal(t, 2*FailurePenalty, tracker.load("cs1").latency)
+
+	// a successful read brings it part of the way back
+	tracker.begin("cs1")(nil)
+	latency := tracker.load("cs1").latency
+	assert.True(t, latency < 2*FailurePenalty && latency > FailurePenalty, "unexpected latency %v", latency)
+	assert.Equal(t, 0, tracker.load("cs1").inFlight)
+}
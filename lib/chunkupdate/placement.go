@@ -0,0 +1,216 @@
+package chunkupdate
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+
+	"zircon/lib/apis"
+)
+
+// A chunkserver that a PlacementPolicy may choose to hold a replica.
+type Candidate struct {
+	ID     apis.ServerID
+	Name   apis.ServerName
+	Domain apis.FailureDomain
+	// As the chunkserver last reported it, or all zeroes if it never did.
+	Capacity apis.ServerCapacity
+	// Whether the chunkserver is being drained, in which case no new replicas are placed on it.
+	Draining bool
+	// Whether the chunkserver has stopped sending heartbeats, in which case no new replicas are placed on it either.
+	Down bool
+}
+
+// The fraction of a chunkserver's storage past which no new replicas are placed on it, so that the replicas it already
+// holds have room to be written to.
+const HighWatermark = 0.9
+
+// Explanation of capacity-aware placement:
+//     Chunkservers report how much free space they have and how many chunks they hold to etcd every
+//     chunkserver.CapacityReportFreq (see chunkserver.ReportCapacity), and CandidatesFor looks these up along with
+//     failure domains. Place never offers a policy a candidate whose storage is fuller than HighWatermark. Among the
+//     rest, both policies here choose at random, but weighted: a server's weight is the fraction of its storage that is
+//     free, times a factor for how many chunks it holds compared to the average candidate, which is 2 for a server that
+//     holds none, 1 for one that holds the average, and falls towards 0 for one that holds far more. So new and emptier
+//     servers fill up faster than those that are nearly full, without every new replica going to the same server.
+//     Servers that never reported, or can't say how large their storage is, count as entirely free.
+
+// Decides which chunkservers hold the replicas of a chunk, both when the chunk is created and when it is repaired after
+// losing replicas. Policies that depend on where servers are can go by their failure domains, or identify them by name.
+type PlacementPolicy interface {
+	// Chooses 'count' distinct servers from 'candidates' to hold new replicas of a chunk. 'existing' lists the servers
+	// that already hold the chunk, which is empty for a new chunk; none of them are among the candidates. Returns an
+	// error if there is no acceptable choice.
+	Place(count int, existing []Candidate, candidates []Candidate) ([]apis.ServerID, error)
+}
+
+type spreadPlacement struct{}
+
+// Places each replica on a different chunkserver, chosen at random, weighted by capacity.
+var SpreadPlacement PlacementPolicy = spreadPlacement{}
+
+func (spreadPlacement) Place(count int, existing []Candidate, candidates []Candidate) ([]apis.ServerID, error) {
+	if len(candidates) < count {
+		return nil, fmt.Errorf("not enough chunkservers to place %d replicas: %v", count, candidates)
+	}
+	result := make([]apis.ServerID, count)
+	for i, candidate := range weightedShuffle(candidates)[:count] {
+		result[i] = candidate.ID
+	}
+	return result, nil
+}
+
+type domainPlacement struct{}
+
+// Spreads the replicas of each chunk across as many zones as possible, and then across as many racks within those zones
+// as possible, so that a single rack never holds every replica of a chunk unless there is only one rack to choose from.
+// Among equally spread choices, chunkservers are chosen at random, weighted by capacity, so with no failure domains
+// recorded, this is the same as SpreadPlacement.
+var DomainPlacement PlacementPolicy = domainPlacement{}
+
+func (domainPlacement) Place(count int, existing []Candidate, candidates []Candidate) ([]apis.ServerID, error) {
+	if len(candidates) < count {
+		return nil, fmt.Errorf("not enough chunkservers to place %d replicas: %v", count, candidates)
+	}
+	zones := map[string]int{}
+	racks := map[apis.FailureDomain]int{}
+	for _, replica := range existing {
+		zones[replica.Domain.Zone]++
+		racks[replica.Domain]++
+	}
+	// shuffled, so that ties are broken at random, and in favor of candidates with more room
+	remaining := weightedShuffle(candidates)
+	result := make([]apis.ServerID, count)
+	for i := range result {
+		best := 0
+		for j, candidate := range remaining {
+			zone, bestZone := zones[candidate.Domain.Zone], zones[remaining[best].Domain.Zone]
+			if zone < bestZone || (zone == bestZone && racks[candidate.Domain] < racks[remaining[best].Domain]) {
+				best = j
+			}
+		}
+		chosen := remaining[best]
+		result[i] = chosen.ID
+		zones[chosen.Domain.Zone]++
+		racks[chosen.Domain]++
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+	return result, nil
+}
+
+// How strongly a policy should prefer a candidate, out of candidates that hold 'meanChunks' chunks on average; see the
+// explanation of capacity-aware placement.
+func (c Candidate) weight(meanChunks float64) float64 {
+	free := 1 - c.Capacity.UsedFraction()
+	mean := math.Max(meanChunks, 1)
+	// never quite zero, so that a server just under the watermark can still be chosen when it is needed
+	return math.Max(free*2*mean/(float64(c.Capacity.Chunks)+mean), 1e-6)
+}
+
+// Puts candidates in a random order, where each is more likely to come early the greater its weight. This is the
+// Efraimidis-Spirakis method: each candidate draws a key of u^(1/weight) for u uniform in (0, 1), and the largest keys
+// come first, so taking a prefix of the result is a weighted sample without replacement.
+func weightedShuffle(candidates []Candidate) []Candidate {
+	total := 0.0
+	for _, candidate := range candidates {
+		total += float64(candidate.Capacity.Chunks)
+	}
+	mean := 0.0
+	if len(candidates) > 0 {
+		mean = total / float64(len(candidates))
+	}
+	keys := make([]float64, len(candidates))
+	order := make([]int, len(candidates))
+	for i, candidate := range candidates {
+		keys[i] = math.Pow(1-rand.Float64(), 1/candidate.weight(mean))
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return keys[order[i]] > keys[order[j]]
+	})
+	shuffled := make([]Candidate, len(candidates))
+	for i, ii := range order {
+		shuffled[i] = candidates[ii]
+	}
+	return shuffled
+}
+
+// Looks up the names, failure domains, capacities, and whether they are draining or down, of a set of chunkservers, to
+// pass them to a PlacementPolicy.
+func CandidatesFor(etcd apis.EtcdInterface, ids []apis.ServerID) ([]Candidate, error) {
+	draining, err := etcd.ListDraining()
+	if err != nil {
+		return nil, err
+	}
+	isDraining := map[apis.ServerName]bool{}
+	for _, name := range draining {
+		isDraining[name] = true
+	}
+	down, err := etcd.ListDownServers()
+	if err != nil {
+		return nil, err
+	}
+	isDown := map[apis.ServerName]bool{}
+	for _, name := range down {
+		isDown[name] = true
+	}
+	candidates := make([]Candidate, len(ids))
+	for i, id := range ids {
+		name, err := etcd.GetNameByID(id)
+		if err != nil {
+			return nil, err
+		}
+		domain, err := etcd.GetFailureDomain(name)
+		if err != nil {
+			return nil, err
+		}
+		capacity, err := etcd.GetCapacity(name)
+		if err != nil {
+			return nil, err
+		}
+		candidates[i] = Candidate{
+			ID:       id,
+			Name:     name,
+			Domain:   domain,
+			Capacity: capacity,
+			Draining: isDraining[name],
+			Down:     isDown[name],
+		}
+	}
+	return candidates, nil
+}
+
+// Asks a policy to place replicas, leaving out any candidates that are draining, down, or whose storage is past
+// HighWatermark, and checks that it chose the right number of distinct candidates.
+func Place(policy PlacementPolicy, count int, existing []Candidate, candidates []Candidate) ([]apis.ServerID, error) {
+	var accepting []Candidate
+	for _, candidate := range candidates {
+		if !candidate.Draining && !candidate.Down && candidate.Capacity.UsedFraction() <= HighWatermark {
+			accepting = append(accepting, candidate)
+		}
+	}
+	if len(accepting) < count && len(accepting) < len(candidates) {
+		return nil, fmt.Errorf("cannot place %d replicas: only %d of %d chunkservers are accepting new replicas",
+			count, len(accepting), len(candidates))
+	}
+	candidates = accepting
+	chosen, err := policy.Place(count, existing, candidates)
+	if err != nil {
+		return nil, err
+	}
+	if len(chosen) != count {
+		return nil, fmt.Errorf("placement policy chose %d servers instead of %d", len(chosen), count)
+	}
+	allowed := map[apis.ServerID]bool{}
+	for _, candidate := range candidates {
+		allowed[candidate.ID] = true
+	}
+	for _, id := range chosen {
+		if !allowed[id] {
+			return nil, fmt.Errorf("placement policy chose server %d, which was not a candidate or was chosen twice", id)
+		}
+		allowed[id] = false
+	}
+	return chosen, nil
+}
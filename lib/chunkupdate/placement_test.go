@@ -0,0 +1,98 @@
+package chunkupdate
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"zircon/apis"
+)
+
+func candidatesIn(domains ...apis.FailureDomain) []Candidate {
+	candidates := make([]Candidate, len(domains))
+	for i, domain := range domains {
+		candidates[i] = Candidate{ID: apis.ServerID(i + 1), Domain: domain}
+	}
+	return candidates
+}
+
+// Tests that DomainPlacement puts replicas in different zones while it can, then in different racks, and takes
+// existing replicas into account when adding more.
+func TestDomainPlacement(t *testing.T) {
+	a1, a2 := apis.FailureDomain{Zone: "a", Rack: "1"}, apis.FailureDomain{Zone: "a", Rack: "2"}
+	b1 := apis.FailureDomain{Zone: "b", Rack: "1"}
+	candidates := candidatesIn(a1, a1, a1, a2, a2, b1)
+	domainOf := map[apis.ServerID]apis.FailureDomain{}
+	for _, candidate := range candidates {
+		domainOf[candidate.ID] = candidate.Domain
+	}
+
+	for i := 0; i < 20; i++ {
+		chosen, err := Place(DomainPlacement, 3, nil, candidates)
+		require.NoError(t, err)
+		domains := map[apis.FailureDomain]bool{}
+		for _, id := range chosen {
+			domains[domainOf[id]] = true
+		}
+		// one replica in zone b, and the other two split between the racks of zone a
+		assert.Equal(t, map[apis.FailureDomain]bool{a1: true, a2: true, b1: true}, domains)
+	}
+
+	// with replicas already in zone b and rack a1, the next one goes to rack a2
+	existing := []Candidate{{ID: 6, Domain: b1}, {ID: 1, Domain: a1}}
+	for i := 0; i < 20; i++ {
+		chosen, err := Place(DomainPlacement, 1, existing, candidatesIn(a1, a1, a1, a2, a2)[1:])
+		require.NoError(t, err)
+		assert.Equal(t, a2, domainOf[chosen[0]])
+	}
+
+	// more replicas than domains still places every one of them
+	chosen, err := Place(DomainPlacement, 6, nil, candidates)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []apis.ServerID{1, 2, 3, 4, 5, 6}, chosen)
+	_, err = Place(DomainPlacement, 7, nil, candidates)
+	assert.Error(t, err)
+}
+
+// Tests that placement never chooses a server past the high watermark, prefers servers with more free space and fewer
+// chunks, and refuses to place replicas when too few servers have room.
+func TestCapacityPlacement(t *testing.T) {
+	candidates := []Candidate{
+		{ID: 1, Capacity: apis.ServerCapacity{FreeBytes: 50, TotalBytes: 1000, Chunks: 100}},
+		{ID: 2, Capacity: apis.ServerCapacity{FreeBytes: 900, TotalBytes: 1000, Chunks: 10}},
+		{ID: 3, Capacity: apis.ServerCapacity{FreeBytes: 300, TotalBytes: 1000, Chunks: 70}},
+		{ID: 4},
+	}
+	for _, policy := range []PlacementPolicy{SpreadPlacement, DomainPlacement} {
+		counts := map[apis.ServerID]int{}
+		for i := 0; i < 500; i++ {
+			chosen, err := Place(policy, 1, nil, candidates)
+			require.NoError(t, err)
+			counts[chosen[0]]++
+		}
+		// server 1 is 95% full
+		assert.Equal(t, 0, counts[1])
+		assert.True(t, counts[2] > counts[3], "placement ignored capacity: %v", counts)
+		assert.True(t, counts[3] > 0, "placement never chose a server with room: %v", counts)
+		assert.True(t, counts[4] > 0, "placement never chose a server with unknown capacity: %v", counts)
+
+		chosen, err := Place(policy, 3, nil, candidates)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []apis.ServerID{2, 3, 4}, chosen)
+		_, err = Place(policy, 4, nil, candidates)
+		assert.Error(t, err)
+	}
+}
+
+// Tests that placement never chooses a server that is draining or down.
+func TestDrainingPlacement(t *testing.T) {
+	candidates := candidatesIn(apis.FailureDomain{}, apis.FailureDomain{}, apis.FailureDomain{}, apis.FailureDomain{})
+	candidates[1].Draining = true
+	candidates[2].Down = true
+	for i := 0; i < 20; i++ {
+		chosen, err := Place(DomainPlacement, 2, nil, candidates)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []apis.ServerID{1, 4}, chosen)
+	}
+	_, err := Place(SpreadPlacement, 3, nil, candidates)
+	assert.Error(t, err)
+}
@@ -2,25 +2,79 @@ package chunkupdate
 // This package is here to abstract away the details of performing chunk accesses.
 
 import (
+	"context"
 	"zircon/lib/apis"
-	"sync"
+	"sync/atomic"
 	"fmt"
 	"errors"
 	"math/rand"
+	"time"
 	"zircon/lib/rpc"
 )
 
+// The number of replicas that must acknowledge a write before it succeeds.
+//
+// With a quorum of W out of N replicas, a write completes as soon as W replicas have committed it, so one slow or
+// unreachable replica no longer stalls every write. The other N-W replicas are recorded as lagging in the metadata
+// entry, so that reads skip them, and are caught up in the background. The cost is durability: until the laggards
+// catch up, the new version exists on only W servers, and losing all of them loses the write even though it was
+// acknowledged. Laggards that cannot catch up are left for the replicator service to replace.
+//
+// AllReplicas (W=N) waits for every replica, and fails the write if any of them fails.
+type WriteQuorum int
+
+const AllReplicas WriteQuorum = 0
+
+// How often, and how many times, a lagging replica is retried while catching up after a quorum write. This covers a
+// replica that is still receiving the write's data when the write is committed.
+const CatchUpInterval = 100 * time.Millisecond
+const CatchUpAttempts = 100
+
+// Computes how many of a chunk's replicas must acknowledge a write under this quorum. A quorum larger than the number
+// of replicas is treated the same as AllReplicas.
+func (q WriteQuorum) Required(replicas int) int {
+	if q <= 0 || int(q) > replicas {
+		return replicas
+	}
+	return int(q)
+}
+
 type Reference struct {
 	Chunk    apis.ChunkNum
 	Version  apis.Version
 	Replicas []apis.ServerAddress
+	// how many of the replicas must receive a write for PrepareWrite to succeed
+	Quorum WriteQuorum
+	// where to report replicas that had to be skipped; nothing is reported if this is nil
+	Logger apis.Logger
+	// if nonzero, how long a read waits for a replica to answer before also trying another one
+	HedgeAfter time.Duration
+	// if set, reads try the replicas that are least loaded and fastest first, rather than going in a random order
+	Load *LoadTracker
+	// if set, the context that reads, PrepareWrite, and PrepareAppend bind their calls to the replicas to, so that they
+	// share its deadline and are abandoned once it is cancelled
+	Context context.Context
 }
 
 type Updater interface {
 	New(replicas int) (apis.ChunkNum, error)
+	NewWithACL(replicas int, acl apis.ACL) (apis.ChunkNum, error)
+	NewBatch(replicas int, count int) ([]apis.ChunkNum, error)
 	ReadMeta(chunk apis.ChunkNum) (*Reference, error)
+	ReadFullMeta(chunk apis.ChunkNum) (apis.MetadataEntry, []apis.ServerAddress, error)
 	CommitWrite(chunk apis.ChunkNum, version apis.Version, hash apis.CommitHash) (apis.Version, error)
+	CommitAppend(chunk apis.ChunkNum, hash apis.CommitHash) (apis.Version, uint32, error)
 	Delete(chunk apis.ChunkNum, version apis.Version) error
+	DeleteIncomplete(chunk apis.ChunkNum) error
+	// See lease.go.
+	AcquireWriteLease(chunk apis.ChunkNum) (apis.LeaseID, error)
+	RenewWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error
+	ReleaseWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error
+	CommitLeasedWrite(chunk apis.ChunkNum, lease apis.LeaseID, hash apis.CommitHash) (apis.Version, error)
+	// Returns an Updater whose calls are bound to ctx up until the point where abandoning them would leave a chunk
+	// half-updated, and whose accesses are checked against the ACLs of chunks on behalf of the caller that ctx records.
+	// See updater.WithContext.
+	WithContext(ctx context.Context) Updater
 }
 
 // Performs a read.
@@ -31,41 +85,229 @@ type Updater interface {
 //   Either returns data and its valid version (of at least this ref's version) read from a chunkserver
 //   Or fails, if all chunkservers failed to respond
 func (ref *Reference) PerformRead(cache rpc.ConnectionCache, offset uint32, length uint32) ([]byte, apis.Version, error) {
+	var data []byte
+	var realVersion apis.Version
+	err := ref.readFromAnyReplica(cache, offset, length, func(cs apis.Chunkserver) (func(), error) {
+		d, v, err := cs.Read(ref.Chunk, offset, length, ref.Version)
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(d)) != length {
+			panic("postcondition on chunkserver.Read(...) violated")
+		}
+		return func() {
+			data, realVersion = d, v
+		}, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, realVersion, nil
+}
+
+// Performs a read of exactly 'version', which may be older than this ref's version if the replicas still retain it.
+// Replicas are tried in a random order, so one that has already reclaimed the version does not prevent reading it from
+// another that still has it.
+func (ref *Reference) PerformReadVersion(cache rpc.ConnectionCache, offset uint32, length uint32, version apis.Version) ([]byte, error) {
+	var data []byte
+	err := ref.readFromAnyReplica(cache, offset, length, func(cs apis.Chunkserver) (func(), error) {
+		d, err := cs.ReadVersion(ref.Chunk, offset, length, version)
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(d)) != length {
+			panic("postcondition on chunkserver.ReadVersion(...) violated")
+		}
+		return func() {
+			data = d
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Like PerformRead, but also returns the checksum the chunkserver reported for the data, after checking that the data
+// matches it. Data that arrived damaged counts as a failed read, and the next replica is tried.
+func (ref *Reference) PerformReadWithChecksum(cache rpc.ConnectionCache, offset uint32, length uint32) ([]byte, apis.Version, apis.Checksum, error) {
+	var data []byte
+	var realVersion apis.Version
+	var checksum apis.Checksum
+	err := ref.readFromAnyReplica(cache, offset, length, func(cs apis.Chunkserver) (func(), error) {
+		d, v, c, err := cs.ReadWithChecksum(ref.Chunk, offset, length, ref.Version)
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(d)) != length {
+			panic("postcondition on chunkserver.ReadWithChecksum(...) violated")
+		}
+		if err := apis.VerifyChecksum(d, c); err != nil {
+			return nil, fmt.Errorf("reading chunk %d: %w", ref.Chunk, err)
+		}
+		return func() {
+			data, realVersion, checksum = d, v, c
+		}, nil
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return data, realVersion, checksum, nil
+}
+
+// Calls read on the replicas in a random order, or from the least loaded if there is a Load tracker, until one succeeds,
+// and then calls the function it returned, which keeps its result. If none do, an error from a replica that was reached
+// is preferred over one from failing to connect. With HedgeAfter set, read may be in progress on more than one replica
+// at once; see readHedged.
+func (ref *Reference) readFromAnyReplica(cache rpc.ConnectionCache, offset uint32, length uint32, read func(apis.Chunkserver) (func(), error)) error {
 	if offset + length > apis.MaxChunkSize {
-		return nil, 0, errors.New("read too long")
+		return fmt.Errorf("read too long: %w", apis.ErrChunkTooLarge)
 	}
 	if len(ref.Replicas) == 0 {
-		return nil, 0, errors.New("cannot perform read; there are no replicas")
+		return errors.New("cannot perform read; there are no replicas")
+	}
+	// Without a load tracker, we use rand.Perm so that we'll try the replicas in a random order
+	var order []int
+	if ref.Load != nil {
+		order = ref.Load.order(ref.Replicas)
+	} else {
+		order = rand.Perm(len(ref.Replicas))
+	}
+	if ref.HedgeAfter > 0 && len(order) > 1 {
+		return ref.readHedged(cache, order, read)
 	}
 	var lastInnerErr error
 	var lastOuterErr error
-	// We use rand.Perm so that we'll try the replicas in a random order
-	for _, ii := range rand.Perm(len(ref.Replicas)) {
+	for _, ii := range order {
 		cs, err := cache.SubscribeChunkserver(ref.Replicas[ii])
 		if err == nil {
-			data, realVersion, err := cs.Read(ref.Chunk, offset, length, ref.Version)
+			var accept func()
+			done := ref.track(ref.Replicas[ii])
+			accept, err = read(ref.bind(cs))
+			done(err)
 			if err == nil {
-				if uint32(len(data)) != length {
-					panic("postcondition on chunkserver.Read(...) violated")
-				}
-				return data, realVersion, nil
+				accept()
+				return nil
 			} else {
 				lastInnerErr = err
 			}
 		} else {
 			lastOuterErr = err
 		}
+		ref.logf(apis.DEBUG, "could not read chunk %d from replica %s: %v", ref.Chunk, ref.Replicas[ii], err)
 	}
+	return pickReadError(lastInnerErr, lastOuterErr)
+}
+
+func pickReadError(lastInnerErr error, lastOuterErr error) error {
 	// at this point, we were unsuccessful, and did not manage to read anything
 	if lastInnerErr != nil {
-		return nil, 0, lastInnerErr
+		return lastInnerErr
 	} else if lastOuterErr != nil {
-		return nil, 0, lastOuterErr
+		return lastOuterErr
 	} else {
 		panic("should have had an error if we failed")
 	}
 }
 
+type hedgedResult struct {
+	replica apis.ServerAddress
+	accept  func()
+	err     error
+	// whether the error came from failing to connect, rather than from the replica
+	outer bool
+}
+
+// Starts reading from the first replica, and if it hasn't answered after HedgeAfter, from the second as well. Whichever
+// succeeds first is used, and the rest are cancelled. Each failure starts the next replica right away, as in the
+// sequential case. Replicas that can't meet the version the read requires fail, so the result always meets it.
+func (ref *Reference) readHedged(cache rpc.ConnectionCache, order []int, read func(apis.Chunkserver) (func(), error)) error {
+	parent := ref.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	// stops any reads still in progress once one has succeeded, or all have failed
+	defer cancel()
+	// buffered, so that reads that lose the race don't wait for anyone to receive their results
+	results := make(chan hedgedResult, len(order))
+	next, pending := 0, 0
+	launch := func() {
+		address := ref.Replicas[order[next]]
+		next++
+		pending++
+		go func() {
+			cs, err := cache.SubscribeChunkserver(address)
+			if err != nil {
+				results <- hedgedResult{replica: address, err: err, outer: true}
+				return
+			}
+			done := ref.track(address)
+			accept, err := read(rpc.ChunkserverWithContext(ctx, cs))
+			if err != nil && ctx.Err() != nil {
+				// this read lost the race to another replica, rather than failing on its own account
+				done(ctx.Err())
+			} else {
+				done(err)
+			}
+			results <- hedgedResult{replica: address, accept: accept, err: err}
+		}()
+	}
+	launch()
+	hedge := time.NewTimer(ref.HedgeAfter)
+	defer hedge.Stop()
+	var lastInnerErr error
+	var lastOuterErr error
+	for {
+		select {
+		case <-hedge.C:
+			if next < len(order) {
+				ref.logf(apis.DEBUG, "no answer for chunk %d after %v; also reading from replica %s", ref.Chunk, ref.HedgeAfter, ref.Replicas[order[next]])
+				launch()
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				result.accept()
+				return nil
+			}
+			ref.logf(apis.DEBUG, "could not read chunk %d from replica %s: %v", ref.Chunk, result.replica, result.err)
+			if result.outer {
+				lastOuterErr = result.err
+			} else {
+				lastInnerErr = result.err
+			}
+			if next < len(order) {
+				launch()
+			} else if pending == 0 {
+				return pickReadError(lastInnerErr, lastOuterErr)
+			}
+		}
+	}
+}
+
+// Binds a replica to ref.Context, if there is one.
+func (ref *Reference) bind(cs apis.Chunkserver) apis.Chunkserver {
+	if ref.Context == nil {
+		return cs
+	}
+	return rpc.ChunkserverWithContext(ref.Context, cs)
+}
+
+// Records a read from a replica in the load tracker, if there is one, returning the function to call once it finishes.
+func (ref *Reference) track(address apis.ServerAddress) func(err error) {
+	if ref.Load == nil {
+		return func(error) {}
+	}
+	return ref.Load.begin(address)
+}
+
+func (ref *Reference) logf(level apis.LogLevel, format string, args ...interface{}) {
+	if ref.Logger != nil {
+		ref.Logger.Logf(level, format, args...)
+	}
+}
+
 // Prepares a write.
 // Preconditions:
 //   offset + length <= apis.MaxChunkSize
@@ -73,29 +315,135 @@ func (ref *Reference) PerformRead(cache rpc.ConnectionCache, offset uint32, leng
 // Postconditions:
 //   If possible, all chunkservers have a copy of the data, directly or indirectly.
 //   On success, Returns the valid commit hash for this data.
-//   Fails if any server fails to connect, directly or indirectly.
+//   Fails if any server fails to connect, directly or indirectly, unless ref.Quorum allows enough of them to fail.
+//   Fails without contacting any replicas if ref.Context has too little time left before its deadline.
 func (ref *Reference) PrepareWrite(cache rpc.ConnectionCache, offset uint32, data []byte) (apis.CommitHash, error) {
 	if offset + uint32(len(data)) > apis.MaxChunkSize {
-		return "", errors.New("write too long")
+		return "", fmt.Errorf("write too long: %w", apis.ErrChunkTooLarge)
 	}
 	if len(ref.Replicas) == 0 {
 		return "", errors.New("cannot perform write; there are no replicas")
 	}
+	ctx := ref.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := rpc.CheckBudget(ctx); err != nil {
+		return "", fmt.Errorf("[update.go/CB] %w", err)
+	}
 	addresses := make([]apis.ServerAddress, len(ref.Replicas))
 	for i, ii := range rand.Perm(len(ref.Replicas)) {
 		addresses[i] = ref.Replicas[ii]
 	}
+	if required := ref.Quorum.Required(len(addresses)); required < len(addresses) {
+		stage := func(cs apis.Chunkserver) error {
+			if err := retryBusy(ctx, func() error { return cs.StartWrite(ref.Chunk, offset, data) }); err != nil {
+				return fmt.Errorf("[update.go/CSW] %w", err)
+			}
+			return nil
+		}
+		if err := prepareQuorum(ctx, cache, addresses, required, stage); err != nil {
+			return "", err
+		}
+		return apis.CalculateCommitHash(offset, data), nil
+	}
 	initial, err := cache.SubscribeChunkserver(addresses[0])
 	if err != nil {
-		return "", fmt.Errorf("[update.go/CSC] %v", err)
+		return "", fmt.Errorf("[update.go/CSC] %w", err)
 	}
-	err = initial.StartWriteReplicated(ref.Chunk, offset, data, addresses[1:])
+	initial = rpc.ChunkserverWithContext(ctx, initial)
+	// staging is keyed by the data, so replicas that staged the write before another refused it just keep it if it is
+	// sent again
+	err = retryBusy(ctx, func() error { return initial.StartWriteReplicated(ref.Chunk, offset, data, addresses[1:]) })
 	if err != nil {
-		return "", fmt.Errorf("[update.go/SWR] %v", err)
+		return "", fmt.Errorf("[update.go/SWR] %w", err)
 	}
 	return apis.CalculateCommitHash(offset, data), nil
 }
 
+// Prepares an append, the same way as PrepareWrite, except that the data is always sent to every replica directly, since
+// chunkservers don't forward appends to each other.
+// On success, returns the valid commit hash for the append, to pass to CommitAppend.
+func (ref *Reference) PrepareAppend(cache rpc.ConnectionCache, data []byte) (apis.CommitHash, error) {
+	if len(data) > apis.MaxChunkSize {
+		return "", fmt.Errorf("append too long: %w", apis.ErrChunkTooLarge)
+	}
+	if len(ref.Replicas) == 0 {
+		return "", errors.New("cannot perform append; there are no replicas")
+	}
+	ctx := ref.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := rpc.CheckBudget(ctx); err != nil {
+		return "", fmt.Errorf("[update.go/CB] %w", err)
+	}
+	stage := func(cs apis.Chunkserver) error {
+		if err := retryBusy(ctx, func() error { return cs.StartAppend(ref.Chunk, data) }); err != nil {
+			return fmt.Errorf("[update.go/CSP] %w", err)
+		}
+		return nil
+	}
+	if err := prepareQuorum(ctx, cache, ref.Replicas, ref.Quorum.Required(len(ref.Replicas)), stage); err != nil {
+		return "", err
+	}
+	return apis.CalculateAppendHash(data), nil
+}
+
+// How many times a write is sent again to replicas that refuse it as an apis.RetryAfterError, such as for want of room
+// to stage it, before it fails.
+const MaxBusyRetries = 3
+
+// Calls 'stage' until it succeeds, or fails other than by being refused as an apis.RetryAfterError, waiting before
+// each retry for as long as the refusal says to. Gives up after MaxBusyRetries retries, or once waiting would take it
+// past the deadline of ctx.
+func retryBusy(ctx context.Context, stage func() error) error {
+	for retries := 0; ; retries++ {
+		err := stage()
+		var busy apis.RetryAfterError
+		if err == nil || retries >= MaxBusyRetries || !errors.As(err, &busy) {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < busy.RetryAfter {
+			return err
+		}
+		select {
+		case <-time.After(busy.RetryAfter):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// Sends a write to every replica directly, rather than forwarding it through a single chunkserver, so that a slow
+// replica can't hold up the rest. Returns once 'required' replicas have staged the write; the others continue in the
+// background.
+func prepareQuorum(ctx context.Context, cache rpc.ConnectionCache, addresses []apis.ServerAddress, required int, stage func(apis.Chunkserver) error) error {
+	results := make(chan error, len(addresses))
+	for _, address := range addresses {
+		go func(address apis.ServerAddress) {
+			cs, err := cache.SubscribeChunkserver(address)
+			if err != nil {
+				results <- fmt.Errorf("[update.go/CSC] %w", err)
+			} else {
+				results <- stage(rpc.ChunkserverWithContext(ctx, cs))
+			}
+		}(address)
+	}
+	staged, failed := 0, 0
+	for staged < required {
+		if err := <-results; err != nil {
+			failed++
+			if failed > len(addresses) - required {
+				return err
+			}
+		} else {
+			staged++
+		}
+	}
+	return nil
+}
+
 type UpdaterMetadata interface {
 	NewEntry() (apis.ChunkNum, error)
 	ReadEntry(chunk apis.ChunkNum) (apis.MetadataEntry, error)
@@ -103,22 +451,97 @@ type UpdaterMetadata interface {
 	DeleteEntry(chunk apis.ChunkNum, previous apis.MetadataEntry) error
 }
 
+// Implemented by UpdaterMetadata that reaches the metadata over RPCs, so that an Updater bound to a context can bind
+// those RPCs to it as well.
+type ContextualMetadata interface {
+	UpdaterMetadata
+	WithContext(ctx context.Context) UpdaterMetadata
+}
+
 type updater struct {
-	mu       sync.Mutex
 	cache    rpc.ConnectionCache
 	metadata UpdaterMetadata
 	etcd     apis.EtcdInterface
+	quorum   WriteQuorum
+	placement PlacementPolicy
+	logger   apis.Logger
+	// how long write leases last from when they are acquired or renewed
+	leaseDuration time.Duration
+	// if set, the context that the calls made before a chunk starts to change are bound to; see WithContext
+	ctx context.Context
+	// who the calls are made on behalf of, if the context was that of an RPC; see checkAccess
+	caller     apis.Principal
+	identified bool
+	// the number of replicas that catchUp is still bringing up to date, shared with every bound copy; updated atomically
+	catchingUp *int64
 }
 
 func NewUpdater(cache rpc.ConnectionCache, etcd apis.EtcdInterface, metadata UpdaterMetadata) Updater {
+	return NewQuorumUpdater(cache, etcd, metadata, AllReplicas)
+}
+
+// Like NewUpdater, but commits writes once 'quorum' replicas have acknowledged them. See WriteQuorum.
+func NewQuorumUpdater(cache rpc.ConnectionCache, etcd apis.EtcdInterface, metadata UpdaterMetadata, quorum WriteQuorum) Updater {
+	return NewPlacementUpdater(cache, etcd, metadata, quorum, DomainPlacement)
+}
+
+// Like NewQuorumUpdater, but chooses the chunkservers for new chunks with 'placement'.
+func NewPlacementUpdater(cache rpc.ConnectionCache, etcd apis.EtcdInterface, metadata UpdaterMetadata, quorum WriteQuorum, placement PlacementPolicy) Updater {
+	return NewLoggingUpdater(cache, etcd, metadata, quorum, placement, apis.NoopLogger)
+}
+
+// Like NewPlacementUpdater, but reports replicas that fall behind to 'logger'.
+func NewLoggingUpdater(cache rpc.ConnectionCache, etcd apis.EtcdInterface, metadata UpdaterMetadata, quorum WriteQuorum, placement PlacementPolicy, logger apis.Logger) Updater {
 	return &updater{
 		metadata: metadata,
 		cache: cache,
 		etcd: etcd,
+		quorum: quorum,
+		placement: placement,
+		logger: logger,
+		leaseDuration: apis.WriteLeaseDuration,
+		catchingUp: new(int64),
+	}
+}
+
+// Returns a copy of this updater whose lookups of metadata and chunkservers are bound to ctx, so that a caller's
+// deadline or cancellation stops them, and whose accesses are checked against the ACLs of chunks if ctx is that of an
+// RPC. Only the steps taken before a chunk starts to change are bound: once a version has been reserved, or a chunk
+// marked for deletion, the rest of the update is carried through regardless, since abandoning it partway would leave
+// the replicas or the metadata entry inconsistent.
+func (f *updater) WithContext(ctx context.Context) Updater {
+	bound := *f
+	bound.ctx = ctx
+	bound.caller, bound.identified = rpc.CallerPrincipal(ctx)
+	return &bound
+}
+
+// The metadata, bound to the updater's context if it has one and the metadata supports it.
+func (f *updater) boundMetadata() UpdaterMetadata {
+	if contextual, ok := f.metadata.(ContextualMetadata); ok && f.ctx != nil {
+		return contextual.WithContext(f.ctx)
+	}
+	return f.metadata
+}
+
+// A chunkserver, bound to the updater's context if it has one.
+func (f *updater) bind(cs apis.Chunkserver) apis.Chunkserver {
+	if f.ctx == nil {
+		return cs
 	}
+	return rpc.ChunkserverWithContext(f.ctx, cs)
 }
 
 func (f *updater) selectInitialChunkservers(replicas int) ([]apis.ServerID, error) {
+	candidates, err := f.initialCandidates(replicas)
+	if err != nil {
+		return nil, err
+	}
+	return Place(f.placement, replicas, nil, candidates)
+}
+
+// Finds the chunkservers that new chunks with this many replicas can be placed on.
+func (f *updater) initialCandidates(replicas int) ([]Candidate, error) {
 	if replicas <= 0 {
 		return nil, errors.New("must request at least one replica")
 	}
@@ -130,58 +553,109 @@ func (f *updater) selectInitialChunkservers(replicas int) ([]apis.ServerID, erro
 		// TODO: make sure that old chunkservers are autoremoved
 		return nil, fmt.Errorf("cannot create new chunks: not enough chunkservers: %v", chunkservers)
 	}
-	result := make([]apis.ServerID, replicas)
-	for i, ii := range rand.Perm(len(chunkservers))[:replicas] {
-		result[i] = chunkservers[ii]
-	}
-	return result, nil
+	return CandidatesFor(f.etcd, chunkservers)
 }
 
 // Allocates a new chunk, all zeroed out. The version number will be zero, so the only way to access it initially is
 // with a version of AnyVersion.
-// If this chunk isn't written to before the connection to the server closes, the empty chunk will be deleted.
+// If this chunk is never written to, it is deleted through DeleteIncomplete, or by garbage collection once it has been
+// left unwritten for long enough.
 func (f *updater) New(replicaNum int) (apis.ChunkNum, error) {
-	// TODO: try to load-balance when initially selecting chunkservers
+	return f.NewWithACL(replicaNum, apis.ACL{})
+}
+
+// Like New, but records 'acl' in the chunk's metadata entry, so that only those it permits can access the chunk. The
+// owner of the ACL must be the updater's caller, if it has one.
+func (f *updater) NewWithACL(replicaNum int, acl apis.ACL) (apis.ChunkNum, error) {
+	if err := f.checkNewACL(acl); err != nil {
+		return 0, err
+	}
+	if replicaNum < 1 || replicaNum > apis.MaxReplicationFactor {
+		return 0, fmt.Errorf("cannot place a chunk on %d replicas", replicaNum)
+	}
 	replicas, err := f.selectInitialChunkservers(replicaNum)
 	if err != nil {
-		return 0, fmt.Errorf("[update.go/SIC] %v", err)
+		return 0, fmt.Errorf("[update.go/SIC] %w", err)
+	}
+	return f.create(replicas, replicaNum, acl)
+}
+
+// Like New, but allocates 'count' chunks at once, up to apis.MaxBatchSize, and only looks up the chunkservers they can
+// be placed on once. If any of them cannot be allocated, those that were are deleted again.
+func (f *updater) NewBatch(replicaNum int, count int) ([]apis.ChunkNum, error) {
+	if replicaNum < 1 || replicaNum > apis.MaxReplicationFactor {
+		return nil, fmt.Errorf("cannot place a chunk on %d replicas", replicaNum)
+	}
+	if count < 1 || count > apis.MaxBatchSize {
+		return nil, fmt.Errorf("cannot allocate %d chunks at once", count)
+	}
+	candidates, err := f.initialCandidates(replicaNum)
+	if err != nil {
+		return nil, fmt.Errorf("[update.go/SIC] %w", err)
 	}
-	// TODO: garbage collection should look for Version=0 metadata entries and delete them
-	chunk, err := f.metadata.NewEntry()
+	chunks := make([]apis.ChunkNum, 0, count)
+	for len(chunks) < count {
+		// placed one at a time, so that the chunks are spread out as much as those allocated separately would be
+		replicas, err := Place(f.placement, replicaNum, nil, candidates)
+		var chunk apis.ChunkNum
+		if err == nil {
+			chunk, err = f.create(replicas, replicaNum, apis.ACL{})
+		}
+		if err != nil {
+			for _, chunk := range chunks {
+				if derr := f.DeleteIncomplete(chunk); derr != nil {
+					// garbage collection gets to it eventually, as it would if we had crashed
+					f.logger.Logf(apis.WARN, "could not delete chunk %d from a failed batch: %v", chunk, derr)
+				}
+			}
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+// Creates a new chunk on 'replicas', which were chosen for it by the placement policy, with 'acl' in its entry.
+func (f *updater) create(replicas []apis.ServerID, replicaNum int, acl apis.ACL) (apis.ChunkNum, error) {
+	// a chunk abandoned partway through being created is no different from one whose creator crashed, so all of this
+	// can be bound to the caller's context
+	metadata := f.boundMetadata()
+	chunk, err := metadata.NewEntry()
 	if err != nil {
-		return 0, fmt.Errorf("[update.go/NET] %v", err)
+		return 0, fmt.Errorf("[update.go/NET] %w", err)
 	}
-	err = f.metadata.UpdateEntry(chunk, apis.MetadataEntry{}, apis.MetadataEntry{
+	err = metadata.UpdateEntry(chunk, apis.MetadataEntry{}, apis.MetadataEntry{
 		MostRecentVersion:   0,
 		LastConsumedVersion: 0,
 		Replicas:            replicas,
+		ACL:                 acl,
+		ReplicationFactor:   uint8(replicaNum),
 	})
-	// TODO: how does garbage collection know not to delete this until the client disconnects early or this server crashes?
 	if err != nil {
-		// oh well, it'll get cleaned up by garbage collection
-		return 0, fmt.Errorf("[update.go/MUE] %v", err)
+		// oh well, it'll get cleaned up by garbage collection, which treats this like any other unwritten entry
+		return 0, fmt.Errorf("[update.go/MUE] %w", err)
 	}
 	// now that we've established the replicas for this chunk, we need to go and tell the chunkservers to store this data
 	for _, replica := range replicas {
 		address, err := AddressForChunkserver(f.etcd, replica)
 		if err != nil {
-			return 0, fmt.Errorf("[update.go/AFC] %v", err)
+			return 0, fmt.Errorf("[update.go/AFC] %w", err)
 		}
 		cs, err := f.cache.SubscribeChunkserver(address)
 		if err != nil {
-			return 0, fmt.Errorf("[update.go/CSC] %v", err)
+			return 0, fmt.Errorf("[update.go/CSC] %w", err)
 		}
-		err = cs.Add(chunk, []byte{}, 0)
+		err = f.bind(cs).Add(chunk, []byte{}, 0)
 		if err != nil {
-			return 0, fmt.Errorf("[update.go/CSA] %v", err)
+			return 0, fmt.Errorf("[update.go/CSA] %w", err)
 		}
 	}
 	return chunk, nil
 }
 
-func (f *updater) getReplicaAddresses(entry apis.MetadataEntry) ([]apis.ServerAddress, error) {
-	addresses := make([]apis.ServerAddress, len(entry.Replicas))
-	for i, id := range entry.Replicas {
+func (f *updater) getReplicaAddresses(ids []apis.ServerID) ([]apis.ServerAddress, error) {
+	addresses := make([]apis.ServerAddress, len(ids))
+	for i, id := range ids {
 		address, err := AddressForChunkserver(f.etcd, id)
 		if err != nil {
 			return nil, err
@@ -191,8 +665,8 @@ func (f *updater) getReplicaAddresses(entry apis.MetadataEntry) ([]apis.ServerAd
 	return addresses, nil
 }
 
-func (f *updater) subscribeReplicas(entry apis.MetadataEntry) ([]apis.Chunkserver, error) {
-	replicaAddresses, err := f.getReplicaAddresses(entry)
+func (f *updater) subscribeReplicas(ids []apis.ServerID) ([]apis.Chunkserver, error) {
+	replicaAddresses, err := f.getReplicaAddresses(ids)
 	if err != nil {
 		return nil, err
 	}
@@ -214,19 +688,22 @@ func (f *updater) subscribeReplicas(entry apis.MetadataEntry) ([]apis.Chunkserve
 // Postconditions:
 //   the MRV (not the LCV) is returned as the version
 //   the chunk is returned as the chunk
-//   the list of replicas from the metadata entry is returned in full
+//   the list of replicas from the metadata entry is returned, except for any that are lagging behind the MRV
 func (f *updater) ReadMeta(chunk apis.ChunkNum) (*Reference, error) {
-	entry, err := f.metadata.ReadEntry(chunk)
+	entry, err := f.boundMetadata().ReadEntry(chunk)
 	if err != nil {
-		return nil, fmt.Errorf("failure while reading metadata entry: %v", err)
+		return nil, fmt.Errorf("failure while reading metadata entry: %w", err)
+	}
+	if err := f.checkAccess(chunk, entry, apis.ReadAccess); err != nil {
+		return nil, err
 	}
 	if entry.MostRecentVersion > entry.LastConsumedVersion {
 		// then this chunk must be in the process of being deleted... don't let them read it!
-		return nil, errors.New("chunk is gone: being deleted right now")
+		return nil, fmt.Errorf("cannot read chunk %d: %w", chunk, apis.ErrBeingDeleted)
 	}
-	addresses, err := f.getReplicaAddresses(entry)
+	addresses, err := f.getReplicaAddresses(entry.Confirmed())
 	if err != nil {
-		return nil, fmt.Errorf("failure while getting metadata addresses: %v", err)
+		return nil, fmt.Errorf("failure while getting metadata addresses: %w", err)
 	}
 	return &Reference{
 		Chunk: chunk,
@@ -235,82 +712,306 @@ func (f *updater) ReadMeta(chunk apis.ChunkNum) (*Reference, error) {
 	}, nil
 }
 
-// Writes metadata for a particular chunk, after each chunkserver has received a preparation message for this write.
-// Only performs the write if the version matches.
-func (f *updater) CommitWrite(chunk apis.ChunkNum, version apis.Version, hash apis.CommitHash) (apis.Version, error) {
-	entry, err := f.metadata.ReadEntry(chunk)
+// Reads the metadata entry of a particular chunk as it is, without any of the checks ReadMeta makes, along with the
+// address of every replica in the order they appear in the entry. This is meant for diagnosing problems with a chunk,
+// rather than for accessing it.
+func (f *updater) ReadFullMeta(chunk apis.ChunkNum) (apis.MetadataEntry, []apis.ServerAddress, error) {
+	entry, err := f.boundMetadata().ReadEntry(chunk)
 	if err != nil {
-		return 0, fmt.Errorf("while fetching metadata entry: %v", err)
+		return apis.MetadataEntry{}, nil, fmt.Errorf("failure while reading metadata entry: %w", err)
 	}
-	if len(entry.Replicas) == 0 {
-		return 0, fmt.Errorf("no replicas available for chunk")
+	if err := f.checkAccess(chunk, entry, apis.ReadAccess); err != nil {
+		return apis.MetadataEntry{}, nil, err
 	}
-	if entry.MostRecentVersion > entry.LastConsumedVersion {
-		// then this chunk must be in the process of being deleted... don't let them change it!
-		return 0, errors.New("attempt to write to chunk in the process of deletion")
+	addresses, err := f.getReplicaAddresses(entry.Replicas)
+	if err != nil {
+		return apis.MetadataEntry{}, nil, fmt.Errorf("failure while getting metadata addresses: %w", err)
 	}
-	// Confirm that the write can take place to the current version
-	if entry.MostRecentVersion != version && version != apis.AnyVersion {
-		return entry.MostRecentVersion, fmt.Errorf("incorrect chunk version: write=%d, existing=%d", version, entry.MostRecentVersion)
+	return entry, addresses, nil
+}
+
+type commitResult struct {
+	id      apis.ServerID
+	replica apis.Chunkserver
+	offset  uint32
+	err     error
+}
+
+// Commits a staged write or append on a single replica, turning oldVersion into newVersion, and returns the offset the
+// data was placed at.
+type applyCommit func(replica apis.Chunkserver, oldVersion apis.Version, newVersion apis.Version) (uint32, error)
+
+// How many times CommitAppend reserves a version again when another commit to the same chunk reserved one first, and how
+// long it waits for a commit that is still in progress before trying again.
+const AppendReserveAttempts = 100
+const ReserveRetryInterval = 10 * time.Millisecond
+
+// Writes metadata for a particular chunk, after each chunkserver has received a preparation message for this write.
+// Only performs the write if the version matches.
+// Succeeds once the updater's write quorum of replicas have committed the write; the rest are marked as lagging.
+func (f *updater) CommitWrite(chunk apis.ChunkNum, version apis.Version, hash apis.CommitHash) (apis.Version, error) {
+	committed, _, err := f.commit(chunk, version, apis.NoLease, 1, func(replica apis.Chunkserver, oldVersion apis.Version, newVersion apis.Version) (uint32, error) {
+		return 0, replica.CommitWrite(chunk, hash, oldVersion, newVersion)
+	})
+	return committed, err
+}
+
+// Commits an append, after each chunkserver has received it through StartAppend, against whichever version is current.
+// Losing the race to reserve the next version to another commit only means reserving the one after it, so concurrent
+// appends don't send their data again; each one is placed after whichever committed before it.
+func (f *updater) CommitAppend(chunk apis.ChunkNum, hash apis.CommitHash) (apis.Version, uint32, error) {
+	return f.commit(chunk, apis.AnyVersion, apis.NoLease, AppendReserveAttempts, func(replica apis.Chunkserver, oldVersion apis.Version, newVersion apis.Version) (uint32, error) {
+		return replica.CommitAppend(chunk, hash, oldVersion, newVersion)
+	})
+}
+
+// Reserves the next version of a chunk, as long as the chunk is at 'version' or it is AnyVersion, and returns the
+// updated metadata entry along with the replicas that hold the current version. With AnyVersion, the reservation is
+// attempted up to 'attempts' times when another commit reserves a version first. The chunk's write lease must be held by
+// 'lease', or by nobody if it is NoLease. Nothing has changed until the reservation succeeds, so all of this is bound to
+// the updater's context.
+func (f *updater) reserve(chunk apis.ChunkNum, version apis.Version, lease apis.LeaseID, attempts int) (apis.MetadataEntry, []apis.ServerID, []apis.Chunkserver, error) {
+	metadata := f.boundMetadata()
+	for attempt := 1; ; attempt++ {
+		entry, err := metadata.ReadEntry(chunk)
+		if err != nil {
+			return apis.MetadataEntry{}, nil, nil, fmt.Errorf("while fetching metadata entry: %w", err)
+		}
+		if len(entry.Replicas) == 0 {
+			return apis.MetadataEntry{}, nil, nil, fmt.Errorf("no replicas available for chunk")
+		}
+		if err := f.checkAccess(chunk, entry, apis.WriteAccess); err != nil {
+			return apis.MetadataEntry{}, nil, nil, err
+		}
+		if entry.MostRecentVersion > entry.LastConsumedVersion {
+			// then this chunk must be in the process of being deleted... don't let them change it!
+			return apis.MetadataEntry{}, nil, nil, fmt.Errorf("cannot write to chunk %d: %w", chunk, apis.ErrBeingDeleted)
+		}
+		if err := checkLease(chunk, entry, lease, time.Now()); err != nil {
+			return apis.MetadataEntry{}, nil, nil, err
+		}
+		if version == apis.AnyVersion && entry.LastConsumedVersion > entry.MostRecentVersion && attempt < attempts {
+			// another commit is still in progress, and committing against the same version as it would fail one of them
+			time.Sleep(ReserveRetryInterval)
+			continue
+		}
+		// Confirm that the write can take place to the current version; the entry is returned for its version
+		if entry.MostRecentVersion != version && version != apis.AnyVersion {
+			return entry, nil, nil, fmt.Errorf("incorrect chunk version for write=%d: %w", version, apis.VersionStaleError{Current: entry.MostRecentVersion})
+		}
+		// Only the replicas that hold the current version can apply the write
+		confirmed := entry.Confirmed()
+		required := f.quorum.Required(len(entry.Replicas))
+		if len(confirmed) < required {
+			return apis.MetadataEntry{}, nil, nil, fmt.Errorf("only %d of %d replicas are up to date, but the write quorum is %d",
+				len(confirmed), len(entry.Replicas), required)
+		}
+		// Connect to all of the replicas
+		replicas, err := f.subscribeReplicas(confirmed)
+		if err != nil {
+			return apis.MetadataEntry{}, nil, nil, err
+		}
+		// Reserve a version for this write
+		oldEntry := entry
+		entry.LastConsumedVersion += 1
+		err = metadata.UpdateEntry(chunk, oldEntry, entry)
+		if err == nil {
+			return entry, confirmed, replicas, nil
+		}
+		if version != apis.AnyVersion || attempt >= attempts || !errors.Is(err, apis.ErrVersionStale) {
+			return apis.MetadataEntry{}, nil, nil, fmt.Errorf("while updating metadata entry: %w", err)
+		}
+		f.logger.Logf(apis.DEBUG, "reserving a version of chunk %d again after attempt %d lost to another commit", chunk, attempt)
 	}
-	// Connect to all of the replicas
-	replicas, err := f.subscribeReplicas(entry)
+}
+
+// Reserves a version, has the replicas apply a staged write or append to produce it, and then makes it the version
+// served to clients, returning it along with the offset of the data.
+func (f *updater) commit(chunk apis.ChunkNum, version apis.Version, lease apis.LeaseID, attempts int, apply applyCommit) (apis.Version, uint32, error) {
+	entry, confirmed, replicas, err := f.reserve(chunk, version, lease, attempts)
 	if err != nil {
-		return 0, err
+		return entry.MostRecentVersion, 0, err
 	}
-	// Reserve a version for this write
-	oldEntry := entry
-	entry.LastConsumedVersion += 1
-	if err := f.metadata.UpdateEntry(chunk, oldEntry, entry); err != nil {
-		return 0, fmt.Errorf("while updating metadata entry: %v", err)
+	required := f.quorum.Required(len(entry.Replicas))
+	// Commit the write to the chunkservers, and wait until enough of them have done so
+	results := make(chan commitResult, len(replicas))
+	// the versions are copied out, because the slower replicas may still be starting once 'entry' has moved on
+	oldVersion, newVersion := entry.MostRecentVersion, entry.LastConsumedVersion
+	for i, replica := range replicas {
+		go func(id apis.ServerID, replica apis.Chunkserver) {
+			offset, err := apply(replica, oldVersion, newVersion)
+			results <- commitResult{id: id, replica: replica, offset: offset, err: err}
+		}(confirmed[i], replica)
 	}
-	// Commit the write to the chunkservers
-	for _, replica := range replicas {
-		// TODO: accept imperfect durability for the sake of availability
-		if err := replica.CommitWrite(chunk, hash, entry.MostRecentVersion, entry.LastConsumedVersion); err != nil {
-			return 0, fmt.Errorf("while commiting writes: %v", err)
+	var committed, failed []commitResult
+	for len(committed) < required {
+		result := <-results
+		if result.err == nil {
+			committed = append(committed, result)
+		} else if failed = append(failed, result); len(failed) > len(replicas) - required {
+			return 0, 0, fmt.Errorf("while commiting writes: %w", result.err)
 		}
 	}
-	// Update the latest stored metadata version
-	oldEntry = entry
+	// Update the latest stored metadata version, recording which replicas have not committed it yet
+	oldEntry := entry
 	entry.MostRecentVersion = entry.LastConsumedVersion
-	if err := f.metadata.UpdateEntry(chunk, oldEntry, entry); err != nil {
-		return 0, fmt.Errorf("while updating metadata entry: %v", err)
+	entry.Lagging = nil
+	for _, id := range entry.Replicas {
+		found := false
+		for _, result := range committed {
+			found = found || result.id == id
+		}
+		if !found {
+			entry.Lagging = append(entry.Lagging, id)
+		}
+	}
+	if oldEntry, entry, err = f.updateKeepingLease(chunk, oldEntry, entry); err != nil {
+		return 0, 0, fmt.Errorf("while updating metadata entry: %w", err)
 	}
 	// TODO: how to repair if a failure occurs right here
 	// Tell the chunkservers to start serving this new version
-	for _, replica := range replicas {
+	for _, result := range committed {
 		// TODO: accept these failures in some way
-		if err := replica.UpdateLatestVersion(chunk, oldEntry.MostRecentVersion, oldEntry.LastConsumedVersion); err != nil {
-			return 0, err
+		if err := result.replica.UpdateLatestVersion(chunk, oldEntry.MostRecentVersion, oldEntry.LastConsumedVersion); err != nil {
+			return 0, 0, err
+		}
+	}
+	pending := len(replicas) - len(committed) - len(failed)
+	if len(failed) > 0 || pending > 0 {
+		go f.catchUp(chunk, apply, oldEntry.MostRecentVersion, entry.MostRecentVersion, failed, results, pending)
+	}
+	// every replica holds the same data for the old version, so they all placed the data at the same offset
+	return entry.MostRecentVersion, committed[0].offset, nil
+}
+
+// Finishes a quorum write on the replicas that did not commit it in time: those in 'failed', and the 'pending' ones
+// whose results have yet to arrive on 'results'. Each replica that catches up is removed from the lagging list.
+func (f *updater) catchUp(chunk apis.ChunkNum, apply applyCommit, oldVersion apis.Version, newVersion apis.Version,
+	failed []commitResult, results <-chan commitResult, pending int) {
+	atomic.AddInt64(f.catchingUp, int64(len(failed) + pending))
+	repair := func(result commitResult) {
+		defer atomic.AddInt64(f.catchingUp, -1)
+		err := result.err
+		// the replica may not have received the data for this write yet
+		for attempt := 0; errors.Is(err, apis.ErrNotFound) && attempt < CatchUpAttempts; attempt++ {
+			time.Sleep(CatchUpInterval)
+			_, err = apply(result.replica, oldVersion, newVersion)
 		}
+		if err == nil {
+			err = result.replica.UpdateLatestVersion(chunk, oldVersion, newVersion)
+		}
+		if err == nil {
+			err = f.confirmReplica(chunk, result.id, newVersion)
+		}
+		if err != nil {
+			f.logger.Logf(apis.WARN, "replica %d of chunk %d could not catch up to version %d: %v", result.id, chunk, newVersion, err)
+		}
+	}
+	for _, result := range failed {
+		go repair(result)
+	}
+	for i := 0; i < pending; i++ {
+		go repair(<-results)
+	}
+}
+
+// Reports how many replicas are still being caught up on writes that were committed without them.
+func (f *updater) ReportMetrics() []apis.Measurement {
+	return []apis.Measurement{{
+		Name:  "zircon_frontend_catching_up_replicas",
+		Help:  "The number of replicas being brought up to date on writes that were committed without them.",
+		Value: float64(atomic.LoadInt64(f.catchingUp)),
+	}}
+}
+
+// Removes a replica from the lagging list of a chunk's metadata entry, as long as the chunk is still at 'version'.
+func (f *updater) confirmReplica(chunk apis.ChunkNum, id apis.ServerID, version apis.Version) error {
+	for {
+		entry, err := f.metadata.ReadEntry(chunk)
+		if err != nil {
+			return err
+		}
+		if entry.MostRecentVersion != version {
+			// a newer write has already happened without this replica, so it's still lagging
+			return fmt.Errorf("chunk moved on while catching up: %w", apis.VersionStaleError{Current: entry.MostRecentVersion})
+		}
+		next := entry
+		next.Lagging = nil
+		for _, laggard := range entry.Lagging {
+			if laggard != id {
+				next.Lagging = append(next.Lagging, laggard)
+			}
+		}
+		err = f.metadata.UpdateEntry(chunk, entry, next)
+		if !errors.Is(err, apis.ErrVersionStale) {
+			return err
+		}
+		// another replica was confirmed at the same time; try again
 	}
-	return entry.MostRecentVersion, nil
 }
 
 // Destroys an old chunk, assuming that the metadata version matches. This includes sending messages to all relevant
 // chunkservers.
+// Only the steps up to marking the chunk as deleted are bound to the updater's context.
 func (f *updater) Delete(chunk apis.ChunkNum, version apis.Version) error {
-	entry, err := f.metadata.ReadEntry(chunk)
+	metadata := f.boundMetadata()
+	entry, err := metadata.ReadEntry(chunk)
 	if err != nil {
-		return fmt.Errorf("while fetching pre-deletion metadata entry: %v", err)
+		return fmt.Errorf("while fetching pre-deletion metadata entry: %w", err)
+	}
+	if err := f.checkAccess(chunk, entry, apis.DeleteAccess); err != nil {
+		return err
 	}
 	if entry.MostRecentVersion > entry.LastConsumedVersion {
 		// then this chunk must be in the process of being deleted... don't let them delete it again!
-		return errors.New("attempt to delete chunk in the process of deletion")
+		return fmt.Errorf("cannot delete chunk %d: %w", chunk, apis.ErrBeingDeleted)
+	}
+	if err := checkLease(chunk, entry, apis.NoLease, time.Now()); err != nil {
+		return err
 	}
 	if entry.MostRecentVersion != version && version != apis.AnyVersion {
-		return errors.New("version mismatch during delete; will not delete")
+		return fmt.Errorf("version mismatch during delete; will not delete: %w", apis.VersionStaleError{Current: entry.MostRecentVersion})
+	}
+	return f.destroy(chunk, entry, metadata)
+}
+
+// Destroys a chunk that was allocated by New but has never been written to, and has no write in progress. Unlike a
+// Delete with AnyVersion, this can't remove a chunk that another client has started using, since the entry is only
+// marked as deleted if it is still unwritten at that point.
+func (f *updater) DeleteIncomplete(chunk apis.ChunkNum) error {
+	metadata := f.boundMetadata()
+	entry, err := metadata.ReadEntry(chunk)
+	if err != nil {
+		return fmt.Errorf("while fetching pre-deletion metadata entry: %w", err)
+	}
+	if err := f.checkAccess(chunk, entry, apis.DeleteAccess); err != nil {
+		return err
+	}
+	if entry.MostRecentVersion > entry.LastConsumedVersion {
+		return fmt.Errorf("cannot delete chunk %d: %w", chunk, apis.ErrBeingDeleted)
+	}
+	if entry.LastConsumedVersion != 0 {
+		return fmt.Errorf("chunk %d has been written to; will not delete: %w", chunk, apis.VersionStaleError{Current: entry.MostRecentVersion})
 	}
+	if entry.Lease.HeldAt(time.Now()) {
+		// whoever holds the lease is about to write to it
+		return fmt.Errorf("chunk %d is leased; will not delete: %w", chunk, apis.VersionStaleError{Current: entry.MostRecentVersion})
+	}
+	return f.destroy(chunk, entry, metadata)
+}
+
+// Marks a chunk as deleted, as long as its metadata entry is still 'entry', and then removes it from every replica and
+// from the metadata. Only the marking is done through 'metadata'.
+func (f *updater) destroy(chunk apis.ChunkNum, entry apis.MetadataEntry, metadata UpdaterMetadata) error {
 	// First, we mark this as deleted
 	oldEntry := entry
 	entry.MostRecentVersion = 0xFFFFFFFFFFFFFFFF
 	entry.LastConsumedVersion = 0
-	if err := f.metadata.UpdateEntry(chunk, oldEntry, entry); err != nil {
-		return fmt.Errorf("while updating metadata entry: %v", err)
+	if err := metadata.UpdateEntry(chunk, oldEntry, entry); err != nil {
+		return fmt.Errorf("while updating metadata entry: %w", err)
 	}
 	// Next, we destroy all of the replica data
-	replicas, err := f.subscribeReplicas(entry)
+	replicas, err := f.subscribeReplicas(entry.Replicas)
 	if err != nil {
 		return err
 	}
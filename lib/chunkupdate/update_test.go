@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"sort"
 	"testing"
+	"time"
 	"zircon/lib/apis"
 	"zircon/lib/chunkserver"
 	"zircon/lib/rpc"
@@ -320,6 +321,40 @@ func TestPrepareWrite_ManyReplicas(t *testing.T) {
 	GenericTestPrepareWrite(t, 13, 512, []bool{false, false, false, false, false, false})
 }
 
+// Tests that replicas that refuse a write for want of room are sent it again once they say to, and that those that
+// keep refusing it fail it in the end.
+func TestPrepareWrite_Busy(t *testing.T) {
+	cache := &rpc.MockCache{
+		Chunkservers: map[apis.ServerAddress]apis.Chunkserver{},
+	}
+	data := []byte("backpressure")
+	busy := apis.RetryAfterError{Err: fmt.Errorf("full: %w", apis.ErrStagingFull), RetryAfter: 10 * time.Millisecond}
+
+	relenting := &mocks.Chunkserver{}
+	relenting.On("StartWrite", apis.ChunkNum(5), uint32(0), data).Return(busy).Twice()
+	relenting.On("StartWrite", apis.ChunkNum(5), uint32(0), data).Return(nil).Once()
+	relentingChatter, err := chunkserver.WithChatter(relenting, cache)
+	assert.NoError(t, err)
+	cache.Chunkservers["relenting"] = relentingChatter
+	ref := &Reference{Replicas: []apis.ServerAddress{"relenting"}, Version: 1, Chunk: 5}
+	start := time.Now()
+	hash, err := ref.PrepareWrite(cache, 0, data)
+	assert.NoError(t, err)
+	assert.Equal(t, apis.CalculateCommitHash(0, data), hash)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	relenting.AssertExpectations(t)
+
+	stubborn := &mocks.Chunkserver{}
+	stubborn.On("StartWrite", apis.ChunkNum(6), uint32(0), data).Return(busy)
+	stubbornChatter, err := chunkserver.WithChatter(stubborn, cache)
+	assert.NoError(t, err)
+	cache.Chunkservers["stubborn"] = stubbornChatter
+	ref = &Reference{Replicas: []apis.ServerAddress{"stubborn"}, Version: 1, Chunk: 6}
+	_, err = ref.PrepareWrite(cache, 0, data)
+	assert.True(t, errors.Is(err, apis.ErrStagingFull))
+	stubborn.AssertNumberOfCalls(t, "StartWrite", MaxBusyRetries+1)
+}
+
 //   ReadMeta partitions:
 //     chunk: exists, doesn't exist, currently deleting
 //     MRV: 0, >0
@@ -0,0 +1,65 @@
+package control
+
+import (
+	"context"
+
+	"zircon/lib/apis"
+	"zircon/lib/rpc"
+)
+
+// A view of a client whose requests are all bound to a context; see ContextClient.WithContext. Reads through it bind
+// the lookups through the frontend and the reads on the replicas, and never share a request with another read; see
+// coalesce.go.
+type boundClient struct {
+	c   *client
+	ctx context.Context
+}
+
+func (b *boundClient) New() (apis.ChunkNum, error) {
+	return b.c.newChunk(rpc.FrontendWithContext(b.ctx, b.c.fe))
+}
+
+func (b *boundClient) NewWithOptions(options apis.NewOptions) (apis.ChunkNum, error) {
+	return b.c.newChunkWithOptions(rpc.FrontendWithContext(b.ctx, b.c.fe), options)
+}
+
+func (b *boundClient) NewBatch(count int) ([]apis.ChunkNum, error) {
+	return b.c.newBatch(rpc.FrontendWithContext(b.ctx, b.c.fe), count)
+}
+
+func (b *boundClient) Read(ref apis.ChunkNum, offset uint32, length uint32) ([]byte, apis.Version, error) {
+	return b.c.read(b.ctx, ref, offset, length)
+}
+
+func (b *boundClient) ReadWithChecksum(ref apis.ChunkNum, offset uint32, length uint32) ([]byte, apis.Version, apis.Checksum, error) {
+	return b.c.readWithChecksum(b.ctx, ref, offset, length)
+}
+
+func (b *boundClient) ReadVersion(ref apis.ChunkNum, offset uint32, length uint32, version apis.Version) ([]byte, error) {
+	return b.c.readVersion(b.ctx, ref, offset, length, version)
+}
+
+func (b *boundClient) Write(ref apis.ChunkNum, offset uint32, version apis.Version, data []byte) (apis.Version, error) {
+	return b.c.WriteContext(b.ctx, ref, offset, version, data)
+}
+
+func (b *boundClient) WriteContext(ctx context.Context, ref apis.ChunkNum, offset uint32, version apis.Version, data []byte) (apis.Version, error) {
+	return b.c.WriteContext(ctx, ref, offset, version, data)
+}
+
+func (b *boundClient) WithContext(ctx context.Context) apis.Client {
+	return b.c.WithContext(ctx)
+}
+
+func (b *boundClient) Append(ref apis.ChunkNum, data []byte) (uint32, apis.Version, error) {
+	return b.c.appendContext(b.ctx, ref, data)
+}
+
+func (b *boundClient) Delete(ref apis.ChunkNum, version apis.Version) error {
+	return b.c.deleteChunk(rpc.FrontendWithContext(b.ctx, b.c.fe), ref, version)
+}
+
+// The client the view was made from is still in use, so only closing that releases anything.
+func (b *boundClient) Close() error {
+	return nil
+}
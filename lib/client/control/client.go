@@ -1,93 +1,577 @@
 package control
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"zircon/lib/apis"
 	"zircon/lib/rpc"
 	"zircon/lib/chunkupdate"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 type client struct {
-	fe    apis.Frontend
-	cache rpc.ConnectionCache
+	fe     apis.Frontend
+	cache  rpc.ConnectionCache
+	quorum chunkupdate.WriteQuorum
+	logger apis.Logger
+	hedge  time.Duration
+	// shared by all reads, so that each is sent to the replica that is keeping up best
+	load *chunkupdate.LoadTracker
+	// nil unless constructed with ClientOptions.CacheBytes; see readcache.go
+	cached *readCache
+	// see tracing.go
+	tracer trace.Tracer
+
+	// see snapshot.go and incomplete.go
+	mu           sync.Mutex
+	snapshots    map[SnapshotID]map[apis.ChunkNum]pinnedChunk
+	lastSnapshot SnapshotID
+	incomplete   map[apis.ChunkNum]struct{}
+
+	// see coalesce.go
+	readsMu sync.Mutex
+	reads   map[readKey]*readFlight
 }
 
 // Construct a client handler that can provide the apis.Client interface based on a single frontend and a way to connect
 // to chunkservers.
 // (Note: this frontend will likely be a zircon.frontend.RoundRobin implementation in most cases.)
 func ConstructClient(frontend apis.Frontend, conncache rpc.ConnectionCache) (apis.Client, error) {
+	return ConstructClientWithOptions(frontend, conncache, ClientOptions{})
+}
+
+// How a client constructed with ConstructClientWithOptions behaves. The zero value is a client like the one that
+// ConstructClient returns.
+type ClientOptions struct {
+	// How many replicas must receive the data for a write before it is committed; all of them if left as zero. This
+	// should match the quorum the frontends were configured with.
+	Quorum chunkupdate.WriteQuorum
+	// Where retried writes and replicas that could not be read from are reported; nowhere if nil.
+	Logger apis.Logger
+	// When a replica takes longer than this to answer a read, the read is also sent to another replica, and whichever
+	// answers first is used. This trims the slowest reads at the cost of some extra load on the chunkservers. Zero
+	// disables this.
+	Hedge time.Duration
+	// How many bytes of data from recent reads to keep, to serve reads from while the chunks they read haven't changed;
+	// see readcache.go. Zero disables this.
+	CacheBytes int
+	// Records a span for each read and write, and for each step they take; see tracing.go. The calls those steps make
+	// are only traced if the connection cache has an rpc.TracingInterceptor as well. Nothing is recorded if nil.
+	Tracing trace.TracerProvider
+}
+
+// Like ConstructClient, but takes all of the options at once, including those that can't be chosen any other way.
+func ConstructClientWithOptions(frontend apis.Frontend, conncache rpc.ConnectionCache, options ClientOptions) (apis.Client, error) {
+	if options.Logger == nil {
+		options.Logger = apis.NoopLogger
+	}
+	if options.Tracing == nil {
+		options.Tracing = noop.NewTracerProvider()
+	}
 	return &client{
 		fe: frontend,
 		cache: conncache,
+		quorum: options.Quorum,
+		logger: options.Logger,
+		hedge: options.Hedge,
+		load: chunkupdate.NewLoadTracker(),
+		cached: newReadCache(options.CacheBytes),
+		tracer: options.Tracing.Tracer(tracerName),
+		snapshots: map[SnapshotID]map[apis.ChunkNum]pinnedChunk{},
+		incomplete: map[apis.ChunkNum]struct{}{},
+		reads: map[readKey]*readFlight{},
 	}, nil
 }
 
 // Allocate a new chunk, all zeroed out. The first write must be done with version=0.
 // The chunk is not considered to exist until that first write is performed.
-// If this chunk isn't written to before the connection to the server closes, the empty chunk will be deleted.
+// If this chunk isn't written to before the client is closed, the empty chunk will be deleted; see incomplete.go.
 func (c *client) New() (apis.ChunkNum, error) {
-	return c.fe.New()
+	return c.newChunk(c.fe)
+}
+
+func (c *client) newChunk(fe apis.Frontend) (apis.ChunkNum, error) {
+	chunk, err := fe.New()
+	if err != nil {
+		return 0, err
+	}
+	c.allocated(chunk)
+	return chunk, nil
+}
+
+func (c *client) newChunkWithOptions(fe apis.Frontend, options apis.NewOptions) (apis.ChunkNum, error) {
+	chunk, err := fe.NewWithOptions(options)
+	if err != nil {
+		return 0, err
+	}
+	c.allocated(chunk)
+	return chunk, nil
+}
+
+// A client that can choose settings for the chunks it allocates, such as keeping critical data on more replicas than
+// the cluster default, or scratch data on fewer, or an ACL that keeps them from other principals.
+type OptionsClient interface {
+	apis.Client
+
+	// Like New, but the chunk is allocated with 'options'; see apis.NewOptions.
+	NewWithOptions(options apis.NewOptions) (apis.ChunkNum, error)
+}
+
+// Allocates a new chunk with 'options' through 'client', if it is able to. Options that are all defaults work with any
+// client.
+func NewWithOptions(client apis.Client, options apis.NewOptions) (apis.ChunkNum, error) {
+	if optioned, ok := client.(OptionsClient); ok {
+		return optioned.NewWithOptions(options)
+	}
+	if options.ReplicationFactor == 0 && options.ACL.Equals(apis.ACL{}) {
+		return client.New()
+	}
+	return 0, errors.New("client cannot choose options for new chunks")
+}
+
+func (c *client) NewWithOptions(options apis.NewOptions) (apis.ChunkNum, error) {
+	return c.newChunkWithOptions(c.fe, options)
+}
+
+// A client that can allocate many chunks in a single round trip to its frontend, for workloads such as ingesting large
+// files, where waiting on New for each chunk in turn would take most of the time.
+type BatchClient interface {
+	apis.Client
+
+	// Like New, but allocates 'count' chunks at once, up to apis.MaxBatchSize. Either every chunk is allocated, or none.
+	NewBatch(count int) ([]apis.ChunkNum, error)
+}
+
+// Allocates 'count' new chunks through 'client', all at once if it is able to, or else one at a time. If allocating
+// them one at a time fails partway through, the chunks allocated so far are left unwritten, to be deleted like any other
+// unwritten chunk.
+func NewBatch(client apis.Client, count int) ([]apis.ChunkNum, error) {
+	if batching, ok := client.(BatchClient); ok {
+		return batching.NewBatch(count)
+	}
+	if count < 1 || count > apis.MaxBatchSize {
+		return nil, fmt.Errorf("cannot allocate %d chunks at once", count)
+	}
+	chunks := make([]apis.ChunkNum, count)
+	for i := range chunks {
+		chunk, err := client.New()
+		if err != nil {
+			return nil, err
+		}
+		chunks[i] = chunk
+	}
+	return chunks, nil
+}
+
+func (c *client) NewBatch(count int) ([]apis.ChunkNum, error) {
+	return c.newBatch(c.fe, count)
+}
+
+func (c *client) newBatch(fe apis.Frontend, count int) ([]apis.ChunkNum, error) {
+	chunks, err := fe.AllocateChunks(count)
+	if err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunks {
+		c.allocated(chunk)
+	}
+	return chunks, nil
 }
 
 // Read part or all of the contents of a chunk. offset + length cannot exceed MaxChunkSize.
 // Returns the data read and the version of the data read. The version can be used with Write.
-// If the chunk does not exist, returns an error.
+// If the chunk does not exist, returns an error. Identical reads in progress at once share a request; see coalesce.go.
+// Each read goes to whichever replica is least loaded, by how this client's recent reads went; see chunkupdate.LoadTracker.
 func (c *client) Read(ref apis.ChunkNum, offset uint32, length uint32) ([]byte, apis.Version, error) {
-	version, addresses, err := c.fe.ReadMetadataEntry(ref)
+	return c.read(context.Background(), ref, offset, length)
+}
+
+func (c *client) read(ctx context.Context, ref apis.ChunkNum, offset uint32, length uint32) (data []byte, version apis.Version, err error) {
+	ctx, span := c.startRequest(ctx, "Client.Read", ref, offset, int(length))
+	defer func() {
+		endSpan(span, err)
+	}()
+	ctx, version, addresses, err := c.lookup(ctx, ref)
 	if err != nil {
 		return nil, 0, err
 	}
+	if data, found := c.cached.get(ref, offset, length, version); found {
+		span.SetAttributes(attribute.Bool("zircon.cached", true))
+		return data, version, nil
+	}
+	readCtx, step := c.tracer.Start(ctx, "read")
 	reference := &chunkupdate.Reference{
-		Chunk:    ref,
-		Version:  version,
-		Replicas: addresses,
+		Chunk:      ref,
+		Version:    version,
+		Replicas:   addresses,
+		Logger:     c.logger,
+		HedgeAfter: c.hedge,
+		Load:       c.load,
+		Context:    readCtx,
 	}
-	return reference.PerformRead(c.cache, offset, length)
+	if ctx.Done() != nil {
+		// a read that can be cancelled doesn't share its request, so that cancelling it can't fail anyone else's read
+		data, version, err = reference.PerformRead(c.cache, offset, length)
+	} else {
+		data, version, err = c.coalescedRead(reference, offset, length)
+	}
+	endSpan(step, err)
+	if err == nil {
+		c.cached.put(ref, offset, version, data)
+	}
+	return data, version, err
+}
+
+// Like Read, but also returns the checksum of the data reported by the chunkserver it was read from, once the data has
+// been checked against it.
+func (c *client) ReadWithChecksum(ref apis.ChunkNum, offset uint32, length uint32) ([]byte, apis.Version, apis.Checksum, error) {
+	return c.readWithChecksum(context.Background(), ref, offset, length)
+}
+
+func (c *client) readWithChecksum(ctx context.Context, ref apis.ChunkNum, offset uint32, length uint32) (data []byte, version apis.Version, checksum apis.Checksum, err error) {
+	ctx, span := c.startRequest(ctx, "Client.ReadWithChecksum", ref, offset, int(length))
+	defer func() {
+		endSpan(span, err)
+	}()
+	ctx, version, addresses, err := c.lookup(ctx, ref)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	readCtx, step := c.tracer.Start(ctx, "read")
+	reference := &chunkupdate.Reference{
+		Chunk:      ref,
+		Version:    version,
+		Replicas:   addresses,
+		Logger:     c.logger,
+		HedgeAfter: c.hedge,
+		Load:       c.load,
+		Context:    readCtx,
+	}
+	data, version, checksum, err = reference.PerformReadWithChecksum(c.cache, offset, length)
+	endSpan(step, err)
+	return data, version, checksum, err
+}
+
+// Read part or all of the contents of a chunk as of a specific version, which may be older than the latest one.
+// If that version has been reclaimed on every replica, returns an error matching ErrVersionReclaimed.
+func (c *client) ReadVersion(ref apis.ChunkNum, offset uint32, length uint32, version apis.Version) ([]byte, error) {
+	return c.readVersion(context.Background(), ref, offset, length, version)
+}
+
+func (c *client) readVersion(ctx context.Context, ref apis.ChunkNum, offset uint32, length uint32, version apis.Version) (data []byte, err error) {
+	ctx, span := c.startRequest(ctx, "Client.ReadVersion", ref, offset, int(length))
+	defer func() {
+		endSpan(span, err)
+	}()
+	ctx, current, addresses, err := c.lookup(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if version > current {
+		return nil, fmt.Errorf("chunk %d is only at version %d, not %d: %w", ref, current, version, apis.ErrNotFound)
+	}
+	readCtx, step := c.tracer.Start(ctx, "read")
+	reference := &chunkupdate.Reference{
+		Chunk:      ref,
+		Version:    current,
+		Replicas:   addresses,
+		Logger:     c.logger,
+		HedgeAfter: c.hedge,
+		Load:       c.load,
+		Context:    readCtx,
+	}
+	data, err = reference.PerformReadVersion(c.cache, offset, length, version)
+	endSpan(step, err)
+	return data, err
+}
+
+// How many times a write with AnyVersion is attempted when other writes to the same chunk keep committing first.
+const AnyVersionAttempts = 10
+
+// Where the time went during a write. The phases add up to roughly the total; when the write was attempted more than
+// once, each phase includes the time it took in every attempt.
+type WriteTrace struct {
+	// Looking up the chunk's current version and replicas from the frontend.
+	Lookup time.Duration
+	// Staging the data on the replicas, through StartWriteReplicated.
+	Prepare time.Duration
+	// Committing the write through the frontend, which updates the metadata entry, commits the data on each replica,
+	// and has them serve the new version with UpdateLatestVersion.
+	Commit time.Duration
+	// How many times a write with AnyVersion was attempted again because another write committed first, and the time
+	// spent on the attempts that were abandoned.
+	Retries  int
+	Retrying time.Duration
+	Total    time.Duration
+}
+
+// A client that can report where the time went during a write.
+type TracingClient interface {
+	apis.Client
+
+	// Like Write, but also returns a breakdown of how long each part of the write took.
+	WriteTraced(ref apis.ChunkNum, offset uint32, version apis.Version, data []byte) (apis.Version, WriteTrace, error)
+}
+
+// Writes through 'client' and reports where the time went. If the client can't break a write down into phases, only
+// the total is filled in.
+func WriteTraced(client apis.Client, ref apis.ChunkNum, offset uint32, version apis.Version, data []byte) (apis.Version, WriteTrace, error) {
+	if tracing, ok := client.(TracingClient); ok {
+		return tracing.WriteTraced(ref, offset, version, data)
+	}
+	start := time.Now()
+	newVersion, err := client.Write(ref, offset, version, data)
+	return newVersion, WriteTrace{Total: time.Since(start)}, err
 }
 
 // Write part or all of the contents of a chunk. offset + len(data) cannot exceed MaxChunkSize.
 // Takes a version; if the version is not AnyVersion and doesn't match the latest version of the chunk, the write is
-// rejected.
+// rejected. With AnyVersion, the write is attempted again if another write commits first.
 // Returns the new version, if the request succeeds, or the most recent version number, if the request fails due to
 // staleness.
 // If the chunk does not exist, returns an error. If this fails for any reason, there must be no visible change to
 // the underlying data. If this fails for a reason besides staleness, the version must be zero.
 func (c *client) Write(ref apis.ChunkNum, offset uint32, version apis.Version, data []byte) (apis.Version, error) {
-	rversion, addresses, err := c.fe.ReadMetadataEntry(ref)
+	newVersion, _, err := c.WriteTraced(ref, offset, version, data)
+	return newVersion, err
+}
+
+func (c *client) WriteTraced(ref apis.ChunkNum, offset uint32, version apis.Version, data []byte) (apis.Version, WriteTrace, error) {
+	return c.writeTraced(context.Background(), ref, offset, version, data)
+}
+
+// A client whose requests can be bound to a context, so that callers can impose deadlines on them and cancel them while
+// they are in flight.
+type ContextClient interface {
+	apis.Client
+
+	// Returns a view of this client whose requests are all bound to ctx, from the lookups through the frontend to the
+	// reads and writes on the replicas. Once a write has been handed to the frontend to commit, the frontend carries it
+	// through even if ctx ends, so that the replicas are not left to diverge; the caller just stops waiting for it.
+	// The view shares this client's connections and snapshots, and closing it does nothing.
+	WithContext(ctx context.Context) apis.Client
+
+	// Like Write, but every call made for the write shares the deadline of ctx: the lookup and commit through the
+	// frontend, staging the data on the replicas, and the calls that the replicas make to forward it to each other.
+	// Each step fails without being started once less than rpc.MinimumCallBudget is left, with an error matching
+	// context.DeadlineExceeded, and a write with AnyVersion is not attempted again after that.
+	WriteContext(ctx context.Context, ref apis.ChunkNum, offset uint32, version apis.Version, data []byte) (apis.Version, error)
+}
+
+// Writes through 'client' within the deadline of ctx. If the client can't bound its calls by a context, the budget is
+// only checked before the write starts.
+func WriteContext(ctx context.Context, client apis.Client, ref apis.ChunkNum, offset uint32, version apis.Version, data []byte) (apis.Version, error) {
+	if contextual, ok := client.(ContextClient); ok {
+		return contextual.WriteContext(ctx, ref, offset, version, data)
+	}
+	if err := rpc.CheckBudget(ctx); err != nil {
+		return 0, err
+	}
+	return client.Write(ref, offset, version, data)
+}
+
+// Binds every request made through 'client' to ctx, if it is a ContextClient. Other clients are returned unchanged.
+func ClientWithContext(ctx context.Context, client apis.Client) apis.Client {
+	if contextual, ok := client.(ContextClient); ok {
+		return contextual.WithContext(ctx)
+	}
+	return client
+}
+
+func (c *client) WriteContext(ctx context.Context, ref apis.ChunkNum, offset uint32, version apis.Version, data []byte) (apis.Version, error) {
+	newVersion, _, err := c.writeTraced(ctx, ref, offset, version, data)
+	return newVersion, err
+}
+
+func (c *client) WithContext(ctx context.Context) apis.Client {
+	return &boundClient{c: c, ctx: ctx}
+}
+
+func (c *client) writeTraced(ctx context.Context, ref apis.ChunkNum, offset uint32, version apis.Version, data []byte) (newVersion apis.Version, trace WriteTrace, err error) {
+	ctx, span := c.startRequest(ctx, "Client.Write", ref, offset, len(data))
+	defer func() {
+		span.SetAttributes(attribute.Int("zircon.retries", trace.Retries))
+		endSpan(span, err)
+	}()
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		attemptStart := time.Now()
+		newVersion, err = c.writeOnce(ctx, ref, offset, version, data, &trace)
+		if err == nil {
+			c.completed(ref)
+		}
+		if version != apis.AnyVersion || attempt >= AnyVersionAttempts || !errors.Is(err, apis.ErrVersionStale) {
+			trace.Total = time.Since(start)
+			return newVersion, trace, err
+		}
+		trace.Retries++
+		trace.Retrying += time.Since(attemptStart)
+		c.logger.Logf(apis.DEBUG, "retrying write to chunk %d after attempt %d lost to another write: %v", ref, attempt, err)
+	}
+}
+
+func (c *client) writeOnce(ctx context.Context, ref apis.ChunkNum, offset uint32, version apis.Version, data []byte, trace *WriteTrace) (apis.Version, error) {
+	if err := rpc.CheckBudget(ctx); err != nil {
+		return 0, fmt.Errorf("[client.go/CB] %w", err)
+	}
+	phase := time.Now()
+	ctx, rversion, addresses, err := c.lookup(ctx, ref)
+	trace.Lookup += time.Since(phase)
 	if err != nil {
-		return 0, fmt.Errorf("[client.go/RME] %v", err)
+		return 0, fmt.Errorf("[client.go/RME] %w", err)
 	}
 	if len(addresses) == 0 {
 		return 0, fmt.Errorf("given zero replicas when reading metadata entry")
 	}
-	if rversion != version {
-		return rversion, fmt.Errorf("version mismatch: found %d instead of %d", rversion, version)
+	if version != apis.AnyVersion && rversion != version {
+		return rversion, fmt.Errorf("version mismatch for write=%d: %w", version, apis.VersionStaleError{Current: rversion})
 	}
+	prepareCtx, step := c.tracer.Start(ctx, "prepare")
 	reference := &chunkupdate.Reference{
 		Chunk:    ref,
 		Version:  rversion,
 		Replicas: addresses,
+		Quorum:   c.quorum,
+		Logger:   c.logger,
+		Context:  prepareCtx,
 	}
+	phase = time.Now()
 	hash, err := reference.PrepareWrite(c.cache, offset, data)
+	trace.Prepare += time.Since(phase)
+	endSpan(step, err)
 	if err != nil {
-		return 0, fmt.Errorf("[client.go/RPW] %v", err)
+		return 0, fmt.Errorf("[client.go/RPW] %w", err)
 	}
-	ver, err := c.fe.CommitWrite(ref, version, hash)
+	if err := rpc.CheckBudget(ctx); err != nil {
+		return 0, fmt.Errorf("[client.go/CB] %w", err)
+	}
+	// commit against the version the data was staged for, so that a write that committed in the meantime is noticed
+	commitCtx, step := c.tracer.Start(ctx, "commit")
+	phase = time.Now()
+	ver, err := rpc.FrontendWithContext(commitCtx, c.fe).CommitWrite(ref, rversion, hash)
+	trace.Commit += time.Since(phase)
+	endSpan(step, err)
 	if err != nil {
-		return ver, fmt.Errorf("[client.go/FCW] %v", err)
+		return ver, fmt.Errorf("[client.go/FCW] %w", err)
 	}
 	return ver, nil
 }
 
+// Append data to the end of the valid data in a chunk, and return where it was placed along with the new version.
+// The data is staged on the replicas once, and then committed against whichever version is current at the time, so
+// concurrent appends to the same chunk don't have to be sent again when another one commits first.
+func (c *client) Append(ref apis.ChunkNum, data []byte) (uint32, apis.Version, error) {
+	return c.appendContext(context.Background(), ref, data)
+}
+
+func (c *client) appendContext(ctx context.Context, ref apis.ChunkNum, data []byte) (uint32, apis.Version, error) {
+	// the replicas only stage the data for callers that present the capability issued with the entry
+	ctx = rpc.ContextWithCapabilities(ctx)
+	fe := rpc.FrontendWithContext(ctx, c.fe)
+	_, addresses, err := fe.ReadMetadataEntry(ref)
+	if err != nil {
+		return 0, 0, fmt.Errorf("[client.go/RME] %w", err)
+	}
+	if len(addresses) == 0 {
+		return 0, 0, fmt.Errorf("given zero replicas when reading metadata entry")
+	}
+	reference := &chunkupdate.Reference{
+		Chunk:    ref,
+		Replicas: addresses,
+		Quorum:   c.quorum,
+		Logger:   c.logger,
+		Context:  ctx,
+	}
+	hash, err := reference.PrepareAppend(c.cache, data)
+	if err != nil {
+		return 0, 0, fmt.Errorf("[client.go/RPA] %w", err)
+	}
+	version, offset, err := fe.CommitAppend(ref, hash)
+	if err != nil {
+		return 0, 0, fmt.Errorf("[client.go/FCA] %w", err)
+	}
+	c.completed(ref)
+	return offset, version, nil
+}
+
+// A client that can report on the replicas of a chunk.
+type StatusClient interface {
+	apis.Client
+
+	// Reads the metadata entry of a chunk, and asks each of its replicas which version it has, so that replicas that
+	// have diverged from the metadata can be found. A replica that can't be asked is reported rather than failing the
+	// whole request.
+	StatChunk(ref apis.ChunkNum) (apis.ChunkStatus, error)
+}
+
+// Reports on the replicas of a chunk through 'client', if it is able to.
+func StatChunk(client apis.Client, ref apis.ChunkNum) (apis.ChunkStatus, error) {
+	if status, ok := client.(StatusClient); ok {
+		return status.StatChunk(ref)
+	}
+	return apis.ChunkStatus{}, errors.New("client cannot report the status of chunks")
+}
+
+func (c *client) StatChunk(ref apis.ChunkNum) (apis.ChunkStatus, error) {
+	ctx := rpc.ContextWithCapabilities(context.Background())
+	entry, addresses, err := rpc.FrontendWithContext(ctx, c.fe).ReadFullMetadataEntry(ref)
+	if err != nil {
+		return apis.ChunkStatus{}, fmt.Errorf("[client.go/RFME] %w", err)
+	}
+	status := apis.ChunkStatus{
+		Chunk:               ref,
+		MostRecentVersion:   entry.MostRecentVersion,
+		LastConsumedVersion: entry.LastConsumedVersion,
+		Replicas:            make([]apis.ReplicaStatus, len(entry.Replicas)),
+	}
+	for i, id := range entry.Replicas {
+		replica := &status.Replicas[i]
+		replica.ID = id
+		replica.Address = addresses[i]
+		for _, laggard := range entry.Lagging {
+			replica.Lagging = replica.Lagging || laggard == id
+		}
+		cs, err := c.cache.SubscribeChunkserver(addresses[i])
+		if err != nil {
+			replica.Err = err
+			continue
+		}
+		// an empty read of whatever version the replica has reports which version that is
+		_, replica.Version, replica.Err = rpc.ChunkserverWithContext(ctx, cs).Read(ref, 0, 0, apis.AnyVersion)
+	}
+	return status, nil
+}
+
 // Destroy a chunk, given a specific version number. Version checking works the same as for Write.
 // If the chunk does not exist, returns an error.
 func (c *client) Delete(ref apis.ChunkNum, version apis.Version) error {
-	return c.fe.Delete(ref, version)
+	return c.deleteChunk(c.fe, ref, version)
 }
 
-// Close all connections used by this client.
-func (c *client) Close() error {
-	// nothing to do here... just when wrapped
+func (c *client) deleteChunk(fe apis.Frontend, ref apis.ChunkNum, version apis.Version) error {
+	if err := fe.Delete(ref, version); err != nil {
+		return err
+	}
+	c.cached.forget(ref)
+	// the chunk number may be handed out again, so it mustn't be deleted again when this client is closed
+	c.completed(ref)
 	return nil
 }
+
+// Close all connections used by this client, release any snapshots it still holds, and delete the chunks it allocated
+// that were never written to.
+func (c *client) Close() error {
+	// connections are only closed when wrapped
+	snapshotErr := c.releaseAllSnapshots()
+	if err := c.deleteIncomplete(); err != nil {
+		return err
+	}
+	return snapshotErr
+}
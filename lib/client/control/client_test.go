@@ -1,15 +1,21 @@
 package control
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"math/rand"
+	"runtime"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 	"log"
 
 	"zircon/lib/apis"
 	"zircon/lib/chunkserver"
+	"zircon/lib/chunkupdate"
 	"zircon/lib/etcd"
 	"zircon/lib/frontend"
 	"zircon/lib/rpc"
@@ -18,10 +24,28 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // Prepares three chunkservers (cs0-cs2) and one frontend server (fe0)
 func PrepareLocalCluster(t *testing.T) (rpccache rpc.ConnectionCache, stats chunkserver.StorageStats, fe apis.Frontend, teardown func()) {
+	return PrepareLocalClusterWith(t, frontend.ConstructFrontend)
+}
+
+// Like PrepareLocalCluster, but constructs the frontend with a custom function.
+func PrepareLocalClusterWith(t *testing.T, construct func(apis.EtcdInterface, rpc.ConnectionCache) (apis.Frontend, error)) (rpccache rpc.ConnectionCache, stats chunkserver.StorageStats, fe apis.Frontend, teardown func()) {
+	return prepareLocalCluster(t, construct, metadatacache.MonotonicAllocation)
+}
+
+// Like PrepareLocalCluster, but the metadata cache hands out chunk numbers with 'strategy'.
+func PrepareLocalClusterWithAllocation(t *testing.T, strategy metadatacache.AllocationStrategy) (rpccache rpc.ConnectionCache, stats chunkserver.StorageStats, fe apis.Frontend, teardown func()) {
+	return prepareLocalCluster(t, frontend.ConstructFrontend, strategy)
+}
+
+func prepareLocalCluster(t *testing.T, construct func(apis.EtcdInterface, rpc.ConnectionCache) (apis.Frontend, error), strategy metadatacache.AllocationStrategy) (rpccache rpc.ConnectionCache, stats chunkserver.StorageStats, fe apis.Frontend, teardown func()) {
 	cache := &rpc.MockCache{
 		Frontends: map[apis.ServerAddress]apis.Frontend{},
 		Chunkservers: map[apis.ServerAddress]apis.Chunkserver{},
@@ -46,10 +70,13 @@ func PrepareLocalCluster(t *testing.T) (rpccache rpc.ConnectionCache, stats chun
 
 	etcd0, teardown2 := etcds("fe0")
 	teardowns.Add(teardown2)
-	fe, err := frontend.ConstructFrontend(etcd0, cache)
-	assert.NoError(t, err)
-	mdc0, err := metadatacache.NewCache(cache, etcd0)
+	fe, err := construct(etcd0, cache)
 	assert.NoError(t, err)
+	mdc0, err := metadatacache.NewCacheWithOptions(cache, etcd0, metadatacache.CacheOptions{Strategy: strategy})
+	require.NoError(t, err)
+	teardowns.Add(func() {
+		assert.NoError(t, mdc0.Close())
+	})
 	cache.MetadataCaches = map[apis.ServerAddress]apis.MetadataCache{
 		"mdc-address-0": mdc0,
 	}
@@ -62,7 +89,7 @@ func PrepareLocalCluster(t *testing.T) (rpccache rpc.ConnectionCache, stats chun
 				sum += statf()
 			}
 			return sum
-		}, fe, teardowns.Teardown
+		}, fe, teardowns.TeardownReverse
 }
 
 func PrepareSimpleClient(t *testing.T) (apis.Client, func()) {
@@ -104,7 +131,10 @@ func TestSimpleClientReadWrite(t *testing.T) {
 	assert.True(t, ver3 > ver2)
 
 	ver5, err := client.Write(cn, 7, ver2, []byte("earth..."))
-	assert.Error(t, err)
+	var stale apis.VersionStaleError
+	if assert.True(t, errors.As(err, &stale)) {
+		assert.Equal(t, ver3, stale.Current)
+	}
 	assert.Equal(t, ver3, ver5) // make sure it returns the correct new version after staleness failure
 
 	data, ver4, err := client.Read(cn, 0, apis.MaxChunkSize)
@@ -112,7 +142,7 @@ func TestSimpleClientReadWrite(t *testing.T) {
 	assert.Equal(t, ver3, ver4)
 	assert.Equal(t, "hello, home!!", string(util.StripTrailingZeroes(data)))
 
-	assert.Error(t, client.Delete(cn, ver2))
+	assert.True(t, errors.Is(client.Delete(cn, ver2), apis.ErrVersionStale))
 
 	data, ver6, err := client.Read(cn, 0, apis.MaxChunkSize)
 	assert.NoError(t, err)
@@ -122,9 +152,263 @@ func TestSimpleClientReadWrite(t *testing.T) {
 	assert.NoError(t, client.Delete(cn, ver6))
 
 	_, _, err = client.Read(cn, 0, apis.MaxChunkSize)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+}
+
+// Tests that a specific version of a chunk can be read, and that older versions are reported as reclaimed once the
+// chunkservers stop retaining them, which these test chunkservers do right away.
+func TestClientReadVersion(t *testing.T) {
+	client, teardown := PrepareSimpleClient(t)
+	defer teardown()
+
+	cn, err := client.New()
+	require.NoError(t, err)
+	ver, err := client.Write(cn, 0, apis.AnyVersion, []byte("hello, world!"))
+	require.NoError(t, err)
+
+	data, err := client.ReadVersion(cn, 0, 13, ver)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello, world!", string(data))
+
+	ver2, err := client.Write(cn, 7, ver, []byte("home!"))
+	require.NoError(t, err)
+
+	data, err = client.ReadVersion(cn, 0, 13, ver2)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello, home!!", string(data))
+
+	_, err = client.ReadVersion(cn, 0, 13, ver)
+	assert.True(t, errors.Is(err, apis.ErrVersionReclaimed))
+
+	_, err = client.ReadVersion(cn, 0, 13, ver2+1)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+}
+
+// A chunkserver that damages the data it returns with a checksum, as if it had been corrupted in transit.
+type damagingChunkserver struct {
+	apis.Chunkserver
+}
+
+func (d damagingChunkserver) ReadWithChecksum(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, apis.Checksum, error) {
+	data, version, checksum, err := d.Chunkserver.ReadWithChecksum(chunk, offset, length, minimum)
+	if err == nil && len(data) > 0 {
+		data[0] ^= 0xFF
+	}
+	return data, version, checksum, err
+}
+
+// Tests that the checksum returned with a read matches the data, and that damaged data from one replica is passed over
+// in favor of another.
+func TestClientReadWithChecksum(t *testing.T) {
+	cache, _, fe, teardown := PrepareLocalCluster(t)
+	defer teardown()
+	client, err := ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer client.Close()
+
+	cn, err := client.New()
+	require.NoError(t, err)
+	ver, err := client.Write(cn, 0, apis.AnyVersion, []byte("hello, world!"))
+	require.NoError(t, err)
+
+	castagnoli := crc32.MakeTable(crc32.Castagnoli)
+	data, ver2, checksum, err := client.ReadWithChecksum(cn, 7, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, ver, ver2)
+	assert.Equal(t, "world", string(data))
+	assert.Equal(t, apis.Checksum(crc32.Checksum([]byte("world"), castagnoli)), checksum)
+
+	data, _, checksum, err = client.ReadWithChecksum(cn, 0, apis.MaxChunkSize)
+	assert.NoError(t, err)
+	assert.Equal(t, apis.Checksum(crc32.Checksum(data, castagnoli)), checksum)
+
+	mock := cache.(*rpc.MockCache)
+	for address, cs := range mock.Chunkservers {
+		mock.Chunkservers[address] = damagingChunkserver{cs}
+		break
+	}
+	for i := 0; i < 10; i++ {
+		data, _, _, err = client.ReadWithChecksum(cn, 0, 13)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello, world!", string(data))
+	}
+}
+
+// A chunkserver whose reads don't answer until the test is over, and then fail.
+type stalledChunkserver struct {
+	apis.Chunkserver
+	release <-chan struct{}
+	mu      sync.Mutex
+	reads   int
+}
+
+func (s *stalledChunkserver) Read(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, error) {
+	s.mu.Lock()
+	s.reads++
+	s.mu.Unlock()
+	<-s.release
+	return nil, 0, errors.New("stalled chunkserver never answers")
+}
+
+func (s *stalledChunkserver) readCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads
+}
+
+// Tests that with hedging enabled, a read that went to a replica that doesn't answer is answered by the other one soon
+// after the hedge delay.
+func TestClientHedgedRead(t *testing.T) {
+	cache, _, fe, teardown := PrepareLocalCluster(t)
+	defer teardown()
+	release := make(chan struct{})
+	defer close(release)
+	const hedge = 20 * time.Millisecond
+	client, err := ConstructClientWithOptions(fe, cache, ClientOptions{Hedge: hedge})
+	require.NoError(t, err)
+	defer client.Close()
+
+	cn, err := client.New()
+	require.NoError(t, err)
+	ver, err := client.Write(cn, 0, apis.AnyVersion, []byte("hello, world!"))
+	require.NoError(t, err)
+
+	_, replicas, err := fe.ReadMetadataEntry(cn)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(replicas))
+	mock := cache.(*rpc.MockCache)
+	stalled := &stalledChunkserver{Chunkserver: mock.Chunkservers[replicas[0]], release: release}
+	mock.Chunkservers[replicas[0]] = stalled
+
+	// a client stops picking a replica that is still stuck on its earlier reads, so each read is made by a new client,
+	// which knows nothing about the load on the replicas yet and tries them in order
+	for i := 0; i < 100 && stalled.readCount() < 3; i++ {
+		reader, err := ConstructClientWithOptions(fe, cache, ClientOptions{Hedge: hedge})
+		require.NoError(t, err)
+		start := time.Now()
+		data, ver2, err := reader.Read(cn, 0, 13)
+		assert.NoError(t, reader.Close())
+		require.NoError(t, err)
+		assert.Equal(t, ver, ver2)
+		assert.Equal(t, "hello, world!", string(data))
+		assert.True(t, time.Since(start) < hedge+time.Second, "read took %v", time.Since(start))
+	}
+	assert.Equal(t, 3, stalled.readCount())
+}
+
+// A chunkserver that accepts new versions of one chunk, but never starts serving them.
+type forgetfulChunkserver struct {
+	apis.Chunkserver
+	chunk apis.ChunkNum
+}
+
+func (f forgetfulChunkserver) UpdateLatestVersion(chunk apis.ChunkNum, oldVersion apis.Version, newVersion apis.Version) error {
+	if chunk == f.chunk {
+		return nil
+	}
+	return f.Chunkserver.UpdateLatestVersion(chunk, oldVersion, newVersion)
+}
+
+// Tests that StatChunk reports the version each replica serves, and so finds a replica that silently fell behind.
+func TestStatChunk(t *testing.T) {
+	cache, _, fe, teardown := PrepareLocalCluster(t)
+	defer teardown()
+	client, err := ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer client.Close()
+
+	cn, err := client.New()
+	require.NoError(t, err)
+	ver, err := client.Write(cn, 0, apis.AnyVersion, []byte("first"))
+	require.NoError(t, err)
+
+	status, err := StatChunk(client, cn)
+	require.NoError(t, err)
+	assert.Equal(t, cn, status.Chunk)
+	assert.Equal(t, ver, status.MostRecentVersion)
+	assert.Equal(t, ver, status.LastConsumedVersion)
+	assert.Equal(t, 2, len(status.Replicas))
+	for _, replica := range status.Replicas {
+		assert.NoError(t, replica.Err)
+		assert.Equal(t, ver, replica.Version)
+		assert.False(t, replica.Lagging)
+	}
+	assert.Empty(t, status.Diverged())
+
+	_, replicas, err := fe.ReadMetadataEntry(cn)
+	require.NoError(t, err)
+	mock := cache.(*rpc.MockCache)
+	mock.Chunkservers[replicas[0]] = forgetfulChunkserver{Chunkserver: mock.Chunkservers[replicas[0]], chunk: cn}
+	ver2, err := client.Write(cn, 0, ver, []byte("second"))
+	require.NoError(t, err)
+
+	status, err = StatChunk(client, cn)
+	require.NoError(t, err)
+	assert.Equal(t, ver2, status.MostRecentVersion)
+	diverged := status.Diverged()
+	if assert.Equal(t, 1, len(diverged)) {
+		assert.Equal(t, replicas[0], diverged[0].Address)
+		assert.Equal(t, ver, diverged[0].Version)
+		assert.NoError(t, diverged[0].Err)
+		// the metadata has no idea
+		assert.False(t, diverged[0].Lagging)
+	}
+
+	_, err = StatChunk(client, cn+1000)
 	assert.Error(t, err)
 }
 
+// Tests that a snapshot keeps reading the data from when it was taken while the chunks are overwritten, and that
+// releasing it lets the old versions be reclaimed.
+func TestSnapshot(t *testing.T) {
+	cache, _, fe, teardown := PrepareLocalCluster(t)
+	defer teardown()
+	client, err := ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var chunks []apis.ChunkNum
+	var versions []apis.Version
+	for i := 0; i < 3; i++ {
+		cn, err := client.New()
+		require.NoError(t, err)
+		ver, err := client.Write(cn, 0, apis.AnyVersion, []byte(fmt.Sprintf("original %d", i)))
+		require.NoError(t, err)
+		chunks = append(chunks, cn)
+		versions = append(versions, ver)
+	}
+
+	id, err := Snapshot(client, chunks[:2])
+	require.NoError(t, err)
+	for i, cn := range chunks {
+		_, err := client.Write(cn, 0, versions[i], []byte(fmt.Sprintf("replaced %d", i)))
+		require.NoError(t, err)
+	}
+
+	for i, cn := range chunks[:2] {
+		data, err := ReadSnapshot(client, id, cn, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("original %d", i), string(data))
+		data, _, err = client.Read(cn, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("replaced %d", i), string(data))
+	}
+	// the chunk left out of the snapshot was reclaimed as usual
+	_, err = ReadSnapshot(client, id, chunks[2], 0, 10)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+	_, err = client.ReadVersion(chunks[2], 0, 10, versions[2])
+	assert.True(t, errors.Is(err, apis.ErrVersionReclaimed))
+
+	require.NoError(t, ReleaseSnapshot(client, id))
+	_, err = ReadSnapshot(client, id, chunks[0], 0, 10)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+	for i, cn := range chunks[:2] {
+		_, err = client.ReadVersion(cn, 0, 10, versions[i])
+		assert.True(t, errors.Is(err, apis.ErrVersionReclaimed))
+	}
+	assert.True(t, errors.Is(ReleaseSnapshot(client, id), apis.ErrNotFound))
+}
+
 // Tests that error checking works properly for reads and writes that exceed the maximum chunk size
 func TestMaxSizeChecking(t *testing.T) {
 	client, teardown := PrepareSimpleClient(t)
@@ -225,6 +509,205 @@ func TestReadRate(t *testing.T) {
 	log.Printf("results of read test: %d final\n", finalCount)
 }
 
+// Tests that a client which finds its frontend through etcd keeps working when that frontend restarts on a new address
+// in the middle of a stream of requests.
+func TestClientRecoversFromFrontendRestart(t *testing.T) {
+	cache, _, fe, teardown := PrepareLocalCluster(t)
+	defer teardown()
+	etcds, teardownEtcd := etcd.PrepareSubscribeForTesting(t)
+	defer teardownEtcd()
+	registration, teardownRegistration := etcds("fe0")
+	defer teardownRegistration()
+	lookup, teardownLookup := etcds("client")
+	defer teardownLookup()
+
+	publish := func() func(kill bool) error {
+		stop, address, err := rpc.PublishFrontend(fe, "127.0.0.1:0")
+		require.NoError(t, err)
+		require.NoError(t, registration.UpdateAddress(address, apis.FRONTEND))
+		return stop
+	}
+	stop := publish()
+	defer func() {
+		stop(true)
+	}()
+
+	feCache := rpc.NewConnectionCache()
+	defer feCache.CloseAll()
+	client, err := ConstructClient(frontend.Rediscovering(lookup, feCache), cache)
+	require.NoError(t, err)
+	defer client.Close()
+
+	chunk, err := client.New()
+	require.NoError(t, err)
+	ver, err := client.Write(chunk, 0, apis.AnyVersion, []byte("hello world"))
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	reads := make(chan int)
+	go func() {
+		count := 0
+		defer func() {
+			reads <- count
+		}()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			data, rver, err := client.Read(chunk, 0, 11)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, ver, rver)
+			assert.Equal(t, "hello world", string(data))
+			count++
+		}
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	stop(true)
+	time.Sleep(50 * time.Millisecond)
+	stop = publish()
+	time.Sleep(200 * time.Millisecond)
+	close(done)
+	assert.True(t, <-reads > 0)
+
+	// writes go to the new frontend as well
+	ver2, err := client.Write(chunk, 0, ver, []byte("hello earth"))
+	assert.NoError(t, err)
+	data, rver, err := client.Read(chunk, 0, 11)
+	assert.NoError(t, err)
+	assert.Equal(t, ver2, rver)
+	assert.Equal(t, "hello earth", string(data))
+}
+
+// A placement policy that never puts two replicas of a chunk in the same zone.
+type zonePlacement map[apis.ServerName]string
+
+func (z zonePlacement) Place(count int, existing []chunkupdate.Candidate, candidates []chunkupdate.Candidate) ([]apis.ServerID, error) {
+	used := map[string]bool{}
+	for _, server := range existing {
+		used[z[server.Name]] = true
+	}
+	var chosen []apis.ServerID
+	for _, i := range rand.Perm(len(candidates)) {
+		if len(chosen) < count && !used[z[candidates[i].Name]] {
+			used[z[candidates[i].Name]] = true
+			chosen = append(chosen, candidates[i].ID)
+		}
+	}
+	if len(chosen) < count {
+		return nil, fmt.Errorf("only %d zones available for %d replicas", len(chosen), count)
+	}
+	return chosen, nil
+}
+
+// Tests that new chunks are placed according to a custom placement policy.
+func TestZonePlacement(t *testing.T) {
+	zones := zonePlacement{"cs0": "a", "cs1": "a", "cs2": "b"}
+	for _, replicas := range []int{2, 3} {
+		cache, _, fe, teardown := PrepareLocalClusterWith(t, func(etcd apis.EtcdInterface, cache rpc.ConnectionCache) (apis.Frontend, error) {
+			return frontend.ConstructFrontendWithOptions(etcd, cache, frontend.FrontendOptions{Replicas: replicas, Placement: zones})
+		})
+		client, err := ConstructClient(fe, cache)
+		require.NoError(t, err)
+
+		for i := 0; i < 10; i++ {
+			chunk, err := client.New()
+			if replicas == 3 {
+				// there are only two zones to put them in
+				assert.Error(t, err)
+				continue
+			}
+			require.NoError(t, err)
+			_, addresses, err := fe.ReadMetadataEntry(chunk)
+			require.NoError(t, err)
+			assert.Len(t, addresses, 2)
+			// cs2 is the only server in zone b, so it must hold one of the two replicas
+			assert.Contains(t, addresses, apis.ServerAddress("cs-address-2"))
+		}
+
+		client.Close()
+		teardown()
+	}
+}
+
+// Tests that new chunks are placed on as many replicas as they ask for, or else the cluster-wide default, and that the
+// choice is recorded in their metadata entries.
+func TestReplicationFactor(t *testing.T) {
+	var feEtcd apis.EtcdInterface
+	cache, _, fe, teardown := PrepareLocalClusterWith(t, func(etcd apis.EtcdInterface, cache rpc.ConnectionCache) (apis.Frontend, error) {
+		feEtcd = etcd
+		return frontend.ConstructFrontend(etcd, cache)
+	})
+	defer teardown()
+	client, err := ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer client.Close()
+
+	expectReplicas := func(chunk apis.ChunkNum, replicas int) {
+		entry, addresses, err := fe.ReadFullMetadataEntry(chunk)
+		require.NoError(t, err)
+		assert.Len(t, addresses, replicas)
+		assert.Equal(t, uint8(replicas), entry.ReplicationFactor)
+	}
+
+	chunk, err := client.New()
+	require.NoError(t, err)
+	expectReplicas(chunk, frontend.InitialReplicationFactor)
+
+	for _, replicas := range []int{1, 3} {
+		chunk, err = NewWithOptions(client, apis.NewOptions{ReplicationFactor: replicas})
+		require.NoError(t, err)
+		expectReplicas(chunk, replicas)
+	}
+
+	// there are only three chunkservers
+	_, err = NewWithOptions(client, apis.NewOptions{ReplicationFactor: 4})
+	assert.Error(t, err)
+
+	require.NoError(t, feEtcd.WriteReplicationFactor(3))
+	chunk, err = client.New()
+	require.NoError(t, err)
+	expectReplicas(chunk, 3)
+	chunk, err = NewWithOptions(client, apis.NewOptions{ReplicationFactor: 1})
+	require.NoError(t, err)
+	expectReplicas(chunk, 1)
+}
+
+// Tests that a batch of chunks allocated at once are all distinct and usable, and that batches of the wrong size are
+// refused.
+func TestNewBatch(t *testing.T) {
+	cache, _, fe, teardown := PrepareLocalCluster(t)
+	defer teardown()
+	client, err := ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer client.Close()
+
+	chunks, err := NewBatch(client, 5)
+	require.NoError(t, err)
+	require.Len(t, chunks, 5)
+	seen := map[apis.ChunkNum]bool{}
+	for i, chunk := range chunks {
+		assert.False(t, seen[chunk])
+		seen[chunk] = true
+		_, err = client.Write(chunk, 0, 0, []byte{byte(i)})
+		assert.NoError(t, err)
+	}
+	for i, chunk := range chunks {
+		data, _, err := client.Read(chunk, 0, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{byte(i)}, data)
+	}
+
+	_, err = NewBatch(client, 0)
+	assert.Error(t, err)
+	_, err = NewBatch(client, apis.MaxBatchSize+1)
+	assert.Error(t, err)
+}
+
 // Tests the ability for multiple clients to safely clobber each others' changes to a shared block of data.
 func TestConflictingClients(t *testing.T) {
 	cache, _, fe, teardown := PrepareLocalCluster(t)
@@ -327,6 +810,144 @@ func TestConflictingClients(t *testing.T) {
 	assert.Equal(t, finalSum, checkSum())
 }
 
+// Tests that while one client holds a write lease on a chunk, its writes all commit without retrying, even when sent at
+// once, and nobody else can change the chunk until the lease is released.
+func TestWriteLease(t *testing.T) {
+	cache, _, fe, teardown := PrepareLocalCluster(t)
+	defer teardown()
+
+	holder, err := ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer holder.Close()
+	other, err := ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer other.Close()
+
+	chunk, err := holder.New()
+	require.NoError(t, err)
+	lease, err := AcquireWriteLease(holder, chunk)
+	require.NoError(t, err)
+	assert.NotEqual(t, apis.NoLease, lease)
+
+	_, err = AcquireWriteLease(other, chunk)
+	assert.True(t, errors.Is(err, apis.ErrLeaseHeld), "unexpected error: %v", err)
+	_, err = other.Write(chunk, 0, apis.AnyVersion, []byte("intruder"))
+	assert.True(t, errors.Is(err, apis.ErrLeaseHeld), "unexpected error: %v", err)
+	_, _, err = other.Append(chunk, []byte("intruder"))
+	assert.True(t, errors.Is(err, apis.ErrLeaseHeld), "unexpected error: %v", err)
+	assert.True(t, errors.Is(other.Delete(chunk, apis.AnyVersion), apis.ErrLeaseHeld))
+
+	count := 8
+	versions := make(chan apis.Version, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			version, err := WriteLeased(holder, chunk, lease, uint32(i*8), []byte(fmt.Sprintf("write #%d", i)))
+			assert.NoError(t, err)
+			versions <- version
+		}(i)
+	}
+	wg.Wait()
+	close(versions)
+	seen := map[apis.Version]bool{}
+	for version := range versions {
+		assert.False(t, seen[version], "version %d committed twice", version)
+		seen[version] = true
+	}
+	assert.NoError(t, RenewWriteLease(holder, chunk, lease))
+
+	data, version, err := other.Read(chunk, 0, uint32(count*8))
+	require.NoError(t, err)
+	assert.Equal(t, apis.Version(count), version)
+	for i := 0; i < count; i++ {
+		assert.Equal(t, fmt.Sprintf("write #%d", i), string(data[i*8:i*8+8]))
+	}
+
+	assert.NoError(t, ReleaseWriteLease(holder, chunk, lease))
+	// releasing it again does nothing
+	assert.NoError(t, ReleaseWriteLease(holder, chunk, lease))
+	_, err = WriteLeased(holder, chunk, lease, 0, []byte("too late"))
+	assert.True(t, errors.Is(err, apis.ErrLeaseLost), "unexpected error: %v", err)
+	assert.True(t, errors.Is(RenewWriteLease(holder, chunk, lease), apis.ErrLeaseLost))
+
+	version, err = other.Write(chunk, 0, version, []byte("mine now"))
+	assert.NoError(t, err)
+	assert.Equal(t, apis.Version(count+1), version)
+}
+
+// Tests that clients appending to the same chunk at once all succeed without retrying, and that each append lands
+// intact at the offset it reported, without overlapping any other.
+func TestConcurrentAppends(t *testing.T) {
+	cache, _, fe, teardown := PrepareLocalCluster(t)
+	defer teardown()
+
+	client, err := ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer client.Close()
+	chunk, err := client.New()
+	require.NoError(t, err)
+	_, err = client.Write(chunk, 0, apis.AnyVersion, []byte("header;"))
+	require.NoError(t, err)
+
+	type appended struct {
+		offset  uint32
+		version apis.Version
+		record  string
+	}
+	const appenders, appendsEach = 8, 5
+	results := make(chan appended, appenders*appendsEach)
+	var wg sync.WaitGroup
+	for i := 0; i < appenders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < appendsEach; j++ {
+				record := fmt.Sprintf("record %d/%d;", i, j)
+				offset, version, err := client.Append(chunk, []byte(record))
+				if assert.NoError(t, err) {
+					results <- appended{offset: offset, version: version, record: record}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	contents, version, err := client.Read(chunk, 0, 1024)
+	require.NoError(t, err)
+	end := uint32(len("header;"))
+	versions := map[apis.Version]bool{}
+	count := 0
+	for result := range results {
+		count++
+		assert.Equal(t, result.record, string(contents[result.offset:int(result.offset)+len(result.record)]))
+		assert.True(t, result.offset >= uint32(len("header;")))
+		assert.False(t, versions[result.version], "version %d reported by two appends", result.version)
+		versions[result.version] = true
+		assert.True(t, result.version <= version)
+		if next := result.offset + uint32(len(result.record)); next > end {
+			end = next
+		}
+	}
+	assert.Equal(t, appenders*appendsEach, count)
+	assert.Equal(t, "header;", string(contents[:len("header;")]))
+	// the appends exactly fill up the space after the header, so none of them overlap
+	total := uint32(len("header;"))
+	for i := 0; i < appenders; i++ {
+		for j := 0; j < appendsEach; j++ {
+			total += uint32(len(fmt.Sprintf("record %d/%d;", i, j)))
+		}
+	}
+	assert.Equal(t, total, end)
+	assert.Equal(t, make([]byte, 1024-end), contents[end:])
+
+	// an append that doesn't fit in what's left of the chunk is rejected
+	_, _, err = client.Append(chunk, make([]byte, apis.MaxChunkSize))
+	assert.True(t, errors.Is(err, apis.ErrChunkTooLarge))
+}
+
 // Tests the ability of many parallel clients to independently perform lots of operations on their own blocks.
 func TestParallelClients(t *testing.T) {
 	cache, _, fe, teardown := PrepareLocalCluster(t)
@@ -509,9 +1130,8 @@ func TestCleanup(t *testing.T) {
 // Tests the ability of a series of clients to invoke New() and then close their connections, and have all of the extra
 // new chunks be safely cleaned up.
 func TestIncompleteRemoval(t *testing.T) {
-	t.Skip("NOT YET IMPLEMENTED")  // TODO: implement incomplete removal!
-
-	cache, usage, fe, teardown := PrepareLocalCluster(t)
+	// freed chunk numbers are only handed out again right away when the metadata cache keeps a free list
+	cache, usage, fe, teardown := PrepareLocalClusterWithAllocation(t, metadatacache.FreeListAllocation)
 	defer teardown()
 
 	// perform one creation and deletion so that any metadata needed is allocated
@@ -576,10 +1196,722 @@ func TestIncompleteRemoval(t *testing.T) {
 		assert.True(t, <-done)
 	}
 
-	close(chunknums)
-
-	assert.True(t, <-done)
+	// every chunk allocated so far has been freed, so this one has to reuse one of their numbers
+	func() {
+		client, err := ConstructClient(fe, cache)
+		require.NoError(t, err)
+		defer client.Close()
+
+		chunk, err := client.New()
+		assert.NoError(t, err)
+		chunknums <- chunk
+	}()
+
+	close(chunknums)
+
+	assert.True(t, <-done)
 
 	// all of the clients have been closed, so we should be back to the original data usage
 	assert.Equal(t, initial, usage())
 }
+
+// A chunkserver that takes a long time to receive the data for writes to one particular chunk.
+type slowChunkserver struct {
+	apis.Chunkserver
+	mu    sync.Mutex
+	slow  bool
+	chunk apis.ChunkNum
+	delay time.Duration
+}
+
+func (s *slowChunkserver) slowDown(chunk apis.ChunkNum) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slow = true
+	s.chunk = chunk
+}
+
+func (s *slowChunkserver) StartWrite(chunk apis.ChunkNum, offset uint32, data []byte) error {
+	s.mu.Lock()
+	slow := s.slow && s.chunk == chunk
+	s.mu.Unlock()
+	if slow {
+		time.Sleep(s.delay)
+	}
+	return s.Chunkserver.StartWrite(chunk, offset, data)
+}
+
+// Tests that with a write quorum of two, writes to a chunk with three replicas complete without waiting for a slow
+// replica, that reads avoid the slow replica until it has caught up, and that it does eventually catch up.
+func TestQuorumWriteWithSlowReplica(t *testing.T) {
+	cache := &rpc.MockCache{
+		Frontends:    map[apis.ServerAddress]apis.Frontend{},
+		Chunkservers: map[apis.ServerAddress]apis.Chunkserver{},
+	}
+	etcds, teardown1 := etcd.PrepareSubscribeForTesting(t)
+	var teardowns util.MultiTeardown
+	teardowns.Add(teardown1)
+	defer teardowns.TeardownReverse()
+
+	var slow *slowChunkserver
+	for i := 0; i < 3; i++ {
+		name := apis.ServerName(fmt.Sprintf("cs%d", i))
+		address := apis.ServerAddress(fmt.Sprintf("cs-address-%d", i))
+
+		cs, _, csTeardown := chunkserver.NewTestChunkserver(t, cache)
+		teardowns.Add(csTeardown)
+		if i == 2 {
+			slow = &slowChunkserver{Chunkserver: cs, delay: time.Second}
+			cs = slow
+		}
+		cache.Chunkservers[address] = cs
+
+		etcd0, etcdClientTeardown := etcds(name)
+		assert.NoError(t, etcd0.UpdateAddress(address, apis.CHUNKSERVER))
+		teardowns.Add(etcdClientTeardown)
+	}
+
+	etcd0, teardown2 := etcds("fe0")
+	teardowns.Add(teardown2)
+	fe, err := frontend.ConstructFrontendWithOptions(etcd0, cache, frontend.FrontendOptions{Replicas: 3, Quorum: 2})
+	require.NoError(t, err)
+	mdc0, err := metadatacache.NewCache(cache, etcd0)
+	require.NoError(t, err)
+	teardowns.Add(func() {
+		assert.NoError(t, mdc0.Close())
+	})
+	cache.MetadataCaches = map[apis.ServerAddress]apis.MetadataCache{
+		"mdc-address-0": mdc0,
+	}
+	require.NoError(t, etcd0.UpdateAddress("mdc-address-0", apis.METADATACACHE))
+
+	client, err := ConstructClientWithOptions(fe, cache, ClientOptions{Quorum: 2})
+	require.NoError(t, err)
+	defer client.Close()
+
+	cn, err := client.New()
+	require.NoError(t, err)
+	_, addresses, err := fe.ReadMetadataEntry(cn)
+	require.NoError(t, err)
+	assert.Len(t, addresses, 3)
+
+	slow.slowDown(cn)
+
+	start := time.Now()
+	ver, err := client.Write(cn, 0, apis.AnyVersion, []byte("hello, world!"))
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) < slow.delay, "write waited for the slow replica: %v", time.Since(start))
+
+	// the slow replica hasn't confirmed the new version yet, so reads must go to the other two
+	_, addresses, err = fe.ReadMetadataEntry(cn)
+	require.NoError(t, err)
+	assert.Len(t, addresses, 2)
+	for i := 0; i < 10; i++ {
+		data, rver, err := client.Read(cn, 0, 13)
+		assert.NoError(t, err)
+		assert.Equal(t, ver, rver)
+		assert.Equal(t, "hello, world!", string(data))
+	}
+
+	// once the slow replica receives its data, it should catch up and serve reads again
+	deadline := time.Now().Add(5 * time.Second)
+	for len(addresses) < 3 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		_, addresses, err = fe.ReadMetadataEntry(cn)
+		require.NoError(t, err)
+	}
+	assert.Len(t, addresses, 3)
+	data, rver, err := slow.Read(cn, 0, 13, ver)
+	assert.NoError(t, err)
+	assert.Equal(t, ver, rver)
+	assert.Equal(t, "hello, world!", string(data))
+
+	// and later writes still don't wait for it
+	start = time.Now()
+	ver2, err := client.Write(cn, 7, ver, []byte("earth"))
+	require.NoError(t, err)
+	assert.True(t, ver2 > ver)
+	assert.True(t, time.Since(start) < slow.delay, "write waited for the slow replica: %v", time.Since(start))
+
+	data, rver, err = client.Read(cn, 0, 13)
+	assert.NoError(t, err)
+	assert.Equal(t, ver2, rver)
+	assert.Equal(t, "hello, earth!", string(data))
+
+	// let the slow replica catch up again before tearing it down
+	_, addresses, err = fe.ReadMetadataEntry(cn)
+	require.NoError(t, err)
+	deadline = time.Now().Add(5 * time.Second)
+	for len(addresses) < 3 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		_, addresses, err = fe.ReadMetadataEntry(cn)
+		require.NoError(t, err)
+	}
+	assert.Len(t, addresses, 3)
+}
+
+// Tests that a chunk's ACL is checked against whoever each request arrives from, and that only its owner can set it.
+func TestChunkACL(t *testing.T) {
+	cache, _, fe, teardown := PrepareLocalCluster(t)
+	defer teardown()
+
+	alice, bob, carol := apis.PrincipalNamed("alice"), apis.PrincipalNamed("bob"), apis.PrincipalNamed("carol")
+	clientFor := func(principal apis.Principal) apis.Client {
+		client, err := ConstructClient(rpc.FrontendWithContext(rpc.ContextWithCaller(context.Background(), principal), fe), cache)
+		require.NoError(t, err)
+		return client
+	}
+	aliceClient, bobClient, anonymousClient := clientFor(alice), clientFor(bob), clientFor(apis.Anonymous)
+	defer aliceClient.Close()
+	defer bobClient.Close()
+	defer anonymousClient.Close()
+
+	chunk, err := NewWithOptions(aliceClient, apis.NewOptions{
+		ACL: apis.ACL{Owner: alice, Allowed: []apis.Principal{bob}, Mode: apis.ReadAccess},
+	})
+	require.NoError(t, err)
+	ver, err := aliceClient.Write(chunk, 0, apis.AnyVersion, []byte("secret"))
+	require.NoError(t, err)
+
+	data, _, err := bobClient.Read(chunk, 0, 6)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), data)
+	_, err = bobClient.Write(chunk, 0, ver, []byte("public"))
+	assert.True(t, errors.Is(err, apis.ErrPermissionDenied), "unexpected error: %v", err)
+	err = bobClient.Delete(chunk, ver)
+	assert.True(t, errors.Is(err, apis.ErrPermissionDenied), "unexpected error: %v", err)
+
+	_, _, err = anonymousClient.Read(chunk, 0, 6)
+	assert.True(t, errors.Is(err, apis.ErrPermissionDenied), "unexpected error: %v", err)
+	carolClient := clientFor(carol)
+	defer carolClient.Close()
+	_, _, err = carolClient.Read(chunk, 0, 6)
+	assert.True(t, errors.Is(err, apis.ErrPermissionDenied), "unexpected error: %v", err)
+
+	// the ACL survives being written to, and is reported along with the rest of the entry
+	entry, _, err := rpc.FrontendWithContext(rpc.ContextWithCaller(context.Background(), alice), fe).ReadFullMetadataEntry(chunk)
+	require.NoError(t, err)
+	assert.Equal(t, alice, entry.ACL.Owner)
+	assert.Equal(t, []apis.Principal{bob}, entry.ACL.Allowed)
+
+	// nobody can hand out chunks owned by someone else
+	_, err = NewWithOptions(bobClient, apis.NewOptions{ACL: apis.ACL{Owner: alice}})
+	assert.True(t, errors.Is(err, apis.ErrPermissionDenied), "unexpected error: %v", err)
+
+	// chunks without an ACL are open to everyone, and in-process callers aren't checked at all
+	open, err := anonymousClient.New()
+	require.NoError(t, err)
+	_, err = bobClient.Write(open, 0, apis.AnyVersion, []byte("public"))
+	assert.NoError(t, err)
+	_, _, err = fe.ReadMetadataEntry(chunk)
+	assert.NoError(t, err)
+
+	ver, err = aliceClient.Write(chunk, 0, ver, []byte("hidden"))
+	require.NoError(t, err)
+	require.NoError(t, aliceClient.Delete(chunk, ver))
+}
+
+// Tests that setting up and tearing down a local cluster repeatedly doesn't leave goroutines behind. Run with -race to
+// also catch teardowns that race with requests still in flight.
+func TestRepeatedClusterTeardown(t *testing.T) {
+	iteration := func() {
+		client, teardown := PrepareSimpleClient(t)
+		defer teardown()
+
+		cn, err := client.New()
+		require.NoError(t, err)
+		_, version, err := client.Read(cn, 0, 1)
+		require.NoError(t, err)
+		require.NoError(t, client.Delete(cn, version))
+	}
+	// the first cluster starts up goroutines that are shared by every later one, such as in the etcd client libraries
+	iteration()
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		iteration()
+	}
+	// allow a little slack for goroutines that come and go on their own
+	assert.LessOrEqual(t, settledGoroutines(baseline+5), baseline+5)
+}
+
+// Waits up to a few seconds for the number of goroutines to drop to a target, and then returns the number.
+func settledGoroutines(target int) int {
+	count := runtime.NumGoroutine()
+	for i := 0; i < 50 && count > target; i++ {
+		time.Sleep(100 * time.Millisecond)
+		count = runtime.NumGoroutine()
+	}
+	return count
+}
+
+// A frontend that runs 'interfere' just before the first CommitWrite it forwards.
+type interferingFrontend struct {
+	apis.Frontend
+	interfere func()
+}
+
+func (f *interferingFrontend) CommitWrite(chunk apis.ChunkNum, version apis.Version, hash apis.CommitHash) (apis.Version, error) {
+	if f.interfere != nil {
+		interfere := f.interfere
+		f.interfere = nil
+		interfere()
+	}
+	return f.Frontend.CommitWrite(chunk, version, hash)
+}
+
+// Tests that a traced write accounts for its time in its phases, and counts the attempts it had to repeat because
+// another write committed first.
+func TestWriteTraced(t *testing.T) {
+	cache, _, fe, teardown := PrepareLocalCluster(t)
+	defer teardown()
+
+	other, err := ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer other.Close()
+	interfering := &interferingFrontend{Frontend: fe}
+	client, err := ConstructClient(interfering, cache)
+	require.NoError(t, err)
+	defer client.Close()
+
+	cn, err := client.New()
+	require.NoError(t, err)
+
+	checkPhases := func(trace WriteTrace) {
+		assert.True(t, trace.Lookup > 0 && trace.Prepare > 0 && trace.Commit > 0, "missing phase: %+v", trace)
+		sum := trace.Lookup + trace.Prepare + trace.Commit
+		assert.True(t, sum <= trace.Total, "phases exceed total: %+v", trace)
+		assert.True(t, trace.Total-sum < trace.Total/10+time.Millisecond, "phases don't account for total: %+v", trace)
+	}
+
+	ver, trace, err := WriteTraced(client, cn, 0, apis.AnyVersion, []byte("first"))
+	require.NoError(t, err)
+	checkPhases(trace)
+	assert.Equal(t, 0, trace.Retries)
+	assert.Equal(t, time.Duration(0), trace.Retrying)
+
+	// another write sneaks in between staging the data and committing it
+	interfering.interfere = func() {
+		_, err := other.Write(cn, 0, apis.AnyVersion, []byte("other"))
+		require.NoError(t, err)
+	}
+	ver2, trace, err := WriteTraced(client, cn, 0, apis.AnyVersion, []byte("second"))
+	require.NoError(t, err)
+	checkPhases(trace)
+	assert.Equal(t, 1, trace.Retries)
+	assert.True(t, trace.Retrying > 0 && trace.Retrying < trace.Total, "bad retry time: %+v", trace)
+	assert.Equal(t, ver+2, ver2)
+
+	data, _, err := client.Read(cn, 0, 6)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+
+	// a write with a specific version is never retried
+	interfering.interfere = func() {
+		_, err := other.Write(cn, 0, apis.AnyVersion, []byte("third"))
+		require.NoError(t, err)
+	}
+	_, trace, err = WriteTraced(client, cn, 0, ver2, []byte("fourth"))
+	assert.True(t, errors.Is(err, apis.ErrVersionStale))
+	assert.Equal(t, 0, trace.Retries)
+}
+
+// Collects the messages logged at each level.
+type capturingLogger struct {
+	mu       sync.Mutex
+	messages map[apis.LogLevel][]string
+}
+
+func (l *capturingLogger) Logf(level apis.LogLevel, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages[level] = append(l.messages[level], fmt.Sprintf(format, args...))
+}
+
+func (l *capturingLogger) get(level apis.LogLevel) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.messages[level]...)
+}
+
+// Tests that a write retried because another write committed first is reported to the client's logger at debug level.
+func TestLoggingClientReportsRetries(t *testing.T) {
+	cache, _, fe, teardown := PrepareLocalCluster(t)
+	defer teardown()
+
+	other, err := ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer other.Close()
+	logger := &capturingLogger{messages: map[apis.LogLevel][]string{}}
+	interfering := &interferingFrontend{Frontend: fe}
+	client, err := ConstructClientWithOptions(interfering, cache, ClientOptions{Logger: logger})
+	require.NoError(t, err)
+	defer client.Close()
+
+	cn, err := client.New()
+	require.NoError(t, err)
+	_, err = client.Write(cn, 0, apis.AnyVersion, []byte("first"))
+	require.NoError(t, err)
+	assert.Empty(t, logger.get(apis.DEBUG))
+
+	interfering.interfere = func() {
+		_, err := other.Write(cn, 0, apis.AnyVersion, []byte("other"))
+		require.NoError(t, err)
+	}
+	_, err = client.Write(cn, 0, apis.AnyVersion, []byte("second"))
+	require.NoError(t, err)
+
+	debug := logger.get(apis.DEBUG)
+	if assert.Len(t, debug, 1) {
+		assert.Contains(t, debug[0], "retrying write")
+		assert.Contains(t, debug[0], fmt.Sprintf("chunk %d", cn))
+	}
+	assert.Empty(t, logger.get(apis.WARN))
+	assert.Empty(t, logger.get(apis.ERROR))
+}
+
+// A frontend that takes 'delay' to look up each metadata entry.
+type slowLookupFrontend struct {
+	apis.Frontend
+	delay time.Duration
+}
+
+func (f *slowLookupFrontend) ReadMetadataEntry(chunk apis.ChunkNum) (apis.Version, []apis.ServerAddress, error) {
+	time.Sleep(f.delay)
+	return f.Frontend.ReadMetadataEntry(chunk)
+}
+
+// A chunkserver that counts the writes staged on it, whether directly or forwarded from another replica.
+type countingChunkserver struct {
+	apis.Chunkserver
+	mu     sync.Mutex
+	staged int
+}
+
+func (c *countingChunkserver) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.staged
+}
+
+func (c *countingChunkserver) StartWrite(chunk apis.ChunkNum, offset uint32, data []byte) error {
+	c.mu.Lock()
+	c.staged++
+	c.mu.Unlock()
+	return c.Chunkserver.StartWrite(chunk, offset, data)
+}
+
+func (c *countingChunkserver) StartWriteReplicated(chunk apis.ChunkNum, offset uint32, data []byte, replicas []apis.ServerAddress) error {
+	c.mu.Lock()
+	c.staged++
+	c.mu.Unlock()
+	return c.Chunkserver.StartWriteReplicated(chunk, offset, data, replicas)
+}
+
+// Tests that a write bounded by a context doesn't go on to the replicas once a slow metadata lookup has used up nearly
+// all of its deadline.
+func TestWriteContextSharesDeadline(t *testing.T) {
+	cache, _, fe, teardown := PrepareLocalCluster(t)
+	defer teardown()
+
+	mock := cache.(*rpc.MockCache)
+	var counters []*countingChunkserver
+	for address, cs := range mock.Chunkservers {
+		counter := &countingChunkserver{Chunkserver: cs}
+		mock.Chunkservers[address] = counter
+		counters = append(counters, counter)
+	}
+	staged := func() int {
+		total := 0
+		for _, counter := range counters {
+			total += counter.count()
+		}
+		return total
+	}
+
+	slow := &slowLookupFrontend{Frontend: fe}
+	client, err := ConstructClient(slow, cache)
+	require.NoError(t, err)
+	defer client.Close()
+
+	cn, err := client.New()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ver, err := WriteContext(ctx, client, cn, 0, apis.AnyVersion, []byte("first"))
+	cancel()
+	require.NoError(t, err)
+	before := staged()
+	assert.True(t, before > 0)
+
+	// the lookup leaves less than the minimum budget for the rest of the write
+	slow.delay = 95 * time.Millisecond
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = WriteContext(ctx, client, cn, 0, apis.AnyVersion, []byte("second"))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+	assert.Equal(t, before, staged())
+
+	slow.delay = 0
+	data, ver2, err := client.Read(cn, 0, 5)
+	require.NoError(t, err)
+	assert.Equal(t, ver, ver2)
+	assert.Equal(t, "first", string(data))
+}
+
+// A chunkserver that counts the reads that reach it, and holds each one until 'gate' is closed.
+type gatedChunkserver struct {
+	apis.Chunkserver
+	gate  chan struct{}
+	mu    sync.Mutex
+	reads int
+}
+
+func (g *gatedChunkserver) Read(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, error) {
+	g.mu.Lock()
+	g.reads++
+	g.mu.Unlock()
+	<-g.gate
+	return g.Chunkserver.Read(chunk, offset, length, minimum)
+}
+
+func (g *gatedChunkserver) readCount() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.reads
+}
+
+// Tests that many identical reads made at once through one client share a single read from a chunkserver, and that
+// each gets its own copy of the data.
+func TestCoalescedReads(t *testing.T) {
+	cache, _, fe, teardown := PrepareLocalCluster(t)
+	defer teardown()
+
+	clientIf, err := ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer clientIf.Close()
+	c := clientIf.(*client)
+
+	cn, err := c.New()
+	require.NoError(t, err)
+	ver, err := c.Write(cn, 0, apis.AnyVersion, []byte("hello world"))
+	require.NoError(t, err)
+
+	mock := cache.(*rpc.MockCache)
+	gate := make(chan struct{})
+	var gated []*gatedChunkserver
+	for address, cs := range mock.Chunkservers {
+		g := &gatedChunkserver{Chunkserver: cs, gate: gate}
+		mock.Chunkservers[address] = g
+		gated = append(gated, g)
+	}
+	totalReads := func() int {
+		total := 0
+		for _, g := range gated {
+			total += g.readCount()
+		}
+		return total
+	}
+
+	count := 20
+	results := make(chan []byte, count)
+	for i := 0; i < count; i++ {
+		go func() {
+			data, rver, err := c.Read(cn, 0, 11)
+			assert.NoError(t, err)
+			assert.Equal(t, ver, rver)
+			results <- data
+		}()
+	}
+
+	// wait for every read but the first to join the first one
+	key := readKey{chunk: cn, offset: 0, length: 11, minimum: ver}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		c.readsMu.Lock()
+		flight := c.reads[key]
+		joined := 0
+		if flight != nil {
+			joined = flight.joined
+		}
+		c.readsMu.Unlock()
+		if joined == count-1 {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "only %d reads joined", joined)
+		time.Sleep(time.Millisecond)
+	}
+	close(gate)
+
+	var first []byte
+	for i := 0; i < count; i++ {
+		data := <-results
+		assert.Equal(t, "hello world", string(data))
+		if first == nil {
+			first = data
+		} else if len(data) > 0 {
+			assert.True(t, &first[0] != &data[0], "reads share the same data")
+		}
+	}
+	assert.Equal(t, 1, totalReads())
+
+	// a read made afterwards isn't given the old result
+	_, err = c.Write(cn, 0, apis.AnyVersion, []byte("hello again"))
+	require.NoError(t, err)
+	data, _, err := c.Read(cn, 0, 11)
+	require.NoError(t, err)
+	assert.Equal(t, "hello again", string(data))
+}
+
+// Tests that a caching client serves repeated reads of an unchanged chunk without reaching a chunkserver, and reads
+// from the chunkservers again once the chunk has been written to.
+func TestCachedReads(t *testing.T) {
+	cache, _, fe, teardown := PrepareLocalCluster(t)
+	defer teardown()
+
+	client, err := ConstructClientWithOptions(fe, cache, ClientOptions{CacheBytes: 1024})
+	require.NoError(t, err)
+	defer client.Close()
+
+	cn, err := client.New()
+	require.NoError(t, err)
+	ver, err := client.Write(cn, 0, apis.AnyVersion, []byte("hello world"))
+	require.NoError(t, err)
+
+	mock := cache.(*rpc.MockCache)
+	gate := make(chan struct{})
+	close(gate)
+	var gated []*gatedChunkserver
+	for address, cs := range mock.Chunkservers {
+		g := &gatedChunkserver{Chunkserver: cs, gate: gate}
+		mock.Chunkservers[address] = g
+		gated = append(gated, g)
+	}
+	totalReads := func() int {
+		total := 0
+		for _, g := range gated {
+			total += g.readCount()
+		}
+		return total
+	}
+
+	data, rver, err := client.Read(cn, 0, 11)
+	require.NoError(t, err)
+	assert.Equal(t, ver, rver)
+	assert.Equal(t, "hello world", string(data))
+	assert.Equal(t, 1, totalReads())
+	// callers get their own copies, so changing one doesn't change the cache
+	data[0] = 'j'
+
+	data, rver, err = client.Read(cn, 0, 11)
+	require.NoError(t, err)
+	assert.Equal(t, ver, rver)
+	assert.Equal(t, "hello world", string(data))
+	data, _, err = client.Read(cn, 6, 5)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(data))
+	assert.Equal(t, 1, totalReads())
+
+	ver, err = client.Write(cn, 0, ver, []byte("jello"))
+	require.NoError(t, err)
+	data, rver, err = client.Read(cn, 0, 11)
+	require.NoError(t, err)
+	assert.Equal(t, ver, rver)
+	assert.Equal(t, "jello world", string(data))
+	assert.Equal(t, 2, totalReads())
+
+	require.NoError(t, client.Delete(cn, ver))
+	_, _, err = client.Read(cn, 0, 11)
+	assert.Error(t, err)
+}
+
+// Tests that the read cache stays within its capacity, evicting the least recently used reads first.
+func TestReadCacheEviction(t *testing.T) {
+	rc := newReadCache(10)
+	rc.put(1, 0, 1, []byte("aaaa"))
+	rc.put(2, 0, 1, []byte("bbbb"))
+	_, found := rc.get(1, 0, 4, 1)
+	assert.True(t, found)
+	rc.put(3, 0, 1, []byte("cccc"))
+	assert.Equal(t, 8, rc.size)
+
+	_, found = rc.get(2, 0, 4, 1)
+	assert.False(t, found, "least recently used read should have been evicted")
+	data, found := rc.get(1, 1, 2, 1)
+	assert.True(t, found)
+	assert.Equal(t, "aa", string(data))
+	_, found = rc.get(1, 0, 4, 2)
+	assert.False(t, found, "only the cached version can be served")
+
+	// a newer version replaces the older one, and an older one is never cached over it
+	rc.put(3, 2, 2, []byte("dd"))
+	rc.put(3, 0, 1, []byte("cccc"))
+	_, found = rc.get(3, 0, 4, 1)
+	assert.False(t, found)
+	data, found = rc.get(3, 2, 2, 2)
+	assert.True(t, found)
+	assert.Equal(t, "dd", string(data))
+	assert.Equal(t, 6, rc.size)
+
+	// reads bigger than the whole cache aren't kept
+	rc.put(4, 0, 1, []byte("eeeeeeeeeeee"))
+	_, found = rc.get(4, 0, 1, 1)
+	assert.False(t, found)
+
+	rc.forget(1)
+	assert.Equal(t, 2, rc.size)
+	assert.Empty(t, rc.chunks[1])
+}
+
+// Tests that a tracing client records a span for each request, beneath any span in the context it is bound to, and a
+// span beneath that for each step of the request.
+func TestTracingClient(t *testing.T) {
+	cache, _, fe, teardown := PrepareLocalCluster(t)
+	defer teardown()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	client, err := ConstructClientWithOptions(fe, cache, ClientOptions{Tracing: provider})
+	require.NoError(t, err)
+	defer client.Close()
+
+	cn, err := client.New()
+	require.NoError(t, err)
+	ctx, root := provider.Tracer("test").Start(context.Background(), "root")
+	ver, err := ClientWithContext(ctx, client).Write(cn, 0, apis.AnyVersion, []byte("hello world"))
+	require.NoError(t, err)
+	root.End()
+	data, _, err := client.Read(cn, 0, 11)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+	_, err = client.ReadVersion(cn, 0, 11, ver+1)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+
+	// each span ends before the one it is beneath
+	spans := recorder.Ended()
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name())
+	}
+	require.Equal(t, []string{
+		"lookup", "prepare", "commit", "Client.Write", "root",
+		"lookup", "read", "Client.Read",
+		"lookup", "Client.ReadVersion",
+	}, names)
+
+	write := spans[3]
+	assert.Equal(t, root.SpanContext().SpanID(), write.Parent().SpanID())
+	assert.Contains(t, write.Attributes(), attribute.Int64("zircon.chunk", int64(cn)))
+	assert.Contains(t, write.Attributes(), attribute.Int("zircon.length", 11))
+	assert.Contains(t, write.Attributes(), attribute.Int("zircon.retries", 0))
+	for _, step := range spans[:3] {
+		assert.Equal(t, write.SpanContext().SpanID(), step.Parent().SpanID())
+		assert.Equal(t, codes.Unset, step.Status().Code)
+	}
+	read := spans[7]
+	assert.False(t, read.Parent().IsValid())
+	assert.Equal(t, read.SpanContext().SpanID(), spans[6].Parent().SpanID())
+
+	assert.Equal(t, codes.Unset, spans[8].Status().Code)
+	assert.Equal(t, codes.Error, spans[9].Status().Code)
+	assert.Contains(t, spans[9].Status().Description, "is only at version")
+}
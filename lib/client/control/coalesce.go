@@ -0,0 +1,68 @@
+package control
+
+import (
+	"zircon/lib/apis"
+	"zircon/lib/chunkupdate"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Concurrent reads of the same part of the same chunk share a single request to a chunkserver: the first one makes the
+// request, and the rest wait for its result. A read only joins one that needs exactly the same version, which it looked
+// up itself after it started, so the shared result is one that it could have read on its own. Writes never share
+// requests, and neither do reads that can be cancelled, since cancelling one would fail the others that joined it.
+
+// Identifies reads that can share a request.
+type readKey struct {
+	chunk   apis.ChunkNum
+	offset  uint32
+	length  uint32
+	minimum apis.Version
+}
+
+// A read in progress, and its result once done is closed.
+type readFlight struct {
+	done    chan struct{}
+	data    []byte
+	version apis.Version
+	err     error
+	// how many other reads are waiting for this one's result
+	joined int
+}
+
+// Performs the read described by 'reference', unless an identical read is already in progress, in which case it waits
+// for that one's result. Every caller gets its own copy of the data.
+func (c *client) coalescedRead(reference *chunkupdate.Reference, offset uint32, length uint32) ([]byte, apis.Version, error) {
+	key := readKey{chunk: reference.Chunk, offset: offset, length: length, minimum: reference.Version}
+
+	c.readsMu.Lock()
+	if flight, found := c.reads[key]; found {
+		flight.joined++
+		c.readsMu.Unlock()
+		trace.SpanFromContext(reference.Context).SetAttributes(attribute.Bool("zircon.coalesced", true))
+		<-flight.done
+		if flight.err != nil {
+			return nil, flight.version, flight.err
+		}
+		return append([]byte(nil), flight.data...), flight.version, nil
+	}
+	flight := &readFlight{done: make(chan struct{})}
+	c.reads[key] = flight
+	c.readsMu.Unlock()
+
+	flight.data, flight.version, flight.err = reference.PerformRead(c.cache, offset, length)
+
+	c.readsMu.Lock()
+	delete(c.reads, key)
+	// no more reads can join once the flight is removed, so this is final
+	joined := flight.joined
+	c.readsMu.Unlock()
+	close(flight.done)
+
+	if flight.err != nil || joined == 0 {
+		return flight.data, flight.version, flight.err
+	}
+	// the others are copying out of flight.data, so it mustn't be handed to a caller that might modify it
+	return append([]byte(nil), flight.data...), flight.version, nil
+}
@@ -0,0 +1,47 @@
+package control
+
+import (
+	"errors"
+
+	"zircon/lib/apis"
+)
+
+// A chunk allocated by New is incomplete until its first write or append commits. The client remembers the incomplete
+// chunks it allocated, and when it is closed, it deletes those that are still incomplete through
+// Frontend.DeleteIncomplete, so that their chunk numbers can be handed out again. DeleteIncomplete leaves a chunk alone
+// if anyone has written to it since, so a chunk number handed to another client before its first write is safe.
+// Chunks left behind by a client that goes away without being closed are removed by the garbage collection service
+// instead; see services.IncompleteChunkLease.
+
+// Records that 'chunk' was just allocated, and has not been written to.
+func (c *client) allocated(chunk apis.ChunkNum) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.incomplete[chunk] = struct{}{}
+}
+
+// Records that 'chunk' no longer needs to be deleted when the client is closed, because it was written to or deleted.
+func (c *client) completed(chunk apis.ChunkNum) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.incomplete, chunk)
+}
+
+// Deletes every chunk this client allocated that is still incomplete, as the client is closed.
+func (c *client) deleteIncomplete() error {
+	c.mu.Lock()
+	incomplete := c.incomplete
+	c.incomplete = map[apis.ChunkNum]struct{}{}
+	c.mu.Unlock()
+	var lastErr error
+	for chunk := range incomplete {
+		err := c.fe.DeleteIncomplete(chunk)
+		// a chunk that was written to by someone else, or deleted, is no longer this client's to delete
+		if err != nil && !errors.Is(err, apis.ErrVersionStale) && !errors.Is(err, apis.ErrNotFound) &&
+			!errors.Is(err, apis.ErrBeingDeleted) {
+			c.logger.Logf(apis.WARN, "could not delete incomplete chunk %d: %v", chunk, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
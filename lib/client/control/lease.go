@@ -0,0 +1,118 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"zircon/lib/apis"
+	"zircon/lib/chunkupdate"
+	"zircon/lib/rpc"
+)
+
+// A client that can hold write leases on chunks, so that a single writer can commit a sequence of writes without
+// having them rejected for being stale by anyone else's. See apis.Frontend.AcquireWriteLease.
+type LeasingClient interface {
+	apis.Client
+
+	// Acquires a write lease on a chunk, which lasts for apis.WriteLeaseDuration unless it is renewed. Fails with an
+	// error matching ErrLeaseHeld if another writer already holds one.
+	AcquireWriteLease(ref apis.ChunkNum) (apis.LeaseID, error)
+	// Extends a write lease to apis.WriteLeaseDuration from now, as long as it hasn't run out.
+	RenewWriteLease(ref apis.ChunkNum, lease apis.LeaseID) error
+	ReleaseWriteLease(ref apis.ChunkNum, lease apis.LeaseID) error
+	// Like Write, but on behalf of the holder of 'lease', which takes the place of the version: the write is applied to
+	// whichever version is current. Fails with an error matching ErrLeaseLost if the lease has run out or been released.
+	WriteLeased(ref apis.ChunkNum, lease apis.LeaseID, offset uint32, data []byte) (apis.Version, error)
+}
+
+func asLeasingClient(client apis.Client) (LeasingClient, error) {
+	if leasing, ok := client.(LeasingClient); ok {
+		return leasing, nil
+	}
+	return nil, errors.New("client cannot hold write leases")
+}
+
+// Acquires a write lease through 'client', if it is able to.
+func AcquireWriteLease(client apis.Client, ref apis.ChunkNum) (apis.LeaseID, error) {
+	leasing, err := asLeasingClient(client)
+	if err != nil {
+		return apis.NoLease, err
+	}
+	return leasing.AcquireWriteLease(ref)
+}
+
+func RenewWriteLease(client apis.Client, ref apis.ChunkNum, lease apis.LeaseID) error {
+	leasing, err := asLeasingClient(client)
+	if err != nil {
+		return err
+	}
+	return leasing.RenewWriteLease(ref, lease)
+}
+
+func ReleaseWriteLease(client apis.Client, ref apis.ChunkNum, lease apis.LeaseID) error {
+	leasing, err := asLeasingClient(client)
+	if err != nil {
+		return err
+	}
+	return leasing.ReleaseWriteLease(ref, lease)
+}
+
+func WriteLeased(client apis.Client, ref apis.ChunkNum, lease apis.LeaseID, offset uint32, data []byte) (apis.Version, error) {
+	leasing, err := asLeasingClient(client)
+	if err != nil {
+		return 0, err
+	}
+	return leasing.WriteLeased(ref, lease, offset, data)
+}
+
+func (c *client) AcquireWriteLease(ref apis.ChunkNum) (apis.LeaseID, error) {
+	lease, err := c.fe.AcquireWriteLease(ref)
+	if err != nil {
+		return apis.NoLease, fmt.Errorf("[lease.go/AWL] %w", err)
+	}
+	return lease, nil
+}
+
+func (c *client) RenewWriteLease(ref apis.ChunkNum, lease apis.LeaseID) error {
+	if err := c.fe.RenewWriteLease(ref, lease); err != nil {
+		return fmt.Errorf("[lease.go/RNL] %w", err)
+	}
+	return nil
+}
+
+func (c *client) ReleaseWriteLease(ref apis.ChunkNum, lease apis.LeaseID) error {
+	if err := c.fe.ReleaseWriteLease(ref, lease); err != nil {
+		return fmt.Errorf("[lease.go/RLL] %w", err)
+	}
+	return nil
+}
+
+// Stages the data the same way as Write, but commits it with CommitLeasedWrite, so there is never a reason to try again.
+func (c *client) WriteLeased(ref apis.ChunkNum, lease apis.LeaseID, offset uint32, data []byte) (apis.Version, error) {
+	ctx := rpc.ContextWithCapabilities(context.Background())
+	_, addresses, err := rpc.FrontendWithContext(ctx, c.fe).ReadMetadataEntry(ref)
+	if err != nil {
+		return 0, fmt.Errorf("[lease.go/RME] %w", err)
+	}
+	if len(addresses) == 0 {
+		return 0, fmt.Errorf("given zero replicas when reading metadata entry")
+	}
+	reference := &chunkupdate.Reference{
+		Chunk:    ref,
+		Replicas: addresses,
+		Quorum:   c.quorum,
+		Logger:   c.logger,
+		Context:  ctx,
+	}
+	hash, err := reference.PrepareWrite(c.cache, offset, data)
+	if err != nil {
+		return 0, fmt.Errorf("[lease.go/RPW] %w", err)
+	}
+	version, err := c.fe.CommitLeasedWrite(ref, lease, hash)
+	if err != nil {
+		return 0, fmt.Errorf("[lease.go/FCW] %w", err)
+	}
+	c.completed(ref)
+	return version, nil
+}
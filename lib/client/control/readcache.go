@@ -0,0 +1,137 @@
+package control
+
+import (
+	"container/list"
+	"sync"
+
+	"zircon/lib/apis"
+)
+
+// A client constructed with ClientOptions.CacheBytes keeps the results of recent reads, and serves a read from them
+// when it covers a range that was already read at the chunk's current version. Every read still looks up the chunk's
+// version through the frontend, as it would to find the replicas anyway, so a cached result is never served once the
+// chunk has changed; only the request to a chunkserver is saved. This makes repeated reads of hot chunks much cheaper.
+//
+// Versions restart when a chunk number is freed and handed out again, so a chunk that is deleted, allocated again, and
+// written up to the same version as a cached read could be served stale data. This client forgets chunks it deletes
+// itself; chunks that other clients delete and reuse are only forgotten as they are evicted.
+
+// The results of recent reads, up to a total size in bytes, with the least recently used evicted first.
+type readCache struct {
+	mu       sync.Mutex
+	capacity int
+	size     int
+	// of *cachedRead, most recently used at the front
+	recent *list.List
+	chunks map[apis.ChunkNum][]*list.Element
+}
+
+type cachedRead struct {
+	chunk   apis.ChunkNum
+	offset  uint32
+	version apis.Version
+	data    []byte
+}
+
+// Returns a cache of up to 'capacity' bytes of data, or nil if capacity is zero, which caches nothing.
+func newReadCache(capacity int) *readCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &readCache{
+		capacity: capacity,
+		recent:   list.New(),
+		chunks:   map[apis.ChunkNum][]*list.Element{},
+	}
+}
+
+// Returns a copy of the data at [offset, offset+length) of 'chunk' as of exactly 'version', if a cached read covers it.
+func (rc *readCache) get(chunk apis.ChunkNum, offset uint32, length uint32, version apis.Version) ([]byte, bool) {
+	if rc == nil {
+		return nil, false
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, element := range rc.chunks[chunk] {
+		read := element.Value.(*cachedRead)
+		if read.version == version && read.offset <= offset && offset+length <= read.offset+uint32(len(read.data)) {
+			rc.recent.MoveToFront(element)
+			start := offset - read.offset
+			return append([]byte(nil), read.data[start:start+length]...), true
+		}
+	}
+	return nil, false
+}
+
+// Keeps a copy of 'data', read from 'chunk' at 'offset' as of 'version'. All of the cached reads of a chunk are of the
+// same version, since at most one can be current, so reads of an older version are dropped in favor of this one, and
+// this one is dropped in favor of reads of a newer version.
+func (rc *readCache) put(chunk apis.ChunkNum, offset uint32, version apis.Version, data []byte) {
+	if rc == nil || len(data) == 0 || len(data) > rc.capacity {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	elements := rc.chunks[chunk]
+	if len(elements) > 0 {
+		cached := elements[0].Value.(*cachedRead).version
+		if cached > version {
+			return
+		} else if cached < version {
+			for _, element := range elements {
+				rc.remove(element)
+			}
+			elements = nil
+		}
+	}
+	for _, element := range elements {
+		read := element.Value.(*cachedRead)
+		if read.offset <= offset && offset+uint32(len(data)) <= read.offset+uint32(len(read.data)) {
+			// already covered, perhaps by a read that finished at the same time
+			return
+		}
+	}
+	read := &cachedRead{chunk: chunk, offset: offset, version: version, data: append([]byte(nil), data...)}
+	rc.chunks[chunk] = append(elements, rc.recent.PushFront(read))
+	rc.size += len(read.data)
+	for rc.size > rc.capacity {
+		rc.evict(rc.recent.Back())
+	}
+}
+
+// Drops every cached read of 'chunk', such as once it has been deleted.
+func (rc *readCache) forget(chunk apis.ChunkNum) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, element := range rc.chunks[chunk] {
+		rc.remove(element)
+	}
+	delete(rc.chunks, chunk)
+}
+
+// Removes a cached read from the recency list, but not from its chunk's list. Must be called with mu held.
+func (rc *readCache) remove(element *list.Element) {
+	rc.size -= len(element.Value.(*cachedRead).data)
+	rc.recent.Remove(element)
+}
+
+// Removes a cached read entirely. Must be called with mu held.
+func (rc *readCache) evict(element *list.Element) {
+	chunk := element.Value.(*cachedRead).chunk
+	rc.remove(element)
+	elements := rc.chunks[chunk]
+	for i, other := range elements {
+		if other == element {
+			elements = append(elements[:i], elements[i+1:]...)
+			break
+		}
+	}
+	if len(elements) == 0 {
+		delete(rc.chunks, chunk)
+	} else {
+		rc.chunks[chunk] = elements
+	}
+}
@@ -0,0 +1,189 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"zircon/lib/apis"
+	"zircon/lib/chunkupdate"
+	"zircon/lib/rpc"
+)
+
+// Identifies a set of chunks frozen by Snapshot. Only meaningful to the client that took the snapshot.
+type SnapshotID uint64
+
+// The version of a chunk that a snapshot froze, and the replicas that agreed to keep it.
+type pinnedChunk struct {
+	version  apis.Version
+	replicas []apis.ServerAddress
+}
+
+// A client that can freeze chunks at their current versions.
+type SnapshotClient interface {
+	apis.Client
+
+	// Pins the current version of each chunk on its replicas, so that the data as of now stays readable through
+	// ReadSnapshot while later writes carry on creating new versions. The pins are held until ReleaseSnapshot, or until
+	// the client is closed; they are lost if a replica restarts, in which case reads fall back to the other replicas.
+	Snapshot(chunks []apis.ChunkNum) (SnapshotID, error)
+	// Reads part of a chunk as it was when the snapshot was taken.
+	ReadSnapshot(id SnapshotID, ref apis.ChunkNum, offset uint32, length uint32) ([]byte, error)
+	ReleaseSnapshot(id SnapshotID) error
+}
+
+func asSnapshotClient(client apis.Client) (SnapshotClient, error) {
+	if snapshots, ok := client.(SnapshotClient); ok {
+		return snapshots, nil
+	}
+	return nil, errors.New("client cannot take snapshots")
+}
+
+// Takes a snapshot through 'client', if it is able to.
+func Snapshot(client apis.Client, chunks []apis.ChunkNum) (SnapshotID, error) {
+	snapshots, err := asSnapshotClient(client)
+	if err != nil {
+		return 0, err
+	}
+	return snapshots.Snapshot(chunks)
+}
+
+func ReadSnapshot(client apis.Client, id SnapshotID, ref apis.ChunkNum, offset uint32, length uint32) ([]byte, error) {
+	snapshots, err := asSnapshotClient(client)
+	if err != nil {
+		return nil, err
+	}
+	return snapshots.ReadSnapshot(id, ref, offset, length)
+}
+
+func ReleaseSnapshot(client apis.Client, id SnapshotID) error {
+	snapshots, err := asSnapshotClient(client)
+	if err != nil {
+		return err
+	}
+	return snapshots.ReleaseSnapshot(id)
+}
+
+func (c *client) Snapshot(chunks []apis.ChunkNum) (SnapshotID, error) {
+	pinned := map[apis.ChunkNum]pinnedChunk{}
+	for _, ref := range chunks {
+		if _, duplicate := pinned[ref]; duplicate {
+			continue
+		}
+		entry, err := c.pinChunk(ref)
+		if err != nil {
+			if uerr := c.unpinAll(pinned); uerr != nil {
+				err = fmt.Errorf("two errors: %v -- and -- %v", err, uerr)
+			}
+			return 0, err
+		}
+		pinned[ref] = entry
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastSnapshot++
+	c.snapshots[c.lastSnapshot] = pinned
+	return c.lastSnapshot, nil
+}
+
+// Pins the current version of a chunk on as many of its replicas as will take it. Fails only if none of them will.
+func (c *client) pinChunk(ref apis.ChunkNum) (pinnedChunk, error) {
+	ctx := rpc.ContextWithCapabilities(context.Background())
+	version, addresses, err := rpc.FrontendWithContext(ctx, c.fe).ReadMetadataEntry(ref)
+	if err != nil {
+		return pinnedChunk{}, fmt.Errorf("[snapshot.go/RME] %w", err)
+	}
+	entry := pinnedChunk{version: version}
+	var lastErr error
+	for _, address := range addresses {
+		cs, err := c.cache.SubscribeChunkserver(address)
+		if err == nil {
+			err = rpc.ChunkserverWithContext(ctx, cs).Pin(ref, version)
+		}
+		if err != nil {
+			c.logger.Logf(apis.WARN, "could not pin version %d of chunk %d on %s: %v", version, ref, address, err)
+			lastErr = err
+			continue
+		}
+		entry.replicas = append(entry.replicas, address)
+	}
+	if len(entry.replicas) == 0 {
+		return pinnedChunk{}, fmt.Errorf("could not pin version %d of chunk %d on any replica: %w", version, ref, lastErr)
+	}
+	return entry, nil
+}
+
+// Releases every pin in a snapshot, carrying on past failures so that one unreachable replica doesn't keep the rest
+// pinned, and returns the last failure.
+func (c *client) unpinAll(pinned map[apis.ChunkNum]pinnedChunk) error {
+	var lastErr error
+	for ref, entry := range pinned {
+		// as for ReadSnapshot, a fresh capability is needed to unpin the chunk on replicas that check their callers
+		ctx := rpc.ContextWithCapabilities(context.Background())
+		_, _, _ = rpc.FrontendWithContext(ctx, c.fe).ReadMetadataEntry(ref)
+		for _, address := range entry.replicas {
+			cs, err := c.cache.SubscribeChunkserver(address)
+			if err == nil {
+				err = rpc.ChunkserverWithContext(ctx, cs).Unpin(ref, entry.version)
+			}
+			if err != nil {
+				lastErr = fmt.Errorf("while unpinning version %d of chunk %d on %s: %w", entry.version, ref, address, err)
+			}
+		}
+	}
+	return lastErr
+}
+
+func (c *client) ReadSnapshot(id SnapshotID, ref apis.ChunkNum, offset uint32, length uint32) ([]byte, error) {
+	c.mu.Lock()
+	pinned, found := c.snapshots[id]
+	c.mu.Unlock()
+	if !found {
+		return nil, fmt.Errorf("no snapshot %d: %w", id, apis.ErrNotFound)
+	}
+	entry, found := pinned[ref]
+	if !found {
+		return nil, fmt.Errorf("chunk %d is not part of snapshot %d: %w", ref, id, apis.ErrNotFound)
+	}
+	// capabilities don't last as long as snapshots can, so the entry is read again for a fresh one; if the chunk is gone,
+	// the read goes ahead without one, which only succeeds on replicas that don't check their callers
+	ctx := rpc.ContextWithCapabilities(context.Background())
+	_, _, _ = rpc.FrontendWithContext(ctx, c.fe).ReadMetadataEntry(ref)
+	reference := &chunkupdate.Reference{
+		Chunk:      ref,
+		Version:    entry.version,
+		Replicas:   entry.replicas,
+		Logger:     c.logger,
+		HedgeAfter: c.hedge,
+		Load:       c.load,
+		Context:    ctx,
+	}
+	return reference.PerformReadVersion(c.cache, offset, length, entry.version)
+}
+
+func (c *client) ReleaseSnapshot(id SnapshotID) error {
+	c.mu.Lock()
+	pinned, found := c.snapshots[id]
+	delete(c.snapshots, id)
+	c.mu.Unlock()
+	if !found {
+		return fmt.Errorf("no snapshot %d: %w", id, apis.ErrNotFound)
+	}
+	return c.unpinAll(pinned)
+}
+
+// Releases every snapshot that is still held, as the client is closed.
+func (c *client) releaseAllSnapshots() error {
+	c.mu.Lock()
+	snapshots := c.snapshots
+	c.snapshots = map[SnapshotID]map[apis.ChunkNum]pinnedChunk{}
+	c.mu.Unlock()
+	var lastErr error
+	for _, pinned := range snapshots {
+		if err := c.unpinAll(pinned); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,56 @@
+package control
+
+import (
+	"context"
+
+	"zircon/lib/apis"
+	"zircon/lib/rpc"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A client constructed with ClientOptions.Tracing records a span for each Read, ReadWithChecksum, ReadVersion and
+// Write, named after the method, such as "Client.Write", as a child of any span in the context that the request is bound
+// to; see ContextClient. Within it, each step of the request has a span of its own, named for the phases of a
+// WriteTrace: "lookup" for finding the chunk's version and replicas through the frontend, "prepare" for staging the
+// data of a write on the replicas with StartWriteReplicated, "commit" for committing it through the frontend, and
+// "read" for reading from the replicas. Each attempt of a write with AnyVersion has its own steps.
+// The calls each step makes are bound to its span, so where connection caches and servers have an
+// rpc.TracingInterceptor, those calls, and the calls that servers make on their behalf, such as the frontend's
+// UpdateEntry on the metadata cache during a commit, are recorded beneath it. A read served from the read cache has no
+// "read" step, and one that shares another read's request (see coalesce.go) is marked as coalesced, since the request is
+// recorded under the read that made it.
+
+// The name of the instrumentation that records spans for requests.
+const tracerName = "zircon/client"
+
+// Starts the span of a request on 'length' bytes at 'offset' in 'chunk'.
+func (c *client) startRequest(ctx context.Context, name string, chunk apis.ChunkNum, offset uint32, length int) (context.Context, trace.Span) {
+	return c.tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.Int64("zircon.chunk", int64(chunk)),
+		attribute.Int64("zircon.offset", int64(offset)),
+		attribute.Int("zircon.length", length),
+	))
+}
+
+// Ends a span, marking it as failed if 'err' is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Looks up the version and replicas of a chunk through the frontend, as the "lookup" step of a request. Returns ctx as
+// extended to keep any capability that the frontend issued for the chunk, which the rest of the request is to be bound
+// to, so that the replicas take its calls; see rpc.ContextWithCapabilities.
+func (c *client) lookup(ctx context.Context, ref apis.ChunkNum) (context.Context, apis.Version, []apis.ServerAddress, error) {
+	ctx = rpc.ContextWithCapabilities(ctx)
+	lookupCtx, span := c.tracer.Start(ctx, "lookup")
+	version, addresses, err := rpc.FrontendWithContext(lookupCtx, c.fe).ReadMetadataEntry(ref)
+	endSpan(span, err)
+	return ctx, version, addresses, err
+}
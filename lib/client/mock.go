@@ -21,6 +21,8 @@ func PrepareNetworkedCluster(t *testing.T) (cliConfig Configuration, newEtcd fun
 
 	etcds, teardown7 := etcd.PrepareSubscribeForTesting(t)
 	teardowns.Add(teardown7)
+	// once every server has stopped, nothing is left to make requests through the cache
+	teardowns.Add(cache.CloseAll)
 
 	for _, name := range []apis.ServerName{"cs0", "cs1", "cs2"} {
 		cs, _, teardown1 := chunkserver.NewTestChunkserver(t, cache)
@@ -52,6 +54,9 @@ func PrepareNetworkedCluster(t *testing.T) (cliConfig Configuration, newEtcd fun
 
 		mdc, err := metadatacache.NewCache(cache, etcdn)
 		assert.NoError(t, err)
+		teardowns.Add(func() {
+			assert.NoError(t, mdc.Close())
+		})
 		teardown10, mdcaddress, err := rpc.PublishMetadataCache(mdc, "127.0.0.1:0")
 		assert.NoError(t, err)
 		teardowns.Add(func() { teardown10(true) })
@@ -67,5 +72,5 @@ func PrepareNetworkedCluster(t *testing.T) (cliConfig Configuration, newEtcd fun
 		return iface
 	}
 
-	return config, newEtcd, teardowns.Teardown
+	return config, newEtcd, teardowns.TeardownReverse
 }
\ No newline at end of file
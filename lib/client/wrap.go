@@ -1,21 +1,109 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"time"
 	"zircon/apis"
+	"zircon/chunkupdate"
 	"zircon/client/control"
+	"zircon/etcd"
 	"zircon/frontend"
 	"zircon/rpc"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 // The configuration information provided by a client application to connect to a Zircon cluster.
 type Configuration struct {
 	FrontendAddresses []apis.ServerAddress `yaml:"frontend-addresses"`
+	// If provided, frontends are found through their registrations in etcd instead, so that the client can move to
+	// another frontend when the one it was using goes away. FrontendAddresses is ignored in this case.
+	EtcdAddresses []apis.ServerAddress `yaml:"etcd-addresses"`
+	// The number of replicas that must receive a write; zero means all of them. See chunkupdate.WriteQuorum.
+	WriteQuorum int `yaml:"write-quorum"`
+	// The most requests a networked client has in progress to any one server at once; zero means no limit. Requests
+	// beyond this wait for an earlier one to finish. See rpc.InFlightLimit.
+	MaxInFlight int `yaml:"max-in-flight"`
+	// How long a read waits for a replica before also trying another one; zero means reads never do. See
+	// control.ClientOptions.
+	HedgeDelay time.Duration `yaml:"hedge-delay"`
+	// How many bytes of recently read data to keep, so that reading them again while they are unchanged doesn't need a
+	// chunkserver; zero means nothing is kept. See control.ClientOptions.
+	ReadCacheBytes int `yaml:"read-cache-bytes"`
+	// How to secure the connections to the cluster's servers; plaintext if left empty. See rpc.TLSConfiguration.
+	TLS rpc.TLSConfiguration `yaml:"tls"`
+	// Which protocol to reach the cluster's servers with; twirp if left empty. See rpc.Transport.
+	Transport rpc.Transport `yaml:"transport"`
+	// How to compress the bodies of requests and responses; uncompressed if left empty. See rpc.Compression.
+	Compression rpc.Compression `yaml:"compression"`
+	// How long connections and calls to the cluster's servers may take; any left as zero take their defaults. See
+	// rpc.Timeouts.
+	Timeouts rpc.Timeouts `yaml:"timeouts"`
+	// How reads are retried when they can't reach a server; any fields left as zero take their defaults. See
+	// rpc.RetryPolicy.
+	Retry rpc.RetryPolicy `yaml:"retry"`
+	// When servers that keep failing to respond are skipped for a while; any fields left as zero take their defaults.
+	// See rpc.BreakerPolicy.
+	Breaker rpc.BreakerPolicy `yaml:"breaker"`
+	// How often servers are pinged between calls; see rpc.HealthCheck.
+	HealthCheck rpc.HealthCheck `yaml:"health-check"`
+	// How connections to servers are kept open; see rpc.PoolOptions.
+	Pool rpc.PoolOptions `yaml:"pool"`
+	// Where to send a span for each read and write, and for each call they make; nothing is traced if left empty. See
+	// rpc.TracingConfiguration and control.ClientOptions.
+	Tracing rpc.TracingConfiguration `yaml:"tracing"`
+}
+
+// The options for the connection caches of a networked client, which connect with 'tlsConfig'.
+func (config Configuration) ConnectionOptions(tlsConfig *tls.Config) rpc.ConnectionOptions {
+	return rpc.ConnectionOptions{
+		Limit:       rpc.InFlightLimit{PerPeer: config.MaxInFlight},
+		TLS:         tlsConfig,
+		Transport:   config.Transport,
+		Compression: config.Compression,
+		Timeouts:    config.Timeouts,
+		Retry:       config.Retry,
+		Breaker:     config.Breaker,
+		Health:      config.HealthCheck,
+		Pool:        config.Pool,
+	}
 }
 
 // Set up all portions of a client based on a Zircon configuration.
 // This will not error if servers aren't available; timeout errors will occur when methods on the client are invoked.
 func ConfigureClient(config Configuration, cache rpc.ConnectionCache) (apis.Client, error) {
+	return ConfigureTracingClient(config, cache, noop.NewTracerProvider())
+}
+
+// Like ConfigureClient, but the client records its spans with a tracer from 'provider'.
+func ConfigureTracingClient(config Configuration, cache rpc.ConnectionCache, provider trace.TracerProvider) (apis.Client, error) {
+	options := control.ClientOptions{
+		Quorum:     chunkupdate.WriteQuorum(config.WriteQuorum),
+		Hedge:      config.HedgeDelay,
+		CacheBytes: config.ReadCacheBytes,
+		Tracing:    provider,
+	}
+	if len(config.EtcdAddresses) > 0 {
+		// the name is only used when registering a server, which a client never does
+		etcdif, err := etcd.SubscribeEtcd("client", config.EtcdAddresses)
+		if err != nil {
+			return nil, err
+		}
+		client, err := control.ConstructClientWithOptions(frontend.Rediscovering(etcdif, cache), cache, options)
+		if err != nil {
+			etcdif.Close()
+			return nil, err
+		}
+		return &clientWithCloseCallback{
+			base: client,
+			close: func() {
+				etcdif.Close()
+			},
+		}, nil
+	}
 	if len(config.FrontendAddresses) < 1 {
 		return nil, errors.New("not enough frontend addresses for client")
 	}
@@ -28,19 +116,42 @@ func ConfigureClient(config Configuration, cache rpc.ConnectionCache) (apis.Clie
 		}
 	}
 	roundrobin := frontend.RoundRobin(frontends)
-	return control.ConstructClient(roundrobin, cache)
+	return control.ConstructClientWithOptions(roundrobin, cache, options)
 }
 
 func ConfigureNetworkedClient(config Configuration) (apis.Client, error) {
-	cache := rpc.NewConnectionCache()
-	client, err := ConfigureClient(config, cache)
+	if err := config.Transport.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Transport.CheckCompression(config.Compression); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := config.TLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	provider, shutdown, err := config.Tracing.TracerProvider("zircon-client")
+	if err != nil {
+		return nil, err
+	}
+	options := config.ConnectionOptions(tlsConfig)
+	if config.Tracing.Enabled() {
+		options.Interceptors = append(options.Interceptors, rpc.TracingInterceptor(provider))
+	}
+	cache := rpc.NewConnectionCacheWithOptions(options)
+	client, err := ConfigureTracingClient(config, cache, provider)
 	if err != nil {
 		cache.CloseAll()
+		_ = shutdown()
 		return nil, err
 	}
 	return &clientWithCloseCallback{
-		base:  client,
-		close: cache.CloseAll,
+		base: client,
+		close: func() {
+			cache.CloseAll()
+			// any spans not yet sent are lost if the collector can't be reached, which shouldn't fail the close
+			_ = shutdown()
+		},
 	}, nil
 }
 
@@ -53,14 +164,78 @@ func (c *clientWithCloseCallback) New() (apis.ChunkNum, error) {
 	return c.base.New()
 }
 
+func (c *clientWithCloseCallback) NewWithOptions(options apis.NewOptions) (apis.ChunkNum, error) {
+	return control.NewWithOptions(c.base, options)
+}
+
+func (c *clientWithCloseCallback) NewBatch(count int) ([]apis.ChunkNum, error) {
+	return control.NewBatch(c.base, count)
+}
+
 func (c *clientWithCloseCallback) Read(ref apis.ChunkNum, offset uint32, length uint32) ([]byte, apis.Version, error) {
 	return c.base.Read(ref, offset, length)
 }
 
+func (c *clientWithCloseCallback) ReadWithChecksum(ref apis.ChunkNum, offset uint32, length uint32) ([]byte, apis.Version, apis.Checksum, error) {
+	return c.base.ReadWithChecksum(ref, offset, length)
+}
+
+func (c *clientWithCloseCallback) ReadVersion(ref apis.ChunkNum, offset uint32, length uint32, version apis.Version) ([]byte, error) {
+	return c.base.ReadVersion(ref, offset, length, version)
+}
+
 func (c *clientWithCloseCallback) Write(ref apis.ChunkNum, offset uint32, version apis.Version, data []byte) (apis.Version, error) {
 	return c.base.Write(ref, offset, version, data)
 }
 
+func (c *clientWithCloseCallback) WriteTraced(ref apis.ChunkNum, offset uint32, version apis.Version, data []byte) (apis.Version, control.WriteTrace, error) {
+	return control.WriteTraced(c.base, ref, offset, version, data)
+}
+
+func (c *clientWithCloseCallback) WriteContext(ctx context.Context, ref apis.ChunkNum, offset uint32, version apis.Version, data []byte) (apis.Version, error) {
+	return control.WriteContext(ctx, c.base, ref, offset, version, data)
+}
+
+func (c *clientWithCloseCallback) WithContext(ctx context.Context) apis.Client {
+	return control.ClientWithContext(ctx, c.base)
+}
+
+func (c *clientWithCloseCallback) StatChunk(ref apis.ChunkNum) (apis.ChunkStatus, error) {
+	return control.StatChunk(c.base, ref)
+}
+
+func (c *clientWithCloseCallback) Snapshot(chunks []apis.ChunkNum) (control.SnapshotID, error) {
+	return control.Snapshot(c.base, chunks)
+}
+
+func (c *clientWithCloseCallback) ReadSnapshot(id control.SnapshotID, ref apis.ChunkNum, offset uint32, length uint32) ([]byte, error) {
+	return control.ReadSnapshot(c.base, id, ref, offset, length)
+}
+
+func (c *clientWithCloseCallback) ReleaseSnapshot(id control.SnapshotID) error {
+	return control.ReleaseSnapshot(c.base, id)
+}
+
+func (c *clientWithCloseCallback) AcquireWriteLease(ref apis.ChunkNum) (apis.LeaseID, error) {
+	return control.AcquireWriteLease(c.base, ref)
+}
+
+func (c *clientWithCloseCallback) RenewWriteLease(ref apis.ChunkNum, lease apis.LeaseID) error {
+	return control.RenewWriteLease(c.base, ref, lease)
+}
+
+func (c *clientWithCloseCallback) ReleaseWriteLease(ref apis.ChunkNum, lease apis.LeaseID) error {
+	return control.ReleaseWriteLease(c.base, ref, lease)
+}
+
+func (c *clientWithCloseCallback) WriteLeased(ref apis.ChunkNum, lease apis.LeaseID, offset uint32, data []byte) (apis.Version, error) {
+	return control.WriteLeased(c.base, ref, lease, offset, data)
+}
+
+func (c *clientWithCloseCallback) Append(ref apis.ChunkNum, data []byte) (uint32, apis.Version, error) {
+	return c.base.Append(ref, data)
+}
+
 func (c *clientWithCloseCallback) Delete(ref apis.ChunkNum, version apis.Version) error {
 	return c.base.Delete(ref, version)
 }
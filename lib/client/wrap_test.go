@@ -1,6 +1,7 @@
 package client
 
 import (
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"testing"
@@ -44,7 +45,10 @@ func TestSimpleClientReadWrite(t *testing.T) {
 	assert.True(t, ver3 > ver2)
 
 	ver5, err := client.Write(cn, 7, ver2, []byte("earth..."))
-	assert.Error(t, err)
+	var stale apis.VersionStaleError
+	if assert.True(t, errors.As(err, &stale)) {
+		assert.Equal(t, ver3, stale.Current)
+	}
 	assert.Equal(t, ver3, ver5) // make sure it returns the correct new version after staleness failure
 
 	data, ver4, err := client.Read(cn, 0, apis.MaxChunkSize)
@@ -52,7 +56,7 @@ func TestSimpleClientReadWrite(t *testing.T) {
 	assert.Equal(t, ver3, ver4)
 	assert.Equal(t, "hello, home!!", string(util.StripTrailingZeroes(data)))
 
-	assert.Error(t, client.Delete(cn, ver2))
+	assert.True(t, errors.Is(client.Delete(cn, ver2), apis.ErrVersionStale))
 
 	data, ver6, err := client.Read(cn, 0, apis.MaxChunkSize)
 	assert.NoError(t, err)
@@ -62,5 +66,37 @@ func TestSimpleClientReadWrite(t *testing.T) {
 	assert.NoError(t, client.Delete(cn, ver6))
 
 	_, _, err = client.Read(cn, 0, apis.MaxChunkSize)
-	assert.Error(t, err)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+}
+
+// Tests that every operation on a deleted chunk fails with ErrChunkDeleted once it reaches the client, rather than
+// with an error that looks like it could be retried, while a chunk that never existed is only reported as not found.
+func TestDeletedChunk(t *testing.T) {
+	config, _, teardown := PrepareNetworkedCluster(t)
+	defer teardown()
+
+	client, err := ConfigureNetworkedClient(config)
+	require.NoError(t, err)
+	defer client.Close()
+
+	cn, err := client.New()
+	require.NoError(t, err)
+	ver, err := client.Write(cn, 0, apis.AnyVersion, []byte("hello, world!"))
+	require.NoError(t, err)
+	require.NoError(t, client.Delete(cn, ver))
+
+	_, _, err = client.Read(cn, 0, 13)
+	assert.True(t, errors.Is(err, apis.ErrChunkDeleted), "unexpected error: %v", err)
+	ver, err = client.Write(cn, 0, apis.AnyVersion, []byte("hello again"))
+	assert.True(t, errors.Is(err, apis.ErrChunkDeleted), "unexpected error: %v", err)
+	assert.False(t, errors.Is(err, apis.ErrVersionStale))
+	assert.Equal(t, apis.Version(0), ver)
+	_, err = client.Write(cn, 0, 1, []byte("hello again"))
+	assert.True(t, errors.Is(err, apis.ErrChunkDeleted), "unexpected error: %v", err)
+	err = client.Delete(cn, apis.AnyVersion)
+	assert.True(t, errors.Is(err, apis.ErrChunkDeleted), "unexpected error: %v", err)
+
+	_, _, err = client.Read(cn+1000, 0, 13)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+	assert.False(t, errors.Is(err, apis.ErrChunkDeleted))
 }
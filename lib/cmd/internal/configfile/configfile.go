@@ -0,0 +1,22 @@
+// Package configfile reads the YAML configuration files that the zircon binaries are started with.
+package configfile
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Reads the configuration in the YAML file at 'path' into 'config', which should point to a struct. Fields that the
+// struct doesn't have are rejected, so that a misspelled setting isn't silently ignored.
+func Load(path string, config interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return fmt.Errorf("invalid configuration in %s: %v", path, err)
+	}
+	return nil
+}
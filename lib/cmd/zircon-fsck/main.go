@@ -0,0 +1,137 @@
+// Checks a Zircon filesystem for inconsistencies between its directory tree and the chunks it is stored in, and
+// optionally repairs them. The configuration is a YAML file holding a filesystem.Configuration, such as
+// config-example/fuse.yaml; its mountpoint is ignored. Looking for unreachable chunks tries every chunk number in the
+// cluster, so it needs etcd-addresses in the client configuration, and takes a while.
+// Repairs should only be made while no other client is changing the filesystem. Unreachable chunks are only deleted
+// with -offline, which promises that much, since a client that is writing a file has data chunks that nothing refers to
+// yet. Exits with status 1 if any problem was left unfixed.
+//
+//	zircon-fsck [-repair] [-quarantine DIR] [-unreachable [-offline]] CONFIG.yaml
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"zircon/lib/apis"
+	"zircon/lib/client"
+	"zircon/lib/cmd/internal/configfile"
+	"zircon/lib/etcd"
+	"zircon/lib/filesystem"
+	"zircon/lib/logging"
+	"zircon/lib/metadatacache"
+)
+
+// Finds every chunk that exists, by trying each chunk number in each metadata block that etcd knows about.
+func listAllocated(config client.Configuration) ([]apis.ChunkNum, error) {
+	if len(config.EtcdAddresses) == 0 {
+		return nil, errors.New("finding unreachable chunks requires etcd-addresses in the client configuration")
+	}
+	etcdif, err := etcd.SubscribeEtcd("fsck", config.EtcdAddresses)
+	if err != nil {
+		return nil, err
+	}
+	defer etcdif.Close()
+	metachunks, err := etcdif.ListAllMetaIDs()
+	if err != nil {
+		return nil, err
+	}
+	cli, err := client.ConfigureNetworkedClient(config)
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+	var chunks []apis.ChunkNum
+	for _, metachunk := range metachunks {
+		for i := 0; i < 1<<apis.EntriesPerBlock; i++ {
+			chunk := metadatacache.EntryAndBlockToChunkNum(metachunk, uint32(i))
+			_, _, err := cli.Read(chunk, 0, 0)
+			if errors.Is(err, apis.ErrNotFound) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("while looking for chunk %d: %v", chunk, err)
+			}
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks, nil
+}
+
+func main() {
+	repair := flag.Bool("repair", false, "fix the problems found in place")
+	quarantine := flag.String("quarantine", "", "move damaged files into this directory, creating it if needed, instead of repairing them")
+	unreachable := flag.Bool("unreachable", false, "also look for chunks that nothing in the filesystem refers to")
+	offline := flag.Bool("offline", false, "promise that no other client is using the filesystem, so that -repair can delete unreachable chunks")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-repair] [-quarantine DIR] [-unreachable [-offline]] CONFIG.yaml\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var config filesystem.Configuration
+	if err := configfile.Load(flag.Arg(0), &config); err != nil {
+		logging.Fatalf(logging.Default(), "%v", err)
+	}
+	base, err := config.Logging.NewLogger(os.Stderr)
+	if err != nil {
+		logging.Fatalf(logging.Default(), "invalid logging configuration: %v", err)
+	}
+	logger := logging.Component(base, "fsck")
+	fs, err := filesystem.NewFilesystemClientWithLogger(config, base)
+	if err != nil {
+		logging.Fatalf(logger, "cannot connect to filesystem: %v", err)
+	}
+	traverser, err := fs.GetTraverser()
+	if err != nil {
+		logging.Fatalf(logger, "%v", err)
+	}
+
+	options := filesystem.FsckOptions{
+		Repair:     *repair,
+		Quarantine: *quarantine,
+		Offline:    *offline,
+	}
+	if options.Quarantine != "" {
+		if err := fs.Mkdir(options.Quarantine); err != nil && !errors.Is(err, filesystem.ErrExists) {
+			logging.Fatalf(logger, "cannot create quarantine directory: %v", err)
+		}
+	}
+	if *unreachable {
+		if *repair && !*offline {
+			logger.Logf(apis.WARN, "unreachable chunks will only be reported, since -offline was not given")
+		}
+		options.Allocated, err = listAllocated(config.ClientConfig)
+		if err != nil {
+			logging.Fatalf(logger, "%v", err)
+		}
+	}
+
+	found, unfixed := 0, 0
+	err = traverser.Fsck(options, func(problem filesystem.Problem) {
+		found++
+		status := "found"
+		if problem.Fixed {
+			status = "fixed"
+		} else {
+			unfixed++
+		}
+		where := problem.Path
+		if where == "" {
+			where = fmt.Sprintf("chunk %d", problem.Chunk)
+		}
+		fmt.Printf("%s: %s at %s: %s\n", status, problem.Type, where, problem.Detail)
+	})
+	if err != nil {
+		logging.Fatalf(logger, "check did not finish: %v", err)
+	}
+	fmt.Printf("%d problems found, %d left unfixed\n", found, unfixed)
+	if unfixed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,72 @@
+// Mounts a Zircon filesystem at a local directory through FUSE, so that existing applications can use it like any
+// other filesystem. The configuration is a YAML file holding a filesystem.Configuration, such as
+// config-example/fuse.yaml. Runs until the filesystem is unmounted, either with fusermount -u or by interrupting this
+// process.
+//
+//	zircon-mount [-mountpoint DIR] CONFIG.yaml
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"gopkg.in/yaml.v2"
+
+	"zircon/lib/apis"
+	"zircon/lib/cmd/internal/configfile"
+	"zircon/lib/filesystem"
+	"zircon/lib/filesystem/fuse"
+	"zircon/lib/logging"
+)
+
+func main() {
+	mountpoint := flag.String("mountpoint", "", "the directory to mount at, instead of the one in the configuration")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-mountpoint DIR] CONFIG.yaml\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var config filesystem.Configuration
+	if err := configfile.Load(flag.Arg(0), &config); err != nil {
+		logging.Fatalf(logging.Default(), "%v", err)
+	}
+	base, err := config.Logging.NewLogger(os.Stderr)
+	if err != nil {
+		logging.Fatalf(logging.Default(), "invalid logging configuration: %v", err)
+	}
+	logger := logging.Component(base, "fuse")
+	if *mountpoint != "" {
+		config.MountPoint = *mountpoint
+	}
+	if config.MountPoint == "" {
+		logging.Fatalf(logger, "no mountpoint specified")
+	}
+
+	server, err := fuse.MountWithLogger(config, base)
+	if err != nil {
+		logging.Fatalf(logger, "cannot mount at %s: %v", config.MountPoint, err)
+	}
+
+	// unmount cleanly when interrupted, so that the mountpoint isn't left behind as a dead mount
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for range signals {
+			if err := server.Unmount(); err != nil {
+				logger.Logf(apis.WARN, "cannot unmount %s yet: %v", config.MountPoint, err)
+			}
+		}
+	}()
+
+	logger.Logf(apis.INFO, "serving zircon filesystem at %s", config.MountPoint)
+	server.Serve()
+	logger.Logf(apis.INFO, "unmounted %s", config.MountPoint)
+}
@@ -0,0 +1,77 @@
+// Serves a Zircon filesystem over NFS version 3, so that it can be mounted by the NFS client built into most operating
+// systems, without FUSE or a Go binary on the client's machine. The configuration is a YAML file such as
+// config-example/nfs.yaml, which holds a filesystem.Configuration along with the settings for the server itself; its
+// mountpoint is ignored. Clients mount the exported directory over TCP, with the port given explicitly, since no
+// portmapper is registered, such as with:
+//
+//	mount -t nfs -o vers=3,proto=tcp,port=2049,mountport=2049,nolock SERVER:/ /mnt/zircon
+//
+//	zircon-nfs [-address HOST:PORT] CONFIG.yaml
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"zircon/lib/apis"
+	"zircon/lib/cmd/internal/configfile"
+	"zircon/lib/filesystem"
+	"zircon/lib/filesystem/nfs"
+	"zircon/lib/logging"
+)
+
+type configuration struct {
+	Filesystem filesystem.Configuration `yaml:",inline"`
+	// The address to listen for NFS and MOUNT calls on. Clients assume port 2049 unless told otherwise.
+	Address string `yaml:"address"`
+	// The directory that clients can mount, along with any directory inside it. Defaults to the root of the
+	// filesystem.
+	Export string `yaml:"export"`
+}
+
+func main() {
+	address := flag.String("address", "", "the address to listen on, instead of the one in the configuration")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-address HOST:PORT] CONFIG.yaml\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var config configuration
+	if err := configfile.Load(flag.Arg(0), &config); err != nil {
+		logging.Fatalf(logging.Default(), "%v", err)
+	}
+	base, err := config.Filesystem.Logging.NewLogger(os.Stderr)
+	if err != nil {
+		logging.Fatalf(logging.Default(), "invalid logging configuration: %v", err)
+	}
+	logger := logging.Component(base, "nfs")
+	if *address != "" {
+		config.Address = *address
+	}
+	if config.Address == "" {
+		config.Address = fmt.Sprintf(":%d", nfs.DefaultPort)
+	}
+
+	fs, err := filesystem.NewFilesystemClientWithLogger(config.Filesystem, base)
+	if err != nil {
+		logging.Fatalf(logger, "cannot connect to filesystem: %v", err)
+	}
+	newServer := nfs.NewServer
+	if config.Filesystem.EnforcePermissions {
+		newServer = nfs.NewServerWithPermissions
+	}
+	server, err := newServer(fs, config.Export)
+	if err != nil {
+		logging.Fatalf(logger, "cannot start NFS server: %v", err)
+	}
+	server.SetLogger(base)
+
+	logger.Logf(apis.INFO, "serving zircon filesystem over NFS at %s", config.Address)
+	logging.Fatalf(logger, "cannot serve: %v", server.ListenAndServe(config.Address))
+}
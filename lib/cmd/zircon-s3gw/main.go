@@ -0,0 +1,91 @@
+// Serves a Zircon filesystem over the Amazon S3 REST API, so that existing S3 tools and SDKs can read and write it
+// without a custom client. The configuration is a YAML file such as config-example/s3gw.yaml, which holds a
+// filesystem.Configuration along with the settings for the gateway itself; its mountpoint is ignored. Each directory
+// inside the gateway's root directory is served as a bucket. Clients must use path-style addressing.
+//
+//	zircon-s3gw [-address HOST:PORT] CONFIG.yaml
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"zircon/lib/apis"
+	"zircon/lib/cmd/internal/configfile"
+	"zircon/lib/filesystem"
+	"zircon/lib/filesystem/s3gw"
+	"zircon/lib/logging"
+)
+
+type configuration struct {
+	Filesystem filesystem.Configuration `yaml:",inline"`
+	// The address to listen for S3 requests on.
+	Address string `yaml:"address"`
+	// The directory whose subdirectories are served as buckets. Defaults to the root of the filesystem.
+	Root string `yaml:"root"`
+	// The region that clients sign requests for. Defaults to us-east-1.
+	Region string `yaml:"region"`
+	// The credentials that clients must sign requests with. If neither is set, requests are not authenticated at all.
+	AccessKey string `yaml:"access-key"`
+	SecretKey string `yaml:"secret-key"`
+	// Serves HTTPS instead of HTTP, if both are set.
+	TLSCert string `yaml:"tls-cert"`
+	TLSKey  string `yaml:"tls-key"`
+}
+
+func main() {
+	address := flag.String("address", "", "the address to listen on, instead of the one in the configuration")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-address HOST:PORT] CONFIG.yaml\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var config configuration
+	if err := configfile.Load(flag.Arg(0), &config); err != nil {
+		logging.Fatalf(logging.Default(), "%v", err)
+	}
+	base, err := config.Filesystem.Logging.NewLogger(os.Stderr)
+	if err != nil {
+		logging.Fatalf(logging.Default(), "invalid logging configuration: %v", err)
+	}
+	logger := logging.Component(base, "s3gw")
+	if *address != "" {
+		config.Address = *address
+	}
+	if config.Address == "" {
+		logging.Fatalf(logger, "no address specified")
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		logging.Fatalf(logger, "tls-cert and tls-key must be specified together")
+	}
+
+	fs, err := filesystem.NewFilesystemClientWithLogger(config.Filesystem, base)
+	if err != nil {
+		logging.Fatalf(logger, "cannot connect to filesystem: %v", err)
+	}
+	var gateway *s3gw.Gateway
+	if config.AccessKey == "" && config.SecretKey == "" {
+		logger.Logf(apis.WARN, "no credentials configured, so requests will not be authenticated")
+		gateway, err = s3gw.NewGateway(fs, config.Root)
+	} else {
+		gateway, err = s3gw.NewAuthenticatedGateway(fs, config.Root, config.Region, config.AccessKey, config.SecretKey)
+	}
+	if err != nil {
+		logging.Fatalf(logger, "cannot start gateway: %v", err)
+	}
+
+	logger.Logf(apis.INFO, "serving zircon filesystem over S3 at %s", config.Address)
+	if config.TLSCert != "" {
+		err = http.ListenAndServeTLS(config.Address, config.TLSCert, config.TLSKey, gateway)
+	} else {
+		err = http.ListenAndServe(config.Address, gateway)
+	}
+	logging.Fatalf(logger, "cannot serve: %v", err)
+}
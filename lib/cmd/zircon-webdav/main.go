@@ -0,0 +1,93 @@
+// Serves a Zircon filesystem over WebDAV, so that it can be mounted as a network drive from desktop operating systems,
+// or browsed from a web browser, over plain HTTP or HTTPS. The configuration is a YAML file such as
+// config-example/webdav.yaml, which holds a filesystem.Configuration along with the settings for the server itself;
+// its mountpoint is ignored.
+//
+//	zircon-webdav [-address HOST:PORT] CONFIG.yaml
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"zircon/lib/apis"
+	"zircon/lib/cmd/internal/configfile"
+	"zircon/lib/filesystem"
+	"zircon/lib/filesystem/webdav"
+	"zircon/lib/logging"
+)
+
+type configuration struct {
+	Filesystem filesystem.Configuration `yaml:",inline"`
+	// The address to listen for WebDAV requests on.
+	Address string `yaml:"address"`
+	// The directory to serve. Defaults to the root of the filesystem.
+	Root string `yaml:"root"`
+	// The credentials that clients must log in with, through HTTP basic authentication. If neither is set, requests
+	// are not authenticated at all.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Serves HTTPS instead of HTTP, if both are set.
+	TLSCert string `yaml:"tls-cert"`
+	TLSKey  string `yaml:"tls-key"`
+}
+
+func main() {
+	address := flag.String("address", "", "the address to listen on, instead of the one in the configuration")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-address HOST:PORT] CONFIG.yaml\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var config configuration
+	if err := configfile.Load(flag.Arg(0), &config); err != nil {
+		logging.Fatalf(logging.Default(), "%v", err)
+	}
+	base, err := config.Filesystem.Logging.NewLogger(os.Stderr)
+	if err != nil {
+		logging.Fatalf(logging.Default(), "invalid logging configuration: %v", err)
+	}
+	logger := logging.Component(base, "webdav")
+	if *address != "" {
+		config.Address = *address
+	}
+	if config.Address == "" {
+		logging.Fatalf(logger, "no address specified")
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		logging.Fatalf(logger, "tls-cert and tls-key must be specified together")
+	}
+
+	fs, err := filesystem.NewFilesystemClientWithLogger(config.Filesystem, base)
+	if err != nil {
+		logging.Fatalf(logger, "cannot connect to filesystem: %v", err)
+	}
+	var handler *webdav.Handler
+	if config.Username == "" && config.Password == "" {
+		logger.Logf(apis.WARN, "no credentials configured, so requests will not be authenticated")
+		handler, err = webdav.NewHandler(fs, config.Root)
+	} else {
+		if config.TLSCert == "" {
+			logger.Logf(apis.WARN, "passwords will be sent unencrypted, since TLS is not configured")
+		}
+		handler, err = webdav.NewAuthenticatedHandler(fs, config.Root, config.Username, config.Password)
+	}
+	if err != nil {
+		logging.Fatalf(logger, "cannot start WebDAV server: %v", err)
+	}
+
+	logger.Logf(apis.INFO, "serving zircon filesystem over WebDAV at %s", config.Address)
+	if config.TLSCert != "" {
+		err = http.ListenAndServeTLS(config.Address, config.TLSCert, config.TLSKey, handler)
+	} else {
+		err = http.ListenAndServe(config.Address, handler)
+	}
+	logging.Fatalf(logger, "cannot serve: %v", err)
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"zircon/lib/filesystem"
+)
+
+// Parses the flags of a command, and checks that it was given between min and max positional arguments.
+func parseArgs(flags *flag.FlagSet, args []string, min int, max int) ([]string, error) {
+	flags.SetOutput(ioutil.Discard)
+	if err := flags.Parse(args); err != nil {
+		return nil, usageError{err.Error()}
+	}
+	if flags.NArg() < min || flags.NArg() > max {
+		return nil, usageError{fmt.Sprintf("wrong number of arguments: %d", flags.NArg())}
+	}
+	return flags.Args(), nil
+}
+
+// What kind of node is at a path: "directory", "symlink", or "file", along with the target of a symlink.
+func describe(fs filesystem.Filesystem, p string) (kind string, info os.FileInfo, target string, err error) {
+	info, err = fs.Stat(p)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if info.IsDir() {
+		return "directory", info, "", nil
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := fs.ReadLink(p)
+		if err != nil {
+			return "", nil, "", err
+		}
+		return "symlink", info, target, nil
+	}
+	return "file", info, "", nil
+}
+
+// The owner and group of a node, as reported by Stat.
+func ownerOf(info os.FileInfo) (uid uint32, gid uint32) {
+	if node, ok := info.Sys().(filesystem.NodeInfo); ok {
+		return node.Uid, node.Gid
+	}
+	return 0, 0
+}
+
+// The access and change times of a node, as reported by Stat; its modification time is info.ModTime().
+func timesOf(info os.FileInfo) (atime time.Time, ctime time.Time) {
+	if node, ok := info.Sys().(filesystem.NodeInfo); ok {
+		return node.Atime, node.Ctime
+	}
+	return time.Time{}, time.Time{}
+}
+
+// Formats a time in the given layout, in local time, or as '-' if it isn't known.
+func formatTime(t time.Time, layout string) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(layout)
+}
+
+// Uploads a local file. Unless -f is given, the file must not exist yet, and is created atomically: it only appears
+// once all of its contents have been written. With -f, an existing file is overwritten in place.
+func put(fs filesystem.Filesystem, args []string) error {
+	flags := flag.NewFlagSet("put", flag.ContinueOnError)
+	force := flags.Bool("f", false, "overwrite the file if it already exists")
+	args, err := parseArgs(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	var in io.Reader = os.Stdin
+	if args[0] != "-" {
+		local, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer local.Close()
+		in = local
+	}
+	if !*force {
+		return fs.CreateAtomic(args[1], in)
+	}
+	out, err := fs.OpenWrite(args[1], true, false)
+	if err != nil {
+		return err
+	}
+	if err := out.Truncate(0); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Downloads a file to a local file, or to standard output if none is named.
+func get(fs filesystem.Filesystem, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("get", flag.ContinueOnError), args, 1, 2)
+	if err != nil {
+		return err
+	}
+	in, err := fs.OpenRead(args[0])
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if len(args) == 1 || args[1] == "-" {
+		_, err = io.Copy(os.Stdout, in)
+		return err
+	}
+	out, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Lists the entries of a directory, by name, or with -l, along with their modes, owners, sizes and modification times.
+func ls(fs filesystem.Filesystem, args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	long := flags.Bool("l", false, "show the mode, owner, group, size and modification time of each entry")
+	args, err := parseArgs(flags, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	dir := "/"
+	if len(args) == 1 {
+		dir = args[0]
+	}
+	info, err := fs.Stat(dir)
+	if err != nil {
+		return err
+	}
+	names := []string{path.Base(dir)}
+	if info.IsDir() {
+		names, err = fs.ListDir(dir)
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+	} else {
+		dir = path.Dir(dir)
+	}
+	for _, name := range names {
+		if !*long {
+			fmt.Println(name)
+			continue
+		}
+		kind, info, target, err := describe(fs, path.Join(dir, name))
+		if err != nil {
+			// the entry may have been removed since the directory was listed
+			fmt.Fprintf(os.Stderr, "cannot stat %s: %v\n", name, err)
+			continue
+		}
+		uid, gid := ownerOf(info)
+		fmt.Printf("%s %5d %5d %12d %16s ", info.Mode(), uid, gid, info.Size(), formatTime(info.ModTime(), "2006-01-02 15:04"))
+		switch kind {
+		case "directory":
+			fmt.Printf("%s/\n", name)
+		case "symlink":
+			fmt.Printf("%s -> %s\n", name, target)
+		default:
+			fmt.Printf("%s\n", name)
+		}
+	}
+	return nil
+}
+
+// Describes a single node. For directories, this includes how many entries they have, and the total size of the files
+// anywhere beneath them.
+func stat(fs filesystem.Filesystem, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("stat", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	kind, info, target, err := describe(fs, args[0])
+	if err != nil {
+		return err
+	}
+	uid, gid := ownerOf(info)
+	fmt.Printf("path: %s\nkind: %s\nmode: %s\nowner: %d\ngroup: %d\n", args[0], kind, info.Mode(), uid, gid)
+	atime, ctime := timesOf(info)
+	fmt.Printf("accessed: %s\nmodified: %s\nchanged: %s\n", formatTime(atime, time.RFC3339Nano),
+		formatTime(info.ModTime(), time.RFC3339Nano), formatTime(ctime, time.RFC3339Nano))
+	switch kind {
+	case "directory":
+		dir, err := fs.StatDir(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("entries: %d\nsubtree size: %d\n", dir.Entries, dir.Size)
+	case "symlink":
+		fmt.Printf("target: %s\n", target)
+	default:
+		fmt.Printf("size: %d\n", info.Size())
+	}
+	return nil
+}
+
+// Creates a directory. With -p, its missing parents are created as well, and it is not an error for it to exist.
+func mkdir(fs filesystem.Filesystem, args []string) error {
+	flags := flag.NewFlagSet("mkdir", flag.ContinueOnError)
+	parents := flags.Bool("p", false, "create missing parent directories, and accept directories that already exist")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if !*parents {
+		return fs.Mkdir(args[0])
+	}
+	return mkdirAll(fs, path.Clean(args[0]))
+}
+
+func mkdirAll(fs filesystem.Filesystem, dir string) error {
+	if info, err := fs.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s exists and is not a directory", dir)
+		}
+		return nil
+	}
+	if parent := path.Dir(dir); parent != dir {
+		if err := mkdirAll(fs, parent); err != nil {
+			return err
+		}
+	}
+	err := fs.Mkdir(dir)
+	if err != nil {
+		// someone else may have created it in the meantime
+		if info, statErr := fs.Stat(dir); statErr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+// Removes a file or symlink, or an empty directory, or with -r, a directory and everything in it.
+func rm(fs filesystem.Filesystem, args []string) error {
+	flags := flag.NewFlagSet("rm", flag.ContinueOnError)
+	recursive := flags.Bool("r", false, "remove directories and everything in them")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *recursive {
+		return fs.RemoveAll(args[0])
+	}
+	info, err := fs.Stat(args[0])
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fs.Rmdir(args[0])
+	}
+	return fs.Unlink(args[0])
+}
+
+// Takes a snapshot of a directory tree, which can then be read under filesystem.SnapshotDir, or with -d, deletes one.
+func snapshot(fs filesystem.Filesystem, args []string) error {
+	flags := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	remove := flags.Bool("d", false, "delete the snapshot with this name")
+	args, err := parseArgs(flags, args, 1, 2)
+	if err != nil {
+		return err
+	}
+	if *remove {
+		if len(args) != 1 {
+			return usageError{"-d takes only a snapshot name"}
+		}
+		return fs.DeleteSnapshot(args[0])
+	}
+	if len(args) != 2 {
+		return usageError{"expected a path and a snapshot name"}
+	}
+	return fs.Snapshot(args[0], args[1])
+}
+
+// Brings back what was most recently deleted from a path into the trash.
+func undelete(fs filesystem.Filesystem, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("undelete", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	return fs.Undelete(args[0])
+}
+
+// Removes whatever has been in the trash for longer than the configured trash period, which is meant to be run
+// regularly, such as from cron.
+func purge(fs filesystem.Filesystem, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("purge", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	return fs.PurgeTrash()
+}
+
+func mv(fs filesystem.Filesystem, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("mv", flag.ContinueOnError), args, 2, 2)
+	if err != nil {
+		return err
+	}
+	return fs.Rename(args[0], args[1])
+}
+
+// Creates a symlink. Zircon has no hard links, so -s is required, to keep the arguments in the same order as ln's.
+func ln(fs filesystem.Filesystem, args []string) error {
+	flags := flag.NewFlagSet("ln", flag.ContinueOnError)
+	symbolic := flags.Bool("s", false, "create a symbolic link")
+	args, err := parseArgs(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	if !*symbolic {
+		return usageError{"only symbolic links are supported"}
+	}
+	return fs.SymLink(args[1], args[0])
+}
+
+// Changes the permissions of a node to an octal mode, such as 755 or 1777.
+func chmod(fs filesystem.Filesystem, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("chmod", flag.ContinueOnError), args, 2, 2)
+	if err != nil {
+		return err
+	}
+	mode, err := strconv.ParseUint(args[0], 8, 32)
+	if err != nil || mode > 07777 {
+		return usageError{fmt.Sprintf("invalid mode: %s", args[0])}
+	}
+	return fs.Chmod(args[1], filesystem.FileMode(uint32(mode)))
+}
+
+// Changes the owner of a node, and its group if one is given, by number. With an empty UID, as in ":GID", only the
+// group is changed.
+func chown(fs filesystem.Filesystem, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("chown", flag.ContinueOnError), args, 2, 2)
+	if err != nil {
+		return err
+	}
+	owner, group := args[0], ""
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		owner, group = owner[:i], owner[i+1:]
+	}
+	uid, gid := -1, -1
+	for _, id := range []struct {
+		text  string
+		value *int
+	}{{owner, &uid}, {group, &gid}} {
+		if id.text == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(id.text, 10, 32)
+		if err != nil {
+			return usageError{fmt.Sprintf("invalid owner: %s", args[0])}
+		}
+		*id.value = int(n)
+	}
+	if uid < 0 && gid < 0 {
+		return usageError{fmt.Sprintf("invalid owner: %s", args[0])}
+	}
+	return fs.Chown(args[1], uid, gid)
+}
+
+// Runs a local command while holding an advisory lock on a file, like flock(1), so that scripts on different machines
+// can take turns with it. The lock is exclusive unless -s is given, and is released once the command exits.
+func lock(fs filesystem.Filesystem, args []string) error {
+	flags := flag.NewFlagSet("lock", flag.ContinueOnError)
+	shared := flags.Bool("s", false, "take a shared lock instead of an exclusive one")
+	args, err := parseArgs(flags, args, 2, math.MaxInt32)
+	if err != nil {
+		return err
+	}
+	unlock, err := fs.Lock(args[0], !*shared)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(args[1], args[2:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	if uerr := unlock(); err == nil {
+		err = uerr
+	}
+	return err
+}
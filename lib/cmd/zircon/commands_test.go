@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"zircon/lib/filesystem"
+)
+
+// Just enough of a filesystem for lock, which has a single file that can be locked, and records whether it is.
+type lockingFilesystem struct {
+	filesystem.Filesystem
+	locked    bool
+	exclusive bool
+}
+
+func (f *lockingFilesystem) Lock(path string, exclusive bool) (func() error, error) {
+	if path != "/lockfile" {
+		return nil, os.ErrNotExist
+	}
+	f.locked, f.exclusive = true, exclusive
+	return func() error {
+		f.locked = false
+		return nil
+	}, nil
+}
+
+// Tests that lock holds the lock while its command runs, releases it after, and passes the command's exit status on.
+func TestLock(t *testing.T) {
+	fs := &lockingFilesystem{}
+
+	require.NoError(t, lock(fs, []string{"/lockfile", "true"}))
+	assert.True(t, fs.exclusive)
+	assert.False(t, fs.locked)
+	require.NoError(t, lock(fs, []string{"-s", "/lockfile", "sh", "-c", "exit 0"}))
+	assert.False(t, fs.exclusive)
+	assert.False(t, fs.locked)
+
+	// the command's own exit status is passed through, and the lock is released all the same
+	err := lock(fs, []string{"/lockfile", "sh", "-c", "exit 3"})
+	require.Error(t, err)
+	status, failed := commandStatus(err)
+	assert.True(t, failed)
+	assert.Equal(t, 3, status)
+	assert.False(t, fs.locked)
+	status, failed = commandStatus(lock(fs, []string{"-s", "/lockfile", "false"}))
+	assert.True(t, failed)
+	assert.Equal(t, 1, status)
+
+	// failures of lock itself are not mistaken for the command's
+	err = lock(fs, []string{"/missing", "true"})
+	require.Error(t, err)
+	_, failed = commandStatus(err)
+	assert.False(t, failed)
+	err = lock(fs, []string{"/lockfile"})
+	assert.IsType(t, usageError{}, err)
+	_, failed = commandStatus(err)
+	assert.False(t, failed)
+}
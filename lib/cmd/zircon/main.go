@@ -0,0 +1,139 @@
+// Works with the files in a Zircon filesystem from the command line, so that operators and scripts can use a cluster
+// without mounting it or writing any Go. The configuration is a YAML file holding a filesystem.Configuration, such as
+// config-example/fuse.yaml; its mountpoint is ignored. It is read from -config, or from $ZIRCON_CONFIG if that is not
+// given. Paths within the filesystem are absolute, and "-" stands for standard input or output.
+//
+//	zircon [-config CONFIG.yaml] put [-f] LOCAL PATH
+//	zircon [-config CONFIG.yaml] get PATH [LOCAL]
+//	zircon [-config CONFIG.yaml] ls [-l] [PATH]
+//	zircon [-config CONFIG.yaml] stat PATH
+//	zircon [-config CONFIG.yaml] mkdir [-p] PATH
+//	zircon [-config CONFIG.yaml] rm [-r] PATH
+//	zircon [-config CONFIG.yaml] mv SOURCE DEST
+//	zircon [-config CONFIG.yaml] ln -s TARGET PATH
+//	zircon [-config CONFIG.yaml] chmod MODE PATH
+//	zircon [-config CONFIG.yaml] chown UID[:GID] PATH
+//	zircon [-config CONFIG.yaml] lock [-s] PATH COMMAND [ARGS...]
+//	zircon [-config CONFIG.yaml] snapshot PATH NAME
+//	zircon [-config CONFIG.yaml] snapshot -d NAME
+//	zircon [-config CONFIG.yaml] undelete PATH
+//	zircon [-config CONFIG.yaml] purge
+//
+// The exit status is 2 for incorrect usage, and 1 for anything else that fails, except that lock exits with the status
+// of its command.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+
+	"zircon/lib/cmd/internal/configfile"
+	"zircon/lib/filesystem"
+)
+
+// The environment variable consulted for the configuration file when -config isn't given.
+const ConfigEnvironment = "ZIRCON_CONFIG"
+
+// A subcommand: how it is invoked, and what it does once the filesystem has been connected to.
+type command struct {
+	usage string
+	run   func(fs filesystem.Filesystem, args []string) error
+}
+
+var commands = map[string]command{
+	"put":      {"put [-f] LOCAL PATH", put},
+	"get":      {"get PATH [LOCAL]", get},
+	"ls":       {"ls [-l] [PATH]", ls},
+	"stat":     {"stat PATH", stat},
+	"mkdir":    {"mkdir [-p] PATH", mkdir},
+	"rm":       {"rm [-r] PATH", rm},
+	"mv":       {"mv SOURCE DEST", mv},
+	"ln":       {"ln -s TARGET PATH", ln},
+	"chmod":    {"chmod MODE PATH", chmod},
+	"chown":    {"chown UID[:GID] PATH", chown},
+	"lock":     {"lock [-s] PATH COMMAND [ARGS...]", lock},
+	"snapshot": {"snapshot PATH NAME | snapshot -d NAME", snapshot},
+	"undelete": {"undelete PATH", undelete},
+	"purge":    {"purge", purge},
+}
+
+// Reported for arguments that don't match a command's usage, so that main can print the usage rather than the error.
+type usageError struct {
+	message string
+}
+
+func (e usageError) Error() string {
+	return e.message
+}
+
+// Reports the exit status of the local command that lock ran, if that command is where 'err' came from.
+func commandStatus(err error) (int, bool) {
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() > 0 {
+		return exit.ExitCode(), true
+	}
+	return 0, false
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [-config CONFIG.yaml] COMMAND [ARGS...]\n\ncommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(out, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	configPath := flag.String("config", os.Getenv(ConfigEnvironment), "the filesystem configuration to connect with (default $"+ConfigEnvironment+")")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd, found := commands[flag.Arg(0)]
+	if !found {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *configPath == "" {
+		fmt.Fprintf(os.Stderr, "no configuration specified with -config or $%s\n", ConfigEnvironment)
+		os.Exit(2)
+	}
+
+	var config filesystem.Configuration
+	if err := configfile.Load(*configPath, &config); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+	fs, err := filesystem.NewFilesystemClient(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: cannot connect to filesystem: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+
+	if err := cmd.run(fs, flag.Args()[1:]); err != nil {
+		if _, ok := err.(usageError); ok {
+			fmt.Fprintf(os.Stderr, "%s\nusage: %s %s\n", err, os.Args[0], cmd.usage)
+			os.Exit(2)
+		}
+		if status, failed := commandStatus(err); failed {
+			// the command has already said what went wrong
+			os.Exit(status)
+		}
+		fmt.Fprintf(os.Stderr, "%s %s: %v\n", os.Args[0], flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
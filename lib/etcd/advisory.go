@@ -0,0 +1,131 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"zircon/lib/apis"
+
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+// Advisory locks are kept apart from the sync locks under /fs/lock, which the filesystem takes for its own operations.
+// Each request for an advisory lock is a key under the prefix for its chunk, attached to a lease of its own, so that
+// the lock disappears along with the key once the lease is revoked or runs out. Requests are granted in the order
+// their keys were created: a request waits until every conflicting key created before it is gone.
+
+const advisoryShared = "shared"
+const advisoryExclusive = "exclusive"
+
+// How long AcquireLock waits for conflicting locks before giving up, which keeps it well within the timeout of an RPC.
+const awaitLockTimeout = 10 * time.Second
+
+func advisoryPrefix(chunk apis.ChunkNum) string {
+	return fmt.Sprintf("/fs/advisory/%d/", chunk)
+}
+
+// Acquires an advisory lock on a chunk
+func (e *etcdinterface) AcquireLock(chunk apis.ChunkNum, exclusive bool) (apis.LockID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), awaitLockTimeout)
+	defer cancel()
+
+	grant, err := e.Client.Grant(ctx, int64(apis.AdvisoryLockTimeout/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	lease := grant.ID
+
+	mode := advisoryShared
+	if exclusive {
+		mode = advisoryExclusive
+	}
+	key := fmt.Sprintf("%s%d", advisoryPrefix(chunk), lease)
+	put, err := e.Client.Put(ctx, key, mode, clientv3.WithLease(lease))
+	if err != nil {
+		e.revokeLock(lease)
+		return 0, err
+	}
+	// nothing else can have been created at the revision of our put
+	created := put.Header.Revision
+
+	for {
+		// we're still in line, even if we've been waiting for longer than the lease lasts
+		if _, err := e.Client.KeepAliveOnce(ctx, lease); err != nil {
+			e.revokeLock(lease)
+			return 0, lockWaitError(ctx, err)
+		}
+		resp, err := e.Client.Get(ctx, advisoryPrefix(chunk), clientv3.WithPrefix(), clientv3.WithMaxCreateRev(created-1))
+		if err != nil {
+			e.revokeLock(lease)
+			return 0, lockWaitError(ctx, err)
+		}
+		var blocker *mvccpb.KeyValue
+		for _, kv := range resp.Kvs {
+			if (exclusive || string(kv.Value) == advisoryExclusive) &&
+				(blocker == nil || kv.CreateRevision > blocker.CreateRevision) {
+				blocker = kv
+			}
+		}
+		if blocker == nil {
+			return apis.LockID(lease), nil
+		}
+		// wait for the latest conflicting request to go away; anything before it is checked again afterwards
+		if err := e.awaitDeletion(ctx, string(blocker.Key), resp.Header.Revision); err != nil {
+			e.revokeLock(lease)
+			return 0, lockWaitError(ctx, err)
+		}
+	}
+}
+
+// Waits until 'key' is deleted after 'revision', or until it is time to renew the lease of the lock being waited for.
+func (e *etcdinterface) awaitDeletion(ctx context.Context, key string, revision int64) error {
+	ctx, cancel := context.WithTimeout(ctx, apis.AdvisoryLockTimeout/3)
+	defer cancel()
+	watch := e.Client.Watcher.Watch(ctx, key, clientv3.WithRev(revision+1), clientv3.WithFilterPut())
+	for {
+		resp, ok := <-watch
+		if !ok || ctx.Err() != nil {
+			// nothing happened in time, but the caller checks again anyway
+			return nil
+		}
+		if resp.Canceled {
+			return resp.Err()
+		}
+		if len(resp.Events) > 0 {
+			return nil
+		}
+	}
+}
+
+// Reports running out of time to wait as contention, so that callers know to try again.
+func lockWaitError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return apis.ErrLockContended
+	}
+	return err
+}
+
+func (e *etcdinterface) revokeLock(lease clientv3.LeaseID) {
+	// if this fails, the lease runs out on its own soon enough
+	_, _ = e.Client.Revoke(context.Background(), lease)
+}
+
+// Extends an advisory lock
+func (e *etcdinterface) RenewLock(lock apis.LockID) error {
+	resp, err := e.Client.KeepAliveOnce(context.Background(), clientv3.LeaseID(lock))
+	if err != nil {
+		return fmt.Errorf("lock lost: %w", err)
+	}
+	if resp.TTL < 1 {
+		return fmt.Errorf("lock lost: lease %d expired", lock)
+	}
+	return nil
+}
+
+// Releases an advisory lock
+func (e *etcdinterface) ReleaseLock(lock apis.LockID) error {
+	_, err := e.Client.Revoke(context.Background(), clientv3.LeaseID(lock))
+	return err
+}
@@ -0,0 +1,40 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"zircon/lib/apis"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+// Each draining chunkserver is a key under drainingPrefix, which stays until the drain is called off, even once the
+// server holds no more replicas, so that nothing is placed on it again before it is retired.
+const drainingPrefix = "/server/draining/"
+
+func (e *etcdinterface) SetDraining(name apis.ServerName, draining bool) error {
+	if !draining {
+		_, err := e.Client.Delete(context.Background(), drainingPrefix+string(name))
+		return err
+	}
+	_, err := e.Client.Put(context.Background(), drainingPrefix+string(name), string(name))
+	return err
+}
+
+func (e *etcdinterface) ListDraining() ([]apis.ServerName, error) {
+	response, err := e.Client.Get(context.Background(), drainingPrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	var servers []apis.ServerName
+	for _, kv := range response.Kvs {
+		key := string(kv.Key)
+		if !strings.HasPrefix(key, drainingPrefix) {
+			return nil, errors.New("unexpected key in draining servers: " + key)
+		}
+		servers = append(servers, apis.ServerName(key[len(drainingPrefix):]))
+	}
+	return servers, nil
+}
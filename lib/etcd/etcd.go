@@ -22,6 +22,11 @@ type etcdinterface struct {
 
 	LeaseMutex sync.Mutex
 	Lease      clientv3.LeaseID // TODO: ensure that Lease is still the same after each transaction
+
+	// the lease that this server's heartbeats keep alive, and how long it lasts without them; see liveness.go
+	heartbeatMutex   sync.Mutex
+	heartbeat        clientv3.LeaseID
+	heartbeatTimeout time.Duration
 }
 
 // Connects to etcd and provides our specific etcd interface based on that connection.
@@ -192,6 +197,83 @@ func (e *etcdinterface) UpdateAddress(address apis.ServerAddress, kind apis.Serv
 	return nil
 }
 
+func (e *etcdinterface) UpdateFailureDomain(domain apis.FailureDomain) error {
+	encoded, err := json.Marshal(domain)
+	if err != nil {
+		return err
+	}
+	_, err = e.Client.Put(context.Background(), "/server/domains/"+string(e.LocalName), string(encoded))
+	return err
+}
+
+func (e *etcdinterface) GetFailureDomain(name apis.ServerName) (apis.FailureDomain, error) {
+	var domain apis.FailureDomain
+	response, err := e.Client.Get(context.Background(), "/server/domains/"+string(name))
+	if err != nil {
+		return domain, err
+	}
+	if len(response.Kvs) == 0 {
+		return domain, nil
+	}
+	if err := json.Unmarshal(response.Kvs[0].Value, &domain); err != nil {
+		return domain, fmt.Errorf("invalid failure domain for server %s: %v", name, err)
+	}
+	return domain, nil
+}
+
+func (e *etcdinterface) UpdateCapacity(capacity apis.ServerCapacity) error {
+	encoded, err := json.Marshal(capacity)
+	if err != nil {
+		return err
+	}
+	_, err = e.Client.Put(context.Background(), "/server/capacity/"+string(e.LocalName), string(encoded))
+	return err
+}
+
+func (e *etcdinterface) GetCapacity(name apis.ServerName) (apis.ServerCapacity, error) {
+	var capacity apis.ServerCapacity
+	response, err := e.Client.Get(context.Background(), "/server/capacity/"+string(name))
+	if err != nil {
+		return capacity, err
+	}
+	if len(response.Kvs) == 0 {
+		return capacity, nil
+	}
+	if err := json.Unmarshal(response.Kvs[0].Value, &capacity); err != nil {
+		return capacity, fmt.Errorf("invalid capacity for server %s: %v", name, err)
+	}
+	return capacity, nil
+}
+
+const ReplicationFactorKey = "/cluster/replication-factor"
+
+func (e *etcdinterface) WriteReplicationFactor(replicas int) error {
+	if replicas < 0 || replicas > apis.MaxReplicationFactor {
+		return fmt.Errorf("replication factor %d out of range", replicas)
+	}
+	if replicas == 0 {
+		_, err := e.Client.Delete(context.Background(), ReplicationFactorKey)
+		return err
+	}
+	_, err := e.Client.Put(context.Background(), ReplicationFactorKey, strconv.Itoa(replicas))
+	return err
+}
+
+func (e *etcdinterface) ReadReplicationFactor() (int, error) {
+	response, err := e.Client.Get(context.Background(), ReplicationFactorKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(response.Kvs) == 0 {
+		return 0, nil
+	}
+	replicas, err := strconv.Atoi(string(response.Kvs[0].Value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid replication factor: %v", err)
+	}
+	return replicas, nil
+}
+
 func (e *etcdinterface) GetNameByID(id apis.ServerID) (apis.ServerName, error) {
 	result, err := e.Client.Get(context.Background(), fmt.Sprintf("/server/by-id/%d", id))
 	if err != nil {
@@ -388,6 +470,33 @@ func (e *etcdinterface) DisclaimMetadata(blockid apis.MetadataID) error {
 	return nil
 }
 
+// Takes over the claim on a particular block of metadata from the server 'from', which must currently hold it.
+func (e *etcdinterface) TransferMetadataClaim(blockid apis.MetadataID, from apis.ServerName) error {
+	lease := func() clientv3.LeaseID {
+		e.LeaseMutex.Lock()
+		defer e.LeaseMutex.Unlock()
+		return e.Lease
+	}()
+	if lease == clientv3.NoLease {
+		return errors.New("no configured lease")
+	}
+
+	key := fmt.Sprintf("/metadata/claims/%d", blockid)
+
+	txn, err := e.Client.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.Value(key), "=", string(from))).
+		Then(clientv3.OpPut(key, string(e.LocalName), clientv3.WithLease(lease))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txn.Succeeded {
+		return fmt.Errorf("metadata block %d is not claimed by %s", blockid, from)
+	}
+	// as with TryClaimingMetadata, make sure that our lease is still active
+	return e.RenewMetadataClaims()
+}
+
 func (e *etcdinterface) getMetametadataRaw(blockid apis.MetadataID) ([]byte, apis.MetadataEntry, error) {
 	checkKey := fmt.Sprintf("/metadata/claims/%d", blockid)
 	readKey := fmt.Sprintf("/metadata/data/%d", blockid)
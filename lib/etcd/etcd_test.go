@@ -110,6 +110,154 @@ func TestListServers(t *testing.T) {
 	assert.Equal(t, []apis.ServerName{"test-name-2"}, servers)
 }
 
+func TestFailureDomains(t *testing.T) {
+	iface1, iface2, teardown := PrepareTwoClients(t)
+	defer teardown()
+
+	// servers that never recorded a domain are in the unknown one
+	domain, err := iface1.GetFailureDomain(iface2.GetName())
+	assert.NoError(t, err)
+	assert.Equal(t, apis.FailureDomain{}, domain)
+
+	assert.NoError(t, iface2.UpdateFailureDomain(apis.FailureDomain{Zone: "zone-a", Rack: "rack-3"}))
+	domain, err = iface1.GetFailureDomain(iface2.GetName())
+	assert.NoError(t, err)
+	assert.Equal(t, apis.FailureDomain{Zone: "zone-a", Rack: "rack-3"}, domain)
+
+	assert.NoError(t, iface2.UpdateFailureDomain(apis.FailureDomain{Zone: "zone-b"}))
+	domain, err = iface2.GetFailureDomain(iface2.GetName())
+	assert.NoError(t, err)
+	assert.Equal(t, apis.FailureDomain{Zone: "zone-b"}, domain)
+	domain, err = iface2.GetFailureDomain(iface1.GetName())
+	assert.NoError(t, err)
+	assert.Equal(t, apis.FailureDomain{}, domain)
+}
+
+func TestCapacity(t *testing.T) {
+	iface1, iface2, teardown := PrepareTwoClients(t)
+	defer teardown()
+
+	// servers that never reported have an unknown capacity
+	capacity, err := iface1.GetCapacity(iface2.GetName())
+	assert.NoError(t, err)
+	assert.Equal(t, apis.ServerCapacity{}, capacity)
+	assert.False(t, capacity.Known())
+
+	reported := apis.ServerCapacity{FreeBytes: 250, TotalBytes: 1000, Chunks: 17}
+	assert.NoError(t, iface2.UpdateCapacity(reported))
+	capacity, err = iface1.GetCapacity(iface2.GetName())
+	assert.NoError(t, err)
+	assert.Equal(t, reported, capacity)
+	assert.InDelta(t, 0.75, capacity.UsedFraction(), 0.0001)
+
+	reported.Chunks = 18
+	assert.NoError(t, iface2.UpdateCapacity(reported))
+	capacity, err = iface2.GetCapacity(iface2.GetName())
+	assert.NoError(t, err)
+	assert.Equal(t, reported, capacity)
+}
+
+func TestReplicationFactor(t *testing.T) {
+	iface1, iface2, teardown := PrepareTwoClients(t)
+	defer teardown()
+
+	replicas, err := iface1.ReadReplicationFactor()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, replicas)
+
+	assert.NoError(t, iface2.WriteReplicationFactor(3))
+	replicas, err = iface1.ReadReplicationFactor()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, replicas)
+
+	assert.Error(t, iface1.WriteReplicationFactor(apis.MaxReplicationFactor+1))
+	assert.Error(t, iface1.WriteReplicationFactor(-1))
+
+	assert.NoError(t, iface1.WriteReplicationFactor(0))
+	replicas, err = iface2.ReadReplicationFactor()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, replicas)
+}
+
+// Tests joining and leaving the metadata ring, including by letting the metadata lease run out
+func TestMetadataRing(t *testing.T) {
+	iface1, iface2, teardown := PrepareTwoClients(t)
+	defer teardown()
+
+	assert.Error(t, iface1.JoinMetadataRing())
+	members, err := iface1.ListMetadataRing()
+	assert.NoError(t, err)
+	assert.Empty(t, members)
+
+	assert.NoError(t, iface1.BeginMetadataLease())
+	assert.NoError(t, iface2.BeginMetadataLease())
+	assert.NoError(t, iface1.JoinMetadataRing())
+	assert.NoError(t, iface2.JoinMetadataRing())
+	members, err = iface2.ListMetadataRing()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []apis.ServerName{iface1.GetName(), iface2.GetName()}, members)
+
+	assert.NoError(t, iface1.LeaveMetadataRing())
+	members, err = iface2.ListMetadataRing()
+	assert.NoError(t, err)
+	assert.Equal(t, []apis.ServerName{iface2.GetName()}, members)
+
+	// without renewals, iface2 drops out of the ring along with its claims
+	time.Sleep(TestingLeaseTimeout * 3)
+	members, err = iface1.ListMetadataRing()
+	assert.NoError(t, err)
+	assert.Empty(t, members)
+}
+
+func TestDraining(t *testing.T) {
+	iface1, iface2, teardown := PrepareTwoClients(t)
+	defer teardown()
+
+	draining, err := iface1.ListDraining()
+	assert.NoError(t, err)
+	assert.Empty(t, draining)
+
+	assert.NoError(t, iface1.SetDraining("cs1", true))
+	assert.NoError(t, iface2.SetDraining("cs2", true))
+	// marking a server twice is harmless
+	assert.NoError(t, iface2.SetDraining("cs2", true))
+	draining, err = iface2.ListDraining()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []apis.ServerName{"cs1", "cs2"}, draining)
+
+	assert.NoError(t, iface2.SetDraining("cs1", false))
+	assert.NoError(t, iface2.SetDraining("cs3", false))
+	draining, err = iface1.ListDraining()
+	assert.NoError(t, err)
+	assert.Equal(t, []apis.ServerName{"cs2"}, draining)
+}
+
+func TestHeartbeats(t *testing.T) {
+	iface1, iface2, teardown := PrepareTwoClients(t)
+	defer teardown()
+
+	// neither has ever sent a heartbeat, so neither is down
+	down, err := iface1.ListDownServers()
+	assert.NoError(t, err)
+	assert.Empty(t, down)
+
+	assert.NoError(t, iface1.Heartbeat(time.Second))
+	assert.NoError(t, iface2.Heartbeat(time.Second))
+	for i := 0; i < 4; i++ {
+		time.Sleep(time.Second / 2)
+		assert.NoError(t, iface1.Heartbeat(time.Second))
+	}
+	down, err = iface1.ListDownServers()
+	assert.NoError(t, err)
+	assert.Equal(t, []apis.ServerName{iface2.GetName()}, down)
+
+	// a server that comes back is no longer down
+	assert.NoError(t, iface2.Heartbeat(time.Second))
+	down, err = iface2.ListDownServers()
+	assert.NoError(t, err)
+	assert.Empty(t, down)
+}
+
 // Tests claiming, disclaiming, and timeouts
 func TestMetadataLeases(t *testing.T) {
 	iface1, iface2, teardown := PrepareTwoClients(t)
@@ -193,6 +341,39 @@ func TestMetadataLeases(t *testing.T) {
 	attemptClaimsDual(iface1, 7, iface1)
 }
 
+// Tests handing a claim from one server to another
+func TestTransferMetadataClaim(t *testing.T) {
+	iface1, iface2, teardown := PrepareTwoClients(t)
+	defer teardown()
+
+	assert.NoError(t, iface1.BeginMetadataLease())
+	assert.Error(t, iface2.TransferMetadataClaim(3, iface1.GetName()))
+	assert.NoError(t, iface2.BeginMetadataLease())
+
+	owner, err := iface1.TryClaimingMetadata(3)
+	assert.NoError(t, err)
+	assert.Equal(t, iface1.GetName(), owner)
+
+	// only from the server that holds it
+	assert.Error(t, iface1.TransferMetadataClaim(3, iface2.GetName()))
+	assert.Error(t, iface2.TransferMetadataClaim(4, iface1.GetName()))
+
+	assert.NoError(t, iface2.TransferMetadataClaim(3, iface1.GetName()))
+	owner, err = iface1.TryClaimingMetadata(3)
+	assert.NoError(t, err)
+	assert.Equal(t, iface2.GetName(), owner)
+	assert.Error(t, iface1.DisclaimMetadata(3))
+
+	// the claim now lasts as long as iface2's lease, not iface1's
+	for i := 0; i < 4; i++ {
+		time.Sleep(TestingLeaseTimeout / 2)
+		assert.NoError(t, iface2.RenewMetadataClaims())
+	}
+	owner, err = iface2.TryClaimingMetadata(3)
+	assert.NoError(t, err)
+	assert.Equal(t, iface2.GetName(), owner)
+}
+
 func TestLeaseAnyMetametadata(t *testing.T) {
 	iface1, iface2, teardown := PrepareTwoClients(t)
 	defer teardown()
@@ -0,0 +1,87 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"zircon/lib/apis"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+// A server that sends heartbeats has a key under heartbeatsPrefix, which stays after it stops, and a key under
+// alivePrefix, which is attached to a lease that the heartbeats keep alive. A server that has the first but not the
+// second is down. Servers that never sent a heartbeat have neither, so they are never considered down.
+const heartbeatsPrefix = "/server/heartbeats/"
+const alivePrefix = "/server/alive/"
+
+func (e *etcdinterface) Heartbeat(timeout time.Duration) error {
+	e.heartbeatMutex.Lock()
+	defer e.heartbeatMutex.Unlock()
+	if e.heartbeat != clientv3.NoLease && e.heartbeatTimeout == timeout {
+		resp, err := e.Client.KeepAliveOnce(context.Background(), e.heartbeat)
+		if err == nil && resp.TTL > 0 {
+			return nil
+		}
+		// the lease ran out, so this server was considered down for a while; start a new one
+	}
+	ttl := int64((timeout + time.Second - 1) / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	resp, err := e.Client.Grant(context.Background(), ttl)
+	if err != nil {
+		return err
+	}
+	_, err = e.Client.Put(context.Background(), heartbeatsPrefix+string(e.LocalName), timeout.String())
+	if err != nil {
+		return err
+	}
+	_, err = e.Client.Put(context.Background(), alivePrefix+string(e.LocalName), string(e.LocalName), clientv3.WithLease(resp.ID))
+	if err != nil {
+		return err
+	}
+	if e.heartbeat != clientv3.NoLease {
+		// if this fails, the old lease runs out on its own soon enough
+		_, _ = e.Client.Revoke(context.Background(), e.heartbeat)
+	}
+	e.heartbeat, e.heartbeatTimeout = resp.ID, timeout
+	return nil
+}
+
+func (e *etcdinterface) listNames(prefix string) (map[apis.ServerName]bool, error) {
+	response, err := e.Client.Get(context.Background(), prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	names := map[apis.ServerName]bool{}
+	for _, kv := range response.Kvs {
+		key := string(kv.Key)
+		if !strings.HasPrefix(key, prefix) {
+			return nil, errors.New("unexpected key in server list: " + key)
+		}
+		names[apis.ServerName(key[len(prefix):])] = true
+	}
+	return names, nil
+}
+
+func (e *etcdinterface) ListDownServers() ([]apis.ServerName, error) {
+	// read in this order, so that a server that sends its first heartbeat in between isn't mistaken for a down one
+	beating, err := e.listNames(heartbeatsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	alive, err := e.listNames(alivePrefix)
+	if err != nil {
+		return nil, err
+	}
+	var down []apis.ServerName
+	for name := range beating {
+		if !alive[name] {
+			down = append(down, name)
+		}
+	}
+	return down, nil
+}
@@ -0,0 +1,47 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"zircon/lib/apis"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+// Each member of the metadata ring is a key under ringPrefix, attached to its metadata lease, so that a cache that
+// stops renewing its claims leaves the ring along with them.
+const ringPrefix = "/metadata/ring/"
+
+func (e *etcdinterface) JoinMetadataRing() error {
+	e.LeaseMutex.Lock()
+	lease := e.Lease
+	e.LeaseMutex.Unlock()
+	if lease == clientv3.NoLease {
+		return errors.New("no configured lease")
+	}
+	_, err := e.Client.Put(context.Background(), ringPrefix+string(e.LocalName), string(e.LocalName), clientv3.WithLease(lease))
+	return err
+}
+
+func (e *etcdinterface) LeaveMetadataRing() error {
+	_, err := e.Client.Delete(context.Background(), ringPrefix+string(e.LocalName))
+	return err
+}
+
+func (e *etcdinterface) ListMetadataRing() ([]apis.ServerName, error) {
+	response, err := e.Client.Get(context.Background(), ringPrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	var members []apis.ServerName
+	for _, kv := range response.Kvs {
+		key := string(kv.Key)
+		if !strings.HasPrefix(key, ringPrefix) {
+			return nil, errors.New("unexpected key in metadata ring: " + key)
+		}
+		members = append(members, apis.ServerName(key[len(ringPrefix):]))
+	}
+	return members, nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"context"
 	"errors"
+	"time"
 
 	"zircon/lib/apis"
 
@@ -328,7 +329,7 @@ func (e *etcdinterface) UpgradeSync(s apis.SyncID) (apis.SyncID, error) {
 			if sl.IsUnlocked() {
 				return 0, errors.New("should already hold a read lock when trying to upgrade")
 			} else {
-				return 0, errors.New("lock access contended")
+				return 0, apis.ErrLockContended
 			}
 		}
 		if !sl.HasReader(s) {
@@ -414,15 +415,19 @@ func (e *etcdinterface) ReleaseSync(s apis.SyncID) error {
 			panic("should never be unlocked here!")
 		}
 		var nsl syncLock
+		ops := []clientv3.Op{clientv3.OpDelete(syncKey)}
 		if sl.HasReader(s) {
 			nsl = sl.WithoutReader(s)
 		} else if sl.IsWriter() || sl.IsElevating() {
+			if sl.IsWriter() {
+				// anything changed under a write lock is visible once it is released; let AwaitRelease know
+				ops = append(ops, clientv3.OpPut(changedKey(chunk), ""))
+			}
 			nsl = sl.WithoutWriter(s)
 		} else {
 			panic("this should never happen!")
 		}
-		success, err := rewriteSyncState(e.Client, chunk, sl, nsl,
-			clientv3.OpDelete(syncKey))
+		success, err := rewriteSyncState(e.Client, chunk, sl, nsl, ops...)
 		if err != nil {
 			return err
 		}
@@ -450,6 +455,46 @@ func (e *etcdinterface) ConfirmSync(s apis.SyncID) (write bool, err error) {
 	return sl.Writer == s, nil
 }
 
+// How long AwaitRelease waits for a release before reporting that there was none, which keeps it well within the
+// timeout of an RPC.
+const awaitReleaseTimeout = 10 * time.Second
+
+func changedKey(chunk apis.ChunkNum) string {
+	return fmt.Sprintf("/fs/changed/%d", chunk)
+}
+
+// Waits for a write lock on a chunk to be released. The revision is that of the key ReleaseSync updates.
+func (e *etcdinterface) AwaitRelease(chunk apis.ChunkNum, seen apis.SyncRevision) (apis.SyncRevision, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), awaitReleaseTimeout)
+	defer cancel()
+	// start watching before looking, so that a release in between isn't missed
+	watch := e.Client.Watcher.Watch(ctx, changedKey(chunk))
+	resp, err := e.Client.Get(ctx, changedKey(chunk))
+	if err != nil {
+		return 0, err
+	}
+	current := apis.SyncRevision(0)
+	if len(resp.Kvs) > 0 {
+		current = apis.SyncRevision(resp.Kvs[0].ModRevision)
+	}
+	if current != seen {
+		return current, nil
+	}
+	for {
+		wresp, ok := <-watch
+		if !ok || ctx.Err() != nil {
+			// nothing was released in time
+			return seen, nil
+		}
+		if wresp.Canceled {
+			return 0, wresp.Err()
+		}
+		if len(wresp.Events) > 0 {
+			return apis.SyncRevision(wresp.Events[len(wresp.Events)-1].Kv.ModRevision), nil
+		}
+	}
+}
+
 const FilesystemRootKey = "/fs/root"
 
 func (e *etcdinterface) ReadFSRoot() (apis.ChunkNum, error) {
@@ -218,3 +218,48 @@ func TestSyncServer_DualEscalateFail(t *testing.T) {
 	assert.True(t, endRelease.After(ipt))
 	assert.True(t, endRelease.Sub(beginRelease) < time.Millisecond * 60, "took too long: %v", endRelease.Sub(beginRelease))
 }
+
+func TestSyncServer_AwaitRelease(t *testing.T) {
+	etcd, teardown := prepareSingleEtcdClient(t)
+	defer teardown()
+
+	initial, err := etcd.AwaitRelease(1, apis.UnknownRevision)
+	require.NoError(t, err)
+
+	released := make(chan apis.SyncRevision)
+	go func() {
+		revision, err := etcd.AwaitRelease(1, initial)
+		assert.NoError(t, err)
+		released <- revision
+	}()
+
+	// read locks can't change anything, so releasing one doesn't count
+	syncid, err := etcd.StartSync(1)
+	require.NoError(t, err)
+	assert.NoError(t, etcd.ReleaseSync(syncid))
+	select {
+	case <-released:
+		t.Fatal("woke up for the release of a read lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	syncid, err = etcd.StartSync(1)
+	require.NoError(t, err)
+	writer, err := etcd.UpgradeSync(syncid)
+	require.NoError(t, err)
+	assert.NoError(t, etcd.ReleaseSync(writer))
+	assert.NoError(t, etcd.ReleaseSync(syncid))
+
+	var revision apis.SyncRevision
+	select {
+	case revision = <-released:
+		assert.NotEqual(t, initial, revision)
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not wake up for the release of a write lock")
+	}
+
+	// a release that happened before the call is reported right away
+	again, err := etcd.AwaitRelease(1, initial)
+	assert.NoError(t, err)
+	assert.Equal(t, revision, again)
+}
@@ -1,7 +1,12 @@
 package filesystem
 
 import (
+	"context"
+	"io"
 	"os"
+	"time"
+
+	"zircon/lib/apis"
 )
 
 type Filesystem interface {
@@ -9,14 +14,88 @@ type Filesystem interface {
 	Rename(source string, dest string) error
 	Unlink(path string) error
 	Rmdir(path string) error
+	// Removes a node and, if it is a directory, everything below it, like os.RemoveAll: a path that doesn't exist is
+	// already removed. Other clients may go on changing the subtree while it is being removed, which is coped with.
+	RemoveAll(path string) error
+	// Takes a snapshot of a subtree, which holds the subtree as it was when it was taken, and appears read-only under
+	// SnapshotDir with the given name. Taking one is cheap, however much data the subtree holds: the data of each file
+	// is only copied once either the file or its copy is written to.
+	Snapshot(path string, name string) error
+	DeleteSnapshot(name string) error
+	// Brings back the node most recently deleted from a path into the trash, which fails with ErrExists if the path has
+	// been taken since, or ErrNotExist if the directory it was in is gone. See FilesystemOptions.TrashPeriod.
+	Undelete(path string) error
+	// Removes everything that was deleted into the trash longer ago than the trash period, or everything in it if there
+	// is no trash period.
+	PurgeTrash() error
 	OpenRead(path string) (ReadOnlyFile, error)
 	// Note: this does *NOT* truncate by default!
 	OpenWrite(path string, create bool, exclusive bool) (WritableFile, error)
+	// Creates a file with all of the contents of a reader at once: until it has been written in full, the file doesn't
+	// exist, and if anything goes wrong, it never does. Fails with ErrExists if the path is already taken.
+	CreateAtomic(path string, data io.Reader) error
+	// Unlike CreateAtomic, a file being uploaded is visible while it is written, so that if the upload is cancelled or
+	// fails, it can be finished later with Resume rather than started over.
+	Upload(ctx context.Context, path string, from io.ReaderAt) error
+	Resume(path string, from io.ReaderAt) error
+	ResumeContext(ctx context.Context, path string, from io.ReaderAt) error
+	// Opens a single chunk as if it were a file of apis.MaxChunkSize bytes, without finding it through any directory.
+	// This is for tooling that needs to look at or repair a chunk directly, such as one that nothing refers to.
+	OpenChunk(chunk apis.ChunkNum) (WritableFile, error)
 	SymLink(source string, dest string) error
 	Stat(path string) (os.FileInfo, error)
+	// Unlike Stat, which only describes a directory itself, this also reports what is inside it.
+	StatDir(path string) (DirInfo, error)
 	ReadLink(path string) (string, error)
-	Truncate(path string, length uint32) error
+	Truncate(path string, length uint64) error
+	// Change the permissions of a node, or its owner and group, where -1 leaves either one as it is, like os.Chmod and
+	// os.Chown. Nothing here enforces them; see AsUser.
+	Chmod(path string, mode os.FileMode) error
+	Chown(path string, uid int, gid int) error
+	// Change the access and modification times of a node, where a zero time leaves that one as it is, like os.Chtimes.
+	Utimes(path string, atime time.Time, mtime time.Time) error
 	ListDir(path string) ([]string, error)
+	// Lists at most 'limit' nodes in a directory, starting from 'cursor', which is zero to start from the beginning, and
+	// returns the cursor to continue from, which is zero once there is nothing left. Unlike ListDir, only that much of
+	// the directory is read, so this suits directories of any size. Every node that stays where it is while the listing
+	// is continued is listed exactly once; nodes added, removed or renamed in the meantime may or may not be.
+	ReadDir(path string, cursor uint64, limit int) (entries []DirEntry, next uint64, err error)
+	// Streams the subtree under a directory out as a portable archive, or reconstructs one from such an archive.
+	Export(path string, w io.Writer) error
+	Import(path string, r io.Reader) error
+	// Copies a directory tree from the local filesystem to a directory in this one, reporting the outcome for each
+	// node to progress if it is not nil.
+	ImportTree(localPath string, destPath string) error
+	ImportTreeProgress(localPath string, destPath string, progress func(localPath string, err error)) error
+
+	// Streams the changes other clients or this one make to the entries of a directory, until the returned function is
+	// called. WatchRecursive also reports changes in every directory below it.
+	Watch(path string) (<-chan ChangeEvent, func(), error)
+	WatchRecursive(path string) (<-chan ChangeEvent, func(), error)
+
+	// Takes an advisory lock on a file, like flock: shared locks can be held by many clients at once, and an exclusive
+	// lock by only one, but neither stops anyone from opening the file. Waits until the lock can be taken. The lock is
+	// kept until unlock is called, or until the client stops renewing it, such as because it crashed.
+	Lock(path string, exclusive bool) (unlock func() error, err error)
 
 	GetTraverser() (*Traverser, error)
 }
+
+// A node in a directory, as listed by ReadDir.
+type DirEntry struct {
+	Name string
+	Type NodeType
+	// As in NodeInfo.
+	Chunk apis.ChunkNum
+	// The cursor that continues a listing just after this node.
+	Cursor uint64
+}
+
+// The contents of a directory, as reported by StatDir.
+type DirInfo struct {
+	// How many nodes are directly inside the directory.
+	Entries int
+	// The total length of every file in the directory and in all of the directories below it. This is maintained as
+	// files change, so it doesn't take a walk of the subtree to find.
+	Size uint64
+}
@@ -0,0 +1,74 @@
+package filesystem
+
+import (
+	"zircon/lib/audit"
+)
+
+// Like fs, but records each node that is renamed or removed through it in 'log', as done by 'actor', along with the
+// snapshots deleted and the trash purged. Creating and writing to files is recorded by the frontends that their chunks
+// are allocated and committed through; see frontend.NewAuditedFrontend.
+func NewAuditedFilesystem(fs Filesystem, log *audit.Log, actor string) Filesystem {
+	return &auditedFS{Filesystem: fs, log: log, actor: actor}
+}
+
+// Like fs, but if it is audited, operations are recorded as done by 'user' rather than by whoever it was audited for.
+// For frontends that serve many users without checking their permissions; AsUser does the same for those that do.
+func OnBehalfOf(fs Filesystem, user User) Filesystem {
+	if audited, ok := fs.(*auditedFS); ok {
+		return &auditedFS{Filesystem: audited.Filesystem, log: audited.log, actor: user.String()}
+	}
+	return fs
+}
+
+type auditedFS struct {
+	Filesystem
+	log   *audit.Log
+	actor string
+}
+
+func (a *auditedFS) record(operation string, path string, dest string, err error) {
+	a.log.Record(audit.Event{
+		Actor:     a.actor,
+		Operation: operation,
+		Path:      path,
+		Dest:      dest,
+		Error:     audit.ErrorText(err),
+	})
+}
+
+func (a *auditedFS) Rename(source string, dest string) error {
+	err := a.Filesystem.Rename(source, dest)
+	a.record("Rename", source, dest, err)
+	return err
+}
+
+func (a *auditedFS) Unlink(path string) error {
+	err := a.Filesystem.Unlink(path)
+	a.record("Unlink", path, "", err)
+	return err
+}
+
+func (a *auditedFS) Rmdir(path string) error {
+	err := a.Filesystem.Rmdir(path)
+	a.record("Rmdir", path, "", err)
+	return err
+}
+
+// Recorded once for the whole subtree, rather than for each node in it.
+func (a *auditedFS) RemoveAll(path string) error {
+	err := a.Filesystem.RemoveAll(path)
+	a.record("RemoveAll", path, "", err)
+	return err
+}
+
+func (a *auditedFS) DeleteSnapshot(name string) error {
+	err := a.Filesystem.DeleteSnapshot(name)
+	a.record("DeleteSnapshot", name, "", err)
+	return err
+}
+
+func (a *auditedFS) PurgeTrash() error {
+	err := a.Filesystem.PurgeTrash()
+	a.record("PurgeTrash", TrashDir, "", err)
+	return err
+}
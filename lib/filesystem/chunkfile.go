@@ -0,0 +1,71 @@
+package filesystem
+
+import (
+	"fmt"
+	"zircon/lib/apis"
+)
+
+// The contents of a single chunk, treated as a file of exactly apis.MaxChunkSize bytes, without any of the layout that
+// a File puts on top of its chunks. Parts that were never written read as zeroes.
+type chunkFile struct {
+	t        Traverser
+	chunk    apis.ChunkNum
+	unlocker Unlocker
+}
+
+func (c *chunkFile) Size() (uint64, error) {
+	if err := c.unlocker.Ensure(); err != nil {
+		return 0, err
+	}
+	return apis.MaxChunkSize, nil
+}
+
+func (c *chunkFile) Read(offset uint64, length uint64) ([]byte, error) {
+	if err := c.unlocker.Ensure(); err != nil {
+		return nil, err
+	}
+	if offset >= apis.MaxChunkSize {
+		return nil, nil
+	}
+	if length > apis.MaxChunkSize-offset {
+		length = apis.MaxChunkSize - offset
+	}
+	data, _, err := c.t.client.Read(c.chunk, uint32(offset), uint32(length))
+	return data, err
+}
+
+// Writes as much of data as fits in the chunk. Like File.Write, the number of bytes written is returned, along with an
+// error if that was less than all of them.
+func (c *chunkFile) Write(offset uint64, data []byte) (uint64, error) {
+	if err := c.unlocker.Ensure(); err != nil {
+		return 0, err
+	}
+	if offset >= apis.MaxChunkSize {
+		return 0, fmt.Errorf("write starts past the end of chunk %d: %w", c.chunk, apis.ErrChunkTooLarge)
+	}
+	var tooLarge error
+	if uint64(len(data)) > apis.MaxChunkSize-offset {
+		data = data[:apis.MaxChunkSize-offset]
+		tooLarge = fmt.Errorf("write exceeds chunk size; only wrote %d bytes: %w", len(data), apis.ErrChunkTooLarge)
+	}
+	if _, err := c.t.client.Write(c.chunk, uint32(offset), apis.AnyVersion, data); err != nil {
+		return 0, err
+	}
+	return uint64(len(data)), tooLarge
+}
+
+// A chunk can't change size, so this zeroes everything from nlength onwards instead.
+func (c *chunkFile) Truncate(nlength uint64) error {
+	if err := c.unlocker.Ensure(); err != nil {
+		return err
+	}
+	if nlength > apis.MaxChunkSize {
+		return fmt.Errorf("cannot extend chunk %d past its size: %w", c.chunk, apis.ErrChunkTooLarge)
+	}
+	_, err := c.t.client.Write(c.chunk, uint32(nlength), apis.AnyVersion, make([]byte, apis.MaxChunkSize-nlength))
+	return err
+}
+
+func (c *chunkFile) Release() {
+	c.unlocker.Unlock()
+}
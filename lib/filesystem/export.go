@@ -0,0 +1,330 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	path2 "path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chosen to cover a decent fraction of a chunk per request, without holding too much in memory.
+const transferBufferSize = 1024 * 1024
+
+// Writes the subtree under a directory to w as a tar archive, with names relative to that directory. File contents
+// are streamed rather than buffered, and symlink targets are stored verbatim. The permissions, ownership and times of
+// each node are kept in the archive, and restored by Import, except for change times, which can't be set.
+func (f *filesystem) Export(path string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	if err := f.exportDir(tw, path, ""); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func (f *filesystem) exportDir(tw *tar.Writer, path string, name string) error {
+	// only hold the directory lock while listing, so that we don't block other clients for the whole export
+	dir, err := f.t.PathDir(path)
+	if err != nil {
+		return err
+	}
+	entries, _, err := dir.listEntries()
+	dir.Release()
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, transferBufferSize)
+	for _, entry := range entries {
+		childPath := path2.Join(path, entry.Name)
+		childName := path2.Join(name, entry.Name)
+		info, err := f.Stat(childPath)
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{
+			Name:    childName,
+			Mode:    int64(PosixMode(info.Mode()) & 07777),
+			ModTime: info.ModTime(),
+			// the only format that keeps access and change times, and times to better than a second
+			Format: tar.FormatPAX,
+		}
+		if node, ok := info.Sys().(NodeInfo); ok {
+			header.Uid, header.Gid = int(node.Uid), int(node.Gid)
+			header.AccessTime, header.ChangeTime = node.Atime, node.Ctime
+		}
+		switch entry.Type {
+		case DIRECTORY:
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if err := f.exportDir(tw, childPath, childName); err != nil {
+				return err
+			}
+		case SYMLINK:
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname, err = f.ReadLink(childPath)
+			if err != nil {
+				return err
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+		case FILE:
+			header.Typeflag = tar.TypeReg
+			header.Size = info.Size()
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			file, err := f.OpenRead(childPath)
+			if err != nil {
+				return err
+			}
+			_, err = io.CopyBuffer(tw, io.LimitReader(file, header.Size), buffer)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("cannot export unknown node type %d: %s", entry.Type, childPath)
+		}
+	}
+	return nil
+}
+
+// Reconstructs a subtree from a tar archive produced by Export, underneath a directory, which is created if it does
+// not already exist. Nothing that already exists is overwritten.
+func (f *filesystem) Import(path string, r io.Reader) error {
+	if _, err := f.Stat(path); err != nil {
+		if err := f.Mkdir(path); err != nil {
+			return err
+		}
+	}
+	tr := tar.NewReader(r)
+	buffer := make([]byte, transferBufferSize)
+	// adding nodes to a directory changes its modification time, so the times of directories are set at the end
+	type dirTimes struct {
+		path  string
+		atime time.Time
+		mtime time.Time
+	}
+	var dirs []dirTimes
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := path2.Clean(header.Name)
+		if path2.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid path in archive: '%s'", header.Name)
+		}
+		target := path2.Join(path, name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := f.Mkdir(target); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := f.SymLink(target, header.Linkname); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			file, err := f.OpenWrite(target, true, true)
+			if err != nil {
+				return err
+			}
+			// closing the file writes out what it still holds, so a failure to close is a failure to import it
+			n, err := io.CopyBuffer(file, tr, buffer)
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			if n != header.Size {
+				return errors.New("archive ended partway through a file")
+			}
+		default:
+			return fmt.Errorf("unsupported entry type in archive: '%s'", header.Name)
+		}
+		if err := f.Chmod(target, FileMode(uint32(header.Mode))); err != nil {
+			return err
+		}
+		if err := f.Chown(target, header.Uid, header.Gid); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{path: target, atime: header.AccessTime, mtime: header.ModTime})
+		} else if err := f.Utimes(target, header.AccessTime, header.ModTime); err != nil {
+			return err
+		}
+	}
+	// deepest first, since setting the times of a directory doesn't change those of the directory above it, but
+	// archives list directories before their contents
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := f.Utimes(dirs[i].path, dirs[i].atime, dirs[i].mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The number of files that ImportTree uploads at once.
+const ImportTreeWorkers = 4
+
+// Returned by ImportTree when only part of a tree could be imported. Failed maps the local path of each node that was
+// not imported to the reason; anything inside a directory that failed is not attempted, and not counted.
+type TreeImportError struct {
+	Imported int
+	Failed   map[string]error
+}
+
+func (e *TreeImportError) Error() string {
+	return fmt.Sprintf("failed to import %d nodes (%d imported successfully)", len(e.Failed), e.Imported)
+}
+
+func (f *filesystem) ImportTree(localPath string, destPath string) error {
+	return f.ImportTreeProgress(localPath, destPath, nil)
+}
+
+// Recreates the directories, files, and symlinks under localPath underneath destPath, which is created if it does not
+// already exist. Nothing that already exists is overwritten. Files are uploaded in parallel, and a failure to import
+// one node doesn't stop the rest; if anything fails, a *TreeImportError is returned once everything else is done.
+// Modification times and permission bits are preserved, but ownership is not. Directories only count as imported once
+// their modes and times have been set, which happens after everything inside them has been imported, so that a
+// directory that is not writable can still be filled.
+func (f *filesystem) ImportTreeProgress(localPath string, destPath string, progress func(localPath string, err error)) error {
+	if _, err := f.Stat(destPath); err != nil {
+		if err := f.Mkdir(destPath); err != nil {
+			return err
+		}
+	}
+
+	var mu sync.Mutex
+	result := &TreeImportError{Failed: map[string]error{}}
+	report := func(local string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			result.Failed[local] = err
+		} else {
+			result.Imported++
+		}
+		if progress != nil {
+			progress(local, err)
+		}
+	}
+
+	type upload struct {
+		local  string
+		target string
+		// the permission bits and modification time to give it
+		mode  os.FileMode
+		mtime time.Time
+	}
+	uploads := make(chan upload)
+	var dirs []upload
+	var wg sync.WaitGroup
+	for i := 0; i < ImportTreeWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := make([]byte, transferBufferSize)
+			for u := range uploads {
+				report(u.local, f.importFile(u.local, u.target, u.mode, u.mtime, buffer))
+			}
+		}()
+	}
+
+	walkErr := filepath.Walk(localPath, func(local string, info os.FileInfo, err error) error {
+		if err != nil {
+			report(local, err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(localPath, local)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		target := path2.Join(destPath, filepath.ToSlash(rel))
+		switch {
+		case info.IsDir():
+			if err := f.Mkdir(target); err != nil {
+				report(local, err)
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, upload{local: local, target: target, mode: info.Mode().Perm(), mtime: info.ModTime()})
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(local)
+			if err == nil {
+				err = f.SymLink(target, link)
+			}
+			if err == nil {
+				err = f.Chmod(target, info.Mode().Perm())
+			}
+			if err == nil {
+				err = f.Utimes(target, time.Time{}, info.ModTime())
+			}
+			report(local, err)
+		case info.Mode().IsRegular():
+			uploads <- upload{local: local, target: target, mode: info.Mode().Perm(), mtime: info.ModTime()}
+		default:
+			report(local, fmt.Errorf("cannot import unsupported file type %v", info.Mode()&os.ModeType))
+		}
+		return nil
+	})
+	close(uploads)
+	wg.Wait()
+	// as in Import, deepest first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err := f.Chmod(dirs[i].target, dirs[i].mode)
+		if err == nil {
+			err = f.Utimes(dirs[i].target, time.Time{}, dirs[i].mtime)
+		}
+		report(dirs[i].local, err)
+	}
+
+	if walkErr != nil {
+		return walkErr
+	}
+	if len(result.Failed) > 0 {
+		return result
+	}
+	return nil
+}
+
+func (f *filesystem) importFile(local string, target string, mode os.FileMode, mtime time.Time, buffer []byte) error {
+	in, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := f.OpenWrite(target, true, true)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyBuffer(out, in, buffer)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(target, mode); err != nil {
+		return err
+	}
+	return f.Utimes(target, time.Time{}, mtime)
+}
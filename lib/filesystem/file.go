@@ -0,0 +1,574 @@
+package filesystem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"zircon/lib/apis"
+	"zircon/lib/util"
+)
+
+// A file is stored as an index chunk, which holds a header, then the length of the file, then the chunk numbers of the
+// data chunks that make up its contents. Each data chunk holds FileChunkSize bytes of the file, and a zero chunk number
+// represents a hole, which reads as zeroes. Data past the end of the file is not guaranteed to be zero, so anything
+// that extends a file clears it first.
+// Only the part of the index that covers the span being read or written is ever fetched, so the cost of an operation
+// doesn't depend on how large the file is.
+// A data chunk that other files' indexes may refer to as well, because of a snapshot, has sharedChunk set in its chunk
+// number in the index, and is copied before it is written to; see shares.go.
+// The header is fileMagic followed by the version of the layout of the index, as a little-endian uint32, so that a
+// later layout can tell the files it needs to convert from those it understands. Files written before there was an
+// index have no header: they hold a 4-byte length followed by the data itself, and are converted the first time they
+// are used. Read as a length, fileMagic is far past anything that fits in a single chunk, so the two can never be
+// confused.
+const FileChunkSize = apis.MaxChunkSize
+const fileHeaderSize = 8
+const fileLengthSize = 8
+const fileVersion = 1
+const legacyLengthSize = 4
+const MaxFileChunks = (apis.MaxChunkSize - fileHeaderSize - fileLengthSize) / 8
+const MaxFileSize = uint64(MaxFileChunks) * FileChunkSize
+
+const sharedChunk apis.ChunkNum = 1 << 63
+
+var fileMagic = [4]byte{'Z', 'I', 'R', 'F'}
+
+// Returned when a file's index chunk is in a layout that this version cannot use. Nothing is changed in such a file.
+var ErrFileFormat = errors.New("unsupported file format")
+
+// How many positions of the index releaseChunks looks at in one go.
+const releaseBatch = 1 << 16
+
+// The length of a file, along with the chunk numbers at positions [first, first+len(chunks)) of its index.
+type fileIndex struct {
+	length  uint64
+	first   int
+	chunks  []apis.ChunkNum
+	version apis.Version
+}
+
+// Returns the chunk number at a position of the index, which must be within the part that was read.
+func (index fileIndex) chunk(i int) apis.ChunkNum {
+	return index.chunks[i-index.first] &^ sharedChunk
+}
+
+// Reports whether the data chunk at a position of the index may be shared with other indexes.
+func (index fileIndex) shared(i int) bool {
+	return index.chunks[i-index.first]&sharedChunk != 0
+}
+
+func indexEntryOffset(i int) uint32 {
+	return uint32(fileHeaderSize + fileLengthSize + 8*i)
+}
+
+// Returns the header and length that start every index chunk, for a file of a certain length.
+func encodeFileHeader(length uint64) []byte {
+	header := make([]byte, fileHeaderSize+fileLengthSize)
+	copy(header, fileMagic[:])
+	binary.LittleEndian.PutUint32(header[len(fileMagic):], fileVersion)
+	binary.LittleEndian.PutUint64(header[fileHeaderSize:], length)
+	return header
+}
+
+// Creates the index chunk of a new, empty file.
+func (t Traverser) newFileChunk() (apis.ChunkNum, error) {
+	chunk, err := t.client.New()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := t.client.Write(chunk, 0, apis.AnyVersion, encodeFileHeader(0)); err != nil {
+		_ = t.client.Delete(chunk, apis.AnyVersion)
+		return 0, err
+	}
+	return chunk, nil
+}
+
+// Returns how many positions of the index are needed to hold a file of a certain length.
+func chunksFor(length uint64) int {
+	return int((length + FileChunkSize - 1) / FileChunkSize)
+}
+
+// Returns the positions of the index that hold a span of the file: (first, count). The span must end within
+// MaxFileSize.
+func chunkSpan(offset uint64, length uint64) (int, int) {
+	first := int(offset / FileChunkSize)
+	if length == 0 {
+		return first, 0
+	}
+	return first, chunksFor(offset+length) - first
+}
+
+// Reads the length of the file and the positions [first, first+count) of its index, all as of the same version. Fails
+// with ErrFileFormat if the index chunk is not in the current layout.
+func (f *File) readIndex(first int, count int) (fileIndex, error) {
+	for {
+		header, ver, err := f.t.client.Read(f.chunk, 0, fileHeaderSize+fileLengthSize)
+		if err != nil {
+			return fileIndex{}, err
+		}
+		if !bytes.Equal(header[:len(fileMagic)], fileMagic[:]) {
+			if err := f.upgradeLegacy(ver); err != nil {
+				return fileIndex{}, err
+			}
+			continue
+		}
+		if version := binary.LittleEndian.Uint32(header[len(fileMagic):]); version != fileVersion {
+			return fileIndex{}, fmt.Errorf("%w: chunk %d has index layout version %d", ErrFileFormat, f.chunk, version)
+		}
+		index := fileIndex{
+			length:  binary.LittleEndian.Uint64(header[fileHeaderSize:]),
+			first:   first,
+			chunks:  make([]apis.ChunkNum, count),
+			version: ver,
+		}
+		if count == 0 {
+			return index, nil
+		}
+		data, err := f.t.client.ReadVersion(f.chunk, indexEntryOffset(first), uint32(8*count), ver)
+		if errors.Is(err, apis.ErrVersionReclaimed) {
+			// the index changed in between; go around again
+			continue
+		} else if err != nil {
+			return fileIndex{}, err
+		}
+		for i := range index.chunks {
+			index.chunks[i] = apis.ChunkNum(binary.LittleEndian.Uint64(data[8*i:]))
+		}
+		return index, nil
+	}
+}
+
+// Converts an index chunk from before there was an index, which was last seen at a certain version, to the current
+// layout, moving the data that it holds into a data chunk of its own. Returns nil if the chunk was converted, or if it
+// changed since it was seen, so that the caller can read it again either way.
+func (f *File) upgradeLegacy(seen apis.Version) error {
+	old, ver, err := f.t.client.Read(f.chunk, 0, apis.MaxChunkSize)
+	if err != nil {
+		return err
+	} else if ver != seen {
+		return nil
+	}
+	length := binary.LittleEndian.Uint32(old)
+	if length > apis.MaxChunkSize-legacyLengthSize {
+		return fmt.Errorf("%w: chunk %d has neither a header nor a length that fits in it", ErrFileFormat, f.chunk)
+	}
+	upgraded := encodeFileHeader(uint64(length))
+	var chunk apis.ChunkNum
+	if data := util.StripTrailingZeroes(old[legacyLengthSize : legacyLengthSize+length]); len(data) > 0 {
+		if chunk, err = f.t.client.New(); err != nil {
+			return err
+		}
+		if _, err := f.t.client.Write(chunk, 0, apis.AnyVersion, data); err != nil {
+			_ = f.t.client.Delete(chunk, apis.AnyVersion)
+			return err
+		}
+		upgraded = append(upgraded, make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(upgraded[indexEntryOffset(0):], uint64(chunk))
+	}
+	// the old data, and anything left behind past its end by truncation, would otherwise be taken for chunk numbers
+	if extent := len(util.StripTrailingZeroes(old)); extent > len(upgraded) {
+		upgraded = append(upgraded, make([]byte, extent-len(upgraded))...)
+	}
+	nver, err := f.t.client.Write(f.chunk, 0, ver, upgraded)
+	if err != nil && chunk != 0 {
+		if derr := f.t.client.Delete(chunk, apis.AnyVersion); derr != nil {
+			return fmt.Errorf("two errors: %v -- and -- %v", err, derr)
+		}
+	}
+	if err != nil && nver == 0 {
+		return err
+	}
+	// on a version mismatch, someone else got there first
+	return nil
+}
+
+// Splits a span of a file into the parts that fall into each data chunk, and calls handle on each part in order, with
+// the position of the chunk in the index, the offset of the part within that chunk, and the part's offset within the
+// span.
+func forEachPiece(offset uint64, length uint64, handle func(i int, inner uint32, start uint64, count uint32) error) error {
+	for start := uint64(0); start < length; {
+		position := offset + start
+		inner := uint32(position % FileChunkSize)
+		count := FileChunkSize - inner
+		if uint64(count) > length-start {
+			count = uint32(length - start)
+		}
+		if err := handle(int(position/FileChunkSize), inner, start, count); err != nil {
+			return err
+		}
+		start += uint64(count)
+	}
+	return nil
+}
+
+// Returns the length of the file, as recorded in its index by the last Write or Truncate to change it. This is exact
+// even when the contents end in zeroes, since it never depends on the data itself.
+// TODO: use caching... we're allowed to, since we have a read lock!
+func (f *File) Size() (uint64, error) {
+	if err := f.unlocker.Ensure(); err != nil {
+		return 0, err
+	}
+	index, err := f.readIndex(0, 0)
+	if err != nil {
+		return 0, err
+	}
+	return index.length, nil
+}
+
+// Reads up to length bytes from the file at a certain offset. Returns fewer bytes if the end of the file is reached.
+func (f *File) Read(offset uint64, length uint64) ([]byte, error) {
+	if err := f.unlocker.Ensure(); err != nil {
+		return nil, err
+	}
+	if offset >= MaxFileSize {
+		return nil, nil
+	}
+	if length > MaxFileSize-offset {
+		length = MaxFileSize - offset
+	}
+	index, err := f.readIndex(chunkSpan(offset, length))
+	if err != nil {
+		return nil, err
+	}
+	if offset >= index.length {
+		return nil, nil
+	}
+	if length > index.length-offset {
+		length = index.length - offset
+	}
+	result := make([]byte, length)
+	err = forEachPiece(offset, length, func(i int, inner uint32, start uint64, count uint32) error {
+		chunk := index.chunk(i)
+		if chunk == 0 {
+			// holes are already zero in the result
+			return nil
+		}
+		data, _, err := f.t.client.Read(chunk, inner, count)
+		if err != nil {
+			return err
+		}
+		copy(result[start:start+uint64(count)], data)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Writes data into the file at a certain offset, extending the file if necessary. Returns the number of bytes that
+// were durably written; if this is less than len(data), an error is always returned as well.
+func (f *File) Write(offset uint64, data []byte) (uint64, error) {
+	// note: we do *not* elevate here! this is because POSIX supports parallel writes to the same file!
+	if err := f.unlocker.Ensure(); err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if offset >= MaxFileSize {
+		return 0, fmt.Errorf("write starts past the maximum file size of %d bytes", MaxFileSize)
+	}
+	var tooLarge error
+	if uint64(len(data)) > MaxFileSize-offset {
+		// only write the part that fits, and report the remainder as a short write
+		data = data[:MaxFileSize-offset]
+		tooLarge = fmt.Errorf("write exceeds maximum file size; only wrote %d bytes", len(data))
+	}
+	index, err := f.readIndex(chunkSpan(offset, uint64(len(data))))
+	if err != nil {
+		return 0, err
+	}
+	if offset > index.length {
+		// make sure that the gap between the old end of the file and this write reads as zeroes
+		if err := f.zeroRange(index.length, offset); err != nil {
+			return 0, err
+		}
+	}
+	written := uint64(0)
+	err = forEachPiece(offset, uint64(len(data)), func(i int, inner uint32, start uint64, count uint32) error {
+		chunk := index.chunk(i)
+		if chunk == 0 || index.shared(i) {
+			var err error
+			chunk, err = f.writableChunk(i)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := f.t.client.Write(chunk, inner, apis.AnyVersion, data[start:start+uint64(count)])
+		if err != nil {
+			return err
+		}
+		written += uint64(count)
+		return nil
+	})
+	if written > 0 && offset+written > index.length {
+		// make the newly-written data visible
+		grown, lerr := f.updateLength(offset+written, true)
+		if lerr != nil {
+			// only the part of the write that overlapped the existing contents is visible
+			if offset < index.length {
+				return index.length - offset, lerr
+			}
+			return 0, lerr
+		}
+		// the data is visible either way, so this can only be reported
+		if serr := f.t.addSize(f.parents, grown); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	if written > 0 {
+		if terr := f.modified(); terr != nil && err == nil {
+			err = terr
+		}
+	}
+	if err != nil {
+		return written, err
+	}
+	return written, tooLarge
+}
+
+// Writes everything from a reader to the file, starting at the beginning, one data chunk at a time.
+func (f *File) writeFrom(r io.Reader) error {
+	buffer := make([]byte, FileChunkSize)
+	for offset := uint64(0); ; {
+		n, err := io.ReadFull(r, buffer)
+		if n > 0 {
+			written, werr := f.Write(offset, buffer[:n])
+			if werr != nil {
+				return werr
+			}
+			offset += written
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (f *File) Truncate(nlength uint64) error {
+	// note: we do *not* elevate here! this is because POSIX supports parallel writes to the same file!
+	if err := f.unlocker.Ensure(); err != nil {
+		return err
+	}
+	if nlength > MaxFileSize {
+		return fmt.Errorf("cannot extend file past the maximum file size of %d bytes", MaxFileSize)
+	}
+	index, err := f.readIndex(0, 0)
+	if err != nil {
+		return err
+	}
+	if nlength == index.length {
+		return nil
+	}
+	if nlength > index.length { // needs to be zeroed out first
+		if err := f.zeroRange(index.length, nlength); err != nil {
+			return err
+		}
+	}
+	change, err := f.updateLength(nlength, false)
+	if err != nil {
+		return err
+	}
+	// any chunks entirely past the new end of the file are no longer needed. chunks left behind past the old end by
+	// failed writes are kept, but zeroRange clears them before they become part of the file again.
+	if err := f.releaseChunks(chunksFor(nlength), chunksFor(index.length)); err != nil {
+		return err
+	}
+	if err := f.modified(); err != nil {
+		return err
+	}
+	return f.t.addSize(f.parents, change)
+}
+
+// Updates the times in the file's entry after its contents changed. Files that weren't reached by traversal, like
+// those being uploaded, are left alone.
+func (f *File) modified() error {
+	return f.touch(func(attributes *Attributes) bool {
+		attributes.modified(time.Now())
+		return true
+	})
+}
+
+// Like Traverser.touch, but for the entry of this file.
+func (f *File) touch(update func(*Attributes) bool) error {
+	if f.parents == nil {
+		return nil
+	}
+	chain := append(append([]apis.ChunkNum(nil), f.parents...), f.chunk)
+	return f.t.touch(chain, update)
+}
+
+// Overwrites a range of the file with zeroes, skipping any holes.
+func (f *File) zeroRange(from uint64, to uint64) error {
+	index, err := f.readIndex(chunkSpan(from, to-from))
+	if err != nil {
+		return err
+	}
+	return forEachPiece(from, to-from, func(i int, inner uint32, start uint64, count uint32) error {
+		chunk := index.chunk(i)
+		if chunk == 0 {
+			return nil
+		}
+		if index.shared(i) {
+			var err error
+			if chunk, err = f.writableChunk(i); err != nil {
+				return err
+			}
+		}
+		_, err := f.t.client.Write(chunk, inner, apis.AnyVersion, make([]byte, count))
+		return err
+	})
+}
+
+// Finds the data chunk at a certain position in the index, ready to be written to: it is allocated if it does not exist
+// yet, and copied if it is shared, so that the other indexes that refer to it don't see the write. The index is only
+// changed if it hasn't changed since it was read, so when several writers reach the same chunk at once, exactly one of
+// them gets to replace it, and the rest delete their own and use that one instead.
+func (f *File) writableChunk(i int) (apis.ChunkNum, error) {
+	for {
+		index, err := f.readIndex(i, 1)
+		if err != nil {
+			return 0, err
+		}
+		existing := index.chunk(i)
+		if existing != 0 && !index.shared(i) {
+			// someone else got there first
+			return existing, nil
+		}
+		chunk := existing
+		if existing != 0 {
+			if chunk, err = f.copyShared(existing); err != nil {
+				return 0, err
+			}
+		} else if chunk, err = f.t.client.New(); err != nil {
+			return 0, err
+		} else if _, err := f.t.client.Write(chunk, 0, apis.AnyVersion, nil); err != nil {
+			return 0, err
+		}
+		entry := make([]byte, 8)
+		binary.LittleEndian.PutUint64(entry, uint64(chunk))
+		ver, err := f.t.client.Write(f.chunk, indexEntryOffset(i), index.version, entry)
+		if err == nil {
+			if chunk != existing && existing != 0 {
+				// this index no longer refers to the shared chunk
+				if err := f.t.releaseShared(existing); err != nil {
+					return 0, err
+				}
+			}
+			return chunk, nil
+		}
+		if chunk != existing {
+			if derr := f.t.client.Delete(chunk, apis.AnyVersion); derr != nil {
+				return 0, fmt.Errorf("two errors: %v -- and -- %v", err, derr)
+			}
+		}
+		if ver == 0 {
+			return 0, err
+		}
+		// version mismatch; the index changed underneath us, so go around again
+	}
+}
+
+// Returns a chunk with the same contents as a shared data chunk, which nothing refers to yet, unless nothing else
+// refers to the shared chunk any more, in which case it is returned as it is, to be kept without being marked.
+func (f *File) copyShared(shared apis.ChunkNum) (apis.ChunkNum, error) {
+	count, err := f.t.shareCount(shared)
+	if err != nil || count == 1 {
+		return shared, err
+	}
+	data, _, err := f.t.client.Read(shared, 0, FileChunkSize)
+	if err != nil {
+		return 0, err
+	}
+	chunk, err := f.t.client.New()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.t.client.Write(chunk, 0, apis.AnyVersion, util.StripTrailingZeroes(data)); err != nil {
+		_ = f.t.client.Delete(chunk, apis.AnyVersion)
+		return 0, err
+	}
+	return chunk, nil
+}
+
+// Changes the recorded length of the file, and returns how much it changed by. If grow is set, the length is only ever
+// increased, so that concurrent writers extending the file do not undo each other.
+func (f *File) updateLength(nlength uint64, grow bool) (int64, error) {
+	for {
+		index, err := f.readIndex(0, 0)
+		if err != nil {
+			return 0, err
+		}
+		if grow && index.length >= nlength {
+			return 0, nil
+		}
+		nbinlength := make([]byte, fileLengthSize)
+		binary.LittleEndian.PutUint64(nbinlength, nlength)
+		ver, err := f.t.client.Write(f.chunk, fileHeaderSize, index.version, nbinlength)
+		if err == nil {
+			return int64(nlength) - int64(index.length), nil
+		} else if ver == 0 {
+			return 0, err
+		}
+		// version mismatch; go around again
+	}
+}
+
+// Removes every data chunk at positions [first, end) of the index, and deletes them. The index is gone through
+// releaseBatch positions at a time, so that deleting a file doesn't need its whole index at once.
+func (f *File) releaseChunks(first int, end int) error {
+	if end > MaxFileChunks {
+		end = MaxFileChunks
+	}
+	for ; first < end; first += releaseBatch {
+		count := end - first
+		if count > releaseBatch {
+			count = releaseBatch
+		}
+		if err := f.releaseWindow(first, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *File) releaseWindow(first int, count int) error {
+	for {
+		index, err := f.readIndex(first, count)
+		if err != nil {
+			return err
+		}
+		var released []apis.ChunkNum
+		for _, chunk := range index.chunks {
+			if chunk != 0 {
+				released = append(released, chunk)
+			}
+		}
+		if len(released) == 0 {
+			return nil
+		}
+		ver, err := f.t.client.Write(f.chunk, indexEntryOffset(first), index.version, make([]byte, 8*count))
+		if err == nil {
+			for _, chunk := range released {
+				if chunk&sharedChunk != 0 {
+					err = f.t.releaseShared(chunk &^ sharedChunk)
+				} else {
+					err = f.t.client.Delete(chunk, apis.AnyVersion)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		} else if ver == 0 {
+			return err
+		}
+		// version mismatch; go around again
+	}
+}
@@ -1,37 +1,80 @@
 package filesystem
 
 import (
+	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"os"
 	path2 "path"
+	"sync"
 	"time"
 	"errors"
 	"zircon/lib/apis"
+	"zircon/lib/audit"
 	"zircon/lib/client"
 	"zircon/lib/rpc"
 	"zircon/lib/filesystem/syncserver"
-	"fmt"
+	"zircon/lib/logging"
 )
 
 type filesystem struct {
-	t *Traverser
+	t           *Traverser
+	readAhead   uint32
+	writeBuffer uint32
+	// whether this can change what is in SnapshotDir; see forSnapshots
+	snapshots   bool
+	// how long deleted nodes are kept in the trash; zero removes them straight away
+	trashPeriod time.Duration
 }
 
 type Configuration struct {
-	MountPoint          string
-	ClientConfig        client.Configuration
-	SyncServerAddresses []apis.ServerAddress
+	// Where the filesystem is mounted by a FUSE daemon; unused otherwise.
+	MountPoint          string               `yaml:"mountpoint"`
+	ClientConfig        client.Configuration `yaml:"client-config"`
+	SyncServerAddresses []apis.ServerAddress `yaml:"sync-servers"`
+	// How many bytes to fetch ahead of sequential reads from open files. Zero disables read-ahead.
+	ReadAhead uint32 `yaml:"read-ahead"`
+	// How many bytes of adjacent writes to open files to gather up before writing them out together. Zero writes each
+	// one out as it is made.
+	WriteBuffer uint32 `yaml:"write-buffer"`
+	// Whether the FUSE daemon and NFS server check each operation against the permissions of the user that makes it.
+	// The FUSE daemon also shares its mount with other users, which, unless it runs as root, needs user_allow_other in
+	// /etc/fuse.conf. Unused otherwise.
+	EnforcePermissions bool `yaml:"enforce-permissions"`
+	// How long deleted files and directories are kept in the trash before they can be purged, such as "72h". Zero
+	// removes them straight away.
+	TrashPeriod time.Duration `yaml:"trash-period"`
+	// How the daemons that serve the filesystem, such as the FUSE daemon and the NFS server, log what they do. See
+	// logging.Configuration.
+	Logging logging.Configuration `yaml:"logging"`
+	// Where renaming and removing files and directories are recorded; see NewAuditedFilesystem. Nothing is recorded
+	// unless a sink is given.
+	Audit audit.Configuration `yaml:"audit"`
 }
 
 func NewFilesystemClient(config Configuration) (Filesystem, error) {
+	return NewFilesystemClientWithLogger(config, logging.Default())
+}
+
+// Like NewFilesystemClient, but reports sinks of the audit log that fail to 'logger'. Operations that aren't made on
+// behalf of any other user are recorded as done by the user that this process runs as; see OnBehalfOf.
+func NewFilesystemClientWithLogger(config Configuration, logger apis.Logger) (Filesystem, error) {
 	if len(config.SyncServerAddresses) == 0 {
 		return nil, errors.New("no syncservers specified")
 	}
+	// the sync servers are secured the same way as the rest of the cluster
+	tlsConfig, err := config.ClientConfig.TLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
 	cli, err := client.ConfigureNetworkedClient(config.ClientConfig)
 	if err != nil {
 		return nil, err
 	}
-	sscache := rpc.NewConnectionCache()
+	ssoptions := config.ClientConfig.ConnectionOptions(tlsConfig)
+	ssoptions.Limit = rpc.InFlightLimit{}
+	sscache := rpc.NewConnectionCacheWithOptions(ssoptions)
 	var ss []apis.SyncServer
 	for _, ssaddr := range config.SyncServerAddresses {
 		server, err := sscache.SubscribeSyncServer(ssaddr)
@@ -40,74 +83,173 @@ func NewFilesystemClient(config Configuration) (Filesystem, error) {
 		}
 		ss = append(ss, server)
 	}
-	return NewFilesystem(cli, syncserver.RoundRobin(ss)), nil
+	fs := NewFilesystemWithOptions(cli, syncserver.RoundRobin(ss), FilesystemOptions{
+		ReadAhead:   config.ReadAhead,
+		WriteBuffer: config.WriteBuffer,
+		TrashPeriod: config.TrashPeriod,
+	})
+	if !config.Audit.Enabled() {
+		return fs, nil
+	}
+	log, err := config.Audit.Open(logging.Component(logger, "audit"))
+	if err != nil {
+		return nil, err
+	}
+	return NewAuditedFilesystem(fs, log, audit.LocalActor()), nil
 }
 
 func NewFilesystem(client apis.Client, sync apis.SyncServer) Filesystem {
+	return NewFilesystemWithOptions(client, sync, FilesystemOptions{})
+}
+
+// How a filesystem constructed with NewFilesystemWithOptions behaves. The zero value is a filesystem like the one that
+// NewFilesystem returns.
+type FilesystemOptions struct {
+	// Once an open file is being read sequentially, how many bytes after what the caller has read are fetched in the
+	// background while it consumes them. Zero disables this.
+	ReadAhead uint32
+	// How many bytes of writes to an open file that continue where the last one left off are held, and then written out
+	// together, which saves a round trip to the chunkservers for each one. Held writes are also written out when the
+	// file is flushed or closed, or when anything else is done with it, and an error in writing them out is reported
+	// then. Zero disables this.
+	WriteBuffer uint32
+	// If positive, Unlink and RemoveAll move what they delete into the trash, from which it can be brought back with
+	// Undelete until PurgeTrash is run more than this much later. See trash.go.
+	TrashPeriod time.Duration
+}
+
+// Like NewFilesystem, but takes all of the options at once, including those that can't be chosen any other way.
+func NewFilesystemWithOptions(client apis.Client, sync apis.SyncServer, options FilesystemOptions) Filesystem {
 	return &filesystem{
+		readAhead: options.ReadAhead,
+		writeBuffer: options.WriteBuffer,
+		trashPeriod: options.TrashPeriod,
 		t: &Traverser{
 			client: client,
 			fs: FilesystemSync{
 				s: sync,
 			},
+			paths: newPathCache(PathCacheSize),
 		},
 	}
 }
 
+// How many times an operation is attempted in all while it keeps losing races against other clients.
+const ConflictAttempts = 20
+
+// How long to wait before attempting an operation again after its first lost race, doubling with each one after that,
+// up to maxConflictBackoff. As with rpc.RetryPolicy, the actual wait is randomized to between half of this and all of
+// it, so that clients that raced each other don't just race again.
+const (
+	initialConflictBackoff = 2 * time.Millisecond
+	maxConflictBackoff     = 200 * time.Millisecond
+)
+
+// Runs op until it completes without losing a race against another client. Such a loss shows up as
+// apis.ErrLockContended or apis.ErrVersionStale, and op must start over from a fresh traversal each time, so that it sees
+// the other client's change. Backs off between attempts, and gives up with the last loss after ConflictAttempts.
+func retryConflicts(op func() error) error {
+	backoff := initialConflictBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if attempt >= ConflictAttempts || (!errors.Is(err, apis.ErrLockContended) && !errors.Is(err, apis.ErrVersionStale)) {
+			return err
+		}
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+		backoff *= 2
+		if backoff > maxConflictBackoff {
+			backoff = maxConflictBackoff
+		}
+	}
+}
+
 func (f *filesystem) Mkdir(path string) error {
-	ref, err := f.t.PathDir(path2.Dir(path))
-	if err != nil {
+	if err := f.writable(path); err != nil {
 		return err
 	}
-	defer ref.Release()
-	return ref.NewDir(path2.Base(path))
+	return retryConflicts(func() error {
+		ref, err := f.t.PathDir(path2.Dir(path))
+		if err != nil {
+			return err
+		}
+		defer ref.Release()
+		return ref.NewDir(path2.Base(path))
+	})
 }
 
 func (f *filesystem) Rename(source string, dest string) error {
-	srcDir, err := f.t.PathDir(path2.Dir(source))
-	if err != nil {
-		return err
-	}
-	defer srcDir.Release()
-	destDir, err := f.t.PathDir(path2.Dir(dest))
-	if err != nil {
+	if err := f.writable(source, dest); err != nil {
 		return err
 	}
-	defer destDir.Release()
-	return srcDir.MoveTo(destDir, source, dest)
+	return retryConflicts(func() error {
+		return f.t.Move(source, dest)
+	})
 }
 
 func (f *filesystem) Unlink(path string) error {
-	ref, err := f.t.PathDir(path2.Dir(path))
-	if err != nil {
+	if err := f.writable(path); err != nil {
 		return err
 	}
-	defer ref.Release()
-	return ref.Remove(path2.Base(path), false)
+	if f.trashes(path) {
+		return f.trash(path, false)
+	}
+	return retryConflicts(func() error {
+		ref, err := f.t.PathDir(path2.Dir(path))
+		if err != nil {
+			return err
+		}
+		defer ref.Release()
+		return ref.Remove(path2.Base(path), false)
+	})
 }
 
 func (f *filesystem) Rmdir(path string) error {
-	ref, err := f.t.PathDir(path2.Dir(path))
-	if err != nil {
+	if err := f.writable(path); err != nil {
 		return err
 	}
-	defer ref.Release()
-	return ref.Remove(path2.Base(path), true)
+	return retryConflicts(func() error {
+		ref, err := f.t.PathDir(path2.Dir(path))
+		if err != nil {
+			return err
+		}
+		defer ref.Release()
+		return ref.Remove(path2.Base(path), true)
+	})
 }
 
 func (f *filesystem) SymLink(source string, dest string) error {
-	ref, err := f.t.PathDir(path2.Dir(source))
-	if err != nil {
+	if err := f.writable(source); err != nil {
 		return err
 	}
-	defer ref.Release()
-	return ref.NewSymLink(path2.Base(source), dest)
+	return retryConflicts(func() error {
+		ref, err := f.t.PathDir(path2.Dir(source))
+		if err != nil {
+			return err
+		}
+		defer ref.Release()
+		return ref.NewSymLink(path2.Base(source), dest)
+	})
 }
 
 type fsFileInfo struct {
-	name string
-	size int64
-	isdir bool
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	node    NodeInfo
+}
+
+// What the Sys method of the os.FileInfo returned by Stat reports about a node.
+type NodeInfo struct {
+	Type NodeType
+	// The chunk that holds the node, which stays the same for as long as the node exists, however it is renamed or
+	// moved. This is what identifies it to protocols like NFS that refer to nodes by handle instead of by path.
+	Chunk apis.ChunkNum
+	Uid   uint32
+	Gid   uint32
+	// The other two times kept alongside the modification time; see Attributes.
+	Atime time.Time
+	Ctime time.Time
 }
 
 func (f fsFileInfo) Name() string {
@@ -119,23 +261,43 @@ func (f fsFileInfo) Size() int64 {
 }
 
 func (f fsFileInfo) Mode() os.FileMode {
-	if f.isdir {
-		return os.FileMode(0040755)
-	} else {
-		return os.FileMode(0100755)
-	}
+	return f.mode
 }
 
 func (f fsFileInfo) ModTime() time.Time {
-	return time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	return f.modTime
 }
 
 func (f fsFileInfo) IsDir() bool {
-	return f.isdir
+	return f.mode.IsDir()
 }
 
 func (f fsFileInfo) Sys() interface{} {
-	return nil
+	return f.node
+}
+
+func newFileInfo(path string, size int64, entry Entry) fsFileInfo {
+	mode := entry.Mode & AttributeModeMask
+	switch entry.Type {
+	case DIRECTORY:
+		mode |= os.ModeDir
+	case SYMLINK:
+		mode |= os.ModeSymlink
+	}
+	return fsFileInfo{
+		name:    path2.Base(path),
+		size:    size,
+		mode:    mode,
+		modTime: entry.Mtime,
+		node: NodeInfo{
+			Type:  entry.Type,
+			Chunk: entry.Chunk,
+			Uid:   entry.Uid,
+			Gid:   entry.Gid,
+			Atime: entry.Atime,
+			Ctime: entry.Ctime,
+		},
+	}
 }
 
 func (f *filesystem) Stat(path string) (os.FileInfo, error) {
@@ -144,18 +306,25 @@ func (f *filesystem) Stat(path string) (os.FileInfo, error) {
 		return nil, err
 	}
 	defer ref.Release()
-	var ntype NodeType
+	var entry Entry
 	if path == "/" {
-		ntype = DIRECTORY
-	} else {
-		ntype, err = ref.Stat(path2.Base(path))
+		entry.Type = DIRECTORY
+		entry.Chunk = ref.chunk
+		entry.Attributes, err = ref.RootAttributes()
 		if err != nil {
 			return nil, err
 		}
+	} else {
+		entry, _, err = ref.lookupEntryAny(path2.Base(path))
+		if errors.Is(err, ErrNotExist) {
+			entry.Type = NONEXISTENT
+		} else if err != nil {
+			return nil, err
+		}
 	}
-	switch ntype {
+	switch entry.Type {
 	case NONEXISTENT:
-		return nil, errors.New("no such file")
+		return nil, fmt.Errorf("%w: %s", ErrNotExist, path)
 	case FILE:
 		f, err := ref.LookupFile(path2.Base(path))
 		if err != nil {
@@ -166,11 +335,7 @@ func (f *filesystem) Stat(path string) (os.FileInfo, error) {
 		if err != nil {
 			return nil, err
 		}
-		return fsFileInfo{
-			name: path2.Base(path),
-			isdir: false,
-			size: int64(size),
-		}, nil
+		return newFileInfo(path, int64(size), entry), nil
 	case DIRECTORY:
 		var r *Reference
 		if path == "/" {
@@ -186,26 +351,88 @@ func (f *filesystem) Stat(path string) (os.FileInfo, error) {
 		if err != nil {
 			return nil, err
 		}
-		return fsFileInfo{
-			name: path2.Base(path),
-			isdir: true,
-			size: int64(EntrySize * len(entries)),
-		}, nil
+		return newFileInfo(path, int64(EntrySize * len(entries)), entry), nil
 	case SYMLINK:
 		link, err := ref.LookupSymLink(path2.Base(path))
 		if err != nil {
 			return nil, err
 		}
-		return fsFileInfo{
-			name: path2.Base(path),
-			isdir: false,
-			size: int64(len(link)),
-		}, nil
+		return newFileInfo(path, int64(len(link)), entry), nil
 	default:
 		return nil, errors.New("internal error: invalid stat result")
 	}
 }
 
+func (f *filesystem) Chmod(path string, mode os.FileMode) error {
+	return f.setAttributes(path, func(attributes *Attributes) {
+		attributes.Mode = mode & AttributeModeMask
+	})
+}
+
+func (f *filesystem) Chown(path string, uid int, gid int) error {
+	return f.setAttributes(path, func(attributes *Attributes) {
+		if uid >= 0 {
+			attributes.Uid = uint32(uid)
+		}
+		if gid >= 0 {
+			attributes.Gid = uint32(gid)
+		}
+	})
+}
+
+func (f *filesystem) Utimes(path string, atime time.Time, mtime time.Time) error {
+	return f.setAttributes(path, func(attributes *Attributes) {
+		if !atime.IsZero() {
+			attributes.Atime = atime
+		}
+		if !mtime.IsZero() {
+			attributes.Mtime = mtime
+		}
+	})
+}
+
+func (f *filesystem) setAttributes(path string, update func(*Attributes)) error {
+	if err := f.writable(path); err != nil {
+		return err
+	}
+	return retryConflicts(func() error {
+		if path == "/" {
+			root, err := f.t.Root()
+			if err != nil {
+				return err
+			}
+			defer root.Release()
+			return root.SetRootAttributes(update)
+		}
+		ref, err := f.t.PathDir(path2.Dir(path))
+		if err != nil {
+			return err
+		}
+		defer ref.Release()
+		return ref.SetAttributes(path2.Base(path), update)
+	})
+}
+
+func (f *filesystem) StatDir(path string) (DirInfo, error) {
+	ref, err := f.t.PathDir(path)
+	if err != nil {
+		return DirInfo{}, err
+	}
+	defer ref.Release()
+	entries, _, err := ref.listEntries()
+	if err != nil {
+		return DirInfo{}, err
+	}
+	size, err := ref.SubtreeSize()
+	if err != nil {
+		return DirInfo{}, err
+	}
+	return DirInfo{
+		Entries: len(entries),
+		Size:    size,
+	}, nil
+}
+
 func (f *filesystem) ReadLink(path string) (string, error) {
 	ref, err := f.t.PathDir(path2.Dir(path))
 	if err != nil {
@@ -236,7 +463,36 @@ func (f *filesystem) ListDir(path string) ([]string, error) {
 	return elements, nil
 }
 
-func (f *filesystem) Truncate(path string, length uint32) error {
+func (f *filesystem) ReadDir(path string, cursor uint64, limit int) ([]DirEntry, uint64, error) {
+	if limit <= 0 {
+		return nil, 0, fmt.Errorf("invalid limit on directory listing: %d", limit)
+	}
+	ref, err := f.t.PathDir(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer ref.Release()
+	// cursors are the slot to continue from, which starts at zero
+	entries, next, err := ref.listEntriesFrom(int(cursor), limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	result := make([]DirEntry, len(entries))
+	for i, entry := range entries {
+		result[i] = DirEntry{
+			Name:   entry.Name,
+			Type:   entry.Type,
+			Chunk:  entry.Chunk,
+			Cursor: uint64(entry.Index + 1),
+		}
+	}
+	return result, uint64(next), nil
+}
+
+func (f *filesystem) Truncate(path string, length uint64) error {
+	if err := f.writable(path); err != nil {
+		return err
+	}
 	ref, err := f.t.PathDir(path2.Dir(path))
 	if err != nil {
 		return err
@@ -260,50 +516,129 @@ func (f *filesystem) OpenRead(path string) (ReadOnlyFile, error) {
 	if err != nil {
 		return nil, err
 	}
+	// reading doesn't depend on the access time being updated, so failing to update it isn't worth failing over, and
+	// snapshots are left as they were taken
+	if !inSnapshots(path) {
+		now := time.Now()
+		_ = file.touch(func(attributes *Attributes) bool {
+			return attributes.accessed(now)
+		})
+	}
 	return &fileStream{
 		f: file,
+		window: f.readAhead,
+		bufferLimit: f.writeBuffer,
 	}, nil
 }
 
 // NOTE: closing file results is INCREDIBLY IMPORTANT
 func (f *filesystem) OpenWrite(path string, create bool, exclusive bool) (WritableFile, error) {
-	ref, err := f.t.PathDir(path2.Dir(path))
-	if err != nil {
+	if err := f.writable(path); err != nil {
 		return nil, err
 	}
-	defer ref.Release()
+	if exclusive && !create {
+		return nil, errors.New("mismatched exclusive/create options")
+	}
 	var file *File
-	if exclusive {
-		if !create {
-			return nil, errors.New("mismatched exclusive/create options")
-		}
-		err := ref.NewFile(path2.Base(path))
+	err := retryConflicts(func() error {
+		ref, err := f.t.PathDir(path2.Dir(path))
 		if err != nil {
-			return nil, err
+			return err
 		}
-		file, err = ref.LookupFile(path2.Base(path))
-		if err != nil {
-			return nil, err
+		defer ref.Release()
+		if create {
+			file, err = ref.OpenOrNewFile(path2.Base(path), exclusive)
+		} else {
+			file, err = ref.LookupFile(path2.Base(path))
 		}
-	} else {
-		file, err = ref.LookupFile(path2.Base(path))
-		if err != nil {
-			if create {
-				err2 := ref.NewFile(path2.Base(path))
-				if err2 != nil {
-					return nil, fmt.Errorf("two errors: %v -- and -- %v", err, err2)
-				}
-				file, err2 = ref.LookupFile(path2.Base(path))
-				if err2 != nil {
-					return nil, fmt.Errorf("two errors: %v -- and -- %v", err, err2)
-				}
-			} else {
-				return nil, err
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &fileStream{
+		f: file,
+		window: f.readAhead,
+		bufferLimit: f.writeBuffer,
+	}, nil
+}
+
+// Writes the whole file before it is linked into its directory, so that nobody can see it until it is complete. Its
+// chunks are unreachable until then, so nothing else can be using them, and they are deleted again if anything fails.
+func (f *filesystem) CreateAtomic(path string, data io.Reader) error {
+	if err := f.writable(path); err != nil {
+		return err
+	}
+	// don't bother writing anything if the link is certain to fail
+	if _, err := f.Stat(path); err == nil {
+		return fmt.Errorf("%w: %s", ErrExists, path)
+	}
+	chunk, err := f.t.newFileChunk()
+	if err != nil {
+		return err
+	}
+	unlocker, err := f.t.fs.ReadLockChunk(chunk)
+	if err != nil {
+		_ = f.t.client.Delete(chunk, apis.AnyVersion)
+		return err
+	}
+	file := &File{
+		t: *f.t,
+		chunk: chunk,
+		unlocker: unlocker,
+	}
+	err = file.writeFrom(data)
+	var parents []apis.ChunkNum
+	if err == nil {
+		err = retryConflicts(func() error {
+			ref, err := f.t.PathDir(path2.Dir(path))
+			if err != nil {
+				return err
 			}
+			defer ref.Release()
+			parents = ref.chain
+			return ref.LinkFile(path2.Base(path), chunk)
+		})
+	}
+	if err != nil {
+		// reclaim whatever was written, which nothing refers to
+		if rerr := file.releaseChunks(0, MaxFileChunks); rerr != nil {
+			err = fmt.Errorf("two errors: %v -- and -- %v", err, rerr)
+		} else if derr := f.t.client.Delete(chunk, apis.AnyVersion); derr != nil {
+			err = fmt.Errorf("two errors: %v -- and -- %v", err, derr)
 		}
+		file.Release()
+		return err
+	}
+	defer file.Release()
+	// the file wasn't in any directory while it was written, so its size only counts once it has been linked
+	size, err := f.t.nodeSize(Entry{Type: FILE, Chunk: chunk})
+	if err != nil {
+		return err
+	}
+	return f.t.addSize(parents, int64(size))
+}
+
+// Opens the contents of a chunk directly, bypassing directories and the layout of files entirely, for inspecting and
+// repairing chunks that nothing refers to any more. The chunk is locked as if it were a file while it is open.
+func (f *filesystem) OpenChunk(chunk apis.ChunkNum) (WritableFile, error) {
+	unlocker, err := f.t.fs.ReadLockChunk(chunk)
+	if err != nil {
+		return nil, err
+	}
+	// fail now, rather than on the first read or write, if the chunk doesn't exist
+	if _, _, err := f.t.client.Read(chunk, 0, 0); err != nil {
+		unlocker.Unlock()
+		return nil, err
 	}
 	return &fileStream{
-		f: file,
+		f: &chunkFile{
+			t: *f.t,
+			chunk: chunk,
+			unlocker: unlocker,
+		},
+		window: f.readAhead,
+		bufferLimit: f.writeBuffer,
 	}, nil
 }
 
@@ -326,6 +661,9 @@ type WritableFile interface {
 	io.Seeker
 	io.Closer
 	Truncate(uint64) error
+	// Writes out any writes that are being held to be written out together, reporting whether they succeeded. Close
+	// does the same.
+	Flush() error
 }
 
 type erroringWriter struct {
@@ -356,6 +694,11 @@ func (f erroringWriter) Truncate(len uint64) error {
 	return errors.New("not a writable file")
 }
 
+func (f erroringWriter) Flush() error {
+	// there can't be anything to write out
+	return nil
+}
+
 func (f erroringWriter) Seek(offset int64, whence int) (int64, error) {
 	return f.base.Seek(offset, whence)
 }
@@ -364,36 +707,161 @@ func (f erroringWriter) Close() error {
 	return f.base.Close()
 }
 
+// What a fileStream reads and writes: usually a File, but see OpenChunk.
+type streamContents interface {
+	Read(offset uint64, length uint64) ([]byte, error)
+	Write(offset uint64, data []byte) (uint64, error)
+	Truncate(nlength uint64) error
+	Size() (uint64, error)
+	Release()
+}
+
 type fileStream struct {
-	f      *File
+	f      streamContents
 	closed bool
-	head   uint32
+	head   uint64
+
+	// read-ahead state: 'buffered' holds data already fetched from 'head' onwards, and 'ahead' is fetching whatever
+	// comes after it. Both are only used once reads are sequential, which is when 'lastEnd' matches 'head'.
+	window   uint32
+	lastEnd  uint64
+	buffered []byte
+	ahead    *prefetch
+	fetching sync.WaitGroup
+
+	// write buffering state: 'pending' holds writes that continue one another, starting at 'pendingAt', that have not
+	// been written out yet. It is written out once it reaches 'bufferLimit', or before anything that would need to see it.
+	bufferLimit uint32
+	pending     []byte
+	pendingAt   uint64
+}
+
+type prefetch struct {
+	done chan struct{}
+	data []byte
+	err  error
 }
 
 var _ WritableFile = &fileStream{}
+var _ io.WriterTo = &fileStream{}
+
+func (f *fileStream) startPrefetch(offset uint64) *prefetch {
+	return f.startFetch(offset, uint64(f.window))
+}
+
+// Starts reading 'length' bytes from 'offset' in the background.
+func (f *fileStream) startFetch(offset uint64, length uint64) *prefetch {
+	p := &prefetch{done: make(chan struct{})}
+	f.fetching.Add(1)
+	go func() {
+		defer f.fetching.Done()
+		defer close(p.done)
+		p.data, p.err = f.f.Read(offset, length)
+	}()
+	return p
+}
+
+// Drops any data fetched ahead of the current position, such as after a seek or a write. A fetch still in progress
+// finishes in the background and its result is ignored.
+func (f *fileStream) discardReadAhead() {
+	f.buffered = nil
+	f.ahead = nil
+}
 
 func (f *fileStream) Read(p []byte) (n int, err error) {
 	if f.closed {
 		return 0, errors.New("file already closed")
 	}
-	data, err := f.f.Read(f.head, uint32(len(p)))
-	if err != nil {
+	if err := f.Flush(); err != nil {
 		return 0, err
 	}
-	if len(data) == 0 && len(p) > 0 {
-		return 0, io.EOF
+	if f.window == 0 || f.head != f.lastEnd {
+		f.discardReadAhead()
+		data, err := f.f.Read(f.head, uint64(len(p)))
+		if err != nil {
+			return 0, err
+		}
+		if len(data) == 0 && len(p) > 0 {
+			return 0, io.EOF
+		}
+		copy(p, data)
+		f.head += uint64(len(data))
+		f.lastEnd = f.head
+		return len(data), nil
 	}
-	copy(p, data)
-	f.head += uint32(len(data))
-	return len(data), nil
+	if len(f.buffered) == 0 {
+		if f.ahead == nil {
+			f.ahead = f.startPrefetch(f.head)
+		}
+		<-f.ahead.done
+		data, err := f.ahead.data, f.ahead.err
+		f.ahead = nil
+		if err != nil {
+			return 0, err
+		}
+		if len(data) == 0 && len(p) > 0 {
+			return 0, io.EOF
+		}
+		f.buffered = data
+		// a short read means that we reached the end of the file, so there's nothing more to fetch
+		if uint32(len(data)) == f.window {
+			f.ahead = f.startPrefetch(f.head + uint64(f.window))
+		}
+	}
+	n = copy(p, f.buffered)
+	f.buffered = f.buffered[n:]
+	f.head += uint64(n)
+	f.lastEnd = f.head
+	return n, nil
+}
+
+// Copies everything from the current position to the end of the file into w, which is how io.Copy reads a file. The
+// file is read a data chunk at a time, and the next one is fetched while the last is being written to w, whether or
+// not read-ahead is enabled, so that the copy keeps the chunkservers busy.
+func (f *fileStream) WriteTo(w io.Writer) (n int64, err error) {
+	if f.closed {
+		return 0, errors.New("file already closed")
+	}
+	if err := f.Flush(); err != nil {
+		return 0, err
+	}
+	f.discardReadAhead()
+	next := f.startFetch(f.head, FileChunkSize)
+	for next != nil {
+		<-next.done
+		data, err := next.data, next.err
+		if err != nil {
+			return n, err
+		}
+		// a short read means that we reached the end of the file, so there's nothing more to fetch
+		if uint64(len(data)) == FileChunkSize {
+			next = f.startFetch(f.head+FileChunkSize, FileChunkSize)
+		} else {
+			next = nil
+		}
+		written, err := w.Write(data)
+		n += int64(written)
+		f.head += uint64(written)
+		f.lastEnd = f.head
+		if err != nil {
+			// a fetch still in progress finishes in the background, and Close waits for it
+			return n, err
+		}
+	}
+	return n, nil
 }
 
 func (f *fileStream) ReadAt(p []byte, off int64) (n int, err error) {
 	if f.closed {
 		return 0, errors.New("file already closed")
 	}
-	// TODO: overflow checks
-	data, err := f.f.Read(uint32(off), uint32(len(p)))
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if err := f.Flush(); err != nil {
+		return 0, err
+	}
+	data, err := f.f.Read(uint64(off), uint64(len(p)))
 	if err != nil {
 		return 0, err
 	}
@@ -409,56 +877,119 @@ func (f *fileStream) Write(p []byte) (n int, err error) {
 	if f.closed {
 		return 0, errors.New("file already closed")
 	}
-	err = f.f.Write(f.head, p)
-	if err != nil {
-		return 0, err
-	}
-	f.head += uint32(len(p))
-	return len(p), nil
+	f.discardReadAhead()
+	written, err := f.write(f.head, p)
+	f.head += written
+	return shortWrite(int(written), len(p), err)
 }
 
 func (f *fileStream) WriteAt(p []byte, off int64) (n int, err error) {
 	if f.closed {
 		return 0, errors.New("file already closed")
 	}
-	// TODO: overflow checks
-	err = f.f.Write(uint32(off), p)
-	if err != nil {
-		return 0, err
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.discardReadAhead()
+	written, err := f.write(uint64(off), p)
+	return shortWrite(int(written), len(p), err)
+}
+
+// Writes 'p' at 'offset', or holds onto it to write out later along with the writes around it. Writes that are held
+// are reported as written in full.
+func (f *fileStream) write(offset uint64, p []byte) (uint64, error) {
+	if f.bufferLimit == 0 {
+		return f.f.Write(offset, p)
+	}
+	adjacent := offset == f.pendingAt+uint64(len(f.pending))
+	if !adjacent || len(f.pending)+len(p) > int(f.bufferLimit) {
+		if err := f.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	if len(p) >= int(f.bufferLimit) || offset+uint64(len(p)) > MaxFileSize {
+		// too big to be worth holding onto, or certain to fail, which should be reported right away
+		return f.f.Write(offset, p)
+	}
+	if len(f.pending) == 0 {
+		f.pendingAt = offset
+	}
+	f.pending = append(f.pending, p...)
+	return uint64(len(p)), nil
+}
+
+// Writes out any writes that are being held, so that they can be read back, and reports whether that succeeded. Held
+// writes that fail are dropped, so the error is only reported once.
+func (f *fileStream) Flush() error {
+	if len(f.pending) == 0 {
+		return nil
 	}
-	return len(p), nil
+	pending, at := f.pending, f.pendingAt
+	f.pending = nil
+	written, err := f.f.Write(at, pending)
+	_, err = shortWrite(int(written), len(pending), err)
+	return err
+}
+
+// Ensures that a write reporting fewer than expected bytes also reports an error, as io.Writer and io.WriterAt require.
+func shortWrite(written int, expected int, err error) (int, error) {
+	if err == nil && written < expected {
+		err = io.ErrShortWrite
+	}
+	return written, err
 }
 
 func (f *fileStream) Seek(offset int64, whence int) (int64, error) {
 	if f.closed {
 		return 0, errors.New("file already closed")
 	}
-	var nhead uint32
-	// TODO: handle overflow
+	var base int64
 	if whence == io.SeekStart {
-		nhead = uint32(offset)
+		base = 0
 	} else if whence == io.SeekCurrent {
-		nhead = uint32(int64(f.head) + offset)
+		base = int64(f.head)
 	} else if whence == io.SeekEnd {
+		if err := f.Flush(); err != nil {
+			return 0, err
+		}
 		size, err := f.f.Size()
 		if err != nil {
 			return 0, err
 		}
-		nhead = uint32(int64(size) + offset)
+		base = int64(size)
+	} else {
+		return 0, errors.New("invalid whence")
+	}
+	// every position and size is at most MaxFileSize, so only a huge offset can overflow
+	if (offset > 0 && base > math.MaxInt64-offset) || base+offset < 0 {
+		return 0, errors.New("seek out of range")
+	}
+	nhead := uint64(base + offset)
+	if nhead != f.head {
+		f.discardReadAhead()
 	}
 	f.head = nhead
 	return int64(nhead), nil
 }
 
 func (f *fileStream) Truncate(len uint64) error {
-	// TODO: handle overflow
-	return f.f.Truncate(uint32(len))
+	f.discardReadAhead()
+	if err := f.Flush(); err != nil {
+		return err
+	}
+	return f.f.Truncate(len)
 }
 
+// Writes out any held writes, and releases the file, even if they could not be written.
 func (f *fileStream) Close() error {
-	if !f.closed {
-		f.f.Release()
-		f.closed = true
-	}
-	return nil
+	if f.closed {
+		return nil
+	}
+	err := f.Flush()
+	f.discardReadAhead()
+	// the file must stay locked until nothing is reading from it
+	f.fetching.Wait()
+	f.f.Release()
+	f.closed = true
+	return err
 }
@@ -1,7 +1,22 @@
 package filesystem
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"zircon/lib/apis"
+	"zircon/lib/audit"
 	"zircon/lib/client"
 	"zircon/lib/filesystem/syncserver"
 	"zircon/lib/rpc"
@@ -42,7 +57,7 @@ func ConstructFilesystemTestCluster(t *testing.T) (new func() Filesystem, teardo
 		fs, err := NewFilesystemClient(config)
 		require.NoError(t, err)
 		return fs
-	}, teardowns.Teardown
+	}, teardowns.TeardownReverse
 }
 
 func TestSimpleOperations(t *testing.T) {
@@ -92,3 +107,2201 @@ func TestSimpleOperations(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []string{"log.txt"}, contents)
 }
+
+// Tests that a write whose final step fails reports only the bytes that actually landed, and that a write extending
+// past the maximum file size is reported as short.
+func TestWriteAtShortWrite(t *testing.T) {
+	fs, client := ConstructMemoryFilesystem()
+
+	f, err := fs.OpenWrite("/data", true, true)
+	require.NoError(t, err)
+	defer f.Close()
+
+	n, err := f.WriteAt([]byte("hello, world!"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 13, n)
+
+	// fail the length update, so that only the overwritten portion is visible
+	client.failWrite = func(chunk apis.ChunkNum, offset uint32, data []byte) error {
+		if offset == fileHeaderSize {
+			return errors.New("injected failure")
+		}
+		return nil
+	}
+	n, err = f.WriteAt([]byte("earth and more"), 7)
+	assert.Error(t, err)
+	assert.Equal(t, 6, n)
+	client.failWrite = nil
+
+	contents := make([]byte, 32)
+	n, err = f.ReadAt(contents, 0)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "hello, earth ", string(contents[:n]))
+
+	n, err = f.WriteAt([]byte("overflow"), int64(MaxFileSize-3))
+	assert.Error(t, err)
+	assert.Equal(t, 3, n)
+
+	n, err = f.Write(make([]byte, 10))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+}
+
+// Tests that a write spanning a chunk boundary reports only the first chunk's worth of data if the second chunk fails.
+func TestWriteAtCrossChunkFailure(t *testing.T) {
+	fs, client := ConstructMemoryFilesystem()
+
+	f, err := fs.OpenWrite("/data", true, true)
+	require.NoError(t, err)
+	defer f.Close()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	client.failWrite = func(chunk apis.ChunkNum, offset uint32, data []byte) error {
+		// the only data write landing at the start of a chunk is the one to the second chunk
+		if offset == 0 && len(data) > 8 {
+			return errors.New("injected failure")
+		}
+		return nil
+	}
+	n, err := f.WriteAt(data, FileChunkSize-1000)
+	assert.Error(t, err)
+	assert.Equal(t, 1000, n)
+	client.failWrite = nil
+
+	info, err := fs.Stat("/data")
+	require.NoError(t, err)
+	assert.Equal(t, int64(FileChunkSize), info.Size())
+
+	readback := make([]byte, 1000)
+	n, err = f.ReadAt(readback, FileChunkSize-1000)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, n)
+	assert.Equal(t, data[:1000], readback)
+}
+
+// Tests that files whose contents end in zero bytes keep their exact size, whether those zeroes were written directly,
+// added by extending the file, or fall just past a chunk boundary.
+func TestTrailingZeroes(t *testing.T) {
+	fs, _ := ConstructMemoryFilesystem()
+
+	expectContents := func(path string, expected []byte) {
+		info, err := fs.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(expected)), info.Size())
+		r, err := fs.OpenRead(path)
+		require.NoError(t, err)
+		contents, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Close())
+		assert.True(t, bytes.Equal(expected, contents), "contents of %s do not match", path)
+	}
+
+	f, err := fs.OpenWrite("/padded", true, true)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("data\x00\x00\x00"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	expectContents("/padded", []byte("data\x00\x00\x00"))
+
+	f, err = fs.OpenWrite("/zeroes", true, true)
+	require.NoError(t, err)
+	_, err = f.Write(make([]byte, 10))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	expectContents("/zeroes", make([]byte, 10))
+
+	assert.NoError(t, fs.Truncate("/padded", 20))
+	expectContents("/padded", append([]byte("data"), make([]byte, 16)...))
+
+	f, err = fs.OpenWrite("/boundary", true, true)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{1, 0, 0, 0}, FileChunkSize-2)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	expected := make([]byte, FileChunkSize+2)
+	expected[FileChunkSize-2] = 1
+	expectContents("/boundary", expected)
+}
+
+// Tests writing and reading back a file that spans several chunks, both in one piece and in smaller unaligned pieces.
+func TestLargeFile(t *testing.T) {
+	fs, client := ConstructMemoryFilesystem()
+
+	data := make([]byte, 20*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	f, err := fs.OpenWrite("/large", true, true)
+	require.NoError(t, err)
+	n, err := f.Write(data)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	assert.NoError(t, f.Close())
+
+	info, err := fs.Stat("/large")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size())
+
+	r, err := fs.OpenRead("/large")
+	require.NoError(t, err)
+	contents, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, contents))
+
+	// read across the first chunk boundary
+	across := make([]byte, 4096)
+	n, err = r.ReadAt(across, FileChunkSize-2048)
+	assert.NoError(t, err)
+	assert.Equal(t, 4096, n)
+	assert.True(t, bytes.Equal(data[FileChunkSize-2048:FileChunkSize+2048], across))
+	assert.NoError(t, r.Close())
+
+	// overwrite in unaligned pieces, including one that extends the file
+	w, err := fs.OpenWrite("/large", false, false)
+	require.NoError(t, err)
+	piece := bytes.Repeat([]byte{0xAB}, 3*1024*1024+17)
+	for offset := int64(1234567); offset < int64(len(data)); offset += int64(len(piece)) {
+		n, err := w.WriteAt(piece, offset)
+		assert.NoError(t, err)
+		assert.Equal(t, len(piece), n)
+		copy(data[offset:], piece)
+		if end := offset + int64(len(piece)); end > int64(len(data)) {
+			data = append(data, piece[int64(len(piece))-(end-int64(len(data))):]...)
+		}
+	}
+	assert.NoError(t, w.Close())
+
+	r, err = fs.OpenRead("/large")
+	require.NoError(t, err)
+	contents, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), len(contents))
+	assert.True(t, bytes.Equal(data, contents))
+	assert.NoError(t, r.Close())
+
+	// removing the file releases all of its chunks
+	assert.NoError(t, fs.Unlink("/large"))
+	assert.Equal(t, 1, len(client.chunks))
+}
+
+// Tests that file chunks carry a header, that files from before there was an index are converted to the current layout
+// with their contents intact, and that files in a layout this version doesn't know are refused without changing
+// anything.
+func TestFileFormat(t *testing.T) {
+	fs, client := ConstructMemoryFilesystem()
+	traverser, err := fs.GetTraverser()
+	require.NoError(t, err)
+
+	fileChunk := func(path string) apis.ChunkNum {
+		f, err := fs.OpenWrite(path, true, true)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		ref, err := traverser.PathDir("/")
+		require.NoError(t, err)
+		defer ref.Release()
+		entry, _, err := ref.lookupEntryAny(path[1:])
+		require.NoError(t, err)
+		return entry.Chunk
+	}
+	// overwrites everything that the file chunk holds so far
+	replace := func(chunk apis.ChunkNum, contents []byte) {
+		_, err := client.Write(chunk, 0, apis.AnyVersion, append(contents, make([]byte, 64)...))
+		require.NoError(t, err)
+	}
+
+	empty := fileChunk("/empty")
+	header, _, err := client.Read(empty, 0, fileHeaderSize)
+	require.NoError(t, err)
+	assert.Equal(t, "ZIRF\x01\x00\x00\x00", string(header))
+
+	// truncated to nothing, with its old contents still after the length
+	replace(empty, []byte("\x00\x00\x00\x00stale contents"))
+	info, err := fs.Stat("/empty")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	header, _, err = client.Read(empty, 0, indexEntryOffset(4))
+	require.NoError(t, err)
+	assert.Equal(t, encodeFileHeader(0), header[:indexEntryOffset(0)])
+	assert.Equal(t, make([]byte, 32), header[indexEntryOffset(0):])
+	f, err := fs.OpenWrite("/empty", false, false)
+	require.NoError(t, err)
+	_, err = f.Write(make([]byte, 10))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	// ending in zeroes, which still count towards its size, followed by what an earlier truncation left behind
+	legacy := fileChunk("/legacy")
+	replace(legacy, []byte("\x07\x00\x00\x00hello\x00\x00stale"))
+	chunks := len(client.chunks)
+	info, err = fs.Stat("/legacy")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), info.Size())
+	assert.Equal(t, chunks+1, len(client.chunks))
+	header, _, err = client.Read(legacy, 0, indexEntryOffset(4))
+	require.NoError(t, err)
+	assert.Equal(t, encodeFileHeader(7), header[:indexEntryOffset(0)])
+	assert.NotZero(t, binary.LittleEndian.Uint64(header[indexEntryOffset(0):]))
+	assert.Equal(t, make([]byte, 24), header[indexEntryOffset(1):])
+	r, err := fs.OpenRead("/legacy")
+	require.NoError(t, err)
+	contents, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\x00\x00", string(contents))
+	assert.NoError(t, r.Close())
+	// converted only once
+	info, err = fs.Stat("/legacy")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), info.Size())
+	assert.Equal(t, chunks+1, len(client.chunks))
+	assert.NoError(t, fs.Unlink("/legacy"))
+	assert.Equal(t, chunks-1, len(client.chunks))
+
+	future := fileChunk("/future")
+	replace(future, []byte("ZIRF\x02\x00\x00\x00\x05\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00"))
+	chunks = len(client.chunks)
+	_, err = fs.Stat("/future")
+	assert.True(t, errors.Is(err, ErrFileFormat), "stat: %v", err)
+	r, err = fs.OpenRead("/future")
+	require.NoError(t, err)
+	_, err = r.Read(make([]byte, 5))
+	assert.True(t, errors.Is(err, ErrFileFormat), "read: %v", err)
+	assert.NoError(t, r.Close())
+	assert.True(t, errors.Is(fs.Truncate("/future", 0), ErrFileFormat))
+	assert.True(t, errors.Is(fs.Unlink("/future"), ErrFileFormat))
+	// in particular, nothing in its index was taken for chunk numbers to delete
+	assert.Equal(t, chunks, len(client.chunks))
+}
+
+// Tests that offsets and sizes past 4GB are neither truncated nor wrapped around, whether they come from a write, a seek,
+// or a truncation.
+func TestLargeOffsets(t *testing.T) {
+	fs, client := ConstructMemoryFilesystem()
+
+	const far = int64(5) << 30
+	f, err := fs.OpenWrite("/far", true, true)
+	require.NoError(t, err)
+	n, err := f.WriteAt([]byte("beyond"), far)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+
+	info, err := fs.Stat("/far")
+	require.NoError(t, err)
+	assert.Equal(t, far+6, info.Size())
+	// only the data chunk that was written to exists; the rest of the file is holes
+	assert.Equal(t, 3, len(client.chunks))
+
+	end, err := f.Seek(-6, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, far, end)
+	contents := make([]byte, 16)
+	n, err = f.Read(contents)
+	assert.NoError(t, err)
+	assert.Equal(t, "beyond", string(contents[:n]))
+
+	n, err = f.ReadAt(contents[:4], far-2)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 'b', 'e'}, contents[:4])
+
+	_, err = f.Seek(-far-7, io.SeekEnd)
+	assert.Error(t, err)
+
+	require.NoError(t, f.Truncate(uint64(far+2)))
+	info, err = fs.Stat("/far")
+	require.NoError(t, err)
+	assert.Equal(t, far+2, info.Size())
+	require.NoError(t, f.Truncate(1<<32))
+	assert.Equal(t, 2, len(client.chunks))
+	assert.NoError(t, f.Close())
+
+	assert.Error(t, fs.Truncate("/far", MaxFileSize+1))
+	dir, err := fs.StatDir("/")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1<<32), dir.Size)
+}
+
+// Tests that a file written as a stream, without regard for chunk boundaries, gets as many data chunks as it needs.
+func TestStreamAcrossChunks(t *testing.T) {
+	fs, client := ConstructMemoryFilesystem()
+
+	const size = 100 * 1024 * 1024
+	f, err := fs.OpenWrite("/stream", true, true)
+	require.NoError(t, err)
+	n, err := io.Copy(f, io.LimitReader(rand.New(rand.NewSource(2)), size))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(size), n)
+	assert.NoError(t, f.Close())
+
+	// the root, the file's index, and its data
+	assert.Equal(t, 2+(size+FileChunkSize-1)/FileChunkSize, len(client.chunks))
+
+	r, err := fs.OpenRead("/stream")
+	require.NoError(t, err)
+	expected := io.LimitReader(rand.New(rand.NewSource(2)), size)
+	buffer, compare := make([]byte, 1024*1024), make([]byte, 1024*1024)
+	for total := 0; total < size; {
+		n, err := io.ReadFull(r, buffer)
+		require.NoError(t, err)
+		_, err = io.ReadFull(expected, compare[:n])
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(compare[:n], buffer[:n]), "mismatch in the %d bytes at %d", n, total)
+		total += n
+	}
+	n2, err := r.Read(buffer)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, n2)
+	assert.NoError(t, r.Close())
+}
+
+// Tests that writers racing to fill in the same missing data chunks end up sharing them, rather than each allocating
+// its own and losing the others' data.
+func TestConcurrentChunkAllocation(t *testing.T) {
+	fs, client := ConstructMemoryFilesystem()
+
+	const chunks = 3
+	const pieces = 24
+	f, err := fs.OpenWrite("/sparse", true, true)
+	require.NoError(t, err)
+	// leaves the file as holes, so that every piece has to find or allocate its chunk
+	require.NoError(t, f.Truncate(chunks*FileChunkSize))
+	require.NoError(t, f.Close())
+
+	data := make([]byte, chunks*FileChunkSize)
+	rand.New(rand.NewSource(3)).Read(data)
+	pieceSize := len(data) / pieces
+	wg := sync.WaitGroup{}
+	for i := 0; i < pieces; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w, err := fs.OpenWrite("/sparse", false, false)
+			if !assert.NoError(t, err) {
+				return
+			}
+			_, err = w.WriteAt(data[i*pieceSize:(i+1)*pieceSize], int64(i*pieceSize))
+			assert.NoError(t, err)
+			assert.NoError(t, w.Close())
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 2+chunks, len(client.chunks))
+	r, err := fs.OpenRead("/sparse")
+	require.NoError(t, err)
+	contents, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, contents))
+	assert.NoError(t, r.Close())
+}
+
+// Hands out data a little at a time, so that a reader has a chance to look at the file while it is being created.
+type trickleReader struct {
+	data  []byte
+	fail  error
+	delay time.Duration
+}
+
+func (r *trickleReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	if len(r.data) == 0 {
+		if r.fail != nil {
+			return 0, r.fail
+		}
+		return 0, io.EOF
+	}
+	if len(p) > 1024*1024 {
+		p = p[:1024*1024]
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// Tests that a file created with CreateAtomic can't be seen until all of its contents can be, and that a failed create
+// leaves nothing behind.
+func TestCreateAtomic(t *testing.T) {
+	fs, client := ConstructMemoryFilesystem()
+
+	data := make([]byte, 2*FileChunkSize+12345)
+	rand.New(rand.NewSource(4)).Read(data)
+
+	done := make(chan struct{})
+	observed := make(chan bool)
+	go func() {
+		seen := false
+		for {
+			select {
+			case <-done:
+				observed <- seen
+				return
+			default:
+			}
+			info, err := fs.Stat("/atomic")
+			if err != nil {
+				continue
+			}
+			seen = true
+			assert.Equal(t, int64(len(data)), info.Size())
+		}
+	}()
+	err := fs.CreateAtomic("/atomic", &trickleReader{data: data, delay: time.Millisecond})
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	assert.True(t, <-observed, "the poller never saw the file")
+
+	r, err := fs.OpenRead("/atomic")
+	require.NoError(t, err)
+	contents, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, contents))
+	assert.NoError(t, r.Close())
+
+	// the path is already taken
+	err = fs.CreateAtomic("/atomic", bytes.NewReader([]byte("other")))
+	assert.True(t, errors.Is(err, ErrExists))
+
+	// a failure partway through reclaims the chunks already written
+	before := len(client.chunks)
+	failure := errors.New("source went away")
+	err = fs.CreateAtomic("/broken", &trickleReader{data: data, fail: failure})
+	assert.True(t, errors.Is(err, failure))
+	_, err = fs.Stat("/broken")
+	assert.Error(t, err)
+	assert.Equal(t, before, len(client.chunks))
+}
+
+// Cancels a context once a certain number of bytes have been read, as if the user gave up partway through an upload.
+type cancellingReader struct {
+	data   []byte
+	after  int
+	cancel func()
+	read   int
+}
+
+func (r *cancellingReader) ReadAt(p []byte, off int64) (int, error) {
+	if r.read += len(p); r.read >= r.after {
+		r.cancel()
+	}
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+// Tests that a cancelled upload leaves a prefix of the contents behind, and that resuming it only rewrites what is
+// missing or no longer matches the source.
+func TestUploadResume(t *testing.T) {
+	fs, _ := ConstructMemoryFilesystem()
+
+	data := make([]byte, 4*FileChunkSize+12345)
+	rand.New(rand.NewSource(5)).Read(data)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := fs.Upload(ctx, "/large", &cancellingReader{data: data, after: len(data) / 2, cancel: cancel})
+	assert.True(t, errors.Is(err, context.Canceled), "unexpected error: %v", err)
+
+	// what was written before the cancellation is intact, and ends on a data chunk boundary
+	r, err := fs.OpenRead("/large")
+	require.NoError(t, err)
+	partial, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.True(t, len(partial) > 0 && len(partial) < len(data), "unexpected length %d", len(partial))
+	assert.Equal(t, 0, len(partial)%FileChunkSize)
+	assert.True(t, bytes.Equal(data[:len(partial)], partial))
+
+	// the same path can't be uploaded to again
+	err = fs.Upload(context.Background(), "/large", bytes.NewReader(data))
+	assert.True(t, errors.Is(err, ErrExists))
+
+	// a region that was already uploaded has changed at the source, so it has to be sent again
+	copy(data[100:], "changed since the upload started")
+	require.NoError(t, fs.Resume("/large", bytes.NewReader(data)))
+
+	r, err = fs.OpenRead("/large")
+	require.NoError(t, err)
+	contents, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.True(t, bytes.Equal(data, contents))
+
+	// resuming against a shorter source cuts the file down to match
+	require.NoError(t, fs.Resume("/large", bytes.NewReader(data[:FileChunkSize+7])))
+	info, err := fs.Stat("/large")
+	require.NoError(t, err)
+	assert.Equal(t, int64(FileChunkSize+7), info.Size())
+
+	assert.Error(t, fs.Resume("/missing", bytes.NewReader(data)))
+}
+
+func writeFile(t *testing.T, fs Filesystem, path string, offset int64, length int) {
+	f, err := fs.OpenWrite(path, true, false)
+	require.NoError(t, err)
+	n, err := f.WriteAt(make([]byte, length), offset)
+	require.NoError(t, err)
+	require.Equal(t, length, n)
+	require.NoError(t, f.Close())
+}
+
+func assertDirInfo(t *testing.T, fs Filesystem, path string, entries int, size uint64) {
+	info, err := fs.StatDir(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, DirInfo{Entries: entries, Size: size}, info, "for %s", path)
+	}
+}
+
+// Tests that StatDir counts the entries directly in a directory, and that the size it reports for the subtree follows
+// every kind of change made anywhere below it.
+func TestStatDir(t *testing.T) {
+	fs, _ := ConstructMemoryFilesystem()
+
+	require.NoError(t, fs.Mkdir("/a"))
+	require.NoError(t, fs.Mkdir("/a/b"))
+	writeFile(t, fs, "/a/x", 0, 100)
+	writeFile(t, fs, "/a/b/y", 0, 2000)
+	require.NoError(t, fs.SymLink("/a/b/link", "/a/x"))
+	writeFile(t, fs, "/top", 0, 50)
+
+	assertDirInfo(t, fs, "/", 2, 2150)
+	assertDirInfo(t, fs, "/a", 2, 2100)
+	assertDirInfo(t, fs, "/a/b", 2, 2000)
+
+	// shrinking and growing
+	require.NoError(t, fs.Truncate("/a/b/y", 500))
+	writeFile(t, fs, "/a/x", 900, 100)
+	assertDirInfo(t, fs, "/a/b", 2, 500)
+	assertDirInfo(t, fs, "/a", 2, 1500)
+	assertDirInfo(t, fs, "/", 2, 1550)
+
+	// a move only affects the directories that the subtree left or joined
+	require.NoError(t, fs.Rename("/a/b", "/c"))
+	assertDirInfo(t, fs, "/a", 1, 1000)
+	assertDirInfo(t, fs, "/c", 2, 500)
+	assertDirInfo(t, fs, "/", 3, 1550)
+
+	require.NoError(t, fs.Unlink("/a/x"))
+	require.NoError(t, fs.CreateAtomic("/c/z", bytes.NewReader(make([]byte, 300))))
+	assertDirInfo(t, fs, "/a", 0, 0)
+	assertDirInfo(t, fs, "/c", 3, 800)
+	assertDirInfo(t, fs, "/", 3, 850)
+
+	_, err := fs.StatDir("/top")
+	assert.Error(t, err)
+}
+
+// Tests that a directory grows past a single chunk once it fills up, and that ReadDir lists it a part at a time.
+func TestLargeDirectory(t *testing.T) {
+	fs, client := ConstructMemoryFilesystem()
+	require.NoError(t, fs.Mkdir("/big"))
+	require.NoError(t, fs.SymLink("/target", "/nowhere"))
+	info, err := fs.Stat("/big")
+	require.NoError(t, err)
+	dir := info.Sys().(NodeInfo).Chunk
+	info, err = fs.Stat("/target")
+	require.NoError(t, err)
+	target := info.Sys().(NodeInfo).Chunk
+
+	// filling a whole chunk through the filesystem would take too long, so fill it in directly
+	page := make([]byte, EntryCount*EntrySize)
+	for i := 0; i < EntryCount; i++ {
+		entry := Entry{Type: SYMLINK, Name: fmt.Sprintf("filler%d", i), Chunk: target, Attributes: DefaultAttributes(SYMLINK)}
+		data, err := entry.encode()
+		require.NoError(t, err)
+		copy(page[i*EntrySize:], data)
+	}
+	_, err = client.Write(dir, 0, apis.AnyVersion, page)
+	require.NoError(t, err)
+
+	require.NoError(t, fs.Mkdir("/big/sub"))
+	writeFile(t, fs, "/big/file", 0, 100)
+	require.NoError(t, fs.Rename("/big/file", "/big/renamed"))
+	names, err := fs.ListDir("/big")
+	require.NoError(t, err)
+	assert.Len(t, names, EntryCount+2)
+	assert.Equal(t, []string{"sub", "renamed"}, names[EntryCount:])
+	assertDirInfo(t, fs, "/big", EntryCount+2, 100)
+	data, _, err := client.Read(dir, nextPageOffset, 8)
+	require.NoError(t, err)
+	second := apis.ChunkNum(binary.LittleEndian.Uint64(data))
+	assert.NotZero(t, second)
+
+	// a slot freed in the first chunk is used again before anything else
+	require.NoError(t, fs.Rename("/big/filler10", "/moved"))
+	require.NoError(t, fs.Mkdir("/big/again"))
+	names, err = fs.ListDir("/big")
+	require.NoError(t, err)
+	assert.Equal(t, "again", names[10])
+
+	listed := map[string]bool{}
+	var cursor uint64
+	for calls := 0; ; calls++ {
+		require.True(t, calls < EntryCount)
+		entries, next, err := fs.ReadDir("/big", cursor, 1000)
+		require.NoError(t, err)
+		assert.True(t, len(entries) <= 1000)
+		for _, entry := range entries {
+			assert.False(t, listed[entry.Name], entry.Name)
+			listed[entry.Name] = true
+		}
+		if cursor == 0 {
+			// removing a node that was already listed doesn't disturb the rest of the listing
+			require.NoError(t, fs.Rmdir("/big/again"))
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	assert.Len(t, listed, EntryCount+2)
+	assert.True(t, listed["sub"])
+	assert.True(t, listed["renamed"])
+	assert.True(t, listed["again"])
+	_, _, err = fs.ReadDir("/big", 0, 0)
+	assert.Error(t, err)
+
+	// the extra chunk goes along with the directory
+	_, err = client.Write(dir, 0, apis.AnyVersion, make([]byte, EntryCount*EntrySize))
+	require.NoError(t, err)
+	require.NoError(t, fs.Rmdir("/big/sub"))
+	require.NoError(t, fs.Unlink("/big/renamed"))
+	entries, next, err := fs.ReadDir("/big", 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Zero(t, next)
+	require.NoError(t, fs.Rmdir("/big"))
+	_, _, err = client.Read(second, 0, 0)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+}
+
+// Tests that a chunk created through the client, outside of any directory, can be opened by number and read and written
+// up to the size of a chunk, but no further.
+func TestOpenChunk(t *testing.T) {
+	fs, client := ConstructMemoryFilesystem()
+
+	chunk, err := client.New()
+	require.NoError(t, err)
+	_, err = client.Write(chunk, 0, apis.AnyVersion, []byte("orphaned data"))
+	require.NoError(t, err)
+
+	f, err := fs.OpenChunk(chunk)
+	require.NoError(t, err)
+	buf := make([]byte, 13)
+	_, err = io.ReadFull(f, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "orphaned data", string(buf))
+
+	end, err := f.Seek(0, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(apis.MaxChunkSize), end)
+	n, err := f.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, n)
+
+	n, err = f.WriteAt([]byte("repaired"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, n)
+	// only the part that fits in the chunk is written
+	n, err = f.WriteAt([]byte("overflowing"), apis.MaxChunkSize-4)
+	assert.True(t, errors.Is(err, apis.ErrChunkTooLarge))
+	assert.Equal(t, 4, n)
+	data, _, err := client.Read(chunk, 0, 16)
+	assert.NoError(t, err)
+	assert.Equal(t, "repaired data\x00\x00\x00", string(data))
+	data, _, err = client.Read(chunk, apis.MaxChunkSize-4, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, "over", string(data))
+
+	// truncating clears the rest of the chunk, since it can't get any shorter
+	assert.NoError(t, f.Truncate(3))
+	n, err = f.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 13, n)
+	assert.Equal(t, "rep\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00", string(buf))
+	assert.Error(t, f.Truncate(apis.MaxChunkSize+1))
+	assert.NoError(t, f.Close())
+
+	_, err = fs.OpenChunk(chunk + 1000)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+}
+
+// Collects a description of every node under a directory, for comparing trees.
+func describeTree(t *testing.T, fs Filesystem, path string) map[string]string {
+	result := map[string]string{}
+	names, err := fs.ListDir(path)
+	require.NoError(t, err)
+	for _, name := range names {
+		child := path + "/" + name
+		info, err := fs.Stat(child)
+		require.NoError(t, err)
+		if link, err := fs.ReadLink(child); err == nil {
+			result[name] = "link:" + link
+		} else if info.IsDir() {
+			result[name] = "dir"
+			for subname, desc := range describeTree(t, fs, child) {
+				result[name+"/"+subname] = desc
+			}
+		} else {
+			f, err := fs.OpenRead(child)
+			require.NoError(t, err)
+			contents, err := ioutil.ReadAll(f)
+			require.NoError(t, err)
+			assert.NoError(t, f.Close())
+			result[name] = "file:" + string(contents)
+		}
+	}
+	return result
+}
+
+// Tests that a subtree can be exported, wiped, and imported again, both in place and into another filesystem.
+func TestExportImport(t *testing.T) {
+	fs, _ := ConstructMemoryFilesystem()
+
+	require.NoError(t, fs.Mkdir("/src"))
+	require.NoError(t, fs.Mkdir("/src/sub"))
+	require.NoError(t, fs.Mkdir("/src/empty"))
+	require.NoError(t, fs.SymLink("/src/link", "../elsewhere/a.txt"))
+	large := bytes.Repeat([]byte("large file contents "), FileChunkSize/10)
+	for name, contents := range map[string][]byte{"/src/a.txt": []byte("hello, world!\n"), "/src/sub/large": large, "/src/sub/empty": nil} {
+		f, err := fs.OpenWrite(name, true, true)
+		require.NoError(t, err)
+		_, err = f.Write(contents)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	before := describeTree(t, fs, "/src")
+	assert.Equal(t, "link:../elsewhere/a.txt", before["link"])
+	assert.Equal(t, 6, len(before))
+
+	var archive bytes.Buffer
+	require.NoError(t, fs.Export("/src", &archive))
+
+	// wipe the original tree
+	for _, name := range []string{"/src/a.txt", "/src/link", "/src/sub/large", "/src/sub/empty"} {
+		require.NoError(t, fs.Unlink(name))
+	}
+	require.NoError(t, fs.Rmdir("/src/sub"))
+	require.NoError(t, fs.Rmdir("/src/empty"))
+	require.NoError(t, fs.Rmdir("/src"))
+
+	require.NoError(t, fs.Import("/src", bytes.NewReader(archive.Bytes())))
+	assert.Equal(t, before, describeTree(t, fs, "/src"))
+
+	other, _ := ConstructMemoryFilesystem()
+	require.NoError(t, other.Import("/restored", bytes.NewReader(archive.Bytes())))
+	assert.Equal(t, before, describeTree(t, other, "/restored"))
+
+	// importing over an existing tree should not clobber anything
+	assert.Error(t, fs.Import("/src", bytes.NewReader(archive.Bytes())))
+}
+
+// Tests that clients racing to create the same file all end up with that one file, and that when the creation is
+// exclusive, exactly one of them succeeds and the rest see ErrExists.
+func TestOpenWriteCreateRace(t *testing.T) {
+	fs, _ := ConstructMemoryFilesystem()
+	require.NoError(t, fs.Mkdir("/race"))
+
+	for i := 0; i < 20; i++ {
+		for _, exclusive := range []bool{false, true} {
+			path := fmt.Sprintf("/race/file-%d-%v", i, exclusive)
+			start := make(chan struct{})
+			files := make([]WritableFile, 2)
+			errs := make([]error, 2)
+			var wg sync.WaitGroup
+			for j := range files {
+				wg.Add(1)
+				go func(j int) {
+					defer wg.Done()
+					<-start
+					files[j], errs[j] = fs.OpenWrite(path, true, exclusive)
+				}(j)
+			}
+			close(start)
+			wg.Wait()
+
+			if exclusive {
+				if errs[0] == nil {
+					assert.True(t, errors.Is(errs[1], ErrExists), "unexpected error: %v", errs[1])
+				} else {
+					assert.True(t, errors.Is(errs[0], ErrExists), "unexpected error: %v", errs[0])
+					assert.NoError(t, errs[1])
+				}
+			} else if assert.NoError(t, errs[0]) && assert.NoError(t, errs[1]) {
+				assert.Equal(t, files[0].(*fileStream).f.(*File).chunk, files[1].(*fileStream).f.(*File).chunk)
+			}
+			for j, file := range files {
+				if errs[j] == nil {
+					assert.NoError(t, file.Close())
+				}
+			}
+		}
+	}
+
+	names, err := fs.ListDir("/race")
+	require.NoError(t, err)
+	assert.Len(t, names, 40)
+}
+
+// A SyncServer that enforces locks in memory, following the same rules as the etcd implementation: new readers wait out
+// any writer or pending elevation, and an elevation that finds one already in progress fails with ErrLockContended.
+type lockingSync struct {
+	permissiveSync
+	lmu    sync.Mutex
+	cond   *sync.Cond
+	locks  map[apis.ChunkNum]*chunkLock
+	chunks map[apis.SyncID]apis.ChunkNum
+	lastID apis.SyncID
+	// for AwaitRelease: the revision of the last write lock released on each chunk, and a channel that is closed and
+	// replaced on every such release
+	revisions    map[apis.ChunkNum]apis.SyncRevision
+	lastRevision apis.SyncRevision
+	released     chan struct{}
+}
+
+type chunkLock struct {
+	writer  apis.SyncID
+	pending bool
+	readers map[apis.SyncID]bool
+}
+
+func newLockingSync(client apis.Client) *lockingSync {
+	l := &lockingSync{
+		permissiveSync: permissiveSync{client: client},
+		locks:          map[apis.ChunkNum]*chunkLock{},
+		chunks:         map[apis.SyncID]apis.ChunkNum{},
+		revisions:      map[apis.ChunkNum]apis.SyncRevision{},
+		released:       make(chan struct{}),
+	}
+	l.cond = sync.NewCond(&l.lmu)
+	return l
+}
+
+func (l *lockingSync) lockFor(chunk apis.ChunkNum) *chunkLock {
+	lock, found := l.locks[chunk]
+	if !found {
+		lock = &chunkLock{readers: map[apis.SyncID]bool{}}
+		l.locks[chunk] = lock
+	}
+	return lock
+}
+
+func (l *lockingSync) newID(chunk apis.ChunkNum) apis.SyncID {
+	l.lastID++
+	l.chunks[l.lastID] = chunk
+	return l.lastID
+}
+
+func (l *lockingSync) StartSync(chunk apis.ChunkNum) (apis.SyncID, error) {
+	l.lmu.Lock()
+	defer l.lmu.Unlock()
+	lock := l.lockFor(chunk)
+	for lock.writer != 0 {
+		l.cond.Wait()
+	}
+	s := l.newID(chunk)
+	lock.readers[s] = true
+	return s, nil
+}
+
+func (l *lockingSync) UpgradeSync(s apis.SyncID) (apis.SyncID, error) {
+	l.lmu.Lock()
+	defer l.lmu.Unlock()
+	chunk, found := l.chunks[s]
+	if !found {
+		return 0, errors.New("no such syncid")
+	}
+	lock := l.lockFor(chunk)
+	if lock.writer != 0 {
+		return 0, apis.ErrLockContended
+	}
+	if !lock.readers[s] {
+		return 0, errors.New("should already hold a read lock when trying to upgrade")
+	}
+	delete(lock.readers, s)
+	lock.writer, lock.pending = s, true
+	for len(lock.readers) > 0 {
+		l.cond.Wait()
+	}
+	lock.readers[s] = true
+	lock.writer, lock.pending = l.newID(chunk), false
+	return lock.writer, nil
+}
+
+func (l *lockingSync) ReleaseSync(s apis.SyncID) error {
+	l.lmu.Lock()
+	defer l.lmu.Unlock()
+	chunk, found := l.chunks[s]
+	if !found {
+		return errors.New("no such syncid")
+	}
+	lock := l.lockFor(chunk)
+	if lock.readers[s] {
+		delete(lock.readers, s)
+	} else if lock.writer == s && !lock.pending {
+		lock.writer = 0
+		l.lastRevision++
+		l.revisions[chunk] = l.lastRevision
+		close(l.released)
+		l.released = make(chan struct{})
+	} else {
+		return errors.New("sync not held")
+	}
+	delete(l.chunks, s)
+	l.cond.Broadcast()
+	return nil
+}
+
+// Gives up after a short while, like the etcd implementation does after a longer one.
+func (l *lockingSync) AwaitRelease(chunk apis.ChunkNum, seen apis.SyncRevision) (apis.SyncRevision, error) {
+	timeout := time.After(100 * time.Millisecond)
+	for {
+		l.lmu.Lock()
+		current, released := l.revisions[chunk], l.released
+		l.lmu.Unlock()
+		if current != seen {
+			return current, nil
+		}
+		select {
+		case <-released:
+		case <-timeout:
+			return seen, nil
+		}
+	}
+}
+
+func (l *lockingSync) ConfirmSync(s apis.SyncID) (write bool, err error) {
+	l.lmu.Lock()
+	defer l.lmu.Unlock()
+	chunk, found := l.chunks[s]
+	if !found {
+		return false, errors.New("no such syncid")
+	}
+	return l.lockFor(chunk).writer == s, nil
+}
+
+// Tests that many clients moving files and directories around at once, through directories that contain each other,
+// never lose or duplicate anything, and that a directory can't be moved inside itself.
+func TestConcurrentMoves(t *testing.T) {
+	client := newMemoryClient()
+	fs := NewFilesystem(client, newLockingSync(client))
+
+	dirs := []string{"/a", "/a/b", "/c", "/c/d"}
+	for _, dir := range dirs {
+		require.NoError(t, fs.Mkdir(dir))
+	}
+	require.NoError(t, fs.Mkdir("/a/sub"))
+	const fileCount = 12
+	for i := 0; i < fileCount; i++ {
+		file, err := fs.OpenWrite(fmt.Sprintf("%s/file-%d", dirs[i%len(dirs)], i), true, true)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < 20; i++ {
+				name := fmt.Sprintf("file-%d", r.Intn(fileCount))
+				if w == 0 {
+					// one client shuffles a directory around, so that the others' paths keep changing underneath them
+					name = "sub"
+				}
+				dest := dirs[r.Intn(len(dirs))]
+				for _, source := range dirs {
+					if source == dest {
+						continue
+					}
+					err := fs.Rename(source+"/"+name, dest+"/"+name)
+					if err == nil || !strings.Contains(err.Error(), "no such node") {
+						assert.NoError(t, err)
+						break
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	found := map[string]int{}
+	for _, dir := range dirs {
+		names, err := fs.ListDir(dir)
+		require.NoError(t, err)
+		for _, name := range names {
+			found[name]++
+		}
+	}
+	assert.Equal(t, 1, found["sub"])
+	for i := 0; i < fileCount; i++ {
+		assert.Equal(t, 1, found[fmt.Sprintf("file-%d", i)])
+	}
+	assert.Len(t, found, fileCount+3) // the files, the subdirectory, and /a/b and /c/d
+
+	assert.Error(t, fs.Rename("/a", "/a/b/a"))
+	assert.Error(t, fs.Rename("/c", "/c/c"))
+	names, err := fs.ListDir("/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "c"}, names)
+}
+
+// Tests that only moves of directories wait for the move lock, and that moves of files between two directories only
+// need the directories themselves.
+func TestMoveLock(t *testing.T) {
+	client := newMemoryClient()
+	sync := newLockingSync(client)
+	fs := NewFilesystem(client, sync)
+
+	require.NoError(t, fs.Mkdir("/a"))
+	require.NoError(t, fs.Mkdir("/b"))
+	require.NoError(t, fs.Mkdir("/a/sub"))
+	require.NoError(t, fs.CreateAtomic("/a/file", strings.NewReader("contents")))
+
+	held, err := (&FilesystemSync{s: sync}).WriteLockChunk(moveLockChunk)
+	require.NoError(t, err)
+
+	require.NoError(t, fs.Rename("/a/file", "/b/file"))
+
+	moved := make(chan error)
+	go func() {
+		moved <- fs.Rename("/a/sub", "/b/sub")
+	}()
+	select {
+	case err := <-moved:
+		t.Fatalf("directory moved while the move lock was held: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	held.Unlock()
+	require.NoError(t, <-moved)
+
+	names, err := fs.ListDir("/b")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"file", "sub"}, names)
+	names, err = fs.ListDir("/a")
+	require.NoError(t, err)
+	assert.Empty(t, names)
+}
+
+// Tests that an operation that keeps losing races is attempted again only so many times, and fails with its last loss.
+func TestRetryConflicts(t *testing.T) {
+	attempts := 0
+	err := retryConflicts(func() error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("attempt %d: %w", attempts, apis.ErrVersionStale)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = retryConflicts(func() error {
+		attempts++
+		return fmt.Errorf("attempt %d: %w", attempts, apis.ErrLockContended)
+	})
+	assert.True(t, errors.Is(err, apis.ErrLockContended))
+	assert.Contains(t, err.Error(), fmt.Sprintf("attempt %d", ConflictAttempts))
+	assert.Equal(t, ConflictAttempts, attempts)
+
+	attempts = 0
+	err = retryConflicts(func() error {
+		attempts++
+		return apis.ErrNotFound
+	})
+	assert.Equal(t, apis.ErrNotFound, err)
+	assert.Equal(t, 1, attempts)
+}
+
+// Tests that RemoveAll removes a whole subtree, even while another client is removing the same subtree, without
+// leaving any of its chunks behind, and that it only removes what the user it is made as could remove.
+func TestRemoveAll(t *testing.T) {
+	fs, client := ConstructMemoryFilesystem()
+	traverser, err := fs.GetTraverser()
+	require.NoError(t, err)
+
+	writeFile(t, fs, "/keep", 0, 10)
+	for _, dir := range []string{"/tree", "/tree/a", "/tree/a/b", "/tree/c"} {
+		require.NoError(t, fs.Mkdir(dir))
+		for i := 0; i < 5; i++ {
+			writeFile(t, fs, fmt.Sprintf("%s/file-%d", dir, i), 0, 100)
+		}
+	}
+	writeFile(t, fs, "/tree/a/big", FileChunkSize-10, 20)
+	require.NoError(t, fs.SymLink("/tree/c/link", "/keep"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, fs.RemoveAll("/tree"))
+		}()
+	}
+	wg.Wait()
+	_, err = fs.Stat("/tree")
+	assert.True(t, errors.Is(err, ErrNotExist))
+	assertDirInfo(t, fs, "/", 1, 10)
+
+	client.mu.Lock()
+	var allocated []apis.ChunkNum
+	for chunk := range client.chunks {
+		allocated = append(allocated, chunk)
+	}
+	client.mu.Unlock()
+	assert.NoError(t, traverser.Fsck(FsckOptions{Allocated: allocated}, func(problem Problem) {
+		assert.Fail(t, "unexpected problem", "%v", problem)
+	}))
+
+	assert.NoError(t, fs.RemoveAll("/tree"))
+	assert.Error(t, fs.RemoveAll("/"))
+	assert.NoError(t, fs.RemoveAll("/keep"))
+	names, err := fs.ListDir("/")
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	alice := AsUser(fs, User{Uid: 1000, Gids: []uint32{1000}})
+	bob := AsUser(fs, User{Uid: 1001, Gids: []uint32{1001}})
+	require.NoError(t, fs.Chmod("/", os.ModeSticky|0777))
+	require.NoError(t, alice.Mkdir("/alice"))
+	require.NoError(t, alice.Mkdir("/alice/sub"))
+	require.NoError(t, alice.CreateAtomic("/alice/sub/notes", strings.NewReader("private")))
+	assert.True(t, errors.Is(bob.RemoveAll("/alice"), ErrPermission))
+	_, err = fs.Stat("/alice/sub/notes")
+	assert.NoError(t, err)
+	assert.NoError(t, alice.RemoveAll("/alice"))
+	_, err = fs.Stat("/alice")
+	assert.True(t, errors.Is(err, ErrNotExist))
+}
+
+// Tests that a snapshot keeps a subtree as it was while the original goes on changing, that nothing in it can be
+// changed, and that deleting snapshots leaves exactly the chunks that the rest of the tree still refers to.
+func TestSnapshots(t *testing.T) {
+	fs, client := ConstructMemoryFilesystem()
+	traverser, err := fs.GetTraverser()
+	require.NoError(t, err)
+	fsck := func() {
+		client.mu.Lock()
+		var allocated []apis.ChunkNum
+		for chunk := range client.chunks {
+			allocated = append(allocated, chunk)
+		}
+		client.mu.Unlock()
+		assert.NoError(t, traverser.Fsck(FsckOptions{Allocated: allocated}, func(problem Problem) {
+			assert.Fail(t, "unexpected problem", "%v", problem)
+		}))
+	}
+
+	require.NoError(t, fs.Mkdir("/docs"))
+	require.NoError(t, fs.Mkdir("/docs/sub"))
+	require.NoError(t, fs.CreateAtomic("/docs/a", strings.NewReader("alpha")))
+	require.NoError(t, fs.CreateAtomic("/docs/sub/b", strings.NewReader("beta")))
+	require.NoError(t, fs.SymLink("/docs/link", "/docs/a"))
+	require.NoError(t, fs.CreateAtomic("/other", strings.NewReader("other")))
+	before := describeTree(t, fs, "/docs")
+
+	require.NoError(t, fs.Snapshot("/docs", "first"))
+	assert.Equal(t, before, describeTree(t, fs, SnapshotDir+"/first"))
+	assertDirInfo(t, fs, SnapshotDir+"/first", 3, 9)
+	assert.True(t, errors.Is(fs.Snapshot("/docs", "first"), ErrExists))
+	assert.Error(t, fs.Snapshot("/docs", "a/b"))
+	assert.Error(t, fs.Snapshot(SnapshotDir+"/first", "nested"))
+	fsck()
+
+	f, err := fs.OpenWrite("/docs/a", false, false)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("A"), 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, fs.Truncate("/docs/sub/b", 2))
+	require.NoError(t, fs.Unlink("/docs/link"))
+	require.NoError(t, fs.CreateAtomic("/docs/new", strings.NewReader("new")))
+	assert.Equal(t, before, describeTree(t, fs, SnapshotDir+"/first"))
+	assert.Equal(t, map[string]string{
+		"a":     "file:Alpha",
+		"sub":   "dir",
+		"sub/b": "file:be",
+		"new":   "file:new",
+	}, describeTree(t, fs, "/docs"))
+
+	_, err = fs.OpenWrite(SnapshotDir+"/first/a", false, false)
+	assert.True(t, errors.Is(err, ErrReadOnly))
+	for _, err := range []error{
+		fs.Mkdir(SnapshotDir + "/first/dir"),
+		fs.Unlink(SnapshotDir + "/first/a"),
+		fs.Rename("/other", SnapshotDir+"/first/other"),
+		fs.Rename(SnapshotDir+"/first/a", "/a"),
+		fs.Truncate(SnapshotDir+"/first/a", 0),
+		fs.Chmod(SnapshotDir+"/first/a", 0600),
+		fs.CreateAtomic(SnapshotDir+"/first/c", strings.NewReader("c")),
+		fs.RemoveAll(SnapshotDir + "/first"),
+	} {
+		assert.True(t, errors.Is(err, ErrReadOnly), "%v", err)
+	}
+	user := AsUser(fs, User{Uid: 1000, Gids: []uint32{1000}})
+	assert.True(t, errors.Is(user.Snapshot("/docs", "mine"), ErrPermission))
+	assert.True(t, errors.Is(user.DeleteSnapshot("first"), ErrPermission))
+
+	// a snapshot of the whole tree leaves out the other snapshots
+	require.NoError(t, fs.Snapshot("/", "second"))
+	tree := describeTree(t, fs, SnapshotDir+"/second")
+	assert.Equal(t, "file:other", tree["other"])
+	assert.Equal(t, "file:Alpha", tree["docs/a"])
+	_, found := tree[".snapshots"]
+	assert.False(t, found)
+	require.NoError(t, fs.Truncate("/other", 0))
+	assert.Equal(t, "file:other", describeTree(t, fs, SnapshotDir+"/second")["other"])
+	fsck()
+
+	require.NoError(t, fs.DeleteSnapshot("first"))
+	assert.Equal(t, "file:Alpha", describeTree(t, fs, SnapshotDir+"/second")["docs/a"])
+	require.NoError(t, fs.DeleteSnapshot("second"))
+	assert.True(t, errors.Is(fs.DeleteSnapshot("second"), ErrNotExist))
+	names, err := fs.ListDir(SnapshotDir)
+	require.NoError(t, err)
+	assert.Empty(t, names)
+	assert.Equal(t, "file:Alpha", describeTree(t, fs, "/docs")["a"])
+	fsck()
+}
+
+// Tests that with a trash period, removed nodes can be brought back until the trash is purged, and that purging only
+// removes what has been in the trash for longer than the period.
+func TestTrash(t *testing.T) {
+	client := newMemoryClient()
+	shared := &permissiveSync{client: client}
+	fs := NewFilesystemWithOptions(client, shared, FilesystemOptions{TrashPeriod: time.Hour})
+	traverser, err := fs.GetTraverser()
+	require.NoError(t, err)
+
+	require.NoError(t, fs.Mkdir("/docs"))
+	require.NoError(t, fs.CreateAtomic("/docs/a", strings.NewReader("first")))
+	require.NoError(t, fs.Unlink("/docs/a"))
+	require.NoError(t, fs.CreateAtomic("/docs/a", strings.NewReader("second")))
+	require.NoError(t, fs.Unlink("/docs/a"))
+	_, err = fs.Stat("/docs/a")
+	assert.True(t, errors.Is(err, ErrNotExist))
+	assert.True(t, errors.Is(fs.Unlink("/docs/a"), ErrNotExist))
+	assert.Error(t, fs.Unlink("/docs"))
+	assertDirInfo(t, fs, "/docs", 0, 0)
+
+	// the most recent deletion comes back first
+	require.NoError(t, fs.Undelete("/docs/a"))
+	require.NoError(t, fs.Rename("/docs/a", "/docs/b"))
+	require.NoError(t, fs.Undelete("/docs/a"))
+	assert.Equal(t, map[string]string{"a": "file:first", "b": "file:second"}, describeTree(t, fs, "/docs"))
+	assert.True(t, errors.Is(fs.Undelete("/docs/a"), ErrNotExist))
+	assert.Error(t, fs.Undelete(TrashDir))
+
+	// a directory goes into the trash as a whole
+	require.NoError(t, fs.RemoveAll("/docs"))
+	require.NoError(t, fs.RemoveAll("/docs"))
+	require.NoError(t, fs.Mkdir("/docs"))
+	assert.True(t, errors.Is(fs.Undelete("/docs"), ErrExists))
+	// empty directories are removed straight away
+	require.NoError(t, fs.Rmdir("/docs"))
+	require.NoError(t, fs.Undelete("/docs"))
+	assert.Equal(t, map[string]string{"a": "file:first", "b": "file:second"}, describeTree(t, fs, "/docs"))
+
+	user := AsUser(fs, User{Uid: 1000, Gids: []uint32{1000}})
+	assert.True(t, errors.Is(user.Undelete("/docs/b"), ErrPermission))
+	assert.True(t, errors.Is(user.PurgeTrash(), ErrPermission))
+	_, err = user.ListDir(TrashDir)
+	assert.True(t, errors.Is(err, ErrPermission))
+
+	// nothing has been in the trash for an hour yet, but without a trash period, everything is due
+	require.NoError(t, fs.Unlink("/docs/b"))
+	require.NoError(t, fs.PurgeTrash())
+	require.NoError(t, fs.Undelete("/docs/b"))
+	require.NoError(t, fs.Unlink("/docs/b"))
+	require.NoError(t, NewFilesystem(client, shared).PurgeTrash())
+	assert.True(t, errors.Is(fs.Undelete("/docs/b"), ErrNotExist))
+	names, err := fs.ListDir(TrashDir)
+	require.NoError(t, err)
+	assert.Empty(t, names)
+	assertDirInfo(t, fs, "/", 2, 5)
+
+	client.mu.Lock()
+	var allocated []apis.ChunkNum
+	for chunk := range client.chunks {
+		allocated = append(allocated, chunk)
+	}
+	client.mu.Unlock()
+	assert.NoError(t, traverser.Fsck(FsckOptions{Allocated: allocated}, func(problem Problem) {
+		assert.Fail(t, "unexpected problem", "%v", problem)
+	}))
+}
+
+// Tests that two clients contending for an exclusive lock on a file never hold it at the same time, that shared locks
+// can be held together, and that a lock whose holder died without releasing it runs out instead of wedging the file.
+func TestAdvisoryLocks(t *testing.T) {
+	newFS, teardown := ConstructFilesystemTestCluster(t)
+	defer teardown()
+	fs1, fs2 := newFS(), newFS()
+
+	file, err := fs1.OpenWrite("/locked", true, true)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	unlock1, err := fs1.Lock("/locked", false)
+	require.NoError(t, err)
+	unlock2, err := fs2.Lock("/locked", false)
+	require.NoError(t, err)
+	require.NoError(t, unlock1())
+	require.NoError(t, unlock2())
+	assert.Error(t, unlock1())
+
+	var holders int32
+	var wg sync.WaitGroup
+	for _, fs := range []Filesystem{fs1, fs2} {
+		wg.Add(1)
+		go func(fs Filesystem) {
+			defer wg.Done()
+			for i := 0; i < 3; i++ {
+				unlock, err := fs.Lock("/locked", true)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, int32(1), atomic.AddInt32(&holders, 1))
+				time.Sleep(20 * time.Millisecond)
+				atomic.AddInt32(&holders, -1)
+				assert.NoError(t, unlock())
+			}
+		}(fs)
+	}
+	wg.Wait()
+
+	// a client that crashed right after taking the lock never renews or releases it
+	chunk, err := fs1.(*filesystem).fileChunk("/locked")
+	require.NoError(t, err)
+	_, err = fs1.(*filesystem).t.fs.s.AcquireLock(chunk, true)
+	require.NoError(t, err)
+
+	start := time.Now()
+	unlock, err := fs2.Lock("/locked", true)
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) >= apis.AdvisoryLockTimeout/2, "lock taken while the dead holder's lease was live")
+	// the new holder keeps renewing its lock, so it outlasts the timeout
+	time.Sleep(apis.AdvisoryLockTimeout * 3 / 2)
+	_, err = fs1.(*filesystem).t.fs.s.AcquireLock(chunk, false)
+	assert.True(t, errors.Is(err, apis.ErrLockContended))
+	require.NoError(t, unlock())
+}
+
+// Tests that a path whose chain of directories is cached is resolved without reading the directories along it, and
+// that the chain is not used once another client renames or removes a directory along it, even after the removed
+// directory's chunk number has been handed out again. Also tests that the cache stays within its size limit.
+func TestPathCacheAcrossClients(t *testing.T) {
+	client := newMemoryClient()
+	client.reuse = true
+	shared := newLockingSync(client)
+	fs1, fs2 := NewFilesystem(client, shared), NewFilesystem(client, shared)
+	traverser, err := fs1.GetTraverser()
+	require.NoError(t, err)
+
+	for _, dir := range []string{"/a", "/a/b", "/a/b/c", "/a/b/c/d"} {
+		require.NoError(t, fs1.Mkdir(dir))
+	}
+	readsFor := func(path string) int {
+		client.mu.Lock()
+		before := client.reads
+		client.mu.Unlock()
+		info, err := fs1.Stat(path)
+		require.NoError(t, err)
+		assert.True(t, info.IsDir())
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return client.reads - before
+	}
+	readsFor("/a/b/c/d")
+	cached := readsFor("/a/b/c/d")
+	paths := traverser.paths
+	traverser.paths = nil
+	uncached := readsFor("/a/b/c/d")
+	traverser.paths = paths
+	// the root, /a and /a/b are skipped
+	assert.Equal(t, uncached-3, cached)
+
+	require.NoError(t, fs2.Rename("/a/b", "/a/x"))
+	_, err = fs1.Stat("/a/b/c/d")
+	assert.True(t, errors.Is(err, ErrNotExist))
+	readsFor("/a/x/c/d")
+
+	dir, err := traverser.PathDir("/a/x/c")
+	require.NoError(t, err)
+	removed := dir.chunk
+	dir.Release()
+	require.NoError(t, fs2.Rmdir("/a/x/c/d"))
+	require.NoError(t, fs2.Rmdir("/a/x/c"))
+	// /e takes the chunk number that /a/x/c had, and /e/d that of /a/x/c/d
+	require.NoError(t, fs2.Mkdir("/e"))
+	require.NoError(t, fs2.Mkdir("/e/d"))
+	dir, err = traverser.PathDir("/e")
+	require.NoError(t, err)
+	assert.Equal(t, removed, dir.chunk)
+	dir.Release()
+	_, err = fs1.Stat("/a/x/c/d")
+	assert.True(t, errors.Is(err, ErrNotExist))
+
+	for i := 0; i < PathCacheSize+10; i++ {
+		require.NoError(t, fs1.Mkdir(fmt.Sprintf("/a/x/%d", i)))
+		_, err := fs1.ListDir(fmt.Sprintf("/a/x/%d", i))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, PathCacheSize, traverser.paths.order.Len())
+	assert.Len(t, traverser.paths.entries, PathCacheSize)
+}
+
+// Measures how long it takes to stat a file at the bottom of a deep tree, with and without the path cache.
+func BenchmarkStatDeepPath(b *testing.B) {
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached=%v", cached), func(b *testing.B) {
+			client := newMemoryClient()
+			fs := NewFilesystem(client, newLockingSync(client))
+			if !cached {
+				fs.(*filesystem).t.paths = nil
+			}
+			path := ""
+			for i := 0; i < 8; i++ {
+				path += fmt.Sprintf("/level-%d", i)
+				require.NoError(b, fs.Mkdir(path))
+			}
+			path += "/file"
+			file, err := fs.OpenWrite(path, true, true)
+			require.NoError(b, err)
+			require.NoError(b, file.Close())
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := fs.Stat(path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Tests copying a generated local tree into the filesystem, and that a partial failure reports what didn't make it.
+func TestImportTree(t *testing.T) {
+	local, err := ioutil.TempDir("", "zircon-import")
+	require.NoError(t, err)
+	defer os.RemoveAll(local)
+
+	contents := map[string][]byte{
+		"top.txt":         []byte("top level"),
+		"empty":           nil,
+		"a/one.bin":       make([]byte, 300000),
+		"a/two.txt":       []byte("second"),
+		"a/b/three.txt":   []byte("deep down"),
+		"a/b/c/four.txt":  []byte("deeper"),
+		"a/b/c/five.data": make([]byte, 50),
+	}
+	rand.New(rand.NewSource(3)).Read(contents["a/one.bin"])
+	for name, data := range contents {
+		require.NoError(t, os.MkdirAll(filepath.Join(local, filepath.Dir(name)), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(local, name), data, 0644))
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(local, "d"), 0755))
+	require.NoError(t, os.Symlink("../top.txt", filepath.Join(local, "a/link")))
+	modes := map[string]os.FileMode{"top.txt": 0644, "a/two.txt": 0600, "a/b/c/five.data": 0755, "a": 0755, "d": 0700}
+	for name, mode := range modes {
+		require.NoError(t, os.Chmod(filepath.Join(local, name), mode))
+	}
+
+	fs, _ := ConstructMemoryFilesystem()
+	var mu sync.Mutex
+	reported := 0
+	require.NoError(t, fs.ImportTreeProgress(local, "/imported", func(localPath string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.NoError(t, err)
+		reported++
+	}))
+	assert.Equal(t, len(contents)+5, reported) // the files, four directories, and the symlink
+
+	names, err := fs.ListDir("/imported")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"top.txt", "empty", "a", "d"}, names)
+	names, err = fs.ListDir("/imported/a/b/c")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"four.txt", "five.data"}, names)
+	names, err = fs.ListDir("/imported/d")
+	require.NoError(t, err)
+	assert.Empty(t, names)
+	link, err := fs.ReadLink("/imported/a/link")
+	require.NoError(t, err)
+	assert.Equal(t, "../top.txt", link)
+	for name, expected := range contents {
+		file, err := fs.OpenRead("/imported/" + name)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(file)
+		assert.NoError(t, err)
+		assert.NoError(t, file.Close())
+		assert.True(t, bytes.Equal(expected, data), "contents of %s do not match", name)
+	}
+	for name, mode := range modes {
+		info, err := fs.Stat("/imported/" + name)
+		require.NoError(t, err)
+		assert.Equal(t, mode, info.Mode().Perm(), "mode of %s", name)
+	}
+
+	// a file that already exists is not overwritten, but everything else is still imported
+	require.NoError(t, fs.Mkdir("/partial"))
+	existing, err := fs.OpenWrite("/partial/top.txt", true, true)
+	require.NoError(t, err)
+	require.NoError(t, existing.Close())
+	err = fs.ImportTree(local, "/partial")
+	var partial *TreeImportError
+	if assert.True(t, errors.As(err, &partial)) {
+		assert.Len(t, partial.Failed, 1)
+		assert.True(t, errors.Is(partial.Failed[filepath.Join(local, "top.txt")], ErrExists))
+		assert.Equal(t, len(contents)+4, partial.Imported)
+	}
+	info, err := fs.Stat("/partial/top.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	info, err = fs.Stat("/partial/a/b/c/four.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), info.Size())
+}
+
+// Tests that reading through a file with read-ahead enabled returns the same data as without it, including after seeks
+// and writes that invalidate what was fetched ahead, and that nothing is fetched past the end of the file.
+func TestReadAhead(t *testing.T) {
+	client := newMemoryClient()
+	fs := NewFilesystemWithOptions(client, &permissiveSync{client: client}, FilesystemOptions{ReadAhead: 1000})
+
+	data := make([]byte, 4500)
+	rand.New(rand.NewSource(5)).Read(data)
+	f, err := fs.OpenWrite("/file", true, true)
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	readAll := func() []byte {
+		var result []byte
+		buffer := make([]byte, 300)
+		for {
+			n, err := f.Read(buffer)
+			result = append(result, buffer[:n]...)
+			if err == io.EOF {
+				return result
+			}
+			require.NoError(t, err)
+		}
+	}
+	assert.True(t, bytes.Equal(data, readAll()))
+	assert.Nil(t, f.(*fileStream).ahead, "should not fetch past the end of the file")
+
+	// seeking backwards must not serve data from the old position
+	_, err = f.Seek(2000, io.SeekStart)
+	require.NoError(t, err)
+	buffer := make([]byte, 10)
+	_, err = io.ReadFull(f, buffer)
+	require.NoError(t, err)
+	assert.Equal(t, data[2000:2010], buffer)
+
+	// nor may it serve data that has since been overwritten
+	_, err = f.WriteAt([]byte("overwritten"), 2010)
+	require.NoError(t, err)
+	copy(data[2010:], "overwritten")
+	assert.True(t, bytes.Equal(data[2010:], readAll()))
+	assert.NoError(t, f.Close())
+}
+
+// Tests that small sequential writes are gathered up and written out together, that they can be read back before the
+// buffer fills, and that writes elsewhere in the file, flushes, and closes write them out.
+func TestWriteBuffer(t *testing.T) {
+	client := newMemoryClient()
+	writes := 0
+	client.failWrite = func(chunk apis.ChunkNum, offset uint32, data []byte) error {
+		writes++
+		return nil
+	}
+	fs := NewFilesystemWithOptions(client, &permissiveSync{client: client}, FilesystemOptions{WriteBuffer: 1000})
+	f, err := fs.OpenWrite("/file", true, true)
+	require.NoError(t, err)
+
+	var expected []byte
+	writes = 0
+	for i := 0; i < 200; i++ {
+		line := []byte(fmt.Sprintf("line %03d\n", i))
+		_, err := f.Write(line)
+		require.NoError(t, err)
+		expected = append(expected, line...)
+	}
+	// the buffer only fills once
+	assert.True(t, writes > 0 && writes < 20, "expected 200 writes to be gathered into a few, but got %d", writes)
+
+	// reading back sees everything, including what hasn't been written out yet
+	buffer := make([]byte, len(expected))
+	_, err = f.ReadAt(buffer, 0)
+	require.NoError(t, err)
+	assert.Equal(t, expected, buffer)
+
+	// a write somewhere else doesn't join the ones before it
+	_, err = f.Write([]byte("tail"))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("LINE"), 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Flush())
+	assert.NoError(t, f.Close())
+	expected = append(expected, "tail"...)
+	copy(expected, "LINE")
+
+	r, err := fs.OpenRead("/file")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(data))
+	assert.NoError(t, r.Close())
+
+	// a failure to write out held writes is reported by Close
+	f, err = fs.OpenWrite("/file", false, false)
+	require.NoError(t, err)
+	client.failWrite = func(chunk apis.ChunkNum, offset uint32, data []byte) error {
+		return errors.New("injected failure")
+	}
+	_, err = f.Write([]byte("lost"))
+	require.NoError(t, err)
+	assert.Error(t, f.Close())
+}
+
+// Measures copying a file spanning several chunks out of a filesystem whose reads have some latency, with and without
+// read-ahead.
+func BenchmarkCopyReadAhead(b *testing.B) {
+	for _, window := range []uint32{0, FileChunkSize} {
+		b.Run(fmt.Sprintf("window=%d", window), func(b *testing.B) {
+			client := newMemoryClient()
+			fs := NewFilesystemWithOptions(client, &permissiveSync{client: client}, FilesystemOptions{ReadAhead: window})
+			f, err := fs.OpenWrite("/large", true, true)
+			require.NoError(b, err)
+			_, err = f.Write(make([]byte, 3*FileChunkSize))
+			require.NoError(b, err)
+			require.NoError(b, f.Close())
+			client.readDelay = 10 * time.Millisecond
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r, err := fs.OpenRead("/large")
+				if err != nil {
+					b.Fatal(err)
+				}
+				// stands in for a consumer that takes time to handle each block, like a network connection
+				w := slowWriter{delay: 5 * time.Millisecond}
+				// hides WriteTo, which would otherwise do its own read-ahead; see BenchmarkCopyWriteTo
+				reader := struct{ io.Reader }{r}
+				if _, err := io.CopyBuffer(w, reader, make([]byte, 1024*1024)); err != nil {
+					b.Fatal(err)
+				}
+				r.Close()
+			}
+		})
+	}
+}
+
+// Measures copying the same file as BenchmarkCopyReadAhead with io.Copy, which reads through WriteTo.
+func BenchmarkCopyWriteTo(b *testing.B) {
+	client := newMemoryClient()
+	fs := NewFilesystem(client, &permissiveSync{client: client})
+	f, err := fs.OpenWrite("/large", true, true)
+	require.NoError(b, err)
+	_, err = f.Write(make([]byte, 3*FileChunkSize))
+	require.NoError(b, err)
+	require.NoError(b, f.Close())
+	client.readDelay = 10 * time.Millisecond
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := fs.OpenRead("/large")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(slowWriter{delay: 5 * time.Millisecond}, r); err != nil {
+			b.Fatal(err)
+		}
+		r.Close()
+	}
+}
+
+// Tests that io.Copy out of a file copies everything from the current position onwards, across chunk boundaries,
+// including writes that were still being held, and leaves the position at the end.
+func TestCopyOut(t *testing.T) {
+	client := newMemoryClient()
+	fs := NewFilesystemWithOptions(client, &permissiveSync{client: client}, FilesystemOptions{WriteBuffer: 1000})
+	data := make([]byte, 2*FileChunkSize+500)
+	rand.New(rand.NewSource(7)).Read(data)
+	f, err := fs.OpenWrite("/file", true, true)
+	require.NoError(t, err)
+	_, err = f.Write(data[:len(data)-10])
+	require.NoError(t, err)
+	_, err = f.Write(data[len(data)-10:])
+	require.NoError(t, err)
+
+	for _, start := range []int64{0, 100, FileChunkSize, int64(len(data))} {
+		_, err = f.Seek(start, io.SeekStart)
+		require.NoError(t, err)
+		var out bytes.Buffer
+		n, err := io.Copy(&out, f)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(data))-start, n)
+		assert.True(t, bytes.Equal(data[start:], out.Bytes()), "copy from %d does not match", start)
+		position, err := f.Seek(0, io.SeekCurrent)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(data)), position)
+	}
+	assert.NoError(t, f.Close())
+}
+
+type slowWriter struct {
+	delay time.Duration
+}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return len(p), nil
+}
+
+// Waits for the next event from a watch, failing the test if it doesn't arrive in time.
+func nextEvent(t *testing.T, events <-chan ChangeEvent) ChangeEvent {
+	select {
+	case event, ok := <-events:
+		require.True(t, ok, "watch ended early")
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a change event")
+		return ChangeEvent{}
+	}
+}
+
+func createFile(t *testing.T, fs Filesystem, path string) {
+	f, err := fs.OpenWrite(path, true, true)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+// Tests that changes to a watched directory, whether made through the same filesystem or another client, arrive in
+// order, and that cancelling the watch ends it.
+func TestWatch(t *testing.T) {
+	client := newMemoryClient()
+	shared := newLockingSync(client)
+	fs, other := NewFilesystem(client, shared), NewFilesystem(client, shared)
+
+	require.NoError(t, fs.Mkdir("/w"))
+	createFile(t, fs, "/w/existing")
+	events, cancel, err := fs.Watch("/w")
+	require.NoError(t, err)
+
+	createFile(t, fs, "/w/a")
+	assert.Equal(t, ChangeEvent{Type: CREATED, Path: "/w/a"}, nextEvent(t, events))
+	require.NoError(t, other.Rename("/w/a", "/w/b"))
+	assert.Equal(t, ChangeEvent{Type: RENAMED, Path: "/w/b", OldPath: "/w/a"}, nextEvent(t, events))
+	require.NoError(t, fs.Mkdir("/w/d"))
+	assert.Equal(t, ChangeEvent{Type: CREATED, Path: "/w/d"}, nextEvent(t, events))
+	// changes inside a subdirectory are only reported by a recursive watch
+	createFile(t, fs, "/w/d/inner")
+	require.NoError(t, other.Unlink("/w/b"))
+	assert.Equal(t, ChangeEvent{Type: DELETED, Path: "/w/b"}, nextEvent(t, events))
+	require.NoError(t, fs.Rename("/w/existing", "/elsewhere"))
+	assert.Equal(t, ChangeEvent{Type: DELETED, Path: "/w/existing"}, nextEvent(t, events))
+
+	cancel()
+	createFile(t, fs, "/w/after")
+	select {
+	case event, ok := <-events:
+		assert.False(t, ok, "received %v after cancelling", event)
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not end after cancelling")
+	}
+
+	_, _, err = fs.Watch("/missing")
+	assert.Error(t, err)
+}
+
+// Tests that a recursive watch follows directories that are created or renamed below it, and stops following ones that
+// are removed.
+func TestWatchRecursive(t *testing.T) {
+	client := newMemoryClient()
+	fs := NewFilesystem(client, newLockingSync(client))
+
+	require.NoError(t, fs.Mkdir("/w"))
+	require.NoError(t, fs.Mkdir("/w/old"))
+	events, cancel, err := fs.WatchRecursive("/w")
+	require.NoError(t, err)
+	defer cancel()
+
+	createFile(t, fs, "/w/old/a")
+	assert.Equal(t, ChangeEvent{Type: CREATED, Path: "/w/old/a"}, nextEvent(t, events))
+
+	require.NoError(t, fs.Mkdir("/w/d"))
+	assert.Equal(t, ChangeEvent{Type: CREATED, Path: "/w/d"}, nextEvent(t, events))
+	createFile(t, fs, "/w/d/f")
+	assert.Equal(t, ChangeEvent{Type: CREATED, Path: "/w/d/f"}, nextEvent(t, events))
+
+	require.NoError(t, fs.Rename("/w/d", "/w/e"))
+	assert.Equal(t, ChangeEvent{Type: RENAMED, Path: "/w/e", OldPath: "/w/d"}, nextEvent(t, events))
+	createFile(t, fs, "/w/e/g")
+	assert.Equal(t, ChangeEvent{Type: CREATED, Path: "/w/e/g"}, nextEvent(t, events))
+
+	require.NoError(t, fs.Unlink("/w/e/f"))
+	assert.Equal(t, ChangeEvent{Type: DELETED, Path: "/w/e/f"}, nextEvent(t, events))
+	require.NoError(t, fs.Unlink("/w/e/g"))
+	assert.Equal(t, ChangeEvent{Type: DELETED, Path: "/w/e/g"}, nextEvent(t, events))
+	require.NoError(t, fs.Rmdir("/w/e"))
+	assert.Equal(t, ChangeEvent{Type: DELETED, Path: "/w/e"}, nextEvent(t, events))
+}
+
+// Tests that Fsck finds dangling entries, missing data chunks, wrong subtree sizes, and unreachable chunks, that it can
+// quarantine damaged files or repair them in place, and that once everything is repaired, checking again finds nothing.
+func TestFsck(t *testing.T) {
+	fs, client := ConstructMemoryFilesystem()
+	traverser, err := fs.GetTraverser()
+	require.NoError(t, err)
+
+	require.NoError(t, fs.Mkdir("/a"))
+	writeFile(t, fs, "/a/big", FileChunkSize-10, 20)
+	writeFile(t, fs, "/a/small", 0, 100)
+	require.NoError(t, fs.SymLink("/link", "/a/small"))
+	require.NoError(t, fs.Mkdir("/lost"))
+
+	allocated := func() []apis.ChunkNum {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		var chunks []apis.ChunkNum
+		for chunk := range client.chunks {
+			chunks = append(chunks, chunk)
+		}
+		return chunks
+	}
+	check := func(options FsckOptions) map[ProblemType]Problem {
+		options.Allocated = allocated()
+		problems := map[ProblemType]Problem{}
+		require.NoError(t, traverser.Fsck(options, func(problem Problem) {
+			assert.NotContains(t, problems, problem.Type)
+			problems[problem.Type] = problem
+		}))
+		return problems
+	}
+	entryChunk := func(dir string, name string) apis.ChunkNum {
+		ref, err := traverser.PathDir(dir)
+		require.NoError(t, err)
+		defer ref.Release()
+		entry, _, err := ref.lookupEntryAny(name)
+		require.NoError(t, err)
+		return entry.Chunk
+	}
+	assert.Empty(t, check(FsckOptions{}))
+
+	// break the tree behind the filesystem's back
+	require.NoError(t, client.Delete(entryChunk("/", "link"), apis.AnyVersion))
+	big := entryChunk("/a", "big")
+	data, _, err := client.Read(big, indexEntryOffset(1), 8)
+	require.NoError(t, err)
+	require.NoError(t, client.Delete(apis.ChunkNum(binary.LittleEndian.Uint64(data)), apis.AnyVersion))
+	orphan, err := client.New()
+	require.NoError(t, err)
+	_, err = client.Write(orphan, 0, apis.AnyVersion, []byte("orphaned"))
+	require.NoError(t, err)
+	_, err = client.Write(entryChunk("/", "a"), subtreeSizeOffset, apis.AnyVersion, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+	require.NoError(t, err)
+
+	problems := check(FsckOptions{})
+	assert.Len(t, problems, 4)
+	assert.Equal(t, Problem{Type: DANGLING, Path: "/link", Chunk: problems[DANGLING].Chunk, Detail: "chunk does not exist"}, problems[DANGLING])
+	assert.Equal(t, "/a/big", problems[DAMAGED].Path)
+	assert.Equal(t, "/a", problems[MISSIZED].Path)
+	assert.Equal(t, orphan, problems[UNREACHABLE].Chunk)
+	for _, problem := range problems {
+		assert.False(t, problem.Fixed)
+	}
+
+	// quarantining moves the damaged file aside and leaves unreachable chunks alone, but repairs everything else
+	problems = check(FsckOptions{Repair: true, Quarantine: "/lost"})
+	assert.Len(t, problems, 4)
+	assert.True(t, problems[DANGLING].Fixed)
+	assert.True(t, problems[DAMAGED].Fixed)
+	assert.True(t, problems[MISSIZED].Fixed)
+	assert.False(t, problems[UNREACHABLE].Fixed)
+	_, err = fs.Stat("/link")
+	assert.Error(t, err)
+	quarantined := fmt.Sprintf("/lost/%d-big", big)
+	_, err = fs.Stat(quarantined)
+	assert.NoError(t, err)
+	assertDirInfo(t, fs, "/a", 1, 100)
+	assertDirInfo(t, fs, "/lost", 1, FileChunkSize+10)
+
+	// repairing in place turns the missing data chunk into a hole, but leaves the unreachable chunk alone, since it
+	// could belong to a file that is being written
+	problems = check(FsckOptions{Repair: true})
+	assert.Len(t, problems, 2)
+	assert.Equal(t, quarantined, problems[DAMAGED].Path)
+	assert.True(t, problems[DAMAGED].Fixed)
+	assert.False(t, problems[UNREACHABLE].Fixed)
+	_, _, err = client.Read(orphan, 0, 0)
+	assert.NoError(t, err)
+
+	// which is only deleted once the filesystem is known to be offline
+	problems = check(FsckOptions{Repair: true, Offline: true})
+	assert.Len(t, problems, 1)
+	assert.True(t, problems[UNREACHABLE].Fixed)
+	_, _, err = client.Read(orphan, 0, 0)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+	f, err := fs.OpenRead(quarantined)
+	require.NoError(t, err)
+	contents, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, make([]byte, FileChunkSize+10), contents)
+	assert.NoError(t, f.Close())
+
+	assert.Empty(t, check(FsckOptions{}))
+	assertDirInfo(t, fs, "/", 2, FileChunkSize+110)
+}
+
+// Tests that modes and owners are kept for every kind of node, including the root directory, and follow nodes across
+// renames.
+func TestAttributes(t *testing.T) {
+	fs, _ := ConstructMemoryFilesystem()
+
+	require.NoError(t, fs.Mkdir("/dir"))
+	require.NoError(t, fs.CreateAtomic("/dir/file", strings.NewReader("contents")))
+	require.NoError(t, fs.SymLink("/dir/link", "file"))
+
+	assertAttributes := func(path string, mode os.FileMode, uid uint32, gid uint32) {
+		info, err := fs.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, mode, info.Mode(), path)
+		node := info.Sys().(NodeInfo)
+		assert.Equal(t, uid, node.Uid, path)
+		assert.Equal(t, gid, node.Gid, path)
+	}
+	assertAttributes("/", os.ModeDir|0755, 0, 0)
+	assertAttributes("/dir", os.ModeDir|0755, 0, 0)
+	assertAttributes("/dir/file", 0644, 0, 0)
+	assertAttributes("/dir/link", os.ModeSymlink|0777, 0, 0)
+
+	require.NoError(t, fs.Chmod("/dir/file", 0600|os.ModeSetgid))
+	require.NoError(t, fs.Chown("/dir/file", 1000, 100))
+	require.NoError(t, fs.Chown("/dir", -1, 100))
+	require.NoError(t, fs.Chmod("/", os.ModeSticky|0777))
+	require.NoError(t, fs.Chown("/", 5, -1))
+	assertAttributes("/", os.ModeDir|os.ModeSticky|0777, 5, 0)
+	assertAttributes("/dir", os.ModeDir|0755, 0, 100)
+	assertAttributes("/dir/file", os.ModeSetgid|0600, 1000, 100)
+
+	require.NoError(t, fs.Rename("/dir/file", "/moved"))
+	assertAttributes("/moved", os.ModeSetgid|0600, 1000, 100)
+	_, err := fs.Stat("/dir/file")
+	assert.True(t, errors.Is(err, ErrNotExist))
+	assert.True(t, errors.Is(fs.Chmod("/dir/file", 0644), ErrNotExist))
+}
+
+// Tests that nodes keep their access, modification and change times, and that each kind of change updates the right
+// ones.
+func TestTimes(t *testing.T) {
+	fs, _ := ConstructMemoryFilesystem()
+
+	times := func(path string) (atime time.Time, mtime time.Time, ctime time.Time) {
+		info, err := fs.Stat(path)
+		require.NoError(t, err)
+		node := info.Sys().(NodeInfo)
+		return node.Atime, info.ModTime(), node.Ctime
+	}
+	// waits long enough that the next change is at a later time than the last
+	tick := func() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	before := time.Now()
+	require.NoError(t, fs.Mkdir("/dir"))
+	require.NoError(t, fs.CreateAtomic("/dir/file", strings.NewReader("contents")))
+	atime, mtime, ctime := times("/dir/file")
+	assert.False(t, mtime.Before(before))
+	assert.Equal(t, mtime, atime)
+	assert.Equal(t, mtime, ctime)
+	_, dirMtime, _ := times("/dir")
+	assert.False(t, dirMtime.Before(mtime))
+	_, rootMtime, _ := times("/")
+	assert.False(t, rootMtime.Before(before))
+
+	// writing changes the modification and change times, but not the access time
+	tick()
+	f, err := fs.OpenWrite("/dir/file", false, false)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("changed"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	atime2, mtime2, ctime2 := times("/dir/file")
+	assert.Equal(t, atime, atime2)
+	assert.True(t, mtime2.After(mtime))
+	assert.Equal(t, mtime2, ctime2)
+
+	// reading changes the access time, but only the first time after each change
+	tick()
+	r, err := fs.OpenRead("/dir/file")
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	atime3, mtime3, _ := times("/dir/file")
+	assert.True(t, atime3.After(mtime2))
+	assert.Equal(t, mtime2, mtime3)
+	tick()
+	r, err = fs.OpenRead("/dir/file")
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	atime4, _, _ := times("/dir/file")
+	assert.Equal(t, atime3, atime4)
+
+	// truncating changes the modification time
+	tick()
+	require.NoError(t, fs.Truncate("/dir/file", 3))
+	_, mtime4, _ := times("/dir/file")
+	assert.True(t, mtime4.After(mtime3))
+
+	// renaming and changing attributes only change the change time, of the node itself; the directory it was in
+	// changes too
+	tick()
+	require.NoError(t, fs.Rename("/dir/file", "/dir/renamed"))
+	_, mtime5, ctime5 := times("/dir/renamed")
+	assert.Equal(t, mtime4, mtime5)
+	assert.True(t, ctime5.After(mtime4))
+	_, dirMtime2, _ := times("/dir")
+	assert.True(t, dirMtime2.After(dirMtime))
+	tick()
+	require.NoError(t, fs.Chmod("/dir/renamed", 0600))
+	_, mtime6, ctime6 := times("/dir/renamed")
+	assert.Equal(t, mtime5, mtime6)
+	assert.True(t, ctime6.After(ctime5))
+
+	// times can be set directly, leaving either one alone
+	when := time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+	require.NoError(t, fs.Utimes("/dir/renamed", time.Time{}, when))
+	atime7, mtime7, _ := times("/dir/renamed")
+	assert.True(t, mtime7.Equal(when))
+	assert.Equal(t, atime4, atime7)
+	require.NoError(t, fs.Utimes("/", when, when))
+	rootAtime, rootMtime, _ := times("/")
+	assert.True(t, rootAtime.Equal(when))
+	assert.True(t, rootMtime.Equal(when))
+
+	// only the owner, or someone who can write to a node, can set its times
+	require.NoError(t, fs.Chown("/dir/renamed", 1000, 1000))
+	assert.NoError(t, AsUser(fs, User{Uid: 1000}).Utimes("/dir/renamed", when, when))
+	assert.True(t, errors.Is(AsUser(fs, User{Uid: 1001}).Utimes("/dir/renamed", when, when), ErrPermission))
+
+	// and they are kept by exports
+	var archive bytes.Buffer
+	require.NoError(t, fs.Export("/dir", &archive))
+	require.NoError(t, fs.Import("/copy", &archive))
+	atime8, mtime8, _ := times("/copy/renamed")
+	assert.True(t, atime8.Equal(when))
+	assert.True(t, mtime8.Equal(when))
+}
+
+// Tests that AsUser checks operations against the permissions of its user, and makes that user the owner of what it
+// creates.
+func TestAsUser(t *testing.T) {
+	fs, _ := ConstructMemoryFilesystem()
+	require.NoError(t, fs.Chmod("/", os.ModeSticky|0777))
+	alice := AsUser(fs, User{Uid: 1000, Gids: []uint32{1000}})
+	bob := AsUser(fs, User{Uid: 1001, Gids: []uint32{1001, 1000}})
+	carol := AsUser(fs, User{Uid: 1002, Gids: []uint32{1002}})
+	root := AsUser(fs, User{Uid: RootUid})
+
+	require.NoError(t, alice.Mkdir("/alice"))
+	require.NoError(t, alice.CreateAtomic("/alice/notes", strings.NewReader("private")))
+	info, err := fs.Stat("/alice/notes")
+	require.NoError(t, err)
+	node := info.Sys().(NodeInfo)
+	assert.Equal(t, FILE, node.Type)
+	assert.Equal(t, uint32(1000), node.Uid)
+	assert.Equal(t, uint32(1000), node.Gid)
+
+	// readable by everyone, but only writable by its owner
+	_, err = carol.OpenRead("/alice/notes")
+	assert.NoError(t, err)
+	_, err = carol.OpenWrite("/alice/notes", false, false)
+	assert.True(t, errors.Is(err, ErrPermission))
+	assert.True(t, errors.Is(carol.Mkdir("/alice/carol"), ErrPermission))
+	assert.True(t, errors.Is(carol.Chmod("/alice/notes", 0666), ErrPermission))
+	assert.True(t, errors.Is(alice.Chown("/alice/notes", 1002, -1), ErrPermission))
+
+	// a group that can search the directory, but not read the file
+	require.NoError(t, alice.Chmod("/alice", 0750))
+	require.NoError(t, alice.Chmod("/alice/notes", 0600))
+	_, err = bob.Stat("/alice/notes")
+	assert.NoError(t, err)
+	_, err = bob.OpenRead("/alice/notes")
+	assert.True(t, errors.Is(err, ErrPermission))
+	_, err = carol.Stat("/alice/notes")
+	assert.True(t, errors.Is(err, ErrPermission))
+	_, err = carol.ListDir("/alice")
+	assert.True(t, errors.Is(err, ErrPermission))
+	_, err = root.OpenRead("/alice/notes")
+	assert.NoError(t, err)
+
+	// an exclusive create of a file that exists fails because it exists, even if it couldn't be written
+	_, err = bob.OpenWrite("/alice/notes", true, true)
+	assert.True(t, errors.Is(err, ErrExists))
+
+	// the sticky bit on the root keeps users from removing each other's nodes
+	require.NoError(t, carol.CreateAtomic("/carol", strings.NewReader("mine")))
+	assert.True(t, errors.Is(alice.Unlink("/carol"), ErrPermission))
+	assert.True(t, errors.Is(alice.Rename("/carol", "/stolen"), ErrPermission))
+	assert.NoError(t, carol.Rename("/carol", "/renamed"))
+	assert.NoError(t, carol.Unlink("/renamed"))
+
+	// nodes created in a setgid directory take its group
+	require.NoError(t, alice.Chmod("/alice", 0770|os.ModeSetgid))
+	require.NoError(t, bob.Mkdir("/alice/shared"))
+	info, err = fs.Stat("/alice/shared")
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeDir|os.ModeSetgid|0755, info.Mode())
+	assert.Equal(t, uint32(1001), info.Sys().(NodeInfo).Uid)
+	assert.Equal(t, uint32(1000), info.Sys().(NodeInfo).Gid)
+}
+
+// Keeps the events written to it, for tests.
+type memorySink struct {
+	events []audit.Event
+}
+
+func (m *memorySink) Write(event audit.Event) error {
+	m.events = append(m.events, event)
+	return nil
+}
+
+func (m *memorySink) Close() error {
+	return nil
+}
+
+// Tests that renaming and removing nodes are recorded as done by the users they were done for, including attempts that
+// those users weren't permitted to make.
+func TestAuditedFilesystem(t *testing.T) {
+	base, _ := ConstructMemoryFilesystem()
+	require.NoError(t, base.Chmod("/", os.ModeSticky|0777))
+	sink := &memorySink{}
+	fs := NewAuditedFilesystem(base, audit.NewLog(apis.NoopLogger, sink), "admin@host")
+	alice := AsUser(fs, User{Uid: 1000, Gids: []uint32{1000}})
+	bob := OnBehalfOf(fs, User{Uid: 1001, Gids: []uint32{1001}})
+
+	require.NoError(t, alice.CreateAtomic("/notes", strings.NewReader("private")))
+	require.NoError(t, alice.Mkdir("/dir"))
+	assert.NoError(t, alice.Rename("/notes", "/dir/notes"))
+	carol := AsUser(fs, User{Uid: 1002, Gids: []uint32{1002}})
+	assert.True(t, errors.Is(carol.RemoveAll("/dir"), ErrPermission))
+	// bob isn't checked, so is allowed to
+	assert.NoError(t, bob.Unlink("/dir/notes"))
+	assert.NoError(t, fs.Rmdir("/dir"))
+
+	var described []string
+	for _, event := range sink.events {
+		assert.False(t, event.Time.IsZero())
+		described = append(described, fmt.Sprintf("%s %s %s %s %q", event.Actor, event.Operation, event.Path,
+			event.Dest, event.Error))
+	}
+	assert.Equal(t, []string{
+		`uid=1000 gids=[1000] Rename /notes /dir/notes ""`,
+		`uid=1002 gids=[1002] RemoveAll /dir  "permission denied: dir"`,
+		`uid=1001 gids=[1001] Unlink /dir/notes  ""`,
+		`admin@host Rmdir /dir  ""`,
+	}, described)
+	// nothing is recorded for filesystems that aren't audited
+	assert.Equal(t, base, OnBehalfOf(base, User{Uid: 1001}))
+}
@@ -0,0 +1,540 @@
+package filesystem
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	path2 "path"
+
+	"zircon/lib/apis"
+)
+
+// Checking the filesystem walks the whole tree from the root, the same way a traversal would, and confirms that every
+// chunk that a directory entry or a file index refers to exists. Each directory is read-locked while it and everything
+// below it are checked, so that the tree can't be rearranged underneath the check. Writing to a file doesn't take a
+// lock, so the check is only exact while nothing is writing to the filesystem, and repairs should only be made then.
+
+type ProblemType uint8
+
+const (
+	// A directory slot that doesn't hold a valid entry. This makes every lookup in the directory fail.
+	BADENTRY ProblemType = iota
+	// A directory entry whose chunk doesn't exist, or a page of a directory that doesn't exist, which cuts the directory
+	// short there.
+	DANGLING ProblemType = iota
+	// A file whose index refers to data chunks that don't exist, or whose length is past MaxFileSize.
+	DAMAGED ProblemType = iota
+	// A chunk that is referred to from more than one place, other than a data chunk that every file referring to it
+	// marks as shared, or a shared chunk that the share table has the wrong count for. Only the first place it was
+	// found is checked.
+	SHARED ProblemType = iota
+	// A directory whose recorded subtree size doesn't match the total length of the files below it.
+	MISSIZED ProblemType = iota
+	// A chunk that exists, but that nothing in the tree refers to.
+	UNREACHABLE ProblemType = iota
+)
+
+func (p ProblemType) String() string {
+	switch p {
+	case BADENTRY:
+		return "invalid entry"
+	case DANGLING:
+		return "dangling entry"
+	case DAMAGED:
+		return "damaged file"
+	case SHARED:
+		return "shared chunk"
+	case MISSIZED:
+		return "wrong subtree size"
+	case UNREACHABLE:
+		return "unreachable chunk"
+	default:
+		return fmt.Sprintf("problem type %d", uint8(p))
+	}
+}
+
+// An inconsistency found by Fsck.
+type Problem struct {
+	Type ProblemType
+	// Where in the tree the problem was found. Empty for UNREACHABLE chunks, which aren't anywhere in it.
+	Path   string
+	Chunk  apis.ChunkNum
+	Detail string
+	// Whether the problem was repaired or quarantined, as FsckOptions asked for.
+	Fixed bool
+}
+
+type FsckOptions struct {
+	// Fixes problems in place: invalid and dangling entries are cleared, the data chunks missing from a file become
+	// holes, recorded subtree sizes are corrected, and unreachable chunks are deleted if Offline is set. Shared chunks
+	// are only reported, since there is no telling which of the places that refer to them is the right one.
+	Repair bool
+	// If not empty, the absolute path of an existing directory that damaged files are moved into instead of being
+	// repaired in place, so that whatever can be salvaged from them is kept as it is. Unreachable chunks are not deleted
+	// in this case either, and can be looked at with OpenChunk.
+	Quarantine string
+	// Every chunk that exists, which is compared against the chunks that the tree refers to in order to find unreachable
+	// ones. If nil, unreachable chunks aren't looked for. This only makes sense when the filesystem is the only thing
+	// storing chunks in the cluster.
+	Allocated []apis.ChunkNum
+	// Promises that no other client is using the filesystem while it is checked. Unreachable chunks are only deleted
+	// when this is set, since the data chunks that a client has just allocated for a file aren't referred to by the
+	// file's index until it writes them, and would otherwise be deleted out from under it.
+	Offline bool
+}
+
+type fsckRun struct {
+	t       Traverser
+	options FsckOptions
+	report  func(Problem)
+	// the path at which each chunk was first found to be referred to
+	reached map[apis.ChunkNum]string
+	// how many file indexes were found to refer to each data chunk that they mark as shared
+	shared map[apis.ChunkNum]uint64
+	// damaged files waiting to be moved to the quarantine directory, which can't happen until the walk has released
+	// its locks
+	quarantined []Problem
+}
+
+// Checks the whole filesystem for inconsistencies between its directory tree and the chunks that the tree is stored in,
+// and reports each one found to 'report'. See FsckOptions for which problems can be repaired, and how.
+func (t Traverser) Fsck(options FsckOptions, report func(Problem)) error {
+	run := &fsckRun{
+		t:       t,
+		options: options,
+		report:  report,
+		reached: map[apis.ChunkNum]string{},
+		shared:  map[apis.ChunkNum]uint64{},
+	}
+	if options.Quarantine != "" {
+		run.options.Quarantine = path2.Clean(options.Quarantine)
+	}
+	root, err := t.Root()
+	if err != nil {
+		return err
+	}
+	run.reached[root.chunk] = "/"
+	_, found, err := run.checkDir(root, "/")
+	root.Release()
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("root directory %d: %w", root.chunk, apis.ErrNotFound)
+	}
+	for _, problem := range run.quarantined {
+		dest := path2.Join(run.options.Quarantine, quarantineName(problem))
+		err := retryConflicts(func() error {
+			return t.Move(problem.Path, dest)
+		})
+		if err != nil {
+			return fmt.Errorf("while quarantining %s: %w", problem.Path, err)
+		}
+		problem.Detail += "; moved to " + dest
+		problem.Fixed = true
+		report(problem)
+	}
+	if err := run.checkShares(); err != nil {
+		return err
+	}
+	return run.checkUnreachable()
+}
+
+// Names a quarantined file after its chunk as well as its old name, so that files from different directories don't
+// collide.
+func quarantineName(problem Problem) string {
+	name := fmt.Sprintf("%d-%s", problem.Chunk, path2.Base(problem.Path))
+	if len(name) > MaxName {
+		name = name[:MaxName]
+	}
+	return name
+}
+
+// Reports whether a chunk exists.
+func (run *fsckRun) exists(chunk apis.ChunkNum) (bool, error) {
+	_, _, err := run.t.client.Read(chunk, 0, 0)
+	if errors.Is(err, apis.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Records that 'path' refers to 'chunk', and reports it as SHARED if something else already did. Returns whether this
+// was the first reference.
+func (run *fsckRun) reach(chunk apis.ChunkNum, path string) bool {
+	if first, found := run.reached[chunk]; found {
+		run.report(Problem{
+			Type:   SHARED,
+			Path:   path,
+			Chunk:  chunk,
+			Detail: "also referred to by " + first,
+		})
+		return false
+	}
+	run.reached[chunk] = path
+	return true
+}
+
+// Like reach, but for a data chunk that a file index marks as shared, which other indexes may also refer to, as long as
+// they mark it as shared too.
+func (run *fsckRun) reachShared(chunk apis.ChunkNum, path string) bool {
+	if _, found := run.shared[chunk]; found {
+		run.shared[chunk]++
+		return false
+	}
+	if !run.reach(chunk, path) {
+		return false
+	}
+	run.shared[chunk] = 1
+	return true
+}
+
+// Checks a directory, which must be read-locked, and everything below it. Returns the total length of the files below
+// it, and whether the directory exists at all.
+func (run *fsckRun) checkDir(dir *Reference, path string) (uint64, bool, error) {
+	size := uint64(0)
+	var recorded uint64
+	var version dirVersion
+	// the slots to clear once everything below this directory has been checked, which keeps this directory's write
+	// lock from being held at the same time as one below it
+	var clear []int
+	// whether the last page that was read refers to a page that doesn't exist, which is unlinked along with the clears
+	unlink := false
+	for page := dir.chunk; page != 0; {
+		data, ver, err := run.t.client.Read(page, 0, apis.MaxChunkSize)
+		if errors.Is(err, apis.ErrNotFound) && page == dir.chunk {
+			return 0, false, nil
+		} else if errors.Is(err, apis.ErrNotFound) {
+			run.fix(&Problem{
+				Type:   DANGLING,
+				Path:   path,
+				Chunk:  page,
+				Detail: fmt.Sprintf("page %d of the directory does not exist", len(version)),
+			})
+			unlink = true
+			break
+		} else if err != nil {
+			return 0, false, err
+		}
+		if page == dir.chunk {
+			recorded = binary.LittleEndian.Uint64(data[subtreeSizeOffset:])
+		} else if !run.reach(page, path) {
+			// the rest of the chain belongs to something else, or loops back on itself
+			break
+		}
+		first := len(version) * EntryCount
+		version = append(version, dirPage{chunk: page, version: ver})
+		for i := 0; i < EntryCount; i++ {
+			entry := decode(data[i*EntrySize:i*EntrySize+EntrySize], first+i)
+			childSize, ok, err := run.checkEntry(dir, path, entry)
+			if err != nil {
+				return 0, false, err
+			}
+			if !ok {
+				clear = append(clear, entry.Index)
+			}
+			size += childSize
+		}
+		page = apis.ChunkNum(binary.LittleEndian.Uint64(data[nextPageOffset:]))
+	}
+	if run.options.Repair && (len(clear) > 0 || unlink) {
+		elevated, err := dir.elevated()
+		if err != nil {
+			return 0, false, err
+		}
+		for _, index := range clear {
+			version, err = elevated.updateEntry(version, index, Entry{Type: NONEXISTENT})
+			if err != nil {
+				elevated.Release()
+				return 0, false, err
+			}
+		}
+		if unlink {
+			last := version[len(version)-1]
+			ver, err := run.t.client.Write(last.chunk, nextPageOffset, last.version, make([]byte, 8))
+			if err != nil {
+				elevated.Release()
+				return 0, false, err
+			}
+			version[len(version)-1].version = ver
+		}
+		elevated.Release()
+	}
+	if recorded != size {
+		problem := Problem{
+			Type:   MISSIZED,
+			Path:   path,
+			Chunk:  dir.chunk,
+			Detail: fmt.Sprintf("recorded as %d bytes, but holds %d", recorded, size),
+		}
+		if run.options.Repair {
+			encoded := make([]byte, 8)
+			binary.LittleEndian.PutUint64(encoded, size)
+			if _, err := run.t.client.Write(dir.chunk, subtreeSizeOffset, version[0].version, encoded); err != nil {
+				return 0, false, fmt.Errorf("while correcting the size of %s: %w", path, err)
+			}
+			problem.Fixed = true
+		}
+		run.report(problem)
+	}
+	return size, true, nil
+}
+
+// Checks one slot of a directory, and everything below the node in it. Returns the total length of the files below
+// the node, and false if the slot should be cleared.
+func (run *fsckRun) checkEntry(dir *Reference, path string, entry Entry) (uint64, bool, error) {
+	if !entry.IsOk() {
+		run.fix(&Problem{
+			Type:   BADENTRY,
+			Path:   path,
+			Detail: fmt.Sprintf("slot %d holds type %d, chunk %d, name %q", entry.Index, entry.Type, entry.Chunk, entry.Name),
+		})
+		return 0, false, nil
+	}
+	if entry.Type == NONEXISTENT {
+		return 0, true, nil
+	}
+	child := path2.Join(path, entry.Name)
+	if !run.reach(entry.Chunk, child) {
+		// count it the same way that the sizes were maintained, without checking it again
+		childSize, err := run.t.nodeSize(entry)
+		if err != nil && !errors.Is(err, apis.ErrNotFound) {
+			return 0, false, err
+		}
+		return childSize, true, nil
+	}
+	var childSize uint64
+	found := true
+	var err error
+	switch entry.Type {
+	case DIRECTORY:
+		childSize, found, err = run.checkChildDir(dir, entry.Chunk, child)
+	case FILE:
+		childSize, found, err = run.checkFile(dir, entry.Chunk, child)
+	case SYMLINK:
+		found, err = run.exists(entry.Chunk)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if !found {
+		run.fix(&Problem{
+			Type:   DANGLING,
+			Path:   child,
+			Chunk:  entry.Chunk,
+			Detail: "chunk does not exist",
+		})
+		return 0, false, nil
+	}
+	return childSize, true, nil
+}
+
+// Reports a problem that is repaired by clearing its directory entry, which checkDir does once it is done with the
+// directory.
+func (run *fsckRun) fix(problem *Problem) {
+	problem.Fixed = run.options.Repair
+	run.report(*problem)
+}
+
+func (run *fsckRun) checkChildDir(parent *Reference, chunk apis.ChunkNum, path string) (uint64, bool, error) {
+	unlocker, err := run.t.fs.ReadLockChunk(chunk)
+	if err != nil {
+		return 0, false, err
+	}
+	var chain []apis.ChunkNum
+	if parent.chain != nil {
+		chain = append(append([]apis.ChunkNum{}, parent.chain...), chunk)
+	}
+	dir := &Reference{
+		chunk:    chunk,
+		unlocker: unlocker,
+		t:        run.t,
+		chain:    chain,
+	}
+	defer dir.Release()
+	return run.checkDir(dir, path)
+}
+
+// Checks that every data chunk in a file's index exists. Returns the length of the file, and whether its index chunk
+// exists at all.
+func (run *fsckRun) checkFile(parent *Reference, chunk apis.ChunkNum, path string) (uint64, bool, error) {
+	unlocker, err := run.t.fs.ReadLockChunk(chunk)
+	if err != nil {
+		return 0, false, err
+	}
+	file := &File{
+		chunk:    chunk,
+		unlocker: unlocker,
+		t:        run.t,
+		parents:  parent.chain,
+	}
+	defer file.Release()
+	index, err := file.readIndex(0, 0)
+	if errors.Is(err, apis.ErrNotFound) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	length := index.length
+	var details []string
+	if length > MaxFileSize {
+		details = append(details, fmt.Sprintf("length %d is past the maximum file size", length))
+		length = MaxFileSize
+	}
+	// data chunks past the end of the file are still referred to, so they have to be looked at to find unreachable ones
+	end := chunksFor(length)
+	if run.options.Allocated != nil {
+		end = MaxFileChunks
+	}
+	var missing []int
+	for first := 0; first < end; first += releaseBatch {
+		count := end - first
+		if count > releaseBatch {
+			count = releaseBatch
+		}
+		window, err := file.readIndex(first, count)
+		if err != nil {
+			return 0, false, err
+		}
+		for i := first; i < first+count; i++ {
+			data := window.chunk(i)
+			if data == 0 {
+				continue
+			} else if window.shared(i) {
+				if !run.reachShared(data, path) {
+					continue
+				}
+			} else if !run.reach(data, path) {
+				continue
+			}
+			found, err := run.exists(data)
+			if err != nil {
+				return 0, false, err
+			}
+			if !found {
+				missing = append(missing, i)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		details = append(details, fmt.Sprintf("%d data chunks do not exist, starting at offset %d", len(missing),
+			uint64(missing[0])*FileChunkSize))
+	}
+	if len(details) == 0 {
+		return index.length, true, nil
+	}
+	problem := Problem{
+		Type:   DAMAGED,
+		Path:   path,
+		Chunk:  chunk,
+		Detail: details[0],
+	}
+	for _, detail := range details[1:] {
+		problem.Detail += "; " + detail
+	}
+	if run.options.Quarantine != "" && path2.Dir(path) != run.options.Quarantine {
+		run.quarantined = append(run.quarantined, problem)
+		return index.length, true, nil
+	}
+	if run.options.Repair {
+		if err := run.repairFile(file, missing, length != index.length); err != nil {
+			return 0, false, fmt.Errorf("while repairing %s: %w", path, err)
+		}
+		problem.Fixed = true
+		run.report(problem)
+		return length, true, nil
+	}
+	run.report(problem)
+	return index.length, true, nil
+}
+
+// Turns the missing data chunks at positions 'missing' of a file's index into holes, and cuts the file's length down
+// to MaxFileSize if 'truncate' is set.
+func (run *fsckRun) repairFile(file *File, missing []int, truncate bool) error {
+	for _, i := range missing {
+		for {
+			index, err := file.readIndex(i, 1)
+			if err != nil {
+				return err
+			}
+			if data := index.chunk(i); data == 0 {
+				break
+			} else if found, err := run.exists(data); err != nil {
+				return err
+			} else if found {
+				// someone else filled it in in the meantime
+				break
+			}
+			ver, err := run.t.client.Write(file.chunk, indexEntryOffset(i), index.version, make([]byte, 8))
+			if err == nil {
+				break
+			} else if ver == 0 {
+				return err
+			}
+			// version mismatch; go around again
+		}
+	}
+	if truncate {
+		_, err := file.updateLength(MaxFileSize, false)
+		return err
+	}
+	return nil
+}
+
+// Compares the share table against how many indexes were found to refer to each shared data chunk. The table can't be
+// repaired while anything might be writing to the files that share the chunks, so mismatches are only reported.
+func (run *fsckRun) checkShares() error {
+	counts, table, err := run.t.readShares()
+	if err != nil {
+		return err
+	}
+	if table != 0 {
+		run.reach(table, "share table")
+	}
+	for chunk, found := range run.shared {
+		recorded, ok := counts[chunk]
+		if !ok {
+			// chunks that only one index refers to are left out of the table
+			recorded = 1
+		}
+		if recorded != found {
+			run.report(Problem{
+				Type:   SHARED,
+				Path:   run.reached[chunk],
+				Chunk:  chunk,
+				Detail: fmt.Sprintf("share table records %d references, but %d were found", recorded, found),
+			})
+		}
+	}
+	for chunk, recorded := range counts {
+		if _, ok := run.shared[chunk]; !ok {
+			run.report(Problem{
+				Type:   SHARED,
+				Chunk:  chunk,
+				Detail: fmt.Sprintf("share table records %d references, but none were found", recorded),
+			})
+		}
+	}
+	return nil
+}
+
+func (run *fsckRun) checkUnreachable() error {
+	for _, chunk := range run.options.Allocated {
+		if _, found := run.reached[chunk]; found {
+			continue
+		}
+		problem := Problem{
+			Type:   UNREACHABLE,
+			Chunk:  chunk,
+			Detail: "nothing in the tree refers to it",
+		}
+		if run.options.Repair && run.options.Quarantine == "" && run.options.Offline {
+			if err := run.t.client.Delete(chunk, apis.AnyVersion); err != nil && !errors.Is(err, apis.ErrNotFound) {
+				return fmt.Errorf("while deleting unreachable chunk %d: %w", chunk, err)
+			}
+			problem.Fixed = true
+		}
+		run.report(problem)
+	}
+	return nil
+}
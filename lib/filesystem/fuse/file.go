@@ -1,6 +1,7 @@
 package fuse
 
 import (
+	"zircon/apis"
 	"zircon/filesystem"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse"
@@ -10,10 +11,16 @@ import (
 
 type fuseFile struct {
 	base filesystem.WritableFile
+	// see fuseFS.logger
+	logger apis.Logger
 }
 
 var _ nodefs.File = &fuseFile{}
 
+func (f *fuseFile) status(err error) fuse.Status {
+	return errorToFuseStatus(err, f.logger)
+}
+
 func (f *fuseFile) SetInode(*nodefs.Inode) {
 	// do nothing
 }
@@ -29,14 +36,14 @@ func (f *fuseFile) InnerFile() nodefs.File {
 func (f *fuseFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
 	n, err := f.base.ReadAt(dest, off)
 	if err != nil && err != io.EOF {
-		return nil, errorToFuseStatus(err)
+		return nil, f.status(err)
 	}
 	return fuse.ReadResultData(dest[:n]), fuse.OK
 }
 
 func (f *fuseFile) Write(data []byte, off int64) (written uint32, code fuse.Status) {
 	n, err := f.base.WriteAt(data, off)
-	return uint32(n), errorToFuseStatus(err)
+	return uint32(n), f.status(err)
 }
 
 func (f *fuseFile) Flock(flags int) fuse.Status {
@@ -44,22 +51,23 @@ func (f *fuseFile) Flock(flags int) fuse.Status {
 }
 
 func (f *fuseFile) Flush() fuse.Status {
-	return fuse.OK
+	return f.status(f.base.Flush())
 }
 
 func (f *fuseFile) Release() {
-	if f.base.Close() != nil {
-		// Close() doesn't ever return non-nil errors for our thing
-		panic("should never be non-nil error!")
+	// the kernel flushes a file before releasing it, which is where a failure to write out held writes is reported to
+	// the application; anything that Close still had to write out, and failed to, can only be logged
+	if err := f.base.Close(); err != nil {
+		f.logger.Logf(apis.WARN, "could not write out a file as it was released: %v", err)
 	}
 }
 
 func (f *fuseFile) Fsync(flags int) (code fuse.Status) {
-	return fuse.OK
+	return f.status(f.base.Flush())
 }
 
 func (f *fuseFile) Truncate(size uint64) fuse.Status {
-	return errorToFuseStatus(f.base.Truncate(size))
+	return f.status(f.base.Truncate(size))
 }
 
 func (f *fuseFile) GetAttr(out *fuse.Attr) fuse.Status {
@@ -5,24 +5,40 @@ import (
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"zircon/filesystem"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
-	"log"
 	"zircon/apis"
+	"zircon/logging"
 	"path"
 	"os"
+	"errors"
+	"syscall"
+	"time"
 )
 
 type fuseFS struct {
 	pathfs.FileSystem
 	fs     filesystem.Filesystem
+	// whether each operation is checked against the permissions of the user that makes it
+	enforce bool
+	// where errors that FUSE has no status for are reported; see errorToFuseStatus
+	logger apis.Logger
 }
 
 func NewFuseFS(fs filesystem.Filesystem) *fuseFS {
 	return &fuseFS{
 		fs: fs,
 		FileSystem: pathfs.NewDefaultFileSystem(),
+		logger: logging.Default(),
 	}
 }
 
+// Like NewFuseFS, but checks each operation against the permissions of the user that makes it, for mounts that are
+// shared between users.
+func NewFuseFSWithPermissions(fs filesystem.Filesystem) *fuseFS {
+	f := NewFuseFS(fs)
+	f.enforce = true
+	return f
+}
+
 var _ pathfs.FileSystem = &fuseFS{}
 
 // Used for pretty printing.
@@ -30,17 +46,63 @@ func (f *fuseFS) String() string {
 	return "Zircon Filesystem"
 }
 
-func errorToFuseStatus(err error) fuse.Status {
+// The filesystem as it should be seen by the user that made a request.
+func (f *fuseFS) as(context *fuse.Context) filesystem.Filesystem {
+	user := filesystem.User{Uid: context.Uid, Gids: []uint32{context.Gid}}
+	if !f.enforce {
+		return filesystem.OnBehalfOf(f.fs, user)
+	}
+	return filesystem.AsUser(f.fs, user)
+}
+
+// Gives a node that was just created for a user the mode that was asked for, and makes that user its owner, unless
+// AsUser already did.
+func (f *fuseFS) created(path string, mode uint32, context *fuse.Context) error {
+	info, err := f.fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !f.enforce {
+		if err := f.fs.Chown(path, int(context.Uid), int(context.Gid)); err != nil {
+			return err
+		}
+	}
+	if info.Mode() & os.ModeSymlink != 0 {
+		return nil
+	}
+	// keep the setgid bit that a directory inherits from its parent
+	return f.fs.Chmod(path, filesystem.FileMode(mode) | info.Mode() & os.ModeSetgid)
+}
+
+// Converts an error into the status that FUSE reports for it. Errors that FUSE has no status for are reported as EIO,
+// and logged to 'logger', since what went wrong would otherwise be lost.
+func errorToFuseStatus(err error, logger apis.Logger) fuse.Status {
 	if err == nil {
 		return fuse.OK
 	}
-	if err.Error() == "no such file" {
+	if errors.Is(err, filesystem.ErrNotExist) {
 		return fuse.ENOENT
 	}
-	log.Printf("NOTE: providing default EIO result for error \"%v\"\n", err)
+	if errors.Is(err, filesystem.ErrExists) {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if errors.Is(err, filesystem.ErrPermission) {
+		return fuse.EACCES
+	}
+	if errors.Is(err, filesystem.ErrNotEmpty) {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+	if errors.Is(err, filesystem.ErrReadOnly) {
+		return fuse.Status(syscall.EROFS)
+	}
+	logger.Logf(apis.WARN, "providing default EIO result for error \"%v\"", err)
 	return fuse.EIO
 }
 
+func (f *fuseFS) status(err error) fuse.Status {
+	return errorToFuseStatus(err, f.logger)
+}
+
 	// Attributes.  This function is the main entry point, through
 	// which FUSE discovers which files and directories exist.
 	//
@@ -48,64 +110,112 @@ func errorToFuseStatus(err error) fuse.Status {
 	// return consistent non-zero FileInfo.Ino data.  Using
 	// hardlinks incurs a performance hit.
 func (f *fuseFS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
-	finfo, err := f.fs.Stat("/" + name)
+	finfo, err := f.as(context).Stat("/" + name)
 	if err != nil {
-		return nil, errorToFuseStatus(err)
+		return nil, f.status(err)
 	}
 	var links uint32 = 1
 	if finfo.IsDir() {
 		// TODO: don't do all of this just for a link count
 		entries, err := f.fs.ListDir("/" + name)
 		if err != nil {
-			return nil, errorToFuseStatus(err)
+			return nil, f.status(err)
 		}
 		links++
 		for _, ent := range entries {
 			s, err := f.fs.Stat(path.Join("/" + name, ent))
 			if err != nil {
-				return nil, errorToFuseStatus(err)
+				return nil, f.status(err)
 			}
 			if s.IsDir() {
 				links++
 			}
 		}
 	}
-	relTime := uint64(finfo.ModTime().Unix())
-	return &fuse.Attr{
+	attr := &fuse.Attr{
 		Size: uint64(finfo.Size()),
-		Atime: relTime,
-		Ctime: relTime,
-		Mtime: relTime,
 		Blksize: apis.MaxChunkSize - 4,
 		Blocks: 1,
-		Mode: uint32(finfo.Mode()),
+		Mode: filesystem.PosixMode(finfo.Mode()),
 		Nlink: links,
-		Owner: context.Owner,
-	}, fuse.OK
+		Owner: ownerOf(finfo),
+	}
+	mtime := finfo.ModTime()
+	atime, ctime := mtime, mtime
+	if node, ok := finfo.Sys().(filesystem.NodeInfo); ok {
+		atime, ctime = node.Atime, node.Ctime
+	}
+	attr.SetTimes(knownTime(atime), knownTime(mtime), knownTime(ctime))
+	return attr, fuse.OK
 }
 
-func (f *fuseFS) Truncate(name string, size uint64, context *fuse.Context) (code fuse.Status) {
-	if size > 0xFFFFFFFF {
-		return fuse.ERANGE
+// Times that aren't known, like those of a root directory that has never changed, are left as the epoch.
+func knownTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
 	}
-	return errorToFuseStatus(f.fs.Truncate("/" + name, uint32(size)))
+	return &t
+}
+
+func ownerOf(finfo os.FileInfo) fuse.Owner {
+	if node, ok := finfo.Sys().(filesystem.NodeInfo); ok {
+		return fuse.Owner{Uid: node.Uid, Gid: node.Gid}
+	}
+	return fuse.Owner{}
+}
+
+func (f *fuseFS) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	return f.status(f.as(context).Chmod("/" + name, filesystem.FileMode(mode)))
+}
+
+// An id of -1 (as a uint32) leaves that id unchanged.
+func (f *fuseFS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	return f.status(f.as(context).Chown("/" + name, int(int32(uid)), int(int32(gid))))
+}
+
+// A nil time leaves that time unchanged.
+func (f *fuseFS) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	var a, m time.Time
+	if atime != nil {
+		a = *atime
+	}
+	if mtime != nil {
+		m = *mtime
+	}
+	return f.status(f.as(context).Utimes("/" + name, a, m))
+}
+
+func (f *fuseFS) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	finfo, err := f.as(context).Stat("/" + name)
+	if err != nil || !f.enforce {
+		return f.status(err)
+	}
+	user := filesystem.User{Uid: context.Uid, Gids: []uint32{context.Gid}}
+	return f.status(filesystem.CheckAccess(finfo, user, filesystem.Access(mode & 7)))
+}
+
+func (f *fuseFS) Truncate(name string, size uint64, context *fuse.Context) (code fuse.Status) {
+	return f.status(f.as(context).Truncate("/" + name, size))
 }
 
 	// Tree structure
 func (f *fuseFS) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
-	return errorToFuseStatus(f.fs.Mkdir("/" + name))
+	if err := f.as(context).Mkdir("/" + name); err != nil {
+		return f.status(err)
+	}
+	return f.status(f.created("/" + name, mode, context))
 }
 
 func (f *fuseFS) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
-	return errorToFuseStatus(f.fs.Rename("/" + oldName, "/" + newName))
+	return f.status(f.as(context).Rename("/" + oldName, "/" + newName))
 }
 
 func (f *fuseFS) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
-	return errorToFuseStatus(f.fs.Rmdir("/" + name))
+	return f.status(f.as(context).Rmdir("/" + name))
 }
 
 func (f *fuseFS) Unlink(name string, context *fuse.Context) (code fuse.Status) {
-	return errorToFuseStatus(f.fs.Unlink("/" + name))
+	return f.status(f.as(context).Unlink("/" + name))
 }
 
 	// Called after mount.
@@ -122,9 +232,6 @@ func (f *fuseFS) OnUnmount() {
 func (f *fuseFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
 	create := (int(flags) & os.O_CREATE) != 0
 	exclusive := (int(flags) & os.O_EXCL) != 0
-	if (int(flags) & os.O_TRUNC) != 0 {
-		// TODO: needed?
-	}
 	if (int(flags) & (os.O_WRONLY | os.O_RDWR)) == (os.O_WRONLY | os.O_RDWR) {
 		return nil, fuse.EINVAL
 	}
@@ -132,14 +239,20 @@ func (f *fuseFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.
 	var file filesystem.WritableFile
 	var err error
 	if writable {
-		file, err = f.fs.OpenWrite("/" + name, create, exclusive)
+		file, err = f.as(context).OpenWrite("/" + name, create, exclusive)
 		if err != nil {
-			return nil, errorToFuseStatus(err)
+			return nil, f.status(err)
+		}
+		if (int(flags) & os.O_TRUNC) != 0 {
+			if err := file.Truncate(0); err != nil {
+				_ = file.Close()
+				return nil, f.status(err)
+			}
 		}
 	} else {
-		subfile, err := f.fs.OpenRead("/" + name)
+		subfile, err := f.as(context).OpenRead("/" + name)
 		if err != nil {
-			return nil, errorToFuseStatus(err)
+			return nil, f.status(err)
 		}
 		file = filesystem.WithErroringWrite(subfile)
 	}
@@ -148,18 +261,28 @@ func (f *fuseFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.
 	}
 	return &fuseFile{
 		base: file,
+		logger: f.logger,
 	}, fuse.OK
 }
 
 func (f *fuseFS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
-	return f.Open("/" + name, flags | uint32(os.O_CREATE) | uint32(os.O_TRUNC) | uint32(os.O_WRONLY), context)
+	_, err := f.fs.Stat("/" + name)
+	existed := err == nil
+	file, code = f.Open(name, flags | uint32(os.O_CREATE) | uint32(os.O_TRUNC) | uint32(os.O_WRONLY), context)
+	if code.Ok() && !existed {
+		if err := f.created("/" + name, mode, context); err != nil {
+			file.Release()
+			return nil, f.status(err)
+		}
+	}
+	return file, code
 }
 
 	// Directory handling
 func (f *fuseFS) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, code fuse.Status) {
-	names, err := f.fs.ListDir("/" + name)
+	names, err := f.as(context).ListDir("/" + name)
 	if err != nil {
-		return nil, errorToFuseStatus(err)
+		return nil, f.status(err)
 	}
 	var ents []fuse.DirEntry
 	for _, name := range names {
@@ -173,13 +296,16 @@ func (f *fuseFS) OpenDir(name string, context *fuse.Context) (stream []fuse.DirE
 
 	// Symlinks.
 func (f *fuseFS) Symlink(value string, linkName string, context *fuse.Context) (code fuse.Status) {
-	return errorToFuseStatus(f.fs.SymLink("/" + linkName, value))
+	if err := f.as(context).SymLink("/" + linkName, value); err != nil {
+		return f.status(err)
+	}
+	return f.status(f.created("/" + linkName, 0777, context))
 }
 
 func (f *fuseFS) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
-	link, err := f.fs.ReadLink("/" + name)
+	link, err := f.as(context).ReadLink("/" + name)
 	if err != nil {
-		return "", errorToFuseStatus(err)
+		return "", f.status(err)
 	}
 	return link, fuse.OK
 }
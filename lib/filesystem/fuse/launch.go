@@ -1,28 +1,63 @@
 package fuse
 
 import (
+	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"zircon/apis"
 	"zircon/filesystem"
+	"zircon/logging"
+	"os"
 	"time"
 )
 
 const Debug = false
 
-func MountFuse(config filesystem.Configuration) error {
-	fs, err := filesystem.NewFilesystemClient(config)
+// Connects to the cluster described by the configuration and mounts it at config.MountPoint. Nothing is served until
+// Serve is called on the result, which runs until the filesystem is unmounted. Logs to standard error as config.Logging
+// asks.
+func Mount(config filesystem.Configuration) (*fuse.Server, error) {
+	logger, err := config.Logging.NewLogger(os.Stderr)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return MountWithLogger(config, logger)
+}
 
-	pathFs := pathfs.NewPathNodeFs(NewFuseFS(fs), &pathfs.PathNodeFsOptions{
+// Like Mount, but logs to 'logger' instead.
+func MountWithLogger(config filesystem.Configuration, logger apis.Logger) (*fuse.Server, error) {
+	fs, err := filesystem.NewFilesystemClientWithLogger(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	fuseFs := NewFuseFS(fs)
+	if config.EnforcePermissions {
+		fuseFs = NewFuseFSWithPermissions(fs)
+	}
+	fuseFs.logger = logging.Component(logger, "fuse")
+	pathFs := pathfs.NewPathNodeFs(fuseFs, &pathfs.PathNodeFsOptions{
 		Debug: Debug,
 	})
-	server, _, err := nodefs.MountRoot(config.MountPoint, pathFs.Root(), &nodefs.Options{
+	// like nodefs.MountRoot, but with the mount options that sharing the mount requires
+	conn := nodefs.NewFileSystemConnector(pathFs.Root(), &nodefs.Options{
 		AttrTimeout: time.Second * 10,
 		EntryTimeout: time.Second * 10,
 		Debug: Debug,
 	})
+	server, err := fuse.NewServer(conn.RawFS(), config.MountPoint, &fuse.MountOptions{
+		// permissions are only worth checking if other users can reach the mount
+		AllowOther: config.EnforcePermissions,
+		Debug: Debug,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+func MountFuse(config filesystem.Configuration) error {
+	server, err := Mount(config)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,79 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	path2 "path"
+	"sync"
+	"time"
+
+	"zircon/lib/apis"
+)
+
+// How often a held advisory lock is renewed, so that a single missed renewal doesn't lose it.
+const lockRenewInterval = apis.AdvisoryLockTimeout / 3
+
+// Advisory locks are held by the sync servers on the chunk of a file, rather than its path, so that a lock follows the
+// file when it is renamed. A held lock is renewed in the background until it is unlocked.
+func (f *filesystem) Lock(path string, exclusive bool) (func() error, error) {
+	chunk, err := f.fileChunk(path)
+	if err != nil {
+		return nil, err
+	}
+	var lock apis.LockID
+	for {
+		lock, err = f.t.fs.s.AcquireLock(chunk, exclusive)
+		if !errors.Is(err, apis.ErrLockContended) {
+			break
+		}
+		// gave up waiting on someone else; ask again
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		ticker := time.NewTicker(lockRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// if this fails, the lock is lost anyway, and there's nobody to tell until unlock
+				if f.t.fs.s.RenewLock(lock) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() error {
+		err := fmt.Errorf("lock on %s already released", path)
+		once.Do(func() {
+			close(stop)
+			<-renewed
+			err = f.t.fs.s.ReleaseLock(lock)
+		})
+		return err
+	}, nil
+}
+
+// Finds the chunk of the file at a path.
+func (f *filesystem) fileChunk(path string) (apis.ChunkNum, error) {
+	ref, err := f.t.PathDir(path2.Dir(path))
+	if err != nil {
+		return 0, err
+	}
+	defer ref.Release()
+	file, err := ref.LookupFile(path2.Base(path))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Release()
+	return file.chunk, nil
+}
@@ -0,0 +1,166 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	path2 "path"
+	"strings"
+	"sync"
+
+	"zircon/lib/apis"
+	"zircon/lib/filesystem"
+)
+
+// Explanation of file handles:
+//     NFS clients refer to nodes by handles that the server hands out, and expect a handle to keep referring to the
+//     same node for as long as it exists, even after it has been renamed or moved, including by other clients. The
+//     handle of a node is the number of the chunk that holds it, which stays the same for the node's whole life, since
+//     renaming or moving a node only moves its entry between directories.
+//     The filesystem is reached by path, so the server keeps a table of the path each handle was last seen at, along
+//     with the handle of the directory it was in. Before a handle is used, its path is checked to still hold the same
+//     chunk. Renames made through this server update the table directly. When a node has been renamed by anyone else,
+//     it is looked for again in the directory it was last seen in, which that directory's handle is resolved for in the
+//     same way, so that renames within a directory, and nodes whose directories were moved, are followed as well.
+//     Nodes moved to another directory by another client can't be found this way, and neither can nodes whose handles
+//     were handed out before the server restarted, since the table is only kept in memory; such handles are reported
+//     as stale, and clients look their paths up again.
+
+// How many directories up resolve will go looking for a node that isn't where it was last seen.
+const maxResolveDepth = 64
+
+var errStale = errors.New("stale file handle")
+
+type handleEntry struct {
+	path   string
+	parent apis.ChunkNum
+}
+
+type handleTable struct {
+	fs   filesystem.Filesystem
+	root apis.ChunkNum
+
+	mu    sync.Mutex
+	nodes map[apis.ChunkNum]handleEntry
+}
+
+func newHandleTable(fs filesystem.Filesystem, root apis.ChunkNum, export string) *handleTable {
+	return &handleTable{
+		fs:    fs,
+		root:  root,
+		nodes: map[apis.ChunkNum]handleEntry{root: {path: export}},
+	}
+}
+
+func encodeHandle(chunk apis.ChunkNum) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(chunk))
+	return handle
+}
+
+func decodeHandle(handle []byte) (apis.ChunkNum, bool) {
+	if len(handle) != 8 {
+		return 0, false
+	}
+	return apis.ChunkNum(binary.BigEndian.Uint64(handle)), true
+}
+
+// Records that the node in 'chunk' is at 'path', inside the directory in 'parent'.
+func (h *handleTable) remember(chunk apis.ChunkNum, path string, parent apis.ChunkNum) {
+	if chunk == h.root {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nodes[chunk] = handleEntry{path: path, parent: parent}
+}
+
+func (h *handleTable) forget(chunk apis.ChunkNum) {
+	if chunk == h.root {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.nodes, chunk)
+}
+
+// Updates the paths of the node that was at 'source', and of every node below it, now that it is at 'dest'.
+func (h *handleTable) moved(source string, dest string, destParent apis.ChunkNum) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for chunk, entry := range h.nodes {
+		if entry.path == source {
+			h.nodes[chunk] = handleEntry{path: dest, parent: destParent}
+		} else if strings.HasPrefix(entry.path, source+"/") {
+			h.nodes[chunk] = handleEntry{path: dest + entry.path[len(source):], parent: entry.parent}
+		}
+	}
+}
+
+func (h *handleTable) lookup(chunk apis.ChunkNum) (handleEntry, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry, ok := h.nodes[chunk]
+	return entry, ok
+}
+
+// A node that a handle has been resolved to.
+type node struct {
+	chunk apis.ChunkNum
+	path  string
+	info  filesystem.NodeInfo
+	// what info came from
+	stat os.FileInfo
+}
+
+// Returns the node that 'chunk' refers to, with its current path, or errStale if it can't be found.
+func (h *handleTable) resolve(chunk apis.ChunkNum) (*node, error) {
+	return h.resolveDepth(chunk, 0)
+}
+
+func (h *handleTable) resolveDepth(chunk apis.ChunkNum, depth int) (*node, error) {
+	entry, ok := h.lookup(chunk)
+	if !ok {
+		return nil, errStale
+	}
+	n, err := h.stat(entry.path)
+	if err == nil && n.chunk == chunk {
+		return n, nil
+	} else if err != nil && !errors.Is(err, filesystem.ErrNotExist) {
+		return nil, err
+	}
+	if chunk == h.root || entry.parent == 0 || depth >= maxResolveDepth {
+		return nil, errStale
+	}
+	// renamed or moved by someone else; look for it where it was last seen
+	parent, err := h.resolveDepth(entry.parent, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	names, err := h.fs.ListDir(parent.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		n, err := h.stat(path2.Join(parent.path, name))
+		if err == nil && n.chunk == chunk {
+			h.remember(chunk, n.path, parent.chunk)
+			return n, nil
+		}
+	}
+	h.forget(chunk)
+	return nil, errStale
+}
+
+// Looks up the node at 'path', without consulting or updating the table.
+func (h *handleTable) stat(path string) (*node, error) {
+	info, err := h.fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	nodeInfo, err := nodeOf(info)
+	if err != nil {
+		return nil, err
+	}
+	return &node{chunk: nodeInfo.Chunk, path: path, info: nodeInfo, stat: info}, nil
+}
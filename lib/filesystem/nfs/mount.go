@@ -0,0 +1,81 @@
+package nfs
+
+import (
+	path2 "path"
+	"strings"
+)
+
+// The MOUNT protocol, version 3, which clients use to get the handle of the directory they mount.
+
+const programMount = 100005
+
+const (
+	mountOK          = 0
+	mountNoEnt       = 2
+	mountAccess      = 13
+	mountNotDir      = 20
+	mountServerFault = 10006
+)
+
+// The longest path a client can ask to mount.
+const maxMountPath = 1024
+
+var mountProcedures = []procedure{
+	0: func(s *Server, c *call, results *xdrWriter) error { return nil },
+	1: (*Server).mount,
+	// no record of which clients have mounted what is kept, so there is nothing to list
+	2: func(s *Server, c *call, results *xdrWriter) error {
+		results.bool(false)
+		return nil
+	},
+	3: func(s *Server, c *call, results *xdrWriter) error {
+		c.args.string(maxMountPath)
+		return c.args.err
+	},
+	4: func(s *Server, c *call, results *xdrWriter) error { return nil },
+	5: (*Server).exports,
+}
+
+// Returns the handle of the exported directory, or of a directory inside it.
+func (s *Server) mount(c *call, results *xdrWriter) error {
+	dir := c.args.string(maxMountPath)
+	if c.args.err != nil {
+		return c.args.err
+	}
+	dir = path2.Clean("/" + dir)
+	if dir != s.export && !strings.HasPrefix(dir, strings.TrimSuffix(s.export, "/")+"/") {
+		results.uint32(mountAccess)
+		return nil
+	}
+	n, err := s.handles.stat(dir)
+	if err != nil {
+		if status := s.statusOf(err); status == nfsErrNoEnt {
+			results.uint32(mountNoEnt)
+		} else {
+			results.uint32(mountServerFault)
+		}
+		return nil
+	}
+	if !n.stat.IsDir() {
+		results.uint32(mountNotDir)
+		return nil
+	}
+	if dir != s.export {
+		// reached without going through its parent, so it can only be found by its path
+		s.handles.remember(n.chunk, dir, 0)
+	}
+	results.uint32(mountOK)
+	results.opaque(encodeHandle(n.chunk))
+	results.uint32(1)
+	results.uint32(authUnix)
+	return nil
+}
+
+func (s *Server) exports(c *call, results *xdrWriter) error {
+	results.bool(true)
+	results.string(s.export)
+	// no groups: anyone may mount it
+	results.bool(false)
+	results.bool(false)
+	return nil
+}
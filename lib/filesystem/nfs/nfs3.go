@@ -0,0 +1,1018 @@
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	path2 "path"
+	"strings"
+	"time"
+
+	"zircon/lib/apis"
+	"zircon/lib/filesystem"
+)
+
+// The procedures of NFS version 3, as translated onto the filesystem.
+
+const programNFS = 100003
+
+// The most data a single READ or WRITE transfers.
+const maxTransfer = 1 << 20
+
+// The largest file handle that the protocol allows.
+const maxHandle = 64
+
+// Names and paths longer than these are rejected while decoding, before they are checked against the filesystem.
+const (
+	maxNameArg = 255
+	maxPathArg = 4096
+)
+
+type nfsStatus uint32
+
+const (
+	nfsOK             nfsStatus = 0
+	nfsErrNoEnt       nfsStatus = 2
+	nfsErrIO          nfsStatus = 5
+	nfsErrAccess      nfsStatus = 13
+	nfsErrExist       nfsStatus = 17
+	nfsErrNotDir      nfsStatus = 20
+	nfsErrIsDir       nfsStatus = 21
+	nfsErrInval       nfsStatus = 22
+	nfsErrRoFs        nfsStatus = 30
+	nfsErrNameTooLong nfsStatus = 63
+	nfsErrNotEmpty    nfsStatus = 66
+	nfsErrStale       nfsStatus = 70
+	nfsErrBadHandle   nfsStatus = 10001
+	nfsErrNotSupp     nfsStatus = 10004
+	nfsErrTooSmall    nfsStatus = 10005
+)
+
+func (e nfsStatus) Error() string {
+	return fmt.Sprintf("NFS status %d", uint32(e))
+}
+
+const (
+	typeRegular   = 1
+	typeDirectory = 2
+	typeSymlink   = 5
+)
+
+// Writes are written out before they are acknowledged.
+const stableFileSync = 2
+
+// Converts an error into the status that NFS reports for it. Errors that NFS has no status for are reported as
+// NFS3ERR_IO, and logged, since what went wrong would otherwise be lost.
+func (s *Server) statusOf(err error) nfsStatus {
+	var status nfsStatus
+	switch {
+	case err == nil:
+		return nfsOK
+	case errors.As(err, &status):
+		return status
+	case errors.Is(err, errStale):
+		return nfsErrStale
+	case errors.Is(err, filesystem.ErrNotExist):
+		return nfsErrNoEnt
+	case errors.Is(err, filesystem.ErrExists):
+		return nfsErrExist
+	case errors.Is(err, filesystem.ErrPermission):
+		return nfsErrAccess
+	case errors.Is(err, filesystem.ErrNotEmpty):
+		return nfsErrNotEmpty
+	case errors.Is(err, filesystem.ErrReadOnly):
+		return nfsErrRoFs
+	default:
+		s.logger.Logf(apis.WARN, "providing default NFS3ERR_IO result for error \"%v\"", err)
+		return nfsErrIO
+	}
+}
+
+// Checks a name that a node is to be looked up, created, or removed by.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return nfsErrInval
+	}
+	if len(name) > filesystem.MaxName {
+		return nfsErrNameTooLong
+	}
+	return nil
+}
+
+var nfsProcedures = []procedure{
+	0:  func(s *Server, c *call, results *xdrWriter) error { return nil },
+	1:  (*Server).getattr,
+	2:  (*Server).setattr,
+	3:  (*Server).lookup,
+	4:  (*Server).access,
+	5:  (*Server).readlink,
+	6:  (*Server).read,
+	7:  (*Server).write,
+	8:  (*Server).create,
+	9:  (*Server).mkdir,
+	10: (*Server).symlink,
+	11: (*Server).mknod,
+	12: (*Server).remove,
+	13: (*Server).rmdir,
+	14: (*Server).rename,
+	15: (*Server).link,
+	16: func(s *Server, c *call, results *xdrWriter) error { return s.readdir(c, results, false) },
+	17: func(s *Server, c *call, results *xdrWriter) error { return s.readdir(c, results, true) },
+	18: (*Server).fsstat,
+	19: (*Server).fsinfo,
+	20: (*Server).pathconf,
+	21: (*Server).commit,
+}
+
+func readHandle(r *xdrReader) (apis.ChunkNum, bool) {
+	return decodeHandle(r.opaque(maxHandle))
+}
+
+// Finds the node for a handle decoded by readHandle.
+func (s *Server) resolve(chunk apis.ChunkNum, valid bool) (*node, error) {
+	if !valid {
+		return nil, nfsErrBadHandle
+	}
+	return s.handles.resolve(chunk)
+}
+
+// Like resolve, but fails with NFS3ERR_NOTDIR unless the node is a directory.
+func (s *Server) resolveDir(chunk apis.ChunkNum, valid bool) (*node, error) {
+	n, err := s.resolve(chunk, valid)
+	if err == nil && n.info.Type != filesystem.DIRECTORY {
+		return n, nfsErrNotDir
+	}
+	return n, err
+}
+
+// Looks a node up again after changing it, for the attributes to report. Returns nil if it can't be found, in which
+// case no attributes are reported.
+func (s *Server) restat(n *node) *node {
+	if n == nil {
+		return nil
+	}
+	updated, err := s.handles.stat(n.path)
+	if err != nil || updated.chunk != n.chunk {
+		return nil
+	}
+	return updated
+}
+
+// Encodes fattr3.
+func (s *Server) writeAttrs(w *xdrWriter, c *call, n *node) {
+	mode := filesystem.PosixMode(n.stat.Mode()) & 07777
+	switch n.info.Type {
+	case filesystem.DIRECTORY:
+		w.uint32(typeDirectory)
+	case filesystem.SYMLINK:
+		w.uint32(typeSymlink)
+	default:
+		w.uint32(typeRegular)
+	}
+	w.uint32(mode)
+	// counting the subdirectories of a directory would take a stat of every node in it; a link count of one tells
+	// tools like find that it isn't known
+	w.uint32(1)
+	w.uint32(n.info.Uid)
+	w.uint32(n.info.Gid)
+	w.uint64(uint64(n.stat.Size()))
+	w.uint64(uint64(n.stat.Size()))
+	w.uint32(0) // rdev
+	w.uint32(0)
+	w.uint64(uint64(s.handles.root))
+	w.uint64(uint64(n.chunk))
+	writeTime(w, n.info.Atime)
+	writeTime(w, n.stat.ModTime())
+	writeTime(w, n.info.Ctime)
+}
+
+// Encodes nfstime3. Times that aren't known, like those of a root directory that has never changed, are sent as the
+// epoch.
+func writeTime(w *xdrWriter, t time.Time) {
+	if t.IsZero() {
+		w.uint32(0)
+		w.uint32(0)
+		return
+	}
+	w.uint32(uint32(t.Unix()))
+	w.uint32(uint32(t.Nanosecond()))
+}
+
+// Encodes post_op_attr, which is empty if 'n' is nil.
+func (s *Server) writePostOp(w *xdrWriter, c *call, n *node) {
+	w.bool(n != nil)
+	if n != nil {
+		s.writeAttrs(w, c, n)
+	}
+}
+
+// Encodes wcc_data, with only the attributes after the change.
+func (s *Server) writeWcc(w *xdrWriter, c *call, after *node) {
+	w.bool(false)
+	s.writePostOp(w, c, after)
+}
+
+// Encodes post_op_fh3 followed by post_op_attr, and the wcc_data of the directory, for a newly created node.
+func (s *Server) writeCreated(w *xdrWriter, c *call, created *node, dir *node) {
+	w.uint32(uint32(nfsOK))
+	w.bool(created != nil)
+	if created != nil {
+		w.opaque(encodeHandle(created.chunk))
+	}
+	s.writePostOp(w, c, created)
+	s.writeWcc(w, c, s.restat(dir))
+}
+
+type setAttrs struct {
+	mode *uint32
+	uid  *uint32
+	gid  *uint32
+	size *uint64
+	// zero to leave unchanged
+	atime time.Time
+	mtime time.Time
+}
+
+const (
+	timeDontChange = 0
+	timeServer     = 1
+	timeClient     = 2
+)
+
+// Decodes sattr3.
+func readSetAttrs(r *xdrReader) setAttrs {
+	var attrs setAttrs
+	for _, field := range []**uint32{&attrs.mode, &attrs.uid, &attrs.gid} {
+		if r.bool() {
+			value := r.uint32()
+			*field = &value
+		}
+	}
+	if r.bool() {
+		size := r.uint64()
+		attrs.size = &size
+	}
+	for _, field := range []*time.Time{&attrs.atime, &attrs.mtime} {
+		switch r.uint32() {
+		case timeServer:
+			*field = time.Now()
+		case timeClient:
+			seconds := r.uint32()
+			nanos := r.uint32()
+			*field = time.Unix(int64(seconds), int64(nanos))
+		}
+	}
+	return attrs
+}
+
+func (s *Server) getattr(c *call, results *xdrWriter) error {
+	chunk, valid := readHandle(c.args)
+	if c.args.err != nil {
+		return c.args.err
+	}
+	n, err := s.resolve(chunk, valid)
+	if err != nil {
+		results.uint32(uint32(s.statusOf(err)))
+		return nil
+	}
+	results.uint32(uint32(nfsOK))
+	s.writeAttrs(results, c, n)
+	return nil
+}
+
+func (s *Server) setattr(c *call, results *xdrWriter) error {
+	chunk, valid := readHandle(c.args)
+	attrs := readSetAttrs(c.args)
+	if c.args.bool() {
+		// the guard, which would only be meaningful if ctime changed
+		c.args.uint32()
+		c.args.uint32()
+	}
+	if c.args.err != nil {
+		return c.args.err
+	}
+	n, err := s.resolve(chunk, valid)
+	if err == nil {
+		err = s.setAttrs(s.as(c), n, attrs)
+	}
+	results.uint32(uint32(s.statusOf(err)))
+	s.writeWcc(results, c, s.restat(n))
+	return nil
+}
+
+func (s *Server) setAttrs(fs filesystem.Filesystem, n *node, attrs setAttrs) error {
+	if attrs.size != nil {
+		if n.info.Type != filesystem.FILE {
+			return nfsErrInval
+		}
+		if err := fs.Truncate(n.path, *attrs.size); err != nil {
+			return err
+		}
+	}
+	if attrs.uid != nil || attrs.gid != nil {
+		uid, gid := -1, -1
+		if attrs.uid != nil {
+			uid = int(*attrs.uid)
+		}
+		if attrs.gid != nil {
+			gid = int(*attrs.gid)
+		}
+		if err := fs.Chown(n.path, uid, gid); err != nil {
+			return err
+		}
+	}
+	if attrs.mode != nil {
+		if err := fs.Chmod(n.path, filesystem.FileMode(*attrs.mode)); err != nil {
+			return err
+		}
+	}
+	if !attrs.atime.IsZero() || !attrs.mtime.IsZero() {
+		return fs.Utimes(n.path, attrs.atime, attrs.mtime)
+	}
+	return nil
+}
+
+func (s *Server) lookup(c *call, results *xdrWriter) error {
+	chunk, valid := readHandle(c.args)
+	name := c.args.string(maxNameArg)
+	if c.args.err != nil {
+		return c.args.err
+	}
+	dir, err := s.resolveDir(chunk, valid)
+	if err == nil && s.enforce {
+		err = filesystem.CheckAccess(dir.stat, userOf(c), filesystem.AccessExecute)
+	}
+	var target *node
+	if err == nil {
+		target, err = s.lookupIn(dir, name)
+	}
+	if err != nil {
+		results.uint32(uint32(s.statusOf(err)))
+		s.writePostOp(results, c, dir)
+		return nil
+	}
+	results.uint32(uint32(nfsOK))
+	results.opaque(encodeHandle(target.chunk))
+	s.writePostOp(results, c, target)
+	s.writePostOp(results, c, dir)
+	return nil
+}
+
+// Finds the node called 'name' in 'dir', including "." and "..", and records its handle.
+func (s *Server) lookupIn(dir *node, name string) (*node, error) {
+	switch name {
+	case ".":
+		return dir, nil
+	case "..":
+		return s.parentOf(dir)
+	}
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	target, err := s.handles.stat(path2.Join(dir.path, name))
+	if err != nil {
+		return nil, err
+	}
+	s.handles.remember(target.chunk, target.path, dir.chunk)
+	return target, nil
+}
+
+// Returns the directory that 'dir' is in, or 'dir' itself if it is the exported directory, so that clients can't go
+// above it.
+func (s *Server) parentOf(dir *node) (*node, error) {
+	if dir.chunk == s.handles.root {
+		return dir, nil
+	}
+	if entry, ok := s.handles.lookup(dir.chunk); ok && entry.parent != 0 {
+		return s.handles.resolve(entry.parent)
+	}
+	parent, err := s.handles.stat(path2.Dir(dir.path))
+	if err != nil {
+		return nil, err
+	}
+	s.handles.remember(parent.chunk, parent.path, 0)
+	return parent, nil
+}
+
+func (s *Server) access(c *call, results *xdrWriter) error {
+	chunk, valid := readHandle(c.args)
+	requested := c.args.uint32()
+	if c.args.err != nil {
+		return c.args.err
+	}
+	n, err := s.resolve(chunk, valid)
+	results.uint32(uint32(s.statusOf(err)))
+	s.writePostOp(results, c, n)
+	if err == nil {
+		results.uint32(s.allowed(c, n, requested))
+	}
+	return nil
+}
+
+// The bits of an ACCESS request.
+const (
+	accessRead    = 0x01
+	accessLookup  = 0x02
+	accessModify  = 0x04
+	accessExtend  = 0x08
+	accessDelete  = 0x10
+	accessExecute = 0x20
+)
+
+// Which of the 'requested' kinds of access the user that made a call has to 'n'.
+func (s *Server) allowed(c *call, n *node, requested uint32) uint32 {
+	if !s.enforce {
+		return requested
+	}
+	var allowed uint32
+	for bit, access := range map[uint32]filesystem.Access{
+		accessRead:    filesystem.AccessRead,
+		accessLookup:  filesystem.AccessExecute,
+		accessModify:  filesystem.AccessWrite,
+		accessExtend:  filesystem.AccessWrite,
+		accessDelete:  filesystem.AccessWrite,
+		accessExecute: filesystem.AccessExecute,
+	} {
+		if requested&bit != 0 && filesystem.CheckAccess(n.stat, userOf(c), access) == nil {
+			allowed |= bit
+		}
+	}
+	return allowed
+}
+
+func (s *Server) readlink(c *call, results *xdrWriter) error {
+	chunk, valid := readHandle(c.args)
+	if c.args.err != nil {
+		return c.args.err
+	}
+	n, err := s.resolve(chunk, valid)
+	var target string
+	if err == nil {
+		if n.info.Type != filesystem.SYMLINK {
+			err = nfsErrInval
+		} else {
+			target, err = s.as(c).ReadLink(n.path)
+		}
+	}
+	results.uint32(uint32(s.statusOf(err)))
+	s.writePostOp(results, c, n)
+	if err == nil {
+		results.string(target)
+	}
+	return nil
+}
+
+func (s *Server) read(c *call, results *xdrWriter) error {
+	chunk, valid := readHandle(c.args)
+	offset := c.args.uint64()
+	count := c.args.uint32()
+	if c.args.err != nil {
+		return c.args.err
+	}
+	if count > maxTransfer {
+		count = maxTransfer
+	}
+	n, err := s.resolve(chunk, valid)
+	var data []byte
+	if err == nil {
+		data, err = s.readFile(s.as(c), n, offset, count)
+	}
+	results.uint32(uint32(s.statusOf(err)))
+	s.writePostOp(results, c, n)
+	if err == nil {
+		results.uint32(uint32(len(data)))
+		results.bool(offset+uint64(len(data)) >= uint64(n.stat.Size()))
+		results.opaque(data)
+	}
+	return nil
+}
+
+func (s *Server) readFile(fs filesystem.Filesystem, n *node, offset uint64, count uint32) ([]byte, error) {
+	if n.info.Type == filesystem.DIRECTORY {
+		return nil, nfsErrIsDir
+	} else if n.info.Type != filesystem.FILE {
+		return nil, nfsErrInval
+	}
+	file, err := fs.OpenRead(n.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data := make([]byte, count)
+	read, err := file.ReadAt(data, int64(offset))
+	if err == io.EOF {
+		err = nil
+	}
+	return data[:read], err
+}
+
+func (s *Server) write(c *call, results *xdrWriter) error {
+	chunk, valid := readHandle(c.args)
+	offset := c.args.uint64()
+	c.args.uint32() // count, which is the length of the data
+	c.args.uint32() // stable, which doesn't matter, since every write is written out before it is acknowledged
+	data := c.args.opaque(maxTransfer)
+	if c.args.err != nil {
+		return c.args.err
+	}
+	n, err := s.resolve(chunk, valid)
+	if err == nil {
+		err = s.writeFile(s.as(c), n, offset, data)
+	}
+	results.uint32(uint32(s.statusOf(err)))
+	s.writeWcc(results, c, s.restat(n))
+	if err == nil {
+		results.uint32(uint32(len(data)))
+		results.uint32(stableFileSync)
+		results.fixed(s.verifier[:])
+	}
+	return nil
+}
+
+func (s *Server) writeFile(fs filesystem.Filesystem, n *node, offset uint64, data []byte) error {
+	if n.info.Type == filesystem.DIRECTORY {
+		return nfsErrIsDir
+	} else if n.info.Type != filesystem.FILE {
+		return nfsErrInval
+	}
+	file, err := fs.OpenWrite(n.path, false, false)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(data, int64(offset)); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Decodes the arguments that say where to create a node, and finds the directory and the path within it.
+func (s *Server) readWhere(c *call) (chunk apis.ChunkNum, valid bool, name string) {
+	chunk, valid = readHandle(c.args)
+	name = c.args.string(maxNameArg)
+	return chunk, valid, name
+}
+
+func (s *Server) prepareCreate(chunk apis.ChunkNum, valid bool, name string) (*node, string, error) {
+	dir, err := s.resolveDir(chunk, valid)
+	if err != nil {
+		return dir, "", err
+	}
+	if err := checkName(name); err != nil {
+		return dir, "", err
+	}
+	return dir, path2.Join(dir.path, name), nil
+}
+
+// Finishes a CREATE, MKDIR or SYMLINK that made the node at 'path' in 'dir', or failed to. The node is given the
+// mode and times in 'attrs', if any, and belongs to the user that made the call.
+func (s *Server) finishCreate(c *call, results *xdrWriter, dir *node, path string, attrs setAttrs, err error) error {
+	var created *node
+	if err == nil {
+		created, err = s.handles.stat(path)
+	}
+	if err == nil {
+		if !s.enforce {
+			// otherwise AsUser already did this
+			err = s.fs.Chown(path, int(c.uid), int(c.gid))
+		}
+		if err == nil && attrs.mode != nil && created.info.Type != filesystem.SYMLINK {
+			// keep the setgid bit that a directory inherits from its parent
+			mode := filesystem.FileMode(*attrs.mode) | created.stat.Mode()&os.ModeSetgid
+			err = s.fs.Chmod(path, mode)
+		}
+		if err == nil && (!attrs.atime.IsZero() || !attrs.mtime.IsZero()) {
+			err = s.fs.Utimes(path, attrs.atime, attrs.mtime)
+		}
+		if err == nil {
+			created = s.restat(created)
+		}
+	}
+	if err != nil {
+		results.uint32(uint32(s.statusOf(err)))
+		s.writeWcc(results, c, s.restat(dir))
+		return nil
+	}
+	s.handles.remember(created.chunk, path, dir.chunk)
+	s.writeCreated(results, c, created, dir)
+	return nil
+}
+
+const (
+	createUnchecked = 0
+	createGuarded   = 1
+	createExclusive = 2
+)
+
+func (s *Server) create(c *call, results *xdrWriter) error {
+	chunk, valid, name := s.readWhere(c)
+	how := c.args.uint32()
+	var attrs setAttrs
+	if how == createExclusive {
+		// the verifier would be stored with the file to recognize a retried CREATE, which there is nowhere to keep;
+		// a retry of a CREATE that succeeded fails with NFS3ERR_EXIST instead
+		c.args.fixed(8)
+	} else {
+		attrs = readSetAttrs(c.args)
+	}
+	if c.args.err != nil {
+		return c.args.err
+	}
+	dir, path, err := s.prepareCreate(chunk, valid, name)
+	if err == nil {
+		var file filesystem.WritableFile
+		file, err = s.as(c).OpenWrite(path, true, how != createUnchecked)
+		if err == nil {
+			if attrs.size != nil {
+				err = file.Truncate(*attrs.size)
+			}
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	// the size is already set, and ownership is always the caller's
+	return s.finishCreate(c, results, dir, path, setAttrs{mode: attrs.mode, atime: attrs.atime, mtime: attrs.mtime}, err)
+}
+
+func (s *Server) mkdir(c *call, results *xdrWriter) error {
+	chunk, valid, name := s.readWhere(c)
+	attrs := readSetAttrs(c.args)
+	if c.args.err != nil {
+		return c.args.err
+	}
+	dir, path, err := s.prepareCreate(chunk, valid, name)
+	if err == nil {
+		err = s.as(c).Mkdir(path)
+	}
+	return s.finishCreate(c, results, dir, path, attrs, err)
+}
+
+func (s *Server) symlink(c *call, results *xdrWriter) error {
+	chunk, valid, name := s.readWhere(c)
+	attrs := readSetAttrs(c.args)
+	target := c.args.string(maxPathArg)
+	if c.args.err != nil {
+		return c.args.err
+	}
+	dir, path, err := s.prepareCreate(chunk, valid, name)
+	if err == nil {
+		if len(target) > filesystem.MaxSymLinkSize {
+			err = nfsErrNameTooLong
+		} else {
+			err = s.as(c).SymLink(path, target)
+		}
+	}
+	return s.finishCreate(c, results, dir, path, attrs, err)
+}
+
+// Device files, sockets and pipes can't be stored.
+func (s *Server) mknod(c *call, results *xdrWriter) error {
+	results.uint32(uint32(nfsErrNotSupp))
+	s.writeWcc(results, c, nil)
+	return nil
+}
+
+// Hard links can't be stored, since each node is in exactly one directory.
+func (s *Server) link(c *call, results *xdrWriter) error {
+	results.uint32(uint32(nfsErrNotSupp))
+	s.writePostOp(results, c, nil)
+	s.writeWcc(results, c, nil)
+	return nil
+}
+
+func (s *Server) remove(c *call, results *xdrWriter) error {
+	return s.removeNode(c, results, false)
+}
+
+func (s *Server) rmdir(c *call, results *xdrWriter) error {
+	return s.removeNode(c, results, true)
+}
+
+func (s *Server) removeNode(c *call, results *xdrWriter, rmdir bool) error {
+	chunk, valid, name := s.readWhere(c)
+	if c.args.err != nil {
+		return c.args.err
+	}
+	dir, path, err := s.prepareCreate(chunk, valid, name)
+	var target *node
+	if err == nil {
+		target, err = s.handles.stat(path)
+	}
+	if err == nil {
+		err = s.removePath(s.as(c), target, rmdir)
+	}
+	results.uint32(uint32(s.statusOf(err)))
+	s.writeWcc(results, c, s.restat(dir))
+	return nil
+}
+
+// Removes a node that is about to be removed or replaced, checking its type first, since the filesystem's errors
+// don't say when a removal failed because the node was of the wrong type.
+func (s *Server) removePath(fs filesystem.Filesystem, target *node, rmdir bool) error {
+	isDir := target.info.Type == filesystem.DIRECTORY
+	if rmdir && !isDir {
+		return nfsErrNotDir
+	} else if !rmdir && isDir {
+		return nfsErrIsDir
+	}
+	var err error
+	if rmdir {
+		err = fs.Rmdir(target.path)
+	} else {
+		err = fs.Unlink(target.path)
+	}
+	if err != nil {
+		return err
+	}
+	s.handles.forget(target.chunk)
+	return nil
+}
+
+func (s *Server) rename(c *call, results *xdrWriter) error {
+	fromChunk, fromValid, fromName := s.readWhere(c)
+	toChunk, toValid, toName := s.readWhere(c)
+	if c.args.err != nil {
+		return c.args.err
+	}
+	fromDir, source, err := s.prepareCreate(fromChunk, fromValid, fromName)
+	var toDir *node
+	var dest string
+	if err == nil {
+		toDir, dest, err = s.prepareCreate(toChunk, toValid, toName)
+	}
+	if err == nil {
+		err = s.renamePath(s.as(c), source, dest, toDir)
+	}
+	results.uint32(uint32(s.statusOf(err)))
+	s.writeWcc(results, c, s.restat(fromDir))
+	s.writeWcc(results, c, s.restat(toDir))
+	return nil
+}
+
+// Renames the node at 'source' to 'dest', replacing whatever is at 'dest', as NFS requires. The filesystem refuses to
+// rename onto an existing node, so the node being replaced is removed first, which leaves a moment in which neither is
+// at 'dest'.
+func (s *Server) renamePath(fs filesystem.Filesystem, source string, dest string, toDir *node) error {
+	if source == dest {
+		return nil
+	}
+	moving, err := s.handles.stat(source)
+	if err != nil {
+		return err
+	}
+	if moving.info.Type == filesystem.DIRECTORY && strings.HasPrefix(dest, source+"/") {
+		// into itself
+		return nfsErrInval
+	}
+	replaced, err := s.handles.stat(dest)
+	if err == nil {
+		if replaced.chunk == moving.chunk {
+			return nil
+		}
+		movingDir, replacedDir := moving.info.Type == filesystem.DIRECTORY, replaced.info.Type == filesystem.DIRECTORY
+		if movingDir && !replacedDir {
+			return nfsErrNotDir
+		} else if !movingDir && replacedDir {
+			return nfsErrIsDir
+		}
+		if err := s.removePath(fs, replaced, replacedDir); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, filesystem.ErrNotExist) {
+		return err
+	}
+	if err := fs.Rename(source, dest); err != nil {
+		return err
+	}
+	s.handles.moved(source, dest, toDir.chunk)
+	return nil
+}
+
+// The cookies of "." and "..". The cookie of every other node is the cursor that continues a listing of its directory
+// just after it, plus cookieOffset, so that a listing that is continued after nodes have been removed or added carries
+// on from the same place.
+const (
+	cookieDot    = 1
+	cookieDotDot = 2
+	cookieOffset = 3
+)
+
+// How many nodes are listed from the filesystem at a time while filling a READDIR or READDIRPLUS reply.
+const readdirBatch = 256
+
+// Roughly how many bytes of a READDIR or READDIRPLUS reply go to each entry, besides its name, and to the rest of the
+// reply, for keeping within the size the client asks for.
+const (
+	direntSize     = 24
+	direntPlusSize = direntSize + 100
+	readdirHeader  = 128
+)
+
+type dirent struct {
+	cookie uint64
+	name   string
+	node   *node
+}
+
+func (s *Server) readdir(c *call, results *xdrWriter, plus bool) error {
+	chunk, valid := readHandle(c.args)
+	cookie := c.args.uint64()
+	c.args.fixed(8) // the cookie verifier, which isn't needed, since cookies stay valid across changes
+	limit := c.args.uint32()
+	if plus {
+		// dircount, which only counts the parts of entries without attributes or handles, and maxcount
+		limit = c.args.uint32()
+	}
+	if c.args.err != nil {
+		return c.args.err
+	}
+	dir, err := s.resolveDir(chunk, valid)
+	var parent *node
+	if err == nil {
+		parent, err = s.parentOf(dir)
+	}
+	if err != nil {
+		results.uint32(uint32(s.statusOf(err)))
+		s.writePostOp(results, c, dir)
+		return nil
+	}
+
+	var pending []dirent
+	if cookie < cookieDot {
+		pending = append(pending, dirent{cookie: cookieDot, name: ".", node: dir})
+	}
+	if cookie < cookieDotDot {
+		pending = append(pending, dirent{cookie: cookieDotDot, name: "..", node: parent})
+	}
+	cursor := uint64(0)
+	if cookie > cookieOffset {
+		cursor = cookie - cookieOffset
+	}
+	more := true
+	body := &xdrWriter{}
+	size, written, eof := readdirHeader, 0, true
+fill:
+	for {
+		for _, entry := range pending {
+			entrySize := direntSize + len(entry.name)
+			if plus {
+				entrySize = direntPlusSize + len(entry.name)
+			}
+			if size+entrySize > int(limit) {
+				eof = false
+				break fill
+			}
+			size += entrySize
+			written++
+			body.bool(true)
+			body.uint64(uint64(entry.node.chunk))
+			body.string(entry.name)
+			body.uint64(entry.cookie)
+			if plus {
+				s.writePostOp(body, c, entry.node)
+				body.bool(true)
+				body.opaque(encodeHandle(entry.node.chunk))
+			}
+		}
+		if !more {
+			break
+		}
+		pending, cursor, err = s.listDir(s.as(c), dir, cursor, plus)
+		if err != nil {
+			results.uint32(uint32(s.statusOf(err)))
+			s.writePostOp(results, c, dir)
+			return nil
+		}
+		more = cursor != 0
+	}
+	if written == 0 && !eof {
+		results.uint32(uint32(nfsErrTooSmall))
+		s.writePostOp(results, c, dir)
+		return nil
+	}
+	results.uint32(uint32(nfsOK))
+	s.writePostOp(results, c, dir)
+	results.fixed(make([]byte, 8))
+	results.Write(body.Bytes())
+	results.bool(false)
+	results.bool(eof)
+	return nil
+}
+
+// Lists the next batch of nodes in 'dir' from 'cursor', and records their handles. Their attributes are only looked up
+// if 'plus' is set, since READDIR doesn't need them. Returns the cursor to continue from, which is zero at the end.
+func (s *Server) listDir(fs filesystem.Filesystem, dir *node, cursor uint64, plus bool) ([]dirent, uint64, error) {
+	listed, next, err := fs.ReadDir(dir.path, cursor, readdirBatch)
+	if err != nil {
+		return nil, 0, err
+	}
+	var entries []dirent
+	for _, entry := range listed {
+		path := path2.Join(dir.path, entry.Name)
+		n := &node{chunk: entry.Chunk, path: path}
+		if plus {
+			n, err = s.handles.stat(path)
+			if errors.Is(err, filesystem.ErrNotExist) {
+				// removed since it was listed
+				continue
+			} else if err != nil {
+				return nil, 0, err
+			}
+		}
+		s.handles.remember(n.chunk, n.path, dir.chunk)
+		entries = append(entries, dirent{cookie: entry.Cursor + cookieOffset, name: entry.Name, node: n})
+	}
+	return entries, next, nil
+}
+
+func (s *Server) fsstat(c *call, results *xdrWriter) error {
+	chunk, valid := readHandle(c.args)
+	if c.args.err != nil {
+		return c.args.err
+	}
+	n, err := s.resolve(chunk, valid)
+	var info filesystem.DirInfo
+	if err == nil {
+		info, err = s.fs.StatDir(s.export)
+	}
+	results.uint32(uint32(s.statusOf(err)))
+	s.writePostOp(results, c, n)
+	if err == nil {
+		// the filesystem doesn't know how much room the cluster has left, so report plenty
+		const total = 1 << 50
+		free := uint64(total)
+		if info.Size < total {
+			free -= info.Size
+		}
+		results.uint64(total)
+		results.uint64(free)
+		results.uint64(free)
+		results.uint64(1 << 32)
+		results.uint64(1 << 32)
+		results.uint64(1 << 32)
+		results.uint32(0)
+	}
+	return nil
+}
+
+func (s *Server) fsinfo(c *call, results *xdrWriter) error {
+	chunk, valid := readHandle(c.args)
+	if c.args.err != nil {
+		return c.args.err
+	}
+	n, err := s.resolve(chunk, valid)
+	results.uint32(uint32(s.statusOf(err)))
+	s.writePostOp(results, c, n)
+	if err == nil {
+		results.uint32(maxTransfer) // rtmax
+		results.uint32(maxTransfer) // rtpref
+		results.uint32(4096)        // rtmult
+		results.uint32(maxTransfer) // wtmax
+		results.uint32(maxTransfer) // wtpref
+		results.uint32(4096)        // wtmult
+		results.uint32(64 << 10)    // dtpref
+		results.uint64(filesystem.MaxFileSize)
+		results.uint32(1) // time_delta
+		results.uint32(0)
+		// FSF3_SYMLINK | FSF3_HOMOGENEOUS
+		results.uint32(0x0002 | 0x0008)
+	}
+	return nil
+}
+
+func (s *Server) pathconf(c *call, results *xdrWriter) error {
+	chunk, valid := readHandle(c.args)
+	if c.args.err != nil {
+		return c.args.err
+	}
+	n, err := s.resolve(chunk, valid)
+	results.uint32(uint32(s.statusOf(err)))
+	s.writePostOp(results, c, n)
+	if err == nil {
+		results.uint32(1) // linkmax
+		results.uint32(filesystem.MaxName)
+		results.bool(true)  // no_trunc
+		results.bool(true)  // chown_restricted
+		results.bool(false) // case_insensitive
+		results.bool(true)  // case_preserving
+	}
+	return nil
+}
+
+func (s *Server) commit(c *call, results *xdrWriter) error {
+	chunk, valid := readHandle(c.args)
+	c.args.uint64()
+	c.args.uint32()
+	if c.args.err != nil {
+		return c.args.err
+	}
+	n, err := s.resolve(chunk, valid)
+	results.uint32(uint32(s.statusOf(err)))
+	s.writeWcc(results, c, n)
+	if err == nil {
+		results.fixed(s.verifier[:])
+	}
+	return nil
+}
@@ -0,0 +1,478 @@
+package nfs
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"zircon/lib/filesystem"
+)
+
+func nodeInfo(t *testing.T, fs filesystem.Filesystem, path string) (os.FileInfo, filesystem.NodeInfo) {
+	info, err := fs.Stat(path)
+	require.NoError(t, err)
+	return info, info.Sys().(filesystem.NodeInfo)
+}
+
+// A client speaking to the server over an in-memory connection.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	xid    uint32
+	// the user that calls are made as
+	uid uint32
+}
+
+func newTestClient(t *testing.T, fs filesystem.Filesystem) *testClient {
+	server, err := NewServer(fs, "/")
+	require.NoError(t, err)
+	return connect(t, server, 1000)
+}
+
+func connect(t *testing.T, server *Server, uid uint32) *testClient {
+	clientSide, serverSide := net.Pipe()
+	go server.serveConn(serverSide)
+	return &testClient{t: t, conn: clientSide, reader: bufio.NewReader(clientSide), uid: uid}
+}
+
+func (c *testClient) Close() {
+	_ = c.conn.Close()
+}
+
+// Performs a call and returns its results.
+func (c *testClient) call(program uint32, proc uint32, args *xdrWriter) *xdrReader {
+	c.xid++
+	w := &xdrWriter{}
+	w.uint32(c.xid)
+	w.uint32(msgCall)
+	w.uint32(rpcVersion)
+	w.uint32(program)
+	w.uint32(3)
+	w.uint32(proc)
+	credentials := &xdrWriter{}
+	credentials.uint32(0)
+	credentials.string("client")
+	credentials.uint32(c.uid)
+	credentials.uint32(c.uid)
+	credentials.uint32(0)
+	w.uint32(authUnix)
+	w.opaque(credentials.Bytes())
+	w.uint32(authNone)
+	w.opaque(nil)
+	w.Write(args.Bytes())
+	require.NoError(c.t, writeRecord(c.conn, w.Bytes()))
+
+	reply, err := readRecord(c.reader)
+	require.NoError(c.t, err)
+	r := &xdrReader{data: reply}
+	assert.Equal(c.t, c.xid, r.uint32())
+	assert.Equal(c.t, uint32(msgReply), r.uint32())
+	assert.Equal(c.t, uint32(replyAccepted), r.uint32())
+	r.uint32()
+	r.opaque(400)
+	require.Equal(c.t, uint32(acceptSuccess), r.uint32())
+	require.NoError(c.t, r.err)
+	return r
+}
+
+type attrs struct {
+	ftype  uint32
+	mode   uint32
+	uid    uint32
+	gid    uint32
+	size   uint64
+	fileid uint64
+	// in seconds
+	mtime uint32
+}
+
+func readAttrs(r *xdrReader) attrs {
+	var a attrs
+	a.ftype = r.uint32()
+	a.mode = r.uint32()
+	r.uint32() // nlink
+	a.uid = r.uint32()
+	a.gid = r.uint32()
+	a.size = r.uint64()
+	r.fixed(24) // used, rdev, fsid
+	a.fileid = r.uint64()
+	r.fixed(8) // atime
+	a.mtime = r.uint32()
+	r.fixed(12) // the rest of mtime, and ctime
+	return a
+}
+
+func skipPostOp(r *xdrReader) {
+	if r.bool() {
+		readAttrs(r)
+	}
+}
+
+func skipWcc(r *xdrReader) {
+	if r.bool() {
+		r.fixed(24)
+	}
+	skipPostOp(r)
+}
+
+func handleArgs(handle []byte) *xdrWriter {
+	w := &xdrWriter{}
+	w.opaque(handle)
+	return w
+}
+
+func whereArgs(dir []byte, name string) *xdrWriter {
+	w := handleArgs(dir)
+	w.string(name)
+	return w
+}
+
+func emptySetAttrs(w *xdrWriter) {
+	for i := 0; i < 4; i++ {
+		w.bool(false)
+	}
+	w.uint32(0)
+	w.uint32(0)
+}
+
+func (c *testClient) mount(path string) []byte {
+	w := &xdrWriter{}
+	w.string(path)
+	r := c.call(programMount, 1, w)
+	require.Equal(c.t, uint32(mountOK), r.uint32())
+	return r.opaque(maxHandle)
+}
+
+func (c *testClient) getattr(handle []byte) (nfsStatus, attrs) {
+	r := c.call(programNFS, 1, handleArgs(handle))
+	status := nfsStatus(r.uint32())
+	if status != nfsOK {
+		return status, attrs{}
+	}
+	return status, readAttrs(r)
+}
+
+func (c *testClient) lookup(dir []byte, name string) (nfsStatus, []byte) {
+	r := c.call(programNFS, 3, whereArgs(dir, name))
+	status := nfsStatus(r.uint32())
+	if status != nfsOK {
+		return status, nil
+	}
+	return status, r.opaque(maxHandle)
+}
+
+// Performs a CREATE or MKDIR, and returns the handle of the new node.
+func (c *testClient) create(proc uint32, dir []byte, name string) (nfsStatus, []byte) {
+	w := whereArgs(dir, name)
+	if proc == 8 {
+		w.uint32(createGuarded)
+	}
+	emptySetAttrs(w)
+	r := c.call(programNFS, proc, w)
+	status := nfsStatus(r.uint32())
+	if status != nfsOK {
+		return status, nil
+	}
+	require.True(c.t, r.bool())
+	return status, r.opaque(maxHandle)
+}
+
+func (c *testClient) write(handle []byte, offset uint64, data string) nfsStatus {
+	w := handleArgs(handle)
+	w.uint64(offset)
+	w.uint32(uint32(len(data)))
+	w.uint32(stableFileSync)
+	w.opaque([]byte(data))
+	r := c.call(programNFS, 7, w)
+	status := nfsStatus(r.uint32())
+	skipWcc(r)
+	if status == nfsOK {
+		assert.Equal(c.t, uint32(len(data)), r.uint32())
+		assert.Equal(c.t, uint32(stableFileSync), r.uint32())
+	}
+	return status
+}
+
+func (c *testClient) read(handle []byte, offset uint64, count uint32) (nfsStatus, string, bool) {
+	w := handleArgs(handle)
+	w.uint64(offset)
+	w.uint32(count)
+	r := c.call(programNFS, 6, w)
+	status := nfsStatus(r.uint32())
+	skipPostOp(r)
+	if status != nfsOK {
+		return status, "", false
+	}
+	r.uint32()
+	eof := r.bool()
+	data := r.opaque(maxTransfer)
+	require.NoError(c.t, r.err)
+	return status, string(data), eof
+}
+
+func (c *testClient) rename(fromDir []byte, fromName string, toDir []byte, toName string) nfsStatus {
+	w := whereArgs(fromDir, fromName)
+	w.opaque(toDir)
+	w.string(toName)
+	return nfsStatus(c.call(programNFS, 14, w).uint32())
+}
+
+func (c *testClient) remove(proc uint32, dir []byte, name string) nfsStatus {
+	return nfsStatus(c.call(programNFS, proc, whereArgs(dir, name)).uint32())
+}
+
+// Changes the mode of a node with SETATTR.
+func (c *testClient) chmod(handle []byte, mode uint32) nfsStatus {
+	w := handleArgs(handle)
+	w.bool(true)
+	w.uint32(mode)
+	for i := 0; i < 3; i++ {
+		// uid, gid, size
+		w.bool(false)
+	}
+	w.uint32(0)
+	w.uint32(0)
+	w.bool(false) // guard
+	return nfsStatus(c.call(programNFS, 2, w).uint32())
+}
+
+// Sets the modification time of a node with SETATTR, to the server's time if 'seconds' is zero.
+func (c *testClient) touch(handle []byte, seconds uint32) nfsStatus {
+	w := handleArgs(handle)
+	for i := 0; i < 4; i++ {
+		// mode, uid, gid, size
+		w.bool(false)
+	}
+	w.uint32(timeDontChange)
+	if seconds == 0 {
+		w.uint32(timeServer)
+	} else {
+		w.uint32(timeClient)
+		w.uint32(seconds)
+		w.uint32(0)
+	}
+	w.bool(false) // guard
+	return nfsStatus(c.call(programNFS, 2, w).uint32())
+}
+
+// Lists a directory with READDIRPLUS, with a limit on the size of each reply, and returns the names in it along with
+// the size of each one.
+func (c *testClient) readdir(dir []byte, maxcount uint32) map[string]uint64 {
+	entries := map[string]uint64{}
+	cookie := uint64(0)
+	for {
+		w := handleArgs(dir)
+		w.uint64(cookie)
+		w.fixed(make([]byte, 8))
+		w.uint32(maxcount)
+		w.uint32(maxcount)
+		r := c.call(programNFS, 17, w)
+		require.Equal(c.t, nfsOK, nfsStatus(r.uint32()))
+		skipPostOp(r)
+		r.fixed(8)
+		for r.bool() {
+			r.uint64()
+			name := r.string(maxNameArg)
+			cookie = r.uint64()
+			require.True(c.t, r.bool())
+			a := readAttrs(r)
+			require.True(c.t, r.bool())
+			r.opaque(maxHandle)
+			_, seen := entries[name]
+			assert.False(c.t, seen, name)
+			entries[name] = a.size
+		}
+		eof := r.bool()
+		require.NoError(c.t, r.err)
+		if eof {
+			return entries
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	fs, _ := filesystem.ConstructMemoryFilesystem()
+	c := newTestClient(t, fs)
+	defer c.Close()
+	root := c.mount("/")
+
+	status, dir := c.create(9, root, "dir")
+	require.Equal(t, nfsOK, status)
+	status, file := c.create(8, dir, "file")
+	require.Equal(t, nfsOK, status)
+	status, _ = c.create(8, dir, "file")
+	assert.Equal(t, nfsErrExist, status)
+
+	require.Equal(t, nfsOK, c.write(file, 0, "hello, "))
+	require.Equal(t, nfsOK, c.write(file, 7, "world"))
+	status, data, eof := c.read(file, 0, 100)
+	require.Equal(t, nfsOK, status)
+	assert.Equal(t, "hello, world", data)
+	assert.True(t, eof)
+	status, data, eof = c.read(file, 7, 3)
+	require.Equal(t, nfsOK, status)
+	assert.Equal(t, "wor", data)
+	assert.False(t, eof)
+
+	status, found := c.lookup(root, "dir")
+	require.Equal(t, nfsOK, status)
+	assert.Equal(t, dir, found)
+	status, found = c.lookup(dir, "..")
+	require.Equal(t, nfsOK, status)
+	assert.Equal(t, root, found)
+	status, _ = c.lookup(root, "missing")
+	assert.Equal(t, nfsErrNoEnt, status)
+	status, _ = c.lookup(root, "a/b")
+	assert.Equal(t, nfsErrInval, status)
+
+	status, a := c.getattr(file)
+	require.Equal(t, nfsOK, status)
+	info, node := nodeInfo(t, fs, "/dir/file")
+	assert.Equal(t, attrs{ftype: typeRegular, mode: 0644, uid: 1000, gid: 1000, size: 12, fileid: uint64(node.Chunk),
+		mtime: uint32(info.ModTime().Unix())}, a)
+
+	assert.Equal(t, nfsErrNotEmpty, c.remove(13, root, "dir"))
+	assert.Equal(t, nfsErrIsDir, c.remove(12, root, "dir"))
+	assert.Equal(t, nfsErrNotDir, c.remove(13, dir, "file"))
+	assert.Equal(t, nfsOK, c.remove(12, dir, "file"))
+	status, _ = c.getattr(file)
+	assert.Equal(t, nfsErrStale, status)
+	assert.Equal(t, nfsOK, c.remove(13, root, "dir"))
+
+	status, _ = c.getattr([]byte("bad"))
+	assert.Equal(t, nfsErrBadHandle, status)
+}
+
+func TestHandlesAcrossRenames(t *testing.T) {
+	fs, _ := filesystem.ConstructMemoryFilesystem()
+	c := newTestClient(t, fs)
+	defer c.Close()
+	root := c.mount("/")
+
+	_, a := c.create(9, root, "a")
+	_, b := c.create(9, root, "b")
+	_, file := c.create(8, a, "file")
+	require.Equal(t, nfsOK, c.write(file, 0, "contents"))
+
+	// through the server
+	require.Equal(t, nfsOK, c.rename(a, "file", b, "moved"))
+	status, data, _ := c.read(file, 0, 100)
+	require.Equal(t, nfsOK, status)
+	assert.Equal(t, "contents", data)
+
+	// by another client, within the same directory, and by moving the directory it's in
+	require.NoError(t, fs.Rename("/b/moved", "/b/renamed"))
+	require.NoError(t, fs.Rename("/b", "/c"))
+	status, data, _ = c.read(file, 0, 100)
+	require.Equal(t, nfsOK, status)
+	assert.Equal(t, "contents", data)
+	status, _ = c.getattr(b)
+	assert.Equal(t, nfsOK, status)
+
+	// replacing an existing file
+	_, other := c.create(8, b, "other")
+	require.Equal(t, nfsOK, c.rename(b, "renamed", b, "other"))
+	status, _ = c.getattr(other)
+	assert.Equal(t, nfsErrStale, status)
+	status, found := c.lookup(b, "other")
+	require.Equal(t, nfsOK, status)
+	assert.Equal(t, file, found)
+
+	assert.Equal(t, nfsErrInval, c.rename(root, "c", b, "inside"))
+	assert.Equal(t, nfsErrNotDir, c.rename(root, "a", b, "other"))
+}
+
+func TestReadDir(t *testing.T) {
+	fs, _ := filesystem.ConstructMemoryFilesystem()
+	c := newTestClient(t, fs)
+	defer c.Close()
+	root := c.mount("/")
+
+	expected := map[string]uint64{".": 0, "..": 0}
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("file%d", i)
+		_, file := c.create(8, root, name)
+		require.Equal(t, nfsOK, c.write(file, 0, strings.Repeat("x", i)))
+		expected[name] = uint64(i)
+	}
+	info, err := fs.Stat("/")
+	require.NoError(t, err)
+	expected["."], expected[".."] = uint64(info.Size()), uint64(info.Size())
+	// small enough to take several calls
+	assert.Equal(t, expected, c.readdir(root, 1024))
+	assert.Equal(t, expected, c.readdir(root, 1<<16))
+}
+
+func TestPermissions(t *testing.T) {
+	fs, _ := filesystem.ConstructMemoryFilesystem()
+	require.NoError(t, fs.Chmod("/", 0777))
+	server, err := NewServerWithPermissions(fs, "/")
+	require.NoError(t, err)
+	owner := connect(t, server, 1000)
+	defer owner.Close()
+	other := connect(t, server, 2000)
+	defer other.Close()
+	root := owner.mount("/")
+
+	status, dir := owner.create(9, root, "private")
+	require.Equal(t, nfsOK, status)
+	_, file := owner.create(8, dir, "file")
+	require.Equal(t, nfsOK, owner.write(file, 0, "secret"))
+	status, a := owner.getattr(file)
+	require.Equal(t, nfsOK, status)
+	assert.Equal(t, uint32(1000), a.uid)
+	assert.Equal(t, uint32(1000), a.gid)
+	assert.Equal(t, uint32(0644), a.mode)
+
+	// readable by others, but not writable
+	status, data, _ := other.read(file, 0, 100)
+	assert.Equal(t, nfsOK, status)
+	assert.Equal(t, "secret", data)
+	assert.Equal(t, nfsErrAccess, other.write(file, 0, "changed"))
+	status, _ = other.create(8, dir, "mine")
+	assert.Equal(t, nfsErrAccess, status)
+	assert.Equal(t, nfsErrAccess, other.chmod(file, 0666))
+
+	// and then not even readable, once the directory can't be searched
+	require.Equal(t, nfsOK, owner.chmod(dir, 0700))
+	status, a = owner.getattr(dir)
+	require.Equal(t, nfsOK, status)
+	assert.Equal(t, uint32(0700), a.mode)
+	status, _ = other.lookup(dir, "file")
+	assert.Equal(t, nfsErrAccess, status)
+	status, _, _ = other.read(file, 0, 100)
+	assert.Equal(t, nfsErrAccess, status)
+	status, data, _ = owner.read(file, 0, 100)
+	assert.Equal(t, nfsOK, status)
+	assert.Equal(t, "secret", data)
+}
+
+func TestTimes(t *testing.T) {
+	fs, _ := filesystem.ConstructMemoryFilesystem()
+	c := newTestClient(t, fs)
+	defer c.Close()
+	root := c.mount("/")
+
+	status, file := c.create(8, root, "file")
+	require.Equal(t, nfsOK, status)
+	_, created := nodeInfo(t, fs, "/file")
+	require.Equal(t, nfsOK, c.touch(file, 1234567890))
+	status, a := c.getattr(file)
+	require.Equal(t, nfsOK, status)
+	assert.Equal(t, uint32(1234567890), a.mtime)
+	_, node := nodeInfo(t, fs, "/file")
+	assert.True(t, node.Atime.Equal(created.Atime), "the access time should be left alone")
+
+	before := time.Now().Add(-time.Second)
+	require.Equal(t, nfsOK, c.touch(file, 0))
+	info, _ := nodeInfo(t, fs, "/file")
+	assert.True(t, info.ModTime().After(before))
+}
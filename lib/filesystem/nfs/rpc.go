@@ -0,0 +1,160 @@
+package nfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ONC RPC version 2 (RFC 5531), as carried over TCP with record marking: each message is sent as one or more
+// fragments, each preceded by four bytes holding its length, with the top bit set on the last fragment of a message.
+
+const rpcVersion = 2
+
+const (
+	msgCall  = 0
+	msgReply = 1
+)
+
+const (
+	replyAccepted = 0
+	replyDenied   = 1
+	rejectVersion = 0
+)
+
+const (
+	acceptSuccess      = 0
+	acceptProgUnavail  = 1
+	acceptProgMismatch = 2
+	acceptProcUnavail  = 3
+	acceptGarbageArgs  = 4
+	acceptSystemErr    = 5
+)
+
+const (
+	authNone = 0
+	authUnix = 1
+)
+
+// The largest message accepted from a client, which leaves room for a WRITE of maxTransfer bytes.
+const maxRecord = maxTransfer + 64<<10
+
+const lastFragment = 1 << 31
+
+type call struct {
+	xid     uint32
+	program uint32
+	version uint32
+	proc    uint32
+	// from AUTH_UNIX credentials, or nobody if the client didn't send any
+	uid uint32
+	gid uint32
+	// supplementary groups
+	gids []uint32
+	args *xdrReader
+}
+
+// The user and group that calls without AUTH_UNIX credentials are made as.
+const nobody = 65534
+
+// The most supplementary groups that AUTH_UNIX credentials can hold.
+const maxGroups = 16
+
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	var record []byte
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		marker := binary.BigEndian.Uint32(header[:])
+		length := int(marker &^ lastFragment)
+		if len(record)+length > maxRecord {
+			return nil, fmt.Errorf("record of more than %d bytes", maxRecord)
+		}
+		start := len(record)
+		record = append(record, make([]byte, length)...)
+		if _, err := io.ReadFull(r, record[start:]); err != nil {
+			return nil, err
+		}
+		if marker&lastFragment != 0 {
+			return record, nil
+		}
+	}
+}
+
+func writeRecord(w io.Writer, message []byte) error {
+	record := make([]byte, 4+len(message))
+	binary.BigEndian.PutUint32(record, lastFragment|uint32(len(message)))
+	copy(record[4:], message)
+	_, err := w.Write(record)
+	return err
+}
+
+// Decodes the header of a call. Returns a nil call, without an error, for messages that aren't calls, which are
+// ignored. A call of an RPC version other than 2 is returned along with the reply that rejects it.
+func parseCall(message []byte) (*call, []byte, error) {
+	r := &xdrReader{data: message}
+	c := &call{xid: r.uint32()}
+	if mtype := r.uint32(); r.err != nil {
+		return nil, nil, r.err
+	} else if mtype != msgCall {
+		return nil, nil, nil
+	}
+	if version := r.uint32(); version != rpcVersion {
+		w := &xdrWriter{}
+		w.uint32(c.xid)
+		w.uint32(msgReply)
+		w.uint32(replyDenied)
+		w.uint32(rejectVersion)
+		w.uint32(rpcVersion)
+		w.uint32(rpcVersion)
+		return c, w.Bytes(), nil
+	}
+	c.program = r.uint32()
+	c.version = r.uint32()
+	c.proc = r.uint32()
+	flavor := r.uint32()
+	credentials := r.opaque(400)
+	// the verifier only matters for flavors of authentication that aren't supported
+	r.uint32()
+	r.opaque(400)
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	c.uid, c.gid = nobody, nobody
+	if flavor == authUnix {
+		cr := &xdrReader{data: credentials}
+		cr.uint32() // stamp
+		cr.string(255)
+		c.uid = cr.uint32()
+		c.gid = cr.uint32()
+		count := cr.uint32()
+		if count > maxGroups {
+			return nil, nil, errors.New("too many groups in AUTH_UNIX credentials")
+		}
+		for i := uint32(0); i < count; i++ {
+			c.gids = append(c.gids, cr.uint32())
+		}
+		if cr.err != nil {
+			return nil, nil, errors.New("malformed AUTH_UNIX credentials")
+		}
+	}
+	c.args = r
+	return c, nil, nil
+}
+
+// Encodes the reply to a call that was accepted, with 'results' after it if it succeeded.
+func acceptedReply(xid uint32, status uint32, results []byte) []byte {
+	w := &xdrWriter{}
+	w.uint32(xid)
+	w.uint32(msgReply)
+	w.uint32(replyAccepted)
+	w.uint32(authNone)
+	w.opaque(nil)
+	w.uint32(status)
+	w.Write(results)
+	return w.Bytes()
+}
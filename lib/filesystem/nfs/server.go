@@ -0,0 +1,262 @@
+package nfs
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	path2 "path"
+	"sync"
+
+	"zircon/lib/apis"
+	"zircon/lib/filesystem"
+	"zircon/lib/logging"
+)
+
+// The server exports a directory of a filesystem over NFS version 3 (RFC 1813), so that it can be mounted by any
+// NFS client, without FUSE or anything else installed on the client's machine. It serves both the MOUNT protocol and
+// NFS itself, on a single TCP port, and doesn't register with a portmapper, so clients have to be told the port and to
+// use TCP, such as with:
+//
+//	mount -t nfs -o vers=3,proto=tcp,port=2049,mountport=2049,nolock SERVER:/ /mnt/zircon
+//
+// Locking over NFS goes through a separate protocol that isn't served, hence nolock; advisory locks still work
+// between processes on the same client.
+//     Clients identify their users with AUTH_UNIX credentials, which the server has no way to verify, so permissions
+//     only keep honest clients' users apart: a server from NewServerWithPermissions checks each call against the
+//     permissions of the user that the client says made it, while one from NewServer performs every call regardless,
+//     and only uses the user to decide who owns the nodes that are created. Either should only be exposed to trusted
+//     networks. Calls without credentials are made as nobody.
+//     Every write is written out to chunks before it is acknowledged, so writes are always reported as stable, and
+//     COMMIT has nothing left to do.
+
+// The port that NFS is served on by default.
+const DefaultPort = 2049
+
+// How many calls from the same connection are handled at once. Clients send calls ahead without waiting for replies,
+// such as when reading ahead through a file.
+const maxConcurrentCalls = 16
+
+type Server struct {
+	fs      filesystem.Filesystem
+	export  string
+	handles *handleTable
+	// whether each call is checked against the permissions of the user that made it
+	enforce bool
+	// sent with every WRITE and COMMIT; a client that sees it change knows that the server restarted
+	verifier [8]byte
+	// where malformed messages, and calls that fail in ways NFS has no status for, are reported; see SetLogger
+	logger apis.Logger
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// Exports the directory at 'export', which clients mount by its path.
+func NewServer(fs filesystem.Filesystem, export string) (*Server, error) {
+	export = path2.Clean("/" + export)
+	info, err := fs.Stat(export)
+	if err != nil {
+		return nil, fmt.Errorf("[server.go/STE] %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("cannot export %s: not a directory", export)
+	}
+	root, err := nodeOf(info)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		fs:        fs,
+		export:    export,
+		handles:   newHandleTable(fs, root.Chunk, export),
+		logger:    logging.Default(),
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+	}
+	if _, err := rand.Read(s.verifier[:]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Like NewServer, but checks each call against the permissions of the user that the client says made it.
+func NewServerWithPermissions(fs filesystem.Filesystem, export string) (*Server, error) {
+	s, err := NewServer(fs, export)
+	if err != nil {
+		return nil, err
+	}
+	s.enforce = true
+	return s, nil
+}
+
+// Reports malformed messages, and calls that fail in ways that NFS has no status for, to 'logger' instead of to standard
+// error. Must be called before the server starts serving.
+func (s *Server) SetLogger(logger apis.Logger) {
+	s.logger = logging.Component(logger, "nfs")
+}
+
+func userOf(c *call) filesystem.User {
+	return filesystem.User{Uid: c.uid, Gids: append([]uint32{c.gid}, c.gids...)}
+}
+
+// The filesystem as it should be seen by the user that made a call.
+func (s *Server) as(c *call) filesystem.Filesystem {
+	if !s.enforce {
+		return filesystem.OnBehalfOf(s.fs, userOf(c))
+	}
+	return filesystem.AsUser(s.fs, userOf(c))
+}
+
+func nodeOf(info os.FileInfo) (filesystem.NodeInfo, error) {
+	node, ok := info.Sys().(filesystem.NodeInfo)
+	if !ok {
+		return filesystem.NodeInfo{}, errors.New("filesystem does not report which chunk holds each node")
+	}
+	return node, nil
+}
+
+func (s *Server) ListenAndServe(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Accepts connections from 'listener' until the server is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return listener.Close()
+	}
+	s.listeners[listener] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, listener)
+		s.mu.Unlock()
+		_ = listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Stops accepting connections and closes the ones that are open.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for listener := range s.listeners {
+		_ = listener.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	var writeMu sync.Mutex
+	reply := func(message []byte) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if err := writeRecord(conn, message); err != nil {
+			// the connection is gone, which the read loop will find out as well
+			_ = conn.Close()
+		}
+	}
+	slots := make(chan struct{}, maxConcurrentCalls)
+	var calls sync.WaitGroup
+	defer calls.Wait()
+	for {
+		message, err := readRecord(reader)
+		if err != nil {
+			return
+		}
+		c, rejection, err := parseCall(message)
+		if err != nil {
+			s.logger.Logf(apis.WARN, "dropping malformed RPC message from %v: %v", conn.RemoteAddr(), err)
+			continue
+		} else if rejection != nil {
+			reply(rejection)
+			continue
+		} else if c == nil {
+			continue
+		}
+		slots <- struct{}{}
+		calls.Add(1)
+		go func() {
+			defer calls.Done()
+			defer func() { <-slots }()
+			reply(s.dispatch(c))
+		}()
+	}
+}
+
+// Performs a call, and returns the reply to send back.
+func (s *Server) dispatch(c *call) []byte {
+	var procs []procedure
+	switch c.program {
+	case programNFS:
+		procs = nfsProcedures
+	case programMount:
+		procs = mountProcedures
+	default:
+		return acceptedReply(c.xid, acceptProgUnavail, nil)
+	}
+	if c.version != 3 {
+		w := &xdrWriter{}
+		w.uint32(3)
+		w.uint32(3)
+		return acceptedReply(c.xid, acceptProgMismatch, w.Bytes())
+	}
+	if c.proc >= uint32(len(procs)) || procs[c.proc] == nil {
+		return acceptedReply(c.xid, acceptProcUnavail, nil)
+	}
+	results := &xdrWriter{}
+	if err := procs[c.proc](s, c, results); errors.Is(err, errGarbage) {
+		return acceptedReply(c.xid, acceptGarbageArgs, nil)
+	} else if err != nil {
+		s.logger.Logf(apis.ERROR, "cannot perform NFS call %d/%d: %v", c.program, c.proc, err)
+		return acceptedReply(c.xid, acceptSystemErr, nil)
+	}
+	return acceptedReply(c.xid, acceptSuccess, results.Bytes())
+}
+
+// Performs a call, decoding its arguments from c.args and encoding its results to 'results'. Failures that the
+// protocol has a status for are encoded in the results; an error is only returned for calls that can't be answered at
+// all, such as ones with arguments that can't be decoded.
+type procedure func(s *Server, c *call, results *xdrWriter) error
@@ -0,0 +1,108 @@
+package nfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Encoding and decoding of XDR (RFC 4506), the format that ONC RPC messages and the NFS and MOUNT protocols are
+// written in. Everything is big-endian and padded out to a multiple of four bytes.
+
+var errGarbage = errors.New("malformed XDR")
+
+// Decodes XDR values one after another. The first value that runs past the end of the data sets err, and from then
+// on, every value decodes as zero, so that a whole set of arguments can be decoded before checking err once.
+type xdrReader struct {
+	data []byte
+	err  error
+}
+
+func (r *xdrReader) take(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		r.err = errGarbage
+		return nil
+	}
+	taken := r.data[:n]
+	r.data = r.data[n:]
+	return taken
+}
+
+func (r *xdrReader) uint32() uint32 {
+	data := r.take(4)
+	if data == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(data)
+}
+
+func (r *xdrReader) uint64() uint64 {
+	data := r.take(8)
+	if data == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+func (r *xdrReader) bool() bool {
+	return r.uint32() != 0
+}
+
+// Decodes fixed-length opaque data of 'n' bytes.
+func (r *xdrReader) fixed(n int) []byte {
+	data := r.take(n)
+	r.take((4 - n%4) % 4)
+	return data
+}
+
+// Decodes variable-length opaque data of at most 'max' bytes.
+func (r *xdrReader) opaque(max int) []byte {
+	n := r.uint32()
+	if n > uint32(max) {
+		r.err = errGarbage
+		return nil
+	}
+	return r.fixed(int(n))
+}
+
+func (r *xdrReader) string(max int) string {
+	return string(r.opaque(max))
+}
+
+type xdrWriter struct {
+	bytes.Buffer
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], v)
+	w.Write(data[:])
+}
+
+func (w *xdrWriter) uint64(v uint64) {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], v)
+	w.Write(data[:])
+}
+
+func (w *xdrWriter) bool(v bool) {
+	if v {
+		w.uint32(1)
+	} else {
+		w.uint32(0)
+	}
+}
+
+func (w *xdrWriter) fixed(data []byte) {
+	w.Write(data)
+	w.Write(make([]byte, (4-len(data)%4)%4))
+}
+
+func (w *xdrWriter) opaque(data []byte) {
+	w.uint32(uint32(len(data)))
+	w.fixed(data)
+}
+
+func (w *xdrWriter) string(s string) {
+	w.opaque([]byte(s))
+}
@@ -0,0 +1,127 @@
+package filesystem
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+
+	"zircon/lib/apis"
+)
+
+// Explanation of the path cache:
+//     Resolving a path locks and reads every directory along it in turn, so each component of a deep path costs a
+//     round trip to the sync server and another to the cluster. Each Traverser remembers the chains of directories
+//     that recently resolved paths led through, keyed by the path of the last one, and starts resolving a path by
+//     locking the directory at the end of its longest remembered prefix directly, so only what is left is walked.
+//     Other clients change the tree without telling us, so a chain is only used if no write lock on any directory
+//     along it has been released since it was remembered, which the sync server reports through AwaitRelease. Every
+//     change to which nodes a directory holds is made under a write lock on it, and removing a directory write-locks
+//     the directory itself as well, so this catches every rename, move and removal along the chain. Unlike chunk
+//     versions, which start over when a removed directory's chunk number is handed out again, revisions only ever
+//     increase, so a chain through a removed directory is never mistaken for one through whatever reused its chunk.
+//     The revision of each directory is read while the walk that found the chain holds a lock on it.
+//     Remembered chains hold no locks, so Release is unaffected, and caching a path never keeps other clients from
+//     changing it. Renames, moves and removals of directories made through the same Traverser forget the chains that
+//     pass through them straight away. Sync servers that don't track releases leave the cache empty.
+
+// The number of paths whose chains are kept by each Traverser.
+const PathCacheSize = 128
+
+// Remembers the chains of directories that paths resolved to. A nil *pathCache caches nothing.
+type pathCache struct {
+	mu      sync.Mutex
+	limit   int
+	order   *list.List // of string, most recently used first
+	entries map[string]cachedPath
+}
+
+type cachedPath struct {
+	// the directories from the root down to the one at the path, and the revision of each when it was locked
+	chain     []apis.ChunkNum
+	revisions []apis.SyncRevision
+	element   *list.Element
+}
+
+func newPathCache(limit int) *pathCache {
+	return &pathCache{
+		limit:   limit,
+		order:   list.New(),
+		entries: map[string]cachedPath{},
+	}
+}
+
+func joinComponents(components []string) string {
+	return "/" + strings.Join(components, "/")
+}
+
+// Finds the longest prefix of 'components' that has a chain cached, and returns how many components it covers along
+// with a copy of its chain and revisions. Zero components means that nothing was found.
+func (c *pathCache) longest(components []string) (int, []apis.ChunkNum, []apis.SyncRevision) {
+	if c == nil {
+		return 0, nil, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for depth := len(components); depth > 0; depth-- {
+		if cached, found := c.entries[joinComponents(components[:depth])]; found {
+			c.order.MoveToFront(cached.element)
+			return depth, append([]apis.ChunkNum(nil), cached.chain...), append([]apis.SyncRevision(nil), cached.revisions...)
+		}
+	}
+	return 0, nil, nil
+}
+
+func (c *pathCache) put(components []string, chain []apis.ChunkNum, revisions []apis.SyncRevision) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := joinComponents(components)
+	if cached, found := c.entries[path]; found {
+		c.order.Remove(cached.element)
+	}
+	c.entries[path] = cachedPath{
+		chain:     append([]apis.ChunkNum(nil), chain...),
+		revisions: append([]apis.SyncRevision(nil), revisions...),
+		element:   c.order.PushFront(path),
+	}
+	for c.order.Len() > c.limit {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(string))
+	}
+}
+
+// Drops the chain cached for a path, such as because it turned out to be out of date.
+func (c *pathCache) forget(components []string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := joinComponents(components)
+	if cached, found := c.entries[path]; found {
+		c.order.Remove(cached.element)
+		delete(c.entries, path)
+	}
+}
+
+// Drops every chain that passes through a directory, such as because it was just renamed, moved or removed.
+func (c *pathCache) forgetChunk(chunk apis.ChunkNum) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for path, cached := range c.entries {
+		if containsChunk(cached.chain, chunk) {
+			c.order.Remove(cached.element)
+			delete(c.entries, path)
+		}
+	}
+}
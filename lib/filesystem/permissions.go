@@ -0,0 +1,565 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	path2 "path"
+	"time"
+
+	"zircon/lib/apis"
+)
+
+// Explanation of permissions:
+//     Every node has a mode, an owner and a group, as on POSIX systems, which are kept in its directory entry (or, for
+//     the root directory, in the root directory itself). Nodes start out owned by user and group zero, with the modes
+//     in DefaultAttributes, and can be changed with Chmod and Chown.
+//     A Filesystem doesn't know who it is being used by, so it performs every operation that it is asked to. Frontends
+//     that serve many users, such as FUSE mounts shared with allow_other, or NFS, wrap it with AsUser for each
+//     request, which checks each operation against the user it is performed for in the same way that a POSIX system
+//     would, and makes that user the owner of the nodes it creates. Nodes created without AsUser, such as through the
+//     command-line client or the S3 gateway, are owned by user zero.
+//     The checks are made just before each operation, by separate reads, so a change to the permissions that races
+//     with an operation may or may not be honored by it.
+
+// Returned by AsUser for operations that the user isn't permitted to perform.
+var ErrPermission = errors.New("permission denied")
+
+// What an operation needs to be allowed to do to a node, as in the bits of a POSIX mode.
+type Access uint8
+
+const (
+	AccessExecute Access = 1
+	AccessWrite   Access = 2
+	AccessRead    Access = 4
+)
+
+// Someone that operations are performed on behalf of.
+type User struct {
+	Uid uint32
+	// The user's primary group, followed by any supplementary groups.
+	Gids []uint32
+}
+
+// The user that every permission check passes for.
+const RootUid = 0
+
+// Describes the user for audit logs, such as "uid=1000 gids=[1000 27]".
+func (u User) String() string {
+	return fmt.Sprintf("uid=%d gids=%v", u.Uid, u.Gids)
+}
+
+func (u User) inGroup(gid uint32) bool {
+	for _, g := range u.Gids {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+func (u User) primaryGid() uint32 {
+	if len(u.Gids) == 0 {
+		return 0
+	}
+	return u.Gids[0]
+}
+
+// Converts an os.FileMode to the bits of a POSIX mode, for protocols like FUSE and NFS that use them.
+func PosixMode(mode os.FileMode) uint32 {
+	posix := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		posix |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		posix |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		posix |= 01000
+	}
+	switch {
+	case mode.IsDir():
+		posix |= 0040000
+	case mode&os.ModeSymlink != 0:
+		posix |= 0120000
+	case mode.IsRegular():
+		posix |= 0100000
+	}
+	return posix
+}
+
+// The reverse of PosixMode, for the permission bits alone.
+func FileMode(posix uint32) os.FileMode {
+	mode := os.FileMode(posix & 0777)
+	if posix&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if posix&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if posix&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// Returns the owner and group of a node, as reported by Stat.
+func ownerOf(info os.FileInfo) (uid uint32, gid uint32) {
+	if node, ok := info.Sys().(NodeInfo); ok {
+		return node.Uid, node.Gid
+	}
+	return 0, 0
+}
+
+// Checks whether 'user' may access the node described by 'info' in every way that 'access' asks for, returning
+// ErrPermission if not.
+func CheckAccess(info os.FileInfo, user User, access Access) error {
+	mode := info.Mode()
+	if user.Uid == RootUid {
+		// the superuser can do anything, except execute a file that nobody can execute
+		if access&AccessExecute != 0 && !mode.IsDir() && mode&0111 == 0 {
+			return fmt.Errorf("%w: %s", ErrPermission, info.Name())
+		}
+		return nil
+	}
+	uid, gid := ownerOf(info)
+	allowed := uint32(mode.Perm())
+	switch {
+	case user.Uid == uid:
+		allowed >>= 6
+	case user.inGroup(gid):
+		allowed >>= 3
+	}
+	if uint32(access)&^(allowed&7) != 0 {
+		return fmt.Errorf("%w: %s", ErrPermission, info.Name())
+	}
+	return nil
+}
+
+// Like fs, but every operation is checked against the permissions of 'user' first, and nodes that are created are
+// owned by 'user'. If fs is audited, operations are recorded as done by 'user', including those that it is refused.
+func AsUser(fs Filesystem, user User) Filesystem {
+	if audited, ok := fs.(*auditedFS); ok {
+		return &auditedFS{Filesystem: AsUser(audited.Filesystem, user), log: audited.log, actor: user.String()}
+	}
+	return &userFS{fs: fs, user: user}
+}
+
+type userFS struct {
+	fs   Filesystem
+	user User
+}
+
+func (u *userFS) isRoot() bool {
+	return u.user.Uid == RootUid
+}
+
+func (u *userFS) requireRoot(path string) error {
+	if !u.isRoot() {
+		return fmt.Errorf("%w: %s", ErrPermission, path)
+	}
+	return nil
+}
+
+// Checks that every directory on the way to 'dir', and 'dir' itself, can be searched, and returns what is at 'dir'.
+func (u *userFS) search(dir string) (os.FileInfo, error) {
+	info, err := u.fs.Stat("/")
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckAccess(info, u.user, AccessExecute); err != nil {
+		return nil, err
+	}
+	if dir == "/" {
+		return info, nil
+	}
+	current := "/"
+	for _, elem := range splitPathMany(path2.Clean(dir)) {
+		current = path2.Join(current, elem)
+		if info, err = u.fs.Stat(current); err != nil {
+			return nil, err
+		}
+		if err := CheckAccess(info, u.user, AccessExecute); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// Checks that the node at 'path' can be reached, and accessed as 'access' asks for, and returns what is there.
+func (u *userFS) node(path string, access Access) (os.FileInfo, error) {
+	if _, err := u.search(path2.Dir(path)); err != nil {
+		return nil, err
+	}
+	info, err := u.fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return info, CheckAccess(info, u.user, access)
+}
+
+// Checks that a node can be added to or removed from the directory that 'path' is in, and returns that directory.
+func (u *userFS) parent(path string) (os.FileInfo, error) {
+	info, err := u.search(path2.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	return info, CheckAccess(info, u.user, AccessWrite|AccessExecute)
+}
+
+// Like parent, but also checks that the node at 'path' may be removed from it, which a sticky directory only allows
+// for the owner of the node or of the directory.
+func (u *userFS) removable(path string) error {
+	dir, err := u.parent(path)
+	if err != nil {
+		return err
+	}
+	if dir.Mode()&os.ModeSticky == 0 || u.isRoot() {
+		return nil
+	}
+	info, err := u.fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	nodeUid, _ := ownerOf(info)
+	dirUid, _ := ownerOf(dir)
+	if u.user.Uid != nodeUid && u.user.Uid != dirUid {
+		return fmt.Errorf("%w: %s", ErrPermission, path)
+	}
+	return nil
+}
+
+// Makes the user the owner of a node it just created. As on POSIX systems, a node created in a directory with the
+// setgid bit takes that directory's group, and a directory created there also gets the setgid bit.
+func (u *userFS) own(path string, dir os.FileInfo) error {
+	gid := u.user.primaryGid()
+	if dir.Mode()&os.ModeSetgid != 0 {
+		_, gid = ownerOf(dir)
+		if info, err := u.fs.Stat(path); err == nil && info.IsDir() {
+			if err := u.fs.Chmod(path, info.Mode()|os.ModeSetgid); err != nil {
+				return err
+			}
+		}
+	}
+	return u.fs.Chown(path, int(u.user.Uid), int(gid))
+}
+
+func (u *userFS) Mkdir(path string) error {
+	dir, err := u.parent(path)
+	if err != nil {
+		return err
+	}
+	if err := u.fs.Mkdir(path); err != nil {
+		return err
+	}
+	return u.own(path, dir)
+}
+
+func (u *userFS) Rename(source string, dest string) error {
+	if err := u.removable(source); err != nil {
+		return err
+	}
+	if _, err := u.parent(dest); err != nil {
+		return err
+	}
+	return u.fs.Rename(source, dest)
+}
+
+func (u *userFS) Unlink(path string) error {
+	if err := u.removable(path); err != nil {
+		return err
+	}
+	return u.fs.Unlink(path)
+}
+
+func (u *userFS) Rmdir(path string) error {
+	if err := u.removable(path); err != nil {
+		return err
+	}
+	return u.fs.Rmdir(path)
+}
+
+// Goes through u's own Unlink and Rmdir, so that each node is only removed if the user could remove it alone.
+func (u *userFS) RemoveAll(path string) error {
+	return removeAll(u, path)
+}
+
+// A snapshot holds everything in a subtree, whoever could read it, so only the superuser can take or delete one.
+func (u *userFS) Snapshot(path string, name string) error {
+	if err := u.requireRoot(path); err != nil {
+		return err
+	}
+	return u.fs.Snapshot(path, name)
+}
+
+func (u *userFS) DeleteSnapshot(name string) error {
+	if err := u.requireRoot(name); err != nil {
+		return err
+	}
+	return u.fs.DeleteSnapshot(name)
+}
+
+// Deleted nodes can belong to anyone, and can be brought back anywhere, so only the superuser can undelete or purge
+// them.
+func (u *userFS) Undelete(path string) error {
+	if err := u.requireRoot(path); err != nil {
+		return err
+	}
+	return u.fs.Undelete(path)
+}
+
+func (u *userFS) PurgeTrash() error {
+	if err := u.requireRoot(TrashDir); err != nil {
+		return err
+	}
+	return u.fs.PurgeTrash()
+}
+
+func (u *userFS) OpenRead(path string) (ReadOnlyFile, error) {
+	if _, err := u.node(path, AccessRead); err != nil {
+		return nil, err
+	}
+	return u.fs.OpenRead(path)
+}
+
+// Checks that a file can be written to, or, if it doesn't exist and 'create' is set, that it can be created. Returns
+// the directory to pass to own once it has been created, or nil if it already exists.
+func (u *userFS) writable(path string, create bool) (os.FileInfo, error) {
+	_, err := u.node(path, AccessWrite)
+	if create && errors.Is(err, ErrNotExist) {
+		return u.parent(path)
+	}
+	return nil, err
+}
+
+func (u *userFS) OpenWrite(path string, create bool, exclusive bool) (WritableFile, error) {
+	dir, err := u.writable(path, create)
+	if err != nil {
+		if _, statErr := u.fs.Stat(path); exclusive && statErr == nil {
+			// an exclusive create of a file that exists fails because it exists, whatever its permissions
+			return nil, fmt.Errorf("%w: %s", ErrExists, path)
+		}
+		return nil, err
+	}
+	file, err := u.fs.OpenWrite(path, create, exclusive)
+	if err != nil || dir == nil {
+		return file, err
+	}
+	if err := u.own(path, dir); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (u *userFS) CreateAtomic(path string, data io.Reader) error {
+	dir, err := u.parent(path)
+	if err != nil {
+		return err
+	}
+	if err := u.fs.CreateAtomic(path, data); err != nil {
+		return err
+	}
+	return u.own(path, dir)
+}
+
+func (u *userFS) Upload(ctx context.Context, path string, from io.ReaderAt) error {
+	dir, err := u.parent(path)
+	if err != nil {
+		return err
+	}
+	err = u.fs.Upload(ctx, path, from)
+	if errors.Is(err, ErrExists) {
+		return err
+	}
+	// an upload that failed partway leaves the file behind to be resumed, which the user has to own to do
+	if _, statErr := u.fs.Stat(path); statErr == nil {
+		if ownErr := u.own(path, dir); err == nil {
+			err = ownErr
+		}
+	}
+	return err
+}
+
+func (u *userFS) Resume(path string, from io.ReaderAt) error {
+	return u.ResumeContext(context.Background(), path, from)
+}
+
+func (u *userFS) ResumeContext(ctx context.Context, path string, from io.ReaderAt) error {
+	if _, err := u.node(path, AccessWrite); err != nil {
+		return err
+	}
+	return u.fs.ResumeContext(ctx, path, from)
+}
+
+// Chunks are reached without going through any directory, so there are no permissions to check them against.
+func (u *userFS) OpenChunk(chunk apis.ChunkNum) (WritableFile, error) {
+	if err := u.requireRoot(fmt.Sprintf("chunk %d", chunk)); err != nil {
+		return nil, err
+	}
+	return u.fs.OpenChunk(chunk)
+}
+
+func (u *userFS) SymLink(source string, dest string) error {
+	dir, err := u.parent(source)
+	if err != nil {
+		return err
+	}
+	if err := u.fs.SymLink(source, dest); err != nil {
+		return err
+	}
+	return u.own(source, dir)
+}
+
+func (u *userFS) Stat(path string) (os.FileInfo, error) {
+	if path != "/" {
+		if _, err := u.search(path2.Dir(path)); err != nil {
+			return nil, err
+		}
+	}
+	return u.fs.Stat(path)
+}
+
+func (u *userFS) StatDir(path string) (DirInfo, error) {
+	if _, err := u.node(path, AccessRead); err != nil {
+		return DirInfo{}, err
+	}
+	return u.fs.StatDir(path)
+}
+
+func (u *userFS) ReadLink(path string) (string, error) {
+	if _, err := u.search(path2.Dir(path)); err != nil {
+		return "", err
+	}
+	return u.fs.ReadLink(path)
+}
+
+func (u *userFS) Truncate(path string, length uint64) error {
+	if _, err := u.node(path, AccessWrite); err != nil {
+		return err
+	}
+	return u.fs.Truncate(path, length)
+}
+
+func (u *userFS) ListDir(path string) ([]string, error) {
+	if _, err := u.node(path, AccessRead); err != nil {
+		return nil, err
+	}
+	return u.fs.ListDir(path)
+}
+
+func (u *userFS) ReadDir(path string, cursor uint64, limit int) ([]DirEntry, uint64, error) {
+	if _, err := u.node(path, AccessRead); err != nil {
+		return nil, 0, err
+	}
+	return u.fs.ReadDir(path, cursor, limit)
+}
+
+// Only the owner of a node can change its permissions. Unless the owner is in the node's group, the setgid bit is
+// dropped, as on POSIX systems.
+func (u *userFS) Chmod(path string, mode os.FileMode) error {
+	info, err := u.node(path, 0)
+	if err != nil {
+		return err
+	}
+	if !u.isRoot() {
+		uid, gid := ownerOf(info)
+		if u.user.Uid != uid {
+			return fmt.Errorf("%w: %s", ErrPermission, path)
+		}
+		if !info.IsDir() && !u.user.inGroup(gid) {
+			mode &^= os.ModeSetgid
+		}
+	}
+	return u.fs.Chmod(path, mode)
+}
+
+// Only the superuser can give a node away. Its owner can change its group, but only to a group that the owner is in.
+func (u *userFS) Chown(path string, uid int, gid int) error {
+	info, err := u.node(path, 0)
+	if err != nil {
+		return err
+	}
+	if !u.isRoot() {
+		owner, _ := ownerOf(info)
+		if u.user.Uid != owner || (uid >= 0 && uint32(uid) != owner) || (gid >= 0 && !u.user.inGroup(uint32(gid))) {
+			return fmt.Errorf("%w: %s", ErrPermission, path)
+		}
+	}
+	return u.fs.Chown(path, uid, gid)
+}
+
+// The owner of a node can set its times to anything. Anyone else who can write to it can set them, as when touching
+// it, but POSIX would only let them set them to the current time, which can't be told apart here.
+func (u *userFS) Utimes(path string, atime time.Time, mtime time.Time) error {
+	info, err := u.node(path, 0)
+	if err != nil {
+		return err
+	}
+	if !u.isRoot() {
+		if owner, _ := ownerOf(info); u.user.Uid != owner {
+			if err := CheckAccess(info, u.user, AccessWrite); err != nil {
+				return err
+			}
+		}
+	}
+	return u.fs.Utimes(path, atime, mtime)
+}
+
+// Exporting and importing subtrees, and watching a subtree, would each have to check every node in it, so only the
+// superuser may do them.
+func (u *userFS) Export(path string, w io.Writer) error {
+	if err := u.requireRoot(path); err != nil {
+		return err
+	}
+	return u.fs.Export(path, w)
+}
+
+func (u *userFS) Import(path string, r io.Reader) error {
+	if err := u.requireRoot(path); err != nil {
+		return err
+	}
+	return u.fs.Import(path, r)
+}
+
+func (u *userFS) ImportTree(localPath string, destPath string) error {
+	return u.ImportTreeProgress(localPath, destPath, nil)
+}
+
+func (u *userFS) ImportTreeProgress(localPath string, destPath string, progress func(localPath string, err error)) error {
+	if err := u.requireRoot(destPath); err != nil {
+		return err
+	}
+	return u.fs.ImportTreeProgress(localPath, destPath, progress)
+}
+
+func (u *userFS) Watch(path string) (<-chan ChangeEvent, func(), error) {
+	if _, err := u.node(path, AccessRead); err != nil {
+		return nil, nil, err
+	}
+	return u.fs.Watch(path)
+}
+
+func (u *userFS) WatchRecursive(path string) (<-chan ChangeEvent, func(), error) {
+	if err := u.requireRoot(path); err != nil {
+		return nil, nil, err
+	}
+	return u.fs.WatchRecursive(path)
+}
+
+func (u *userFS) Lock(path string, exclusive bool) (func() error, error) {
+	if _, err := u.node(path, AccessRead); err != nil {
+		return nil, err
+	}
+	return u.fs.Lock(path, exclusive)
+}
+
+// The traverser works on chunks directly, without checking any permissions.
+func (u *userFS) GetTraverser() (*Traverser, error) {
+	if err := u.requireRoot("traverser"); err != nil {
+		return nil, err
+	}
+	return u.fs.GetTraverser()
+}
@@ -0,0 +1,179 @@
+package filesystem
+
+import (
+	"errors"
+	path2 "path"
+	"sync"
+)
+
+// Explanation of RemoveAll:
+//     A subtree can't be removed all at once: each directory has to be emptied before it can be removed, and that is
+//     done one node at a time, through the same Unlink and Rmdir that everyone else uses. So RemoveAll has to cope with
+//     other clients changing the subtree while it is being removed. Nodes that someone else removes first are counted
+//     as removed; a node that was replaced by one of the other type since it was listed is removed as whatever it is
+//     now; and a directory that something was added to while it was being emptied is emptied again, up to
+//     removeAllAttempts times, before RemoveAll gives up with ErrNotEmpty.
+//     Directories are listed with ReadDir, a batch at a time, and each batch is removed before the next one is listed,
+//     so that no more of a large directory is held at once than that. Removing a node write-locks its directory, so
+//     the files in a directory are removed one at a time, but the subdirectories in a batch are removed in parallel,
+//     along with everything below them. Every listing, unlink and rmdir waits for one of RemoveAllWorkers slots, so
+//     that however wide the tree is, only so many requests are made at once.
+//     Once anything fails, nothing new is started, and the first failure is returned when everything already under
+//     way has finished. Whatever was removed by then stays removed.
+
+// The most operations that RemoveAll makes at once.
+const RemoveAllWorkers = 8
+
+// How many times RemoveAll empties a directory that others keep adding to before giving up.
+const removeAllAttempts = 5
+
+// How many nodes RemoveAll lists from a directory at a time.
+const removeBatch = 256
+
+func (f *filesystem) RemoveAll(path string) error {
+	if f.trashes(path) {
+		if err := f.trash(path, true); !errors.Is(err, ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return removeAll(f, path)
+}
+
+type remover struct {
+	fs    Filesystem
+	slots chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// Implements RemoveAll in terms of the rest of a Filesystem.
+func removeAll(fs Filesystem, path string) error {
+	if path2.Clean(path) == "/" {
+		return errors.New("cannot remove the root directory")
+	}
+	r := &remover{
+		fs:    fs,
+		slots: make(chan struct{}, RemoveAllWorkers),
+	}
+	var isDir bool
+	err := r.do(func() error {
+		info, err := fs.Stat(path)
+		if err == nil {
+			isDir = info.IsDir()
+		}
+		return err
+	})
+	if errors.Is(err, ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	r.remove(path, isDir)
+	return r.failure()
+}
+
+// Performs a single operation once a slot is free, unless something has failed in the meantime.
+func (r *remover) do(op func() error) error {
+	r.slots <- struct{}{}
+	defer func() {
+		<-r.slots
+	}()
+	if err := r.failure(); err != nil {
+		return err
+	}
+	return op()
+}
+
+func (r *remover) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *remover) failure() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Removes a node that was a directory when it was listed if isDir is set. Rather than being returned, a failure is
+// recorded, which stops everything else.
+func (r *remover) remove(path string, isDir bool) {
+	err := r.removeAs(path, isDir)
+	if err != nil && !errors.Is(err, ErrNotExist) && r.failure() == nil {
+		// it may have been replaced since it was listed
+		var nowDir bool
+		statErr := r.do(func() error {
+			info, err := r.fs.Stat(path)
+			if err == nil {
+				nowDir = info.IsDir()
+			}
+			return err
+		})
+		if errors.Is(statErr, ErrNotExist) {
+			err = nil
+		} else if statErr == nil && nowDir != isDir {
+			err = r.removeAs(path, nowDir)
+		}
+	}
+	if err != nil && !errors.Is(err, ErrNotExist) {
+		r.fail(err)
+	}
+}
+
+func (r *remover) removeAs(path string, isDir bool) error {
+	if !isDir {
+		return r.do(func() error {
+			return r.fs.Unlink(path)
+		})
+	}
+	for attempt := 1; ; attempt++ {
+		if err := r.empty(path); err != nil {
+			return err
+		}
+		err := r.do(func() error {
+			return r.fs.Rmdir(path)
+		})
+		if !errors.Is(err, ErrNotEmpty) || attempt == removeAllAttempts {
+			return err
+		}
+	}
+}
+
+// Removes everything that is in a directory when it is listed.
+func (r *remover) empty(path string) error {
+	var cursor uint64
+	for {
+		var entries []DirEntry
+		var next uint64
+		err := r.do(func() (err error) {
+			entries, next, err = r.fs.ReadDir(path, cursor, removeBatch)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		var wg sync.WaitGroup
+		for _, entry := range entries {
+			child := path2.Join(path, entry.Name)
+			if entry.Type != DIRECTORY {
+				r.remove(child, false)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.remove(child, true)
+			}()
+		}
+		wg.Wait()
+		if err := r.failure(); err != nil || next == 0 {
+			return err
+		}
+		cursor = next
+	}
+}
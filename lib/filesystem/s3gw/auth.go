@@ -0,0 +1,408 @@
+package s3gw
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How far the time a request was signed at may be from the gateway's clock, as in S3.
+const maxClockSkew = 15 * time.Minute
+
+// The longest a presigned URL may be valid for, as in S3.
+const maxPresignedExpiry = 7 * 24 * time.Hour
+
+// The largest chunk of an aws-chunked body that is accepted. Each chunk is held in memory until its signature has been
+// checked; SDKs send chunks of 64 KiB to a few MiB.
+const maxStreamingChunk = 16 << 20
+
+const (
+	signingAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat    = "20060102T150405Z"
+
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// Explanation of authentication:
+//     Requests are authenticated with AWS Signature Version 4, the same way S3 does, so that SDKs and tools configured
+//     with the gateway's access key and secret key work unchanged. The signature covers the method, path, query, the
+//     headers the client chose to sign, and a SHA-256 of the body, which the client sends ahead of the body in the
+//     x-amz-content-sha256 header. The gateway checks the signature before doing anything else, but can only check the
+//     body's hash once it has all been read, so a body that doesn't match fails the request partway through, which
+//     leaves no object behind since objects are only moved into place once they have been written in full.
+//     SDKs often send bodies in the aws-chunked encoding instead, where each chunk is signed on its own, chained to the
+//     signature of the one before it. These are decoded and checked chunk by chunk as the body is read.
+//     A gateway without credentials doesn't check signatures at all, but still decodes aws-chunked bodies, since
+//     clients send them regardless of whether anything checks them.
+
+type authenticator struct {
+	region    string
+	accessKey string
+	secretKey string
+	now       func() time.Time
+}
+
+// What a request was signed with, which the signatures of the chunks of its body are chained to.
+type signingContext struct {
+	auth      *authenticator
+	date      time.Time
+	scope     string
+	signature string
+}
+
+// Checks the signature of 'request', if the gateway requires one, and returns the body to read from in place of
+// request.Body, which is decoded if it is aws-chunked and fails at the end if it doesn't match its declared hash.
+func (g *Gateway) authenticate(request *http.Request) (io.ReadCloser, error) {
+	payload := request.Header.Get("X-Amz-Content-Sha256")
+	var signing *signingContext
+	if g.auth != nil {
+		var err error
+		if request.URL.Query().Get("X-Amz-Algorithm") != "" {
+			signing, err = g.auth.checkPresigned(request)
+			payload = unsignedPayload
+		} else {
+			signing, err = g.auth.checkHeader(request, payload)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	body := request.Body
+	switch {
+	case payload == streamingPayload:
+		reader := &chunkedReader{body: bufio.NewReader(body), signing: signing}
+		return readCloser{reader, body}, nil
+	case payload == streamingUnsignedTrailer:
+		reader := &chunkedReader{body: bufio.NewReader(body)}
+		return readCloser{reader, body}, nil
+	case strings.HasPrefix(payload, "STREAMING-"):
+		return nil, errNotImplemented
+	case signing != nil && payload != unsignedPayload:
+		expected, err := hex.DecodeString(payload)
+		if err != nil || len(expected) != sha256.Size {
+			return nil, errContentSHA256
+		}
+		return readCloser{&hashedReader{body: body, hash: sha256.New(), expected: expected}, body}, nil
+	default:
+		return body, nil
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Fails the final read of a body if it didn't match its declared SHA-256.
+type hashedReader struct {
+	body     io.Reader
+	hash     hash.Hash
+	expected []byte
+}
+
+func (h *hashedReader) Read(p []byte) (int, error) {
+	n, err := h.body.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(h.hash.Sum(nil), h.expected) {
+		return n, errContentSHA256
+	}
+	return n, err
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (a *authenticator) signingKey(date time.Time) []byte {
+	key := hmacSHA256([]byte("AWS4"+a.secretKey), date.Format("20060102"))
+	key = hmacSHA256(key, a.region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, "aws4_request")
+}
+
+func (s *signingContext) sign(stringToSign string) string {
+	return hex.EncodeToString(hmacSHA256(s.auth.signingKey(s.date), stringToSign))
+}
+
+// Checks a credential of the form ACCESSKEY/YYYYMMDD/REGION/s3/aws4_request against the gateway's, and returns the
+// scope that the signature is for.
+func (a *authenticator) checkCredential(credential string, date time.Time) (string, error) {
+	parts := strings.SplitN(credential, "/", 2)
+	if len(parts) != 2 {
+		return "", errAccessDenied
+	}
+	if parts[0] != a.accessKey {
+		return "", errInvalidAccessKey
+	}
+	scope := parts[1]
+	if scope != date.Format("20060102")+"/"+a.region+"/s3/aws4_request" {
+		return "", errSignatureMismatch
+	}
+	return scope, nil
+}
+
+func (a *authenticator) checkSkew(date time.Time) error {
+	skew := a.now().Sub(date)
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return errRequestTimeSkewed
+	}
+	return nil
+}
+
+// Checks a request signed in its Authorization header.
+func (a *authenticator) checkHeader(request *http.Request, payload string) (*signingContext, error) {
+	authorization := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, signingAlgorithm+" ") {
+		// anonymous, or signed with an older version of the algorithm
+		return nil, errAccessDenied
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(authorization, signingAlgorithm+" "), ",") {
+		if eq := strings.IndexByte(field, '='); eq >= 0 {
+			fields[strings.TrimSpace(field[:eq])] = strings.TrimSpace(field[eq+1:])
+		}
+	}
+	if payload == "" {
+		// S3 requires the hash of the body to be declared, so that it is part of the signature
+		return nil, errContentSHA256
+	}
+	amzDate := request.Header.Get("X-Amz-Date")
+	if amzDate == "" {
+		amzDate = request.Header.Get("Date")
+	}
+	date, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil {
+		if date, err = http.ParseTime(amzDate); err != nil {
+			return nil, errAccessDenied
+		}
+		date = date.UTC()
+	}
+	if err := a.checkSkew(date); err != nil {
+		return nil, err
+	}
+	scope, err := a.checkCredential(fields["Credential"], date)
+	if err != nil {
+		return nil, err
+	}
+	signing := &signingContext{auth: a, date: date, scope: scope}
+	canonical, err := canonicalRequest(request, fields["SignedHeaders"], request.URL.Query(), payload)
+	if err != nil {
+		return nil, err
+	}
+	expected := signing.sign(stringToSign(date, scope, canonical))
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return nil, errSignatureMismatch
+	}
+	signing.signature = expected
+	return signing, nil
+}
+
+// Checks a request signed in its query string, as with a presigned URL.
+func (a *authenticator) checkPresigned(request *http.Request) (*signingContext, error) {
+	query := request.URL.Query()
+	if query.Get("X-Amz-Algorithm") != signingAlgorithm {
+		return nil, errAccessDenied
+	}
+	date, err := time.Parse(amzDateFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, errAccessDenied
+	}
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || time.Duration(expires)*time.Second > maxPresignedExpiry {
+		return nil, errAccessDenied
+	}
+	now := a.now()
+	if now.Before(date.Add(-maxClockSkew)) {
+		return nil, errRequestTimeSkewed
+	}
+	if now.After(date.Add(time.Duration(expires) * time.Second)) {
+		return nil, errExpiredRequest
+	}
+	scope, err := a.checkCredential(query.Get("X-Amz-Credential"), date)
+	if err != nil {
+		return nil, err
+	}
+	signature := query.Get("X-Amz-Signature")
+	query.Del("X-Amz-Signature")
+	signing := &signingContext{auth: a, date: date, scope: scope}
+	canonical, err := canonicalRequest(request, query.Get("X-Amz-SignedHeaders"), query, unsignedPayload)
+	if err != nil {
+		return nil, err
+	}
+	expected := signing.sign(stringToSign(date, scope, canonical))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, errSignatureMismatch
+	}
+	signing.signature = expected
+	return signing, nil
+}
+
+func stringToSign(date time.Time, scope string, canonical string) string {
+	return signingAlgorithm + "\n" + date.Format(amzDateFormat) + "\n" + scope + "\n" + hashHex([]byte(canonical))
+}
+
+// Percent-encodes everything except the characters that SigV4 leaves alone, and slashes if 'path' is set.
+func uriEncode(s string, path bool) string {
+	var encoded strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			encoded.WriteByte(c)
+		case c == '/' && path:
+			encoded.WriteByte(c)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
+
+func canonicalRequest(request *http.Request, signedHeaders string, query map[string][]string, payload string) (string, error) {
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, false)+"="+uriEncode(value, false))
+		}
+	}
+	sort.Strings(pairs)
+
+	if signedHeaders == "" {
+		return "", errSignatureMismatch
+	}
+	var headers strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		var values []string
+		switch name {
+		case "host":
+			values = []string{request.Host}
+		default:
+			values = append(values, request.Header.Values(name)...)
+		}
+		for i, value := range values {
+			values[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+
+	return strings.Join([]string{
+		request.Method,
+		uriEncode(request.URL.Path, true),
+		strings.Join(pairs, "&"),
+		headers.String(),
+		signedHeaders,
+		payload,
+	}, "\n"), nil
+}
+
+// Decodes a body in the aws-chunked encoding, and checks the signature of each chunk if 'signing' is set. Each chunk
+// is of the form "SIZE[;chunk-signature=SIGNATURE]\r\nDATA\r\n", where SIZE is in hexadecimal, and the last chunk is
+// empty and may be followed by trailing headers.
+type chunkedReader struct {
+	body    *bufio.Reader
+	signing *signingContext
+	current []byte
+	done    bool
+	err     error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.current) == 0 && !c.done && c.err == nil {
+		c.err = c.nextChunk()
+	}
+	if len(c.current) > 0 {
+		n := copy(p, c.current)
+		c.current = c.current[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return 0, io.EOF
+}
+
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.body.ReadString('\n')
+	if err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+func (c *chunkedReader) nextChunk() error {
+	header, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	sizeField, signature := header, ""
+	if semicolon := strings.IndexByte(header, ';'); semicolon >= 0 {
+		sizeField = header[:semicolon]
+		signature = strings.TrimPrefix(header[semicolon+1:], "chunk-signature=")
+	}
+	size, err := strconv.ParseUint(sizeField, 16, 32)
+	if err != nil || size > maxStreamingChunk {
+		return errIncompleteBody
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.body, data); err != nil {
+		return errIncompleteBody
+	}
+	if c.signing != nil {
+		expected := c.signing.sign(strings.Join([]string{
+			signingAlgorithm + "-PAYLOAD",
+			c.signing.date.Format(amzDateFormat),
+			c.signing.scope,
+			c.signing.signature,
+			hashHex(nil),
+			hashHex(data),
+		}, "\n"))
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			return errSignatureMismatch
+		}
+		c.signing.signature = expected
+	}
+	if size == 0 {
+		// trailing headers, such as checksums, which aren't checked, up to the blank line that ends the body
+		for {
+			line, err := c.readLine()
+			if err == io.ErrUnexpectedEOF && line == "" {
+				break
+			} else if err != nil {
+				return err
+			}
+			if line == "" {
+				break
+			}
+		}
+		c.done = true
+		// anything after the encoded body is ignored, as a plain body would be
+		_, _ = io.Copy(ioutil.Discard, c.body)
+		return nil
+	}
+	if crlf, err := c.readLine(); err != nil || crlf != "" {
+		return errIncompleteBody
+	}
+	c.current = data
+	return nil
+}
@@ -0,0 +1,110 @@
+package s3gw
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"zircon/lib/filesystem"
+)
+
+// An error to report to the client as an S3 error response, with the code that SDKs look for.
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.message)
+}
+
+var (
+	errAccessDenied       = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errSignatureMismatch  = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+	errInvalidAccessKey   = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records."}
+	errRequestTimeSkewed  = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+	errExpiredRequest     = &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	errContentSHA256      = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+	errBadDigest          = &s3Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received."}
+	errMalformedXML       = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema."}
+	errInvalidPart        = &s3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found or did not match its entity tag."}
+	errInvalidPartOrder   = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order."}
+	errInvalidArgument    = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid argument."}
+	errIncompleteBody     = &s3Error{http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header."}
+	errBucketNotEmpty     = &s3Error{http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty."}
+	errBucketExists       = &s3Error{http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it."}
+	errMethodNotAllowed   = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+	errNotImplemented     = &s3Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented."}
+	errMissingContentSize = &s3Error{http.StatusLengthRequired, "MissingContentLength", "You must provide the Content-Length HTTP header."}
+)
+
+func errNoSuchBucket(bucket string) error {
+	return &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist: " + bucket}
+}
+
+func errNoSuchKey(key string) error {
+	return &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist: " + key}
+}
+
+func errNoSuchUpload(id string) error {
+	return &s3Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist: " + id}
+}
+
+func errInvalidBucketName(bucket string) error {
+	return &s3Error{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid: " + bucket}
+}
+
+// Keys are paths in the filesystem, so they can't have empty elements, or hold an object both at "a" and under "a/".
+func errInvalidKey(key string) error {
+	return &s3Error{http.StatusBadRequest, "InvalidArgument", "The key can't be stored in this filesystem: " + key}
+}
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestID string `xml:"RequestId"`
+}
+
+// Maps an error from the filesystem, or from the gateway itself, onto an S3 error. Errors that don't have an S3
+// equivalent are reported as InternalError, with their message passed through so that they can be diagnosed.
+func toS3Error(err error) *s3Error {
+	var s3err *s3Error
+	switch {
+	case errors.As(err, &s3err):
+		return s3err
+	case errors.Is(err, filesystem.ErrNotExist):
+		return &s3Error{http.StatusNotFound, "NoSuchKey", err.Error()}
+	default:
+		return &s3Error{http.StatusInternalServerError, "InternalError", err.Error()}
+	}
+}
+
+func writeError(writer http.ResponseWriter, request *http.Request, resource string, err error) {
+	s3err := toS3Error(err)
+	if request.Method == http.MethodHead {
+		// responses to HEAD have no body to explain themselves in
+		writer.WriteHeader(s3err.status)
+		return
+	}
+	_ = writeXML(writer, s3err.status, errorResponse{
+		Code:      s3err.code,
+		Message:   s3err.message,
+		Resource:  resource,
+		RequestID: writer.Header().Get("X-Amz-Request-Id"),
+	})
+}
+
+func writeXML(writer http.ResponseWriter, status int, response interface{}) error {
+	data, err := xml.Marshal(response)
+	if err != nil {
+		return err
+	}
+	writer.Header().Set("Content-Type", "application/xml")
+	writer.WriteHeader(status)
+	_, err = writer.Write(append([]byte(xml.Header), data...))
+	return err
+}
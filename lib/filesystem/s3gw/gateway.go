@@ -0,0 +1,318 @@
+package s3gw
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	path2 "path"
+	"regexp"
+	"strings"
+	"time"
+
+	"zircon/lib/filesystem"
+)
+
+// The gateway serves a filesystem through the parts of the Amazon S3 REST API that common tools and SDKs rely on:
+// listing, creating and deleting buckets; putting, copying, getting and deleting objects; listing objects, with or
+// without a delimiter; and multipart uploads. Requests must use path-style addressing (http://host/bucket/key), which
+// most SDKs support through an option such as ForcePathStyle or addressing_style=path.
+//     Each directory directly inside the gateway's root directory is a bucket, and an object's key is its path inside
+//     the bucket, so "photos/2019/cat.jpg" in bucket "media" is the file /media/photos/2019/cat.jpg when the root is
+//     "/". Directories along a key are created as objects are put, and removed again once the last object in them is
+//     deleted, so that the directory tree never shows more than the objects do.
+//     An object is put by writing it out in full to a file in the gateway's staging directory, and then moving it into
+//     place, replacing whatever object was there before. A reader never sees an object that is only partly written,
+//     although for a moment in between, the key has no object at all.
+//     The parts of a multipart upload are each staged as a file of their own, so that their data goes straight into
+//     chunks as it arrives rather than being held by the gateway, and completing the upload joins them together into
+//     the final object.
+//     The filesystem doesn't keep checksums of files, so the ETag of an object is only an MD5 of its contents in the
+//     response to the request that put it. Elsewhere, it is derived from the object's size and modification time, and
+//     is formatted like the ETag of a multipart upload, which clients know not to compare with an MD5.
+
+// The directory inside the root that the gateway keeps its staged objects and uploads in. It is never listed as a
+// bucket, since bucket names can't start with a dot.
+const stateDir = ".s3gw"
+
+// The region that requests are signed for, unless the gateway is configured with another one.
+const DefaultRegion = "us-east-1"
+
+type Gateway struct {
+	fs   filesystem.Filesystem
+	root string
+	// nil if requests aren't authenticated
+	auth *authenticator
+}
+
+// Serves the directories inside 'root' as buckets, without checking who makes requests. This is only suitable for
+// networks where every client is trusted.
+func NewGateway(fs filesystem.Filesystem, root string) (*Gateway, error) {
+	root = path2.Clean("/" + root)
+	g := &Gateway{fs: fs, root: root}
+	for _, dir := range []string{g.statePath(""), g.statePath("staging"), g.statePath("uploads")} {
+		if err := fs.Mkdir(dir); err != nil && !errors.Is(err, filesystem.ErrExists) {
+			return nil, fmt.Errorf("[gateway.go/MSD] %w", err)
+		}
+	}
+	return g, nil
+}
+
+// Like NewGateway, but only accepts requests signed with AWS Signature Version 4 using 'accessKey' and 'secretKey', for
+// 'region', or DefaultRegion if it is empty.
+func NewAuthenticatedGateway(fs filesystem.Filesystem, root string, region string, accessKey string, secretKey string) (*Gateway, error) {
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("both an access key and a secret key are required")
+	}
+	if region == "" {
+		region = DefaultRegion
+	}
+	g, err := NewGateway(fs, root)
+	if err != nil {
+		return nil, err
+	}
+	g.auth = &authenticator{region: region, accessKey: accessKey, secretKey: secretKey, now: time.Now}
+	return g, nil
+}
+
+func (g *Gateway) statePath(name string) string {
+	return path2.Join(g.root, stateDir, name)
+}
+
+func (g *Gateway) bucketPath(bucket string) string {
+	return path2.Join(g.root, bucket)
+}
+
+// The path of the file that holds an object. Keys are checked by checkKey first.
+func (g *Gateway) objectPath(bucket string, key string) string {
+	return g.bucketPath(bucket) + "/" + key
+}
+
+var bucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// Checks that a key can be stored as a path: every element has to be a valid file name, so keys can't have empty
+// elements, or elements of "." or "..". A key that ends in a slash is a folder marker, as consoles create for empty
+// folders, and is reported as such.
+func checkKey(key string) (folder bool, err error) {
+	folder = strings.HasSuffix(key, "/")
+	for _, element := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		if element == "" || element == "." || element == ".." {
+			return false, errInvalidKey(key)
+		}
+	}
+	return folder, nil
+}
+
+func (g *Gateway) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	resource := request.URL.Path
+	body, err := g.authenticate(request)
+	if err != nil {
+		writeError(writer, request, resource, err)
+		return
+	}
+	request.Body = body
+
+	trimmed := strings.TrimPrefix(resource, "/")
+	bucket, key := trimmed, ""
+	if slash := strings.IndexByte(trimmed, '/'); slash >= 0 {
+		bucket, key = trimmed[:slash], trimmed[slash+1:]
+	}
+	switch {
+	case bucket == "":
+		err = g.serveService(writer, request)
+	case !bucketName.MatchString(bucket):
+		err = errInvalidBucketName(bucket)
+	case key == "":
+		err = g.serveBucket(writer, request, bucket)
+	default:
+		err = g.serveObject(writer, request, bucket, key)
+	}
+	if err != nil {
+		writeError(writer, request, resource, err)
+	}
+}
+
+func (g *Gateway) serveService(writer http.ResponseWriter, request *http.Request) error {
+	if request.Method != http.MethodGet {
+		return errMethodNotAllowed
+	}
+	return g.listBuckets(writer)
+}
+
+func (g *Gateway) serveBucket(writer http.ResponseWriter, request *http.Request, bucket string) error {
+	query := request.URL.Query()
+	switch request.Method {
+	case http.MethodGet:
+		if _, ok := query["location"]; ok {
+			if err := g.checkBucket(bucket); err != nil {
+				return err
+			}
+			return writeXML(writer, http.StatusOK, locationConstraint{Region: g.region()})
+		}
+		if _, ok := query["uploads"]; ok {
+			return errNotImplemented
+		}
+		return g.listObjects(writer, request, bucket)
+	case http.MethodHead:
+		if err := g.checkBucket(bucket); err != nil {
+			return err
+		}
+		writer.WriteHeader(http.StatusOK)
+		return nil
+	case http.MethodPut:
+		return g.createBucket(writer, bucket)
+	case http.MethodDelete:
+		return g.deleteBucket(writer, bucket)
+	case http.MethodPost:
+		if _, ok := query["delete"]; ok {
+			return g.deleteObjects(writer, request, bucket)
+		}
+		return errNotImplemented
+	default:
+		return errMethodNotAllowed
+	}
+}
+
+func (g *Gateway) serveObject(writer http.ResponseWriter, request *http.Request, bucket string, key string) error {
+	folder, err := checkKey(key)
+	if err != nil {
+		return err
+	}
+	query := request.URL.Query()
+	uploadID, multipart := query["uploadId"]
+	switch request.Method {
+	case http.MethodGet, http.MethodHead:
+		if multipart {
+			return errNotImplemented
+		}
+		return g.getObject(writer, request, bucket, key)
+	case http.MethodPut:
+		if multipart {
+			return g.putPart(writer, request, bucket, key, uploadID[0], query.Get("partNumber"))
+		}
+		if source := request.Header.Get("X-Amz-Copy-Source"); source != "" {
+			return g.copyObject(writer, bucket, key, source)
+		}
+		if folder {
+			return g.putFolder(writer, request, bucket, key)
+		}
+		return g.putObject(writer, request, bucket, key)
+	case http.MethodDelete:
+		if multipart {
+			return g.abortUpload(writer, bucket, key, uploadID[0])
+		}
+		return g.deleteObject(writer, bucket, key)
+	case http.MethodPost:
+		if _, ok := query["uploads"]; ok {
+			return g.createUpload(writer, bucket, key)
+		}
+		if multipart {
+			return g.completeUpload(writer, request, bucket, key, uploadID[0])
+		}
+		return errNotImplemented
+	default:
+		return errMethodNotAllowed
+	}
+}
+
+func (g *Gateway) region() string {
+	if g.auth != nil {
+		return g.auth.region
+	}
+	return DefaultRegion
+}
+
+// Fails with NoSuchBucket unless 'bucket' exists.
+func (g *Gateway) checkBucket(bucket string) error {
+	info, err := g.fs.Stat(g.bucketPath(bucket))
+	if errors.Is(err, filesystem.ErrNotExist) || (err == nil && !info.IsDir()) {
+		return errNoSuchBucket(bucket)
+	}
+	return err
+}
+
+// Creates every directory along 'dir' that doesn't exist yet, stopping at the bucket, which must exist already.
+func (g *Gateway) mkdirAll(bucket string, dir string) error {
+	bucketPath := g.bucketPath(bucket)
+	if dir == bucketPath {
+		return g.checkBucket(bucket)
+	}
+	info, err := g.fs.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return errInvalidKey(strings.TrimPrefix(dir, bucketPath+"/"))
+		}
+		return nil
+	} else if !errors.Is(err, filesystem.ErrNotExist) {
+		return err
+	}
+	if err := g.mkdirAll(bucket, path2.Dir(dir)); err != nil {
+		return err
+	}
+	if err := g.fs.Mkdir(dir); err != nil && !errors.Is(err, filesystem.ErrExists) {
+		return err
+	}
+	return nil
+}
+
+// Removes 'dir' and the directories above it, up to but not including the bucket, for as long as they are empty.
+func (g *Gateway) pruneDirs(bucket string, dir string) {
+	for bucketPath := g.bucketPath(bucket); dir != bucketPath && strings.HasPrefix(dir, bucketPath+"/"); dir = path2.Dir(dir) {
+		names, err := g.fs.ListDir(dir)
+		if err != nil || len(names) > 0 || g.fs.Rmdir(dir) != nil {
+			// in use, or already removed by another request; either way, whatever is above is taken care of
+			return
+		}
+	}
+}
+
+// Picks an ID for a staged file or an upload. IDs are used as names in the filesystem, so they are kept short enough to
+// fit within filesystem.MaxName.
+func randomID() (string, error) {
+	var id [12]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// Writes the whole of 'data' out to a new file in the staging directory, and returns the file's path.
+func (g *Gateway) stage(data io.Reader) (string, error) {
+	id, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	staged := g.statePath("staging/" + id)
+	if err := g.fs.CreateAtomic(staged, data); err != nil {
+		return "", err
+	}
+	return staged, nil
+}
+
+// Moves a staged file to 'dest', replacing any file there. A staged file that can't be moved is removed.
+func (g *Gateway) publish(staged string, dest string) error {
+	var err error
+	// another request can put the same key in between removing the old file and moving the new one into place, in
+	// which case this one goes again; the last to be moved into place wins, just as it would in S3
+	for attempt := 0; attempt < 5; attempt++ {
+		err = g.fs.Rename(staged, dest)
+		if !errors.Is(err, filesystem.ErrExists) {
+			break
+		}
+		info, serr := g.fs.Stat(dest)
+		if serr == nil && info.IsDir() {
+			err = errInvalidKey(dest)
+			break
+		}
+		if uerr := g.fs.Unlink(dest); uerr != nil && !errors.Is(uerr, filesystem.ErrNotExist) {
+			err = uerr
+			break
+		}
+	}
+	if err != nil {
+		_ = g.fs.Unlink(staged)
+	}
+	return err
+}
@@ -0,0 +1,269 @@
+package s3gw
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"zircon/lib/filesystem"
+)
+
+// The most keys a listing returns, if the client doesn't ask for fewer.
+const defaultMaxKeys = 1000
+
+// Explanation of listing:
+//     S3 lists keys in byte order, and the filesystem lists each directory by itself, so a listing walks the bucket's
+//     tree depth-first, visiting the nodes in each directory in order of their names, with a slash after the names of
+//     directories, since that is how they continue in the keys below them. Taken in that order, the keys come out of
+//     the walk already sorted, and a listing can stop as soon as it has as many keys as it was asked for.
+//     Whole directories are passed over without being read whenever none of the keys in them can be listed: when they
+//     fall outside the prefix, when they come before where the listing is continuing from, and when the delimiter is
+//     "/", in which case each one is listed as a single common prefix instead.
+//     Every node in the tree is stat'ed as the walk reaches it, so listing a directory takes one request to the
+//     filesystem for each node in it.
+
+// Reached the end of a page of results.
+var errPageFull = errors.New("listed as many keys as were asked for")
+
+type listing struct {
+	g         *Gateway
+	prefix    string
+	delimiter string
+	// keys, and common prefixes, at or before this one are left out
+	after   string
+	maxKeys int
+
+	contents   []objectEntry
+	prefixes   []commonPrefix
+	last       string
+	truncated  bool
+	withOwners bool
+}
+
+func (l *listing) count() int {
+	return len(l.contents) + len(l.prefixes)
+}
+
+// Adds a key or a common prefix to the results, or reports that there is no room for it.
+func (l *listing) add(key string, entry *objectEntry) error {
+	if l.count() >= l.maxKeys {
+		l.truncated = true
+		return errPageFull
+	}
+	if entry != nil {
+		l.contents = append(l.contents, *entry)
+	} else {
+		l.prefixes = append(l.prefixes, commonPrefix{Prefix: key})
+	}
+	l.last = key
+	return nil
+}
+
+// The common prefix that 'key' is listed under instead of by itself, if any.
+func (l *listing) rollup(key string) (string, bool) {
+	if l.delimiter == "" || !strings.HasPrefix(key, l.prefix) {
+		return "", false
+	}
+	index := strings.Index(key[len(l.prefix):], l.delimiter)
+	if index < 0 {
+		return "", false
+	}
+	return key[:len(l.prefix)+index+len(l.delimiter)], true
+}
+
+// Adds a key to the results, or the common prefix that it is under if that hasn't been added already. Keys arrive in
+// order, so all of the keys under the same common prefix arrive together.
+func (l *listing) addKey(key string, info os.FileInfo) error {
+	if !strings.HasPrefix(key, l.prefix) {
+		return nil
+	}
+	if prefix, ok := l.rollup(key); ok {
+		if prefix <= l.after || (len(l.prefixes) > 0 && l.last == prefix) {
+			return nil
+		}
+		return l.add(prefix, nil)
+	}
+	if key <= l.after {
+		return nil
+	}
+	entry := &objectEntry{
+		Key:          key,
+		LastModified: formatTime(info.ModTime()),
+		ETag:         statETag(info),
+		StorageClass: "STANDARD",
+	}
+	if !info.IsDir() {
+		entry.Size = info.Size()
+	}
+	if l.withOwners {
+		entry.Owner = &gatewayOwner
+	}
+	return l.add(key, entry)
+}
+
+// Lists the keys under the directory at 'dir', all of which begin with 'dirKey', which is empty for the bucket itself.
+func (l *listing) walk(dir string, dirKey string) error {
+	names, err := l.g.fs.ListDir(dir)
+	if errors.Is(err, filesystem.ErrNotExist) {
+		// removed since its parent was listed
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(names) == 0 && dirKey != "" {
+		// an empty directory is listed as a folder of its own
+		info, err := l.g.fs.Stat(dir)
+		if errors.Is(err, filesystem.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return l.addKey(dirKey, info)
+	}
+
+	type node struct {
+		key  string
+		info os.FileInfo
+	}
+	var nodes []node
+	for _, name := range names {
+		info, err := l.g.fs.Stat(dir + "/" + name)
+		if errors.Is(err, filesystem.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		key := dirKey + name
+		if info.IsDir() {
+			key += "/"
+		}
+		nodes = append(nodes, node{key: key, info: info})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].key < nodes[j].key
+	})
+
+	for _, n := range nodes {
+		if !n.info.IsDir() {
+			if err := l.addKey(n.key, n.info); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasPrefix(n.key, l.prefix) && !strings.HasPrefix(l.prefix, n.key) {
+			// none of the keys below it have the prefix
+			continue
+		}
+		if n.key <= l.after && !strings.HasPrefix(l.after, n.key) {
+			// every key below it comes before where the listing continues from
+			continue
+		}
+		if prefix, ok := l.rollup(n.key); ok && l.delimiter == "/" {
+			// every key below it is listed under the same common prefix, and there is at least one
+			if err := l.addKey(prefix, n.info); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := l.walk(dir+"/"+strings.TrimSuffix(n.key[len(dirKey):], "/"), n.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Escapes keys for encoding-type=url, which clients ask for so that keys with characters XML can't hold survive.
+func encodeKey(key string) string {
+	return strings.ReplaceAll(url.QueryEscape(key), "+", "%20")
+}
+
+func (g *Gateway) listObjects(writer http.ResponseWriter, request *http.Request, bucket string) error {
+	if err := g.checkBucket(bucket); err != nil {
+		return err
+	}
+	query := request.URL.Query()
+	version2 := query.Get("list-type") == "2"
+	l := &listing{
+		g:          g,
+		prefix:     query.Get("prefix"),
+		delimiter:  query.Get("delimiter"),
+		maxKeys:    defaultMaxKeys,
+		withOwners: !version2 || query.Get("fetch-owner") == "true",
+	}
+	if maxKeys := query.Get("max-keys"); maxKeys != "" {
+		n, err := strconv.Atoi(maxKeys)
+		if err != nil || n < 0 {
+			return errInvalidArgument
+		}
+		if n < l.maxKeys {
+			l.maxKeys = n
+		}
+	}
+	token := query.Get("continuation-token")
+	if version2 && token != "" {
+		after, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return errInvalidArgument
+		}
+		l.after = string(after)
+	} else if version2 {
+		l.after = query.Get("start-after")
+	} else {
+		l.after = query.Get("marker")
+	}
+
+	if err := l.walk(g.bucketPath(bucket), ""); err != nil && err != errPageFull {
+		return fmt.Errorf("[list.go/WLK] %w", err)
+	}
+
+	result := listBucketResult{
+		Xmlns:          s3Namespace,
+		Name:           bucket,
+		Prefix:         l.prefix,
+		Delimiter:      l.delimiter,
+		MaxKeys:        l.maxKeys,
+		IsTruncated:    l.truncated,
+		Contents:       l.contents,
+		CommonPrefixes: l.prefixes,
+	}
+	if version2 {
+		keyCount := l.count()
+		result.KeyCount = &keyCount
+		result.ContinuationToken = token
+		result.StartAfter = query.Get("start-after")
+		if l.truncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(l.last))
+		}
+	} else {
+		marker := query.Get("marker")
+		result.Marker = &marker
+		if l.truncated && l.delimiter != "" {
+			// without a delimiter, clients continue from the last key instead
+			result.NextMarker = l.last
+		}
+	}
+	if query.Get("encoding-type") == "url" {
+		result.EncodingType = "url"
+		result.Prefix = encodeKey(result.Prefix)
+		result.Delimiter = encodeKey(result.Delimiter)
+		result.StartAfter = encodeKey(result.StartAfter)
+		result.NextMarker = encodeKey(result.NextMarker)
+		if result.Marker != nil {
+			marker := encodeKey(*result.Marker)
+			result.Marker = &marker
+		}
+		for i := range result.Contents {
+			result.Contents[i].Key = encodeKey(result.Contents[i].Key)
+		}
+		for i := range result.CommonPrefixes {
+			result.CommonPrefixes[i].Prefix = encodeKey(result.CommonPrefixes[i].Prefix)
+		}
+	}
+	return writeXML(writer, http.StatusOK, result)
+}
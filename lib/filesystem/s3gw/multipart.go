@@ -0,0 +1,219 @@
+package s3gw
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	path2 "path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"zircon/lib/filesystem"
+)
+
+// The highest part number that S3 accepts.
+const maxPartNumber = 10000
+
+// Explanation of multipart uploads:
+//     Each upload has a directory in the gateway's uploads directory, named after its ID, which holds a file recording
+//     the bucket and key it is for, and a file for each part that has been uploaded, named after the part's number and
+//     MD5. The MD5 is written in base64 rather than hex in the name, since hex wouldn't fit within filesystem.MaxName.
+//     Each part is written out to the filesystem as it arrives, so the gateway never holds more of an upload than
+//     the request it is handling at the moment; completing the upload then reads the parts back in order while writing
+//     the object out, and removes the upload's directory.
+//     Uploads that are never completed or aborted are left in the uploads directory until removed by hand.
+
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{24}$`)
+
+func (g *Gateway) uploadPath(id string, name string) string {
+	return g.statePath("uploads/" + id + "/" + name)
+}
+
+func partPrefix(number int) string {
+	return fmt.Sprintf("%05d-", number)
+}
+
+func partName(number int, sum []byte) string {
+	return partPrefix(number) + base64.RawURLEncoding.EncodeToString(sum)
+}
+
+// Checks that the upload with ID 'id' exists and is for 'key' in 'bucket'.
+func (g *Gateway) checkUpload(bucket string, key string, id string) error {
+	if !uploadIDPattern.MatchString(id) {
+		return errNoSuchUpload(id)
+	}
+	file, err := g.fs.OpenRead(g.uploadPath(id, "target"))
+	if errors.Is(err, filesystem.ErrNotExist) {
+		return errNoSuchUpload(id)
+	} else if err != nil {
+		return fmt.Errorf("[multipart.go/OUT] %w", err)
+	}
+	defer file.Close()
+	target, err := ioutil.ReadAll(file)
+	if err != nil {
+		return fmt.Errorf("[multipart.go/RUT] %w", err)
+	}
+	if string(target) != bucket+"\n"+key {
+		return errNoSuchUpload(id)
+	}
+	return nil
+}
+
+func (g *Gateway) createUpload(writer http.ResponseWriter, bucket string, key string) error {
+	if strings.HasSuffix(key, "/") {
+		// folders are directories, which can't be written to
+		return errInvalidKey(key)
+	}
+	if err := g.checkBucket(bucket); err != nil {
+		return err
+	}
+	id, err := randomID()
+	if err != nil {
+		return fmt.Errorf("[multipart.go/RID] %w", err)
+	}
+	if err := g.fs.Mkdir(g.statePath("uploads/" + id)); err != nil {
+		return fmt.Errorf("[multipart.go/MUD] %w", err)
+	}
+	if err := g.fs.CreateAtomic(g.uploadPath(id, "target"), strings.NewReader(bucket+"\n"+key)); err != nil {
+		return fmt.Errorf("[multipart.go/CUT] %w", err)
+	}
+	return writeXML(writer, http.StatusOK, initiateMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: id,
+	})
+}
+
+func (g *Gateway) putPart(writer http.ResponseWriter, request *http.Request, bucket string, key string, id string, partNumber string) error {
+	number, err := strconv.Atoi(partNumber)
+	if err != nil || number < 1 || number > maxPartNumber {
+		return errInvalidArgument
+	}
+	if err := g.checkUpload(bucket, key, id); err != nil {
+		return err
+	}
+	body := hashBody(request.Body)
+	staged, err := g.stage(body)
+	if err != nil {
+		return fmt.Errorf("[multipart.go/STP] %w", err)
+	}
+	sum, err := body.check(request)
+	if err != nil {
+		_ = g.fs.Unlink(staged)
+		return err
+	}
+	name := partName(number, sum)
+	if err := g.publish(staged, g.uploadPath(id, name)); err != nil {
+		return fmt.Errorf("[multipart.go/PBP] %w", err)
+	}
+	// a part that is uploaded again replaces the one uploaded before
+	names, err := g.fs.ListDir(g.statePath("uploads/" + id))
+	if err != nil {
+		return fmt.Errorf("[multipart.go/LUD] %w", err)
+	}
+	for _, other := range names {
+		if other != name && strings.HasPrefix(other, partPrefix(number)) {
+			if err := g.fs.Unlink(g.uploadPath(id, other)); err != nil && !errors.Is(err, filesystem.ErrNotExist) {
+				return fmt.Errorf("[multipart.go/URP] %w", err)
+			}
+		}
+	}
+	writer.Header().Set("ETag", quoteETag(sum))
+	writer.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *Gateway) completeUpload(writer http.ResponseWriter, request *http.Request, bucket string, key string, id string) error {
+	if err := g.checkUpload(bucket, key, id); err != nil {
+		return err
+	}
+	var complete completeMultipartUpload
+	if err := xml.NewDecoder(io.LimitReader(request.Body, 2<<20)).Decode(&complete); err != nil {
+		return errMalformedXML
+	}
+	if len(complete.Parts) == 0 {
+		return errMalformedXML
+	}
+
+	// the ETag of a multipart upload is the MD5 of the MD5s of its parts, followed by how many parts there were
+	var sums bytes.Buffer
+	var parts []io.Reader
+	for i, part := range complete.Parts {
+		if i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber {
+			return errInvalidPartOrder
+		}
+		etag := strings.ToLower(strings.Trim(part.ETag, `"`))
+		sum, err := hex.DecodeString(etag)
+		if err != nil || len(sum) != md5.Size {
+			return errInvalidPart
+		}
+		sums.Write(sum)
+		file, err := g.fs.OpenRead(g.uploadPath(id, partName(part.PartNumber, sum)))
+		if errors.Is(err, filesystem.ErrNotExist) {
+			return errInvalidPart
+		} else if err != nil {
+			return fmt.Errorf("[multipart.go/OPP] %w", err)
+		}
+		defer file.Close()
+		parts = append(parts, file)
+	}
+
+	target := g.objectPath(bucket, key)
+	if err := g.mkdirAll(bucket, path2.Dir(target)); err != nil {
+		return err
+	}
+	staged, err := g.stage(io.MultiReader(parts...))
+	if err == nil {
+		err = g.publish(staged, target)
+	}
+	if err != nil {
+		g.pruneDirs(bucket, path2.Dir(target))
+		return fmt.Errorf("[multipart.go/CPU] %w", err)
+	}
+	if err := g.removeUpload(id); err != nil {
+		return fmt.Errorf("[multipart.go/RMU] %w", err)
+	}
+	sum := md5.Sum(sums.Bytes())
+	return writeXML(writer, http.StatusOK, completeMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(complete.Parts)),
+	})
+}
+
+func (g *Gateway) abortUpload(writer http.ResponseWriter, bucket string, key string, id string) error {
+	if err := g.checkUpload(bucket, key, id); err != nil {
+		return err
+	}
+	if err := g.removeUpload(id); err != nil {
+		return fmt.Errorf("[multipart.go/ABU] %w", err)
+	}
+	writer.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Removes an upload's directory along with everything in it.
+func (g *Gateway) removeUpload(id string) error {
+	dir := g.statePath("uploads/" + id)
+	names, err := g.fs.ListDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := g.fs.Unlink(dir + "/" + name); err != nil && !errors.Is(err, filesystem.ErrNotExist) {
+			return err
+		}
+	}
+	return g.fs.Rmdir(dir)
+}
@@ -0,0 +1,303 @@
+package s3gw
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	path2 "path"
+	"strings"
+
+	"zircon/lib/filesystem"
+)
+
+// The most that a request to delete multiple objects may name, as in S3.
+const maxDeleteKeys = 1000
+
+func quoteETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum) + `"`
+}
+
+// An ETag that changes whenever an object is replaced or changed in place, for objects whose contents weren't just
+// hashed. It ends in "-1" like the ETag of a single-part multipart upload, so that clients don't take it for an MD5.
+func statETag(info os.FileInfo) string {
+	sum := md5.Sum([]byte(fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())))
+	return `"` + hex.EncodeToString(sum[:]) + `-1"`
+}
+
+// Reads 'body' through an MD5 hash, so that once it has been read to the end, the hash can be compared against the
+// Content-MD5 that the client sent, if any.
+type hashedBody struct {
+	io.Reader
+	hash hash.Hash
+}
+
+func hashBody(body io.Reader) *hashedBody {
+	h := md5.New()
+	return &hashedBody{Reader: io.TeeReader(body, h), hash: h}
+}
+
+func (h *hashedBody) check(request *http.Request) ([]byte, error) {
+	sum := h.hash.Sum(nil)
+	if expected := request.Header.Get("Content-MD5"); expected != "" {
+		decoded, err := base64.StdEncoding.DecodeString(expected)
+		if err != nil || string(decoded) != string(sum) {
+			return nil, errBadDigest
+		}
+	}
+	return sum, nil
+}
+
+func (g *Gateway) listBuckets(writer http.ResponseWriter) error {
+	names, err := g.fs.ListDir(g.root)
+	if err != nil {
+		return fmt.Errorf("[objects.go/LBR] %w", err)
+	}
+	result := listAllMyBucketsResult{Xmlns: s3Namespace, Owner: gatewayOwner}
+	for _, name := range names {
+		if !bucketName.MatchString(name) {
+			continue
+		}
+		info, err := g.fs.Stat(g.bucketPath(name))
+		if err != nil || !info.IsDir() {
+			// removed since it was listed, or just a file that happens to be in the root
+			continue
+		}
+		result.Buckets = append(result.Buckets, bucketEntry{Name: name, CreationDate: formatTime(info.ModTime())})
+	}
+	return writeXML(writer, http.StatusOK, result)
+}
+
+func (g *Gateway) createBucket(writer http.ResponseWriter, bucket string) error {
+	err := g.fs.Mkdir(g.bucketPath(bucket))
+	if errors.Is(err, filesystem.ErrExists) {
+		return errBucketExists
+	} else if err != nil {
+		return fmt.Errorf("[objects.go/MKB] %w", err)
+	}
+	writer.Header().Set("Location", "/"+bucket)
+	writer.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *Gateway) deleteBucket(writer http.ResponseWriter, bucket string) error {
+	if err := g.checkBucket(bucket); err != nil {
+		return err
+	}
+	names, err := g.fs.ListDir(g.bucketPath(bucket))
+	if err != nil {
+		return fmt.Errorf("[objects.go/LBD] %w", err)
+	}
+	if len(names) > 0 {
+		return errBucketNotEmpty
+	}
+	if err := g.fs.Rmdir(g.bucketPath(bucket)); err != nil {
+		// most likely, an object was put in the meantime
+		return errBucketNotEmpty
+	}
+	writer.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (g *Gateway) getObject(writer http.ResponseWriter, request *http.Request, bucket string, key string) error {
+	if err := g.checkBucket(bucket); err != nil {
+		return err
+	}
+	folder := strings.HasSuffix(key, "/")
+	target := g.objectPath(bucket, strings.TrimSuffix(key, "/"))
+	info, err := g.fs.Stat(target)
+	if errors.Is(err, filesystem.ErrNotExist) || (err == nil && info.IsDir() != folder) {
+		return errNoSuchKey(key)
+	} else if err != nil {
+		return fmt.Errorf("[objects.go/STO] %w", err)
+	}
+	header := writer.Header()
+	header.Set("ETag", statETag(info))
+	// set explicitly, so that ServeContent doesn't try to guess one from the data
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Accept-Ranges", "bytes")
+	if folder {
+		http.ServeContent(writer, request, "", info.ModTime(), strings.NewReader(""))
+		return nil
+	}
+	file, err := g.fs.OpenRead(target)
+	if err != nil {
+		return fmt.Errorf("[objects.go/OPO] %w", err)
+	}
+	defer file.Close()
+	// handles HEAD, Range, and the conditional headers
+	http.ServeContent(writer, request, "", info.ModTime(), file)
+	return nil
+}
+
+func (g *Gateway) putObject(writer http.ResponseWriter, request *http.Request, bucket string, key string) error {
+	target := g.objectPath(bucket, key)
+	if err := g.mkdirAll(bucket, path2.Dir(target)); err != nil {
+		return err
+	}
+	body := hashBody(request.Body)
+	staged, err := g.stage(body)
+	if err != nil {
+		g.pruneDirs(bucket, path2.Dir(target))
+		return fmt.Errorf("[objects.go/STG] %w", err)
+	}
+	sum, err := body.check(request)
+	if err == nil {
+		err = g.publish(staged, target)
+	} else {
+		_ = g.fs.Unlink(staged)
+	}
+	if err != nil {
+		g.pruneDirs(bucket, path2.Dir(target))
+		return err
+	}
+	writer.Header().Set("ETag", quoteETag(sum))
+	writer.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// Puts an empty object whose key ends in a slash, which consoles and some tools use to create a folder with nothing in
+// it yet. This is stored as an empty directory, which is listed as the same object.
+func (g *Gateway) putFolder(writer http.ResponseWriter, request *http.Request, bucket string, key string) error {
+	if n, _ := io.Copy(ioutil.Discard, io.LimitReader(request.Body, 1)); n > 0 {
+		return errInvalidKey(key)
+	}
+	if err := g.mkdirAll(bucket, g.objectPath(bucket, strings.TrimSuffix(key, "/"))); err != nil {
+		return err
+	}
+	sum := md5.Sum(nil)
+	writer.Header().Set("ETag", quoteETag(sum[:]))
+	writer.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *Gateway) copyObject(writer http.ResponseWriter, bucket string, key string, source string) error {
+	if query := strings.IndexByte(source, '?'); query >= 0 {
+		// only versionId can be given, and there is only ever one version
+		source = source[:query]
+	}
+	source, err := url.PathUnescape(strings.TrimPrefix(source, "/"))
+	if err != nil {
+		return errInvalidArgument
+	}
+	slash := strings.IndexByte(source, '/')
+	if slash < 0 {
+		return errInvalidArgument
+	}
+	sourceBucket, sourceKey := source[:slash], source[slash+1:]
+	if !bucketName.MatchString(sourceBucket) {
+		return errInvalidBucketName(sourceBucket)
+	}
+	if folder, err := checkKey(sourceKey); err != nil {
+		return err
+	} else if folder {
+		return errNotImplemented
+	}
+	if err := g.checkBucket(sourceBucket); err != nil {
+		return err
+	}
+	file, err := g.fs.OpenRead(g.objectPath(sourceBucket, sourceKey))
+	if errors.Is(err, filesystem.ErrNotExist) {
+		return errNoSuchKey(sourceKey)
+	} else if err != nil {
+		return fmt.Errorf("[objects.go/OCS] %w", err)
+	}
+	defer file.Close()
+
+	target := g.objectPath(bucket, key)
+	if err := g.mkdirAll(bucket, path2.Dir(target)); err != nil {
+		return err
+	}
+	h := md5.New()
+	staged, err := g.stage(io.TeeReader(file, h))
+	if err == nil {
+		err = g.publish(staged, target)
+	}
+	if err != nil {
+		g.pruneDirs(bucket, path2.Dir(target))
+		return fmt.Errorf("[objects.go/CPO] %w", err)
+	}
+	info, err := g.fs.Stat(target)
+	if err != nil {
+		return fmt.Errorf("[objects.go/STC] %w", err)
+	}
+	return writeXML(writer, http.StatusOK, copyObjectResult{
+		LastModified: formatTime(info.ModTime()),
+		ETag:         quoteETag(h.Sum(nil)),
+	})
+}
+
+// Deletes the object at 'key', if there is one, and any directories that are left empty without it. Deleting an
+// object that doesn't exist succeeds, as in S3.
+func (g *Gateway) deleteKey(bucket string, key string) error {
+	folder, err := checkKey(key)
+	if err != nil {
+		return err
+	}
+	target := g.objectPath(bucket, strings.TrimSuffix(key, "/"))
+	info, err := g.fs.Stat(target)
+	if errors.Is(err, filesystem.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("[objects.go/STD] %w", err)
+	}
+	if info.IsDir() != folder {
+		return nil
+	}
+	if folder {
+		// only a folder with nothing in it is an object of its own; otherwise it is just part of other keys
+		if names, err := g.fs.ListDir(target); err != nil || len(names) > 0 {
+			return err
+		}
+		err = g.fs.Rmdir(target)
+	} else {
+		err = g.fs.Unlink(target)
+	}
+	if err != nil && !errors.Is(err, filesystem.ErrNotExist) {
+		return fmt.Errorf("[objects.go/DLO] %w", err)
+	}
+	g.pruneDirs(bucket, path2.Dir(target))
+	return nil
+}
+
+func (g *Gateway) deleteObject(writer http.ResponseWriter, bucket string, key string) error {
+	if err := g.checkBucket(bucket); err != nil {
+		return err
+	}
+	if err := g.deleteKey(bucket, key); err != nil {
+		return err
+	}
+	writer.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (g *Gateway) deleteObjects(writer http.ResponseWriter, request *http.Request, bucket string) error {
+	if err := g.checkBucket(bucket); err != nil {
+		return err
+	}
+	var objects deleteRequest
+	if err := xml.NewDecoder(io.LimitReader(request.Body, 2<<20)).Decode(&objects); err != nil {
+		return errMalformedXML
+	}
+	if len(objects.Objects) == 0 || len(objects.Objects) > maxDeleteKeys {
+		return errMalformedXML
+	}
+	result := deleteResult{Xmlns: s3Namespace}
+	for _, object := range objects.Objects {
+		if err := g.deleteKey(bucket, object.Key); err != nil {
+			s3err := toS3Error(err)
+			result.Errors = append(result.Errors, deleteErrorEntry{Key: object.Key, Code: s3err.code, Message: s3err.message})
+		} else if !objects.Quiet {
+			result.Deleted = append(result.Deleted, deletedEntry{Key: object.Key})
+		}
+	}
+	return writeXML(writer, http.StatusOK, result)
+}
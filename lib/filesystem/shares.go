@@ -0,0 +1,185 @@
+package filesystem
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"zircon/lib/apis"
+)
+
+// Explanation of shared chunks:
+//     A snapshot copies the index of each file, but not its data chunks, so the file in the snapshot and the file it
+//     was copied from refer to the same data chunks. Each index marks such chunks as shared, by setting sharedChunk in
+//     their chunk numbers, and the share table records how many indexes refer to each of them. Writing to a shared
+//     chunk through any index first replaces it in that index with a copy, and releasing it from an index, as when a
+//     file is truncated or removed, only deletes it once no other index refers to it.
+//     The share table is a single chunk, whose number is kept in the root directory, and which is only created once
+//     something is first shared. It is a hash table of shareSlots slots, each holding a chunk number and how many
+//     indexes refer to that chunk, which is always at least two: a marked chunk that isn't in the table is only referred
+//     to by one index, which can write to it after unmarking it, without copying it. Each chunk is kept in one of the
+//     shareWindow slots starting from the one its number hashes to, so a change to the table takes a single read of
+//     those slots, and a single write that is only made if the table hasn't changed since, as with directories.
+//     The table can't grow, so no more than about shareSlots chunks can be shared at once, and taking a snapshot fails
+//     if the window for one of its chunks is already full.
+
+const shareSlotSize = 16
+const shareSlots = apis.MaxChunkSize / shareSlotSize
+const shareWindow = 64
+
+// The first slot that a chunk can be kept in.
+func shareHome(chunk apis.ChunkNum) int {
+	return int(uint64(chunk) * 0x9E3779B97F4A7C15 % uint64(shareSlots-shareWindow+1))
+}
+
+// Returns the share table, creating it first if it doesn't exist yet and 'create' is set. Zero means that there isn't
+// one, and so that nothing is shared.
+func (t Traverser) shareTable(create bool) (apis.ChunkNum, error) {
+	root, err := t.fs.GetRoot()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		data, ver, err := t.client.Read(root, sharesOffset, 8)
+		if err != nil {
+			return 0, err
+		}
+		table := apis.ChunkNum(binary.LittleEndian.Uint64(data))
+		if table != 0 || !create {
+			return table, nil
+		}
+		if table, err = t.client.New(); err != nil {
+			return 0, err
+		}
+		// as with a new directory, write once so that every later change is checked against the version it was based on
+		if _, err := t.client.Write(table, 0, apis.AnyVersion, nil); err != nil {
+			_ = t.client.Delete(table, apis.AnyVersion)
+			return 0, err
+		}
+		encoded := make([]byte, 8)
+		binary.LittleEndian.PutUint64(encoded, uint64(table))
+		nver, err := t.client.Write(root, sharesOffset, ver, encoded)
+		if err == nil {
+			return table, nil
+		}
+		if derr := t.client.Delete(table, apis.AnyVersion); derr != nil {
+			return 0, fmt.Errorf("two errors: %v -- and -- %v", err, derr)
+		}
+		if nver == 0 {
+			return 0, err
+		}
+		// version mismatch; someone else may have created it first, so go around again
+	}
+}
+
+// Reads the slots that a chunk can be kept in, and returns them along with which of them holds the chunk and which is
+// the first free one, each of which is -1 if there is none.
+func (t Traverser) readShareWindow(table apis.ChunkNum, chunk apis.ChunkNum) ([]byte, apis.Version, int, int, error) {
+	data, ver, err := t.client.Read(table, uint32(shareHome(chunk)*shareSlotSize), shareWindow*shareSlotSize)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	found, free := -1, -1
+	for i := 0; i < shareWindow; i++ {
+		switch apis.ChunkNum(binary.LittleEndian.Uint64(data[i*shareSlotSize:])) {
+		case chunk:
+			found = i
+		case 0:
+			if free < 0 {
+				free = i
+			}
+		}
+	}
+	return data, ver, found, free, nil
+}
+
+// Returns how many indexes refer to a data chunk that is marked as shared.
+func (t Traverser) shareCount(chunk apis.ChunkNum) (uint64, error) {
+	table, err := t.shareTable(false)
+	if err != nil || table == 0 {
+		return 1, err
+	}
+	data, _, found, _, err := t.readShareWindow(table, chunk)
+	if err != nil || found < 0 {
+		return 1, err
+	}
+	return binary.LittleEndian.Uint64(data[found*shareSlotSize+8:]), nil
+}
+
+// Changes how many indexes refer to a data chunk that is marked as shared by 'delta', and returns how many do
+// afterwards.
+func (t Traverser) adjustShares(chunk apis.ChunkNum, delta int64) (uint64, error) {
+	table, err := t.shareTable(delta > 0)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		count := int64(1)
+		var data []byte
+		var ver apis.Version
+		found, free := -1, -1
+		if table != 0 {
+			if data, ver, found, free, err = t.readShareWindow(table, chunk); err != nil {
+				return 0, err
+			}
+			if found >= 0 {
+				count = int64(binary.LittleEndian.Uint64(data[found*shareSlotSize+8:]))
+			}
+		}
+		count += delta
+		if count < 0 {
+			return 0, fmt.Errorf("chunk %d is referred to by fewer than %d indexes", chunk, -delta)
+		}
+		slot := make([]byte, shareSlotSize)
+		position := found
+		if count >= 2 {
+			if position < 0 {
+				position = free
+			}
+			if position < 0 {
+				return 0, errors.New("share table is full")
+			}
+			binary.LittleEndian.PutUint64(slot, uint64(chunk))
+			binary.LittleEndian.PutUint64(slot[8:], uint64(count))
+		} else if found < 0 {
+			// it isn't in the table, and doesn't need to be
+			return uint64(count), nil
+		}
+		offset := uint32((shareHome(chunk) + position) * shareSlotSize)
+		nver, err := t.client.Write(table, offset, ver, slot)
+		if err == nil {
+			return uint64(count), nil
+		} else if nver == 0 {
+			return 0, err
+		}
+		// version mismatch; go around again
+	}
+}
+
+// Records that one fewer index refers to a data chunk that is marked as shared, and deletes it if that was the last.
+func (t Traverser) releaseShared(chunk apis.ChunkNum) error {
+	count, err := t.adjustShares(chunk, -1)
+	if err != nil || count > 0 {
+		return err
+	}
+	return t.client.Delete(chunk, apis.AnyVersion)
+}
+
+// Reads the whole share table, for checking it against the tree.
+func (t Traverser) readShares() (map[apis.ChunkNum]uint64, apis.ChunkNum, error) {
+	table, err := t.shareTable(false)
+	if err != nil || table == 0 {
+		return nil, table, err
+	}
+	data, _, err := t.client.Read(table, 0, shareSlots*shareSlotSize)
+	if err != nil {
+		return nil, table, err
+	}
+	counts := map[apis.ChunkNum]uint64{}
+	for i := 0; i < shareSlots; i++ {
+		if chunk := apis.ChunkNum(binary.LittleEndian.Uint64(data[i*shareSlotSize:])); chunk != 0 {
+			counts[chunk] = binary.LittleEndian.Uint64(data[i*shareSlotSize+8:])
+		}
+	}
+	return counts, table, nil
+}
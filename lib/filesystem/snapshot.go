@@ -0,0 +1,394 @@
+package filesystem
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	path2 "path"
+	"strings"
+
+	"zircon/lib/apis"
+	"zircon/lib/util"
+)
+
+// Explanation of snapshots:
+//     A snapshot is a copy of a subtree as it was when the snapshot was taken, kept in SnapshotDir, where it can be read
+//     like any other part of the tree, but not changed. Taking one copies every directory in the subtree, and the index
+//     of every file, but not the files' data: each file in the snapshot shares its data chunks with the file it was
+//     copied from, until one of them is written to; see shares.go. So a snapshot costs about as much as listing the
+//     subtree does, however much data the subtree holds.
+//     The copy is built before anything refers to it, and is only linked into SnapshotDir once it is complete, so a
+//     snapshot either appears whole or not at all. While it is built, each directory in the subtree is read-locked from
+//     when it is reached until the snapshot is linked in, so nothing can be added to, removed from or renamed within a
+//     directory once it has been copied, and the snapshot holds the tree as it was when the last of those locks was
+//     taken. Writing to a file doesn't take a lock, so each file is captured as it was when it was copied, and a write
+//     that was already under way by then may show up in the snapshot as well.
+//     Nothing in SnapshotDir can be changed except by taking and deleting snapshots, and SnapshotDir itself is left out
+//     of snapshots of the root directory.
+
+// Where snapshots are kept, each in a directory named after it.
+const SnapshotDir = "/.snapshots"
+
+// Returned when changing anything in SnapshotDir.
+var ErrReadOnly = errors.New("snapshots are read-only")
+
+// Reports whether a path is SnapshotDir, or anything in it.
+func inSnapshots(path string) bool {
+	path = path2.Clean(path)
+	return path == SnapshotDir || strings.HasPrefix(path, SnapshotDir+"/")
+}
+
+// Fails with ErrReadOnly if any of these paths is in SnapshotDir, unless this filesystem is the one that takes and
+// deletes snapshots.
+func (f *filesystem) writable(paths ...string) error {
+	if f.snapshots {
+		return nil
+	}
+	for _, path := range paths {
+		if inSnapshots(path) {
+			return fmt.Errorf("%w: %s", ErrReadOnly, path)
+		}
+	}
+	return nil
+}
+
+// Returns this filesystem as one that can change what is in SnapshotDir, and that removes nodes for good, rather than
+// moving them into the trash.
+func (f *filesystem) forSnapshots() *filesystem {
+	g := *f
+	g.snapshots = true
+	g.trashPeriod = 0
+	return &g
+}
+
+func checkSnapshotName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return nil
+}
+
+func (f *filesystem) Snapshot(path string, name string) error {
+	if err := checkSnapshotName(name); err != nil {
+		return err
+	}
+	if inSnapshots(path) {
+		return fmt.Errorf("cannot snapshot %s, which is already in %s", path, SnapshotDir)
+	}
+	if err := f.forSnapshots().Mkdir(SnapshotDir); err != nil && !errors.Is(err, ErrExists) {
+		return err
+	}
+	dest := path2.Join(SnapshotDir, name)
+	// don't bother copying anything if the link is certain to fail
+	if _, err := f.Stat(dest); err == nil {
+		return fmt.Errorf("%w: %s", ErrExists, dest)
+	}
+	s := &snapshotter{t: *f.t}
+	defer s.release()
+	top, size, err := s.copyPath(path)
+	if err == nil {
+		top.Name = name
+		var chain []apis.ChunkNum
+		err = retryConflicts(func() error {
+			ref, err := f.t.PathDir(SnapshotDir)
+			if err != nil {
+				return err
+			}
+			defer ref.Release()
+			chain = ref.chain
+			return ref.linkEntry(top)
+		})
+		if err == nil {
+			return f.t.addSize(chain, int64(size))
+		}
+	}
+	if derr := s.discard(); derr != nil {
+		err = fmt.Errorf("two errors: %v -- and -- %v", err, derr)
+	}
+	return err
+}
+
+func (f *filesystem) DeleteSnapshot(name string) error {
+	if err := checkSnapshotName(name); err != nil {
+		return err
+	}
+	path := path2.Join(SnapshotDir, name)
+	if _, err := f.Stat(path); err != nil {
+		return err
+	}
+	return removeAll(f.forSnapshots(), path)
+}
+
+// Builds the copy of a subtree for Snapshot.
+type snapshotter struct {
+	t Traverser
+	// the directories of the subtree that have been copied, which stay locked until the copy is linked in
+	locked []*Reference
+	// the nodes of the copy, which are deleted again if it can't be linked in
+	created []Entry
+}
+
+// Copies the node at a path, and everything below it, and returns the entry for the copy, along with the total length
+// of the files in it.
+func (s *snapshotter) copyPath(path string) (Entry, uint64, error) {
+	if path2.Clean(path) == "/" {
+		root, err := s.t.Root()
+		if err != nil {
+			return Entry{}, 0, err
+		}
+		s.locked = append(s.locked, root)
+		attributes, err := root.RootAttributes()
+		if err != nil {
+			return Entry{}, 0, err
+		}
+		chunk, size, err := s.copyDir(root, true)
+		return Entry{Type: DIRECTORY, Chunk: chunk, Attributes: attributes}, size, err
+	}
+	parent, err := s.t.PathDir(path2.Dir(path))
+	if err != nil {
+		return Entry{}, 0, err
+	}
+	defer parent.Release()
+	entry, _, err := parent.lookupEntryAny(path2.Base(path))
+	if err != nil {
+		return Entry{}, 0, err
+	}
+	return s.copyEntry(entry)
+}
+
+func (s *snapshotter) copyEntry(entry Entry) (Entry, uint64, error) {
+	copied := Entry{Type: entry.Type, Name: entry.Name, Attributes: entry.Attributes}
+	var size uint64
+	var err error
+	switch entry.Type {
+	case FILE:
+		var unlocker Unlocker
+		if unlocker, err = s.t.fs.ReadLockChunk(entry.Chunk); err != nil {
+			return Entry{}, 0, err
+		}
+		file := &File{
+			chunk:    entry.Chunk,
+			unlocker: unlocker,
+			t:        s.t,
+		}
+		copied.Chunk, size, err = file.share()
+		file.Release()
+		if err == nil {
+			s.created = append(s.created, copied)
+		}
+	case SYMLINK:
+		copied.Chunk, err = s.copySymLink(entry.Chunk)
+	case DIRECTORY:
+		var unlocker Unlocker
+		if unlocker, err = s.t.fs.ReadLockChunk(entry.Chunk); err != nil {
+			return Entry{}, 0, err
+		}
+		dir := &Reference{
+			chunk:    entry.Chunk,
+			unlocker: unlocker,
+			t:        s.t,
+		}
+		s.locked = append(s.locked, dir)
+		copied.Chunk, size, err = s.copyDir(dir, false)
+	default:
+		err = fmt.Errorf("cannot copy node of type %d", entry.Type)
+	}
+	if err != nil {
+		return Entry{}, 0, err
+	}
+	return copied, size, nil
+}
+
+func (s *snapshotter) copySymLink(chunk apis.ChunkNum) (apis.ChunkNum, error) {
+	unlocker, err := s.t.fs.ReadLockChunk(chunk)
+	if err != nil {
+		return 0, err
+	}
+	defer unlocker.Unlock()
+	target, _, err := s.t.client.Read(chunk, 0, MaxSymLinkSize)
+	if err != nil {
+		return 0, err
+	}
+	copied, err := s.t.client.New()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.t.client.Write(copied, 0, apis.AnyVersion, util.StripTrailingZeroes(target)); err != nil {
+		_ = s.t.client.Delete(copied, apis.AnyVersion)
+		return 0, err
+	}
+	s.created = append(s.created, Entry{Type: SYMLINK, Chunk: copied})
+	return copied, nil
+}
+
+// Copies a directory, which must be read-locked, and everything in it, leaving SnapshotDir out of the root directory.
+// Returns the chunk of the copy, and the total length of the files in it.
+func (s *snapshotter) copyDir(dir *Reference, root bool) (apis.ChunkNum, uint64, error) {
+	entries, _, err := dir.listEntries()
+	if err != nil {
+		return 0, 0, err
+	}
+	chunk, err := s.t.client.New()
+	if err != nil {
+		return 0, 0, err
+	}
+	ver, err := s.t.client.Write(chunk, 0, apis.AnyVersion, nil)
+	if err != nil {
+		_ = s.t.client.Delete(chunk, apis.AnyVersion)
+		return 0, 0, err
+	}
+	s.created = append(s.created, Entry{Type: DIRECTORY, Chunk: chunk})
+	// nothing else can reach the copy yet, so this can't be contended
+	unlocker, err := s.t.fs.WriteLockChunk(chunk)
+	if err != nil {
+		return 0, 0, err
+	}
+	copy := &Reference{
+		chunk:    chunk,
+		unlocker: unlocker,
+		t:        s.t,
+	}
+	defer copy.Release()
+	version := dirVersion{{chunk: chunk, version: ver}}
+	size := uint64(0)
+	index := 0
+	for _, entry := range entries {
+		if root && entry.Name == path2.Base(SnapshotDir) {
+			continue
+		}
+		copied, childSize, err := s.copyEntry(entry)
+		if err != nil {
+			return 0, 0, err
+		}
+		if version, err = copy.updateEntry(version, index, copied); err != nil {
+			return 0, 0, err
+		}
+		index++
+		size += childSize
+	}
+	encoded := make([]byte, 8)
+	binary.LittleEndian.PutUint64(encoded, size)
+	if _, err := s.t.client.Write(chunk, subtreeSizeOffset, version[0].version, encoded); err != nil {
+		return 0, 0, err
+	}
+	return chunk, size, nil
+}
+
+// Releases the locks on the directories that were copied.
+func (s *snapshotter) release() {
+	for i := len(s.locked) - 1; i >= 0; i-- {
+		s.locked[i].Release()
+	}
+	s.locked = nil
+}
+
+// Deletes everything that was copied, which nothing refers to, and releases the data chunks that the copied files
+// shared.
+func (s *snapshotter) discard() error {
+	for _, entry := range s.created {
+		switch entry.Type {
+		case FILE:
+			file := &File{chunk: entry.Chunk, t: s.t}
+			if err := file.releaseChunks(0, MaxFileChunks); err != nil {
+				return err
+			}
+		case DIRECTORY:
+			_, pages, err := s.t.readEntries(entry.Chunk)
+			if err != nil {
+				return err
+			}
+			for _, page := range pages[1:] {
+				if err := s.t.client.Delete(page.chunk, apis.AnyVersion); err != nil {
+					return err
+				}
+			}
+		}
+		if err := s.t.client.Delete(entry.Chunk, apis.AnyVersion); err != nil {
+			return err
+		}
+	}
+	s.created = nil
+	return nil
+}
+
+// Makes a copy of the file's index that shares every data chunk within the length of the file, marking them as shared
+// in both, and returns the chunk of the copy, which nothing refers to yet, along with the length of the file.
+func (f *File) share() (apis.ChunkNum, uint64, error) {
+	if err := f.unlocker.Ensure(); err != nil {
+		return 0, 0, err
+	}
+	count := 0
+	for {
+		index, err := f.readIndex(0, count)
+		if err != nil {
+			return 0, 0, err
+		}
+		if chunksFor(index.length) != count {
+			// the length changed since it was last read
+			count = chunksFor(index.length)
+			continue
+		}
+		marked := append(encodeFileHeader(index.length), make([]byte, 8*count)...)
+		var shared []apis.ChunkNum
+		for i := 0; i < count; i++ {
+			if chunk := index.chunk(i); chunk != 0 {
+				binary.LittleEndian.PutUint64(marked[indexEntryOffset(i):], uint64(chunk|sharedChunk))
+				shared = append(shared, chunk)
+			}
+		}
+		if len(shared) > 0 {
+			if err := f.t.shareAll(shared); err != nil {
+				return 0, 0, err
+			}
+			// the counts are only right if the index still refers to the chunks that were counted
+			ver, err := f.t.client.Write(f.chunk, indexEntryOffset(0), index.version, marked[indexEntryOffset(0):])
+			if err != nil {
+				if uerr := f.t.unshareAll(shared); uerr != nil {
+					return 0, 0, fmt.Errorf("two errors: %v -- and -- %v", err, uerr)
+				}
+				if ver == 0 {
+					return 0, 0, err
+				}
+				// version mismatch; go around again
+				continue
+			}
+		}
+		chunk, err := f.t.client.New()
+		if err == nil {
+			if _, err = f.t.client.Write(chunk, 0, apis.AnyVersion, marked); err != nil {
+				_ = f.t.client.Delete(chunk, apis.AnyVersion)
+			}
+		}
+		if err != nil {
+			// this index still marks them, which is harmless
+			if uerr := f.t.unshareAll(shared); uerr != nil {
+				return 0, 0, fmt.Errorf("two errors: %v -- and -- %v", err, uerr)
+			}
+			return 0, 0, err
+		}
+		return chunk, index.length, nil
+	}
+}
+
+// Records that one more index refers to each of these data chunks, or to none of them if this fails.
+func (t Traverser) shareAll(chunks []apis.ChunkNum) error {
+	for i, chunk := range chunks {
+		if _, err := t.adjustShares(chunk, 1); err != nil {
+			if uerr := t.unshareAll(chunks[:i]); uerr != nil {
+				return fmt.Errorf("two errors: %v -- and -- %v", err, uerr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Undoes shareAll.
+func (t Traverser) unshareAll(chunks []apis.ChunkNum) error {
+	for _, chunk := range chunks {
+		if _, err := t.adjustShares(chunk, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
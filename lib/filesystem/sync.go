@@ -34,6 +34,12 @@ func (f *FilesystemSync) ReadLockChunk(chunk apis.ChunkNum) (Unlocker, error) {
 	}, nil
 }
 
+// Returns the revision of the latest release of a write lock on a chunk, without waiting for another; see
+// apis.SyncServerDirect.AwaitRelease.
+func (f *FilesystemSync) Revision(chunk apis.ChunkNum) (apis.SyncRevision, error) {
+	return f.s.AwaitRelease(chunk, apis.UnknownRevision)
+}
+
 // note: the root chunk never changes
 func (f *FilesystemSync) GetRoot() (apis.ChunkNum, error) {
 	return f.s.GetFSRoot()
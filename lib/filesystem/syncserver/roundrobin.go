@@ -47,6 +47,22 @@ func (r *roundrobin) ConfirmSync(s apis.SyncID) (write bool, err error) {
 	return r.next().ConfirmSync(s)
 }
 
+func (r *roundrobin) AwaitRelease(chunk apis.ChunkNum, seen apis.SyncRevision) (apis.SyncRevision, error) {
+	return r.next().AwaitRelease(chunk, seen)
+}
+
+func (r *roundrobin) AcquireLock(chunk apis.ChunkNum, exclusive bool) (apis.LockID, error) {
+	return r.next().AcquireLock(chunk, exclusive)
+}
+
+func (r *roundrobin) RenewLock(lock apis.LockID) error {
+	return r.next().RenewLock(lock)
+}
+
+func (r *roundrobin) ReleaseLock(lock apis.LockID) error {
+	return r.next().ReleaseLock(lock)
+}
+
 // this caches, instead of round-robining
 func (r *roundrobin) GetFSRoot() (apis.ChunkNum, error) {
 	ichunk := atomic.LoadUint64(&r.cachedRoot)
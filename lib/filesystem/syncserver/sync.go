@@ -29,6 +29,22 @@ func (s syncServer) ConfirmSync(sy apis.SyncID) (write bool, err error) {
 	return s.etcd.ConfirmSync(sy)
 }
 
+func (s syncServer) AwaitRelease(chunk apis.ChunkNum, seen apis.SyncRevision) (apis.SyncRevision, error) {
+	return s.etcd.AwaitRelease(chunk, seen)
+}
+
+func (s syncServer) AcquireLock(chunk apis.ChunkNum, exclusive bool) (apis.LockID, error) {
+	return s.etcd.AcquireLock(chunk, exclusive)
+}
+
+func (s syncServer) RenewLock(lock apis.LockID) error {
+	return s.etcd.RenewLock(lock)
+}
+
+func (s syncServer) ReleaseLock(lock apis.LockID) error {
+	return s.etcd.ReleaseLock(lock)
+}
+
 func (s syncServer) GetFSRoot() (apis.ChunkNum, error) {
 	chunk, err := s.etcd.ReadFSRoot()
 	if err != nil {
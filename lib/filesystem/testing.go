@@ -0,0 +1,250 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+	"zircon/lib/apis"
+)
+
+// An in-memory implementation of apis.Client, for testing the filesystem layer without a cluster. If failWrite is set,
+// it is consulted before each write, and any error it returns is reported without changing the chunk. Each read takes
+// at least readDelay, to stand in for a network round trip, and is counted in reads. If reuse is set, New hands out
+// the numbers of deleted chunks again, most recently deleted first, the way a metadata cache's free list does.
+type memoryClient struct {
+	mu        sync.Mutex
+	next      apis.ChunkNum
+	chunks    map[apis.ChunkNum][]byte
+	versions  map[apis.ChunkNum]apis.Version
+	failWrite func(chunk apis.ChunkNum, offset uint32, data []byte) error
+	readDelay time.Duration
+	reads     int
+	reuse     bool
+	freed     []apis.ChunkNum
+}
+
+func newMemoryClient() *memoryClient {
+	return &memoryClient{
+		next:     1,
+		chunks:   map[apis.ChunkNum][]byte{},
+		versions: map[apis.ChunkNum]apis.Version{},
+	}
+}
+
+func (m *memoryClient) New() (apis.ChunkNum, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	chunk := m.next
+	if m.reuse && len(m.freed) > 0 {
+		chunk = m.freed[len(m.freed)-1]
+		m.freed = m.freed[:len(m.freed)-1]
+	} else {
+		m.next++
+	}
+	m.chunks[chunk] = nil
+	return chunk, nil
+}
+
+func (m *memoryClient) Read(ref apis.ChunkNum, offset uint32, length uint32) ([]byte, apis.Version, error) {
+	time.Sleep(m.readDelay)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reads++
+	data, found := m.chunks[ref]
+	if !found {
+		return nil, 0, fmt.Errorf("no such chunk: %w", apis.ErrNotFound)
+	}
+	if offset+length > apis.MaxChunkSize {
+		return nil, 0, errors.New("read too large")
+	}
+	result := make([]byte, length)
+	if offset < uint32(len(data)) {
+		copy(result, data[offset:])
+	}
+	return result, m.versions[ref], nil
+}
+
+func (m *memoryClient) ReadWithChecksum(ref apis.ChunkNum, offset uint32, length uint32) ([]byte, apis.Version, apis.Checksum, error) {
+	data, version, err := m.Read(ref, offset, length)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return data, version, apis.CalculateChecksum(data), nil
+}
+
+// The in-memory client keeps no old versions, so only the current version can be read.
+func (m *memoryClient) ReadVersion(ref apis.ChunkNum, offset uint32, length uint32, version apis.Version) ([]byte, error) {
+	data, current, err := m.Read(ref, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if version > current {
+		return nil, fmt.Errorf("chunk %d has not reached version %d: %w", ref, version, apis.ErrNotFound)
+	}
+	if version != current {
+		return nil, fmt.Errorf("chunk %d version %d: %w", ref, version, apis.ErrVersionReclaimed)
+	}
+	return data, nil
+}
+
+func (m *memoryClient) Write(ref apis.ChunkNum, offset uint32, version apis.Version, data []byte) (apis.Version, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, found := m.chunks[ref]
+	if !found {
+		return 0, errors.New("no such chunk")
+	}
+	if offset+uint32(len(data)) > apis.MaxChunkSize {
+		return 0, errors.New("write too large")
+	}
+	if version != apis.AnyVersion && version != m.versions[ref] {
+		return m.versions[ref], apis.VersionStaleError{Current: m.versions[ref]}
+	}
+	if m.failWrite != nil {
+		if err := m.failWrite(ref, offset, data); err != nil {
+			return 0, err
+		}
+	}
+	if end := offset + uint32(len(data)); end > uint32(len(existing)) {
+		existing = append(existing, make([]byte, end-uint32(len(existing)))...)
+	}
+	copy(existing[offset:], data)
+	m.chunks[ref] = existing
+	m.versions[ref]++
+	return m.versions[ref], nil
+}
+
+func (m *memoryClient) Append(ref apis.ChunkNum, data []byte) (uint32, apis.Version, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, found := m.chunks[ref]
+	if !found {
+		return 0, 0, errors.New("no such chunk")
+	}
+	if len(existing)+len(data) > apis.MaxChunkSize {
+		return 0, 0, apis.ErrChunkTooLarge
+	}
+	m.chunks[ref] = append(existing, data...)
+	m.versions[ref]++
+	return uint32(len(existing)), m.versions[ref], nil
+}
+
+func (m *memoryClient) Delete(ref apis.ChunkNum, version apis.Version) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.chunks[ref]; !found {
+		return errors.New("no such chunk")
+	}
+	if version != apis.AnyVersion && version != m.versions[ref] {
+		return errors.New("stale version")
+	}
+	delete(m.chunks, ref)
+	delete(m.versions, ref)
+	if m.reuse {
+		m.freed = append(m.freed, ref)
+	}
+	return nil
+}
+
+func (m *memoryClient) Close() error {
+	return nil
+}
+
+// A SyncServer that grants every lock immediately, for tests that only exercise a single filesystem client.
+type permissiveSync struct {
+	client apis.Client
+	mu     sync.Mutex
+	nextID apis.SyncID
+	root   apis.ChunkNum
+}
+
+func (p *permissiveSync) StartSync(chunk apis.ChunkNum) (apis.SyncID, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextID++
+	return p.nextID, nil
+}
+
+func (p *permissiveSync) UpgradeSync(s apis.SyncID) (apis.SyncID, error) {
+	return p.StartSync(0)
+}
+
+func (p *permissiveSync) ReleaseSync(s apis.SyncID) error {
+	return nil
+}
+
+func (p *permissiveSync) ConfirmSync(s apis.SyncID) (write bool, err error) {
+	return true, nil
+}
+
+func (p *permissiveSync) AwaitRelease(chunk apis.ChunkNum, seen apis.SyncRevision) (apis.SyncRevision, error) {
+	return 0, errors.New("permissiveSync does not track lock releases")
+}
+
+func (p *permissiveSync) AcquireLock(chunk apis.ChunkNum, exclusive bool) (apis.LockID, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextID++
+	return apis.LockID(p.nextID), nil
+}
+
+func (p *permissiveSync) RenewLock(lock apis.LockID) error {
+	return nil
+}
+
+func (p *permissiveSync) ReleaseLock(lock apis.LockID) error {
+	return nil
+}
+
+func (p *permissiveSync) GetFSRoot() (apis.ChunkNum, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.root == 0 {
+		chunk, err := p.client.New()
+		if err != nil {
+			return 0, err
+		}
+		if _, err := p.client.Write(chunk, 0, apis.AnyVersion, nil); err != nil {
+			return 0, err
+		}
+		p.root = chunk
+	}
+	return p.root, nil
+}
+
+// Constructs a filesystem backed entirely by memory, without any servers, for testing the filesystem and the packages
+// built on it against its real semantics without a cluster. Only a single client can use it, since every lock is
+// granted right away.
+func ConstructMemoryFilesystem() (Filesystem, *memoryClient) {
+	client := newMemoryClient()
+	return NewFilesystem(client, &permissiveSync{client: client}), client
+}
+
+// Lists every path within root, root included, in sorted order, so that tests can check exactly what a filesystem
+// holds.
+func ListTree(fs Filesystem, root string) ([]string, error) {
+	paths := []string{root}
+	info, err := fs.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return paths, nil
+	}
+	names, err := fs.ListDir(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		sub, err := ListTree(fs, path.Join(root, name))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, sub...)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
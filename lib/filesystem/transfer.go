@@ -0,0 +1,127 @@
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"io"
+	path2 "path"
+
+	"zircon/lib/apis"
+)
+
+// Creates a new file at a path and uploads the contents of 'from' into it. If ctx is cancelled, the upload stops before
+// the next data chunk is started, and ctx.Err() is returned; the file is left holding a prefix of the contents, which
+// Resume can finish later. Fails with ErrExists if the path is already taken.
+// The data is written one data chunk at a time, in order, and the file's recorded length only grows once the data
+// below it has been written, so the length of a partial upload doubles as its checkpoint.
+func (f *filesystem) Upload(ctx context.Context, path string, from io.ReaderAt) error {
+	return f.transfer(ctx, path, from, true)
+}
+
+func (f *filesystem) Resume(path string, from io.ReaderAt) error {
+	return f.ResumeContext(context.Background(), path, from)
+}
+
+// Finishes an upload into an existing file that was interrupted. Whatever it already holds is checked against 'from'
+// by checksum rather than being written again, and any data chunk that doesn't match is rewritten, so this is also
+// safe if 'from' changed since the upload was interrupted.
+func (f *filesystem) ResumeContext(ctx context.Context, path string, from io.ReaderAt) error {
+	return f.transfer(ctx, path, from, false)
+}
+
+func (f *filesystem) transfer(ctx context.Context, path string, from io.ReaderAt, create bool) error {
+	if err := f.writable(path); err != nil {
+		return err
+	}
+	var file *File
+	err := retryConflicts(func() error {
+		ref, err := f.t.PathDir(path2.Dir(path))
+		if err != nil {
+			return err
+		}
+		defer ref.Release()
+		if create {
+			file, err = ref.OpenOrNewFile(path2.Base(path), true)
+		} else {
+			file, err = ref.LookupFile(path2.Base(path))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer file.Release()
+
+	committed, err := file.Size()
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, FileChunkSize)
+	for offset := uint64(0); offset < committed; offset += FileChunkSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		length := committed - offset
+		if length > FileChunkSize {
+			length = FileChunkSize
+		}
+		n, err := from.ReadAt(buffer[:length], int64(offset))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err := file.verifyOrWrite(offset, buffer[:n]); err != nil {
+			return err
+		}
+		if n < int(length) {
+			// the source is shorter than what was already uploaded, so the rest of the file has to go
+			return file.Truncate(offset + uint64(n))
+		}
+	}
+	for offset := committed; ; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// stay within one data chunk, so that the length only ever covers data chunks that were written in full
+		n, err := from.ReadAt(buffer[:FileChunkSize-offset%FileChunkSize], int64(offset))
+		if n > 0 {
+			written, werr := file.Write(offset, buffer[:n])
+			if werr != nil {
+				return werr
+			}
+			offset += written
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Rewrites the part of a file starting at a data chunk boundary unless it already holds exactly 'data', as judged by the
+// checksum of what is stored.
+func (f *File) verifyOrWrite(offset uint64, data []byte) error {
+	if offset%FileChunkSize != 0 {
+		return fmt.Errorf("[transfer.go/ALIGN] offset %d is not at the start of a data chunk", offset)
+	}
+	position := int(offset / FileChunkSize)
+	index, err := f.readIndex(position, 1)
+	if err != nil {
+		return err
+	}
+	chunk := index.chunk(position)
+	var stored apis.Checksum
+	if chunk == 0 {
+		stored = apis.ExtendChecksumWithZeroes(apis.CalculateChecksum(nil), len(data))
+	} else if _, _, stored, err = f.t.client.ReadWithChecksum(chunk, 0, uint32(len(data))); err != nil {
+		return err
+	}
+	if stored == apis.CalculateChecksum(data) {
+		return nil
+	}
+	written, err := f.Write(offset, data)
+	if err == nil && int(written) < len(data) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	path2 "path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Explanation of the trash:
+//     A filesystem with a trash period doesn't remove anything that Unlink or RemoveAll is asked to remove. Instead, the
+//     node is moved into TrashDir, where it can be brought back with Undelete, until PurgeTrash is run once the period
+//     is over. Moving a node is a single rename, however much is below it, so deleting into the trash costs no more
+//     than renaming does. Whatever is in the trash is still counted in the sizes of the directories above it, which
+//     are those of TrashDir, until it is purged.
+//     Each deletion gets a directory of its own in TrashDir, named after when it happened, in which the node keeps the
+//     path it was deleted from, so the trash can be browsed like any other part of the tree, and Undelete only needs
+//     that path to find the most recent deletion of it. Since deleted nodes keep their paths there, TrashDir can only
+//     be looked into by the superuser.
+//     Removing anything that is already in TrashDir removes it for good. Nothing is ever purged unless PurgeTrash is
+//     run, such as regularly with the zircon command, and how long the trash period is only decides what it purges.
+//     Rmdir still removes empty directories straight away. RemoveAll through AsUser removes one node at a time, so that
+//     each is checked against the user's permissions, and so each file goes into the trash separately.
+
+// Where deleted nodes are kept until they are purged.
+const TrashDir = "/.trash"
+
+// How the directories for each deletion are named: after when it happened, in a way that sorts in the same order, and
+// fits within MaxName.
+const trashStampFormat = "20060102T150405.000000000Z"
+
+// Reports whether a path is TrashDir, or anything in it.
+func inTrash(path string) bool {
+	path = path2.Clean(path)
+	return path == TrashDir || strings.HasPrefix(path, TrashDir+"/")
+}
+
+// Reports whether removing this path should move it into the trash, rather than removing it.
+func (f *filesystem) trashes(path string) bool {
+	return f.trashPeriod > 0 && !inTrash(path)
+}
+
+// Moves a node into a new deletion in TrashDir, if it is a directory exactly when 'dir' is set.
+func (f *filesystem) trash(path string, dir bool) error {
+	path = path2.Clean(path)
+	if path == "/" {
+		return errors.New("cannot remove the root directory")
+	}
+	// fail the way removing the node would, before anything is created for it
+	info, err := f.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && !dir {
+		return errors.New("attempt to remove directory")
+	}
+	deletion, err := f.newDeletion()
+	if err != nil {
+		return err
+	}
+	dest := path2.Join(deletion, path)
+	err = f.mkdirsBelow(deletion, path2.Dir(dest))
+	if err == nil {
+		err = f.Rename(path, dest)
+	}
+	if err != nil {
+		// it's already in the trash, so this removes it for good
+		if rerr := f.RemoveAll(deletion); rerr != nil {
+			return fmt.Errorf("two errors: %v -- and -- %v", err, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Creates the directory for a new deletion in TrashDir, named after the current time, and returns its path.
+func (f *filesystem) newDeletion() (string, error) {
+	if err := f.Mkdir(TrashDir); err == nil {
+		// deleted nodes keep their paths in the trash, whatever the directories above them allowed
+		if err := f.Chmod(TrashDir, 0700); err != nil {
+			return "", err
+		}
+	} else if !errors.Is(err, ErrExists) {
+		return "", err
+	}
+	now := time.Now().UTC()
+	for {
+		deletion := path2.Join(TrashDir, now.Format(trashStampFormat))
+		err := f.Mkdir(deletion)
+		if !errors.Is(err, ErrExists) {
+			return deletion, err
+		}
+		// another deletion happened at the same moment
+		now = now.Add(time.Nanosecond)
+	}
+}
+
+// Creates each directory on the way from 'top', which must exist, down to 'dir'.
+func (f *filesystem) mkdirsBelow(top string, dir string) error {
+	if dir == top {
+		return nil
+	}
+	if err := f.mkdirsBelow(top, path2.Dir(dir)); err != nil {
+		return err
+	}
+	return f.Mkdir(dir)
+}
+
+func (f *filesystem) Undelete(path string) error {
+	path = path2.Clean(path)
+	if path == "/" || inTrash(path) {
+		return fmt.Errorf("cannot undelete %s", path)
+	}
+	deletions, err := f.ListDir(TrashDir)
+	if err != nil && !errors.Is(err, ErrNotExist) {
+		return err
+	}
+	// the most recent deletion first
+	sort.Sort(sort.Reverse(sort.StringSlice(deletions)))
+	for _, name := range deletions {
+		deletion := path2.Join(TrashDir, name)
+		source := path2.Join(deletion, path)
+		if _, err := f.Stat(source); errors.Is(err, ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := f.Rename(source, path); err != nil {
+			return err
+		}
+		// unless more was deleted along with it, all that is left of the deletion is the directories that led to it
+		for dir := path2.Dir(source); dir != TrashDir; dir = path2.Dir(dir) {
+			if err := f.Rmdir(dir); errors.Is(err, ErrNotEmpty) {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s in %s", ErrNotExist, path, TrashDir)
+}
+
+func (f *filesystem) PurgeTrash() error {
+	deletions, err := f.ListDir(TrashDir)
+	if errors.Is(err, ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-f.trashPeriod)
+	for _, name := range deletions {
+		deleted, err := time.Parse(trashStampFormat, name)
+		if err != nil || deleted.After(cutoff) {
+			// not a deletion, or not one that is due yet
+			continue
+		}
+		if err := f.RemoveAll(path2.Join(TrashDir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -6,17 +6,35 @@ import (
 	"zircon/lib/util"
 	"errors"
 	"fmt"
+	"os"
 	path2 "path"
+	"time"
 )
 
+// Returned when creating a node whose name is already taken in its directory.
+var ErrExists = errors.New("file already exists")
+
+// Returned when a path names a node that doesn't exist, or passes through a directory that doesn't.
+var ErrNotExist = errors.New("no such node")
+
+// Returned when removing a directory that still has something in it.
+var ErrNotEmpty = errors.New("directory not empty")
+
 type Traverser struct {
 	client apis.Client
 	fs FilesystemSync
+	paths *pathCache
 }
 
 // Each of the following structures inherently includes a READ LOCK. You can assume the item itself will not change!
 // Relatedly, do not hold onto references to these for long periods of time.
 
+// Locks are always acquired in tree order: a node is only locked while holding locks on nodes above it, never below.
+// Traversals, NewFile, NewDir, and Remove follow this directly, by locking a directory before anything inside it.
+// Move is the only operation that holds two unrelated directories at once; it takes them in order of chunk number.
+// Only moving a directory can change which directory is inside another, so moves of directories also hold the move
+// lock, so that no two of them can interleave; moves of anything else only lock the two directories involved.
+
 // Note: some of our model for this was based on analysis gleaned from
 //https://www.doc.ic.ac.uk/~pg/publications/Ntzik2017Reasoning.pdf, although we didn't consider most of that document.
 
@@ -24,12 +42,16 @@ type Reference struct {
 	t        Traverser
 	chunk    apis.ChunkNum
 	unlocker Unlocker
+	// the directories from the root down to this one, if it was reached by traversal; see addSize
+	chain []apis.ChunkNum
 }
 
 type File struct {
 	t        Traverser
 	chunk    apis.ChunkNum
 	unlocker Unlocker
+	// the directories from the root down to the one this file is in, if it was reached by traversal
+	parents []apis.ChunkNum
 }
 
 type NodeType uint8
@@ -53,6 +75,7 @@ func (t Traverser) Root() (*Reference, error) {
 		chunk: root,
 		unlocker: lock,
 		t: t,
+		chain: []apis.ChunkNum{root},
 	}, nil
 }
 
@@ -77,36 +100,246 @@ func splitPathMany(path string) []string {
 }
 
 func (t Traverser) PathDir(path string) (*Reference, error) {
+	directory, _, err := t.pathChain(path)
+	return directory, err
+}
+
+// Like PathDir, but also reports the chunk of every directory passed through, starting with the root and ending with the
+// directory itself. Only the part of the path past the longest prefix in the path cache is walked; see pathcache.go.
+func (t Traverser) pathChain(path string) (*Reference, []apis.ChunkNum, error) {
 	if path == "" || path[0] != '/' {
-		return nil, fmt.Errorf("path is not absolute: '%s'", path)
+		return nil, nil, fmt.Errorf("path is not absolute: '%s'", path)
 	}
+	components := splitPathMany(path)
 	// TODO: traverse symlinks
-	directory, err := t.Root()
+	directory, revisions, depth, err := t.startWalk(components)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	for _, elem := range splitPathMany(path) {
+	chain := append([]apis.ChunkNum(nil), directory.chain...)
+	for ; depth < len(components); depth++ {
 		// invariant: each time around the loop, we have exactly one lock, which is a read lock on 'directory'
-		ndir, err := directory.LookupDir(elem)
+		ndir, err := directory.LookupDir(components[depth])
 		directory.Release()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		directory = ndir
+		chain = append(chain, directory.chunk)
+		if revisions != nil {
+			// read while the directory is locked, so that nothing can have changed it in between
+			revision, err := t.fs.Revision(directory.chunk)
+			if err != nil {
+				revisions = nil
+				continue
+			}
+			revisions = append(revisions, revision)
+			t.paths.put(components[:depth+1], chain, revisions)
+		}
+	}
+	return directory, chain, nil
+}
+
+// Locks the directory to start resolving a path from: the last one along the longest prefix of the path whose cached
+// chain is still accurate, or else the root. Returns it along with the revision of each directory along its chain, or
+// nil if there is no path cache or the sync server doesn't track revisions, and how many components it covers.
+func (t Traverser) startWalk(components []string) (*Reference, []apis.SyncRevision, int, error) {
+	if depth, chain, revisions := t.paths.longest(components); depth > 0 {
+		directory, err := t.lockDir(chain[len(chain)-1])
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		// the last directory is locked before checking, so that it can't change between the check and the walk
+		if t.unchangedSince(chain, revisions) {
+			directory.chain = chain
+			return directory, revisions, depth, nil
+		}
+		directory.Release()
+		t.paths.forget(components[:depth])
+	}
+	root, err := t.Root()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if t.paths == nil {
+		return root, nil, 0, nil
+	}
+	revision, err := t.fs.Revision(root.chunk)
+	if err != nil {
+		return root, nil, 0, nil
 	}
-	return directory, nil
+	return root, []apis.SyncRevision{revision}, 0, nil
 }
 
-const EntrySize = 32
-const MaxName = EntrySize - 8 - 1
-const EntryCount = apis.MaxChunkSize / EntrySize
+// Reports whether no write lock on any of the directories in a chain has been released since each was at its revision.
+func (t Traverser) unchangedSince(chain []apis.ChunkNum, revisions []apis.SyncRevision) bool {
+	for i, chunk := range chain {
+		revision, err := t.fs.Revision(chunk)
+		if err != nil || revision != revisions[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (t Traverser) lockDir(chunk apis.ChunkNum) (*Reference, error) {
+	unlocker, err := t.fs.ReadLockChunk(chunk)
+	if err != nil {
+		return nil, err
+	}
+	return &Reference{
+		chunk: chunk,
+		unlocker: unlocker,
+		t: t,
+	}, nil
+}
+
+// Like lockDir, but takes a write lock.
+func (t Traverser) writeLockDir(chunk apis.ChunkNum) (*Reference, error) {
+	unlocker, err := t.fs.WriteLockChunk(chunk)
+	if err != nil {
+		return nil, err
+	}
+	return &Reference{
+		chunk: chunk,
+		unlocker: unlocker,
+		t: t,
+	}, nil
+}
+
+const EntrySize = 72
+// An entry holds its node's type, its chunk, and its attributes, followed by its name.
+const attributesSize = 34
+const MaxName = EntrySize - 8 - 1 - attributesSize
+// A directory's entries are kept in a chain of chunks, called its pages, starting with the directory's own chunk, which
+// is what refers to it and what is locked for it. Each page holds EntryCount entries, and entries are numbered across
+// the whole chain, so that entry i is in page i / EntryCount. Pages are added to the end of the chain as the directory
+// fills up, and are kept until the directory is removed.
+// The last entry's worth of space in each page holds the page after it, or zero if there is none, instead of an entry.
+// In the directory's own chunk, it also holds the total size of every file below the directory, and in the root
+// directory, the attributes of the root directory itself, which has no entry to hold them, and the share table; see
+// shares.go.
+const EntryCount = apis.MaxChunkSize / EntrySize - 1
+const subtreeSizeOffset = EntryCount * EntrySize
+const rootAttributesOffset = subtreeSizeOffset + 8
+const nextPageOffset = rootAttributesOffset + 1 + attributesSize
+const sharesOffset = nextPageOffset + 8
 const MaxSymLinkSize = 1024
 
+// A page of a directory, and the version it was at when its entries were read.
+type dirPage struct {
+	chunk   apis.ChunkNum
+	version apis.Version
+}
+
+// The version of a directory as of when its entries were read: each of its pages, in order, with its version. An entry
+// is only written if the page that holds it is still at the version it was read at.
+type dirVersion []dirPage
+
+// Like this version, but matching any version of each page, for writes that can't conflict with anything.
+func (v dirVersion) anyVersion() dirVersion {
+	result := make(dirVersion, len(v))
+	for i, page := range v {
+		result[i] = dirPage{chunk: page.chunk, version: apis.AnyVersion}
+	}
+	return result
+}
+
 type Entry struct {
 	Index int        // not stored in encoding; broadly optional
 	Type  NodeType
 	Name  string
 	Chunk apis.ChunkNum
+	Attributes
+}
+
+// The ownership, permissions and times of a node, as kept in its entry.
+type Attributes struct {
+	// Only the permission bits, along with os.ModeSetuid, os.ModeSetgid and os.ModeSticky.
+	Mode os.FileMode
+	Uid  uint32
+	Gid  uint32
+	// When the node was last read, when its contents were last changed, and when it or its attributes were last
+	// changed, as in POSIX. Files count as read when they are opened for reading, and only if they haven't been read
+	// since they were last changed or in the last day, like Linux's relatime, so that reading doesn't cost a write.
+	// Directories change when nodes are added to them, removed from them, or renamed within them. Zero if unknown.
+	Atime time.Time
+	Mtime time.Time
+	Ctime time.Time
+}
+
+// How long since a file was last read before reading it again updates Atime, even if it hasn't changed since.
+const atimeInterval = 24 * time.Hour
+
+// The bits of an os.FileMode that Attributes.Mode keeps.
+const AttributeModeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// The attributes that a node starts out with, until they are changed with Chmod or Chown.
+func DefaultAttributes(ntype NodeType) Attributes {
+	switch ntype {
+	case DIRECTORY:
+		return Attributes{Mode: 0755}
+	case SYMLINK:
+		return Attributes{Mode: 0777}
+	default:
+		return Attributes{Mode: 0644}
+	}
+}
+
+// Sets every time to 'now', as for a node that was just created.
+func (a *Attributes) created(now time.Time) {
+	a.Atime, a.Mtime, a.Ctime = now, now, now
+}
+
+// Sets the times for a change to the contents of a node at 'now'.
+func (a *Attributes) modified(now time.Time) {
+	a.Mtime, a.Ctime = now, now
+}
+
+// Sets the time for a read of a node at 'now', and reports whether it changed, following the rules described for Atime.
+func (a *Attributes) accessed(now time.Time) bool {
+	if a.Atime.After(a.Mtime) && now.Sub(a.Atime) < atimeInterval {
+		return false
+	}
+	a.Atime = now
+	return true
+}
+
+// Times are stored as nanoseconds since the Unix epoch, with zero for the zero time.
+func decodeTime(data []byte) time.Time {
+	nanos := int64(binary.LittleEndian.Uint64(data))
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+func encodeTime(data []byte, t time.Time) {
+	var nanos int64
+	if !t.IsZero() {
+		nanos = t.UnixNano()
+	}
+	binary.LittleEndian.PutUint64(data, uint64(nanos))
+}
+
+func decodeAttributes(data []byte) Attributes {
+	return Attributes{
+		Mode:  FileMode(uint32(binary.LittleEndian.Uint16(data[0:2]))),
+		Uid:   binary.LittleEndian.Uint32(data[2:6]),
+		Gid:   binary.LittleEndian.Uint32(data[6:10]),
+		Atime: decodeTime(data[10:18]),
+		Mtime: decodeTime(data[18:26]),
+		Ctime: decodeTime(data[26:34]),
+	}
+}
+
+func (a Attributes) encode(data []byte) {
+	binary.LittleEndian.PutUint16(data[0:2], uint16(PosixMode(a.Mode)))
+	binary.LittleEndian.PutUint32(data[2:6], a.Uid)
+	binary.LittleEndian.PutUint32(data[6:10], a.Gid)
+	encodeTime(data[10:18], a.Atime)
+	encodeTime(data[18:26], a.Mtime)
+	encodeTime(data[26:34], a.Ctime)
 }
 
 func (e *Entry) IsOk() bool {
@@ -118,7 +351,8 @@ func decode(data []byte, index int) Entry {
 		Index: index,
 		Type: NodeType(data[0]),
 		Chunk: apis.ChunkNum(binary.LittleEndian.Uint64(data[1:])),
-		Name: string(util.StripTrailingZeroes(data[9:])),
+		Attributes: decodeAttributes(data[9:9+attributesSize]),
+		Name: string(util.StripTrailingZeroes(data[9+attributesSize:])),
 	}
 }
 
@@ -129,30 +363,127 @@ func (e *Entry) encode() ([]byte, error) {
 	if len(e.Name) > MaxName {
 		return nil, errors.New("filename in entry is too long!")
 	}
-	copy(result[9:], e.Name)
+	if e.Type != NONEXISTENT {
+		e.Attributes.encode(result[9:9+attributesSize])
+	}
+	copy(result[9+attributesSize:], e.Name)
 	return result, nil
 }
 
 // results are in sorted order by index
-func (r *Reference) listEntries() ([]Entry, apis.Version, error) {
+func (r *Reference) listEntries() ([]Entry, dirVersion, error) {
 	if err := r.unlocker.Ensure(); err != nil {
-		return nil, 0, err
+		return nil, nil, err
+	}
+	return r.t.readEntries(r.chunk)
+}
+
+// Reads the entries of a directory, along with the version of the directory that they are from. Without a lock on the
+// directory, they may be out of date as soon as they are returned.
+func (t Traverser) readEntries(dir apis.ChunkNum) ([]Entry, dirVersion, error) {
+	var result []Entry
+	var version dirVersion
+	for page := dir; page != 0; {
+		for _, seen := range version {
+			if seen.chunk == page {
+				return nil, nil, fmt.Errorf("pages of directory %d form a cycle", dir)
+			}
+		}
+		entries, ver, next, err := t.readPage(page, len(version) * EntryCount)
+		if err != nil {
+			return nil, nil, err
+		}
+		result = append(result, entries...)
+		version = append(version, dirPage{chunk: page, version: ver})
+		page = next
 	}
-	data, ver, err := r.t.client.Read(r.chunk, 0, apis.MaxChunkSize)
+	return result, version, nil
+}
+
+// Reads the entries in one page of a directory, numbered from 'first', along with the version of the page and the page
+// after it.
+func (t Traverser) readPage(page apis.ChunkNum, first int) ([]Entry, apis.Version, apis.ChunkNum, error) {
+	data, ver, err := t.client.Read(page, 0, apis.MaxChunkSize)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, 0, err
 	}
 	var result []Entry
 	for i := 0; i < EntryCount; i++ {
-		entry := decode(data[i *EntrySize:i *EntrySize+EntrySize], i)
+		entry := decode(data[i *EntrySize:i *EntrySize+EntrySize], first + i)
 		if !entry.IsOk() {
-			return nil, 0, errors.New("found invalid entry in folder!")
+			return nil, 0, 0, errors.New("found invalid entry in folder!")
 		}
 		if entry.Type != NONEXISTENT {
 			result = append(result, entry)
 		}
 	}
-	return result, ver, nil
+	next := apis.ChunkNum(binary.LittleEndian.Uint64(data[nextPageOffset:]))
+	return result, ver, next, nil
+}
+
+// Returns the page of a directory after this one, or zero if this is the last.
+func (t Traverser) nextPage(page apis.ChunkNum) (apis.ChunkNum, error) {
+	data, _, err := t.client.Read(page, nextPageOffset, 8)
+	if err != nil {
+		return 0, err
+	}
+	return apis.ChunkNum(binary.LittleEndian.Uint64(data)), nil
+}
+
+// How many slots listEntriesFrom reads at once.
+const listBatch = 4096
+
+// Lists at most 'limit' entries, starting from slot 'from', and returns them along with the slot to continue from, or
+// zero once there are no more. Unlike listEntries, this only reads the parts of the directory that it needs, so it can
+// be used on directories of any size.
+func (r *Reference) listEntriesFrom(from int, limit int) ([]Entry, int, error) {
+	if err := r.unlocker.Ensure(); err != nil {
+		return nil, 0, err
+	}
+	page := r.chunk
+	for i := 0; i < from / EntryCount; i++ {
+		next, err := r.t.nextPage(page)
+		if err != nil {
+			return nil, 0, err
+		}
+		if next == 0 {
+			return nil, 0, nil
+		}
+		page = next
+	}
+	var result []Entry
+	slot := from
+	for len(result) < limit {
+		inner := slot % EntryCount
+		count := EntryCount - inner
+		if count > listBatch {
+			count = listBatch
+		}
+		data, _, err := r.t.client.Read(page, uint32(inner * EntrySize), uint32(count * EntrySize))
+		if err != nil {
+			return nil, 0, err
+		}
+		for i := 0; i < count && len(result) < limit; i++ {
+			entry := decode(data[i *EntrySize:i *EntrySize+EntrySize], slot)
+			slot++
+			if !entry.IsOk() {
+				return nil, 0, errors.New("found invalid entry in folder!")
+			}
+			if entry.Type != NONEXISTENT {
+				result = append(result, entry)
+			}
+		}
+		if slot % EntryCount == 0 {
+			page, err = r.t.nextPage(page)
+			if err != nil {
+				return nil, 0, err
+			}
+			if page == 0 {
+				return result, 0, nil
+			}
+		}
+	}
+	return result, slot, nil
 }
 
 func (r *Reference) elevated() (*Reference, error) {
@@ -164,18 +495,197 @@ func (r *Reference) elevated() (*Reference, error) {
 		unlocker: nul,
 		t: r.t,
 		chunk: r.chunk,
+		chain: r.chain,
 	}, nil
 }
 
-func (r *Reference) updateEntry(version apis.Version, index int, new Entry) (apis.Version, error) {
+// Writes an entry into a slot of the directory, if the page that holds the slot is still at 'version', and returns the
+// version of the directory afterwards. A slot just past the last page adds a page to hold it.
+func (r *Reference) updateEntry(version dirVersion, index int, new Entry) (dirVersion, error) {
 	if err := r.unlocker.EnsureWrite(); err != nil {
-		return 0, err
+		return nil, err
 	}
 	data, err := new.encode()
 	if err != nil {
+		return nil, err
+	}
+	pageIndex := index / EntryCount
+	if pageIndex == len(version) {
+		if version, err = r.addPage(version); err != nil {
+			return nil, err
+		}
+	} else if pageIndex > len(version) {
+		return nil, fmt.Errorf("slot %d is past the end of directory %d", index, r.chunk)
+	}
+	page := version[pageIndex]
+	ver, err := r.t.client.Write(page.chunk, uint32(index % EntryCount * EntrySize), page.version, data)
+	if err != nil {
+		return nil, err
+	}
+	updated := append(dirVersion(nil), version...)
+	updated[pageIndex].version = ver
+	return updated, nil
+}
+
+// Adds an empty page to the end of the directory, and returns the version of the directory with it.
+func (r *Reference) addPage(version dirVersion) (dirVersion, error) {
+	chunk, err := r.t.client.New()
+	if err != nil {
+		return nil, err
+	}
+	// as with a new directory, write once so that every later update is checked against the version it was based on
+	ver, err := r.t.client.Write(chunk, 0, apis.AnyVersion, nil)
+	if err != nil {
+		_ = r.t.client.Delete(chunk, apis.AnyVersion)
+		return nil, err
+	}
+	last := version[len(version)-1]
+	link := make([]byte, 8)
+	binary.LittleEndian.PutUint64(link, uint64(chunk))
+	lastVer, err := r.t.client.Write(last.chunk, nextPageOffset, last.version, link)
+	if err != nil {
+		// nothing refers to the new page yet
+		_ = r.t.client.Delete(chunk, apis.AnyVersion)
+		return nil, err
+	}
+	updated := append(append(dirVersion(nil), version...), dirPage{chunk: chunk, version: ver})
+	updated[len(version)-1].version = lastVer
+	return updated, nil
+}
+
+// Adds delta to the recorded size of every directory in chain. The directories aren't locked; instead, each one is
+// only updated if nothing else changed it since it was read, so that changes anywhere below a directory are all counted
+// even when they happen at once.
+// TODO: a node whose size changes while it, or a directory above it, is being moved can be counted in the wrong place
+func (t Traverser) addSize(chain []apis.ChunkNum, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	for _, dir := range chain {
+		for {
+			data, ver, err := t.client.Read(dir, subtreeSizeOffset, 8)
+			if err != nil {
+				return err
+			}
+			size := make([]byte, 8)
+			binary.LittleEndian.PutUint64(size, binary.LittleEndian.Uint64(data)+uint64(delta))
+			nver, err := t.client.Write(dir, subtreeSizeOffset, ver, size)
+			if err == nil {
+				break
+			} else if nver == 0 {
+				return err
+			}
+			// version mismatch; go around again
+		}
+	}
+	return nil
+}
+
+// Changes the attributes of a node by passing them through update, which reports whether they need to be written. The
+// chain holds the directories from the root down to the node, followed by the node itself, as in Reference.chain and
+// File.parents; the node is left alone if it wasn't reached by traversal. Like addSize, this doesn't lock the directory
+// that holds the node's entry, and instead only writes the entry if nothing else changed the directory since it was
+// read. If the node was moved or removed in the meantime, it is left alone.
+func (t Traverser) touch(chain []apis.ChunkNum, update func(*Attributes) bool) error {
+	if len(chain) == 0 {
+		return nil
+	}
+	chunk := chain[len(chain)-1]
+	if len(chain) == 1 {
+		return t.touchRoot(chunk, update)
+	}
+	dir := chain[len(chain)-2]
+	for {
+		entries, version, err := t.readEntries(dir)
+		if err != nil {
+			return err
+		}
+		found := -1
+		for i, entry := range entries {
+			if entry.Chunk == chunk {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			return nil
+		}
+		entry := entries[found]
+		if !update(&entry.Attributes) {
+			return nil
+		}
+		data, err := entry.encode()
+		if err != nil {
+			return err
+		}
+		page := version[entry.Index / EntryCount]
+		nver, err := t.client.Write(page.chunk, uint32(entry.Index % EntryCount * EntrySize), page.version, data)
+		if err == nil {
+			return nil
+		} else if nver == 0 {
+			return err
+		}
+		// version mismatch; go around again
+	}
+}
+
+// Like touch, but for the root directory, whose attributes are kept in the root directory itself.
+func (t Traverser) touchRoot(root apis.ChunkNum, update func(*Attributes) bool) error {
+	for {
+		attributes, ver, err := t.readRootAttributes(root)
+		if err != nil {
+			return err
+		}
+		if !update(&attributes) {
+			return nil
+		}
+		nver, err := t.writeRootAttributes(root, ver, attributes)
+		if err == nil {
+			return nil
+		} else if nver == 0 {
+			return err
+		}
+		// version mismatch; go around again
+	}
+}
+
+// Updates the times of a directory after nodes were added to it or removed from it.
+func (t Traverser) dirModified(chain []apis.ChunkNum) error {
+	now := time.Now()
+	return t.touch(chain, func(attributes *Attributes) bool {
+		attributes.modified(now)
+		return true
+	})
+}
+
+// Returns how much a node contributes to the size of the directories above it: the length of a file, the recorded
+// size of a directory, and nothing for a symlink.
+func (t Traverser) nodeSize(entry Entry) (uint64, error) {
+	switch entry.Type {
+	case FILE:
+		index, err := (&File{chunk: entry.Chunk, t: t}).readIndex(0, 0)
+		if err != nil {
+			return 0, err
+		}
+		return index.length, nil
+	case DIRECTORY:
+		data, _, err := t.client.Read(entry.Chunk, subtreeSizeOffset, 8)
+		if err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint64(data), nil
+	default:
+		return 0, nil
+	}
+}
+
+// Returns the total length of every file in this directory and in the directories below it. This is kept up to date
+// as files change, so it costs a single read no matter how large the subtree is.
+func (r *Reference) SubtreeSize() (uint64, error) {
+	if err := r.unlocker.Ensure(); err != nil {
 		return 0, err
 	}
-	return r.t.client.Write(r.chunk, uint32(index * EntrySize), version, data)
+	return r.t.nodeSize(Entry{Type: DIRECTORY, Chunk: r.chunk})
 }
 
 func (r *Reference) Stat(name string) (NodeType, error) {
@@ -194,9 +704,9 @@ func (r *Reference) Stat(name string) (NodeType, error) {
 	return NONEXISTENT, nil
 }
 
-func (r *Reference) lookupEntryAny(name string) (Entry, apis.Version, error) {
+func (r *Reference) lookupEntryAny(name string) (Entry, dirVersion, error) {
 	if name == "" {
-		return Entry{}, 0, errors.New("empty filename")
+		return Entry{}, nil, errors.New("empty filename")
 	}
 	entries, ver, err := r.listEntries()
 	if err != nil {
@@ -207,7 +717,7 @@ func (r *Reference) lookupEntryAny(name string) (Entry, apis.Version, error) {
 			return entry, ver, nil
 		}
 	}
-	return Entry{}, ver, fmt.Errorf("no such node: %s", name)
+	return Entry{}, ver, fmt.Errorf("%w: %s", ErrNotExist, name)
 }
 
 func (r *Reference) lookupEntry(name string, ntype NodeType) (Entry, error) {
@@ -234,6 +744,7 @@ func (r *Reference) LookupFile(name string) (*File, error) {
 		chunk: entry.Chunk,
 		unlocker: unlocker,
 		t: r.t,
+		parents: r.chain,
 	}, nil
 }
 
@@ -246,15 +757,20 @@ func (r *Reference) LookupDir(name string) (*Reference, error) {
 	if err != nil {
 		return nil, err
 	}
+	var chain []apis.ChunkNum
+	if r.chain != nil {
+		chain = append(append([]apis.ChunkNum{}, r.chain...), entry.Chunk)
+	}
 	return &Reference{
 		chunk: entry.Chunk,
 		unlocker: unlocker,
 		t: r.t,
+		chain: chain,
 	}, nil
 }
 
 func (r *Reference) LookupSymLink(name string) (string, error) {
-	entry, err := r.lookupEntry(name, FILE)
+	entry, err := r.lookupEntry(name, SYMLINK)
 	if err != nil {
 		return "", err
 	}
@@ -262,42 +778,36 @@ func (r *Reference) LookupSymLink(name string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	file := &File{
-		chunk: entry.Chunk,
-		unlocker: unlocker,
-		t: r.t,
-	}
-	defer file.Release()
-	data, err := file.Read(0, MaxSymLinkSize)
+	defer unlocker.Unlock()
+	// symlink chunks hold the target directly, rather than using the file layout
+	data, _, err := r.t.client.Read(entry.Chunk, 0, MaxSymLinkSize)
 	if err != nil {
 		return "", err
 	}
 	return string(util.StripTrailingZeroes(data)), nil
 }
 
-func (r *Reference) scanNewEntry(name string) (int, apis.Version, error) {
+// Finds the first free slot in the directory for an entry by this name, which may be just past its last page.
+func (r *Reference) scanNewEntry(name string) (int, dirVersion, error) {
 	if name == "" {
-		return 0, 0, errors.New("empty filename")
+		return 0, nil, errors.New("empty filename")
 	}
 	if len(name) > MaxName {
-		return 0, 0, fmt.Errorf("name too long")
+		return 0, nil, fmt.Errorf("name too long")
 	}
 	entries, ver, err := r.listEntries()
 	if err != nil {
-		return 0, 0, err
+		return 0, nil, err
 	}
 	firstFree := 0
 	for _, entry := range entries {
 		if entry.Name == name {
-			return 0, 0, fmt.Errorf("file already exists: %s", name)
+			return 0, nil, fmt.Errorf("%w: %s", ErrExists, name)
 		}
 		if entry.Index == firstFree {
 			firstFree++ // lets firstFree land on the first empty entry
 		}
 	}
-	if firstFree >= EntryCount {
-		return 0, 0, errors.New("no room in directory for another file")
-	}
 	return firstFree, ver, nil
 }
 
@@ -316,25 +826,85 @@ func (r *Reference) tryNewEntry(name string, exec func () (apis.ChunkNum, NodeTy
 		return err
 	}
 	// TODO: what if we crash here
+	attributes := DefaultAttributes(ntype)
+	attributes.created(time.Now())
 	_, err = elevated.updateEntry(ver, firstFree, Entry{
 		Chunk: chunk,
 		Type: ntype,
 		Name: name,
+		Attributes: attributes,
 	})
-	return err
+	if err != nil {
+		// nothing refers to the new chunk, so don't leave it behind
+		_ = r.t.client.Delete(chunk, apis.AnyVersion)
+		return err
+	}
+	return r.t.dirModified(r.chain)
 }
 
 func (r *Reference) NewFile(name string) error {
 	return r.tryNewEntry(name, func() (apis.ChunkNum, NodeType, error) {
-		chunk, err := r.t.client.New()
+		chunk, err := r.t.newFileChunk()
 		return chunk, FILE, err
 	})
 }
 
+// Opens the file with this name, creating it first if nothing by that name exists. If exclusive, an existing file is
+// not opened, and ErrExists is returned instead.
+// If another client creates or removes a node in this directory at the same time, this fails with
+// apis.ErrLockContended or apis.ErrVersionStale. The caller should release this reference and try again, at which
+// point it will see the other client's change.
+func (r *Reference) OpenOrNewFile(name string, exclusive bool) (*File, error) {
+	err := r.NewFile(name)
+	if err != nil && (exclusive || !errors.Is(err, ErrExists)) {
+		return nil, err
+	}
+	return r.LookupFile(name)
+}
+
+// Adds an entry for a file whose chunk was already created and filled in elsewhere. Unlike NewFile, the chunk is left
+// alone if this fails, so that the caller can try again or reclaim it as it sees fit.
+func (r *Reference) LinkFile(name string, chunk apis.ChunkNum) error {
+	attributes := DefaultAttributes(FILE)
+	attributes.created(time.Now())
+	return r.linkEntry(Entry{
+		Chunk: chunk,
+		Type: FILE,
+		Name: name,
+		Attributes: attributes,
+	})
+}
+
+// Like LinkFile, but for a node of any type, which keeps whatever attributes it is given.
+func (r *Reference) linkEntry(entry Entry) error {
+	firstFree, ver, err := r.scanNewEntry(entry.Name)
+	if err != nil {
+		return err
+	}
+	elevated, err := r.elevated()
+	if err != nil {
+		return err
+	}
+	defer elevated.Release()
+	if _, err = elevated.updateEntry(ver, firstFree, entry); err != nil {
+		return err
+	}
+	return r.t.dirModified(r.chain)
+}
+
 func (r *Reference) NewDir(name string) error {
 	return r.tryNewEntry(name, func() (apis.ChunkNum, NodeType, error) {
 		chunk, err := r.t.client.New()
-		return chunk, DIRECTORY, err
+		if err != nil {
+			return 0, NONEXISTENT, err
+		}
+		// a fresh chunk is at version zero, which would match AnyVersion; writing once means that every later update to
+		// the directory's entries is checked against the version it was based on
+		_, err = r.t.client.Write(chunk, 0, apis.AnyVersion, nil)
+		if err != nil {
+			return 0, NONEXISTENT, err
+		}
+		return chunk, DIRECTORY, nil
 	})
 }
 
@@ -355,38 +925,62 @@ func (r *Reference) NewSymLink(name string, target string) error {
 	})
 }
 
-// attempts to elevate two different references at once.
-// this gets around the normal rule of "only one elevated reference at a time" by ordering based on chunk number
-func elevateBoth(r1, r2 *Reference) (*Reference, *Reference, error) {
-	flip := r1.chunk > r2.chunk
-	if flip {
-		r1, r2 = r2, r1
-	}
-	r1e, err := r1.elevated()
+// Changes the attributes of the node with this name, by passing them through update.
+// If another client changes this directory at the same time, this fails with apis.ErrLockContended or
+// apis.ErrVersionStale, and may be retried.
+func (r *Reference) SetAttributes(name string, update func(*Attributes)) error {
+	entry, ver, err := r.lookupEntryAny(name)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	r2e, err := r2.elevated()
+	elevated, err := r.elevated()
 	if err != nil {
-		r1e.Release()
-		return nil, nil, err
-	}
-	if flip {
-		return r2e, r1e, nil
-	} else {
-		return r1e, r2e, nil
+		return err
 	}
+	defer elevated.Release()
+	update(&entry.Attributes)
+	entry.Attributes.Mode &= AttributeModeMask
+	entry.Ctime = time.Now()
+	_, err = elevated.updateEntry(ver, entry.Index, entry)
+	return err
 }
 
-func (r *Reference) Rename(sourcename string, targetname string) error {
-	if sourcename == targetname {
-		return errors.New("attempt to rename file to itself!")
+// Returns the attributes of the root directory, which are kept in the root directory itself, since nothing has an entry
+// for it. Until they are first set, they are the default attributes of a directory.
+func (r *Reference) RootAttributes() (Attributes, error) {
+	attributes, _, err := r.rootAttributes()
+	return attributes, err
+}
+
+func (r *Reference) rootAttributes() (Attributes, apis.Version, error) {
+	if err := r.unlocker.Ensure(); err != nil {
+		return Attributes{}, 0, err
 	}
-	entryS, verS, err := r.lookupEntryAny(sourcename)
+	return r.t.readRootAttributes(r.chunk)
+}
+
+func (t Traverser) readRootAttributes(root apis.ChunkNum) (Attributes, apis.Version, error) {
+	// a flag byte, which is zero until the attributes have been set, followed by the attributes
+	data, ver, err := t.client.Read(root, rootAttributesOffset, 1+attributesSize)
 	if err != nil {
-		return err
+		return Attributes{}, 0, err
+	}
+	if data[0] == 0 {
+		return DefaultAttributes(DIRECTORY), ver, nil
 	}
-	indexT, _, err := r.scanNewEntry(targetname)
+	return decodeAttributes(data[1:]), ver, nil
+}
+
+func (t Traverser) writeRootAttributes(root apis.ChunkNum, ver apis.Version, attributes Attributes) (apis.Version, error) {
+	data := make([]byte, 1+attributesSize)
+	data[0] = 1
+	attributes.encode(data[1:])
+	return t.client.Write(root, rootAttributesOffset, ver, data)
+}
+
+// Like SetAttributes, but for the root directory, which this must be a reference to.
+func (r *Reference) SetRootAttributes(update func(*Attributes)) error {
+	attributes, ver, err := r.rootAttributes()
 	if err != nil {
 		return err
 	}
@@ -395,207 +989,299 @@ func (r *Reference) Rename(sourcename string, targetname string) error {
 		return err
 	}
 	defer elevated.Release()
-	verN, err := elevated.updateEntry(verS, entryS.Index, Entry{ Type: NONEXISTENT })
-	if err != nil {
-		return err
-	}
-	// TODO: this point contains a serious concurrency flaw: a race condition that can make a file disappear!
-	//       THIS NEEDS TO BE FIXED.
-	if _, err = elevated.updateEntry(verN, indexT, entryS); err != nil {
+	if err := elevated.unlocker.EnsureWrite(); err != nil {
 		return err
 	}
-	return nil
+	update(&attributes)
+	attributes.Mode &= AttributeModeMask
+	attributes.Ctime = time.Now()
+	_, err = r.t.writeRootAttributes(r.chunk, ver, attributes)
+	return err
 }
 
-func (r *Reference) MoveTo(target *Reference, sourcename string, targetname string) error {
-	if r.chunk == target.chunk {
-		return r.Rename(sourcename, targetname)
+func (r *Reference) Rename(sourcename string, targetname string) error {
+	if sourcename == targetname {
+		return errors.New("attempt to rename file to itself!")
 	}
-	entryS, verS, err := r.lookupEntryAny(sourcename)
+	entryS, _, err := r.lookupEntryAny(sourcename)
 	if err != nil {
 		return err
 	}
-	indexT, verT, err := target.scanNewEntry(targetname)
+	indexT, verT, err := r.scanNewEntry(targetname)
 	if err != nil {
 		return err
 	}
-	elevSource, elevTarget, err := elevateBoth(r, target)
+	elevated, err := r.elevated()
 	if err != nil {
 		return err
 	}
-	defer elevSource.Release()
-	defer elevTarget.Release()
-	if _, err = elevSource.updateEntry(verS, entryS.Index, Entry{ Type: NONEXISTENT }); err != nil {
+	defer elevated.Release()
+	if entryS.Type == DIRECTORY {
+		// chains through the directory are caught by the revisions anyway, but this saves checking them to find out
+		r.t.paths.forgetChunk(entryS.Chunk)
+	}
+	attributes := entryS.Attributes
+	attributes.Ctime = time.Now()
+	// the new entry goes in first, so that if we fail partway, the node is left with two names rather than none
+	verN, err := elevated.updateEntry(verT, indexT, Entry{ Type: entryS.Type, Name: targetname, Chunk: entryS.Chunk, Attributes: attributes })
+	if err != nil {
 		return err
 	}
-	// TODO: this point contains a serious concurrency flaw: a race condition that can make a file disappear!
-	//       THIS NEEDS TO BE FIXED.
-	if _, err = elevTarget.updateEntry(verT, indexT, entryS); err != nil {
+	// the directory is locked, so only touch and addSize can have changed it since, and neither changes which entries
+	// are in use; insisting on the version would leave the node with two names if one of them got in first
+	if _, err = elevated.updateEntry(verN.anyVersion(), entryS.Index, Entry{ Type: NONEXISTENT }); err != nil {
 		return err
 	}
-	return nil
+	return r.t.dirModified(r.chain)
 }
 
-func (r *Reference) Remove(name string, rmdir bool) error {
-	entry, ver, err := r.lookupEntryAny(name)
-	if err != nil {
-		return err
-	}
-	if entry.Type == DIRECTORY {
-		if !rmdir {
-			return errors.New("attempt to remove directory")
+// Held as a write lock for the duration of every move of a directory between two directories. No chunk is ever
+// allocated as zero, so this doesn't conflict with the lock on any real node.
+const moveLockChunk apis.ChunkNum = 0
+
+func containsChunk(chain []apis.ChunkNum, chunk apis.ChunkNum) bool {
+	for _, c := range chain {
+		if c == chunk {
+			return true
 		}
-		dir, err := r.LookupDir(name)
+	}
+	return false
+}
+
+// Moves the node at the absolute path 'source' to the absolute path 'dest', which must not already exist. A directory
+// cannot be moved inside itself.
+// If another client changes either directory at the same time, this fails with apis.ErrLockContended or
+// apis.ErrVersionStale, and may be retried.
+func (t Traverser) Move(source string, dest string) error {
+	sourceName, destName := path2.Base(source), path2.Base(dest)
+	if path2.Dir(source) == path2.Dir(dest) {
+		dir, err := t.PathDir(path2.Dir(source))
 		if err != nil {
 			return err
 		}
 		defer dir.Release()
-		contents, _, err := dir.listEntries()
+		return dir.Rename(sourceName, destName)
+	}
+
+	sourceDir, sourceChain, err := t.pathChain(path2.Dir(source))
+	if err != nil {
+		return err
+	}
+	entryS, _, err := sourceDir.lookupEntryAny(sourceName)
+	sourceDir.Release()
+	if err != nil {
+		return err
+	}
+	movingDir := entryS.Type == DIRECTORY
+	if movingDir {
+		lock, err := t.fs.WriteLockChunk(moveLockChunk)
 		if err != nil {
 			return err
 		}
-		if len(contents) != 0 {
-			return errors.New("attempt to remove non-empty directory")
-		}
-		// TODO: check this ordering of elevation -- is there a deadlock here?
-		dirElevated, err := dir.elevated()
+		defer lock.Unlock()
+		// only moves of directories can change which directory another is inside of, so while we hold the move lock,
+		// these chains stay accurate even though we don't hold locks on the directories along them
+		sourceDir, sourceChain, err = t.pathChain(path2.Dir(source))
 		if err != nil {
 			return err
 		}
-		defer dirElevated.Release()
-		// (we just need to hold this until we perform the delete at the end)
-	} else {
-		if rmdir {
-			return errors.New("attempt to remove non-directory")
-		}
-		unlocker, err := r.t.fs.WriteLockChunk(entry.Chunk)
+		sourceDir.Release()
+	}
+	destDir, destChain, err := t.pathChain(path2.Dir(dest))
+	if err != nil {
+		return err
+	}
+	destDir.Release()
+	sourceChunk, destChunk := sourceChain[len(sourceChain)-1], destChain[len(destChain)-1]
+
+	if sourceChunk == destChunk {
+		dir, err := t.lockDir(sourceChunk)
 		if err != nil {
 			return err
 		}
-		defer unlocker.Unlock()
+		defer dir.Release()
+		return dir.Rename(sourceName, destName)
 	}
-	elevated, err := r.elevated()
+
+	destFirst := containsChunk(sourceChain, destChunk) ||
+		(!containsChunk(destChain, sourceChunk) && destChunk < sourceChunk)
+	first, second := sourceChunk, destChunk
+	if destFirst {
+		first, second = destChunk, sourceChunk
+	}
+	// each is write locked before the next is locked at all, since holding a read lock on one directory while waiting to
+	// elevate another breaks the lock order just as much as taking them out of order would
+	firstDir, err := t.writeLockDir(first)
 	if err != nil {
 		return err
 	}
-	defer elevated.Release()
-	if _, err = elevated.updateEntry(ver, entry.Index, Entry{Type: NONEXISTENT}); err != nil {
+	defer firstDir.Release()
+	secondDir, err := t.writeLockDir(second)
+	if err != nil {
 		return err
 	}
-	// TODO: check failure modes here
-	return elevated.t.client.Delete(entry.Chunk, apis.AnyVersion)
-}
-
-func (r *Reference) Release() {
-	r.unlocker.Unlock()
-}
+	defer secondDir.Release()
+	sourceDir, destDir = firstDir, secondDir
+	if destFirst {
+		sourceDir, destDir = secondDir, firstDir
+	}
+	if !movingDir {
+		// without the move lock, a directory may have been moved into the other since the chains were found, in which
+		// case they were locked child first, against tree order; now that both are locked, that can no longer change
+		misordered, err := secondDir.holds(first)
+		if err != nil {
+			return err
+		}
+		if misordered {
+			return fmt.Errorf("%w: directories moved during move of %s", apis.ErrLockContended, source)
+		}
+	}
 
-// TODO: use caching... we're allowed to, since we have a read lock!
-func (f *File) Size() (uint32, error) {
-	if err := f.unlocker.Ensure(); err != nil {
-		return 0, err
+	entryS, verS, err := sourceDir.lookupEntryAny(sourceName)
+	if err != nil {
+		return err
 	}
-	// file chunks include an embedded length field at the start
-	binlength, _, err := f.t.client.Read(f.chunk, 0, 4)
+	if entryS.Type == DIRECTORY && !movingDir {
+		return fmt.Errorf("%w: %s was replaced by a directory", apis.ErrLockContended, source)
+	}
+	if entryS.Type == DIRECTORY && containsChunk(destChain, entryS.Chunk) {
+		return fmt.Errorf("cannot move directory %s inside itself", source)
+	}
+	indexT, verT, err := destDir.scanNewEntry(destName)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	if entryS.Type == DIRECTORY {
+		t.paths.forgetChunk(entryS.Chunk)
 	}
-	return binary.LittleEndian.Uint32(binlength), nil
-}
 
-func (f *File) Read(offset uint32, length uint32) ([]byte, error) {
-	if err := f.unlocker.Ensure(); err != nil {
-		return nil, err
+	// as in Rename, add before removing, so that a failure in between can't lose the node
+	attributes := entryS.Attributes
+	attributes.Ctime = time.Now()
+	if _, err = destDir.updateEntry(verT, indexT, Entry{ Type: entryS.Type, Name: destName, Chunk: entryS.Chunk, Attributes: attributes }); err != nil {
+		return err
+	}
+	// as in Rename, the source directory is locked, so the entry can be cleared whatever its version
+	if _, err = sourceDir.updateEntry(verS.anyVersion(), entryS.Index, Entry{ Type: NONEXISTENT }); err != nil {
+		return err
+	}
+	if err := t.dirModified(sourceChain); err != nil {
+		return err
 	}
-	if offset + 4 < offset {
-		return nil, errors.New("offset too large; overflow")
+	if err := t.dirModified(destChain); err != nil {
+		return err
 	}
-	data, _, err := f.t.client.Read(f.chunk, 0, offset + length + 4)
+	// the directories above both places are unaffected, so only charge the ones the node actually left or joined
+	size, err := t.nodeSize(entryS)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	maxlen := binary.LittleEndian.Uint32(data[0:4])
-	if maxlen + 4 >= offset + 4 {
-		return data[offset + 4:maxlen + 4], nil
-	} else {
-		return nil, nil
+	if err := t.addSize(excludingChunks(sourceChain, destChain), -int64(size)); err != nil {
+		return err
 	}
+	return t.addSize(excludingChunks(destChain, sourceChain), int64(size))
 }
 
-func (f *File) Write(offset uint32, data []byte) error {
-	// note: we do *not* elevate here! this is because POSIX supports parallel writes to the same file!
-	if err := f.unlocker.Ensure(); err != nil {
+// Reports whether the directory has an entry for 'chunk'.
+func (r *Reference) holds(chunk apis.ChunkNum) (bool, error) {
+	entries, _, err := r.listEntries()
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.Chunk == chunk {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func excludingChunks(chain []apis.ChunkNum, exclude []apis.ChunkNum) []apis.ChunkNum {
+	var result []apis.ChunkNum
+	for _, c := range chain {
+		if !containsChunk(exclude, c) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func (r *Reference) Remove(name string, rmdir bool) error {
+	entry, ver, err := r.lookupEntryAny(name)
+	if err != nil {
+		return err
+	}
+	if entry.Type == DIRECTORY && !rmdir {
+		return errors.New("attempt to remove directory")
+	}
+	if entry.Type != DIRECTORY && rmdir {
+		return errors.New("attempt to remove non-directory")
+	}
+	elevated, err := r.elevated()
+	if err != nil {
 		return err
 	}
-	binlength, ver, err := f.t.client.Read(f.chunk, 0, 4)
+	defer elevated.Release()
+	// the parent is already locked, so the node can be locked without breaking the ordering
+	unlocker, err := r.t.fs.WriteLockChunk(entry.Chunk)
 	if err != nil {
 		return err
 	}
-	length := binary.LittleEndian.Uint32(binlength)
-	dlen := uint32(len(data))
-	// TODO: come back and check integer overflow cases
-	if offset + dlen > length {
-		// this means we need to update the length, not just the data
-		if offset > length {
-			// this means we need to write a block of zeroes too
-			padded := make([]byte, offset + dlen - length)
-			copy(padded[offset - length:], data)
-			ver, err = f.t.client.Write(f.chunk, 4 + length, ver, padded)
-			if err != nil {
-				return err
-			}
-		} else {
-			ver, err = f.t.client.Write(f.chunk, 4 + offset, ver, data)
-			if err != nil {
-				return err
-			}
+	defer unlocker.Unlock()
+	var file *File
+	// the pages of a directory after its own chunk, which go along with it
+	var extraPages dirVersion
+	if entry.Type == DIRECTORY {
+		r.t.paths.forgetChunk(entry.Chunk)
+		dir := &Reference{
+			chunk: entry.Chunk,
+			unlocker: unlocker,
+			t: r.t,
 		}
-		// now fix the length (note: this should retry on its own)
-		nbinlength := make([]byte, 4)
-		binary.LittleEndian.PutUint32(nbinlength, offset + dlen)
-		_, err = f.t.client.Write(f.chunk, 0, ver, nbinlength)
+		contents, pages, err := dir.listEntries()
 		if err != nil {
 			return err
 		}
-	} else {
-		_, err = f.t.client.Write(f.chunk, 4 + offset, ver, data)
-		if err != nil {
-			// TODO: retry on version mismatch failure (for all)
-			return err
+		if len(contents) != 0 {
+			return fmt.Errorf("%w: %s", ErrNotEmpty, name)
+		}
+		extraPages = pages[1:]
+	} else if entry.Type == FILE {
+		file = &File{
+			chunk: entry.Chunk,
+			unlocker: unlocker,
+			t: r.t,
 		}
 	}
-	return nil
-}
-
-func (f *File) Truncate(nlength uint32) error {
-	// note: we do *not* elevate here! this is because POSIX supports parallel writes to the same file!
-	if err := f.unlocker.Ensure(); err != nil {
+	size, err := r.t.nodeSize(entry)
+	if err != nil {
 		return err
 	}
-	binlength, ver, err := f.t.client.Read(f.chunk, 0, 4)
-	if err != nil {
+	if _, err = elevated.updateEntry(ver, entry.Index, Entry{Type: NONEXISTENT}); err != nil {
 		return err
 	}
-	length := binary.LittleEndian.Uint32(binlength)
-	if nlength == length {
-		return nil
+	// TODO: check failure modes here
+	if file != nil {
+		if err := file.releaseChunks(0, MaxFileChunks); err != nil {
+			return err
+		}
 	}
-	if nlength > length { // needs to be zeroed out first
-		ver, err = f.t.client.Write(f.chunk, length, ver, make([]byte, nlength - length))
-		if err != nil {
-			// TODO: maybe retry
+	for _, page := range extraPages {
+		if err := elevated.t.client.Delete(page.chunk, apis.AnyVersion); err != nil {
 			return err
 		}
 	}
-	// now we can just adjust the length
-	nbinlength := make([]byte, 4)
-	binary.LittleEndian.PutUint32(nbinlength, nlength)
-	_, err = f.t.client.Write(f.chunk, 0, ver, nbinlength)
-	if err != nil {
-		// TODO: maybe retry
+	if err := elevated.t.client.Delete(entry.Chunk, apis.AnyVersion); err != nil {
 		return err
 	}
-	return nil
+	if err := r.t.dirModified(r.chain); err != nil {
+		return err
+	}
+	return r.t.addSize(r.chain, -int64(size))
+}
+
+func (r *Reference) Release() {
+	r.unlocker.Unlock()
 }
 
 func (f *File) Release() {
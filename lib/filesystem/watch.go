@@ -0,0 +1,335 @@
+package filesystem
+
+import (
+	"errors"
+	path2 "path"
+	"sort"
+	"sync"
+	"time"
+
+	"zircon/lib/apis"
+)
+
+type ChangeType uint8
+
+const (
+	// A new entry appeared in a directory.
+	CREATED ChangeType = iota
+	// An entry was replaced by a different node under the same name.
+	MODIFIED ChangeType = iota
+	// An entry disappeared from a directory.
+	DELETED ChangeType = iota
+	// An entry was given a new name within the same directory.
+	RENAMED ChangeType = iota
+)
+
+// A change to the entries of a watched directory.
+type ChangeEvent struct {
+	Type ChangeType
+	// The path of the affected entry. For RENAMED, this is its new path.
+	Path string
+	// For RENAMED, the path the entry had before.
+	OldPath string
+}
+
+// How long a watch waits before trying again when it can't reach the sync server.
+const watchRetryInterval = time.Second
+
+// Every directory changes only under a write lock on its chunk, so a watch waits for the sync server to report that
+// such a lock was released, and then compares the directory's entries against the ones it saw before. Writing to an
+// open file doesn't take a lock, so only changes to directory entries are reported.
+// Moves between two directories show up as a DELETED in one and a CREATED in the other.
+type watchSession struct {
+	t         Traverser
+	recursive bool
+	events    chan ChangeEvent
+	stop      chan struct{}
+	stopOnce  sync.Once
+	running   sync.WaitGroup
+
+	// protects the names and children of every watchedDir in the session
+	mu sync.Mutex
+}
+
+type watchedDir struct {
+	chunk apis.ChunkNum
+	// the root of the watch has no parent, and its name is its full path
+	parent   *watchedDir
+	name     string
+	children map[apis.ChunkNum]*watchedDir
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (f *filesystem) Watch(path string) (<-chan ChangeEvent, func(), error) {
+	return f.watch(path, false)
+}
+
+func (f *filesystem) WatchRecursive(path string) (<-chan ChangeEvent, func(), error) {
+	return f.watch(path, true)
+}
+
+func (f *filesystem) watch(path string, recursive bool) (<-chan ChangeEvent, func(), error) {
+	ref, err := f.t.PathDir(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	chunk := ref.chunk
+	ref.Release()
+
+	s := &watchSession{
+		t:         *f.t,
+		recursive: recursive,
+		events:    make(chan ChangeEvent),
+		stop:      make(chan struct{}),
+	}
+	root := s.newDir(chunk, nil, path2.Clean(path))
+	if err := s.start(root, true); err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		s.running.Wait()
+		close(s.events)
+	}()
+	return s.events, s.cancel, nil
+}
+
+// Stops delivering events. The channel is closed once every directory's wait for the sync server has returned.
+func (s *watchSession) cancel() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+func (s *watchSession) newDir(chunk apis.ChunkNum, parent *watchedDir, name string) *watchedDir {
+	return &watchedDir{
+		chunk:    chunk,
+		parent:   parent,
+		name:     name,
+		children: map[apis.ChunkNum]*watchedDir{},
+		stop:     make(chan struct{}),
+	}
+}
+
+func (s *watchSession) path(dir *watchedDir, name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elements := []string{name}
+	for ; dir != nil; dir = dir.parent {
+		elements = append([]string{dir.name}, elements...)
+	}
+	return path2.Join(elements...)
+}
+
+// Starts watching a directory. With 'baseline', whatever is in the directory now is taken as already seen, and this
+// doesn't return until that has been established, so that nothing done afterwards can be missed. Otherwise, everything
+// in it is reported as CREATED, which is how a directory that appears under a recursive watch is filled in.
+func (s *watchSession) start(dir *watchedDir, baseline bool) error {
+	revision := apis.UnknownRevision
+	var entries []Entry
+	if baseline {
+		var err error
+		revision, entries, err = s.snapshot(dir.chunk, apis.UnknownRevision)
+		if err != nil {
+			return err
+		}
+		if s.recursive {
+			for _, entry := range entries {
+				if entry.Type == DIRECTORY {
+					if err := s.startChild(dir, entry, true); err != nil {
+						s.stopDir(dir)
+						return err
+					}
+				}
+			}
+		}
+	}
+	s.running.Add(1)
+	go s.run(dir, revision, entries)
+	return nil
+}
+
+func (s *watchSession) startChild(dir *watchedDir, entry Entry, baseline bool) error {
+	child := s.newDir(entry.Chunk, dir, entry.Name)
+	s.mu.Lock()
+	// checked under the lock, so that stopDir either sees this child or stops us from adding it
+	if s.stopped(dir) {
+		s.mu.Unlock()
+		return nil
+	}
+	dir.children[entry.Chunk] = child
+	s.mu.Unlock()
+	return s.start(child, baseline)
+}
+
+// Stops watching a directory and everything being watched below it.
+func (s *watchSession) stopDir(dir *watchedDir) {
+	dir.stopOnce.Do(func() {
+		close(dir.stop)
+	})
+	s.mu.Lock()
+	children := dir.children
+	dir.children = map[apis.ChunkNum]*watchedDir{}
+	s.mu.Unlock()
+	for _, child := range children {
+		s.stopDir(child)
+	}
+}
+
+func (s *watchSession) stopped(dir *watchedDir) bool {
+	select {
+	case <-s.stop:
+		return true
+	case <-dir.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Waits for the directory to change after 'seen', and then lists its entries. The revision returned is the one the
+// entries are at least as new as.
+func (s *watchSession) snapshot(chunk apis.ChunkNum, seen apis.SyncRevision) (apis.SyncRevision, []Entry, error) {
+	revision, err := s.t.fs.s.AwaitRelease(chunk, seen)
+	if err != nil || revision == seen {
+		return revision, nil, err
+	}
+	ref, err := s.t.lockDir(chunk)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer ref.Release()
+	entries, _, err := ref.listEntries()
+	if err != nil {
+		return 0, nil, err
+	}
+	return revision, entries, nil
+}
+
+func (s *watchSession) run(dir *watchedDir, revision apis.SyncRevision, entries []Entry) {
+	defer s.running.Done()
+	defer s.stopDir(dir)
+	for !s.stopped(dir) {
+		next, listing, err := s.snapshot(dir.chunk, revision)
+		if errors.Is(err, apis.ErrNotFound) {
+			// the directory itself was removed, which its parent reports
+			return
+		} else if err != nil {
+			select {
+			case <-s.stop:
+			case <-dir.stop:
+			case <-time.After(watchRetryInterval):
+			}
+			continue
+		}
+		if next == revision {
+			continue
+		}
+		revision = next
+		for _, change := range diffEntries(entries, listing) {
+			if !s.report(dir, change) {
+				return
+			}
+		}
+		entries = listing
+	}
+}
+
+// Delivers a change, and keeps track of the directories under a recursive watch. Returns false if the watch stopped.
+func (s *watchSession) report(dir *watchedDir, change entryChange) bool {
+	event := ChangeEvent{Type: change.Type, Path: s.path(dir, change.Entry.Name)}
+	if change.Type == RENAMED {
+		event.OldPath = s.path(dir, change.OldName)
+	}
+	if s.stopped(dir) {
+		return false
+	}
+	select {
+	case s.events <- event:
+	case <-s.stop:
+		return false
+	case <-dir.stop:
+		return false
+	}
+	if !s.recursive {
+		return true
+	}
+	s.mu.Lock()
+	child, watched := dir.children[change.Entry.Chunk]
+	switch {
+	case change.Type == RENAMED && watched:
+		child.name = change.Entry.Name
+	case change.Type == DELETED && watched:
+		delete(dir.children, change.Entry.Chunk)
+	}
+	s.mu.Unlock()
+	if change.Type == DELETED && watched {
+		s.stopDir(child)
+	} else if change.Type == CREATED && change.Entry.Type == DIRECTORY {
+		// can't fail, because nothing needs to be read before the new directory's watch starts
+		_ = s.startChild(dir, change.Entry, false)
+	}
+	return true
+}
+
+type entryChange struct {
+	Type    ChangeType
+	Entry   Entry
+	OldName string
+}
+
+// Works out how a directory's entries changed. Entries that kept their node but changed their name were renamed.
+// Changes are ordered as deletions, renames, replacements, and then creations, each by name.
+func diffEntries(before []Entry, after []Entry) []entryChange {
+	oldByName := map[string]Entry{}
+	oldByChunk := map[apis.ChunkNum]Entry{}
+	for _, entry := range before {
+		oldByName[entry.Name] = entry
+		oldByChunk[entry.Chunk] = entry
+	}
+	newByName := map[string]Entry{}
+	newByChunk := map[apis.ChunkNum]Entry{}
+	for _, entry := range after {
+		newByName[entry.Name] = entry
+		newByChunk[entry.Chunk] = entry
+	}
+
+	var deleted, renamed, modified, created []entryChange
+	for _, entry := range before {
+		if _, kept := newByName[entry.Name]; kept {
+			continue
+		}
+		if moved, found := newByChunk[entry.Chunk]; found && moved.Name != entry.Name {
+			if _, replaced := oldByName[moved.Name]; !replaced {
+				renamed = append(renamed, entryChange{Type: RENAMED, Entry: moved, OldName: entry.Name})
+				continue
+			}
+		}
+		deleted = append(deleted, entryChange{Type: DELETED, Entry: entry})
+	}
+	for _, entry := range after {
+		previous, existed := oldByName[entry.Name]
+		if existed {
+			if previous.Chunk != entry.Chunk || previous.Type != entry.Type {
+				modified = append(modified, entryChange{Type: MODIFIED, Entry: entry})
+			}
+			continue
+		}
+		if moved, found := oldByChunk[entry.Chunk]; found {
+			if _, stillThere := newByName[moved.Name]; !stillThere {
+				// counted as a rename above
+				continue
+			}
+		}
+		created = append(created, entryChange{Type: CREATED, Entry: entry})
+	}
+
+	var changes []entryChange
+	for _, group := range [][]entryChange{deleted, renamed, modified, created} {
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].Entry.Name < group[j].Entry.Name
+		})
+		changes = append(changes, group...)
+	}
+	return changes
+}
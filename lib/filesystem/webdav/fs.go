@@ -0,0 +1,206 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	path2 "path"
+	"sort"
+
+	dav "golang.org/x/net/webdav"
+
+	"zircon/lib/filesystem"
+)
+
+// Adapts a filesystem to the interface that the WebDAV handler works through.
+type davFS struct {
+	fs   filesystem.Filesystem
+	root string
+}
+
+var _ dav.FileSystem = &davFS{}
+
+// The WebDAV handler decides on responses with os.IsNotExist and os.IsExist, which only recognize the errors of the os
+// package, so the filesystem's errors are translated to those.
+func translate(op string, name string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, filesystem.ErrNotExist):
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	case errors.Is(err, filesystem.ErrExists):
+		return &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+	default:
+		return err
+	}
+}
+
+// Names are already cleaned by the WebDAV handler, but are cleaned again here so that the served directory can't be
+// escaped regardless.
+func (d *davFS) pathOf(name string) string {
+	return path2.Join(d.root, path2.Clean("/"+name))
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return translate("mkdir", name, d.fs.Mkdir(d.pathOf(name)))
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (dav.File, error) {
+	path := d.pathOf(name)
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		info, err := d.fs.Stat(path)
+		if err != nil {
+			return nil, translate("open", name, err)
+		}
+		if info.IsDir() {
+			return &dirFile{fs: d.fs, path: path}, nil
+		}
+		file, err := d.fs.OpenRead(path)
+		if err != nil {
+			return nil, translate("open", name, err)
+		}
+		return &readFile{ReadOnlyFile: file, fs: d.fs, path: path}, nil
+	}
+	file, err := d.fs.OpenWrite(path, flag&os.O_CREATE != 0, flag&os.O_EXCL != 0)
+	if err != nil {
+		return nil, translate("open", name, err)
+	}
+	if flag&os.O_TRUNC != 0 {
+		if err := file.Truncate(0); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	return &writeFile{WritableFile: file, fs: d.fs, path: path}, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	path := d.pathOf(name)
+	if path == d.root {
+		return os.ErrInvalid
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return translate("remove", name, d.fs.RemoveAll(path))
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName string, newName string) error {
+	source, dest := d.pathOf(oldName), d.pathOf(newName)
+	if source == d.root || dest == d.root {
+		return os.ErrInvalid
+	}
+	return translate("rename", oldName, d.fs.Rename(source, dest))
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := d.fs.Stat(d.pathOf(name))
+	return info, translate("stat", name, err)
+}
+
+type readFile struct {
+	filesystem.ReadOnlyFile
+	fs   filesystem.Filesystem
+	path string
+}
+
+func (f *readFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *readFile) Stat() (os.FileInfo, error) {
+	return f.fs.Stat(f.path)
+}
+
+func (f *readFile) Write(p []byte) (int, error) {
+	return 0, errors.New("file not opened for writing")
+}
+
+type writeFile struct {
+	filesystem.WritableFile
+	fs   filesystem.Filesystem
+	path string
+}
+
+func (f *writeFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *writeFile) Stat() (os.FileInfo, error) {
+	// the handler reports the size of an uploaded file before closing it, so anything held back has to be written
+	// out first
+	if err := f.Flush(); err != nil {
+		return nil, err
+	}
+	return f.fs.Stat(f.path)
+}
+
+type dirFile struct {
+	fs   filesystem.Filesystem
+	path string
+	// the rest of the listing, once Readdir has started it
+	remaining []os.FileInfo
+	listed    bool
+}
+
+func (f *dirFile) Close() error {
+	return nil
+}
+
+func (f *dirFile) Read(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (f *dirFile) Write(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (f *dirFile) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart {
+		f.remaining, f.listed = nil, false
+		return 0, nil
+	}
+	return 0, errors.New("is a directory")
+}
+
+func (f *dirFile) Stat() (os.FileInfo, error) {
+	return f.fs.Stat(f.path)
+}
+
+// Like os.File.Readdir: returns everything that remains if count is zero or less, and otherwise up to count entries,
+// with io.EOF once there are none left.
+func (f *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.listed {
+		names, err := f.fs.ListDir(f.path)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			info, err := f.fs.Stat(path2.Join(f.path, name))
+			if errors.Is(err, filesystem.ErrNotExist) {
+				// removed since it was listed
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			f.remaining = append(f.remaining, info)
+		}
+		f.listed = true
+	}
+	if count <= 0 {
+		infos := f.remaining
+		f.remaining = nil
+		return infos, nil
+	}
+	if len(f.remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.remaining) {
+		count = len(f.remaining)
+	}
+	infos := f.remaining[:count]
+	f.remaining = f.remaining[count:]
+	return infos, nil
+}
@@ -0,0 +1,142 @@
+package webdav
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	path2 "path"
+	"sort"
+
+	dav "golang.org/x/net/webdav"
+
+	"zircon/lib/filesystem"
+)
+
+// The handler serves a directory of a filesystem over WebDAV (RFC 4918), through golang.org/x/net/webdav, so that it
+// can be mounted as a network drive by the WebDAV clients built into Windows, macOS and most Linux desktops, or used
+// with tools like cadaver and rclone, without anything installed beyond what the operating system provides.
+//     Directories can also be browsed with an ordinary web browser: a GET of a directory lists what is inside it, with
+//     links to its files and subdirectories, while a GET of a file downloads it.
+//     WebDAV locks are only kept by the handler that granted them, in memory, and are separate from the advisory
+//     locks that Filesystem.Lock takes, so they only keep WebDAV clients of the same handler from overwriting each
+//     other's changes.
+//     Files are written in place as they are uploaded, so a client that reads a file while it is being uploaded sees
+//     only part of the new contents.
+
+type Handler struct {
+	fs   filesystem.Filesystem
+	root string
+	dav  *dav.Handler
+	// empty if requests aren't authenticated
+	username string
+	password string
+}
+
+// Serves the directory at 'root' without checking who makes requests. This is only suitable for networks where every
+// client is trusted.
+func NewHandler(fs filesystem.Filesystem, root string) (*Handler, error) {
+	root = path2.Clean("/" + root)
+	info, err := fs.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("[handler.go/STR] %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("cannot serve %s: not a directory", root)
+	}
+	return &Handler{
+		fs:   fs,
+		root: root,
+		dav: &dav.Handler{
+			FileSystem: &davFS{fs: fs, root: root},
+			LockSystem: dav.NewMemLS(),
+		},
+	}, nil
+}
+
+// Like NewHandler, but only accepts requests that authenticate with HTTP basic authentication as 'username' and
+// 'password'. Basic authentication sends the password with every request, so this should only be served over HTTPS;
+// Windows refuses to use it otherwise.
+func NewAuthenticatedHandler(fs filesystem.Filesystem, root string, username string, password string) (*Handler, error) {
+	if username == "" || password == "" {
+		return nil, errors.New("both a username and a password are required")
+	}
+	h, err := NewHandler(fs, root)
+	if err != nil {
+		return nil, err
+	}
+	h.username, h.password = username, password
+	return h, nil
+}
+
+func (h *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if h.username != "" && !h.authenticated(request) {
+		writer.Header().Set("WWW-Authenticate", `Basic realm="zircon", charset="UTF-8"`)
+		http.Error(writer, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	if request.Method == http.MethodGet || request.Method == http.MethodHead {
+		// WebDAV leaves GET of a directory undefined, and the WebDAV handler refuses it
+		if info, err := h.fs.Stat(h.pathOf(request.URL.Path)); err == nil && info.IsDir() {
+			h.listDirectory(writer, request)
+			return
+		}
+	}
+	h.dav.ServeHTTP(writer, request)
+}
+
+func (h *Handler) authenticated(request *http.Request) bool {
+	username, password, ok := request.BasicAuth()
+	if !ok {
+		return false
+	}
+	// compare both in full either way, so that the time taken doesn't say which one was wrong
+	usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(h.username)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(h.password)) == 1
+	return usernameOK && passwordOK
+}
+
+// The path in the filesystem of a name in the served directory. Names are cleaned first, so that they can't reach
+// above it.
+func (h *Handler) pathOf(name string) string {
+	return path2.Join(h.root, path2.Clean("/"+name))
+}
+
+// Writes out a page that lists a directory, for browsers.
+func (h *Handler) listDirectory(writer http.ResponseWriter, request *http.Request) {
+	names, err := h.fs.ListDir(h.pathOf(request.URL.Path))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Strings(names)
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if request.Method == http.MethodHead {
+		return
+	}
+	dir := path2.Clean("/" + request.URL.Path)
+	fmt.Fprintf(writer, "<!DOCTYPE html>\n<title>%s</title>\n<h1>%s</h1>\n<ul>\n", html.EscapeString(dir), html.EscapeString(dir))
+	if dir != "/" {
+		fmt.Fprintf(writer, "<li><a href=\"%s\">..</a></li>\n", dirLink(path2.Dir(dir)))
+	}
+	for _, name := range names {
+		child := path2.Join(dir, name)
+		if info, err := h.fs.Stat(h.pathOf(child)); err == nil && info.IsDir() {
+			fmt.Fprintf(writer, "<li><a href=\"%s\">%s/</a></li>\n", dirLink(child), html.EscapeString(name))
+		} else {
+			fmt.Fprintf(writer, "<li><a href=\"%s\">%s</a></li>\n", (&url.URL{Path: child}).EscapedPath(), html.EscapeString(name))
+		}
+	}
+	fmt.Fprint(writer, "</ul>\n")
+}
+
+// Links to a directory with a trailing slash, so that relative links within its page resolve inside it.
+func dirLink(dir string) string {
+	link := (&url.URL{Path: dir}).EscapedPath()
+	if dir != "/" {
+		link += "/"
+	}
+	return link
+}
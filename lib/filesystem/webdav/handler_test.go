@@ -0,0 +1,112 @@
+package webdav
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"zircon/lib/filesystem"
+)
+
+func do(t *testing.T, server *httptest.Server, method string, path string, body string, headers ...string) (*http.Response, string) {
+	request, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	for i := 0; i+1 < len(headers); i += 2 {
+		request.Header.Set(headers[i], headers[i+1])
+	}
+	response, err := server.Client().Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	return response, string(data)
+}
+
+func TestWebDAV(t *testing.T) {
+	fs, _ := filesystem.ConstructMemoryFilesystem()
+	require.NoError(t, fs.Mkdir("/share"))
+	handler, err := NewHandler(fs, "/share")
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	response, _ := do(t, server, "MKCOL", "/docs", "")
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	response, _ = do(t, server, "MKCOL", "/missing/docs", "")
+	assert.Equal(t, http.StatusConflict, response.StatusCode)
+
+	response, _ = do(t, server, "PUT", "/docs/a.txt", "hello, world")
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	response, _ = do(t, server, "PUT", "/docs/a.txt", "hello")
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	response, body := do(t, server, "GET", "/docs/a.txt", "")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "hello", body)
+	response, body = do(t, server, "GET", "/docs/a.txt", "", "Range", "bytes=1-2")
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+	assert.Equal(t, "el", body)
+	response, _ = do(t, server, "GET", "/docs/b.txt", "")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	response, body = do(t, server, "PROPFIND", "/docs/", "", "Depth", "1")
+	assert.Equal(t, http.StatusMultiStatus, response.StatusCode)
+	assert.Contains(t, body, "<D:href>/docs/a.txt</D:href>")
+	assert.Contains(t, body, "<D:getcontentlength>5</D:getcontentlength>")
+
+	response, body = do(t, server, "GET", "/docs/", "")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, body, `<a href="/docs/a.txt">a.txt</a>`)
+	assert.Contains(t, body, `<a href="/">..</a>`)
+
+	response, _ = do(t, server, "MOVE", "/docs", "", "Destination", server.URL+"/moved")
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	response, _ = do(t, server, "COPY", "/moved", "", "Destination", server.URL+"/copied")
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	paths, err := filesystem.ListTree(fs, "/share")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/share", "/share/copied", "/share/copied/a.txt", "/share/moved", "/share/moved/a.txt"}, paths)
+
+	response, _ = do(t, server, "DELETE", "/moved", "")
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	response, _ = do(t, server, "DELETE", "/", "")
+	assert.NotEqual(t, http.StatusNoContent, response.StatusCode)
+	paths, err = filesystem.ListTree(fs, "/share")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/share", "/share/copied", "/share/copied/a.txt"}, paths)
+
+	// nothing above the served directory can be reached
+	response, _ = do(t, server, "GET", "/../share/copied/a.txt", "")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestAuthentication(t *testing.T) {
+	fs, _ := filesystem.ConstructMemoryFilesystem()
+	handler, err := NewAuthenticatedHandler(fs, "/", "user", "secret")
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	response, _ := do(t, server, "PROPFIND", "/", "", "Depth", "0")
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	assert.NotEmpty(t, response.Header.Get("WWW-Authenticate"))
+
+	request, err := http.NewRequest("PROPFIND", server.URL+"/", nil)
+	require.NoError(t, err)
+	request.Header.Set("Depth", "0")
+	request.SetBasicAuth("user", "wrong")
+	response, err = server.Client().Do(request)
+	require.NoError(t, err)
+	_ = response.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	request.SetBasicAuth("user", "secret")
+	response, err = server.Client().Do(request)
+	require.NoError(t, err)
+	_ = response.Body.Close()
+	assert.Equal(t, http.StatusMultiStatus, response.StatusCode)
+}
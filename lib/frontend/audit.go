@@ -0,0 +1,125 @@
+package frontend
+
+import (
+	"context"
+
+	"zircon/lib/apis"
+	"zircon/lib/audit"
+	"zircon/lib/rpc"
+)
+
+type audited struct {
+	fe  apis.Frontend
+	log *audit.Log
+	// the client that requests are made by; see WithContext
+	actor string
+}
+
+// Like 'fe', but records each chunk that is allocated, written to or deleted through it in 'log', along with the
+// client that did so, as known to audit.CallerOf once the frontend has been bound to the context of a call.
+func NewAuditedFrontend(fe apis.Frontend, log *audit.Log) apis.Frontend {
+	return &audited{fe: fe, log: log}
+}
+
+func (a *audited) record(operation string, chunk apis.ChunkNum, version apis.Version, err error) {
+	a.log.Record(audit.Event{
+		Actor:     a.actor,
+		Operation: operation,
+		Chunk:     chunk,
+		Version:   version,
+		Error:     audit.ErrorText(err),
+	})
+}
+
+func (a *audited) WithContext(ctx context.Context) apis.Frontend {
+	return &audited{fe: rpc.FrontendWithContext(ctx, a.fe), log: a.log, actor: audit.CallerOf(ctx)}
+}
+
+func (a *audited) New() (apis.ChunkNum, error) {
+	chunk, err := a.fe.New()
+	a.record("New", chunk, 0, err)
+	return chunk, err
+}
+
+func (a *audited) NewWithOptions(options apis.NewOptions) (apis.ChunkNum, error) {
+	chunk, err := a.fe.NewWithOptions(options)
+	a.record("New", chunk, 0, err)
+	return chunk, err
+}
+
+// Records each chunk allocated as a separate New, or a single failed New if none could be.
+func (a *audited) AllocateChunks(count int) ([]apis.ChunkNum, error) {
+	chunks, err := a.fe.AllocateChunks(count)
+	if err != nil {
+		a.record("New", 0, 0, err)
+	}
+	for _, chunk := range chunks {
+		a.record("New", chunk, 0, nil)
+	}
+	return chunks, err
+}
+
+func (a *audited) ReadMetadataEntry(chunk apis.ChunkNum) (apis.Version, []apis.ServerAddress, error) {
+	return a.fe.ReadMetadataEntry(chunk)
+}
+
+func (a *audited) ReadFullMetadataEntry(chunk apis.ChunkNum) (apis.MetadataEntry, []apis.ServerAddress, error) {
+	return a.fe.ReadFullMetadataEntry(chunk)
+}
+
+func (a *audited) CommitWrite(chunk apis.ChunkNum, version apis.Version, hash apis.CommitHash) (apis.Version, error) {
+	nversion, err := a.fe.CommitWrite(chunk, version, hash)
+	a.record("CommitWrite", chunk, nversion, err)
+	return nversion, err
+}
+
+func (a *audited) CommitAppend(chunk apis.ChunkNum, hash apis.CommitHash) (apis.Version, uint32, error) {
+	nversion, offset, err := a.fe.CommitAppend(chunk, hash)
+	a.record("CommitAppend", chunk, nversion, err)
+	return nversion, offset, err
+}
+
+func (a *audited) Delete(chunk apis.ChunkNum, version apis.Version) error {
+	err := a.fe.Delete(chunk, version)
+	a.record("Delete", chunk, version, err)
+	return err
+}
+
+func (a *audited) DeleteIncomplete(chunk apis.ChunkNum) error {
+	err := a.fe.DeleteIncomplete(chunk)
+	a.record("DeleteIncomplete", chunk, 0, err)
+	return err
+}
+
+func (a *audited) AcquireWriteLease(chunk apis.ChunkNum) (apis.LeaseID, error) {
+	return a.fe.AcquireWriteLease(chunk)
+}
+
+func (a *audited) RenewWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error {
+	return a.fe.RenewWriteLease(chunk, lease)
+}
+
+func (a *audited) ReleaseWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error {
+	return a.fe.ReleaseWriteLease(chunk, lease)
+}
+
+func (a *audited) CommitLeasedWrite(chunk apis.ChunkNum, lease apis.LeaseID, hash apis.CommitHash) (apis.Version, error) {
+	nversion, err := a.fe.CommitLeasedWrite(chunk, lease, hash)
+	a.record("CommitLeasedWrite", chunk, nversion, err)
+	return nversion, err
+}
+
+// Audited frontends are published in place of the frontends they wrap, so they report the same health and metrics.
+func (a *audited) CheckHealth() []apis.DependencyStatus {
+	if checker, ok := a.fe.(apis.HealthChecker); ok {
+		return checker.CheckHealth()
+	}
+	return nil
+}
+
+func (a *audited) ReportMetrics() []apis.Measurement {
+	if reporter, ok := a.fe.(apis.MetricsReporter); ok {
+		return reporter.ReportMetrics()
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"zircon/lib/apis"
+	"zircon/lib/rpc"
+)
+
+// How many times a request is attempted before giving up on reaching any frontend, and how long to wait between
+// attempts, to give a restarting frontend time to register its new address.
+const RediscoverAttempts = 20
+const RediscoverInterval = 100 * time.Millisecond
+
+type rediscovering struct {
+	etcd  apis.EtcdInterface
+	cache rpc.ConnectionCache
+	// if set, the context that requests are bound to; see WithContext
+	ctx context.Context
+	// shared with every copy made by WithContext
+	state *discovered
+}
+
+// The frontend that requests are currently sent to.
+type discovered struct {
+	mu      sync.Mutex
+	current apis.Frontend
+	address apis.ServerAddress
+	nextID  int
+}
+
+// Constructs an interface to the frontends registered in etcd as if they were one frontend. Requests go to one
+// frontend until it stops responding, such as when it restarts on a new address; then the registrations are looked up
+// again, and the request is retried on whichever frontend is found.
+// A retried request may have already been performed by the frontend that stopped responding: a retried New may leave
+// behind an unused chunk, and a retried CommitWrite or Delete may report that the version is stale.
+func Rediscovering(etcd apis.EtcdInterface, cache rpc.ConnectionCache) apis.Frontend {
+	return &rediscovering{etcd: etcd, cache: cache, state: &discovered{}}
+}
+
+// Returns a view of these frontends whose requests are bound to ctx, including the waits between retries, while still
+// sharing which frontend is in use.
+func (r *rediscovering) WithContext(ctx context.Context) apis.Frontend {
+	bound := *r
+	bound.ctx = ctx
+	return &bound
+}
+
+func (r *rediscovering) get() (apis.Frontend, apis.ServerAddress, error) {
+	state := r.state
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.current != nil {
+		return state.current, state.address, nil
+	}
+	names, err := r.etcd.ListServers(apis.FRONTEND)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(names) == 0 {
+		return nil, "", fmt.Errorf("no frontends registered: %w", apis.ErrUnreachable)
+	}
+	// start from a different registration each time, so that one dead frontend doesn't get picked over and over
+	state.nextID = (state.nextID + 1) % len(names)
+	address, err := r.etcd.GetAddress(names[state.nextID], apis.FRONTEND)
+	if err != nil {
+		return nil, "", err
+	}
+	fe, err := r.cache.SubscribeFrontend(address)
+	if err != nil {
+		return nil, "", err
+	}
+	state.current, state.address = fe, address
+	return fe, address, nil
+}
+
+// Stops using the frontend at this address, unless another request has already moved on from it.
+func (r *rediscovering) forget(address apis.ServerAddress) {
+	state := r.state
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.address == address {
+		state.current, state.address = nil, ""
+	}
+}
+
+// Waits before the next attempt at a request, unless the context the request is bound to ends first.
+func (r *rediscovering) wait() error {
+	if r.ctx == nil {
+		time.Sleep(RediscoverInterval)
+		return nil
+	}
+	timer := time.NewTimer(RediscoverInterval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+func (r *rediscovering) retry(request func(fe apis.Frontend) error) error {
+	var err error
+	for attempt := 0; attempt < RediscoverAttempts; attempt++ {
+		if attempt > 0 {
+			if waitErr := r.wait(); waitErr != nil {
+				return fmt.Errorf("gave up on reaching a frontend after %v: %w", err, waitErr)
+			}
+		}
+		var fe apis.Frontend
+		var address apis.ServerAddress
+		fe, address, err = r.get()
+		if err == nil {
+			if r.ctx != nil {
+				fe = rpc.FrontendWithContext(r.ctx, fe)
+			}
+			err = request(fe)
+			if err == nil || !errors.Is(err, apis.ErrUnreachable) {
+				return err
+			}
+			r.forget(address)
+		} else if !errors.Is(err, apis.ErrUnreachable) {
+			return err
+		}
+	}
+	return err
+}
+
+func (r *rediscovering) ReadMetadataEntry(chunk apis.ChunkNum) (version apis.Version, addresses []apis.ServerAddress, err error) {
+	err = r.retry(func(fe apis.Frontend) error {
+		version, addresses, err = fe.ReadMetadataEntry(chunk)
+		return err
+	})
+	return version, addresses, err
+}
+
+func (r *rediscovering) ReadFullMetadataEntry(chunk apis.ChunkNum) (entry apis.MetadataEntry, addresses []apis.ServerAddress, err error) {
+	err = r.retry(func(fe apis.Frontend) error {
+		entry, addresses, err = fe.ReadFullMetadataEntry(chunk)
+		return err
+	})
+	return entry, addresses, err
+}
+
+func (r *rediscovering) CommitWrite(chunk apis.ChunkNum, version apis.Version, hash apis.CommitHash) (nversion apis.Version, err error) {
+	err = r.retry(func(fe apis.Frontend) error {
+		nversion, err = fe.CommitWrite(chunk, version, hash)
+		return err
+	})
+	return nversion, err
+}
+
+func (r *rediscovering) CommitAppend(chunk apis.ChunkNum, hash apis.CommitHash) (nversion apis.Version, offset uint32, err error) {
+	err = r.retry(func(fe apis.Frontend) error {
+		nversion, offset, err = fe.CommitAppend(chunk, hash)
+		return err
+	})
+	return nversion, offset, err
+}
+
+func (r *rediscovering) New() (chunk apis.ChunkNum, err error) {
+	err = r.retry(func(fe apis.Frontend) error {
+		chunk, err = fe.New()
+		return err
+	})
+	return chunk, err
+}
+
+func (r *rediscovering) NewWithOptions(options apis.NewOptions) (chunk apis.ChunkNum, err error) {
+	err = r.retry(func(fe apis.Frontend) error {
+		chunk, err = fe.NewWithOptions(options)
+		return err
+	})
+	return chunk, err
+}
+
+func (r *rediscovering) AllocateChunks(count int) (chunks []apis.ChunkNum, err error) {
+	err = r.retry(func(fe apis.Frontend) error {
+		chunks, err = fe.AllocateChunks(count)
+		return err
+	})
+	return chunks, err
+}
+
+func (r *rediscovering) Delete(chunk apis.ChunkNum, version apis.Version) error {
+	return r.retry(func(fe apis.Frontend) error {
+		return fe.Delete(chunk, version)
+	})
+}
+
+func (r *rediscovering) DeleteIncomplete(chunk apis.ChunkNum) error {
+	return r.retry(func(fe apis.Frontend) error {
+		return fe.DeleteIncomplete(chunk)
+	})
+}
+
+func (r *rediscovering) AcquireWriteLease(chunk apis.ChunkNum) (lease apis.LeaseID, err error) {
+	err = r.retry(func(fe apis.Frontend) error {
+		lease, err = fe.AcquireWriteLease(chunk)
+		return err
+	})
+	return lease, err
+}
+
+func (r *rediscovering) RenewWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error {
+	return r.retry(func(fe apis.Frontend) error {
+		return fe.RenewWriteLease(chunk, lease)
+	})
+}
+
+func (r *rediscovering) ReleaseWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error {
+	return r.retry(func(fe apis.Frontend) error {
+		return fe.ReleaseWriteLease(chunk, lease)
+	})
+}
+
+func (r *rediscovering) CommitLeasedWrite(chunk apis.ChunkNum, lease apis.LeaseID, hash apis.CommitHash) (nversion apis.Version, err error) {
+	err = r.retry(func(fe apis.Frontend) error {
+		nversion, err = fe.CommitLeasedWrite(chunk, lease, hash)
+		return err
+	})
+	return nversion, err
+}
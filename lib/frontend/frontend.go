@@ -1,37 +1,114 @@
 package frontend
 
 import (
+	"context"
+	"fmt"
+
 	"zircon/lib/apis"
 	"zircon/lib/rpc"
 	"zircon/lib/chunkupdate"
+	"zircon/lib/logging"
 )
 
 const InitialReplicationFactor = 2
 
 type frontend struct {
-	etcd    apis.EtcdInterface
-	cache   rpc.ConnectionCache
-	updater chunkupdate.Updater
+	etcd     apis.EtcdInterface
+	cache    rpc.ConnectionCache
+	updater  chunkupdate.Updater
+	replicas int
 }
 
 // Construct a frontend server, not including metadata caches and service handlers.
 func ConstructFrontend(etcd apis.EtcdInterface, cache rpc.ConnectionCache) (apis.Frontend, error) {
-	updater := chunkupdate.NewUpdater(cache, etcd, &reselectingMetadataUpdater{
+	return ConstructFrontendWithOptions(etcd, cache, FrontendOptions{})
+}
+
+// How a frontend constructed with ConstructFrontendWithOptions behaves. The zero value is a frontend like the one that
+// ConstructFrontend returns.
+type FrontendOptions struct {
+	// How many chunkservers new chunks are placed on when etcd records no replication factor for the cluster;
+	// InitialReplicationFactor if left as zero.
+	Replicas int
+	// How many of a chunk's replicas must acknowledge a write before it is committed; all of them if left as zero.
+	// Clients should be configured with the same quorum.
+	Quorum chunkupdate.WriteQuorum
+	// How the chunkservers for new chunks are chosen; chunkupdate.DomainPlacement if nil. The replication service
+	// should be given the same policy, so that replicas it repairs are placed by the same rules.
+	Placement chunkupdate.PlacementPolicy
+	// Where redirections between metadata caches and replicas that fall behind on writes are reported; nowhere if nil.
+	Logger apis.Logger
+}
+
+// Like ConstructFrontend, but takes all of the options at once, including those that can't be chosen any other way.
+func ConstructFrontendWithOptions(etcd apis.EtcdInterface, cache rpc.ConnectionCache, options FrontendOptions) (apis.Frontend, error) {
+	if options.Replicas == 0 {
+		options.Replicas = InitialReplicationFactor
+	}
+	if options.Placement == nil {
+		options.Placement = chunkupdate.DomainPlacement
+	}
+	if options.Logger == nil {
+		options.Logger = apis.NoopLogger
+	}
+	logger := logging.Component(options.Logger, "frontend")
+	updater := chunkupdate.NewLoggingUpdater(cache, etcd, &reselectingMetadataUpdater{
 		etcd: etcd,
 		cache: cache,
-	})
+		logger: logger,
+		ring: &ringCache{},
+	}, options.Quorum, options.Placement, logger)
 	return &frontend{
 		etcd: etcd,
 		cache: cache,
 		updater: updater,
+		replicas: options.Replicas,
 	}, nil
 }
 
 // Allocates a new chunk, all zeroed out. The version number will be zero, so the only way to access it initially is
 // with a version of AnyVersion.
-// If this chunk isn't written to before the connection to the server closes, the empty chunk will be deleted.
+// If this chunk is never written to, it is deleted through DeleteIncomplete, or by garbage collection once it has been
+// left unwritten for long enough.
 func (f *frontend) New() (apis.ChunkNum, error) {
-	return f.updater.New(InitialReplicationFactor)
+	return f.NewWithOptions(apis.NewOptions{})
+}
+
+// Like New, but places the chunk on as many replicas as 'options' asks for. Unless it asks for a particular number,
+// the chunk gets the cluster-wide replication factor recorded in etcd, or this frontend's own if there is none. The
+// chunk's ACL, if 'options' gives it one, must be owned by whoever made the request.
+func (f *frontend) NewWithOptions(options apis.NewOptions) (apis.ChunkNum, error) {
+	replicas, err := f.replicationFactor(options)
+	if err != nil {
+		return 0, err
+	}
+	return f.updater.NewWithACL(replicas, options.ACL)
+}
+
+// Like New, but allocates 'count' chunks at once, each placed on the cluster-wide number of replicas.
+func (f *frontend) AllocateChunks(count int) ([]apis.ChunkNum, error) {
+	replicas, err := f.replicationFactor(apis.NewOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return f.updater.NewBatch(replicas, count)
+}
+
+// Works out how many replicas a new chunk should have: as many as 'options' asks for, or else the cluster-wide
+// replication factor recorded in etcd, or else this frontend's own.
+func (f *frontend) replicationFactor(options apis.NewOptions) (int, error) {
+	replicas := options.ReplicationFactor
+	if replicas == 0 {
+		cluster, err := f.etcd.ReadReplicationFactor()
+		if err != nil {
+			return 0, fmt.Errorf("[frontend.go/RRF] %w", err)
+		}
+		replicas = cluster
+	}
+	if replicas == 0 {
+		replicas = f.replicas
+	}
+	return replicas, nil
 }
 
 // Reads the metadata entry of a particular chunk.
@@ -43,14 +120,82 @@ func (f *frontend) ReadMetadataEntry(chunk apis.ChunkNum) (apis.Version, []apis.
 	return ref.Version, ref.Replicas, nil
 }
 
+// Reads the whole metadata entry of a particular chunk, and the addresses of all of its replicas.
+func (f *frontend) ReadFullMetadataEntry(chunk apis.ChunkNum) (apis.MetadataEntry, []apis.ServerAddress, error) {
+	return f.updater.ReadFullMeta(chunk)
+}
+
 // Writes metadata for a particular chunk, after each chunkserver has received a preparation message for this write.
 // Only performs the write if the version matches.
 func (f *frontend) CommitWrite(chunk apis.ChunkNum, version apis.Version, hash apis.CommitHash) (apis.Version, error) {
 	return f.updater.CommitWrite(chunk, version, hash)
 }
 
+// Commits an append, after each chunkserver has received it, against whichever version of the chunk is current.
+func (f *frontend) CommitAppend(chunk apis.ChunkNum, hash apis.CommitHash) (apis.Version, uint32, error) {
+	return f.updater.CommitAppend(chunk, hash)
+}
+
 // Destroys an old chunk, assuming that the metadata version matches. This includes sending messages to all relevant
 // chunkservers.
 func (f *frontend) Delete(chunk apis.ChunkNum, version apis.Version) error {
 	return f.updater.Delete(chunk, version)
 }
+
+// Destroys a chunk that was allocated by New but has never been written to.
+func (f *frontend) DeleteIncomplete(chunk apis.ChunkNum) error {
+	return f.updater.DeleteIncomplete(chunk)
+}
+
+// Acquires a write lease on a chunk, which keeps anyone else from changing it until the lease is released or expires.
+func (f *frontend) AcquireWriteLease(chunk apis.ChunkNum) (apis.LeaseID, error) {
+	return f.updater.AcquireWriteLease(chunk)
+}
+
+// Extends a write lease to apis.WriteLeaseDuration from now.
+func (f *frontend) RenewWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error {
+	return f.updater.RenewWriteLease(chunk, lease)
+}
+
+// Gives up a write lease, if it is still held.
+func (f *frontend) ReleaseWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error {
+	return f.updater.ReleaseWriteLease(chunk, lease)
+}
+
+// Commits a write on behalf of the holder of a write lease, against whichever version of the chunk is current.
+func (f *frontend) CommitLeasedWrite(chunk apis.ChunkNum, lease apis.LeaseID, hash apis.CommitHash) (apis.Version, error) {
+	return f.updater.CommitLeasedWrite(chunk, lease, hash)
+}
+
+// Returns a view of this frontend whose lookups of metadata and chunkservers are bound to ctx, and which checks what the
+// caller recorded in ctx may do to each chunk; see apis.ACL. Commits and deletions that have started to change a chunk
+// are carried through regardless; see chunkupdate.Updater.
+func (f *frontend) WithContext(ctx context.Context) apis.Frontend {
+	return &frontend{
+		etcd: f.etcd,
+		cache: f.cache,
+		updater: f.updater.WithContext(ctx),
+		replicas: f.replicas,
+	}
+}
+
+// Reports whether etcd can be reached to look up this frontend's metadata cache, and whether that metadata cache can be
+// reached in turn.
+func (f *frontend) CheckHealth() []apis.DependencyStatus {
+	address, err := f.etcd.GetAddress(f.etcd.GetName(), apis.METADATACACHE)
+	etcd := apis.CheckDependency("etcd", err)
+	if err != nil {
+		err = fmt.Errorf("cannot look up address: %v", err)
+	} else {
+		err = f.cache.Preconnect([]apis.ServerAddress{address})
+	}
+	return []apis.DependencyStatus{etcd, apis.CheckDependency("metadatacache", err)}
+}
+
+// Reports the metrics of the updater, such as how many replicas it is catching up on writes.
+func (f *frontend) ReportMetrics() []apis.Measurement {
+	if reporter, ok := f.updater.(apis.MetricsReporter); ok {
+		return reporter.ReportMetrics()
+	}
+	return nil
+}
@@ -1,18 +1,65 @@
 package frontend
 
 import (
+	"context"
 	"zircon/lib/apis"
 	"zircon/lib/rpc"
 	"zircon/lib/chunkupdate"
 	"fmt"
+	"sync"
+	"time"
 )
 
 type reselectingMetadataUpdater struct {
-	etcd  apis.EtcdInterface
-	cache rpc.ConnectionCache
+	etcd   apis.EtcdInterface
+	cache  rpc.ConnectionCache
+	logger apis.Logger
+	// if set, the context that requests to the metadata caches are bound to
+	ctx context.Context
+	// shared with every copy made by WithContext
+	ring *ringCache
 }
 
-var _ chunkupdate.UpdaterMetadata = &reselectingMetadataUpdater{}
+// The metadata ring, as last read from etcd.
+type ringCache struct {
+	mu      sync.Mutex
+	ring    *apis.MetadataRing
+	fetched time.Time
+}
+
+// Returns the metadata ring, reading it again from etcd if the one we have is more than RingRefreshInterval old.
+func (c *ringCache) get(etcd apis.EtcdInterface) (*apis.MetadataRing, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ring == nil || time.Since(c.fetched) >= apis.RingRefreshInterval {
+		members, err := etcd.ListMetadataRing()
+		if err != nil {
+			return nil, err
+		}
+		c.ring = apis.NewMetadataRing(members)
+		c.fetched = time.Now()
+	}
+	return c.ring, nil
+}
+
+var _ chunkupdate.ContextualMetadata = &reselectingMetadataUpdater{}
+
+func (r *reselectingMetadataUpdater) WithContext(ctx context.Context) chunkupdate.UpdaterMetadata {
+	bound := *r
+	bound.ctx = ctx
+	return &bound
+}
+
+func (r *reselectingMetadataUpdater) subscribe(address apis.ServerAddress) (apis.MetadataCache, error) {
+	cache, err := r.cache.SubscribeMetadataCache(address)
+	if err != nil {
+		return nil, err
+	}
+	if r.ctx != nil {
+		cache = rpc.MetadataCacheWithContext(r.ctx, cache)
+	}
+	return cache, nil
+}
 
 // TODO: avoid inefficiently rerequesting access to the same metadata caches...
 // (though these *are* cached by the RPC connectionCache, so it shouldn't be completely horrible)
@@ -20,34 +67,44 @@ func (r *reselectingMetadataUpdater) getMetadataCache() (apis.MetadataCache, err
 	// connect to the local metadata cache
 	address, err := r.etcd.GetAddress(r.etcd.GetName(), apis.METADATACACHE)
 	if err != nil {
-		return nil, fmt.Errorf("each frontend must have a local metadata cache, but: %v", err)
-	}
-	cache, err := r.cache.SubscribeMetadataCache(address)
-	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("each frontend must have a local metadata cache, but: %w", err)
 	}
-	return cache, nil
+	return r.subscribe(address)
 }
 
 func (r *reselectingMetadataUpdater) getSpecificMetadataCache(redirect apis.ServerName) (apis.MetadataCache, error) {
 	// connect to the local metadata cache
 	address, err := r.etcd.GetAddress(redirect, apis.METADATACACHE)
 	if err != nil {
-		return nil, fmt.Errorf("cannot find target of redirection: %v", err)
+		return nil, fmt.Errorf("cannot find target of redirection: %w", err)
 	}
-	cache, err := r.cache.SubscribeMetadataCache(address)
-	if err != nil {
-		return nil, err
+	return r.subscribe(address)
+}
+
+// Connects to the metadata cache that the ring says likely owns a chunk's entry, or the local one if there's no telling.
+func (r *reselectingMetadataUpdater) getOwningMetadataCache(chunk apis.ChunkNum) (apis.MetadataCache, error) {
+	if r.ring != nil {
+		ring, err := r.ring.get(r.etcd)
+		if err != nil {
+			r.logger.Logf(apis.DEBUG, "cannot read metadata ring; asking local metadata cache: %v", err)
+		} else if owner := ring.Owner(chunk); owner != apis.NoRedirect {
+			cache, err := r.getSpecificMetadataCache(owner)
+			if err == nil {
+				return cache, nil
+			}
+			// the ring may be out of date
+			r.logger.Logf(apis.DEBUG, "cannot reach likely owner %s of chunk %d; asking local metadata cache: %v", owner, chunk, err)
+		}
 	}
-	return cache, nil
+	return r.getMetadataCache()
 }
 
 const MaxRedirections = 30
 
-func (r *reselectingMetadataUpdater) runRedirectionLoop(attempt func(apis.MetadataCache) (apis.ServerName, error)) error {
-	cache, err := r.getMetadataCache()
+func (r *reselectingMetadataUpdater) runRedirectionLoop(chunk apis.ChunkNum, attempt func(apis.MetadataCache) (apis.ServerName, error)) error {
+	cache, err := r.getOwningMetadataCache(chunk)
 	if err != nil {
-		return fmt.Errorf("[metadata.go/GMC] %v", err)
+		return fmt.Errorf("[metadata.go/GMC] %w", err)
 	}
 	var lastSkippedError error
 	for tries := 0; tries < MaxRedirections; tries++ {
@@ -58,33 +115,34 @@ func (r *reselectingMetadataUpdater) runRedirectionLoop(attempt func(apis.Metada
 			return err
 		} else {
 			lastSkippedError = err
+			r.logger.Logf(apis.DEBUG, "redirecting metadata request to owner %s: %v", redirect, err)
 			cache, err = r.getSpecificMetadataCache(redirect)
 			if err != nil {
-				return fmt.Errorf("[metadata.go/SMC] %v", err)
+				return fmt.Errorf("[metadata.go/SMC] %w", err)
 			}
 			// fall through; let's try this again with the correct server.
 		}
 	}
 	// ran out of attempts to redirect to the correct server. probably a redirection loop!
-	err = fmt.Errorf("probable redirection loop; original error: %v", lastSkippedError)
+	err = fmt.Errorf("probable redirection loop; original error: %w", lastSkippedError)
 	return err
 }
 
 func (r *reselectingMetadataUpdater) NewEntry() (apis.ChunkNum, error) {
 	cache, err := r.getMetadataCache()
 	if err != nil {
-		return 0, fmt.Errorf("[metadata.go/GMC] %v", err)
+		return 0, fmt.Errorf("[metadata.go/GMC] %w", err)
 	}
 	chunk, err := cache.NewEntry()
 	if err != nil {
-		return 0, fmt.Errorf("[metadata.go/CNE] %v", err)
+		return 0, fmt.Errorf("[metadata.go/CNE] %w", err)
 	}
 	return chunk, nil
 }
 
 func (r *reselectingMetadataUpdater) ReadEntry(chunk apis.ChunkNum) (apis.MetadataEntry, error) {
 	var entry apis.MetadataEntry
-	err := r.runRedirectionLoop(func(cache apis.MetadataCache) (redirect apis.ServerName, err error) {
+	err := r.runRedirectionLoop(chunk, func(cache apis.MetadataCache) (redirect apis.ServerName, err error) {
 		entry, redirect, err = cache.ReadEntry(chunk)
 		return
 	})
@@ -95,13 +153,13 @@ func (r *reselectingMetadataUpdater) ReadEntry(chunk apis.ChunkNum) (apis.Metada
 }
 
 func (r *reselectingMetadataUpdater) UpdateEntry(chunk apis.ChunkNum, previous apis.MetadataEntry, next apis.MetadataEntry) error {
-	return r.runRedirectionLoop(func(cache apis.MetadataCache) (apis.ServerName, error) {
+	return r.runRedirectionLoop(chunk, func(cache apis.MetadataCache) (apis.ServerName, error) {
 		return cache.UpdateEntry(chunk, previous, next)
 	})
 }
 
 func (r *reselectingMetadataUpdater) DeleteEntry(chunk apis.ChunkNum, previous apis.MetadataEntry) error {
-	return r.runRedirectionLoop(func(cache apis.MetadataCache) (apis.ServerName, error) {
+	return r.runRedirectionLoop(chunk, func(cache apis.MetadataCache) (apis.ServerName, error) {
 		return cache.DeleteEntry(chunk, previous)
 	})
 }
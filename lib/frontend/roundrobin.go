@@ -1,8 +1,10 @@
 package frontend
 
 import (
+	"context"
 	"sync"
 	"zircon/lib/apis"
+	"zircon/lib/rpc"
 )
 
 type roundrobin struct {
@@ -18,6 +20,11 @@ func RoundRobin(servers []apis.Frontend) apis.Frontend {
 	return &roundrobin{servers: servers}
 }
 
+// Returns a view of these frontends whose requests are bound to ctx, which takes turns with this one.
+func (r *roundrobin) WithContext(ctx context.Context) apis.Frontend {
+	return &boundRoundrobin{r: r, ctx: ctx}
+}
+
 func (r *roundrobin) next() apis.Frontend {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -31,14 +38,115 @@ func (r *roundrobin) ReadMetadataEntry(chunk apis.ChunkNum) (apis.Version, []api
 	return r.next().ReadMetadataEntry(chunk)
 }
 
+func (r *roundrobin) ReadFullMetadataEntry(chunk apis.ChunkNum) (apis.MetadataEntry, []apis.ServerAddress, error) {
+	return r.next().ReadFullMetadataEntry(chunk)
+}
+
 func (r *roundrobin) CommitWrite(chunk apis.ChunkNum, version apis.Version, hash apis.CommitHash) (apis.Version, error) {
 	return r.next().CommitWrite(chunk, version, hash)
 }
 
+func (r *roundrobin) CommitAppend(chunk apis.ChunkNum, hash apis.CommitHash) (apis.Version, uint32, error) {
+	return r.next().CommitAppend(chunk, hash)
+}
+
 func (r *roundrobin) New() (apis.ChunkNum, error) {
 	return r.next().New()
 }
 
+func (r *roundrobin) NewWithOptions(options apis.NewOptions) (apis.ChunkNum, error) {
+	return r.next().NewWithOptions(options)
+}
+
+func (r *roundrobin) AllocateChunks(count int) ([]apis.ChunkNum, error) {
+	return r.next().AllocateChunks(count)
+}
+
 func (r *roundrobin) Delete(chunk apis.ChunkNum, version apis.Version) error {
 	return r.next().Delete(chunk, version)
 }
+
+func (r *roundrobin) DeleteIncomplete(chunk apis.ChunkNum) error {
+	return r.next().DeleteIncomplete(chunk)
+}
+
+func (r *roundrobin) AcquireWriteLease(chunk apis.ChunkNum) (apis.LeaseID, error) {
+	return r.next().AcquireWriteLease(chunk)
+}
+
+func (r *roundrobin) RenewWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error {
+	return r.next().RenewWriteLease(chunk, lease)
+}
+
+func (r *roundrobin) ReleaseWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error {
+	return r.next().ReleaseWriteLease(chunk, lease)
+}
+
+func (r *roundrobin) CommitLeasedWrite(chunk apis.ChunkNum, lease apis.LeaseID, hash apis.CommitHash) (apis.Version, error) {
+	return r.next().CommitLeasedWrite(chunk, lease, hash)
+}
+
+type boundRoundrobin struct {
+	r   *roundrobin
+	ctx context.Context
+}
+
+func (b *boundRoundrobin) next() apis.Frontend {
+	return rpc.FrontendWithContext(b.ctx, b.r.next())
+}
+
+func (b *boundRoundrobin) WithContext(ctx context.Context) apis.Frontend {
+	return b.r.WithContext(ctx)
+}
+
+func (b *boundRoundrobin) ReadMetadataEntry(chunk apis.ChunkNum) (apis.Version, []apis.ServerAddress, error) {
+	return b.next().ReadMetadataEntry(chunk)
+}
+
+func (b *boundRoundrobin) ReadFullMetadataEntry(chunk apis.ChunkNum) (apis.MetadataEntry, []apis.ServerAddress, error) {
+	return b.next().ReadFullMetadataEntry(chunk)
+}
+
+func (b *boundRoundrobin) CommitWrite(chunk apis.ChunkNum, version apis.Version, hash apis.CommitHash) (apis.Version, error) {
+	return b.next().CommitWrite(chunk, version, hash)
+}
+
+func (b *boundRoundrobin) CommitAppend(chunk apis.ChunkNum, hash apis.CommitHash) (apis.Version, uint32, error) {
+	return b.next().CommitAppend(chunk, hash)
+}
+
+func (b *boundRoundrobin) New() (apis.ChunkNum, error) {
+	return b.next().New()
+}
+
+func (b *boundRoundrobin) NewWithOptions(options apis.NewOptions) (apis.ChunkNum, error) {
+	return b.next().NewWithOptions(options)
+}
+
+func (b *boundRoundrobin) AllocateChunks(count int) ([]apis.ChunkNum, error) {
+	return b.next().AllocateChunks(count)
+}
+
+func (b *boundRoundrobin) Delete(chunk apis.ChunkNum, version apis.Version) error {
+	return b.next().Delete(chunk, version)
+}
+
+func (b *boundRoundrobin) DeleteIncomplete(chunk apis.ChunkNum) error {
+	return b.next().DeleteIncomplete(chunk)
+}
+
+func (b *boundRoundrobin) AcquireWriteLease(chunk apis.ChunkNum) (apis.LeaseID, error) {
+	return b.next().AcquireWriteLease(chunk)
+}
+
+func (b *boundRoundrobin) RenewWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error {
+	return b.next().RenewWriteLease(chunk, lease)
+}
+
+func (b *boundRoundrobin) ReleaseWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error {
+	return b.next().ReleaseWriteLease(chunk, lease)
+}
+
+func (b *boundRoundrobin) CommitLeasedWrite(chunk apis.ChunkNum, lease apis.LeaseID, hash apis.CommitHash) (apis.Version, error) {
+	return b.next().CommitLeasedWrite(chunk, lease, hash)
+}
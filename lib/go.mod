@@ -1,10 +1,27 @@
 module zircon/lib
 
-go 1.12
+go 1.21
 
 require (
+	github.com/golang/snappy v0.0.1
 	github.com/hanwen/go-fuse v1.0.0
-	github.com/stretchr/testify v1.4.0
+	github.com/stretchr/testify v1.9.0
 	go.etcd.io/etcd v3.4.2+incompatible
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/sdk v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
+	golang.org/x/net v0.0.0-20190813141303-74dc4d7220e7
+	google.golang.org/grpc v1.23.1
 	gopkg.in/yaml.v2 v2.2.7
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	go.opentelemetry.io/otel/metric v1.28.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
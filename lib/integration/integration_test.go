@@ -1,6 +1,7 @@
 package integration
 
 import (
+	"errors"
 	"testing"
 
 	"zircon/lib/apis"
@@ -38,7 +39,10 @@ func TestSimpleClientReadWrite(t *testing.T) {
 	assert.True(t, ver3 > ver2)
 
 	ver5, err := client.Write(cn, 7, ver2, []byte("earth..."))
-	assert.Error(t, err)
+	var stale apis.VersionStaleError
+	if assert.True(t, errors.As(err, &stale)) {
+		assert.Equal(t, ver3, stale.Current)
+	}
 	assert.Equal(t, ver3, ver5) // make sure it returns the correct new version after staleness failure
 
 	data, ver4, err := client.Read(cn, 0, apis.MaxChunkSize)
@@ -46,7 +50,7 @@ func TestSimpleClientReadWrite(t *testing.T) {
 	assert.Equal(t, ver3, ver4)
 	assert.Equal(t, "hello, home!!", string(util.StripTrailingZeroes(data)))
 
-	assert.Error(t, client.Delete(cn, ver2))
+	assert.True(t, errors.Is(client.Delete(cn, ver2), apis.ErrVersionStale))
 
 	data, ver6, err := client.Read(cn, 0, apis.MaxChunkSize)
 	assert.NoError(t, err)
@@ -56,5 +60,5 @@ func TestSimpleClientReadWrite(t *testing.T) {
 	assert.NoError(t, client.Delete(cn, ver6))
 
 	_, _, err = client.Read(cn, 0, apis.MaxChunkSize)
-	assert.Error(t, err)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
 }
@@ -4,11 +4,14 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"testing"
+	"zircon/admin"
 	"zircon/apis"
 	"zircon/chunkserver"
+	"zircon/chunkupdate"
 	"zircon/client"
 	"zircon/etcd"
 	"zircon/frontend"
+	"zircon/logging"
 	"zircon/metadatacache"
 	"zircon/rpc"
 	"zircon/services"
@@ -23,6 +26,8 @@ func PrepareNetworkedCluster(t *testing.T) (fe apis.Client, teardown func()) {
 
 	etcds, teardown7 := etcd.PrepareSubscribeForTesting(t)
 	teardowns.Add(teardown7)
+	// once every server has stopped, nothing is left to make requests through the cache
+	teardowns.Add(cache.CloseAll)
 
 	for _, name := range []apis.ServerName{"cs0", "cs1", "cs2"} {
 		cs, _, teardown1 := chunkserver.NewTestChunkserver(t, cache)
@@ -35,6 +40,9 @@ func PrepareNetworkedCluster(t *testing.T) (fe apis.Client, teardown func()) {
 		etcdif, teardown := etcds(name)
 		teardowns.Add(teardown)
 		etcdif.UpdateAddress(csaddr, apis.CHUNKSERVER)
+		stopHeartbeats, err := chunkserver.StartHeartbeats(etcdif, apis.DefaultLivenessTimeout, apis.NoopLogger)
+		assert.NoError(t, err)
+		teardowns.Add(stopHeartbeats)
 	}
 
 	config := client.Configuration{}
@@ -42,10 +50,16 @@ func PrepareNetworkedCluster(t *testing.T) (fe apis.Client, teardown func()) {
 	for _, name := range []apis.ServerName{"fe0"} {
 		etcdn, teardown8 := etcds(name)
 
-		fen, err := frontend.ConstructFrontend(etcdn, cache)
+		// the admin server reports what the frontend and its server log
+		recorder := logging.NewRecorder(admin.RecentErrors)
+		logger := recorder.Wrap(apis.NoopLogger)
+		fen, err := frontend.ConstructFrontendWithOptions(etcdn, cache, frontend.FrontendOptions{Logger: logger})
 
 		assert.NoError(t, err)
-		teardown9, address, err := rpc.PublishFrontend(fen, "127.0.0.1:0")
+		teardown9, address, err := rpc.PublishFrontendWithOptions(fen, "127.0.0.1:0", rpc.ServerOptions{
+			Logger: logger,
+			Admin:  admin.NewHandler(etcdn, cache, recorder),
+		})
 		assert.NoError(t, err)
 		teardowns.Add(teardown8, func() {
 			teardown9(true)
@@ -55,6 +69,9 @@ func PrepareNetworkedCluster(t *testing.T) (fe apis.Client, teardown func()) {
 
 		mdc, err := metadatacache.NewCache(cache, etcdn)
 		assert.NoError(t, err)
+		teardowns.Add(func() {
+			assert.NoError(t, mdc.Close())
+		})
 		teardown10, mdcaddress, err := rpc.PublishMetadataCache(mdc, "127.0.0.1:0")
 		assert.NoError(t, err)
 		teardowns.Add(func() { teardown10(true) })
@@ -64,12 +81,15 @@ func PrepareNetworkedCluster(t *testing.T) (fe apis.Client, teardown func()) {
 		config.FrontendAddresses = append(config.FrontendAddresses, address)
 
 		// Setup services
-		_, err = services.StartServices(etcdn, mdc, cache)
+		stopServices, err := services.StartServices(etcdn, mdc, cache, chunkupdate.DomainPlacement)
 		assert.NoError(t, err)
+		teardowns.Add(func() {
+			assert.NoError(t, stopServices())
+		})
 	}
 
 	clientH, err := client.ConfigureNetworkedClient(config)
 	require.NoError(t, err)
 
-	return clientH, teardowns.Teardown
+	return clientH, teardowns.TeardownReverse
 }
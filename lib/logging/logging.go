@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"zircon/lib/apis"
+)
+
+// Explanation of logging:
+//     Components send their diagnostic messages through the apis.Logger they are constructed with. The loggers made
+//     here write each message as a structured record through log/slog, either as text, such as
+//         time=2026-10-16T11:00:05.123Z level=WARN msg="replica cs-address-1 fell behind" component=frontend
+//     or as a line of JSON, along with any fields the logger was given through With. Each component marks the messages
+//     it logs with its name through Component, so that those of a process that runs several components, or of several
+//     processes gathered in one place, can be told apart. Other loggers, such as apis.NoopLogger, are left as they are,
+//     since they have nowhere to put fields.
+
+// How a daemon logs, as given in its configuration file. The zero value logs text at INFO and above.
+type Configuration struct {
+	// The least severe messages that are logged: "debug", "info", "warn" or "error". Info if left empty.
+	Level string `yaml:"level"`
+	// Whether each message is written as a line of JSON rather than as text.
+	JSON bool `yaml:"json"`
+}
+
+// Parses the name of a level, as given in a Configuration. Empty means INFO.
+func ParseLevel(name string) (apis.LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return apis.DEBUG, nil
+	case "", "info":
+		return apis.INFO, nil
+	case "warn", "warning":
+		return apis.WARN, nil
+	case "error":
+		return apis.ERROR, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
+// Makes the logger for a daemon that is configured with 'config', which writes to 'out'.
+func (config Configuration) NewLogger(out io.Writer) (apis.Logger, error) {
+	minimum, err := ParseLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+	options := &slog.HandlerOptions{Level: slogLevel(minimum)}
+	if config.JSON {
+		return &logger{out: slog.New(slog.NewJSONHandler(out, options))}, nil
+	}
+	return &logger{out: slog.New(slog.NewTextHandler(out, options))}, nil
+}
+
+// Logs text to standard error at INFO and above, for when a daemon's configuration couldn't be loaded or doesn't say
+// otherwise.
+func Default() apis.Logger {
+	return &logger{out: slog.New(slog.NewTextHandler(os.Stderr, nil))}
+}
+
+// A logger that can attach fields to the messages logged through it.
+type FieldLogger interface {
+	apis.Logger
+
+	// Returns a logger that adds 'key' with 'value' to every message logged through it, as well as any fields this one
+	// already adds.
+	With(key string, value interface{}) apis.Logger
+}
+
+// Adds 'key' with 'value' to every message logged through 'base', if it is a FieldLogger. Other loggers are returned
+// unchanged.
+func With(base apis.Logger, key string, value interface{}) apis.Logger {
+	if fielded, ok := base.(FieldLogger); ok {
+		return fielded.With(key, value)
+	}
+	return base
+}
+
+// Marks every message logged through 'base' as coming from 'component', such as "chunkserver" or "fuse"; see With.
+func Component(base apis.Logger, component string) apis.Logger {
+	return With(base, "component", component)
+}
+
+// Logs a message at ERROR and exits, like log.Fatalf, for daemons that cannot go on.
+func Fatalf(logger apis.Logger, format string, args ...interface{}) {
+	logger.Logf(apis.ERROR, format, args...)
+	os.Exit(1)
+}
+
+type logger struct {
+	out *slog.Logger
+}
+
+func (l *logger) Logf(level apis.LogLevel, format string, args ...interface{}) {
+	ctx := context.Background()
+	// skip formatting messages that would be dropped anyway, since DEBUG messages can be frequent
+	if !l.out.Enabled(ctx, slogLevel(level)) {
+		return
+	}
+	l.out.Log(ctx, slogLevel(level), fmt.Sprintf(format, args...))
+}
+
+func (l *logger) With(key string, value interface{}) apis.Logger {
+	return &logger{out: l.out.With(key, value)}
+}
+
+func slogLevel(level apis.LogLevel) slog.Level {
+	switch level {
+	case apis.DEBUG:
+		return slog.LevelDebug
+	case apis.INFO:
+		return slog.LevelInfo
+	case apis.WARN:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
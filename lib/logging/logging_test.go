@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"zircon/lib/apis"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tests that messages below the configured level are dropped, and the rest are written as text with their fields.
+func TestTextLogger(t *testing.T) {
+	var out bytes.Buffer
+	base, err := Configuration{Level: "warn"}.NewLogger(&out)
+	require.NoError(t, err)
+	logger := With(Component(base, "frontend"), "server", "fe0")
+
+	logger.Logf(apis.INFO, "not logged")
+	logger.Logf(apis.WARN, "replica %s fell behind", "cs-address-1")
+	base.Logf(apis.ERROR, "no fields")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `level=WARN msg="replica cs-address-1 fell behind" component=frontend server=fe0`)
+	assert.Contains(t, lines[1], "level=ERROR msg=\"no fields\"")
+	assert.NotContains(t, lines[1], "component=")
+}
+
+// Tests that each message is written as a line of JSON when asked to be.
+func TestJSONLogger(t *testing.T) {
+	var out bytes.Buffer
+	base, err := Configuration{Level: "debug", JSON: true}.NewLogger(&out)
+	require.NoError(t, err)
+	Component(base, "chunkserver").Logf(apis.DEBUG, "reclaiming chunk %d", 73)
+
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &record))
+	assert.Equal(t, "DEBUG", record["level"])
+	assert.Equal(t, "reclaiming chunk 73", record["msg"])
+	assert.Equal(t, "chunkserver", record["component"])
+	assert.NotEmpty(t, record["time"])
+}
+
+// Tests that levels are parsed from their names, and that loggers that can't carry fields are left alone.
+func TestLevelsAndFields(t *testing.T) {
+	for name, level := range map[string]apis.LogLevel{"": apis.INFO, "debug": apis.DEBUG, "INFO": apis.INFO, "warning": apis.WARN, "error": apis.ERROR} {
+		parsed, err := ParseLevel(name)
+		assert.NoError(t, err)
+		assert.Equal(t, level, parsed, name)
+	}
+	_, err := ParseLevel("loud")
+	assert.Error(t, err)
+	_, err = Configuration{Level: "loud"}.NewLogger(&bytes.Buffer{})
+	assert.Error(t, err)
+
+	assert.Equal(t, apis.NoopLogger, Component(apis.NoopLogger, "frontend"))
+}
+
+// Tests that a recorder passes every message on, and remembers only the most recent warnings and errors, with fields.
+func TestRecorder(t *testing.T) {
+	var out bytes.Buffer
+	base, err := Configuration{Level: "debug"}.NewLogger(&out)
+	require.NoError(t, err)
+	recorder := NewRecorder(2)
+	logger := recorder.Wrap(base)
+	assert.Empty(t, recorder.Recent())
+
+	Component(logger, "frontend").Logf(apis.WARN, "first")
+	logger.Logf(apis.INFO, "not remembered")
+	logger.Logf(apis.ERROR, "second")
+	logger.Logf(apis.WARN, "third")
+
+	assert.Equal(t, 4, strings.Count(out.String(), "\n"))
+	assert.Contains(t, out.String(), "msg=first component=frontend")
+	recent := recorder.Recent()
+	require.Len(t, recent, 2)
+	assert.Equal(t, "second", recent[0].Message)
+	assert.Equal(t, "ERROR", recent[0].Level)
+	assert.Nil(t, recent[0].Fields)
+	assert.Equal(t, "third", recent[1].Message)
+
+	With(Component(logger, "frontend"), "server", "fe0").Logf(apis.ERROR, "fourth")
+	assert.Equal(t, map[string]interface{}{"component": "frontend", "server": "fe0"}, recorder.Recent()[1].Fields)
+}
@@ -0,0 +1,94 @@
+package logging
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"zircon/lib/apis"
+)
+
+// A warning or error remembered by a Recorder.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+	// the fields that the logger it was logged through adds, such as its component
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Remembers the most recent warnings and errors logged through the loggers it wraps, so that a daemon can show them,
+// such as on its admin server, without anyone having to dig through its output.
+type Recorder struct {
+	mu sync.Mutex
+	// used as a ring, with 'next' as the oldest once it has filled up
+	records []Record
+	next    int
+	full    bool
+}
+
+// Makes a recorder that remembers up to 'capacity' messages, forgetting the oldest ones first.
+func NewRecorder(capacity int) *Recorder {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Recorder{records: make([]Record, capacity)}
+}
+
+// Returns a logger that passes every message on to 'base', and has this recorder remember those at WARN and above.
+func (r *Recorder) Wrap(base apis.Logger) apis.Logger {
+	return &recordingLogger{recorder: r, base: base}
+}
+
+// Returns the messages remembered, oldest first.
+func (r *Recorder) Recent() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]Record{}, r.records[:r.next]...)
+	}
+	return append(append([]Record{}, r.records[r.next:]...), r.records[:r.next]...)
+}
+
+func (r *Recorder) add(record Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records[r.next] = record
+	r.next++
+	if r.next == len(r.records) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+type recordingLogger struct {
+	recorder *Recorder
+	base     apis.Logger
+	// never modified once the logger is made, since loggers made by With share the start of it
+	fields []field
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+func (l *recordingLogger) Logf(level apis.LogLevel, format string, args ...interface{}) {
+	l.base.Logf(level, format, args...)
+	if level < apis.WARN {
+		return
+	}
+	record := Record{Time: time.Now(), Level: level.String(), Message: fmt.Sprintf(format, args...)}
+	if len(l.fields) > 0 {
+		record.Fields = map[string]interface{}{}
+		for _, f := range l.fields {
+			record.Fields[f.key] = f.value
+		}
+	}
+	l.recorder.add(record)
+}
+
+func (l *recordingLogger) With(key string, value interface{}) apis.Logger {
+	fields := append(l.fields[:len(l.fields):len(l.fields)], field{key: key, value: value})
+	return &recordingLogger{recorder: l.recorder, base: With(l.base, key, value), fields: fields}
+}
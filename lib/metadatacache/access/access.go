@@ -34,7 +34,7 @@ func ConstructAccess(etcd apis.EtcdInterface, cache rpc.ConnectionCache) (*Acces
 func (f *Access) New() (apis.MetadataID, error) {
 	num, err := f.updater.New(InitialReplicationFactor)
 	if err != nil {
-		return 0, fmt.Errorf("while constructing new metadata chunk: %v", err)
+		return 0, fmt.Errorf("while constructing new metadata chunk: %w", err)
 	}
 	return apis.MetadataID(num), nil
 }
@@ -52,11 +52,11 @@ func (f *Access) Read(chunk apis.MetadataID) ([]byte, apis.Version, error) {
 func (f *Access) Write(chunk apis.MetadataID, version apis.Version, offset uint32, data []byte) (apis.Version, error) {
 	ref, err := f.updater.ReadMeta(apis.ChunkNum(chunk))
 	if err != nil {
-		return 0, fmt.Errorf("[access.go/URM] %v", err)
+		return 0, fmt.Errorf("[access.go/URM] %w", err)
 	}
 	hash, err := ref.PrepareWrite(f.cache, offset, data)
 	if err != nil {
-		return 0, fmt.Errorf("[access.go/RPW] %v", err)
+		return 0, fmt.Errorf("[access.go/RPW] %w", err)
 	}
 	return f.updater.CommitWrite(apis.ChunkNum(chunk), ref.Version, hash)
 }
@@ -26,14 +26,14 @@ func (r *etcdMetadataUpdater) NewEntry() (apis.ChunkNum, error) {
 		}
 		owner, err := r.etcd.TryClaimingMetadata(i)
 		if err != nil {
-			return 0, fmt.Errorf("while scanning claims for NewEntry: %v", err)
+			return 0, fmt.Errorf("while scanning claims for NewEntry: %w", err)
 		}
 		if owner != r.etcd.GetName() {
 			continue // someone else has this, of course
 		}
 		data, err := r.etcd.GetMetametadata(i)
 		if err != nil {
-			return 0, fmt.Errorf("while scanning metametadata for NewEntry: %v", err)
+			return 0, fmt.Errorf("while scanning metametadata for NewEntry: %w", err)
 		}
 		if len(data.Replicas) == 0 && data.LastConsumedVersion == 0 && data.MostRecentVersion == 0 {
 			r.localAllocations[i] = true
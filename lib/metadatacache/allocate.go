@@ -0,0 +1,117 @@
+package metadatacache
+
+import (
+	"fmt"
+	"sort"
+	"zircon/apis"
+)
+
+// How a metadata cache chooses the chunk numbers that NewEntry hands out. Whichever is used, an entry is always marked
+// as allocated in its block before its number is handed out, and only while it was free, so a number is never handed
+// out while it is still live.
+type AllocationStrategy int
+
+const (
+	// Hands out reserved entries in increasing order within each block. Entries freed by DeleteEntry are only reused
+	// once a later reservation reaches them again.
+	MonotonicAllocation AllocationStrategy = iota
+	// Like MonotonicAllocation, but the entries that this cache frees through DeleteEntry are handed out again before
+	// any reserved entries, so that the live entries of a block stay packed together and deleted chunk numbers are
+	// reused right away.
+	FreeListAllocation
+	// Hands out each reservation in an order scrambled by a hash of the chunk numbers, so that chunks allocated one
+	// after another aren't numbered one after another.
+	HashedAllocation
+)
+
+func (s AllocationStrategy) String() string {
+	switch s {
+	case MonotonicAllocation:
+		return "monotonic"
+	case FreeListAllocation:
+		return "free-list"
+	case HashedAllocation:
+		return "hashed"
+	default:
+		return fmt.Sprintf("AllocationStrategy(%d)", int(s))
+	}
+}
+
+// Orders a fresh reservation according to the strategy.
+func (s AllocationStrategy) order(reserved []apis.ChunkNum) {
+	if s == HashedAllocation {
+		sort.Slice(reserved, func(i, j int) bool {
+			return scrambleChunkNum(reserved[i]) < scrambleChunkNum(reserved[j])
+		})
+	}
+}
+
+// A bijective mix of the bits of a chunk number (the finalizer of MurmurHash3), so that nearby numbers land far apart.
+func scrambleChunkNum(chunk apis.ChunkNum) uint64 {
+	x := uint64(chunk)
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb53fe63e9a85
+	x ^= x >> 33
+	return x
+}
+
+// Remembers an entry that was just freed, so that NewEntry can hand it out again. Must be called with mu held.
+func (mc *metadatacache) recycle(chunk apis.ChunkNum) {
+	if mc.strategy == FreeListAllocation {
+		mc.freed = append(mc.freed, chunk)
+	}
+}
+
+// Hands out the most recently freed entry that can still be claimed, if any. Entries that were allocated again by
+// someone else since they were freed, or whose blocks this cache no longer leases, are dropped. Must be called with mu
+// held.
+func (mc *metadatacache) reuseFreed() (apis.ChunkNum, bool) {
+	for len(mc.freed) > 0 {
+		chunk := mc.freed[len(mc.freed)-1]
+		mc.freed = mc.freed[:len(mc.freed)-1]
+		claimed, err := mc.claimEntry(chunk)
+		if err != nil {
+			mc.logger.Logf(apis.DEBUG, "could not reuse freed chunk number %d: %v", chunk, err)
+		} else if claimed {
+			return chunk, true
+		}
+	}
+	return 0, false
+}
+
+// Marks a single entry as allocated and clears out whatever its slot held, as long as it is currently free. Returns
+// false if it was already allocated.
+func (mc *metadatacache) claimEntry(chunk apis.ChunkNum) (bool, error) {
+	metachunk := ChunkToBlockID(chunk)
+	index := ChunkToEntryNumber(chunk)
+	for {
+		data, version, _, err := mc.leasing.Read(metachunk)
+		if err != nil {
+			return false, fmt.Errorf("[allocate.go/MLR] %w", err)
+		}
+		if getBitsetInData(data, index) {
+			return false, nil
+		}
+		offset, payload := claimInData(data, index)
+		nver, _, err := mc.journaledWrite(journalReserve, []apis.ChunkNum{chunk}, metachunk, version, offset, payload)
+		if err == nil {
+			return true, nil
+		} else if nver == 0 {
+			return false, fmt.Errorf("[allocate.go/MLW] %w", err)
+		}
+		// version mismatch; go around again
+	}
+}
+
+// Provides write parameters that mark a single entry as allocated and clear its slot: (offset, data). Like
+// reserveInData, this covers both the bitset and the entry, so that it can be applied as a single versioned write.
+func claimInData(data []byte, index uint32) (uint32, []byte) {
+	bitOffset, bit := updateBitsetInData(data, index, true)
+	entryOffset := EntryNumberToOffset(index)
+	payload := make([]byte, entryOffset+apis.EntrySize-bitOffset)
+	copy(payload, data[bitOffset:entryOffset])
+	copy(payload, bit)
+	return bitOffset, payload
+}
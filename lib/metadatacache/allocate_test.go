@@ -0,0 +1,138 @@
+package metadatacache
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"zircon/apis"
+	"zircon/chunkserver"
+	"zircon/etcd"
+	"zircon/rpc"
+)
+
+// Tests that claiming a single entry sets only its bit and clears only its slot.
+func TestClaimInData(t *testing.T) {
+	data := make([]byte, EntryNumberToOffset(1<<apis.EntriesPerBlock))
+	data[0] = 0x05
+	copy(data[EntryNumberToOffset(1):], []byte("tombstone"))
+	copy(data[EntryNumberToOffset(2):], []byte("live entry data"))
+
+	offset, payload := claimInData(data, 1)
+	copy(data[offset:], payload)
+
+	assert.Equal(t, byte(0x07), data[0])
+	assert.Equal(t, make([]byte, apis.EntrySize), data[EntryNumberToOffset(1):EntryNumberToOffset(2)])
+	assert.Equal(t, "live entry data", string(data[EntryNumberToOffset(2):EntryNumberToOffset(2)+15]))
+}
+
+// Tests that hashed allocation only reorders a reservation, scrambling its order, and that the others leave it alone.
+func TestHashedOrder(t *testing.T) {
+	var reserved []apis.ChunkNum
+	for i := 0; i < ReservationSize; i++ {
+		reserved = append(reserved, EntryAndBlockToChunkNum(3, uint32(i)))
+	}
+	ordered := append([]apis.ChunkNum(nil), reserved...)
+	HashedAllocation.order(ordered)
+	assert.ElementsMatch(t, reserved, ordered)
+	assert.NotEqual(t, reserved, ordered)
+
+	unchanged := append([]apis.ChunkNum(nil), reserved...)
+	MonotonicAllocation.order(unchanged)
+	FreeListAllocation.order(unchanged)
+	assert.Equal(t, reserved, unchanged)
+}
+
+func prepareAllocatingCache(t *testing.T, strategy AllocationStrategy) (CheckpointingCache, func()) {
+	etcds, teardown := etcd.PrepareSubscribeForTesting(t)
+	etcd1, teardown1 := etcds("mc1")
+	conn := rpc.NewConnectionCache()
+	cs, _, csT := chunkserver.NewTestChunkserver(t, conn)
+	csTeardown, address, err := rpc.PublishChunkserver(cs, ":0")
+	require.NoError(t, err)
+	require.NoError(t, etcd1.UpdateAddress(address, apis.CHUNKSERVER))
+
+	cache, err := NewCacheWithOptions(conn, etcd1, CacheOptions{Strategy: strategy})
+	require.NoError(t, err)
+	return cache, func() {
+		assert.NoError(t, cache.Close())
+		assert.NoError(t, csTeardown(true))
+		csT()
+		conn.CloseAll()
+		teardown1()
+		teardown()
+	}
+}
+
+// Tests that with free-list allocation, a deleted entry's number is handed out again, as a fresh entry rather than a
+// tombstone, and that monotonic allocation doesn't reuse it.
+func TestFreeListReuse(t *testing.T) {
+	for _, strategy := range []AllocationStrategy{MonotonicAllocation, FreeListAllocation} {
+		t.Run(strategy.String(), func(t *testing.T) {
+			cache, teardown := prepareAllocatingCache(t, strategy)
+			defer teardown()
+
+			chunk, err := cache.NewEntry()
+			require.NoError(t, err)
+			entry := apis.MetadataEntry{MostRecentVersion: 1, Replicas: []apis.ServerID{1}}
+			_, err = cache.UpdateEntry(chunk, apis.MetadataEntry{}, entry)
+			require.NoError(t, err)
+			_, err = cache.DeleteEntry(chunk, entry)
+			require.NoError(t, err)
+
+			next, err := cache.NewEntry()
+			require.NoError(t, err)
+			if strategy == FreeListAllocation {
+				assert.Equal(t, chunk, next)
+				reused, _, err := cache.ReadEntry(next)
+				assert.NoError(t, err)
+				assert.Equal(t, apis.MetadataEntry{}, reused)
+			} else {
+				assert.NotEqual(t, chunk, next)
+				_, _, err := cache.ReadEntry(chunk)
+				assert.True(t, errors.Is(err, apis.ErrChunkDeleted))
+			}
+		})
+	}
+}
+
+// Tests that allocating and deleting entries from many goroutines at once never hands out a number that is still live.
+func TestNoDoubleAllocation(t *testing.T) {
+	for _, strategy := range []AllocationStrategy{MonotonicAllocation, FreeListAllocation, HashedAllocation} {
+		t.Run(strategy.String(), func(t *testing.T) {
+			cache, teardown := prepareAllocatingCache(t, strategy)
+			defer teardown()
+
+			var mu sync.Mutex
+			live := map[apis.ChunkNum]bool{}
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < 40; i++ {
+						chunk, err := cache.NewEntry()
+						if !assert.NoError(t, err) {
+							return
+						}
+						mu.Lock()
+						assert.False(t, live[chunk], "chunk %d handed out while live", chunk)
+						live[chunk] = true
+						mu.Unlock()
+						if i%2 == 1 {
+							// give the number back before anyone else can be handed it
+							mu.Lock()
+							delete(live, chunk)
+							mu.Unlock()
+							_, err := cache.DeleteEntry(chunk, apis.MetadataEntry{})
+							assert.NoError(t, err, "deleting %d", chunk)
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+			assert.Equal(t, 8*20, len(live))
+		})
+	}
+}
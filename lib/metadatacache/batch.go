@@ -0,0 +1,31 @@
+package metadatacache
+
+import (
+	"fmt"
+	"zircon/apis"
+)
+
+// Batched requests are served one chunk at a time, just as they would be if they were sent separately; they only save
+// the round trips. Chunks in the same metadata block are served from the same loaded copy of it.
+
+func (mc *metadatacache) BatchReadEntry(chunks []apis.ChunkNum) ([]apis.EntryResult, error) {
+	if len(chunks) > apis.MaxBatchSize {
+		return nil, fmt.Errorf("batch of %d chunks is larger than the limit of %d", len(chunks), apis.MaxBatchSize)
+	}
+	results := make([]apis.EntryResult, len(chunks))
+	for i, chunk := range chunks {
+		results[i].Entry, results[i].Owner, results[i].Err = mc.ReadEntry(chunk)
+	}
+	return results, nil
+}
+
+func (mc *metadatacache) BatchUpdateEntry(updates []apis.EntryUpdate) ([]apis.EntryResult, error) {
+	if len(updates) > apis.MaxBatchSize {
+		return nil, fmt.Errorf("batch of %d updates is larger than the limit of %d", len(updates), apis.MaxBatchSize)
+	}
+	results := make([]apis.EntryResult, len(updates))
+	for i, update := range updates {
+		results[i].Owner, results[i].Err = mc.UpdateEntry(update.Chunk, update.Previous, update.Next)
+	}
+	return results, nil
+}
@@ -0,0 +1,75 @@
+package metadatacache
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"zircon/apis"
+	"zircon/chunkserver"
+	"zircon/etcd"
+	"zircon/rpc"
+)
+
+// Tests that each chunk in a batch succeeds or fails on its own.
+func TestBatches(t *testing.T) {
+	etcds, teardown := etcd.PrepareSubscribeForTesting(t)
+	defer teardown()
+	etcd1, teardown1 := etcds("mc1")
+	defer teardown1()
+
+	conn := rpc.NewConnectionCache()
+	defer conn.CloseAll()
+
+	cs, _, csT := chunkserver.NewTestChunkserver(t, conn)
+	defer csT()
+	csTeardown, address, err := rpc.PublishChunkserver(cs, ":0")
+	require.NoError(t, err)
+	defer csTeardown(true)
+	require.NoError(t, etcd1.UpdateAddress(address, apis.CHUNKSERVER))
+
+	cache, err := NewCache(conn, etcd1)
+	require.NoError(t, err)
+	defer cache.Close()
+
+	var chunks []apis.ChunkNum
+	var updates []apis.EntryUpdate
+	for i := 0; i < 5; i++ {
+		chunk, err := cache.NewEntry()
+		require.NoError(t, err)
+		chunks = append(chunks, chunk)
+		updates = append(updates, apis.EntryUpdate{
+			Chunk: chunk,
+			Next:  apis.MetadataEntry{MostRecentVersion: apis.Version(i + 1), Replicas: []apis.ServerID{apis.ServerID(i)}},
+		})
+	}
+	// expects the wrong previous entry
+	updates[3].Previous = apis.MetadataEntry{MostRecentVersion: 77}
+
+	results, err := cache.BatchUpdateEntry(updates)
+	require.NoError(t, err)
+	require.Equal(t, len(updates), len(results))
+	for i, result := range results {
+		if i == 3 {
+			assert.True(t, errors.Is(result.Err, apis.ErrVersionStale))
+		} else {
+			assert.NoError(t, result.Err)
+		}
+	}
+
+	// a chunk that was never allocated
+	missing := EntryAndBlockToChunkNum(ChunkToBlockID(chunks[0]), (1<<apis.EntriesPerBlock)-1)
+	results, err = cache.BatchReadEntry(append(chunks, missing))
+	require.NoError(t, err)
+	require.Equal(t, len(chunks)+1, len(results))
+	for i, update := range updates {
+		assert.NoError(t, results[i].Err)
+		if i != 3 {
+			assert.Equal(t, update.Next, results[i].Entry)
+		}
+	}
+	assert.Error(t, results[len(chunks)].Err)
+
+	_, err = cache.BatchReadEntry(make([]apis.ChunkNum, apis.MaxBatchSize+1))
+	assert.Error(t, err)
+}
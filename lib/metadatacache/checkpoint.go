@@ -0,0 +1,214 @@
+package metadatacache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"zircon/apis"
+)
+
+// A MetadataCache that can also save its state and later roll back to it, for recovering from a bad deploy.
+type CheckpointingCache interface {
+	apis.MetadataCache
+
+	// Writes a snapshot of every metadata block leased by this cache: which entries are allocated, and their contents.
+	// Each block is captured at a single point in time, and ongoing operations are only blocked while a block is
+	// copied.
+	Checkpoint(w io.Writer) error
+
+	// Overwrites the metadata blocks in a snapshot with their checkpointed state, claiming each one through etcd
+	// first. Entries allocated since the checkpoint are left as they are, so that their chunk numbers are never handed
+	// out again while they are still live. Fails with the owner's name if another server holds the lease on one of the
+	// blocks.
+	Restore(r io.Reader) error
+
+	// Hands the lease on a metadata block off to the metadata cache 'to', without failing any requests for it along the
+	// way; see handoff.go.
+	HandOff(block apis.MetadataID, to apis.ServerName) error
+
+	// Hands off every metadata block whose likely owner on the metadata ring is another cache.
+	Rebalance() error
+
+	// Leaves the metadata ring, and hands off every metadata block to the cache that is its likely owner without us.
+	// Should be called before Close when shutting down.
+	Drain() error
+
+	// Stops renewing the cache's leases. The cache must not be used afterwards.
+	Close() error
+}
+
+var checkpointMagic = []byte("ZMCC\x01")
+
+// A checkpointed metadata block. Entries are only stored for the chunks marked as allocated in the bitset, since
+// the rest of the block is meaningless.
+type blockSnapshot struct {
+	id      apis.MetadataID
+	bitset  []byte
+	entries map[uint32][]byte
+}
+
+func snapshotBlock(id apis.MetadataID, data []byte) blockSnapshot {
+	snapshot := blockSnapshot{
+		id:      id,
+		bitset:  make([]byte, apis.BitsetSize),
+		entries: map[uint32][]byte{},
+	}
+	copy(snapshot.bitset, data[:apis.BitsetSize])
+	for index := uint32(0); index < apis.BitsetSize*8; index++ {
+		if getBitsetInData(snapshot.bitset, index) {
+			offset := EntryNumberToOffset(index)
+			snapshot.entries[index] = append([]byte(nil), data[offset:offset+apis.EntrySize]...)
+		}
+	}
+	return snapshot
+}
+
+// Produces the data for a single write that returns a block to the snapshotted state.
+func (b blockSnapshot) contents() []byte {
+	return b.restoredOver(nil)
+}
+
+// Like contents, but starting from the 'current' contents of the block, so that the entries allocated in it since the
+// snapshot are kept, along with their place in the bitset.
+func (b blockSnapshot) restoredOver(current []byte) []byte {
+	data := make([]byte, EntryNumberToOffset(1<<apis.EntriesPerBlock))
+	copy(data, current)
+	for i, cell := range b.bitset {
+		data[i] |= cell
+	}
+	for index, entry := range b.entries {
+		copy(data[EntryNumberToOffset(index):], entry)
+	}
+	return data
+}
+
+func writeBlockSnapshot(w io.Writer, b blockSnapshot) error {
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint64(header, uint64(b.id))
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(b.entries)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(b.bitset); err != nil {
+		return err
+	}
+	for index := uint32(0); index < apis.BitsetSize*8; index++ {
+		entry, found := b.entries[index]
+		if !found {
+			continue
+		}
+		binindex := make([]byte, 4)
+		binary.LittleEndian.PutUint32(binindex, index)
+		if _, err := w.Write(binindex); err != nil {
+			return err
+		}
+		if _, err := w.Write(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns a snapshot with an ID of zero at the end of the stream.
+func readBlockSnapshot(r io.Reader) (blockSnapshot, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return blockSnapshot{}, err
+	}
+	b := blockSnapshot{
+		id:      apis.MetadataID(binary.LittleEndian.Uint64(header)),
+		bitset:  make([]byte, apis.BitsetSize),
+		entries: map[uint32][]byte{},
+	}
+	if b.id == 0 {
+		return b, nil
+	}
+	if _, err := io.ReadFull(r, b.bitset); err != nil {
+		return blockSnapshot{}, err
+	}
+	count := binary.LittleEndian.Uint32(header[8:])
+	for i := uint32(0); i < count; i++ {
+		record := make([]byte, 4+apis.EntrySize)
+		if _, err := io.ReadFull(r, record); err != nil {
+			return blockSnapshot{}, err
+		}
+		index := binary.LittleEndian.Uint32(record)
+		if index >= apis.BitsetSize*8 || !getBitsetInData(b.bitset, index) {
+			return blockSnapshot{}, fmt.Errorf("invalid entry %d in checkpoint of block %d", index, b.id)
+		}
+		b.entries[index] = record[4:]
+	}
+	return b, nil
+}
+
+func (mc *metadatacache) Checkpoint(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(checkpointMagic); err != nil {
+		return err
+	}
+	leases, err := mc.leasing.ListLeases()
+	if err != nil {
+		return fmt.Errorf("[checkpoint.go/MLL] %w", err)
+	}
+	for _, metachunk := range leases {
+		// the contents returned by Read are never modified in place, so this is a consistent view of the block
+		data, _, _, err := mc.leasing.Read(metachunk)
+		if err != nil {
+			return fmt.Errorf("[checkpoint.go/MLR] %w", err)
+		}
+		if err := writeBlockSnapshot(bw, snapshotBlock(metachunk, data)); err != nil {
+			return err
+		}
+	}
+	// terminate with an empty block ID
+	if err := writeBlockSnapshot(bw, blockSnapshot{}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (mc *metadatacache) Restore(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(checkpointMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return err
+	}
+	if !bytes.Equal(magic, checkpointMagic) {
+		return errors.New("not a metadata cache checkpoint")
+	}
+
+	// hold off on allocations until the restore is done. Our reservation stays allocated, since nothing allocated is
+	// freed by a restore, but entries in it that the checkpoint held are overwritten, and dropped by NewEntry.
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	for {
+		b, err := readBlockSnapshot(br)
+		if err != nil {
+			return err
+		}
+		if b.id == 0 {
+			return nil
+		}
+		for {
+			// reading the block claims it through etcd, if nobody else holds it
+			current, version, owner, err := mc.leasing.Read(b.id)
+			if err != nil {
+				if owner != apis.NoRedirect {
+					return fmt.Errorf("cannot restore block %d: %w", b.id, err)
+				}
+				return fmt.Errorf("[checkpoint.go/MLR] %w", err)
+			}
+			nver, _, err := mc.journaledWrite(journalRestore, nil, b.id, version, 0, b.restoredOver(current))
+			if err == nil {
+				break
+			} else if nver == 0 {
+				return fmt.Errorf("[checkpoint.go/MLW] %w", err)
+			}
+			// version mismatch; go around again
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package metadatacache
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"zircon/apis"
+	"zircon/chunkserver"
+	"zircon/etcd"
+	"zircon/rpc"
+)
+
+// Tests that block snapshots survive serialization, and that only allocated entries are kept.
+func TestBlockSnapshotRoundTrip(t *testing.T) {
+	data := make([]byte, EntryNumberToOffset(1<<apis.EntriesPerBlock))
+	for _, index := range []uint32{0, 9, 32767} {
+		data[index/8] |= 1 << (index % 8)
+		copy(data[EntryNumberToOffset(index):], []byte{byte(index), 1, 2, 3})
+	}
+	copy(data[EntryNumberToOffset(10):], []byte("unallocated garbage"))
+
+	var buf bytes.Buffer
+	require.NoError(t, writeBlockSnapshot(&buf, snapshotBlock(7, data)))
+	require.NoError(t, writeBlockSnapshot(&buf, blockSnapshot{}))
+
+	b, err := readBlockSnapshot(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, apis.MetadataID(7), b.id)
+	assert.Equal(t, 3, len(b.entries))
+
+	restored := b.contents()
+	assert.Equal(t, data[:EntryNumberToOffset(10)], restored[:EntryNumberToOffset(10)])
+	assert.Equal(t, make([]byte, apis.EntrySize), restored[EntryNumberToOffset(10):EntryNumberToOffset(11)])
+	assert.Equal(t, data[EntryNumberToOffset(32767):], restored[EntryNumberToOffset(32767):])
+
+	end, err := readBlockSnapshot(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, apis.MetadataID(0), end.id)
+}
+
+// Tests checkpointing while other operations are in progress, then mutating the cache, restoring, and verifying
+// that the restored view matches the checkpoint, without losing the entries allocated since or issuing them again.
+func TestCheckpointRestore(t *testing.T) {
+	etcds, teardown := etcd.PrepareSubscribeForTesting(t)
+	defer teardown()
+	etcd1, teardown1 := etcds("mc1")
+	defer teardown1()
+
+	conn := rpc.NewConnectionCache()
+	defer conn.CloseAll()
+
+	cs, _, csT := chunkserver.NewTestChunkserver(t, conn)
+	defer csT()
+	csTeardown, address, err := rpc.PublishChunkserver(cs, ":0")
+	require.NoError(t, err)
+	defer csTeardown(true)
+	require.NoError(t, etcd1.UpdateAddress(address, apis.CHUNKSERVER))
+
+	cache, err := NewCache(conn, etcd1)
+	require.NoError(t, err)
+
+	entries := map[apis.ChunkNum]apis.MetadataEntry{}
+	for i := 0; i < 10; i++ {
+		chunk, err := cache.NewEntry()
+		require.NoError(t, err)
+		entry := apis.MetadataEntry{MostRecentVersion: apis.Version(i + 1), Replicas: []apis.ServerID{apis.ServerID(i)}}
+		_, err = cache.UpdateEntry(chunk, apis.MetadataEntry{}, entry)
+		require.NoError(t, err)
+		entries[chunk] = entry
+	}
+
+	issued := map[apis.ChunkNum]bool{}
+	for chunk := range entries {
+		issued[chunk] = true
+	}
+
+	// keep allocating in the background while the checkpoint is taken
+	var wg sync.WaitGroup
+	wg.Add(1)
+	background := make([]apis.ChunkNum, 20)
+	go func() {
+		defer wg.Done()
+		for i := range background {
+			var err error
+			background[i], err = cache.NewEntry()
+			assert.NoError(t, err)
+		}
+	}()
+	var checkpoint bytes.Buffer
+	require.NoError(t, cache.Checkpoint(&checkpoint))
+	wg.Wait()
+	for _, chunk := range background {
+		issued[chunk] = true
+	}
+
+	// mutate everything we know about
+	for chunk, entry := range entries {
+		_, err := cache.DeleteEntry(chunk, entry)
+		require.NoError(t, err)
+	}
+	// and allocate more, past everything the checkpoint knows about
+	later := map[apis.ChunkNum]apis.MetadataEntry{}
+	for i := 0; i < ReservationSize; i++ {
+		chunk, err := cache.NewEntry()
+		require.NoError(t, err)
+		entry := apis.MetadataEntry{MostRecentVersion: 1, Replicas: []apis.ServerID{apis.ServerID(i)}}
+		_, err = cache.UpdateEntry(chunk, apis.MetadataEntry{}, entry)
+		require.NoError(t, err)
+		later[chunk] = entry
+		issued[chunk] = true
+	}
+
+	require.NoError(t, cache.Restore(bytes.NewReader(checkpoint.Bytes())))
+
+	for chunk, entry := range entries {
+		restored, owner, err := cache.ReadEntry(chunk)
+		assert.NoError(t, err)
+		assert.Equal(t, apis.NoRedirect, owner)
+		assert.Equal(t, entry, restored)
+	}
+
+	// entries allocated after the checkpoint are kept
+	for chunk, entry := range later {
+		kept, _, err := cache.ReadEntry(chunk)
+		assert.NoError(t, err)
+		assert.Equal(t, entry, kept)
+	}
+
+	// allocations after a restore must not collide with restored entries, or with those allocated since
+	for i := 0; i < 2*ReservationSize; i++ {
+		chunk, err := cache.NewEntry()
+		require.NoError(t, err)
+		assert.False(t, issued[chunk], "chunk %d issued twice", chunk)
+		issued[chunk] = true
+	}
+}
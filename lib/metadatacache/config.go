@@ -0,0 +1,17 @@
+package metadatacache
+
+import (
+	"zircon/apis"
+	"zircon/rpc"
+)
+
+// The metadata cache section of a metadata cache's configuration, such as config-example/mdc.yaml.
+type Configuration struct {
+	// Where the cache keeps its journal; see journal.go. Empty keeps no journal.
+	JournalPath string `yaml:"journal-path"`
+}
+
+// Constructs a metadata cache the way its configuration asks for.
+func ConfigureCache(connCache rpc.ConnectionCache, etcd apis.EtcdInterface, logger apis.Logger, config Configuration) (CheckpointingCache, error) {
+	return NewCacheWithOptions(connCache, etcd, CacheOptions{Logger: logger, JournalPath: config.JournalPath})
+}
@@ -0,0 +1,104 @@
+package metadatacache
+
+import (
+	"fmt"
+	"zircon/apis"
+)
+
+// Explanation of handoffs:
+//     A metadata cache that is shutting down, or that holds blocks which the metadata ring says belong to another
+//     cache, can hand its leases off, rather than dropping them. Left to expire, a lease would leave clients redirected
+//     to a cache that no longer serves the block until it runs out, after which whoever asks first claims the block.
+//     A handoff goes like this:
+//      - prepare: the cache that holds the block starts holding back new requests for it.
+//      - flush: writes to the block that are already in progress are waited for. Since writes go straight through to
+//        the chunkservers, the block is then up to date there.
+//      - transfer: the holder asks the new owner, through AcceptHandoff, to take over the claim on the block in etcd,
+//        which only succeeds if the holder still has it, and to load the block.
+//      - ack: once the new owner says it has the block, the holder drops it, and the requests it held back are
+//        redirected to the new owner, which is ready for them.
+//     If the transfer fails, the holder drops the block anyway, and loads it again when next asked, unless etcd shows
+//     that the other cache has it after all.
+
+func (mc *metadatacache) AcceptHandoff(block apis.MetadataID, from apis.ServerName) error {
+	if err := mc.leasing.Accept(block, from); err != nil {
+		return fmt.Errorf("[handoff.go/LAC] %w", err)
+	}
+	mc.logger.Logf(apis.DEBUG, "took over metadata block %d from %s", block, from)
+	return nil
+}
+
+func (mc *metadatacache) HandOff(block apis.MetadataID, to apis.ServerName) error {
+	if to == mc.etcd.GetName() {
+		return fmt.Errorf("cannot hand off metadata block %d to ourselves", block)
+	}
+	address, err := mc.etcd.GetAddress(to, apis.METADATACACHE)
+	if err != nil {
+		return fmt.Errorf("[handoff.go/GAD] %w", err)
+	}
+	peer, err := mc.conns.SubscribeMetadataCache(address)
+	if err != nil {
+		return fmt.Errorf("[handoff.go/SMC] %w", err)
+	}
+	err = mc.leasing.HandOff(block, func() error {
+		return peer.AcceptHandoff(block, mc.etcd.GetName())
+	})
+	if err != nil {
+		return fmt.Errorf("[handoff.go/LHO] %w", err)
+	}
+	mc.logger.Logf(apis.DEBUG, "handed off metadata block %d to %s", block, to)
+	return nil
+}
+
+func (mc *metadatacache) Rebalance() error {
+	members, err := mc.etcd.ListMetadataRing()
+	if err != nil {
+		return fmt.Errorf("[handoff.go/LMR] %w", err)
+	}
+	return mc.handOffBy(apis.NewMetadataRing(members))
+}
+
+func (mc *metadatacache) Drain() error {
+	if err := mc.etcd.LeaveMetadataRing(); err != nil {
+		return fmt.Errorf("[handoff.go/LVR] %w", err)
+	}
+	members, err := mc.etcd.ListMetadataRing()
+	if err != nil {
+		return fmt.Errorf("[handoff.go/LMR] %w", err)
+	}
+	// we may have listed ourselves if another request put us back in the ring in the meantime
+	var others []apis.ServerName
+	for _, member := range members {
+		if member != mc.etcd.GetName() {
+			others = append(others, member)
+		}
+	}
+	if len(others) == 0 {
+		// nobody to hand anything off to; our leases simply expire once we're closed
+		return nil
+	}
+	return mc.handOffBy(apis.NewMetadataRing(others))
+}
+
+// Hands off every block we hold whose likely owner on 'ring' is another cache. Carries on past blocks that cannot be
+// handed off, and reports the first error afterwards.
+func (mc *metadatacache) handOffBy(ring *apis.MetadataRing) error {
+	blocks, err := mc.leasing.ListLeases()
+	if err != nil {
+		return fmt.Errorf("[handoff.go/LLS] %w", err)
+	}
+	var first error
+	for _, block := range blocks {
+		owner := ring.BlockOwner(block)
+		if owner == apis.NoRedirect || owner == mc.etcd.GetName() {
+			continue
+		}
+		if err := mc.HandOff(block, owner); err != nil {
+			mc.logger.Logf(apis.WARN, "could not hand off metadata block %d to %s: %v", block, owner, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
@@ -0,0 +1,108 @@
+package metadatacache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"zircon/apis"
+	"zircon/chunkserver"
+	"zircon/etcd"
+	"zircon/rpc"
+)
+
+// Tests handing a block off between two caches while requests for it keep coming, and then draining a cache.
+func TestHandOff(t *testing.T) {
+	etcds, teardown := etcd.PrepareSubscribeForTesting(t)
+	defer teardown()
+	etcd1, teardown1 := etcds("mc1")
+	defer teardown1()
+	etcd2, teardown2 := etcds("mc2")
+	defer teardown2()
+
+	conn := rpc.NewConnectionCache()
+	defer conn.CloseAll()
+
+	cs, _, csT := chunkserver.NewTestChunkserver(t, conn)
+	defer csT()
+	csTeardown, address, err := rpc.PublishChunkserver(cs, ":0")
+	require.NoError(t, err)
+	defer csTeardown(true)
+	require.NoError(t, etcd1.UpdateAddress(address, apis.CHUNKSERVER))
+
+	cache1, err := NewCache(conn, etcd1)
+	require.NoError(t, err)
+	defer cache1.Close()
+	cache2, err := NewCache(conn, etcd2)
+	require.NoError(t, err)
+	defer cache2.Close()
+	for _, c := range []struct {
+		cache CheckpointingCache
+		etcd  apis.EtcdInterface
+	}{{cache1, etcd1}, {cache2, etcd2}} {
+		mcTeardown, mcAddress, err := rpc.PublishMetadataCache(c.cache, ":0")
+		require.NoError(t, err)
+		defer mcTeardown(true)
+		require.NoError(t, c.etcd.UpdateAddress(mcAddress, apis.METADATACACHE))
+	}
+
+	chunk, err := cache1.NewEntry()
+	require.NoError(t, err)
+	entry := apis.MetadataEntry{MostRecentVersion: 1, Replicas: []apis.ServerID{1}}
+	_, err = cache1.UpdateEntry(chunk, apis.MetadataEntry{}, entry)
+	require.NoError(t, err)
+
+	// keep updating the entry through whichever cache owns it while it changes hands
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var cache apis.MetadataCache = cache1
+		for i := 2; i < 40; i++ {
+			next := apis.MetadataEntry{MostRecentVersion: apis.Version(i), Replicas: []apis.ServerID{1}}
+			owner, err := cache.UpdateEntry(chunk, entry, next)
+			if owner == etcd2.GetName() {
+				cache = cache2
+				owner, err = cache.UpdateEntry(chunk, entry, next)
+			}
+			assert.Equal(t, apis.NoRedirect, owner)
+			if assert.NoError(t, err) {
+				entry = next
+			}
+		}
+	}()
+	require.NoError(t, cache1.HandOff(ChunkToBlockID(chunk), etcd2.GetName()))
+	wg.Wait()
+
+	read, owner, err := cache2.ReadEntry(chunk)
+	assert.NoError(t, err)
+	assert.Equal(t, apis.NoRedirect, owner)
+	assert.Equal(t, entry, read)
+	_, owner, err = cache1.ReadEntry(chunk)
+	assert.Error(t, err)
+	assert.Equal(t, etcd2.GetName(), owner)
+
+	// not ours to hand off anymore
+	assert.Error(t, cache1.HandOff(ChunkToBlockID(chunk), etcd2.GetName()))
+
+	stats, err := cache1.Stats()
+	assert.NoError(t, err)
+	assert.True(t, stats.Hits > 0)
+	assert.True(t, stats.Redirects > 0)
+	assert.Equal(t, uint64(0), stats.LeaseExpirations)
+	stats, err = cache2.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.OwnedBlocks)
+	// including the rest of the entries that cache1 reserved along with ours
+	assert.True(t, stats.OwnedEntries >= 1)
+
+	// draining cache2 leaves cache1 as the only member of the ring, so everything goes back to it
+	require.NoError(t, cache2.Drain())
+	read, owner, err = cache1.ReadEntry(chunk)
+	assert.NoError(t, err)
+	assert.Equal(t, apis.NoRedirect, owner)
+	assert.Equal(t, entry, read)
+	members, err := etcd1.ListMetadataRing()
+	assert.NoError(t, err)
+	assert.Equal(t, []apis.ServerName{etcd1.GetName()}, members)
+}
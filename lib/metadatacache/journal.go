@@ -0,0 +1,459 @@
+package metadatacache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"zircon/apis"
+	"zircon/util"
+)
+
+// Explanation of the journal:
+//     A metadata cache can keep a journal: a local file in which it notes each change it is about to make to a metadata
+//     block, and then whether the change went through, along with which entries it has reserved and which of those it
+//     has handed out. A cache that crashes in the middle of a change leaves the change behind in the journal with no
+//     outcome, and the client that asked for it may or may not have been told. Entries that were reserved, but not yet
+//     handed out, are also left marked as allocated, where nothing would otherwise ever hand them out again.
+//     When the cache starts up again with the same journal, it recovers before it serves anything. For each change that
+//     has no outcome, it claims the block again, and compares it against the change: if the block is still at the
+//     version the change was based on, the change never landed, and it is rolled back by being forgotten, so that a
+//     client retrying it will find everything as it was; if the block holds what the change wrote, the change is
+//     rolled forward, as if it had been reported as finished. Anything else means another cache changed the block in
+//     the meantime, so the change is only logged. After that, every reserved entry that was never handed out is handed
+//     out again, as long as its block is still this cache's, and the entry is still allocated and empty. Nobody else can
+//     have handed those out, since they were marked as allocated all along.
+//     Once recovered, the journal is started over, holding only the reservation that is still to be handed out, and so
+//     it is again whenever it grows past journalCompaction records. A cache that is closed releases whatever it still
+//     has reserved, and notes that in the journal, so that nothing is left to hand out when it starts up again.
+//     Each record is checksummed, so that one cut short by a crash is recognized and ignored. Records are appended
+//     without being synced, so the journal outlives the process, but not necessarily the machine it runs on.
+
+// How many records the journal holds before it is started over with only what is still outstanding.
+const journalCompaction = 4096
+
+type journalKind uint8
+
+const (
+	// The beginnings of changes to a metadata block.
+	journalUpdate journalKind = iota + 1
+	journalDelete
+	journalReserve
+	// The outcomes of changes.
+	journalCommit
+	journalAbort
+	// An entry handed out from a reservation.
+	journalIssue
+	// The beginning of a change that frees reserved entries that were never handed out.
+	journalRelease
+	// The beginning of a change that returns a block to its checkpointed state.
+	journalRestore
+)
+
+func (k journalKind) String() string {
+	switch k {
+	case journalUpdate:
+		return "update"
+	case journalDelete:
+		return "delete"
+	case journalReserve:
+		return "reservation"
+	case journalCommit:
+		return "commit"
+	case journalAbort:
+		return "abort"
+	case journalIssue:
+		return "issue"
+	case journalRelease:
+		return "release"
+	case journalRestore:
+		return "restore"
+	default:
+		return fmt.Sprintf("journalKind(%d)", uint8(k))
+	}
+}
+
+// A single record in the journal. A change is identified by its ID, and is to write 'payload' at 'offset' in 'block',
+// if the block is still at 'version'. The chunks are the entries that the change reserves or deletes. An outcome only
+// has the ID of its change, and for a commit, the version the block was left at. An issue only has its chunk.
+type journalRecord struct {
+	kind    journalKind
+	id      uint64
+	block   apis.MetadataID
+	version apis.Version
+	offset  uint32
+	chunks  []apis.ChunkNum
+	payload []byte
+}
+
+const journalHeaderSize = 1 + 8 + 8 + 8 + 4 + 4 + 4
+
+func (r journalRecord) encode() []byte {
+	data := make([]byte, journalHeaderSize+8*len(r.chunks)+len(r.payload)+4)
+	data[0] = byte(r.kind)
+	binary.LittleEndian.PutUint64(data[1:], r.id)
+	binary.LittleEndian.PutUint64(data[9:], uint64(r.block))
+	binary.LittleEndian.PutUint64(data[17:], uint64(r.version))
+	binary.LittleEndian.PutUint32(data[25:], r.offset)
+	binary.LittleEndian.PutUint32(data[29:], uint32(len(r.chunks)))
+	binary.LittleEndian.PutUint32(data[33:], uint32(len(r.payload)))
+	for i, chunk := range r.chunks {
+		binary.LittleEndian.PutUint64(data[journalHeaderSize+8*i:], uint64(chunk))
+	}
+	copy(data[journalHeaderSize+8*len(r.chunks):], r.payload)
+	end := len(data) - 4
+	binary.LittleEndian.PutUint32(data[end:], crc32.ChecksumIEEE(data[:end]))
+	return data
+}
+
+// Reads the next record. Returns io.EOF at the end of the journal, including where the last record was cut short.
+func readJournalRecord(r *bufio.Reader) (journalRecord, error) {
+	header := make([]byte, journalHeaderSize)
+	if _, err := io.ReadFull(r, header); err == io.ErrUnexpectedEOF {
+		return journalRecord{}, io.EOF
+	} else if err != nil {
+		return journalRecord{}, err
+	}
+	chunks := binary.LittleEndian.Uint32(header[29:])
+	payload := binary.LittleEndian.Uint32(header[33:])
+	if chunks > apis.BitsetSize*8 || payload > apis.MaxChunkSize {
+		return journalRecord{}, errors.New("corrupt record in metadata journal")
+	}
+	rest := make([]byte, 8*int(chunks)+int(payload)+4)
+	if _, err := io.ReadFull(r, rest); err == io.ErrUnexpectedEOF || err == io.EOF {
+		return journalRecord{}, io.EOF
+	} else if err != nil {
+		return journalRecord{}, err
+	}
+	end := len(rest) - 4
+	checksum := crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, rest[:end])
+	if checksum != binary.LittleEndian.Uint32(rest[end:]) {
+		if _, err := r.Peek(1); err == io.EOF {
+			// only partly written when the cache stopped
+			return journalRecord{}, io.EOF
+		}
+		return journalRecord{}, errors.New("corrupt record in metadata journal")
+	}
+	record := journalRecord{
+		kind:    journalKind(header[0]),
+		id:      binary.LittleEndian.Uint64(header[1:]),
+		block:   apis.MetadataID(binary.LittleEndian.Uint64(header[9:])),
+		version: apis.Version(binary.LittleEndian.Uint64(header[17:])),
+		offset:  binary.LittleEndian.Uint32(header[25:]),
+		payload: rest[8*chunks : end],
+	}
+	for i := uint32(0); i < chunks; i++ {
+		record.chunks = append(record.chunks, apis.ChunkNum(binary.LittleEndian.Uint64(rest[8*i:])))
+	}
+	return record, nil
+}
+
+// What a journal shows about the cache that kept it.
+type journalState struct {
+	// the changes that were begun, but have no outcome, in the order they were begun
+	pending []journalRecord
+	// the entries that were reserved by changes that were committed, but never handed out
+	reserved []apis.ChunkNum
+	// the ID after the last one used
+	nextID uint64
+}
+
+func replayJournal(r io.Reader) (journalState, error) {
+	br := bufio.NewReader(r)
+	var order []uint64
+	begun := map[uint64]journalRecord{}
+	var reserved []apis.ChunkNum
+	issued := map[apis.ChunkNum]bool{}
+	state := journalState{nextID: 1}
+	for {
+		record, err := readJournalRecord(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return journalState{}, err
+		}
+		if record.id >= state.nextID {
+			state.nextID = record.id + 1
+		}
+		switch record.kind {
+		case journalUpdate, journalDelete, journalReserve, journalRelease, journalRestore:
+			begun[record.id] = record
+			order = append(order, record.id)
+		case journalCommit:
+			if change, found := begun[record.id]; found && change.kind == journalReserve {
+				for _, chunk := range change.chunks {
+					reserved = append(reserved, chunk)
+					delete(issued, chunk)
+				}
+			} else if found && change.kind == journalRelease {
+				// no longer outstanding, the same as if they had been handed out
+				for _, chunk := range change.chunks {
+					issued[chunk] = true
+				}
+			}
+			delete(begun, record.id)
+		case journalAbort:
+			delete(begun, record.id)
+		case journalIssue:
+			for _, chunk := range record.chunks {
+				issued[chunk] = true
+			}
+		default:
+			return journalState{}, fmt.Errorf("unknown record kind %d in metadata journal", record.kind)
+		}
+	}
+	for _, id := range order {
+		if change, found := begun[id]; found {
+			state.pending = append(state.pending, change)
+		}
+	}
+	for _, chunk := range reserved {
+		if !issued[chunk] {
+			state.reserved = append(state.reserved, chunk)
+			// an entry can be reserved again after being handed out and deleted, but is only outstanding once
+			issued[chunk] = true
+		}
+	}
+	return state, nil
+}
+
+// Reads the journal at 'path', which is empty if there isn't one yet.
+func readJournal(path string) (journalState, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return journalState{nextID: 1}, nil
+	} else if err != nil {
+		return journalState{}, err
+	}
+	defer file.Close()
+	return replayJournal(file)
+}
+
+type journal struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	nextID  uint64
+	records int
+	// the changes that were begun, and have no outcome yet
+	pending map[uint64]journalRecord
+}
+
+// Starts the journal at 'path' over, holding only 'reserved' as a reservation that is still to be handed out.
+func openJournal(path string, nextID uint64, reserved []apis.ChunkNum) (*journal, error) {
+	j := &journal{
+		path:    path,
+		nextID:  nextID,
+		pending: map[uint64]journalRecord{},
+	}
+	if err := j.compact(reserved); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Must be called with mu held.
+func (j *journal) append(record journalRecord) error {
+	if _, err := j.file.Write(record.encode()); err != nil {
+		return err
+	}
+	j.records++
+	return nil
+}
+
+// Notes a change that is about to be made, and returns its ID.
+func (j *journal) begin(change journalRecord) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	change.id = j.nextID
+	j.nextID++
+	if err := j.append(change); err != nil {
+		return 0, err
+	}
+	j.pending[change.id] = change
+	return change.id, nil
+}
+
+// Notes that a change went through, leaving the block at 'version', or, if 'version' is zero, that it didn't.
+func (j *journal) finish(id uint64, version apis.Version) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	outcome := journalRecord{kind: journalCommit, id: id, version: version}
+	if version == 0 {
+		outcome.kind = journalAbort
+	}
+	if err := j.append(outcome); err != nil {
+		return err
+	}
+	delete(j.pending, id)
+	return nil
+}
+
+// Notes that an entry was handed out from a reservation.
+func (j *journal) issue(chunk apis.ChunkNum) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.append(journalRecord{kind: journalIssue, chunks: []apis.ChunkNum{chunk}})
+}
+
+// Reports whether the journal has grown enough to be started over.
+func (j *journal) full() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.records >= journalCompaction
+}
+
+// Starts the journal over, holding only the changes that have no outcome yet, and 'reserved' as a reservation that is
+// still to be handed out. The new journal replaces the old one in a single rename, so that a crash leaves one or the
+// other.
+func (j *journal) compact(reserved []apis.ChunkNum) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var buf bytes.Buffer
+	records := 0
+	if len(reserved) > 0 {
+		id := j.nextID
+		j.nextID++
+		buf.Write(journalRecord{kind: journalReserve, id: id, chunks: reserved}.encode())
+		buf.Write(journalRecord{kind: journalCommit, id: id}.encode())
+		records += 2
+	}
+	var ids []uint64
+	for id := range j.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		return ids[a] < ids[b]
+	})
+	for _, id := range ids {
+		buf.Write(j.pending[id].encode())
+		records++
+	}
+	temp := j.path + ".tmp"
+	if err := writeSynced(temp, buf.Bytes()); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, j.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if j.file != nil {
+		_ = j.file.Close()
+	}
+	j.file = file
+	j.records = records
+	return nil
+}
+
+func writeSynced(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// Writes to a metadata block like Leasing.Write, noting the change in the journal first, if there is one, and its
+// outcome afterwards. A change whose outcome isn't known, because the write failed for some reason other than the
+// version, stays in the journal without one, so that it is resolved if the cache restarts.
+func (mc *metadatacache) journaledWrite(kind journalKind, chunks []apis.ChunkNum, metachunk apis.MetadataID,
+	version apis.Version, offset uint32, data []byte) (apis.Version, apis.ServerName, error) {
+	if mc.journal == nil {
+		return mc.leasing.Write(metachunk, version, offset, data)
+	}
+	id, err := mc.journal.begin(journalRecord{
+		kind:    kind,
+		block:   metachunk,
+		version: version,
+		offset:  offset,
+		chunks:  chunks,
+		payload: data,
+	})
+	if err != nil {
+		return 0, apis.NoRedirect, fmt.Errorf("[journal.go/JNB] %w", err)
+	}
+	nver, owner, err := mc.leasing.Write(metachunk, version, offset, data)
+	if err == nil {
+		if jerr := mc.journal.finish(id, nver); jerr != nil {
+			// the change itself went through, and would be rolled forward after a restart anyway
+			mc.logger.Logf(apis.ERROR, "could not journal the outcome of a change to block %d: %v", metachunk, jerr)
+		}
+	} else if nver != 0 {
+		if jerr := mc.journal.finish(id, 0); jerr != nil {
+			mc.logger.Logf(apis.ERROR, "could not journal the outcome of a change to block %d: %v", metachunk, jerr)
+		}
+	}
+	return nver, owner, err
+}
+
+// Resolves the changes that a journal shows were interrupted, and returns the reserved entries that can still be
+// handed out.
+func (mc *metadatacache) recoverJournal(state journalState) ([]apis.ChunkNum, error) {
+	reserved := state.reserved
+	for _, change := range state.pending {
+		data, version, owner, err := mc.leasing.Read(change.block)
+		if err != nil {
+			if owner == apis.NoRedirect {
+				return nil, fmt.Errorf("[journal.go/MLR] %w", err)
+			}
+			mc.logger.Logf(apis.WARN, "interrupted %s of block %d left alone, since %s now owns the block",
+				change.kind, change.block, owner)
+			continue
+		}
+		end := int(change.offset) + len(change.payload)
+		switch {
+		case version == change.version:
+			mc.logger.Logf(apis.INFO, "rolling back interrupted %s of block %d", change.kind, change.block)
+		case end <= len(data) && bytes.Equal(data[change.offset:end], change.payload):
+			mc.logger.Logf(apis.INFO, "rolling forward interrupted %s of block %d", change.kind, change.block)
+			if change.kind == journalReserve {
+				reserved = append(reserved, change.chunks...)
+			}
+		default:
+			mc.logger.Logf(apis.WARN, "interrupted %s of block %d cannot be resolved, since the block has changed since",
+				change.kind, change.block)
+		}
+	}
+	var usable []apis.ChunkNum
+	for _, chunk := range reserved {
+		data, _, owner, err := mc.leasing.Read(ChunkToBlockID(chunk))
+		if err != nil {
+			if owner == apis.NoRedirect {
+				return nil, fmt.Errorf("[journal.go/MLR] %w", err)
+			}
+			continue
+		}
+		index := ChunkToEntryNumber(chunk)
+		offset := EntryNumberToOffset(index)
+		if getBitsetInData(data, index) && len(util.StripTrailingZeroes(data[offset:offset+apis.EntrySize])) == 0 {
+			usable = append(usable, chunk)
+		}
+	}
+	if len(usable) < len(reserved) {
+		mc.logger.Logf(apis.INFO, "%d reserved entries can no longer be handed out", len(reserved)-len(usable))
+	}
+	return usable, nil
+}
@@ -0,0 +1,177 @@
+package metadatacache
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"zircon/apis"
+	"zircon/chunkserver"
+	"zircon/etcd"
+	"zircon/rpc"
+	"zircon/util"
+)
+
+// Tests that journal records survive being written and read back, and that a record cut short ends the journal.
+func TestJournalRecordRoundTrip(t *testing.T) {
+	records := []journalRecord{
+		{kind: journalReserve, id: 1, block: 3, version: 7, offset: 12, chunks: []apis.ChunkNum{5, 6}, payload: []byte{1, 2}},
+		{kind: journalCommit, id: 1, version: 8},
+		{kind: journalUpdate, id: 2, block: 3, version: 8, offset: 4096, chunks: []apis.ChunkNum{5}, payload: []byte("entry")},
+	}
+	var buf bytes.Buffer
+	for _, record := range records {
+		buf.Write(record.encode())
+	}
+	torn := buf.Bytes()[:buf.Len()-3]
+
+	state, err := replayJournal(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, []journalRecord{records[2]}, state.pending)
+	assert.Equal(t, []apis.ChunkNum{5, 6}, state.reserved)
+	assert.Equal(t, uint64(3), state.nextID)
+
+	state, err = replayJournal(bytes.NewReader(torn))
+	require.NoError(t, err)
+	assert.Empty(t, state.pending)
+	assert.Equal(t, []apis.ChunkNum{5, 6}, state.reserved)
+	assert.Equal(t, uint64(2), state.nextID)
+
+	corrupt := append([]byte{}, buf.Bytes()...)
+	corrupt[journalHeaderSize+2] ^= 0xFF
+	_, err = replayJournal(bytes.NewReader(corrupt))
+	assert.Error(t, err)
+}
+
+// Tests that a journal shows which changes were interrupted and which reserved entries were never handed out, and
+// that starting it over keeps both.
+func TestJournalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	jpath := path.Join(dir, "journal")
+
+	state, err := readJournal(jpath)
+	require.NoError(t, err)
+	assert.Empty(t, state.pending)
+	assert.Empty(t, state.reserved)
+
+	j, err := openJournal(jpath, state.nextID, nil)
+	require.NoError(t, err)
+	id, err := j.begin(journalRecord{kind: journalReserve, block: 1, version: 1, chunks: []apis.ChunkNum{10, 11, 12}})
+	require.NoError(t, err)
+	require.NoError(t, j.finish(id, 2))
+	require.NoError(t, j.issue(10))
+	id, err = j.begin(journalRecord{kind: journalUpdate, block: 1, version: 2, chunks: []apis.ChunkNum{10}})
+	require.NoError(t, err)
+	require.NoError(t, j.finish(id, 0))
+	_, err = j.begin(journalRecord{kind: journalDelete, block: 1, version: 2, chunks: []apis.ChunkNum{10}})
+	require.NoError(t, err)
+	require.NoError(t, j.close())
+
+	state, err = readJournal(jpath)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(state.pending))
+	assert.Equal(t, journalDelete, state.pending[0].kind)
+	assert.Equal(t, []apis.ChunkNum{11, 12}, state.reserved)
+
+	// once recovered, the journal starts over with only the entries that are still to be handed out
+	j, err = openJournal(jpath, state.nextID, state.reserved)
+	require.NoError(t, err)
+	require.NoError(t, j.issue(11))
+	require.NoError(t, j.compact([]apis.ChunkNum{12}))
+	assert.False(t, j.full())
+	require.NoError(t, j.close())
+
+	state, err = readJournal(jpath)
+	require.NoError(t, err)
+	assert.Empty(t, state.pending)
+	assert.Equal(t, []apis.ChunkNum{12}, state.reserved)
+}
+
+// Prepares a chunkserver for metadata blocks to be kept on, and returns the etcd interface for a metadata cache named
+// 'name', and the connection cache through which the chunkserver can be reached.
+func prepareCacheEnvironment(t *testing.T, name apis.ServerName) (apis.EtcdInterface, rpc.ConnectionCache, func()) {
+	teardowns := &util.MultiTeardown{}
+	etcds, teardown := etcd.PrepareSubscribeForTesting(t)
+	teardowns.Add(teardown)
+	etcdn, teardown1 := etcds(name)
+	teardowns.Add(teardown1)
+
+	conn := rpc.NewConnectionCache()
+	teardowns.Add(conn.CloseAll)
+
+	cs, _, csT := chunkserver.NewTestChunkserver(t, conn)
+	teardowns.Add(csT)
+	csTeardown, address, err := rpc.PublishChunkserver(cs, ":0")
+	require.NoError(t, err)
+	teardowns.Add(func() { csTeardown(true) })
+	require.NoError(t, etcdn.UpdateAddress(address, apis.CHUNKSERVER))
+	return etcdn, conn, teardowns.TeardownReverse
+}
+
+// Tests that a cache configured with a journal path keeps its journal there.
+func TestConfigureCacheJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	jpath := path.Join(dir, "journal")
+
+	etcdn, conn, teardown := prepareCacheEnvironment(t, "mc1")
+	defer teardown()
+
+	cache, err := ConfigureCache(conn, etcdn, apis.NoopLogger, Configuration{JournalPath: jpath})
+	require.NoError(t, err)
+	chunk, err := cache.NewEntry()
+	require.NoError(t, err)
+	_, err = cache.UpdateEntry(chunk, apis.MetadataEntry{}, apis.MetadataEntry{MostRecentVersion: 1})
+	require.NoError(t, err)
+	require.NoError(t, cache.Close())
+
+	state, err := readJournal(jpath)
+	require.NoError(t, err)
+	assert.Empty(t, state.pending)
+	// the rest of the reservation was released when the cache was closed
+	assert.Empty(t, state.reserved)
+}
+
+// Tests that entries released by a closed cache are no longer outstanding in its journal.
+func TestJournalRelease(t *testing.T) {
+	var buf bytes.Buffer
+	for _, record := range []journalRecord{
+		{kind: journalReserve, id: 1, block: 3, version: 7, chunks: []apis.ChunkNum{5, 6, 7}},
+		{kind: journalCommit, id: 1, version: 8},
+		{kind: journalIssue, chunks: []apis.ChunkNum{5}},
+		{kind: journalRelease, id: 2, block: 3, version: 8, chunks: []apis.ChunkNum{6}},
+		{kind: journalCommit, id: 2, version: 9},
+		{kind: journalRelease, id: 3, block: 3, version: 9, chunks: []apis.ChunkNum{7}},
+		{kind: journalAbort, id: 3},
+	} {
+		buf.Write(record.encode())
+	}
+	state, err := replayJournal(&buf)
+	require.NoError(t, err)
+	assert.Empty(t, state.pending)
+	assert.Equal(t, []apis.ChunkNum{7}, state.reserved)
+}
+
+// Tests that an interrupted restore is left pending in the journal, like any other change, without touching the
+// reservation.
+func TestJournalRestore(t *testing.T) {
+	var buf bytes.Buffer
+	records := []journalRecord{
+		{kind: journalReserve, id: 1, block: 3, version: 7, chunks: []apis.ChunkNum{5, 6}},
+		{kind: journalCommit, id: 1, version: 8},
+		{kind: journalRestore, id: 2, block: 3, version: 8, payload: []byte("checkpointed")},
+	}
+	for _, record := range records {
+		buf.Write(record.encode())
+	}
+	state, err := replayJournal(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, []journalRecord{records[2]}, state.pending)
+	assert.Equal(t, []apis.ChunkNum{5, 6}, state.reserved)
+}
@@ -5,6 +5,7 @@ import (
 	"zircon/apis"
 	"zircon/rpc"
 	"sync"
+	"sync/atomic"
 	"errors"
 	"fmt"
 	"time"
@@ -18,8 +19,15 @@ type Lease struct {
 }
 
 type Leasing struct {
+	// updated atomically, and kept first for the sake of their alignment; see Stats
+	hits        uint64
+	misses      uint64
+	redirects   uint64
+	expirations uint64
+
 	access *access.Access
 	etcd   apis.EtcdInterface
+	logger apis.Logger
 
 	mu         sync.Mutex
 	cancel     chan struct{}
@@ -28,9 +36,12 @@ type Leasing struct {
 	validUntil time.Time
 	leases     map[apis.MetadataID]*Lease
 	populating map[apis.MetadataID]chan struct{}
+	// blocks being handed off to other caches, which requests wait on; see HandOff
+	handoffs   map[apis.MetadataID]chan struct{}
 }
 
-func ConstructLeasing(etcd apis.EtcdInterface, cache rpc.ConnectionCache) (*Leasing, error) {
+// Constructs a leasing agent, which reports losing its leases and redirecting requests to other owners to 'logger'.
+func ConstructLeasing(etcd apis.EtcdInterface, cache rpc.ConnectionCache, logger apis.Logger) (*Leasing, error) {
 	chunkAccess, err := access.ConstructAccess(etcd, cache)
 	if err != nil {
 		return nil, err
@@ -38,8 +49,10 @@ func ConstructLeasing(etcd apis.EtcdInterface, cache rpc.ConnectionCache) (*Leas
 	return &Leasing{
 		access: chunkAccess,
 		etcd: etcd,
+		logger: logger,
 		leases: make(map[apis.MetadataID]*Lease),
 		populating: make(map[apis.MetadataID]chan struct{}),
+		handoffs: make(map[apis.MetadataID]chan struct{}),
 	}, nil
 }
 
@@ -59,13 +72,18 @@ func (l *Leasing) Start() error {
 	if err != nil {
 		return err
 	}
+	// see the explanation of the metadata ring in apis
+	err = l.etcd.JoinMetadataRing()
+	if err != nil {
+		return err
+	}
 
 	l.cancel = make(chan struct{})
 	l.done = make(chan struct{})
 	l.safe = true
 	l.validUntil = start.Add(l.etcd.GetMetadataLeaseTimeout())
 
-	go l.mainloop()
+	go l.mainloop(l.cancel, l.done)
 
 	return l.ensureRenewed_LK()
 }
@@ -87,6 +105,10 @@ func (l *Leasing) Stop() error {
 	if done == nil {
 		return errors.New("either already stopped or already in the process of stopping!")
 	}
+	if err := l.etcd.LeaveMetadataRing(); err != nil {
+		// nothing lost; we drop out of the ring anyway once our metadata lease runs out
+		l.logger.Logf(apis.WARN, "could not leave the metadata ring: %v", err)
+	}
 	<-done
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -94,13 +116,14 @@ func (l *Leasing) Stop() error {
 	return nil
 }
 
-func (l *Leasing) mainloop() {
+// Takes its channels as arguments, because Stop clears them from the Leasing while this is still running.
+func (l *Leasing) mainloop(cancel chan struct{}, done chan struct{}) {
 	defer func() {
-		close(l.done)
+		close(done)
 	}()
 	for {
 		select {
-		case <-l.cancel:
+		case <-cancel:
 			return
 		case <-time.After(l.etcd.GetMetadataLeaseTimeout() / 3):
 			start := time.Now()
@@ -108,13 +131,20 @@ func (l *Leasing) mainloop() {
 			if !time.Now().Before(l.validUntil) {
 				// took too long, and we may have been considered to have lost leases
 				// so now we just terminate.
+				l.logger.Logf(apis.ERROR, "metadata leases expired before they could be renewed; no longer serving them")
+				atomic.AddUint64(&l.expirations, 1)
 				return
 			}
 			if err != nil {
+				l.logger.Logf(apis.ERROR, "could not renew metadata leases; no longer serving them: %v", err)
+				atomic.AddUint64(&l.expirations, 1)
 				l.notifyUnsafe()
 				return
 			} else {
+				// only this loop changes validUntil, but requests check it under the lock
+				l.mu.Lock()
 				l.validUntil = start.Add(l.etcd.GetMetadataLeaseTimeout())
+				l.mu.Unlock()
 			}
 		}
 	}
@@ -135,6 +165,20 @@ func (l *Leasing) ensureRenewed_LK() error {
 	}
 }
 
+// Fails if the agent isn't running, or if its leases have expired or couldn't be renewed, in which case it no longer owns
+// any blocks and requests for them are refused.
+func (l *Leasing) CheckOwnership() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cancel == nil {
+		return errors.New("leasing agent is not running")
+	}
+	if !l.safe {
+		return errors.New("could not renew leases; no longer serving them")
+	}
+	return l.ensureRenewed_LK()
+}
+
 func (l *Leasing) ensureClaimed(id apis.MetadataID) (apis.ServerName, error) {
 	l.mu.Lock()
 	_, foundLease := l.leases[id]
@@ -194,19 +238,19 @@ func (l *Leasing) GetOrCreateAnyUnleased() (apis.MetadataID, error) {
 	// TODO: figure out how this handles leases if they're re-established during this time
 	id, err := l.etcd.LeaseAnyMetametadata()
 	if err != nil {
-		return 0, fmt.Errorf("[leasing.go/LAM] %v", err)
+		return 0, fmt.Errorf("[leasing.go/LAM] %w", err)
 	}
 	if id == 0 {
 		// TODO: what if we lose our lease right here?
 		id, err = l.access.New()
 		if err != nil {
-			return 0, fmt.Errorf("[leasing.go/ACN] %v", err)
+			return 0, fmt.Errorf("[leasing.go/ACN] %w", err)
 		}
 		// we do an empty write to make sure the block sticks around (TODO: is this necessary?)
 		// since the write is empty, there is no negative effect from it applying in the wrong scenario
 		_, err = l.access.Write(id, apis.AnyVersion, 0, []byte{})
 		if err != nil {
-			return 0, fmt.Errorf("[leasing.go/ACW] %v", err)
+			return 0, fmt.Errorf("[leasing.go/ACW] %w", err)
 		}
 		owner, err := l.ensureClaimed(id)
 		if err != nil {
@@ -235,14 +279,48 @@ func (l *Leasing) populateCache(id apis.MetadataID) (apis.ServerName, error) {
 		return apis.NoRedirect, err
 	}
 	if owner != l.etcd.GetName() {
-		return owner, fmt.Errorf("owned by someone else: %s", owner)
+		l.logger.Logf(apis.DEBUG, "metadata block %d is owned by %s; redirecting", id, owner)
+		atomic.AddUint64(&l.redirects, 1)
+		return owner, apis.ErrOwnerRedirect{Owner: owner}
 	}
+	l.mu.Lock()
+	loaded := l.leases[id] != nil
+	l.mu.Unlock()
 	if err := l.requestPopulation(id); err != nil {
 		return apis.NoRedirect, err
 	}
+	if loaded {
+		atomic.AddUint64(&l.hits, 1)
+	} else {
+		atomic.AddUint64(&l.misses, 1)
+	}
 	return apis.NoRedirect, nil
 }
 
+// Reports how many lookups of blocks found them loaded or not, or were redirected, and how many times our leases
+// expired. Leaves the rest of the stats for the cache to fill in.
+func (l *Leasing) Stats() apis.MetadataCacheStats {
+	return apis.MetadataCacheStats{
+		Hits:             atomic.LoadUint64(&l.hits),
+		Misses:           atomic.LoadUint64(&l.misses),
+		Redirects:        atomic.LoadUint64(&l.redirects),
+		LeaseExpirations: atomic.LoadUint64(&l.expirations),
+	}
+}
+
+// Returns the contents of a block that we hold the lease on, without claiming or loading anything, or counting it
+// towards Stats. Reports false if the block isn't loaded.
+func (l *Leasing) Contents(id apis.MetadataID) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lease := l.leases[id]
+	if lease == nil || l.ensureRenewed_LK() != nil {
+		return nil, false
+	}
+	// never modified in place, since writes replace the contents
+	return lease.Contents, true
+}
+
 func (l *Leasing) ListLeases() ([]apis.MetadataID, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -253,20 +331,38 @@ func (l *Leasing) ListLeases() ([]apis.MetadataID, error) {
 	return result, l.ensureRenewed_LK()
 }
 
+// Waits until a block is not being handed off, and then returns our lease on it, or nil if we no longer hold one.
+func (l *Leasing) awaitHandoff_LK(id apis.MetadataID) *Lease {
+	for l.handoffs[id] != nil {
+		c := l.handoffs[id]
+		l.mu.Unlock()
+		<-c
+		l.mu.Lock()
+	}
+	return l.leases[id]
+}
+
 // Reads a complete chunk.
 func (l *Leasing) Read(metachunk apis.MetadataID) ([]byte, apis.Version, apis.ServerName, error) {
-	owner, err := l.populateCache(metachunk)
-	if err != nil {
-		return nil, 0, owner, err
-	}
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	lease := l.leases[metachunk]
-	if err := l.ensureRenewed_LK(); err != nil {
-		// cache invalidated!
-		return nil, 0, apis.NoRedirect, err
+	for {
+		owner, err := l.populateCache(metachunk)
+		if err != nil {
+			return nil, 0, owner, err
+		}
+		l.mu.Lock()
+		lease := l.awaitHandoff_LK(metachunk)
+		if lease == nil {
+			// handed off in the meantime; find out who has it now
+			l.mu.Unlock()
+			continue
+		}
+		defer l.mu.Unlock()
+		if err := l.ensureRenewed_LK(); err != nil {
+			// cache invalidated!
+			return nil, 0, apis.NoRedirect, err
+		}
+		return lease.Contents, lease.Version, apis.NoRedirect, nil
 	}
-	return lease.Contents, lease.Version, apis.NoRedirect, nil
 }
 
 // Writes part of a chunk. Only performs the write if the version matches. Returns the new version on success, or the
@@ -284,24 +380,25 @@ func (l *Leasing) Write(metachunk apis.MetadataID, version apis.Version, offset
 		return 0, owner, err
 	}
 	l.mu.Lock()
-	lease := l.leases[metachunk]
-	if lease.Version != version {
-		l.mu.Unlock()
-		return lease.Version, apis.NoRedirect, errors.New("version mismatch during lease write")
-	}
-	for lease.WriteCompletion != nil {
+	lease := l.awaitHandoff_LK(metachunk)
+	for lease != nil && lease.Version == version && lease.WriteCompletion != nil {
 		waitOn := lease.WriteCompletion
 		l.mu.Unlock()
 		<-waitOn
 		l.mu.Lock()
-		lease = l.leases[metachunk]
-		if lease.WriteCompletion == waitOn {
+		lease = l.awaitHandoff_LK(metachunk)
+		if lease != nil && lease.WriteCompletion == waitOn {
 			lease.WriteCompletion = nil
 		}
-		if lease.Version != version {
-			l.mu.Unlock()
-			return lease.Version, apis.NoRedirect, errors.New("version mismatch during lease write")
-		}
+	}
+	if lease == nil {
+		// handed off in the meantime, so the new owner has to be asked instead
+		l.mu.Unlock()
+		return l.Write(metachunk, version, offset, data)
+	}
+	if lease.Version != version {
+		l.mu.Unlock()
+		return lease.Version, apis.NoRedirect, errors.New("version mismatch during lease write")
 	}
 	writeChan := make(chan struct{})
 	defer close(writeChan)
@@ -328,3 +425,53 @@ func (l *Leasing) Write(metachunk apis.MetadataID, version apis.Version, offset
 	}
 	return newVersion, apis.NoRedirect, nil
 }
+
+// Hands our lease on a block off to another metadata cache. Requests for the block are held back while writes to it
+// that are already in progress finish, and then 'transfer' is called to have the other cache take over the lease in
+// etcd. Once it returns, the held requests carry on, and find that the block is no longer ours, so they are redirected
+// to its new owner. The block is dropped from the cache even if 'transfer' fails, in case the other cache took over
+// before failing to say so; if it didn't, the block is loaded again by the next request for it.
+func (l *Leasing) HandOff(id apis.MetadataID, transfer func() error) error {
+	l.mu.Lock()
+	lease := l.leases[id]
+	if lease == nil || l.handoffs[id] != nil {
+		l.mu.Unlock()
+		return fmt.Errorf("cannot hand off metadata block %d; not leased, or already being handed off", id)
+	}
+	done := make(chan struct{})
+	l.handoffs[id] = done
+	for lease.WriteCompletion != nil {
+		waitOn := lease.WriteCompletion
+		l.mu.Unlock()
+		<-waitOn
+		l.mu.Lock()
+		if lease.WriteCompletion == waitOn {
+			lease.WriteCompletion = nil
+		}
+	}
+	l.mu.Unlock()
+
+	err := transfer()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.leases[id] == lease {
+		delete(l.leases, id)
+	}
+	delete(l.handoffs, id)
+	close(done)
+	return err
+}
+
+// Takes over the lease on a block from the metadata cache 'from', which must hold it, and loads the block.
+func (l *Leasing) Accept(id apis.MetadataID, from apis.ServerName) error {
+	if err := l.etcd.TransferMetadataClaim(id, from); err != nil {
+		return err
+	}
+	if err := l.requestPopulation(id); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ensureRenewed_LK()
+}
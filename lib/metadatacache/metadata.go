@@ -4,32 +4,112 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"sync"
 	"zircon/apis"
+	"zircon/logging"
 	"zircon/metadatacache/leasing"
 	"zircon/rpc"
 	"zircon/util"
 )
 
 type metadatacache struct {
-	leasing *leasing.Leasing
+	leasing  *leasing.Leasing
+	etcd     apis.EtcdInterface
+	conns    rpc.ConnectionCache
+	logger   apis.Logger
+	strategy AllocationStrategy
+
+	mu       sync.Mutex
+	reserved []apis.ChunkNum
+	// entries freed by DeleteEntry, for FreeListAllocation; see allocate.go
+	freed []apis.ChunkNum
+	// nil unless the cache keeps a journal; see journal.go
+	journal *journal
 }
 
 // Construct a new metadata cache.
-func NewCache(connCache rpc.ConnectionCache, etcd apis.EtcdInterface) (apis.MetadataCache, error) {
-	agent, err := leasing.ConstructLeasing(etcd, connCache)
+func NewCache(connCache rpc.ConnectionCache, etcd apis.EtcdInterface) (CheckpointingCache, error) {
+	return NewCacheWithOptions(connCache, etcd, CacheOptions{})
+}
+
+// How a metadata cache constructed with NewCacheWithOptions behaves. The zero value is a cache like the one that
+// NewCache returns.
+type CacheOptions struct {
+	// Where lost leases and redirections to the owners of other metadata blocks are reported; nowhere if nil.
+	Logger apis.Logger
+	// How the chunk numbers handed out by NewEntry are chosen; MonotonicAllocation if left as zero.
+	Strategy AllocationStrategy
+	// Where to keep a journal noting each change to a metadata block, from which the cache recovers whatever was
+	// interrupted when it last stopped before serving anything; see journal.go. Empty keeps no journal.
+	JournalPath string
+}
+
+// Like NewCache, but takes all of the options at once, including those that can't be chosen any other way.
+func NewCacheWithOptions(connCache rpc.ConnectionCache, etcd apis.EtcdInterface, options CacheOptions) (CheckpointingCache, error) {
+	if options.Logger == nil {
+		options.Logger = apis.NoopLogger
+	}
+	logger := logging.Component(options.Logger, "metadatacache")
+	strategy, journalPath := options.Strategy, options.JournalPath
+	var state journalState
+	if journalPath != "" {
+		var err error
+		if state, err = readJournal(journalPath); err != nil {
+			return nil, fmt.Errorf("cannot read metadata journal %s: %w", journalPath, err)
+		}
+	}
+	agent, err := leasing.ConstructLeasing(etcd, connCache, logger)
 	if err != nil {
 		return nil, err
 	}
-	// TODO: figure out a good time to run Stop()
 	// TODO: be able to automatically re-establish a lease by Stop()/Start() sequence
 	err = agent.Start()
 	if err != nil {
 		return nil, err
 	}
 
-	return &metadatacache{
-		leasing: agent,
-	}, nil
+	mc := &metadatacache{
+		leasing:  agent,
+		etcd:     etcd,
+		conns:    connCache,
+		logger:   logger,
+		strategy: strategy,
+	}
+	if journalPath != "" {
+		// the leases on the blocks that the journal mentions are claimed again along the way
+		reserved, err := mc.recoverJournal(state)
+		if err == nil {
+			mc.reserved = reserved
+			mc.journal, err = openJournal(journalPath, state.nextID, reserved)
+		}
+		if err != nil {
+			_ = agent.Stop()
+			return nil, err
+		}
+	}
+	return mc, nil
+}
+
+// Reports whether etcd, where the leases on metadata blocks are kept, can be reached, and whether this cache still holds
+// its leases, without which it can't serve any block.
+func (mc *metadatacache) CheckHealth() []apis.DependencyStatus {
+	_, err := mc.etcd.GetIDByName(mc.etcd.GetName())
+	return []apis.DependencyStatus{apis.CheckDependency("etcd", err), apis.CheckDependency("leases", mc.leasing.CheckOwnership())}
+}
+
+func (mc *metadatacache) Close() error {
+	mc.mu.Lock()
+	if err := mc.releaseReserved(); err != nil {
+		mc.logger.Logf(apis.WARN, "%v", err)
+	}
+	mc.mu.Unlock()
+	err := mc.leasing.Stop()
+	if mc.journal != nil {
+		if jerr := mc.journal.close(); err == nil {
+			err = jerr
+		}
+	}
+	return err
 }
 
 // Reads the metadata entry of a particular chunk.
@@ -43,7 +123,7 @@ func (mc *metadatacache) ReadEntry(chunk apis.ChunkNum) (apis.MetadataEntry, api
 
 	found := getBitsetInData(data, ChunkToEntryNumber(chunk))
 	if !found {
-		return apis.MetadataEntry{}, apis.NoRedirect, fmt.Errorf("entry doesn't exist to be able to be read: %d", chunk)
+		return apis.MetadataEntry{}, apis.NoRedirect, fmt.Errorf("cannot read entry for chunk %d: %w", chunk, missingEntry(data, offset))
 	}
 
 	entry, err := deserializeEntry(data[offset : offset+apis.EntrySize])
@@ -62,36 +142,36 @@ func (mc *metadatacache) UpdateEntry(chunk apis.ChunkNum, previous apis.Metadata
 	for {
 		data, version, owner, err := mc.leasing.Read(metachunk)
 		if err != nil {
-			return owner, fmt.Errorf("[metadata.go/MLR] %v", err)
+			return owner, fmt.Errorf("[metadata.go/MLR] %w", err)
 		}
 
 		found := getBitsetInData(data, ChunkToEntryNumber(chunk))
 		if !found {
-			return apis.NoRedirect, errors.New("entry doesn't exist to be able to be updated")
+			return apis.NoRedirect, fmt.Errorf("cannot update entry for chunk %d: %w", chunk, missingEntry(data, offset))
 		}
 
 		entry, err := deserializeEntry(data[offset : offset+apis.EntrySize])
 		if err != nil {
-			return apis.NoRedirect, fmt.Errorf("[metadata.go/DSE] %v", err)
+			return apis.NoRedirect, fmt.Errorf("[metadata.go/DSE] %w", err)
 		}
 		if !entry.Equals(previous) {
-			return apis.NoRedirect, errors.New("entry does not match previous expected entry")
+			return apis.NoRedirect, fmt.Errorf("entry does not match previous expected entry: %w", apis.ErrVersionStale)
 		}
 
 		updated, err := serializeEntry(newEntry)
 		if err != nil {
-			return apis.NoRedirect, fmt.Errorf("[metadata.go/SRE] %v", err)
+			return apis.NoRedirect, fmt.Errorf("[metadata.go/SRE] %w", err)
 		}
 		if len(updated) != apis.EntrySize {
 			panic("postcondition on serializeEntry failed")
 		}
 
-		_, owner, err = mc.leasing.Write(metachunk, version, offset, updated)
+		_, owner, err = mc.journaledWrite(journalUpdate, []apis.ChunkNum{chunk}, metachunk, version, offset, updated)
 		if err == nil {
 			// success!
 			return apis.NoRedirect, nil
 		} else if version == 0 {
-			return owner, fmt.Errorf("[metadata.go/MLW] %v", err)
+			return owner, fmt.Errorf("[metadata.go/MLW] %w", err)
 		}
 		// version mismatch; go around again and re-attempt changes
 	}
@@ -110,7 +190,7 @@ func (mc *metadatacache) DeleteEntry(chunk apis.ChunkNum, previous apis.Metadata
 
 		found := getBitsetInData(data, ChunkToEntryNumber(chunk))
 		if !found {
-			return apis.NoRedirect, errors.New("entry doesn't exist to be able to be deleted")
+			return apis.NoRedirect, fmt.Errorf("cannot delete entry for chunk %d: %w", chunk, missingEntry(data, offset))
 		}
 
 		entry, err := deserializeEntry(data[offset : offset+apis.EntrySize])
@@ -118,13 +198,16 @@ func (mc *metadatacache) DeleteEntry(chunk apis.ChunkNum, previous apis.Metadata
 			return apis.NoRedirect, err
 		}
 		if !entry.Equals(previous) {
-			return apis.NoRedirect, errors.New("entry does not match previous expected entry")
+			return apis.NoRedirect, fmt.Errorf("entry does not match previous expected entry: %w", apis.ErrVersionStale)
 		}
 
-		updateOffset, newData := updateBitsetInData(data, ChunkToEntryNumber(chunk), false)
+		updateOffset, newData := tombstoneInData(data, ChunkToEntryNumber(chunk))
 
-		_, owner, err = mc.leasing.Write(metachunk, version, updateOffset, newData)
+		_, owner, err = mc.journaledWrite(journalDelete, []apis.ChunkNum{chunk}, metachunk, version, updateOffset, newData)
 		if err == nil {
+			mc.mu.Lock()
+			mc.recycle(chunk)
+			mc.mu.Unlock()
 			return apis.NoRedirect, nil
 		} else if version == 0 {
 			return owner, err
@@ -133,6 +216,56 @@ func (mc *metadatacache) DeleteEntry(chunk apis.ChunkNum, previous apis.Metadata
 	}
 }
 
+// The flags kept in byte 18 of a serialized entry.
+const (
+	// an ACL follows the lagging replicas: the owner, then the mode and the number of allowed principals as a byte each,
+	// then the allowed principals, with principals taking 8 bytes each
+	entryHasACL = 1 << iota
+	// the entry is the tombstone of a deleted chunk
+	entryDeleted
+)
+
+// How much room an ACL takes up in a serialized entry.
+func aclSize(acl apis.ACL) int {
+	if !acl.Restricted() {
+		return 0
+	}
+	return 10 + 8*len(acl.Allowed)
+}
+
+// The tombstone left in place of a deleted entry. Its slot is cleared again when the entry is reserved by NewEntry.
+var tombstone = apis.MetadataEntry{Deleted: true}
+
+// Provides write parameters that free an entry and leave a tombstone in its place: (offset, data). Like reserveInData,
+// this covers both the bitset and the entry, so that it can be applied as a single versioned write.
+func tombstoneInData(data []byte, index uint32) (uint32, []byte) {
+	bitOffset, bit := updateBitsetInData(data, index, false)
+	entryOffset := EntryNumberToOffset(index)
+	payload := make([]byte, entryOffset+apis.EntrySize-bitOffset)
+	copy(payload, data[bitOffset:])
+	copy(payload, bit)
+	serialized, err := serializeEntry(tombstone)
+	if err != nil {
+		panic("tombstone should always be serializable")
+	}
+	copy(payload[entryOffset-bitOffset:], serialized)
+	return bitOffset, payload
+}
+
+// The error for an entry that isn't allocated: ErrChunkDeleted if its slot holds a tombstone, or ErrNotFound if it
+// never held anything, or was never deleted through DeleteEntry.
+func missingEntry(data []byte, offset uint32) error {
+	entry, err := deserializeEntry(data[offset : offset+apis.EntrySize])
+	if err == nil && entry.Deleted {
+		return apis.ErrChunkDeleted
+	}
+	return apis.ErrNotFound
+}
+
+// Where the write lease is kept within a serialized entry: the last 16 bytes, after the space set aside for replicas.
+// Entries written before leases existed have zeroes here, which is the same as having no lease.
+const leaseOffset = apis.EntrySize - 16
+
 // Deserialize a metadate entry using gob
 func deserializeEntry(data []byte) (apis.MetadataEntry, error) {
 	if len(util.StripTrailingZeroes(data)) == 0 {
@@ -143,10 +276,36 @@ func deserializeEntry(data []byte) (apis.MetadataEntry, error) {
 	var entry apis.MetadataEntry
 	entry.MostRecentVersion = apis.Version(binary.LittleEndian.Uint64(data))
 	entry.LastConsumedVersion = apis.Version(binary.LittleEndian.Uint64(data[8:]))
+	entry.Deleted = data[18]&entryDeleted != 0
+	entry.ReplicationFactor = data[19]
 	entry.Replicas = make([]apis.ServerID, data[16])
 	for i := 0; i < len(entry.Replicas); i++ {
 		entry.Replicas[i] = apis.ServerID(binary.LittleEndian.Uint32(data[20+4*i:]))
 	}
+	if data[17] > 0 {
+		// lagging replicas are listed directly after the full list of replicas
+		lagStart := 20 + 4*len(entry.Replicas)
+		entry.Lagging = make([]apis.ServerID, data[17])
+		for i := 0; i < len(entry.Lagging); i++ {
+			entry.Lagging[i] = apis.ServerID(binary.LittleEndian.Uint32(data[lagStart+4*i:]))
+		}
+	}
+	if data[18]&entryHasACL != 0 {
+		aclStart := 20 + 4*(len(entry.Replicas)+len(entry.Lagging))
+		if aclStart+10 > leaseOffset || aclStart+10+8*int(data[aclStart+9]) > leaseOffset {
+			return apis.MetadataEntry{}, errors.New("ACL does not fit in entry")
+		}
+		entry.ACL.Owner = apis.Principal(binary.LittleEndian.Uint64(data[aclStart:]))
+		entry.ACL.Mode = apis.Access(data[aclStart+8])
+		if count := int(data[aclStart+9]); count > 0 {
+			entry.ACL.Allowed = make([]apis.Principal, count)
+			for i := 0; i < count; i++ {
+				entry.ACL.Allowed[i] = apis.Principal(binary.LittleEndian.Uint64(data[aclStart+10+8*i:]))
+			}
+		}
+	}
+	entry.Lease.Holder = apis.LeaseID(binary.LittleEndian.Uint64(data[leaseOffset:]))
+	entry.Lease.Expiry = int64(binary.LittleEndian.Uint64(data[leaseOffset+8:]))
 
 	return entry, nil
 }
@@ -157,13 +316,37 @@ func serializeEntry(entry apis.MetadataEntry) ([]byte, error) {
 	data := make([]byte, apis.EntrySize)
 	binary.LittleEndian.PutUint64(data, uint64(entry.MostRecentVersion))
 	binary.LittleEndian.PutUint64(data[8:], uint64(entry.LastConsumedVersion))
-	if len(entry.Replicas) >= 256 || len(entry.Replicas) > (apis.EntrySize-20)/4 {
-		return nil, fmt.Errorf("too many replicas: %d", len(entry.Replicas))
+	if len(entry.ACL.Allowed) > apis.MaxACLPrincipals {
+		return nil, fmt.Errorf("too many principals in ACL: %d", len(entry.ACL.Allowed))
+	}
+	if len(entry.Replicas) >= 256 || 20+4*(len(entry.Replicas)+len(entry.Lagging))+aclSize(entry.ACL) > leaseOffset {
+		return nil, fmt.Errorf("too many replicas: %d (%d lagging)", len(entry.Replicas), len(entry.Lagging))
 	}
 	data[16] = uint8(len(entry.Replicas))
+	data[17] = uint8(len(entry.Lagging))
+	if entry.Deleted {
+		data[18] |= entryDeleted
+	}
+	data[19] = entry.ReplicationFactor
 	for i := 0; i < len(entry.Replicas); i++ {
 		binary.LittleEndian.PutUint32(data[20+4*i:], uint32(entry.Replicas[i]))
 	}
+	lagStart := 20 + 4*len(entry.Replicas)
+	for i := 0; i < len(entry.Lagging); i++ {
+		binary.LittleEndian.PutUint32(data[lagStart+4*i:], uint32(entry.Lagging[i]))
+	}
+	if entry.ACL.Restricted() {
+		data[18] |= entryHasACL
+		aclStart := lagStart + 4*len(entry.Lagging)
+		binary.LittleEndian.PutUint64(data[aclStart:], uint64(entry.ACL.Owner))
+		data[aclStart+8] = uint8(entry.ACL.Mode)
+		data[aclStart+9] = uint8(len(entry.ACL.Allowed))
+		for i, principal := range entry.ACL.Allowed {
+			binary.LittleEndian.PutUint64(data[aclStart+10+8*i:], uint64(principal))
+		}
+	}
+	binary.LittleEndian.PutUint64(data[leaseOffset:], uint64(entry.Lease.Holder))
+	binary.LittleEndian.PutUint64(data[leaseOffset+8:], uint64(entry.Lease.Expiry))
 
 	return data, nil
 }
@@ -196,42 +379,6 @@ func EntryAndBlockToChunkNum(metachunk apis.MetadataID, index uint32) apis.Chunk
 	return apis.ChunkNum(uint64(metachunk<<apis.EntriesPerBlock) | uint64(index))
 }
 
-// Allocate a new metadata entry and corresponding chunk number
-func (mc *metadatacache) NewEntry() (apis.ChunkNum, error) {
-	for {
-		metachunk, index, err := mc.findAnyFreeChunk()
-		if err != nil {
-			return 0, fmt.Errorf("[metadata.go/FFC] %v", err)
-		}
-
-		noclobber, err := mc.updateBitset(metachunk, index, true)
-		if err != nil {
-			return 0, fmt.Errorf("[metadata.go/MUB] %v", err)
-		}
-
-		if noclobber {
-			chunk := EntryAndBlockToChunkNum(metachunk, index)
-
-			for {
-				_, version, _, err := mc.leasing.Read(metachunk)
-				if err != nil {
-					// TODO: what now? how do we recover this storage space?
-					return 0, fmt.Errorf("[metadata.go/MLR] %v", err)
-				}
-				nver, _, err := mc.leasing.Write(metachunk, version, EntryNumberToOffset(index), make([]byte, apis.EntrySize))
-				if err == nil {
-					return chunk, nil
-				} else if nver == 0 {
-					// TODO: what now? how do we recover this storage space?
-					return 0, fmt.Errorf("[metadata.go/MLW] %v", err)
-				}
-				// version mismatch; go around again!
-			}
-		}
-		// welp... guess we gotta go around again! someone else messed with our chunk.
-	}
-}
-
 // Checks whether a chunk has been allocated or not in the bitset part of a certain metachunk.
 func (mc *metadatacache) getBitset(metachunk apis.MetadataID, index uint32) (bool, error) {
 	data, _, _, err := mc.leasing.Read(metachunk)
@@ -296,7 +443,7 @@ func (mc *metadatacache) findAnyFreeChunk() (apis.MetadataID, uint32, error) {
 	// First, see if there is an open spot in a lease that we hold
 	metadataID, index, found, err := mc.findAnyLeasedFreeChunk()
 	if err != nil {
-		return 0, 0, fmt.Errorf("[metadata.go/FLC] %v", err)
+		return 0, 0, fmt.Errorf("[metadata.go/FLC] %w", err)
 	}
 	if found {
 		return metadataID, index, nil
@@ -308,12 +455,12 @@ func (mc *metadatacache) findAnyFreeChunk() (apis.MetadataID, uint32, error) {
 		// TODO: what if one server runs through this a lot of times, and suddenly has everything claimed? inefficient!
 		metadataID, err := mc.leasing.GetOrCreateAnyUnleased()
 		if err != nil {
-			return 0, 0, fmt.Errorf("[metadata.go/GCU] %v", err)
+			return 0, 0, fmt.Errorf("[metadata.go/GCU] %w", err)
 		}
 
 		index, found, err := mc.findFreeChunkIn(metadataID)
 		if err != nil {
-			return 0, 0, fmt.Errorf("[metadata.go/FCI] %v", err)
+			return 0, 0, fmt.Errorf("[metadata.go/FCI] %w", err)
 		}
 
 		if found {
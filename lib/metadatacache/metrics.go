@@ -0,0 +1,106 @@
+package metadatacache
+
+import (
+	"fmt"
+	"zircon/apis"
+)
+
+// Reports how many metadata blocks this cache leases, how many chunks they hold entries for, and how many replicas of
+// those chunks have fallen behind the latest version, along with the counts reported by Stats. Measurements that can't
+// be taken are left out.
+func (mc *metadatacache) ReportMetrics() []apis.Measurement {
+	leases, err := mc.leasing.ListLeases()
+	if err != nil {
+		mc.logger.Logf(apis.WARN, "could not list leases for metrics: %v", err)
+		return nil
+	}
+	chunks, laggingChunks, laggingReplicas := 0, 0, 0
+	for _, metachunk := range leases {
+		// as with Checkpoint, the contents are a consistent view of the block, and looking at them isn't a lookup
+		data, loaded := mc.leasing.Contents(metachunk)
+		if !loaded {
+			continue
+		}
+		for index := uint32(0); index < 1<<apis.EntriesPerBlock; index++ {
+			if !getBitsetInData(data, index) {
+				continue
+			}
+			offset := EntryNumberToOffset(index)
+			entry, err := deserializeEntry(data[offset : offset+apis.EntrySize])
+			if err != nil {
+				continue
+			}
+			chunks++
+			if len(entry.Lagging) > 0 {
+				laggingChunks++
+				laggingReplicas += len(entry.Lagging)
+			}
+		}
+	}
+	stats := mc.leasing.Stats()
+	return []apis.Measurement{
+		{
+			Name:  "zircon_metadatacache_blocks",
+			Help:  "The number of metadata blocks this metadata cache holds the lease on.",
+			Value: float64(len(leases)),
+		},
+		{
+			Name:  "zircon_metadatacache_chunks",
+			Help:  "The number of chunks with entries in the metadata blocks this metadata cache leases.",
+			Value: float64(chunks),
+		},
+		{
+			Name:  "zircon_metadatacache_lagging_chunks",
+			Help:  "The number of those chunks with at least one replica behind the latest version.",
+			Value: float64(laggingChunks),
+		},
+		{
+			Name:  "zircon_metadatacache_lagging_replicas",
+			Help:  "The number of replicas of those chunks that are behind the latest version.",
+			Value: float64(laggingReplicas),
+		},
+		{
+			Name:  "zircon_metadatacache_hits_total",
+			Help:  "The number of lookups of metadata blocks that this metadata cache already had loaded.",
+			Value: float64(stats.Hits),
+		},
+		{
+			Name:  "zircon_metadatacache_misses_total",
+			Help:  "The number of lookups of metadata blocks that had to be loaded from the chunkservers first.",
+			Value: float64(stats.Misses),
+		},
+		{
+			Name:  "zircon_metadatacache_redirects_total",
+			Help:  "The number of requests redirected to the metadata cache that holds the lease on the block.",
+			Value: float64(stats.Redirects),
+		},
+		{
+			Name:  "zircon_metadatacache_lease_expirations_total",
+			Help:  "The number of times this metadata cache lost all of its leases by failing to renew them in time.",
+			Value: float64(stats.LeaseExpirations),
+		},
+	}
+}
+
+// Reports the counts kept by the leasing agent, along with how many blocks we lease and how many entries are allocated
+// in them.
+func (mc *metadatacache) Stats() (apis.MetadataCacheStats, error) {
+	stats := mc.leasing.Stats()
+	leases, err := mc.leasing.ListLeases()
+	if err != nil {
+		return apis.MetadataCacheStats{}, fmt.Errorf("[metrics.go/LLS] %w", err)
+	}
+	for _, metachunk := range leases {
+		data, loaded := mc.leasing.Contents(metachunk)
+		if !loaded {
+			continue
+		}
+		stats.OwnedBlocks++
+		for index := uint32(0); index < 1<<apis.EntriesPerBlock; index++ {
+			if getBitsetInData(data, index) {
+				stats.OwnedEntries++
+			}
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,225 @@
+package metadatacache
+
+import (
+	"fmt"
+	"zircon/apis"
+	"zircon/util"
+)
+
+// The number of metadata entries claimed by a single write to a metadata block. Every write to a metadata block is
+// recorded in etcd, so claiming entries in bulk means that N calls to NewEntry cost roughly N/ReservationSize etcd
+// writes instead of 2N.
+const ReservationSize = 64
+
+// Allocate a new metadata entry and corresponding chunk number, handing out entries from the local reservation and
+// claiming a new reservation whenever it runs dry. With FreeListAllocation, entries freed by DeleteEntry are handed out
+// first.
+func (mc *metadatacache) NewEntry() (apis.ChunkNum, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if chunk, reused := mc.reuseFreed(); reused {
+		return chunk, mc.issue(chunk)
+	}
+
+	var chunk apis.ChunkNum
+	for {
+		if len(mc.reserved) == 0 {
+			reserved, err := mc.reserveEntries()
+			if err != nil {
+				return 0, fmt.Errorf("[reserve.go/RSE] %w", err)
+			}
+			mc.strategy.order(reserved)
+			mc.reserved = reserved
+		}
+		chunk = mc.reserved[0]
+		mc.reserved = mc.reserved[1:]
+		if mc.stillReserved(chunk) {
+			break
+		}
+		mc.logger.Logf(apis.DEBUG, "dropped reserved chunk number %d, which was freed or lost in the meantime", chunk)
+	}
+	if err := mc.issue(chunk); err != nil {
+		return 0, err
+	}
+	if mc.journal != nil && mc.journal.full() {
+		if err := mc.journal.compact(mc.reserved); err != nil {
+			mc.logger.Logf(apis.WARN, "could not compact metadata journal: %v", err)
+		}
+	}
+	return chunk, nil
+}
+
+// Reports whether a reserved entry can still be handed out: whether its block is still this cache's, and the entry is
+// still allocated and empty. Garbage collection deletes entries that stay empty for long enough, reservations
+// included, and a block can be handed off to another cache, so a reservation that sat around for a while may be gone.
+func (mc *metadatacache) stillReserved(chunk apis.ChunkNum) bool {
+	data, loaded := mc.leasing.Contents(ChunkToBlockID(chunk))
+	if !loaded {
+		return false
+	}
+	index := ChunkToEntryNumber(chunk)
+	offset := EntryNumberToOffset(index)
+	return getBitsetInData(data, index) && len(util.StripTrailingZeroes(data[offset:offset+apis.EntrySize])) == 0
+}
+
+// Notes in the journal, if there is one, that an entry is about to be handed out. If that fails, the entry is put
+// back, for NewEntry to hand out later. Must be called with mu held.
+func (mc *metadatacache) issue(chunk apis.ChunkNum) error {
+	if mc.journal == nil {
+		return nil
+	}
+	if err := mc.journal.issue(chunk); err != nil {
+		mc.reserved = append([]apis.ChunkNum{chunk}, mc.reserved...)
+		return fmt.Errorf("[reserve.go/JNI] %w", err)
+	}
+	return nil
+}
+
+// Claims up to ReservationSize free entries within a single metadata block. The claimed entries are marked as
+// allocated in the block's bitset before they are returned, so even if this server restarts before handing them all
+// out, no chunk number in the reservation will ever be issued twice.
+// Entries that are still reserved when the cache is closed are released by Close. With a journal, entries that were
+// reserved but never handed out before a crash are handed out again after the restart. Without one, they stay
+// allocated until garbage collection deletes them as incomplete.
+func (mc *metadatacache) reserveEntries() ([]apis.ChunkNum, error) {
+	for {
+		metachunk, _, err := mc.findAnyFreeChunk()
+		if err != nil {
+			return nil, fmt.Errorf("[reserve.go/FFC] %w", err)
+		}
+
+		data, version, _, err := mc.leasing.Read(metachunk)
+		if err != nil {
+			return nil, fmt.Errorf("[reserve.go/MLR] %w", err)
+		}
+
+		offset, payload, indexes := reserveInData(data, ReservationSize)
+		if len(indexes) == 0 {
+			// someone else filled up the block since we looked at it; try another one
+			continue
+		}
+		chunks := make([]apis.ChunkNum, len(indexes))
+		for i, index := range indexes {
+			chunks[i] = EntryAndBlockToChunkNum(metachunk, index)
+		}
+
+		nver, _, err := mc.journaledWrite(journalReserve, chunks, metachunk, version, offset, payload)
+		if err == nil {
+			return chunks, nil
+		} else if nver == 0 {
+			return nil, fmt.Errorf("[reserve.go/MLW] %w", err)
+		}
+		// version mismatch; go around again!
+	}
+}
+
+// Picks up to count free entries from the contents of a metadata block, and provides the write parameters that claim
+// them: (offset, data, indexes). The write sets the bitset bits for the claimed entries and clears their entry data,
+// while preserving everything else in the covered range, so that it can be applied as a single versioned write.
+func reserveInData(data []byte, count int) (uint32, []byte, []uint32) {
+	var indexes []uint32
+	for index := uint32(0); index < apis.BitsetSize*8 && len(indexes) < count; index++ {
+		if !getBitsetInData(data, index) {
+			indexes = append(indexes, index)
+		}
+	}
+	if len(indexes) == 0 {
+		return 0, nil, nil
+	}
+
+	start := indexes[0] / 8
+	end := EntryNumberToOffset(indexes[len(indexes)-1]) + apis.EntrySize
+	payload := make([]byte, end-start)
+	copy(payload, data[start:end])
+
+	for _, index := range indexes {
+		payload[index/8-start] |= 1 << (index % 8)
+
+		entryOffset := EntryNumberToOffset(index) - start
+		copy(payload[entryOffset:entryOffset+apis.EntrySize], make([]byte, apis.EntrySize))
+	}
+	return start, payload, indexes
+}
+
+// Marks the entries that were reserved, but never handed out, as free again, so that closing the cache doesn't leave
+// them allocated with nothing to hand them out. Entries that were changed or freed since they were reserved, and those
+// in blocks that are no longer this cache's, are left alone. Must be called with mu held.
+func (mc *metadatacache) releaseReserved() error {
+	var blocks []apis.MetadataID
+	indexes := map[apis.MetadataID][]uint32{}
+	for _, chunk := range mc.reserved {
+		metachunk := ChunkToBlockID(chunk)
+		if _, found := indexes[metachunk]; !found {
+			blocks = append(blocks, metachunk)
+		}
+		indexes[metachunk] = append(indexes[metachunk], ChunkToEntryNumber(chunk))
+	}
+	mc.reserved = nil
+	for _, metachunk := range blocks {
+		if err := mc.releaseIn(metachunk, indexes[metachunk]); err != nil {
+			return fmt.Errorf("cannot release reserved entries in block %d: %w", metachunk, err)
+		}
+	}
+	return nil
+}
+
+func (mc *metadatacache) releaseIn(metachunk apis.MetadataID, indexes []uint32) error {
+	for {
+		data, version, owner, err := mc.leasing.Read(metachunk)
+		if owner != apis.NoRedirect {
+			// handed off since; the entries are left for garbage collection
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("[reserve.go/MLR] %w", err)
+		}
+
+		offset, payload, released := releaseInData(data, indexes)
+		if len(released) == 0 {
+			return nil
+		}
+		chunks := make([]apis.ChunkNum, len(released))
+		for i, index := range released {
+			chunks[i] = EntryAndBlockToChunkNum(metachunk, index)
+		}
+
+		nver, _, err := mc.journaledWrite(journalRelease, chunks, metachunk, version, offset, payload)
+		if err == nil {
+			return nil
+		} else if nver == 0 {
+			return fmt.Errorf("[reserve.go/MLW] %w", err)
+		}
+		// version mismatch; go around again!
+	}
+}
+
+// Picks those of 'indexes' that are still allocated and empty from the contents of a metadata block, and provides the
+// write parameters that free them: (offset, data, indexes). Only the bitset is covered by the write, since the entries
+// are already empty.
+func releaseInData(data []byte, indexes []uint32) (uint32, []byte, []uint32) {
+	var released []uint32
+	start, end := uint32(apis.BitsetSize), uint32(0)
+	for _, index := range indexes {
+		offset := EntryNumberToOffset(index)
+		if !getBitsetInData(data, index) || len(util.StripTrailingZeroes(data[offset:offset+apis.EntrySize])) != 0 {
+			continue
+		}
+		released = append(released, index)
+		if index/8 < start {
+			start = index / 8
+		}
+		if index/8+1 > end {
+			end = index/8 + 1
+		}
+	}
+	if len(released) == 0 {
+		return 0, nil, nil
+	}
+
+	payload := make([]byte, end-start)
+	copy(payload, data[start:end])
+	for _, index := range released {
+		payload[index/8-start] &^= 1 << (index % 8)
+	}
+	return start, payload, released
+}
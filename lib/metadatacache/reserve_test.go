@@ -0,0 +1,156 @@
+package metadatacache
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"zircon/apis"
+)
+
+// Applies a reservation write to the persisted contents of a metadata block.
+func applyReservation(t *testing.T, data []byte, count int) []uint32 {
+	offset, payload, indexes := reserveInData(data, count)
+	assert.NotEmpty(t, indexes)
+	copy(data[offset:], payload)
+	return indexes
+}
+
+// Tests that reservations never hand out the same entry twice, even when the in-memory reservation is lost by a
+// simulated restart partway through.
+func TestReserveNoReuseAcrossRestart(t *testing.T) {
+	data := make([]byte, EntryNumberToOffset(1<<apis.EntriesPerBlock))
+
+	// pretend that a few entries were allocated and then one was deleted
+	for _, index := range []uint32{0, 1, 2, 5, 70} {
+		data[index/8] |= 1 << (index % 8)
+	}
+	data[1/8] &^= 1 << 1
+	copy(data[EntryNumberToOffset(1):], []byte("stale entry data"))
+	copy(data[EntryNumberToOffset(2):], []byte("live entry data"))
+
+	seen := map[uint32]bool{0: true, 2: true, 5: true, 70: true}
+
+	first := applyReservation(t, data, ReservationSize)
+	assert.Equal(t, ReservationSize, len(first))
+	assert.Equal(t, uint32(1), first[0])
+	for _, index := range first {
+		assert.False(t, seen[index])
+		seen[index] = true
+		assert.True(t, getBitsetInData(data, index))
+		assert.Equal(t, make([]byte, apis.EntrySize), data[EntryNumberToOffset(index):EntryNumberToOffset(index+1)])
+	}
+	assert.Equal(t, "live entry data", string(data[EntryNumberToOffset(2):EntryNumberToOffset(2)+15]))
+
+	for i := 0; i < 10; i++ {
+		for _, index := range applyReservation(t, data, ReservationSize) {
+			assert.False(t, seen[index])
+			seen[index] = true
+		}
+	}
+	assert.Equal(t, 4+11*ReservationSize, len(seen))
+}
+
+// Tests that a reservation in a nearly-full block returns only what's left, and nothing once it's full.
+func TestReserveFullBlock(t *testing.T) {
+	data := make([]byte, EntryNumberToOffset(1<<apis.EntriesPerBlock))
+	for i := 0; i < apis.BitsetSize; i++ {
+		data[i] = 0xFF
+	}
+	last := uint32(1<<apis.EntriesPerBlock) - 1
+	data[last/8] &^= 1 << (last % 8)
+
+	indexes := applyReservation(t, data, ReservationSize)
+	assert.Equal(t, []uint32{last}, indexes)
+
+	_, payload, indexes := reserveInData(data, ReservationSize)
+	assert.Empty(t, payload)
+	assert.Empty(t, indexes)
+}
+
+// Tests that releasing a reservation frees only the entries that are still allocated and empty.
+func TestReleaseInData(t *testing.T) {
+	data := make([]byte, EntryNumberToOffset(1<<apis.EntriesPerBlock))
+	reserved := applyReservation(t, data, 20)
+	copy(data[EntryNumberToOffset(reserved[3]):], []byte("handed out and written"))
+
+	offset, payload, released := releaseInData(data, []uint32{reserved[19], reserved[3], reserved[10]})
+	assert.Equal(t, []uint32{reserved[19], reserved[10]}, released)
+	copy(data[offset:], payload)
+	for i, index := range reserved {
+		assert.Equal(t, i != 10 && i != 19, getBitsetInData(data, index))
+	}
+
+	_, payload, released = releaseInData(data, []uint32{reserved[19], reserved[3]})
+	assert.Empty(t, payload)
+	assert.Empty(t, released)
+}
+
+// Issues 'count' entries from 'cache', checking that none of them were issued before, according to 'issued'.
+func issueEntries(t *testing.T, cache apis.MetadataCache, count int, issued map[apis.ChunkNum]bool) []apis.ChunkNum {
+	var chunks []apis.ChunkNum
+	for i := 0; i < count; i++ {
+		chunk, err := cache.NewEntry()
+		require.NoError(t, err)
+		assert.False(t, issued[chunk], "chunk %d issued twice", chunk)
+		issued[chunk] = true
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// Tests that a cache that is closed and started again never issues a chunk number twice, and hands back the entries it
+// had reserved but never issued.
+func TestReserveAcrossCacheRestart(t *testing.T) {
+	etcdn, conn, teardown := prepareCacheEnvironment(t, "mc1")
+	defer teardown()
+
+	issued := map[apis.ChunkNum]bool{}
+	cache, err := NewCache(conn, etcdn)
+	require.NoError(t, err)
+	first := issueEntries(t, cache, 3, issued)
+	require.NoError(t, cache.Close())
+
+	cache, err = NewCache(conn, etcdn)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, cache.Close())
+	}()
+	// the rest of the reservation is free again
+	_, _, err = cache.ReadEntry(first[2] + 1)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+
+	issueEntries(t, cache, 2*ReservationSize, issued)
+}
+
+// Tests that a cache with a journal that stops without being closed hands out the rest of its reservation once it is
+// started again, instead of leaving those entries allocated.
+func TestReserveAcrossCacheCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := Configuration{JournalPath: path.Join(dir, "journal")}
+
+	etcdn, conn, teardown := prepareCacheEnvironment(t, "mc1")
+	defer teardown()
+
+	issued := map[apis.ChunkNum]bool{}
+	cache, err := ConfigureCache(conn, etcdn, apis.NoopLogger, config)
+	require.NoError(t, err)
+	first := issueEntries(t, cache, 3, issued)
+	// stop the cache without releasing anything, as if it crashed
+	crashed := cache.(*metadatacache)
+	require.NoError(t, crashed.leasing.Stop())
+	require.NoError(t, crashed.journal.close())
+
+	cache, err = ConfigureCache(conn, etcdn, apis.NoopLogger, config)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, cache.Close())
+	}()
+	next := issueEntries(t, cache, 2*ReservationSize, issued)
+	assert.Equal(t, first[2]+1, next[0])
+}
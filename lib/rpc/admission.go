@@ -0,0 +1,155 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+	"zircon/apis"
+)
+
+// Explanation of admission control:
+//     A chunkserver holds the data of each write that it is sent in memory from when the call arrives, through staging
+//     it (see StartWrite), until it is committed. Staging is bounded by the chunkserver itself, which refuses writes that
+//     it has no room to stage, but calls that arrive faster than they can be handled would otherwise each have their
+//     data read in before that, without any bound, and leave the chunkserver further behind the more of them there are.
+//     Admission control bounds them: calls that carry write data are handled at most MaxWrites at a time, with up to
+//     MaxQueued more waiting their turn, and all of them together may carry at most MaxBytes of data, as counted from
+//     the lengths of their requests before they are read. Calls beyond those bounds are refused straight away, before
+//     their data is read, with an apis.RetryAfterError that matches apis.ErrBusy and tells the caller how long to back
+//     off for. Chunkservers that run out of room to stage writes refuse them the same way, matching apis.ErrStagingFull.
+//     Calls that don't carry write data aren't limited, since they hold little until they respond.
+
+// How long callers refused by admission control are told to wait before trying again, unless the limits say otherwise.
+const DefaultRetryAfter = 100 * time.Millisecond
+
+// Bounds the calls carrying write data that a chunkserver takes on at once. The zero value doesn't limit them.
+type AdmissionLimits struct {
+	// The most such calls handled at once. Zero means no limit, in which case MaxQueued is unused.
+	MaxWrites int `yaml:"max-writes"`
+	// How many more calls wait for one of those to finish before further calls are refused.
+	MaxQueued int `yaml:"max-queued"`
+	// The most bytes carried by the calls being handled and waiting, together. Zero means no limit. A call larger than
+	// this is still let in when nothing else is, so that it isn't refused forever.
+	MaxBytes int64 `yaml:"max-bytes"`
+	// How long refused callers are told to wait before trying again. Zero takes DefaultRetryAfter.
+	RetryAfter time.Duration `yaml:"retry-after"`
+}
+
+// The methods of each service whose calls carry write data, and so are subject to admission control.
+var writeMethods = map[string][]string{
+	"Chunkserver": {"StartWrite", "StartWriteReplicated", "StartAppend", "Add"},
+}
+
+func carriesWrite(call Call) bool {
+	for _, method := range writeMethods[call.Service] {
+		if call.Method == method {
+			return true
+		}
+	}
+	return false
+}
+
+// The calls that a server has taken on under its AdmissionLimits.
+type admission struct {
+	limits AdmissionLimits
+	// holds a token for each call being handled, if the number of them is limited
+	slots chan struct{}
+
+	mu sync.Mutex
+	// the calls being handled and waiting, and the bytes they carry
+	admitted int
+	bytes    int64
+}
+
+// Returns nil if 'limits' doesn't limit anything.
+func newAdmission(limits AdmissionLimits) *admission {
+	if limits.MaxWrites <= 0 && limits.MaxBytes <= 0 {
+		return nil
+	}
+	if limits.RetryAfter <= 0 {
+		limits.RetryAfter = DefaultRetryAfter
+	}
+	a := &admission{limits: limits}
+	if limits.MaxWrites > 0 {
+		a.slots = make(chan struct{}, limits.MaxWrites)
+	}
+	return a
+}
+
+// Takes on a call that carries 'size' bytes, waiting for a turn to handle it if need be, or refuses it. Once it has
+// been handled, or if ctx ends while it waits, the returned function must be called.
+func (a *admission) admit(ctx context.Context, size int64) (release func(), err error) {
+	a.mu.Lock()
+	if a.limits.MaxBytes > 0 && a.admitted > 0 && a.bytes+size > a.limits.MaxBytes {
+		bytes := a.bytes
+		a.mu.Unlock()
+		return nil, apis.RetryAfterError{
+			Err:        fmt.Errorf("%d bytes of writes already in progress: %w", bytes, apis.ErrBusy),
+			RetryAfter: a.limits.RetryAfter,
+		}
+	}
+	if a.slots != nil && a.admitted >= a.limits.MaxWrites+a.limits.MaxQueued {
+		admitted := a.admitted
+		a.mu.Unlock()
+		return nil, apis.RetryAfterError{
+			Err:        fmt.Errorf("%d writes already in progress or waiting: %w", admitted, apis.ErrBusy),
+			RetryAfter: a.limits.RetryAfter,
+		}
+	}
+	a.admitted++
+	a.bytes += size
+	a.mu.Unlock()
+
+	leave := func() {
+		a.mu.Lock()
+		a.admitted--
+		a.bytes -= size
+		a.mu.Unlock()
+	}
+	if a.slots == nil {
+		return leave, nil
+	}
+	select {
+	case a.slots <- struct{}{}:
+		return func() {
+			<-a.slots
+			leave()
+		}, nil
+	case <-ctx.Done():
+		leave()
+		return nil, contextError(ctx, ctx.Err())
+	}
+}
+
+// How many bytes a request carries, as far as can be told before reading it. Requests that don't say, such as those
+// whose bodies were compressed, are counted as carrying as much as a single call can.
+func requestSize(request *http.Request) int64 {
+	if request.ContentLength >= 0 {
+		return request.ContentLength
+	}
+	return apis.MaxChunkSize
+}
+
+// Applies 'limits' to the calls that 'handler' serves, refusing those beyond them before reading any of their data.
+func withAdmission(handler http.Handler, limits AdmissionLimits) http.Handler {
+	a := newAdmission(limits)
+	if a == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		call, ok := rpcCall(request.URL.Path)
+		if !ok || !carriesWrite(call) {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		release, err := a.admit(request.Context(), requestSize(request))
+		if err != nil {
+			writeCallError(writer, request.URL.Path, err)
+			return
+		}
+		defer release()
+		handler.ServeHTTP(writer, request)
+	})
+}
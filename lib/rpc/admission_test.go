@@ -0,0 +1,133 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"zircon/apis"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const startWritePath = "/twirp/zircon.rpc.twirp.Chunkserver/StartWrite"
+
+// A handler that holds each call until it is let go, and reports when each one arrives.
+type holdingHandler struct {
+	arrived chan string
+	release chan struct{}
+}
+
+func newHoldingHandler() *holdingHandler {
+	return &holdingHandler{arrived: make(chan string, 10), release: make(chan struct{})}
+}
+
+func (h *holdingHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+	h.arrived <- string(body)
+	<-h.release
+	writer.WriteHeader(http.StatusOK)
+}
+
+// Makes a call with 'body' to 'path', and returns the error it was refused with, if any.
+func post(t *testing.T, server *httptest.Server, path string, body string) error {
+	response, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	return responseError(response.Request.URL.Path, response.StatusCode, response.Header, data)
+}
+
+func assertRetryAfter(t *testing.T, err error, after time.Duration) {
+	var busy apis.RetryAfterError
+	if assert.True(t, errors.As(err, &busy), "%v", err) {
+		assert.Equal(t, after, busy.RetryAfter)
+	}
+	assert.True(t, errors.Is(err, apis.ErrBusy))
+}
+
+// Tests that calls carrying writes beyond those being handled and waiting are refused, telling the caller when to try
+// again, and that other calls aren't held back.
+func TestAdmissionQueue(t *testing.T) {
+	handler := newHoldingHandler()
+	server := httptest.NewServer(withAdmission(handler, AdmissionLimits{MaxWrites: 1, MaxQueued: 1}))
+	defer server.Close()
+
+	results := make(chan error, 2)
+	go func() {
+		results <- post(t, server, startWritePath, "first")
+	}()
+	assert.Equal(t, "first", <-handler.arrived)
+	go func() {
+		results <- post(t, server, startWritePath, "second")
+	}()
+	// waits for the first to finish, rather than being refused
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case body := <-handler.arrived:
+		t.Fatalf("%s was handled while another write was", body)
+	default:
+	}
+
+	assertRetryAfter(t, post(t, server, WriteStreamPath+"?chunk=1&offset=0", "third"), DefaultRetryAfter)
+	assertRetryAfter(t, post(t, server, startWritePath, "fourth"), DefaultRetryAfter)
+
+	// reads aren't limited
+	go func() {
+		_ = post(t, server, "/twirp/zircon.rpc.twirp.Chunkserver/Read", "read")
+	}()
+	assert.Equal(t, "read", <-handler.arrived)
+
+	close(handler.release)
+	assert.Equal(t, "second", <-handler.arrived)
+	assert.NoError(t, <-results)
+	assert.NoError(t, <-results)
+	// once they are done, there is room again
+	assert.NoError(t, post(t, server, startWritePath, "fifth"))
+}
+
+// Tests that calls are refused once those in progress carry too much data, before their data is read, unless nothing
+// else is in progress.
+func TestAdmissionBytes(t *testing.T) {
+	handler := newHoldingHandler()
+	server := httptest.NewServer(withAdmission(handler, AdmissionLimits{MaxBytes: 100, RetryAfter: 3 * time.Second}))
+	defer server.Close()
+
+	large := strings.Repeat("x", 80)
+	done := make(chan error, 1)
+	go func() {
+		done <- post(t, server, startWritePath, large)
+	}()
+	assert.Equal(t, large, <-handler.arrived)
+	assertRetryAfter(t, post(t, server, startWritePath, strings.Repeat("y", 30)), 3*time.Second)
+	close(handler.release)
+	assert.NoError(t, <-done)
+
+	// alone, a call larger than the limit still gets through
+	assert.NoError(t, post(t, server, startWritePath, strings.Repeat("z", 200)))
+	assert.Equal(t, 200, len(<-handler.arrived))
+}
+
+// Tests that a refused streamed write reaches the client with how long to wait before trying again.
+func TestAdmissionStreamed(t *testing.T) {
+	handler := newHoldingHandler()
+	server := httptest.NewServer(withAdmission(handler, AdmissionLimits{MaxWrites: 1, RetryAfter: 1500 * time.Millisecond}))
+	defer server.Close()
+
+	go func() {
+		_ = post(t, server, startWritePath, "first")
+	}()
+	<-handler.arrived
+	defer close(handler.release)
+
+	data := []byte("streamed")
+	client := streamClient{address: apis.ServerAddress(strings.TrimPrefix(server.URL, "http://")), client: &http.Client{}}
+	err := client.startWrite(context.Background(), 7, 0, data)
+	assertRetryAfter(t, err, 1500*time.Millisecond)
+}
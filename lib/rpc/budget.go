@@ -0,0 +1,73 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The least time that must be left before a context's deadline for a call to be started under it. A call with less time
+// than this left would most likely run out partway through, after the server had already started on it, so it fails
+// right away instead.
+const MinimumCallBudget = 10 * time.Millisecond
+
+// The header that carries the time a call has left before its deadline, in nanoseconds. The time left is sent rather
+// than the deadline itself, so that the clocks of the two servers don't need to agree.
+const budgetHeader = "Zircon-Budget"
+
+// Included in the message of every error from CheckBudget, so that the failure can still be recognized once it has been
+// passed back through twirp by a server that failed its own call.
+const budgetExhausted = "deadline budget exhausted"
+
+// Fails if ctx has been cancelled or has less than MinimumCallBudget left before its deadline. The error matches
+// context.DeadlineExceeded unless ctx was cancelled outright.
+func CheckBudget(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining < MinimumCallBudget {
+			return fmt.Errorf("%s: only %v left: %w", budgetExhausted, remaining, context.DeadlineExceeded)
+		}
+	}
+	return nil
+}
+
+// Passes the deadline of each request's context along to the server, and refuses to send requests that don't have
+// enough time left to finish. Also presents the capability that the call is to present, if any; see Capability.
+type budgetClient struct {
+	client *http.Client
+}
+
+func (b budgetClient) Do(request *http.Request) (*http.Response, error) {
+	if err := CheckBudget(request.Context()); err != nil {
+		return nil, err
+	}
+	if deadline, ok := request.Context().Deadline(); ok {
+		request.Header.Set(budgetHeader, strconv.FormatInt(int64(time.Until(deadline)), 10))
+	}
+	if capability := presentedCapability(request.Context()); capability != "" {
+		request.Header.Set(capabilityHeader, string(capability))
+	}
+	return b.client.Do(request)
+}
+
+// Gives each request that arrives with a budget a context with the corresponding deadline, so that the calls the server
+// makes on its behalf share the caller's deadline.
+func withBudget(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if header := request.Header.Get(budgetHeader); header != "" {
+			budget, err := strconv.ParseInt(header, 10, 64)
+			if err != nil {
+				http.Error(writer, "invalid "+budgetHeader+" header", http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := context.WithTimeout(request.Context(), time.Duration(budget))
+			defer cancel()
+			request = request.WithContext(ctx)
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,141 @@
+package rpc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"zircon/apis"
+)
+
+// Explanation of capabilities:
+//     Clients read chunks from their replicas, and stage writes on them, by calling the chunkservers directly rather
+//     than through the frontend that checked the chunk's ACL. A chunkserver published with ServerOptions.Cluster set
+//     only takes those calls from the cluster's own servers, and from callers that present a capability for the chunk:
+//     proof that a frontend handed them its metadata entry, which the ACL only lets the frontend do for those it
+//     permits ReadAccess. Frontends published with a ServerOptions.CapabilityKey issue one with every entry they
+//     return, signed with the key, which every frontend and chunkserver in the cluster must share.
+//     A capability is only good for the chunk and the caller it was issued for, and only until CapabilityLifetime has
+//     passed, so that it is no use to anyone it is passed on to, or once the chunk's number has been handed out again.
+//     Staging a write doesn't change the chunk, so a capability is enough for that too; the write only takes effect
+//     when it is committed through a frontend, which checks for WriteAccess. Everything else that changes a
+//     chunkserver's chunks, such as committing writes or deleting chunks, is only taken from the cluster's servers.
+//     Clients collect capabilities under a context made by ContextWithCapabilities: each metadata entry read through a
+//     frontend bound to it adds one, and the calls made through chunkservers bound to it present the one for their
+//     chunk. See FrontendWithContext and ChunkserverWithContext.
+
+// A frontend's signature on a chunk for a caller, which lets the caller access the chunk's replicas directly.
+type Capability string
+
+// How long a capability is good for once it is issued.
+const CapabilityLifetime = time.Hour
+
+// The header, or gRPC metadata key, that carries the capability that a call presents.
+const capabilityHeader = "Zircon-Capability"
+
+func capabilityMAC(key []byte, chunk apis.ChunkNum, principal apis.Principal, expires int64) []byte {
+	var message [24]byte
+	binary.LittleEndian.PutUint64(message[0:], uint64(chunk))
+	binary.LittleEndian.PutUint64(message[8:], uint64(principal))
+	binary.LittleEndian.PutUint64(message[16:], uint64(expires))
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(message[:])
+	return mac.Sum(nil)
+}
+
+// Issues a capability for 'chunk' to 'principal', signed with 'key', which expires at 'expiry'.
+func issueCapability(key []byte, chunk apis.ChunkNum, principal apis.Principal, expiry time.Time) Capability {
+	expires := expiry.UnixNano()
+	return Capability(strconv.FormatInt(expires, 10) + "." + hex.EncodeToString(capabilityMAC(key, chunk, principal, expires)))
+}
+
+// Fails unless the capability was signed with 'key' for 'chunk' and 'principal', and is still good at 'now'.
+func (c Capability) check(key []byte, chunk apis.ChunkNum, principal apis.Principal, now time.Time) error {
+	if len(key) == 0 {
+		return errors.New("no capability key is configured")
+	}
+	dot := strings.IndexByte(string(c), '.')
+	if dot < 0 {
+		return errors.New("malformed capability")
+	}
+	expires, err := strconv.ParseInt(string(c[:dot]), 10, 64)
+	if err != nil {
+		return errors.New("malformed capability")
+	}
+	mac, err := hex.DecodeString(string(c[dot+1:]))
+	if err != nil || !hmac.Equal(mac, capabilityMAC(key, chunk, principal, expires)) {
+		return fmt.Errorf("capability was not issued for chunk %d to caller %016x", chunk, uint64(principal))
+	}
+	if now.UnixNano() > expires {
+		return fmt.Errorf("capability for chunk %d expired at %v", chunk, time.Unix(0, expires))
+	}
+	return nil
+}
+
+// The capabilities collected under a context made by ContextWithCapabilities.
+type capabilities struct {
+	mu     sync.Mutex
+	issued map[apis.ChunkNum]Capability
+}
+
+type capabilitiesKey struct{}
+
+// The capability that a call presents, or that was presented with the call that ctx belongs to.
+type presentedKey struct{}
+
+// Returns a context under which the capabilities that frontends issue are collected, so that calls to chunkservers made
+// under it can present them. Returns ctx itself if it already collects them.
+func ContextWithCapabilities(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(capabilitiesKey{}).(*capabilities); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, capabilitiesKey{}, &capabilities{issued: map[apis.ChunkNum]Capability{}})
+}
+
+// Keeps a capability that a frontend issued for 'chunk', if ctx collects them.
+func collectCapability(ctx context.Context, chunk apis.ChunkNum, capability Capability) {
+	collected, ok := ctx.Value(capabilitiesKey{}).(*capabilities)
+	if !ok || capability == "" {
+		return
+	}
+	collected.mu.Lock()
+	defer collected.mu.Unlock()
+	collected.issued[chunk] = capability
+}
+
+// Returns the context for a call on 'chunk', which presents the capability collected for it under ctx, if there is one.
+// Otherwise, a server's calls on behalf of a client carry on presenting whatever the client presented.
+func presentCapability(ctx context.Context, chunk apis.ChunkNum) context.Context {
+	collected, ok := ctx.Value(capabilitiesKey{}).(*capabilities)
+	if !ok {
+		return ctx
+	}
+	collected.mu.Lock()
+	capability, found := collected.issued[chunk]
+	collected.mu.Unlock()
+	if !found {
+		return ctx
+	}
+	return contextWithPresented(ctx, capability)
+}
+
+// Returns the capability presented with the call that ctx belongs to, or that a call made under ctx is to present.
+func presentedCapability(ctx context.Context) Capability {
+	capability, _ := ctx.Value(presentedKey{}).(Capability)
+	return capability
+}
+
+// Returns a context recording that the call it belongs to presented 'capability', unless it presented none.
+func contextWithPresented(ctx context.Context, capability Capability) context.Context {
+	if capability == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, presentedKey{}, capability)
+}
@@ -2,7 +2,8 @@ package rpc
 
 import (
 	"context"
-	"errors"
+	"crypto/tls"
+	"fmt"
 	"net/http"
 	"zircon/apis"
 	"zircon/rpc/twirp"
@@ -10,75 +11,250 @@ import (
 
 // Connects to an RPC handler for a Chunkserver on a certain address.
 func UncachedSubscribeChunkserver(address apis.ServerAddress, client *http.Client) (apis.Chunkserver, error) {
-	saddr := "http://" + string(address)
-	tserve := twirp.NewChunkserverProtobufClient(saddr, client)
+	saddr := serverURL(address, client)
+	tserve := twirp.NewChunkserverProtobufClient(saddr, budgetClient{client})
 
-	return &proxyTwirpAsChunkserver{server: tserve}, nil
+	return &proxyTwirpAsChunkserver{
+		server: tserve,
+		stream: &streamClient{address: address, client: client},
+		ctx:    context.Background(),
+	}, nil
+}
+
+// Implemented by Chunkservers that make RPCs of their own, such as to forward a write to the other replicas, so that
+// those RPCs can be bound to a caller's context too.
+type ContextualChunkserver interface {
+	apis.Chunkserver
+	WithContext(ctx context.Context) apis.Chunkserver
 }
 
-// Starts serving an RPC handler for a Chunkserver on a certain address. Runs forever.
+// Rebinds a Chunkserver obtained from this package so that its RPCs carry ctx, allowing callers to impose deadlines and
+// cancellation on the underlying transport. A ContextualChunkserver is rebound through WithContext. Other
+// implementations are returned unchanged.
+func ChunkserverWithContext(ctx context.Context, server apis.Chunkserver) apis.Chunkserver {
+	if proxy, ok := server.(*proxyTwirpAsChunkserver); ok {
+		return &proxyTwirpAsChunkserver{server: proxy.server, stream: proxy.stream, ctx: ctx}
+	}
+	if contextual, ok := server.(ContextualChunkserver); ok {
+		return contextual.WithContext(ctx)
+	}
+	return server
+}
+
+// Starts serving an RPC handler for a Chunkserver on a certain address, along with the endpoints at LivenessPath,
+// ReadinessPath and MetricsPath, and those for streamed transfers at ReadStreamPath and WriteStreamPath. Runs forever.
 func PublishChunkserver(server apis.Chunkserver, address apis.ServerAddress) (func(kill bool) error, apis.ServerAddress, error) {
-	tserve := twirp.NewChunkserverServer(&proxyChunkserverAsTwirp{server: server}, nil)
-	return LaunchEmbeddedHTTP(tserve, address)
+	return PublishChunkserverWithTLS(server, address, nil)
+}
+
+// Like PublishChunkserver, but serves over TLS with 'config', unless it is nil. See TLSConfiguration.
+func PublishChunkserverWithTLS(server apis.Chunkserver, address apis.ServerAddress, config *tls.Config) (func(kill bool) error, apis.ServerAddress, error) {
+	return PublishChunkserverWithOptions(server, address, ServerOptions{TLS: config})
+}
+
+// Like PublishChunkserverWithTLS, but takes all of the options at once, including those that can't be chosen any
+// other way.
+func PublishChunkserverWithOptions(server apis.Chunkserver, address apis.ServerAddress, options ServerOptions) (func(kill bool) error, apis.ServerAddress, error) {
+	if options.Transport == GRPCTransport {
+		return publishGRPCChunkserver(server, address, options)
+	}
+	tserve := twirp.NewChunkserverServer(&proxyChunkserverAsTwirp{server: server, guard: options.guard()}, nil)
+	handler := options.wrap(withStreams(tserve, server, options.guard()), "chunkserver")
+	return LaunchEmbeddedHTTPWithTLS(withMetrics(withHealth(handler, "chunkserver", server), "chunkserver", server), address, options.TLS)
 }
 
 type proxyChunkserverAsTwirp struct {
 	server apis.Chunkserver
+	// the cluster's servers can make every call, but clients only those that read or stage data, with a capability
+	guard guard
+}
+
+// Chunk data sent in either direction carries the checksum the sender took of it, which the receiver checks before
+// doing anything with the data, so that data damaged between the two is never staged, stored, or returned to a caller.
+// A chunkserver that forwards a write to the other replicas checks it on receipt, and its forwarded copies carry a
+// checksum of their own that those replicas check in turn. Chunkservers keep checking the data they stage until it is
+// stored; see chunkserver/control.
+
+// Checks that data received in a request matches the checksum it was sent with.
+func checkReceived(data []byte, checksum uint32) error {
+	if err := apis.VerifyChecksum(data, apis.Checksum(checksum)); err != nil {
+		return fmt.Errorf("data was damaged in transit: %w", err)
+	}
+	return nil
 }
 
-func (p *proxyChunkserverAsTwirp) StartWriteReplicated(context context.Context, input *twirp.Chunkserver_StartWriteReplicated) (*twirp.Nothing, error) {
-	err := p.server.StartWriteReplicated(apis.ChunkNum(input.Chunk), input.Offset, input.Data, StringArrayToAddressArray(input.Addresses))
-	return &twirp.Nothing{}, err
+// The forwarded writes share the deadline of the request, if it has one.
+func (p *proxyChunkserverAsTwirp) StartWriteReplicated(ctx context.Context, input *twirp.Chunkserver_StartWriteReplicated) (*twirp.Nothing, error) {
+	if err := p.guard.checkDirect(ctx, apis.ChunkNum(input.Chunk)); err != nil {
+		return &twirp.Nothing{}, encodeError(err)
+	}
+	if err := checkReceived(input.Data, input.Checksum); err != nil {
+		return &twirp.Nothing{}, encodeError(err)
+	}
+	err := ChunkserverWithContext(ctx, p.server).StartWriteReplicated(apis.ChunkNum(input.Chunk), input.Offset, input.Data, StringArrayToAddressArray(input.Addresses))
+	return &twirp.Nothing{}, encodeError(err)
 }
 
-func (p *proxyChunkserverAsTwirp) Replicate(context context.Context, input *twirp.Chunkserver_Replicate) (*twirp.Nothing, error) {
-	err := p.server.Replicate(apis.ChunkNum(input.Chunk), apis.ServerAddress(input.ServerAddress), apis.Version(input.Version))
-	return &twirp.Nothing{}, err
+func (p *proxyChunkserverAsTwirp) Replicate(ctx context.Context, input *twirp.Chunkserver_Replicate) (*twirp.Nothing, error) {
+	if err := p.guard.checkCluster(ctx); err != nil {
+		return &twirp.Nothing{}, encodeError(err)
+	}
+	err := ChunkserverWithContext(ctx, p.server).Replicate(apis.ChunkNum(input.Chunk), apis.ServerAddress(input.ServerAddress), apis.Version(input.Version))
+	return &twirp.Nothing{}, encodeError(err)
 }
 
-func (p *proxyChunkserverAsTwirp) Read(context context.Context, input *twirp.Chunkserver_Read) (*twirp.Chunkserver_Read_Result, error) {
+func (p *proxyChunkserverAsTwirp) Read(ctx context.Context, input *twirp.Chunkserver_Read) (*twirp.Chunkserver_Read_Result, error) {
+	if err := p.guard.checkDirect(ctx, apis.ChunkNum(input.Chunk)); err != nil {
+		return nil, encodeError(err)
+	}
 	data, version, err := p.server.Read(apis.ChunkNum(input.Chunk), input.Offset, input.Length, apis.Version(input.Version))
-	message := ""
+	message, code := "", codeNone
 	if err != nil {
 		message = err.Error()
 		if message == "" {
 			panic("expected nonempty error code")
 		}
+		// a stale version is already carried by the version field
+		code, _, _ = errorFields(err)
 	}
 	return &twirp.Chunkserver_Read_Result{
-		Data:    data,
-		Version: uint64(version),
-		Error:   message,
+		Data:      data,
+		Version:   uint64(version),
+		Error:     message,
+		ErrorCode: code,
+		Checksum:  uint32(apis.CalculateChecksum(data)),
 	}, nil
 }
 
-func (p *proxyChunkserverAsTwirp) StartWrite(context context.Context, input *twirp.Chunkserver_StartWrite) (*twirp.Nothing, error) {
+func (p *proxyChunkserverAsTwirp) ReadWithChecksum(ctx context.Context, input *twirp.Chunkserver_Read) (*twirp.Chunkserver_ReadWithChecksum_Result, error) {
+	if err := p.guard.checkDirect(ctx, apis.ChunkNum(input.Chunk)); err != nil {
+		return nil, encodeError(err)
+	}
+	data, version, checksum, err := p.server.ReadWithChecksum(apis.ChunkNum(input.Chunk), input.Offset, input.Length, apis.Version(input.Version))
+	message, code := "", codeNone
+	if err != nil {
+		message = err.Error()
+		if message == "" {
+			panic("expected nonempty error code")
+		}
+		code, _, _ = errorFields(err)
+	}
+	return &twirp.Chunkserver_ReadWithChecksum_Result{
+		Data:      data,
+		Version:   uint64(version),
+		Error:     message,
+		ErrorCode: code,
+		Checksum:  uint32(checksum),
+	}, nil
+}
+
+func (p *proxyChunkserverAsTwirp) ReadVersion(ctx context.Context, input *twirp.Chunkserver_ReadVersion) (*twirp.Chunkserver_ReadVersion_Result, error) {
+	if err := p.guard.checkDirect(ctx, apis.ChunkNum(input.Chunk)); err != nil {
+		return nil, encodeError(err)
+	}
+	data, err := p.server.ReadVersion(apis.ChunkNum(input.Chunk), input.Offset, input.Length, apis.Version(input.Version))
+	return &twirp.Chunkserver_ReadVersion_Result{
+		Data:     data,
+		Checksum: uint32(apis.CalculateChecksum(data)),
+	}, encodeError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) StartWrite(ctx context.Context, input *twirp.Chunkserver_StartWrite) (*twirp.Nothing, error) {
+	if err := p.guard.checkDirect(ctx, apis.ChunkNum(input.Chunk)); err != nil {
+		return &twirp.Nothing{}, encodeError(err)
+	}
+	if err := checkReceived(input.Data, input.Checksum); err != nil {
+		return &twirp.Nothing{}, encodeError(err)
+	}
 	err := p.server.StartWrite(apis.ChunkNum(input.Chunk), input.Offset, input.Data)
-	return &twirp.Nothing{}, err
+	return &twirp.Nothing{}, encodeError(err)
 }
 
-func (p *proxyChunkserverAsTwirp) CommitWrite(context context.Context, input *twirp.Chunkserver_CommitWrite) (*twirp.Nothing, error) {
+func (p *proxyChunkserverAsTwirp) CommitWrite(ctx context.Context, input *twirp.Chunkserver_CommitWrite) (*twirp.Nothing, error) {
+	if err := p.guard.checkCluster(ctx); err != nil {
+		return &twirp.Nothing{}, encodeError(err)
+	}
 	err := p.server.CommitWrite(apis.ChunkNum(input.Chunk), apis.CommitHash(input.Hash), apis.Version(input.OldVersion), apis.Version(input.NewVersion))
-	return &twirp.Nothing{}, err
+	return &twirp.Nothing{}, encodeError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) StartAppend(ctx context.Context, input *twirp.Chunkserver_StartAppend) (*twirp.Nothing, error) {
+	if err := p.guard.checkDirect(ctx, apis.ChunkNum(input.Chunk)); err != nil {
+		return &twirp.Nothing{}, encodeError(err)
+	}
+	if err := checkReceived(input.Data, input.Checksum); err != nil {
+		return &twirp.Nothing{}, encodeError(err)
+	}
+	err := p.server.StartAppend(apis.ChunkNum(input.Chunk), input.Data)
+	return &twirp.Nothing{}, encodeError(err)
 }
 
-func (p *proxyChunkserverAsTwirp) UpdateLatestVersion(context context.Context, input *twirp.Chunkserver_UpdateLatestVersion) (*twirp.Nothing, error) {
+func (p *proxyChunkserverAsTwirp) CommitAppend(ctx context.Context, input *twirp.Chunkserver_CommitWrite) (*twirp.Chunkserver_CommitAppend_Result, error) {
+	if err := p.guard.checkCluster(ctx); err != nil {
+		return nil, encodeError(err)
+	}
+	offset, err := p.server.CommitAppend(apis.ChunkNum(input.Chunk), apis.CommitHash(input.Hash), apis.Version(input.OldVersion), apis.Version(input.NewVersion))
+	return &twirp.Chunkserver_CommitAppend_Result{
+		Offset: offset,
+	}, encodeError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) UpdateLatestVersion(ctx context.Context, input *twirp.Chunkserver_UpdateLatestVersion) (*twirp.Nothing, error) {
+	if err := p.guard.checkCluster(ctx); err != nil {
+		return &twirp.Nothing{}, encodeError(err)
+	}
 	err := p.server.UpdateLatestVersion(apis.ChunkNum(input.Chunk), apis.Version(input.OldVersion), apis.Version(input.NewVersion))
-	return &twirp.Nothing{}, err
+	return &twirp.Nothing{}, encodeError(err)
 }
 
-func (p *proxyChunkserverAsTwirp) Add(context context.Context, input *twirp.Chunkserver_Add) (*twirp.Nothing, error) {
+func (p *proxyChunkserverAsTwirp) Add(ctx context.Context, input *twirp.Chunkserver_Add) (*twirp.Nothing, error) {
+	if err := p.guard.checkCluster(ctx); err != nil {
+		return &twirp.Nothing{}, encodeError(err)
+	}
+	if err := checkReceived(input.InitialData, input.Checksum); err != nil {
+		return &twirp.Nothing{}, encodeError(err)
+	}
 	err := p.server.Add(apis.ChunkNum(input.Chunk), input.InitialData, apis.Version(input.Version))
-	return &twirp.Nothing{}, err
+	return &twirp.Nothing{}, encodeError(err)
 }
 
-func (p *proxyChunkserverAsTwirp) Delete(context context.Context, input *twirp.Chunkserver_Delete) (*twirp.Nothing, error) {
+func (p *proxyChunkserverAsTwirp) Delete(ctx context.Context, input *twirp.Chunkserver_Delete) (*twirp.Nothing, error) {
+	if err := p.guard.checkCluster(ctx); err != nil {
+		return &twirp.Nothing{}, encodeError(err)
+	}
 	err := p.server.Delete(apis.ChunkNum(input.Chunk), apis.Version(input.Version))
-	return &twirp.Nothing{}, err
+	return &twirp.Nothing{}, encodeError(err)
 }
 
-func (p *proxyChunkserverAsTwirp) ListAllChunks(context.Context,
-	*twirp.Nothing) (*twirp.Chunkserver_ListAllChunks_Result, error) {
+func (p *proxyChunkserverAsTwirp) Undelete(ctx context.Context, input *twirp.Chunkserver_Undelete) (*twirp.Nothing, error) {
+	if err := p.guard.checkCluster(ctx); err != nil {
+		return &twirp.Nothing{}, encodeError(err)
+	}
+	err := p.server.Undelete(apis.ChunkNum(input.Chunk), apis.Version(input.Version))
+	return &twirp.Nothing{}, encodeError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) Pin(ctx context.Context, input *twirp.Chunkserver_Pin) (*twirp.Nothing, error) {
+	if err := p.guard.checkDirect(ctx, apis.ChunkNum(input.Chunk)); err != nil {
+		return &twirp.Nothing{}, encodeError(err)
+	}
+	err := p.server.Pin(apis.ChunkNum(input.Chunk), apis.Version(input.Version))
+	return &twirp.Nothing{}, encodeError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) Unpin(ctx context.Context, input *twirp.Chunkserver_Pin) (*twirp.Nothing, error) {
+	if err := p.guard.checkDirect(ctx, apis.ChunkNum(input.Chunk)); err != nil {
+		return &twirp.Nothing{}, encodeError(err)
+	}
+	err := p.server.Unpin(apis.ChunkNum(input.Chunk), apis.Version(input.Version))
+	return &twirp.Nothing{}, encodeError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) ListAllChunks(ctx context.Context,
+	_ *twirp.Nothing) (*twirp.Chunkserver_ListAllChunks_Result, error) {
+	if err := p.guard.checkCluster(ctx); err != nil {
+		return nil, encodeError(err)
+	}
 	chunks, err := p.server.ListAllChunks()
 
 	chunkVersions := make([]*twirp.ChunkVersion, len(chunks))
@@ -91,100 +267,233 @@ func (p *proxyChunkserverAsTwirp) ListAllChunks(context.Context,
 
 	return &twirp.Chunkserver_ListAllChunks_Result{
 		Chunks: chunkVersions,
-	}, err
+	}, encodeError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) DigestChunks(ctx context.Context,
+	input *twirp.Chunkserver_DigestChunks) (*twirp.Chunkserver_DigestChunks_Result, error) {
+	if err := p.guard.checkCluster(ctx); err != nil {
+		return nil, encodeError(err)
+	}
+	chunks := make([]apis.ChunkNum, len(input.Chunks))
+	for i, chunk := range input.Chunks {
+		chunks[i] = apis.ChunkNum(chunk)
+	}
+	digests, err := p.server.DigestChunks(chunks)
+
+	encoded := make([]*twirp.ChunkDigest, len(digests))
+	for i, digest := range digests {
+		versions := make([]uint64, len(digest.Versions))
+		for j, version := range digest.Versions {
+			versions[j] = uint64(version)
+		}
+		encoded[i] = &twirp.ChunkDigest{
+			Chunk:    uint64(digest.Chunk),
+			Latest:   uint64(digest.Latest),
+			Checksum: uint32(digest.Checksum),
+			Versions: versions,
+		}
+	}
+
+	return &twirp.Chunkserver_DigestChunks_Result{
+		Digests: encoded,
+	}, encodeError(err)
 }
 
 type proxyTwirpAsChunkserver struct {
 	server twirp.Chunkserver
+	// for payloads of at least StreamThreshold bytes; nil if payloads of any size go in messages
+	stream *streamClient
+	// calls that read or stage data present the capability collected under it for their chunk, if there is one
+	ctx context.Context
 }
 
 func (p *proxyTwirpAsChunkserver) StartWriteReplicated(chunk apis.ChunkNum, offset uint32, data []byte,
 	replicas []apis.ServerAddress) error {
 
-	_, err := p.server.StartWriteReplicated(context.Background(), &twirp.Chunkserver_StartWriteReplicated{
+	_, err := p.server.StartWriteReplicated(presentCapability(p.ctx, chunk), &twirp.Chunkserver_StartWriteReplicated{
 		Chunk:     uint64(chunk),
 		Offset:    offset,
 		Data:      data,
 		Addresses: AddressArrayToStringArray(replicas),
+		Checksum:  uint32(apis.CalculateChecksum(data)),
 	})
-	return err
+	return callError(p.ctx, err)
 }
 
 func (p *proxyTwirpAsChunkserver) Replicate(chunk apis.ChunkNum, serverAddress apis.ServerAddress,
 	version apis.Version) error {
-	_, err := p.server.Replicate(context.Background(), &twirp.Chunkserver_Replicate{
+	_, err := p.server.Replicate(p.ctx, &twirp.Chunkserver_Replicate{
 		Chunk:         uint64(chunk),
 		ServerAddress: string(serverAddress),
 		Version:       uint64(version),
 	})
-	return err
+	return callError(p.ctx, err)
 }
 
 func (p *proxyTwirpAsChunkserver) Read(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, error) {
-	result, err := p.server.Read(context.Background(), &twirp.Chunkserver_Read{
+	if p.stream != nil && length >= StreamThreshold {
+		return p.stream.read(presentCapability(p.ctx, chunk), chunk, offset, length, minimum)
+	}
+	result, err := p.server.Read(presentCapability(p.ctx, chunk), &twirp.Chunkserver_Read{
 		Chunk:   uint64(chunk),
 		Offset:  offset,
 		Length:  length,
 		Version: uint64(minimum),
 	})
+	err = callError(p.ctx, err)
 	if err != nil {
 		return nil, 0, err
 	}
 	if result.Error != "" {
-		return nil, apis.Version(result.Version), errors.New(result.Error)
+		return nil, apis.Version(result.Version), errorFromFields(result.Error, result.ErrorCode, apis.Version(result.Version), "")
+	}
+	if err := checkReceived(result.Data, result.Checksum); err != nil {
+		return nil, 0, err
 	}
 	return result.Data, apis.Version(result.Version), nil
 }
 
+func (p *proxyTwirpAsChunkserver) ReadWithChecksum(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, apis.Checksum, error) {
+	result, err := p.server.ReadWithChecksum(presentCapability(p.ctx, chunk), &twirp.Chunkserver_Read{
+		Chunk:   uint64(chunk),
+		Offset:  offset,
+		Length:  length,
+		Version: uint64(minimum),
+	})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if result.Error != "" {
+		return nil, apis.Version(result.Version), 0, errorFromFields(result.Error, result.ErrorCode, apis.Version(result.Version), "")
+	}
+	return result.Data, apis.Version(result.Version), apis.Checksum(result.Checksum), nil
+}
+
+func (p *proxyTwirpAsChunkserver) ReadVersion(chunk apis.ChunkNum, offset uint32, length uint32, version apis.Version) ([]byte, error) {
+	result, err := p.server.ReadVersion(presentCapability(p.ctx, chunk), &twirp.Chunkserver_ReadVersion{
+		Chunk:   uint64(chunk),
+		Offset:  offset,
+		Length:  length,
+		Version: uint64(version),
+	})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkReceived(result.Data, result.Checksum); err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
+
 func (p *proxyTwirpAsChunkserver) StartWrite(chunk apis.ChunkNum, offset uint32, data []byte) error {
-	_, err := p.server.StartWrite(context.Background(), &twirp.Chunkserver_StartWrite{
-		Chunk:  uint64(chunk),
-		Offset: offset,
-		Data:   data,
+	if p.stream != nil && len(data) >= StreamThreshold {
+		return p.stream.startWrite(presentCapability(p.ctx, chunk), chunk, offset, data)
+	}
+	_, err := p.server.StartWrite(presentCapability(p.ctx, chunk), &twirp.Chunkserver_StartWrite{
+		Chunk:    uint64(chunk),
+		Offset:   offset,
+		Data:     data,
+		Checksum: uint32(apis.CalculateChecksum(data)),
 	})
-	return err
+	return callError(p.ctx, err)
 }
 
 func (p *proxyTwirpAsChunkserver) CommitWrite(chunk apis.ChunkNum, hash apis.CommitHash, oldVersion apis.Version,
 	newVersion apis.Version) error {
-	_, err := p.server.CommitWrite(context.Background(), &twirp.Chunkserver_CommitWrite{
+	_, err := p.server.CommitWrite(p.ctx, &twirp.Chunkserver_CommitWrite{
 		Chunk:      uint64(chunk),
 		Hash:       string(hash),
 		OldVersion: uint64(oldVersion),
 		NewVersion: uint64(newVersion),
 	})
-	return err
+	return callError(p.ctx, err)
+}
+
+func (p *proxyTwirpAsChunkserver) StartAppend(chunk apis.ChunkNum, data []byte) error {
+	_, err := p.server.StartAppend(presentCapability(p.ctx, chunk), &twirp.Chunkserver_StartAppend{
+		Chunk:    uint64(chunk),
+		Data:     data,
+		Checksum: uint32(apis.CalculateChecksum(data)),
+	})
+	return callError(p.ctx, err)
+}
+
+func (p *proxyTwirpAsChunkserver) CommitAppend(chunk apis.ChunkNum, hash apis.CommitHash, oldVersion apis.Version,
+	newVersion apis.Version) (uint32, error) {
+	result, err := p.server.CommitAppend(p.ctx, &twirp.Chunkserver_CommitWrite{
+		Chunk:      uint64(chunk),
+		Hash:       string(hash),
+		OldVersion: uint64(oldVersion),
+		NewVersion: uint64(newVersion),
+	})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return 0, err
+	}
+	return result.Offset, nil
 }
 
 func (p *proxyTwirpAsChunkserver) UpdateLatestVersion(chunk apis.ChunkNum, oldVersion apis.Version,
 	newVersion apis.Version) error {
-	_, err := p.server.UpdateLatestVersion(context.Background(), &twirp.Chunkserver_UpdateLatestVersion{
+	_, err := p.server.UpdateLatestVersion(p.ctx, &twirp.Chunkserver_UpdateLatestVersion{
 		Chunk:      uint64(chunk),
 		OldVersion: uint64(oldVersion),
 		NewVersion: uint64(newVersion),
 	})
-	return err
+	return callError(p.ctx, err)
 }
 
 func (p *proxyTwirpAsChunkserver) Add(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version) error {
-	_, err := p.server.Add(context.Background(), &twirp.Chunkserver_Add{
+	_, err := p.server.Add(p.ctx, &twirp.Chunkserver_Add{
 		Chunk:       uint64(chunk),
 		InitialData: initialData,
 		Version:     uint64(initialVersion),
+		Checksum:    uint32(apis.CalculateChecksum(initialData)),
 	})
-	return err
+	return callError(p.ctx, err)
 }
 
 func (p *proxyTwirpAsChunkserver) Delete(chunk apis.ChunkNum, version apis.Version) error {
-	_, err := p.server.Delete(context.Background(), &twirp.Chunkserver_Delete{
+	_, err := p.server.Delete(p.ctx, &twirp.Chunkserver_Delete{
+		Chunk:   uint64(chunk),
+		Version: uint64(version),
+	})
+	return callError(p.ctx, err)
+}
+
+func (p *proxyTwirpAsChunkserver) Undelete(chunk apis.ChunkNum, version apis.Version) error {
+	_, err := p.server.Undelete(p.ctx, &twirp.Chunkserver_Undelete{
+		Chunk:   uint64(chunk),
+		Version: uint64(version),
+	})
+	return callError(p.ctx, err)
+}
+
+func (p *proxyTwirpAsChunkserver) Pin(chunk apis.ChunkNum, version apis.Version) error {
+	_, err := p.server.Pin(presentCapability(p.ctx, chunk), &twirp.Chunkserver_Pin{
 		Chunk:   uint64(chunk),
 		Version: uint64(version),
 	})
-	return err
+	return callError(p.ctx, err)
+}
+
+func (p *proxyTwirpAsChunkserver) Unpin(chunk apis.ChunkNum, version apis.Version) error {
+	_, err := p.server.Unpin(presentCapability(p.ctx, chunk), &twirp.Chunkserver_Pin{
+		Chunk:   uint64(chunk),
+		Version: uint64(version),
+	})
+	return callError(p.ctx, err)
 }
 
 func (p *proxyTwirpAsChunkserver) ListAllChunks() ([]apis.ChunkVersion, error) {
-	result, err := p.server.ListAllChunks(context.Background(), &twirp.Nothing{})
+	result, err := p.server.ListAllChunks(p.ctx, &twirp.Nothing{})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return nil, err
+	}
 	decoded := make([]apis.ChunkVersion, len(result.Chunks))
 	for i, v := range result.Chunks {
 		decoded[i] = apis.ChunkVersion{
@@ -192,5 +501,31 @@ func (p *proxyTwirpAsChunkserver) ListAllChunks() ([]apis.ChunkVersion, error) {
 			Version: apis.Version(v.Version),
 		}
 	}
-	return decoded, err
+	return decoded, nil
+}
+
+func (p *proxyTwirpAsChunkserver) DigestChunks(chunks []apis.ChunkNum) ([]apis.ChunkDigest, error) {
+	encoded := make([]uint64, len(chunks))
+	for i, chunk := range chunks {
+		encoded[i] = uint64(chunk)
+	}
+	result, err := p.server.DigestChunks(p.ctx, &twirp.Chunkserver_DigestChunks{Chunks: encoded})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return nil, err
+	}
+	decoded := make([]apis.ChunkDigest, len(result.Digests))
+	for i, digest := range result.Digests {
+		versions := make([]apis.Version, len(digest.Versions))
+		for j, version := range digest.Versions {
+			versions[j] = apis.Version(version)
+		}
+		decoded[i] = apis.ChunkDigest{
+			Chunk:    apis.ChunkNum(digest.Chunk),
+			Latest:   apis.Version(digest.Latest),
+			Checksum: apis.Checksum(digest.Checksum),
+			Versions: versions,
+		}
+	}
+	return decoded, nil
 }
@@ -1,11 +1,19 @@
 package rpc
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 	"zircon/apis"
 	"zircon/apis/mocks"
+	"zircon/rpc/twirp"
 )
 
 func beginChunkserverTest(t *testing.T) (*mocks.Chunkserver, func(), apis.Chunkserver) {
@@ -76,6 +84,40 @@ func TestChunkserver_Read(t *testing.T) {
 	assert.Contains(t, err.Error(), "hello world 03")
 }
 
+func TestChunkserver_ReadWithChecksum(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("ReadWithChecksum", apis.ChunkNum(75), uint32(57), uint32(58), apis.Version(59)).Return([]byte("testy testy"), apis.Version(60), apis.Checksum(61), nil)
+	mocked.On("ReadWithChecksum", apis.ChunkNum(0), uint32(0), uint32(0), apis.Version(0)).Return(nil, apis.Version(6), apis.Checksum(0), apis.VersionStaleError{Current: 6})
+
+	data, ver, checksum, err := server.ReadWithChecksum(75, 57, 58, 59)
+	assert.NoError(t, err)
+	assert.Equal(t, "testy testy", string(data))
+	assert.Equal(t, apis.Version(60), ver)
+	assert.Equal(t, apis.Checksum(61), checksum)
+
+	_, ver, _, err = server.ReadWithChecksum(0, 0, 0, 0)
+	assert.True(t, errors.Is(err, apis.ErrVersionStale))
+	assert.Equal(t, apis.Version(6), ver)
+}
+
+func TestChunkserver_ReadVersion(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("ReadVersion", apis.ChunkNum(75), uint32(57), uint32(58), apis.Version(59)).Return([]byte("testy testy"), nil)
+	mocked.On("ReadVersion", apis.ChunkNum(0), uint32(0), uint32(0), apis.Version(0)).Return(nil, fmt.Errorf("hello world 10: %w", apis.ErrVersionReclaimed))
+
+	data, err := server.ReadVersion(75, 57, 58, 59)
+	assert.NoError(t, err)
+	assert.Equal(t, "testy testy", string(data))
+
+	_, err = server.ReadVersion(0, 0, 0, 0)
+	assert.True(t, errors.Is(err, apis.ErrVersionReclaimed))
+	assert.Contains(t, err.Error(), "hello world 10")
+}
+
 func TestChunkserver_StartWrite(t *testing.T) {
 	mocked, teardown, server := beginChunkserverTest(t)
 	defer teardown()
@@ -146,6 +188,41 @@ func TestChunkserver_Delete(t *testing.T) {
 	assert.Contains(t, err.Error(), "hello world 08")
 }
 
+func TestChunkserver_Undelete(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("Undelete", apis.ChunkNum(83), apis.Version(70)).Return(nil)
+	mocked.On("Undelete", apis.ChunkNum(0), apis.Version(0)).Return(fmt.Errorf("hello world 09: %w", apis.ErrNotFound))
+
+	assert.NoError(t, server.Undelete(83, 70))
+
+	err := server.Undelete(0, 0)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+	assert.Contains(t, err.Error(), "hello world 09")
+}
+
+func TestChunkserver_Pin(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("Pin", apis.ChunkNum(84), apis.Version(71)).Return(nil)
+	mocked.On("Pin", apis.ChunkNum(0), apis.Version(0)).Return(fmt.Errorf("hello world 12: %w", apis.ErrVersionReclaimed))
+	mocked.On("Unpin", apis.ChunkNum(84), apis.Version(71)).Return(nil)
+	mocked.On("Unpin", apis.ChunkNum(0), apis.Version(0)).Return(fmt.Errorf("hello world 13: %w", apis.ErrNotFound))
+
+	assert.NoError(t, server.Pin(84, 71))
+	assert.NoError(t, server.Unpin(84, 71))
+
+	err := server.Pin(0, 0)
+	assert.True(t, errors.Is(err, apis.ErrVersionReclaimed))
+	assert.Contains(t, err.Error(), "hello world 12")
+
+	err = server.Unpin(0, 0)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+	assert.Contains(t, err.Error(), "hello world 13")
+}
+
 func TestChunkserver_ListAllChunks_Pass(t *testing.T) {
 	mocked, teardown, server := beginChunkserverTest(t)
 	defer teardown()
@@ -174,3 +251,165 @@ func TestChunkserver_ListAllChunks_Fail(t *testing.T) {
 	}
 	assert.Empty(t, chunks)
 }
+
+func TestChunkserver_DigestChunks_Pass(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("DigestChunks", []apis.ChunkNum{81, 82, 83}).Return([]apis.ChunkDigest{
+		{Chunk: 81, Latest: 68, Checksum: 0x1234abcd, Versions: []apis.Version{67, 68}},
+		{Chunk: 82, Latest: 69, Checksum: 0xfeed, Versions: []apis.Version{69}},
+	}, nil)
+
+	digests, err := server.DigestChunks([]apis.ChunkNum{81, 82, 83})
+	assert.NoError(t, err)
+	assert.Equal(t, []apis.ChunkDigest{
+		{Chunk: 81, Latest: 68, Checksum: 0x1234abcd, Versions: []apis.Version{67, 68}},
+		{Chunk: 82, Latest: 69, Checksum: 0xfeed, Versions: []apis.Version{69}},
+	}, digests)
+}
+
+func TestChunkserver_DigestChunks_Fail(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("DigestChunks", []apis.ChunkNum{81}).Return([]apis.ChunkDigest{},
+		errors.New("hello world 14"))
+
+	digests, err := server.DigestChunks([]apis.ChunkNum{81})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "hello world 14")
+	}
+	assert.Empty(t, digests)
+}
+
+func TestChunkserver_Cancel(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("Read", apis.ChunkNum(80), uint32(0), uint32(4), apis.Version(0)).
+		After(500*time.Millisecond).Return([]byte("late"), apis.Version(1), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	_, _, err := ChunkserverWithContext(ctx, server).Read(80, 0, 4, 0)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestChunkserver_TypedErrors(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("Read", apis.ChunkNum(81), uint32(0), uint32(4), apis.Version(9)).
+		Return(nil, apis.Version(7), fmt.Errorf("hello world 10: %w", apis.VersionStaleError{Current: 7}))
+	mocked.On("StartWrite", apis.ChunkNum(81), uint32(0), []byte("data")).
+		Return(fmt.Errorf("hello world 11: %w", apis.ErrNotFound))
+
+	_, ver, err := server.Read(81, 0, 4, 9)
+	var stale apis.VersionStaleError
+	if assert.True(t, errors.As(err, &stale)) {
+		assert.Equal(t, apis.Version(7), stale.Current)
+	}
+	assert.Equal(t, apis.Version(7), ver)
+	assert.Contains(t, err.Error(), "hello world 10")
+
+	err = server.StartWrite(81, 0, []byte("data"))
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+	assert.False(t, errors.Is(err, apis.ErrVersionStale))
+	assert.Contains(t, err.Error(), "hello world 11")
+}
+
+func TestChunkserver_Streamed(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	large := bytes.Repeat([]byte("streamed data\n"), StreamThreshold)
+	mocked.On("Read", apis.ChunkNum(82), uint32(3), uint32(len(large)), apis.Version(4)).Return(large, apis.Version(5), nil)
+	mocked.On("Read", apis.ChunkNum(83), uint32(0), uint32(StreamThreshold), apis.Version(9)).
+		Return(nil, apis.Version(7), fmt.Errorf("hello world 12: %w", apis.VersionStaleError{Current: 7}))
+	mocked.On("StartWrite", apis.ChunkNum(82), uint32(6), large).Return(nil)
+	mocked.On("StartWrite", apis.ChunkNum(83), uint32(0), large).Return(fmt.Errorf("hello world 13: %w", apis.ErrStagingFull))
+
+	data, ver, err := server.Read(82, 3, uint32(len(large)), 4)
+	assert.NoError(t, err)
+	assert.Equal(t, apis.Version(5), ver)
+	assert.True(t, bytes.Equal(large, data))
+
+	_, ver, err = server.Read(83, 0, StreamThreshold, 9)
+	var stale apis.VersionStaleError
+	if assert.True(t, errors.As(err, &stale)) {
+		assert.Equal(t, apis.Version(7), stale.Current)
+	}
+	assert.Equal(t, apis.Version(7), ver)
+	assert.Contains(t, err.Error(), "hello world 12")
+
+	assert.NoError(t, server.StartWrite(82, 6, large))
+	err = server.StartWrite(83, 0, large)
+	assert.True(t, errors.Is(err, apis.ErrStagingFull))
+	assert.Contains(t, err.Error(), "hello world 13")
+}
+
+// Tests that the streamed endpoints are served next to twirp, and that they check their parameters.
+func TestChunkserver_StreamEndpoints(t *testing.T) {
+	mocked := new(mocks.Chunkserver)
+	teardown, address, err := PublishChunkserver(mocked, ":0")
+	assert.NoError(t, err)
+	defer teardown(true)
+
+	mocked.On("Read", apis.ChunkNum(84), uint32(0), uint32(5), apis.Version(0)).Return([]byte("bytes"), apis.Version(2), nil)
+
+	response, err := http.Get("http://" + string(address) + ReadStreamPath + "?chunk=84&offset=0&length=5&version=0")
+	if assert.NoError(t, err) {
+		body, err := ioutil.ReadAll(response.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, response.Body.Close())
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, "bytes", string(body))
+		assert.Equal(t, "2", response.Header.Get(versionHeader))
+	}
+
+	response, err = http.Post("http://"+string(address)+WriteStreamPath+"?chunk=84", "application/octet-stream", strings.NewReader("data"))
+	if assert.NoError(t, err) {
+		assert.NoError(t, response.Body.Close())
+		assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	}
+	mocked.AssertExpectations(t)
+}
+
+// Tests that chunk data that doesn't match the checksum it was sent with is refused before it reaches the chunkserver.
+func TestChunkserver_Checksums(t *testing.T) {
+	mocked := new(mocks.Chunkserver)
+	teardown, address, err := PublishChunkserver(mocked, ":0")
+	assert.NoError(t, err)
+	defer teardown(true)
+
+	handler := &proxyChunkserverAsTwirp{server: mocked}
+	_, err = handler.StartWrite(context.Background(), &twirp.Chunkserver_StartWrite{
+		Chunk:    85,
+		Data:     []byte("damaged"),
+		Checksum: uint32(apis.CalculateChecksum([]byte("original"))),
+	})
+	assert.True(t, errors.Is(decodeError(err), apis.ErrChecksumMismatch))
+	_, err = handler.Add(context.Background(), &twirp.Chunkserver_Add{
+		Chunk:       85,
+		InitialData: []byte("damaged"),
+		Version:     1,
+	})
+	assert.True(t, errors.Is(decodeError(err), apis.ErrChecksumMismatch))
+
+	request, err := http.NewRequest(http.MethodPost, "http://"+string(address)+WriteStreamPath+"?chunk=85&offset=0", strings.NewReader("damaged"))
+	assert.NoError(t, err)
+	request.Header.Set(checksumHeader, formatChecksum([]byte("original")))
+	response, err := http.DefaultClient.Do(request)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusInternalServerError, response.StatusCode)
+		err = streamResponseError(response, 0)
+		assert.NoError(t, response.Body.Close())
+		assert.True(t, errors.Is(err, apis.ErrChecksumMismatch))
+	}
+	mocked.AssertExpectations(t)
+}
@@ -2,23 +2,86 @@ package rpc
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"zircon/apis"
 )
 
+// Everything about how a published server serves its RPCs. The zero value serves plaintext twirp, with no
+// interceptors, and without logging anything.
+type ServerOptions struct {
+	// nil for plaintext connections; see TLSConfiguration
+	TLS          *tls.Config
+	Transport    Transport
+	Interceptors []Interceptor
+	// Where panics that the server recovers from are reported, and where each call is logged as it finishes. Either
+	// can be nil, in which case nothing is logged there. See withRecovery and withAccessLog.
+	Logger    apis.Logger
+	AccessLog apis.Logger
+	// Bounds the calls carrying write data that the server takes on at once; see AdmissionLimits. Only chunkservers are
+	// sent such calls.
+	Admission AdmissionLimits
+	// Served under AdminPath alongside the RPC handler, such as the one made by admin.NewHandler, or nil for nothing to
+	// be. Only frontends published over twirp serve it.
+	Admin http.Handler
+	// The principals of the cluster's own servers: its frontends, chunkservers and metadata caches, which act on the
+	// frontends' behalf. When set, chunkservers and metadata caches only let these change anything, and chunkservers
+	// only let anyone else read or stage writes with a Capability. Calls from within the same process are always taken.
+	Cluster []apis.Principal
+	// The secret that frontends sign the capabilities they issue with, and that chunkservers check them against, which
+	// every frontend and chunkserver in a cluster must share. Frontends issue none without it.
+	CapabilityKey []byte
+}
+
+// The path under which a frontend serves ServerOptions.Admin. Requests are passed on with it stripped from their paths,
+// so the handler sees the same paths as it would on an address of its own.
+const AdminPath = "/admin"
+
+// Wraps the RPC handler of a server published over twirp in the middleware that the options call for, and in the
+// panic recovery and identification of callers that every server has. Calls refused by admission control are logged,
+// but not passed through the interceptors, since they were never handled.
+func (o ServerOptions) wrap(handler http.Handler, role string) http.Handler {
+	handler = withAdmission(withInterceptors(handler, o.Interceptors), o.Admission)
+	return withCaller(withAccessLog(withRecovery(handler, role, o.Logger), role, o.AccessLog))
+}
+
+// Serves 'admin' under AdminPath, unless it is nil, and passes every other request on to 'handler'. The admin handler
+// is kept apart from the RPC middleware, since its requests aren't calls.
+func withAdmin(handler http.Handler, admin http.Handler) http.Handler {
+	if admin == nil {
+		return handler
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.Handle(AdminPath+"/", http.StripPrefix(AdminPath, admin))
+	return mux
+}
+
 func LaunchEmbeddedHTTP(handler http.Handler, address apis.ServerAddress) (func(kill bool) error, apis.ServerAddress, error) {
+	return LaunchEmbeddedHTTPWithTLS(handler, address, nil)
+}
+
+// Like LaunchEmbeddedHTTP, but accepts only TLS connections, set up with 'config', unless it is nil.
+func LaunchEmbeddedHTTPWithTLS(handler http.Handler, address apis.ServerAddress, config *tls.Config) (func(kill bool) error, apis.ServerAddress, error) {
 	if address == "" {
-		address = ":http"
+		if config != nil {
+			address = ":https"
+		} else {
+			address = ":http"
+		}
 	}
 
 	listener, err := net.Listen("tcp", string(address))
 	if err != nil {
 		return nil, "", err
 	}
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
 
-	httpServer := &http.Server{Handler: handler}
+	httpServer := &http.Server{Handler: withBudget(withCompression(handler))}
 	termErr := make(chan error)
 	go func() {
 		defer func() {
@@ -55,6 +118,15 @@ func LaunchEmbeddedHTTP(handler http.Handler, address apis.ServerAddress) (func(
 	return teardown, apis.ServerAddress(listener.Addr().String()), nil
 }
 
+// When an RPC fails because its context was cancelled or expired, twirp reports a generic transport error; this
+// substitutes the context's own error so that callers can distinguish it.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
 func StringArrayToAddressArray(strings []string) []apis.ServerAddress {
 	addresses := make([]apis.ServerAddress, len(strings))
 	for i, v := range strings {
@@ -86,3 +158,28 @@ func IntArrayToIDArray(ints []uint32) []apis.ServerID {
 	}
 	return ids
 }
+
+// Splits an ACL into the fields that carry it in messages: (owner, allowed, mode).
+func aclToTwirp(acl apis.ACL) (uint64, []uint64, uint32) {
+	allowed := make([]uint64, len(acl.Allowed))
+	for i, principal := range acl.Allowed {
+		allowed[i] = uint64(principal)
+	}
+	return uint64(acl.Owner), allowed, uint32(acl.Mode)
+}
+
+// Reconstructs an ACL from the fields produced by aclToTwirp.
+func aclFromTwirp(owner uint64, allowed []uint64, mode uint32) apis.ACL {
+	if owner == 0 {
+		return apis.ACL{}
+	}
+	acl := apis.ACL{Owner: apis.Principal(owner), Mode: apis.Access(mode)}
+	// keep an ACL with nobody else allowed the same as one read directly from a metadata cache
+	if len(allowed) > 0 {
+		acl.Allowed = make([]apis.Principal, len(allowed))
+		for i, principal := range allowed {
+			acl.Allowed[i] = apis.Principal(principal)
+		}
+	}
+	return acl
+}
@@ -0,0 +1,309 @@
+package rpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"zircon/apis"
+
+	"github.com/golang/snappy"
+)
+
+// How the bodies of requests and responses are compressed on the connections from a ConnectionCache. Servers always
+// accept every supported compression, so this only needs to be configured on the client side.
+type Compression string
+
+const (
+	// Bodies are sent as they are. This is the default.
+	NoCompression Compression = ""
+	// Compresses well, at the cost of more CPU time; best when the network is the bottleneck.
+	GzipCompression Compression = "gzip"
+	// Compresses less, but fast enough to be worthwhile even on a fast network.
+	SnappyCompression Compression = "snappy"
+)
+
+// Fails unless the compression is one that this package supports.
+func (c Compression) Validate() error {
+	if c == NoCompression {
+		return nil
+	}
+	if _, found := codecs[c]; !found {
+		return fmt.Errorf("unknown compression %q; expected %q or %q", string(c), GzipCompression, SnappyCompression)
+	}
+	return nil
+}
+
+// Explanation of compression:
+//     Chunk data is often very compressible, and a Read or StartWrite can carry up to MaxChunkSize of it, so compressing
+//     bodies can save a lot of bandwidth. Compression is negotiated with the standard HTTP headers, so it applies the
+//     same way to twirp messages and to streamed transfers. A client that wants compressed responses lists its
+//     compression in Accept-Encoding, and the server compresses each response body of at least CompressionThreshold
+//     bytes with it. Every server lists the compressions it can decode in the compressionsHeader of its responses, and
+//     a client only compresses the request bodies it sends to a server once it has seen that server list its
+//     compression, so that it can still talk to servers that don't support compression at all. Preconnect is enough
+//     to find out. Smaller bodies aren't compressed either way, since there is little to gain from them.
+
+// The smallest body that is compressed.
+const CompressionThreshold = 4 * 1024
+
+// The response header in which servers list the compressions they accept on request bodies.
+const compressionsHeader = "Zircon-Accept-Encoding"
+
+// The most that a compressed request body is allowed to expand to, which is enough for any valid request.
+const maxDecompressedSize = 2 * apis.MaxChunkSize
+
+type codec struct {
+	writer func(w io.Writer) io.WriteCloser
+	reader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[Compression]codec{
+	GzipCompression: {
+		writer: func(w io.Writer) io.WriteCloser {
+			// the fastest level, since every byte sent passes through it
+			writer, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+			return writer
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	SnappyCompression: {
+		writer: func(w io.Writer) io.WriteCloser {
+			return snappy.NewBufferedWriter(w)
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(snappy.NewReader(r)), nil
+		},
+	},
+}
+
+// The compressions that servers accept, listed as they are in compressionsHeader.
+var acceptedCompressions = func() string {
+	var names []string
+	for compression := range codecs {
+		names = append(names, string(compression))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}()
+
+// Whether a comma-separated header lists 'compression'.
+func listsCompression(header string, compression Compression) bool {
+	for _, name := range strings.Split(header, ",") {
+		// ignores any quality value, since a client only ever lists one compression
+		if semicolon := strings.IndexByte(name, ';'); semicolon != -1 {
+			name = name[:semicolon]
+		}
+		if Compression(strings.TrimSpace(name)) == compression {
+			return true
+		}
+	}
+	return false
+}
+
+// Decodes compressed request bodies, and compresses response bodies for clients that asked for it.
+func withCompression(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set(compressionsHeader, acceptedCompressions)
+		if encoding := request.Header.Get("Content-Encoding"); encoding != "" {
+			codec, found := codecs[Compression(encoding)]
+			if !found {
+				http.Error(writer, "unsupported Content-Encoding "+encoding, http.StatusUnsupportedMediaType)
+				return
+			}
+			body, err := codec.reader(request.Body)
+			if err != nil {
+				http.Error(writer, "invalid compressed body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer body.Close()
+			request.Body = &limitedBody{reader: body, closer: request.Body, remaining: maxDecompressedSize}
+			request.ContentLength = -1
+			request.Header.Del("Content-Encoding")
+			request.Header.Del("Content-Length")
+		}
+		for compression, codec := range codecs {
+			if listsCompression(request.Header.Get("Accept-Encoding"), compression) {
+				compressing := &compressingWriter{ResponseWriter: writer, compression: compression, codec: codec}
+				defer compressing.close()
+				writer = compressing
+				break
+			}
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// Fails a read that would take a decompressed body past its limit, rather than letting a small request expand without
+// bound.
+type limitedBody struct {
+	reader    io.Reader
+	closer    io.Closer
+	remaining int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, fmt.Errorf("decompressed body exceeds %d bytes: %w", maxDecompressedSize, apis.ErrChunkTooLarge)
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+func (l *limitedBody) Close() error {
+	return l.closer.Close()
+}
+
+// Compresses a response body if it turns out to be large enough. Both twirp and streamed reads give the length of their
+// responses before writing them, which is what this decides by.
+type compressingWriter struct {
+	http.ResponseWriter
+	compression Compression
+	codec       codec
+	encoder     io.WriteCloser
+	decided     bool
+}
+
+func (c *compressingWriter) WriteHeader(status int) {
+	if !c.decided {
+		c.decided = true
+		header := c.Header()
+		length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+		if status == http.StatusOK && err == nil && length >= CompressionThreshold && header.Get("Content-Encoding") == "" {
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", string(c.compression))
+			c.encoder = c.codec.writer(c.ResponseWriter)
+		}
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressingWriter) Write(data []byte) (int, error) {
+	if !c.decided {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.encoder != nil {
+		return c.encoder.Write(data)
+	}
+	return c.ResponseWriter.Write(data)
+}
+
+// Flushes out the end of the compressed body, if it was compressed.
+func (c *compressingWriter) close() {
+	if c.encoder != nil {
+		_ = c.encoder.Close()
+	}
+}
+
+// Wraps the transport of a ConnectionCache to compress request bodies and decompress response bodies, and keeps track
+// of which servers are known to accept compressed requests.
+type compressingTransport struct {
+	transport   http.RoundTripper
+	compression Compression
+	codec       codec
+
+	mu sync.Mutex
+	// the hosts that have listed the compression in compressionsHeader
+	accepting map[string]bool
+}
+
+// Wraps 'transport' to use 'compression', unless it is NoCompression, in which case 'transport' is returned as it is.
+func newCompressingTransport(transport http.RoundTripper, compression Compression) http.RoundTripper {
+	codec, found := codecs[compression]
+	if !found {
+		return transport
+	}
+	return &compressingTransport{
+		transport:   transport,
+		compression: compression,
+		codec:       codec,
+		accepting:   map[string]bool{},
+	}
+}
+
+func (c *compressingTransport) accepts(host string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.accepting[host]
+}
+
+func (c *compressingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// the request is the caller's, so it is only changed through a copy
+	request = request.Clone(request.Context())
+	request.Header.Set("Accept-Encoding", string(c.compression))
+	if request.Body != nil && request.ContentLength >= CompressionThreshold && request.Header.Get("Content-Encoding") == "" && c.accepts(request.URL.Host) {
+		var buffer bytes.Buffer
+		encoder := c.codec.writer(&buffer)
+		_, err := io.Copy(encoder, request.Body)
+		if cerr := encoder.Close(); err == nil {
+			err = cerr
+		}
+		if cerr := request.Body.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		compressed := buffer.Bytes()
+		request.Body = ioutil.NopCloser(bytes.NewReader(compressed))
+		request.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(compressed)), nil
+		}
+		request.ContentLength = int64(len(compressed))
+		request.Header.Set("Content-Encoding", string(c.compression))
+	}
+
+	response, err := c.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	if listsCompression(response.Header.Get(compressionsHeader), c.compression) {
+		c.mu.Lock()
+		c.accepting[request.URL.Host] = true
+		c.mu.Unlock()
+	}
+	if encoding := response.Header.Get("Content-Encoding"); encoding != "" {
+		if Compression(encoding) != c.compression {
+			_ = response.Body.Close()
+			return nil, fmt.Errorf("response from %s has unexpected Content-Encoding %s", request.URL.Host, encoding)
+		}
+		body, err := c.codec.reader(response.Body)
+		if err != nil {
+			_ = response.Body.Close()
+			return nil, err
+		}
+		response.Body = &decodedBody{Reader: body, decoder: body, body: response.Body}
+		response.ContentLength = -1
+		response.Header.Del("Content-Encoding")
+		response.Header.Del("Content-Length")
+		response.Uncompressed = true
+	}
+	return response, nil
+}
+
+// The decompressed body of a response, which closes the original body along with the decoder.
+type decodedBody struct {
+	io.Reader
+	decoder io.Closer
+	body    io.Closer
+}
+
+func (d *decodedBody) Close() error {
+	err := d.decoder.Close()
+	if berr := d.body.Close(); err == nil {
+		err = berr
+	}
+	return err
+}
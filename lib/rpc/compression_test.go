@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tests that a client only compresses request bodies once the server has said that it accepts them, that large
+// response bodies come back compressed, and that both arrive intact.
+func TestCompressionNegotiation(t *testing.T) {
+	for _, compression := range []Compression{GzipCompression, SnappyCompression} {
+		t.Run(string(compression), func(t *testing.T) {
+			var encodings []string
+			echo := withCompression(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				body, err := ioutil.ReadAll(request.Body)
+				require.NoError(t, err)
+				writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				writer.WriteHeader(http.StatusOK)
+				_, _ = writer.Write(body)
+			}))
+			server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				encodings = append(encodings, request.Header.Get("Content-Encoding"))
+				echo.ServeHTTP(writer, request)
+			}))
+			defer server.Close()
+			client := &http.Client{Transport: newCompressingTransport(&http.Transport{DisableCompression: true}, compression)}
+
+			post := func(data []byte) *http.Response {
+				response, err := client.Post(server.URL, "application/octet-stream", bytes.NewReader(data))
+				require.NoError(t, err)
+				defer response.Body.Close()
+				body, err := ioutil.ReadAll(response.Body)
+				require.NoError(t, err)
+				assert.Equal(t, data, body)
+				return response
+			}
+			large := bytes.Repeat([]byte("compressible "), StreamThreshold)
+			small := []byte("too small to compress")
+
+			response := post(large)
+			assert.True(t, response.Uncompressed)
+			response = post(large)
+			assert.True(t, response.Uncompressed)
+			response = post(small)
+			assert.False(t, response.Uncompressed)
+			assert.Equal(t, []string{"", string(compression), ""}, encodings)
+		})
+	}
+}
+
+// Tests that a server leaves responses alone for clients that don't ask for compression, and refuses bodies in a
+// compression it doesn't know.
+func TestCompressionNotRequested(t *testing.T) {
+	data := bytes.Repeat([]byte("compressible "), StreamThreshold)
+	server := httptest.NewServer(withCompression(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, _ = writer.Write(data)
+	})))
+	defer server.Close()
+	client := &http.Client{Transport: newCompressingTransport(&http.Transport{DisableCompression: true}, NoCompression)}
+
+	response, err := client.Get(server.URL)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	assert.NoError(t, response.Body.Close())
+	assert.Equal(t, "", response.Header.Get("Content-Encoding"))
+	assert.Equal(t, data, body)
+	assert.Equal(t, "gzip, snappy", response.Header.Get(compressionsHeader))
+
+	request, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(data))
+	require.NoError(t, err)
+	request.Header.Set("Content-Encoding", "lzma")
+	response, err = client.Do(request)
+	require.NoError(t, err)
+	assert.NoError(t, response.Body.Close())
+	assert.Equal(t, http.StatusUnsupportedMediaType, response.StatusCode)
+
+	assert.Error(t, Compression("lzma").Validate())
+	assert.NoError(t, GRPCTransport.CheckCompression(GzipCompression))
+	assert.Error(t, GRPCTransport.CheckCompression(SnappyCompression))
+}
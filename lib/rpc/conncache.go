@@ -1,7 +1,12 @@
 package rpc
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"sync"
@@ -27,8 +32,14 @@ type ConnectionCache interface {
 	// Failure to connect does *not* cause an error here; just timeouts when trying to call specific methods.
 	SubscribeSyncServer(address apis.ServerAddress) (apis.SyncServer, error)
 
-	// Closes as many open connections as possible. May disrupt current operations. Should not be necessary to call if
-	// no subscriptions have been attempted.
+	// Opens connections to servers ahead of their first requests, so that those requests don't have to wait for them,
+	// and checks that each server responds. Connecting again to an address that already has an open connection reuses
+	// it, so this can be called as often as needed. Returns an error if any of the servers could not be reached.
+	Preconnect(addresses []apis.ServerAddress) error
+
+	// Closes every open connection. Requests already in progress are allowed to finish first, and this does not return
+	// until all of the connections have actually been closed. Any request made through a subscription afterwards fails.
+	// Should not be necessary to call if no subscriptions have been attempted.
 	CloseAll()
 }
 
@@ -39,34 +50,130 @@ type conncache struct {
 	metadatacaches map[apis.ServerAddress]apis.MetadataCache
 	syncservers    map[apis.ServerAddress]apis.SyncServer
 	client         *http.Client
-	transport      *http.Transport
+	transport      *trackingTransport
+	breakers       *circuitBreakers
 	closed         bool
+	// see checkHealth; the channels are nil if health checks are disabled
+	health     HealthCheck
+	stopHealth chan struct{}
+	healthDone chan struct{}
+	// preconnections in progress, so that concurrent calls for the same address share one connection
+	preconnecting map[apis.ServerAddress]*preconnection
+}
+
+type preconnection struct {
+	done chan struct{}
+	err  error
+}
+
+// Bounds how many requests a connection cache has in progress to any one server at a time, so that a burst of calls
+// queues up on the client instead of flooding the server.
+type InFlightLimit struct {
+	// The most requests in progress to a single address at once. Zero means no limit.
+	PerPeer int
+	// If set, a request beyond the limit fails right away with an error matching apis.ErrBusy, instead of waiting for
+	// another request to the same address to finish.
+	FailFast bool
 }
 
 func NewConnectionCache() ConnectionCache {
-	transport := &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout:   5 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   5 * time.Second,
+	return NewConnectionCacheWithLimit(InFlightLimit{})
+}
+
+// Like NewConnectionCache, but enforces a limit on the requests in progress to each server.
+func NewConnectionCacheWithLimit(limit InFlightLimit) ConnectionCache {
+	return NewConnectionCacheWithTLS(limit, nil)
+}
+
+// Like NewConnectionCacheWithLimit, but connects to servers over TLS with 'config', unless it is nil, in which case
+// connections are plaintext. See TLSConfiguration.
+func NewConnectionCacheWithTLS(limit InFlightLimit, config *tls.Config) ConnectionCache {
+	return NewConnectionCacheWithCompression(limit, config, NoCompression)
+}
+
+// Like NewConnectionCacheWithTLS, but compresses the bodies of requests and responses with 'compression'.
+func NewConnectionCacheWithCompression(limit InFlightLimit, config *tls.Config, compression Compression) ConnectionCache {
+	return NewConnectionCacheWithTimeouts(limit, config, compression, DefaultTimeouts)
+}
+
+// Like NewConnectionCacheWithCompression, but bounds how long connections and calls take with 'timeouts' instead of
+// DefaultTimeouts.
+func NewConnectionCacheWithTimeouts(limit InFlightLimit, config *tls.Config, compression Compression, timeouts Timeouts) ConnectionCache {
+	return NewConnectionCacheWithOptions(ConnectionOptions{Limit: limit, TLS: config, Compression: compression, Timeouts: timeouts})
+}
+
+// Everything about how a connection cache connects to servers and makes calls to them. The zero value connects over
+// plaintext twirp, with no in-flight limit and no compression, and with the defaults for everything else.
+type ConnectionOptions struct {
+	Limit InFlightLimit
+	// nil for plaintext connections; see TLSConfiguration
+	TLS         *tls.Config
+	Transport   Transport
+	Compression Compression
+	Timeouts    Timeouts
+	Retry       RetryPolicy
+	Breaker     BreakerPolicy
+	Health      HealthCheck
+	Pool        PoolOptions
+	// see Interceptor
+	Interceptors []Interceptor
+}
+
+// Like NewConnectionCacheWithTimeouts, but takes all of the options at once, including those that can't be chosen any
+// other way.
+func NewConnectionCacheWithOptions(options ConnectionOptions) ConnectionCache {
+	if options.Transport == GRPCTransport {
+		return newGRPCCache(options)
+	}
+	timeouts := options.Timeouts.withDefaults()
+	pool := options.Pool.withDefaults()
+	transport := newTrackingTransport(options.Limit)
+	dialer := &net.Dialer{
+		Timeout:   timeouts.Connect,
+		KeepAlive: pool.KeepAlive,
+		DualStack: true,
+	}
+	transport.transport = &http.Transport{
+		DialContext:           transport.dialer(dialer.DialContext),
+		MaxIdleConns:          pool.MaxIdleConns,
+		MaxIdleConnsPerHost:   pool.MaxIdleConnsPerHost,
+		IdleConnTimeout:       pool.IdleConnTimeout,
+		TLSClientConfig:       options.TLS,
+		TLSHandshakeTimeout:   timeouts.Connect,
 		ExpectContinueTimeout: 1 * time.Second,
+		// compression is only ever asked for explicitly, by compressingTransport
+		DisableCompression: true,
 	}
+	breakers := newCircuitBreakers(options.Breaker)
+	retry := &retryTransport{
+		transport: newCompressingTransport(transport, options.Compression),
+		policy:    options.Retry.withDefaults(),
+		breakers:  breakers,
+	}
+	// calls are bounded by deadlineTransport instead of a client-wide timeout, so that servers learn of the deadline
 	client := &http.Client{
-		Timeout:   30 * time.Second,
-		Transport: transport,
+		Transport: deadlineTransport{transport: retry, timeouts: timeouts},
+	}
+	if len(options.Interceptors) > 0 {
+		client.Transport = interceptingTransport{transport: client.Transport, interceptors: options.Interceptors}
 	}
-	return &conncache{
+	cache := &conncache{
 		client:         client,
 		transport:      transport,
+		breakers:       breakers,
+		health:         options.Health.withDefaults(),
 		chunkservers:   map[apis.ServerAddress]apis.Chunkserver{},
 		frontends:      map[apis.ServerAddress]apis.Frontend{},
 		metadatacaches: map[apis.ServerAddress]apis.MetadataCache{},
 		syncservers:    map[apis.ServerAddress]apis.SyncServer{},
+		preconnecting:  map[apis.ServerAddress]*preconnection{},
+	}
+	if cache.health.Interval > 0 {
+		cache.stopHealth = make(chan struct{})
+		cache.healthDone = make(chan struct{})
+		go cache.checkHealth(cache.stopHealth, cache.healthDone)
 	}
+	return cache
 }
 
 func (c *conncache) SubscribeChunkserver(address apis.ServerAddress) (apis.Chunkserver, error) {
@@ -153,9 +260,283 @@ func (c *conncache) SubscribeSyncServer(address apis.ServerAddress) (apis.SyncSe
 	}
 }
 
-func (c *conncache) CloseAll() {
+// How long Preconnect waits for each server to respond.
+const PreconnectTimeout = 5 * time.Second
+
+func (c *conncache) Preconnect(addresses []apis.ServerAddress) error {
+	var pending []*preconnection
+	for _, address := range addresses {
+		p, err := c.startPreconnect(address)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, p)
+	}
+	var failures []error
+	for _, p := range pending {
+		<-p.done
+		if p.err != nil {
+			failures = append(failures, p.err)
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("could not reach %d of %d servers; first failure: %w", len(failures), len(addresses), failures[0])
+	}
+	return nil
+}
+
+func (c *conncache) startPreconnect(address apis.ServerAddress) (*preconnection, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, errors.New("attempt to use closed connection cache")
+	}
+	if p, found := c.preconnecting[address]; found {
+		return p, nil
+	}
+	p := &preconnection{done: make(chan struct{})}
+	c.preconnecting[address] = p
+	go func() {
+		p.err = c.probe(address)
+		c.mu.Lock()
+		delete(c.preconnecting, address)
+		c.mu.Unlock()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// Makes a request that any server answers, even if only to say that there is nothing at that path, which leaves the
+// connection it was made on open for the next request.
+func (c *conncache) probe(address apis.ServerAddress) error {
+	ctx, cancel := context.WithTimeout(context.Background(), PreconnectTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL(address, c.client)+"/", nil)
+	if err != nil {
+		return err
+	}
+	response, err := c.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("cannot preconnect to %s: %v: %w", address, err, apis.ErrUnreachable)
+	}
+	// the connection is only reused once the response has been read in full
+	_, err = io.Copy(ioutil.Discard, response.Body)
+	if cerr := response.Body.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *conncache) CloseAll() {
+	c.mu.Lock()
+	wasClosed := c.closed
 	c.closed = true
-	c.transport.CloseIdleConnections()
+	c.mu.Unlock()
+
+	if c.stopHealth != nil && !wasClosed {
+		close(c.stopHealth)
+		<-c.healthDone
+	}
+	c.transport.close()
+}
+
+// How often CloseAll retries closing idle connections while it waits for the rest to close.
+const closePollInterval = 10 * time.Millisecond
+
+// Wraps an http.Transport to keep count of the requests in progress and the connections open through it, so that it
+// can be shut down without cutting off requests partway through and without leaving connections behind. It also
+// enforces the in-flight limit for each address.
+type trackingTransport struct {
+	transport *http.Transport
+	limit     InFlightLimit
+
+	mu       sync.Mutex
+	closed   bool
+	requests int
+	conns    int
+	changed  *sync.Cond
+	// one buffered channel per address, holding a token for each request in progress to it
+	slots map[string]chan struct{}
+	// the open connections to each address, so that those to a dead server can be evicted
+	open map[string]map[*trackedConn]bool
+}
+
+func newTrackingTransport(limit InFlightLimit) *trackingTransport {
+	t := &trackingTransport{
+		limit: limit,
+		slots: map[string]chan struct{}{},
+		open:  map[string]map[*trackedConn]bool{},
+	}
+	t.changed = sync.NewCond(&t.mu)
+	return t
+}
+
+// Waits for a slot for a request to the request's address, or fails if the limit is reached and FailFast is set.
+// Returns the function that frees the slot again.
+func (t *trackingTransport) acquire(request *http.Request) (func(), error) {
+	if t.limit.PerPeer <= 0 {
+		return func() {}, nil
+	}
+	t.mu.Lock()
+	slots, found := t.slots[request.URL.Host]
+	if !found {
+		slots = make(chan struct{}, t.limit.PerPeer)
+		t.slots[request.URL.Host] = slots
+	}
+	t.mu.Unlock()
+
+	release := func() {
+		<-slots
+	}
+	if t.limit.FailFast {
+		select {
+		case slots <- struct{}{}:
+			return release, nil
+		default:
+			// coded so that it keeps matching ErrBusy after twirp turns it into a message
+			return nil, encodeError(fmt.Errorf("%d requests already in progress to %s: %w", t.limit.PerPeer, request.URL.Host, apis.ErrBusy))
+		}
+	}
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-request.Context().Done():
+		return nil, request.Context().Err()
+	}
+}
+
+func (t *trackingTransport) add(requests int, conns int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests += requests
+	t.conns += conns
+	t.changed.Broadcast()
+}
+
+func (t *trackingTransport) dialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		tracked := &trackedConn{Conn: conn, transport: t, address: address}
+		t.mu.Lock()
+		if t.open[address] == nil {
+			t.open[address] = map[*trackedConn]bool{}
+		}
+		t.open[address][tracked] = true
+		t.conns++
+		t.changed.Broadcast()
+		t.mu.Unlock()
+		return tracked, nil
+	}
+}
+
+// Closes every connection to 'address', whether idle or in use, such as once its server is found to be dead. Requests in
+// progress on them fail.
+func (t *trackingTransport) evict(address string) {
+	t.mu.Lock()
+	var conns []*trackedConn
+	for conn := range t.open[address] {
+		conns = append(conns, conn)
+	}
+	t.mu.Unlock()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+func (t *trackingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// requests still waiting for a slot don't hold up close, and fail once they get one
+	release, err := t.acquire(request)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		release()
+		return nil, errors.New("attempt to use closed connection cache")
+	}
+	t.requests++
+	t.mu.Unlock()
+
+	response, err := t.transport.RoundTrip(request)
+	if err != nil {
+		release()
+		t.add(-1, 0)
+		return nil, err
+	}
+	// the request isn't over until its response has been read
+	response.Body = &trackedBody{ReadCloser: response.Body, transport: t, release: release}
+	return response, nil
+}
+
+// Refuses new requests, waits for the ones in progress to finish, and then closes every connection.
+func (t *trackingTransport) close() {
+	t.mu.Lock()
+	t.closed = true
+	for t.requests > 0 {
+		t.changed.Wait()
+	}
+	t.mu.Unlock()
+
+	// A connection that was still being dialed when its request gave up may be added to the idle pool after this first
+	// attempt, so keep closing idle connections until none are left.
+	done := make(chan struct{})
+	go func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for t.conns > 0 {
+			t.changed.Wait()
+		}
+		close(done)
+	}()
+	for {
+		t.transport.CloseIdleConnections()
+		select {
+		case <-done:
+			return
+		case <-time.After(closePollInterval):
+		}
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	transport *trackingTransport
+	address   string
+	once      sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		t := c.transport
+		t.mu.Lock()
+		delete(t.open[c.address], c)
+		if len(t.open[c.address]) == 0 {
+			delete(t.open, c.address)
+		}
+		t.mu.Unlock()
+		t.add(0, -1)
+	})
+	return err
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	transport *trackingTransport
+	release   func()
+	once      sync.Once
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.release()
+		b.transport.add(-1, 0)
+	})
+	return err
 }
@@ -0,0 +1,218 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/apis/mocks"
+)
+
+// Tests that CloseAll lets a request in progress finish before closing its connection, and that requests made after
+// it fail.
+func TestCloseAllWaitsForRequests(t *testing.T) {
+	cache := NewConnectionCache()
+	mocked := new(mocks.Frontend)
+	teardown, address, err := PublishFrontend(mocked, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer teardown(true)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mocked.On("New").Run(func(mock.Arguments) {
+		close(started)
+		<-release
+	}).Return(apis.ChunkNum(7), nil).Once()
+
+	server, err := cache.SubscribeFrontend(address)
+	require.NoError(t, err)
+
+	result := make(chan error)
+	go func() {
+		chunk, err := server.New()
+		assert.Equal(t, apis.ChunkNum(7), chunk)
+		result <- err
+	}()
+	<-started
+
+	closed := make(chan struct{})
+	go func() {
+		cache.CloseAll()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("CloseAll returned while a request was in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	assert.NoError(t, <-result)
+	<-closed
+
+	_, err = server.New()
+	assert.Error(t, err)
+	_, err = cache.SubscribeFrontend(address)
+	assert.Error(t, err)
+	mocked.AssertExpectations(t)
+}
+
+// Tests that a connection cache never has more requests in progress to a server than its limit, even when far more
+// calls are made at once, and that every call still completes.
+func TestInFlightLimitQueues(t *testing.T) {
+	const limit = 4
+	cache := NewConnectionCacheWithLimit(InFlightLimit{PerPeer: limit})
+	defer cache.CloseAll()
+	mocked := new(mocks.Frontend)
+	teardown, address, err := PublishFrontend(mocked, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer teardown(true)
+
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	mocked.On("New").Run(func(mock.Arguments) {
+		mu.Lock()
+		inFlight++
+		if inFlight > most {
+			most = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}).Return(apis.ChunkNum(7), nil)
+
+	server, err := cache.SubscribeFrontend(address)
+	require.NoError(t, err)
+
+	const calls = 100
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		go func() {
+			_, err := server.New()
+			errs <- err
+		}()
+	}
+	for i := 0; i < calls; i++ {
+		select {
+		case err := <-errs:
+			assert.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("calls did not all complete; possible deadlock")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, most <= limit, "%d requests were in progress at once", most)
+	assert.True(t, most > 0)
+	mocked.AssertNumberOfCalls(t, "New", calls)
+}
+
+// Tests that with FailFast, calls beyond the limit fail with ErrBusy instead of waiting.
+func TestInFlightLimitFailFast(t *testing.T) {
+	cache := NewConnectionCacheWithLimit(InFlightLimit{PerPeer: 2, FailFast: true})
+	defer cache.CloseAll()
+	mocked := new(mocks.Frontend)
+	teardown, address, err := PublishFrontend(mocked, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer teardown(true)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mocked.On("New").Run(func(mock.Arguments) {
+		started <- struct{}{}
+		<-release
+	}).Return(apis.ChunkNum(7), nil).Twice()
+
+	server, err := cache.SubscribeFrontend(address)
+	require.NoError(t, err)
+
+	errs := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := server.New()
+			errs <- err
+		}()
+		<-started
+	}
+
+	_, err = server.New()
+	assert.True(t, errors.Is(err, apis.ErrBusy))
+	assert.False(t, errors.Is(err, apis.ErrUnreachable))
+
+	close(release)
+	assert.NoError(t, <-errs)
+	assert.NoError(t, <-errs)
+	mocked.AssertExpectations(t)
+}
+
+func (t *trackingTransport) openConns() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conns
+}
+
+// Tests that a preconnected server answers its first request without a connection having to be set up for it, unlike a
+// server that wasn't, and that preconnecting again, even concurrently, doesn't open any more connections.
+func TestPreconnect(t *testing.T) {
+	const dialDelay = 200 * time.Millisecond
+	cache := NewConnectionCache().(*conncache)
+	defer cache.CloseAll()
+	// stands in for a connection that takes a while to set up, such as one with a TLS handshake or a long round trip
+	cache.transport.transport.DialContext = cache.transport.dialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		time.Sleep(dialDelay)
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	})
+
+	var addresses []apis.ServerAddress
+	for i := 0; i < 2; i++ {
+		mocked := new(mocks.Frontend)
+		mocked.On("New").Return(apis.ChunkNum(i+1), nil)
+		teardown, address, err := PublishFrontend(mocked, "127.0.0.1:0")
+		require.NoError(t, err)
+		defer teardown(true)
+		addresses = append(addresses, address)
+	}
+	warm, cold := addresses[0], addresses[1]
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, cache.Preconnect([]apis.ServerAddress{warm}))
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, cache.Preconnect([]apis.ServerAddress{warm}))
+	assert.Equal(t, 1, cache.transport.openConns())
+
+	timeFirstNew := func(address apis.ServerAddress) time.Duration {
+		server, err := cache.SubscribeFrontend(address)
+		require.NoError(t, err)
+		start := time.Now()
+		_, err = server.New()
+		require.NoError(t, err)
+		return time.Since(start)
+	}
+	assert.True(t, timeFirstNew(warm) < dialDelay, "preconnected server had to be connected to again")
+	assert.Equal(t, 1, cache.transport.openConns())
+	assert.True(t, timeFirstNew(cold) >= dialDelay, "cold server did not need a connection")
+	assert.Equal(t, 2, cache.transport.openConns())
+}
+
+// Tests that Preconnect reports servers it can't reach.
+func TestPreconnectUnreachable(t *testing.T) {
+	cache := NewConnectionCache()
+	defer cache.CloseAll()
+	// nothing listens on the discard port
+	err := cache.Preconnect([]apis.ServerAddress{"127.0.0.1:9"})
+	assert.True(t, errors.Is(err, apis.ErrUnreachable))
+}
@@ -0,0 +1,185 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"zircon/apis"
+)
+
+// Twirp only carries the message of an error, so the typed errors from apis would otherwise turn into opaque strings
+// on the client side. Results that return other information alongside an error carry these codes in an errorCode
+// field, and errors returned through twirp directly have the code tagged onto their message. Either way, the client
+// side reconstructs an error that matches with errors.Is and errors.As.
+const (
+	codeNone uint32 = iota
+	codeNotFound
+	// a staleness failure that doesn't know the latest version
+	codeVersionStale
+	// a staleness failure that carries the latest version, as a VersionStaleError
+	codeVersionStaleAt
+	codeChunkTooLarge
+	codeAlreadyExists
+	codeBeingDeleted
+	codeOwnerRedirect
+	codeLockContended
+	codePermissionDenied
+	codeVersionReclaimed
+	codeBusy
+	codeStagingFull
+	codeChunkDeleted
+	codeLeaseHeld
+	codeLeaseLost
+	codeChecksumMismatch
+	// a refusal that carries how long to wait before trying again, as a RetryAfterError, for a server that was too busy
+	// or had no room to stage a write
+	codeBusyRetryAfter
+	codeStagingFullRetryAfter
+)
+
+var codedSentinels = map[uint32]error{
+	codeNotFound:         apis.ErrNotFound,
+	codeVersionStale:     apis.ErrVersionStale,
+	codeChunkTooLarge:    apis.ErrChunkTooLarge,
+	codeAlreadyExists:    apis.ErrAlreadyExists,
+	codeBeingDeleted:     apis.ErrBeingDeleted,
+	codeLockContended:    apis.ErrLockContended,
+	codePermissionDenied: apis.ErrPermissionDenied,
+	codeVersionReclaimed: apis.ErrVersionReclaimed,
+	codeBusy:             apis.ErrBusy,
+	codeStagingFull:      apis.ErrStagingFull,
+	codeChunkDeleted:     apis.ErrChunkDeleted,
+	codeLeaseHeld:        apis.ErrLeaseHeld,
+	codeLeaseLost:        apis.ErrLeaseLost,
+	codeChecksumMismatch: apis.ErrChecksumMismatch,
+}
+
+const errorCodeTag = "zircon-error="
+
+// An error received from a remote server, which keeps the original message but unwraps to the error it was coded as.
+type remoteError struct {
+	message string
+	cause   error
+}
+
+func (e remoteError) Error() string {
+	return e.message
+}
+
+func (e remoteError) Unwrap() error {
+	return e.cause
+}
+
+// Splits an error into the fields needed to reconstruct it on the other side of a connection. The version is only
+// meaningful for codeVersionStaleAt, and the owner for codeOwnerRedirect. The codes that carry how long to wait before
+// retrying carry it in the version, in milliseconds, since they have no version of their own.
+func errorFields(err error) (code uint32, version apis.Version, owner apis.ServerName) {
+	var redirect apis.ErrOwnerRedirect
+	var stale apis.VersionStaleError
+	var busy apis.RetryAfterError
+	if errors.As(err, &redirect) {
+		return codeOwnerRedirect, 0, redirect.Owner
+	} else if errors.As(err, &stale) {
+		return codeVersionStaleAt, stale.Current, ""
+	} else if errors.As(err, &busy) {
+		code = codeBusyRetryAfter
+		if errors.Is(busy.Err, apis.ErrStagingFull) {
+			code = codeStagingFullRetryAfter
+		}
+		return code, apis.Version(busy.RetryAfter / time.Millisecond), ""
+	} else if errors.Is(err, apis.ErrChunkDeleted) {
+		// checked first, since it also matches ErrNotFound
+		return codeChunkDeleted, 0, ""
+	}
+	for code, sentinel := range codedSentinels {
+		if errors.Is(err, sentinel) {
+			return code, 0, ""
+		}
+	}
+	return codeNone, 0, ""
+}
+
+// Reconstructs an error from its message and the fields produced by errorFields. Returns nil if there is no message.
+func errorFromFields(message string, code uint32, version apis.Version, owner apis.ServerName) error {
+	if message == "" {
+		return nil
+	}
+	var cause error
+	switch code {
+	case codeOwnerRedirect:
+		cause = apis.ErrOwnerRedirect{Owner: owner}
+	case codeVersionStaleAt:
+		cause = apis.VersionStaleError{Current: version}
+	case codeBusyRetryAfter:
+		cause = apis.RetryAfterError{Err: apis.ErrBusy, RetryAfter: time.Duration(version) * time.Millisecond}
+	case codeStagingFullRetryAfter:
+		cause = apis.RetryAfterError{Err: apis.ErrStagingFull, RetryAfter: time.Duration(version) * time.Millisecond}
+	default:
+		cause = codedSentinels[code]
+	}
+	if cause == nil {
+		return errors.New(message)
+	}
+	return remoteError{message: message, cause: cause}
+}
+
+// Prepares an error to be returned from a twirp handler, so that decodeError can reconstruct it.
+func encodeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	code, version, owner := errorFields(err)
+	if code == codeNone {
+		return err
+	}
+	tag := strconv.FormatUint(uint64(code), 10) + "/" + strconv.FormatUint(uint64(version), 10) + "/" + string(owner)
+	return errors.New(errorCodeTag + tag + " " + err.Error())
+}
+
+// Reconstructs an error returned through twirp by a handler that used encodeError. Any text added by the transport
+// before the tag is kept.
+func decodeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	message := err.Error()
+	start := strings.Index(message, errorCodeTag)
+	if start == -1 {
+		return err
+	}
+	tagged := message[start+len(errorCodeTag):]
+	end := strings.IndexByte(tagged, ' ')
+	if end == -1 {
+		return err
+	}
+	fields := strings.SplitN(tagged[:end], "/", 3)
+	if len(fields) != 3 {
+		return err
+	}
+	code, cerr := strconv.ParseUint(fields[0], 10, 32)
+	version, verr := strconv.ParseUint(fields[1], 10, 64)
+	if cerr != nil || verr != nil {
+		return err
+	}
+	return errorFromFields(message[:start]+tagged[end+1:], uint32(code), apis.Version(version), apis.ServerName(fields[2]))
+}
+
+// This is how twirp describes a call that failed at the transport level, before any response arrived.
+const transportFailure = "failed to do request"
+
+// Converts the error from a twirp call on the client side into the error that the remote server originally returned.
+// Calls that could not reach the server at all are marked as apis.ErrUnreachable, unless the connection cache refused to
+// send them, in which case the error it coded is kept. Calls that ran out of deadline budget, whether here or on a
+// server further along, match context.DeadlineExceeded.
+func callError(ctx context.Context, err error) error {
+	err = contextError(ctx, err)
+	if err != nil && strings.Contains(err.Error(), budgetExhausted) {
+		return remoteError{message: err.Error(), cause: context.DeadlineExceeded}
+	}
+	if err != nil && ctx.Err() == nil && strings.Contains(err.Error(), transportFailure) && !strings.Contains(err.Error(), errorCodeTag) {
+		return remoteError{message: err.Error(), cause: apis.ErrUnreachable}
+	}
+	return decodeError(err)
+}
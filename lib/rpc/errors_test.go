@@ -0,0 +1,108 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	"zircon/apis"
+)
+
+// Tests that typed errors survive being tagged onto a twirp error and decoded again, even when wrapped on both ends.
+func TestErrorCodeRoundTrip(t *testing.T) {
+	for _, sentinel := range []error{apis.ErrNotFound, apis.ErrVersionStale, apis.ErrChunkTooLarge,
+		apis.ErrAlreadyExists, apis.ErrBeingDeleted, apis.ErrLockContended, apis.ErrStagingFull, apis.ErrChunkDeleted,
+		apis.ErrLeaseHeld, apis.ErrLeaseLost, apis.ErrChecksumMismatch} {
+		decoded := decodeError(fmt.Errorf("twirp error internal: %w", encodeError(fmt.Errorf("context: %w", sentinel))))
+		assert.True(t, errors.Is(decoded, sentinel))
+		assert.Equal(t, "twirp error internal: context: "+sentinel.Error(), decoded.Error())
+	}
+
+	decoded := decodeError(encodeError(fmt.Errorf("write: %w", apis.VersionStaleError{Current: 75})))
+	var stale apis.VersionStaleError
+	if assert.True(t, errors.As(decoded, &stale)) {
+		assert.Equal(t, apis.Version(75), stale.Current)
+	}
+	assert.True(t, errors.Is(decoded, apis.ErrVersionStale))
+	assert.False(t, errors.Is(decoded, apis.ErrNotFound))
+
+	// a deleted chunk is also not found, but is still told apart from one that never existed
+	decoded = decodeError(encodeError(fmt.Errorf("read: %w", apis.ErrChunkDeleted)))
+	assert.True(t, errors.Is(decoded, apis.ErrChunkDeleted))
+	assert.True(t, errors.Is(decoded, apis.ErrNotFound))
+	decoded = decodeError(encodeError(fmt.Errorf("read: %w", apis.ErrNotFound)))
+	assert.False(t, errors.Is(decoded, apis.ErrChunkDeleted))
+
+	// refusals keep how long to wait before retrying, and what the server ran out of room for
+	decoded = decodeError(encodeError(fmt.Errorf("stage: %w", apis.RetryAfterError{
+		Err: fmt.Errorf("full: %w", apis.ErrStagingFull), RetryAfter: 250 * time.Millisecond})))
+	var busy apis.RetryAfterError
+	if assert.True(t, errors.As(decoded, &busy)) {
+		assert.Equal(t, 250*time.Millisecond, busy.RetryAfter)
+	}
+	assert.True(t, errors.Is(decoded, apis.ErrStagingFull))
+	assert.True(t, errors.Is(decoded, apis.ErrBusy))
+	decoded = decodeError(encodeError(apis.RetryAfterError{Err: apis.ErrBusy, RetryAfter: time.Second}))
+	assert.True(t, errors.Is(decoded, apis.ErrBusy))
+	assert.False(t, errors.Is(decoded, apis.ErrStagingFull))
+
+	decoded = decodeError(encodeError(apis.ErrOwnerRedirect{Owner: "metadata-3"}))
+	var redirect apis.ErrOwnerRedirect
+	if assert.True(t, errors.As(decoded, &redirect)) {
+		assert.Equal(t, apis.ServerName("metadata-3"), redirect.Owner)
+	}
+
+	// errors without a code are passed through unchanged
+	plain := errors.New("hello world")
+	assert.Equal(t, plain, encodeError(plain))
+	assert.Equal(t, plain, decodeError(plain))
+	assert.Nil(t, encodeError(nil))
+	assert.Nil(t, decodeError(nil))
+}
+
+// Tests that the fields carried in RPC results are enough to reconstruct each kind of error.
+func TestErrorFieldsRoundTrip(t *testing.T) {
+	for _, original := range []error{
+		fmt.Errorf("context: %w", apis.ErrNotFound),
+		fmt.Errorf("context: %w", apis.ErrChunkDeleted),
+		fmt.Errorf("context: %w", apis.VersionStaleError{Current: 12}),
+		apis.VersionStaleError{Current: 0},
+		apis.ErrOwnerRedirect{Owner: "metadata-7"},
+		apis.RetryAfterError{Err: fmt.Errorf("full: %w", apis.ErrStagingFull), RetryAfter: 2 * time.Second},
+		errors.New("something else"),
+	} {
+		code, version, owner := errorFields(original)
+		decoded := errorFromFields(original.Error(), code, version, owner)
+		assert.Equal(t, original.Error(), decoded.Error())
+		var stale, dstale apis.VersionStaleError
+		assert.Equal(t, errors.As(original, &stale), errors.As(decoded, &dstale))
+		assert.Equal(t, stale, dstale)
+		var redirect, dredirect apis.ErrOwnerRedirect
+		assert.Equal(t, errors.As(original, &redirect), errors.As(decoded, &dredirect))
+		assert.Equal(t, redirect, dredirect)
+		assert.Equal(t, errors.Is(original, apis.ErrNotFound), errors.Is(decoded, apis.ErrNotFound))
+		assert.Equal(t, errors.Is(original, apis.ErrChunkDeleted), errors.Is(decoded, apis.ErrChunkDeleted))
+		var busy, dbusy apis.RetryAfterError
+		assert.Equal(t, errors.As(original, &busy), errors.As(decoded, &dbusy))
+		assert.Equal(t, busy.RetryAfter, dbusy.RetryAfter)
+		assert.Equal(t, errors.Is(original, apis.ErrStagingFull), errors.Is(decoded, apis.ErrStagingFull))
+	}
+	assert.Nil(t, errorFromFields("", codeNotFound, 0, ""))
+}
+
+// Tests that transport failures are recognized as unreachable servers, unless the caller's context was the cause.
+func TestCallErrorUnreachable(t *testing.T) {
+	failure := errors.New("twirp error internal: failed to do request: dial tcp 127.0.0.1:1: connect: connection refused")
+	err := callError(context.Background(), failure)
+	assert.True(t, errors.Is(err, apis.ErrUnreachable))
+	assert.Equal(t, failure.Error(), err.Error())
+
+	assert.False(t, errors.Is(callError(context.Background(), errors.New("twirp error internal: no such chunk")),
+		apis.ErrUnreachable))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, callError(ctx, failure))
+}
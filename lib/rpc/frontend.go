@@ -2,103 +2,412 @@ package rpc
 
 import (
 	"context"
+	"crypto/tls"
 	"net/http"
+	"time"
 	"zircon/apis"
 	"zircon/rpc/twirp"
 )
 
 // Connects to an RPC handler for a Frontend on a certain address.
 func UncachedSubscribeFrontend(address apis.ServerAddress, client *http.Client) (apis.Frontend, error) {
-	saddr := "http://" + string(address)
-	tserve := twirp.NewFrontendProtobufClient(saddr, client)
+	saddr := serverURL(address, client)
+	tserve := twirp.NewFrontendProtobufClient(saddr, budgetClient{client})
 
-	return &proxyTwirpAsFrontend{server: tserve}, nil
+	return &proxyTwirpAsFrontend{server: tserve, ctx: context.Background()}, nil
 }
 
-// Starts serving an RPC handler for a Frontend on a certain address. Runs forever.
+// Implemented by Frontends that make RPCs of their own, such as to look up metadata or to reach the replicas of a
+// chunk, so that those RPCs can be bound to a caller's context too, and by Frontends that check what the caller of each
+// request may do, so that they can be told who that is; see CallerPrincipal.
+type ContextualFrontend interface {
+	apis.Frontend
+	WithContext(ctx context.Context) apis.Frontend
+}
+
+// Rebinds a Frontend obtained from this package so that its RPCs carry ctx, allowing callers to impose deadlines and
+// cancellation on the underlying transport. A ContextualFrontend is rebound through WithContext. Other
+// implementations are returned unchanged.
+func FrontendWithContext(ctx context.Context, server apis.Frontend) apis.Frontend {
+	if proxy, ok := server.(*proxyTwirpAsFrontend); ok {
+		return &proxyTwirpAsFrontend{server: proxy.server, ctx: ctx}
+	}
+	if contextual, ok := server.(ContextualFrontend); ok {
+		return contextual.WithContext(ctx)
+	}
+	return server
+}
+
+// Starts serving an RPC handler for a Frontend on a certain address, along with the endpoints at LivenessPath,
+// ReadinessPath and MetricsPath, and at AdminPath if ServerOptions.Admin is given. Each request is handled by the
+// frontend as rebound to its context, which records its caller. Runs forever.
 func PublishFrontend(server apis.Frontend, address apis.ServerAddress) (func(kill bool) error, apis.ServerAddress, error) {
-	tserve := twirp.NewFrontendServer(&proxyFrontendAsTwirp{server: server}, nil)
-	return LaunchEmbeddedHTTP(tserve, address)
+	return PublishFrontendWithTLS(server, address, nil)
+}
+
+// Like PublishFrontend, but serves over TLS with 'config', unless it is nil. See TLSConfiguration.
+func PublishFrontendWithTLS(server apis.Frontend, address apis.ServerAddress, config *tls.Config) (func(kill bool) error, apis.ServerAddress, error) {
+	return PublishFrontendWithOptions(server, address, ServerOptions{TLS: config})
+}
+
+// Like PublishFrontendWithTLS, but takes all of the options at once, including those that can't be chosen any
+// other way.
+func PublishFrontendWithOptions(server apis.Frontend, address apis.ServerAddress, options ServerOptions) (func(kill bool) error, apis.ServerAddress, error) {
+	if options.Transport == GRPCTransport {
+		return publishGRPCFrontend(server, address, options)
+	}
+	tserve := twirp.NewFrontendServer(&proxyFrontendAsTwirp{server: server, key: options.CapabilityKey}, nil)
+	handler := options.wrap(tserve, "frontend")
+	handler = withMetrics(withHealth(handler, "frontend", server), "frontend", server)
+	return LaunchEmbeddedHTTPWithTLS(withAdmin(handler, options.Admin), address, options.TLS)
 }
 
 type proxyFrontendAsTwirp struct {
 	server apis.Frontend
+	// signs the capabilities issued along with metadata entries; none are issued if it is empty
+	key []byte
+}
+
+// Issues the caller of the call that ctx belongs to a capability for 'chunk', which the frontend has just let them
+// read the metadata entry of. See Capability.
+func (p *proxyFrontendAsTwirp) issue(ctx context.Context, chunk apis.ChunkNum) string {
+	if len(p.key) == 0 {
+		return ""
+	}
+	principal, _ := CallerPrincipal(ctx)
+	return string(issueCapability(p.key, chunk, principal, time.Now().Add(CapabilityLifetime)))
 }
 
 func (p *proxyFrontendAsTwirp) ReadMetadataEntry(ctx context.Context, request *twirp.Frontend_ReadMetadataEntry) (*twirp.Frontend_ReadMetadataEntry_Result, error) {
-	ver, address, err := p.server.ReadMetadataEntry(apis.ChunkNum(request.Chunk))
+	ver, address, err := FrontendWithContext(ctx, p.server).ReadMetadataEntry(apis.ChunkNum(request.Chunk))
 	if err != nil {
-		return nil, err
+		return nil, encodeError(err)
 	}
 	return &twirp.Frontend_ReadMetadataEntry_Result{
-		Version: uint64(ver),
-		Address: AddressArrayToStringArray(address),
+		Version:    uint64(ver),
+		Address:    AddressArrayToStringArray(address),
+		Capability: p.issue(ctx, apis.ChunkNum(request.Chunk)),
+	}, nil
+}
+
+func (p *proxyFrontendAsTwirp) ReadFullMetadataEntry(ctx context.Context, request *twirp.Frontend_ReadFullMetadataEntry) (*twirp.Frontend_ReadFullMetadataEntry_Result, error) {
+	entry, address, err := FrontendWithContext(ctx, p.server).ReadFullMetadataEntry(apis.ChunkNum(request.Chunk))
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	owner, allowed, mode := aclToTwirp(entry.ACL)
+	return &twirp.Frontend_ReadFullMetadataEntry_Result{
+		MostRecentVersion:   uint64(entry.MostRecentVersion),
+		LastConsumedVersion: uint64(entry.LastConsumedVersion),
+		Replicas:            IDArrayToIntArray(entry.Replicas),
+		Lagging:             IDArrayToIntArray(entry.Lagging),
+		Address:             AddressArrayToStringArray(address),
+		AclOwner:            owner,
+		AclAllowed:          allowed,
+		AclMode:             mode,
+		LeaseHolder:         uint64(entry.Lease.Holder),
+		LeaseExpiry:         entry.Lease.Expiry,
+		ReplicationFactor:   uint32(entry.ReplicationFactor),
+		Capability:          p.issue(ctx, apis.ChunkNum(request.Chunk)),
 	}, nil
 }
 
 func (p *proxyFrontendAsTwirp) CommitWrite(ctx context.Context, request *twirp.Frontend_CommitWrite) (*twirp.Frontend_CommitWrite_Result, error) {
-	ver, err := p.server.CommitWrite(apis.ChunkNum(request.Chunk), apis.Version(request.Version), apis.CommitHash(request.Hash))
+	ver, err := FrontendWithContext(ctx, p.server).CommitWrite(apis.ChunkNum(request.Chunk), apis.Version(request.Version), apis.CommitHash(request.Hash))
 	if err != nil {
-		return nil, err
+		code, _, _ := errorFields(err)
+		return &twirp.Frontend_CommitWrite_Result{
+			Version:   uint64(ver),
+			Error:     err.Error(),
+			ErrorCode: code,
+		}, nil
 	}
 	return &twirp.Frontend_CommitWrite_Result{
 		Version: uint64(ver),
 	}, nil
 }
 
+func (p *proxyFrontendAsTwirp) CommitAppend(ctx context.Context, request *twirp.Frontend_CommitAppend) (*twirp.Frontend_CommitAppend_Result, error) {
+	ver, offset, err := FrontendWithContext(ctx, p.server).CommitAppend(apis.ChunkNum(request.Chunk), apis.CommitHash(request.Hash))
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &twirp.Frontend_CommitAppend_Result{
+		Version: uint64(ver),
+		Offset:  offset,
+	}, nil
+}
+
 func (p *proxyFrontendAsTwirp) New(ctx context.Context, request *twirp.Frontend_New) (*twirp.Frontend_New_Result, error) {
-	chunk, err := p.server.New()
+	chunk, err := FrontendWithContext(ctx, p.server).New()
 	if err != nil {
-		return nil, err
+		return nil, encodeError(err)
+	}
+	return &twirp.Frontend_New_Result{
+		Chunk: uint64(chunk),
+	}, nil
+}
+
+func (p *proxyFrontendAsTwirp) NewWithOptions(ctx context.Context, request *twirp.Frontend_NewWithOptions) (*twirp.Frontend_New_Result, error) {
+	chunk, err := FrontendWithContext(ctx, p.server).NewWithOptions(apis.NewOptions{
+		ReplicationFactor: int(request.ReplicationFactor),
+		ACL:               aclFromTwirp(request.AclOwner, request.AclAllowed, request.AclMode),
+	})
+	if err != nil {
+		return nil, encodeError(err)
 	}
 	return &twirp.Frontend_New_Result{
 		Chunk: uint64(chunk),
 	}, nil
 }
 
+func (p *proxyFrontendAsTwirp) AllocateChunks(ctx context.Context, request *twirp.Frontend_AllocateChunks) (*twirp.Frontend_AllocateChunks_Result, error) {
+	chunks, err := FrontendWithContext(ctx, p.server).AllocateChunks(int(request.Count))
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	result := &twirp.Frontend_AllocateChunks_Result{
+		Chunks: make([]uint64, len(chunks)),
+	}
+	for i, chunk := range chunks {
+		result.Chunks[i] = uint64(chunk)
+	}
+	return result, nil
+}
+
 func (p *proxyFrontendAsTwirp) Delete(ctx context.Context, request *twirp.Frontend_Delete) (*twirp.Frontend_Delete_Result, error) {
-	err := p.server.Delete(apis.ChunkNum(request.Chunk), apis.Version(request.Version))
-	return &twirp.Frontend_Delete_Result{}, err
+	err := FrontendWithContext(ctx, p.server).Delete(apis.ChunkNum(request.Chunk), apis.Version(request.Version))
+	if err != nil {
+		code, version, _ := errorFields(err)
+		return &twirp.Frontend_Delete_Result{
+			Error:          err.Error(),
+			ErrorCode:      code,
+			CurrentVersion: uint64(version),
+		}, nil
+	}
+	return &twirp.Frontend_Delete_Result{}, nil
+}
+
+func (p *proxyFrontendAsTwirp) DeleteIncomplete(ctx context.Context, request *twirp.Frontend_DeleteIncomplete) (*twirp.Frontend_Delete_Result, error) {
+	err := FrontendWithContext(ctx, p.server).DeleteIncomplete(apis.ChunkNum(request.Chunk))
+	if err != nil {
+		code, version, _ := errorFields(err)
+		return &twirp.Frontend_Delete_Result{
+			Error:          err.Error(),
+			ErrorCode:      code,
+			CurrentVersion: uint64(version),
+		}, nil
+	}
+	return &twirp.Frontend_Delete_Result{}, nil
+}
+
+func (p *proxyFrontendAsTwirp) AcquireWriteLease(ctx context.Context, request *twirp.Frontend_AcquireWriteLease) (*twirp.Frontend_AcquireWriteLease_Result, error) {
+	lease, err := FrontendWithContext(ctx, p.server).AcquireWriteLease(apis.ChunkNum(request.Chunk))
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &twirp.Frontend_AcquireWriteLease_Result{
+		Lease: uint64(lease),
+	}, nil
+}
+
+func (p *proxyFrontendAsTwirp) RenewWriteLease(ctx context.Context, request *twirp.Frontend_WriteLease) (*twirp.Frontend_WriteLease_Result, error) {
+	err := FrontendWithContext(ctx, p.server).RenewWriteLease(apis.ChunkNum(request.Chunk), apis.LeaseID(request.Lease))
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &twirp.Frontend_WriteLease_Result{}, nil
+}
+
+func (p *proxyFrontendAsTwirp) ReleaseWriteLease(ctx context.Context, request *twirp.Frontend_WriteLease) (*twirp.Frontend_WriteLease_Result, error) {
+	err := FrontendWithContext(ctx, p.server).ReleaseWriteLease(apis.ChunkNum(request.Chunk), apis.LeaseID(request.Lease))
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &twirp.Frontend_WriteLease_Result{}, nil
+}
+
+func (p *proxyFrontendAsTwirp) CommitLeasedWrite(ctx context.Context, request *twirp.Frontend_CommitLeasedWrite) (*twirp.Frontend_CommitLeasedWrite_Result, error) {
+	ver, err := FrontendWithContext(ctx, p.server).CommitLeasedWrite(apis.ChunkNum(request.Chunk), apis.LeaseID(request.Lease), apis.CommitHash(request.Hash))
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &twirp.Frontend_CommitLeasedWrite_Result{
+		Version: uint64(ver),
+	}, nil
 }
 
 type proxyTwirpAsFrontend struct {
 	server twirp.Frontend
+	ctx    context.Context
 }
 
 func (p *proxyTwirpAsFrontend) ReadMetadataEntry(chunk apis.ChunkNum) (apis.Version, []apis.ServerAddress, error) {
-	result, err := p.server.ReadMetadataEntry(context.Background(), &twirp.Frontend_ReadMetadataEntry{
+	result, err := p.server.ReadMetadataEntry(p.ctx, &twirp.Frontend_ReadMetadataEntry{
 		Chunk: uint64(chunk),
 	})
+	err = callError(p.ctx, err)
 	if err != nil {
 		return 0, nil, err
 	}
+	collectCapability(p.ctx, chunk, Capability(result.Capability))
 	return apis.Version(result.Version), StringArrayToAddressArray(result.Address), nil
 }
 
+func (p *proxyTwirpAsFrontend) ReadFullMetadataEntry(chunk apis.ChunkNum) (apis.MetadataEntry, []apis.ServerAddress, error) {
+	result, err := p.server.ReadFullMetadataEntry(p.ctx, &twirp.Frontend_ReadFullMetadataEntry{
+		Chunk: uint64(chunk),
+	})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return apis.MetadataEntry{}, nil, err
+	}
+	collectCapability(p.ctx, chunk, Capability(result.Capability))
+	entry := apis.MetadataEntry{
+		MostRecentVersion:   apis.Version(result.MostRecentVersion),
+		LastConsumedVersion: apis.Version(result.LastConsumedVersion),
+		Replicas:            IntArrayToIDArray(result.Replicas),
+		ACL:                 aclFromTwirp(result.AclOwner, result.AclAllowed, result.AclMode),
+		Lease: apis.WriteLease{
+			Holder: apis.LeaseID(result.LeaseHolder),
+			Expiry: result.LeaseExpiry,
+		},
+		ReplicationFactor: uint8(result.ReplicationFactor),
+	}
+	// keep an entry with no laggards the same as one read directly from a metadata cache
+	if len(result.Lagging) > 0 {
+		entry.Lagging = IntArrayToIDArray(result.Lagging)
+	}
+	return entry, StringArrayToAddressArray(result.Address), nil
+}
+
 func (p *proxyTwirpAsFrontend) CommitWrite(chunk apis.ChunkNum, version apis.Version, hash apis.CommitHash) (apis.Version, error) {
-	result, err := p.server.CommitWrite(context.Background(), &twirp.Frontend_CommitWrite{
+	result, err := p.server.CommitWrite(p.ctx, &twirp.Frontend_CommitWrite{
 		Chunk:   uint64(chunk),
 		Version: uint64(version),
 		Hash:    string(hash),
 	})
+	err = callError(p.ctx, err)
 	if err != nil {
 		return 0, err
 	}
+	if result.Error != "" {
+		// the version is only meaningful after a staleness failure, and is zero otherwise
+		return apis.Version(result.Version), errorFromFields(result.Error, result.ErrorCode, apis.Version(result.Version), "")
+	}
 	return apis.Version(result.Version), nil
 }
 
+func (p *proxyTwirpAsFrontend) CommitAppend(chunk apis.ChunkNum, hash apis.CommitHash) (apis.Version, uint32, error) {
+	result, err := p.server.CommitAppend(p.ctx, &twirp.Frontend_CommitAppend{
+		Chunk: uint64(chunk),
+		Hash:  string(hash),
+	})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return 0, 0, err
+	}
+	return apis.Version(result.Version), result.Offset, nil
+}
+
 func (p *proxyTwirpAsFrontend) New() (apis.ChunkNum, error) {
-	result, err := p.server.New(context.Background(), &twirp.Frontend_New{})
+	result, err := p.server.New(p.ctx, &twirp.Frontend_New{})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return 0, err
+	}
+	return apis.ChunkNum(result.Chunk), nil
+}
+
+func (p *proxyTwirpAsFrontend) NewWithOptions(options apis.NewOptions) (apis.ChunkNum, error) {
+	owner, allowed, mode := aclToTwirp(options.ACL)
+	result, err := p.server.NewWithOptions(p.ctx, &twirp.Frontend_NewWithOptions{
+		ReplicationFactor: uint32(options.ReplicationFactor),
+		AclOwner:          owner,
+		AclAllowed:        allowed,
+		AclMode:           mode,
+	})
+	err = callError(p.ctx, err)
 	if err != nil {
 		return 0, err
 	}
 	return apis.ChunkNum(result.Chunk), nil
 }
 
+func (p *proxyTwirpAsFrontend) AllocateChunks(count int) ([]apis.ChunkNum, error) {
+	result, err := p.server.AllocateChunks(p.ctx, &twirp.Frontend_AllocateChunks{
+		Count: uint32(count),
+	})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return nil, err
+	}
+	chunks := make([]apis.ChunkNum, len(result.Chunks))
+	for i, chunk := range result.Chunks {
+		chunks[i] = apis.ChunkNum(chunk)
+	}
+	return chunks, nil
+}
+
 func (p *proxyTwirpAsFrontend) Delete(chunk apis.ChunkNum, version apis.Version) error {
-	_, err := p.server.Delete(context.Background(), &twirp.Frontend_Delete{
+	result, err := p.server.Delete(p.ctx, &twirp.Frontend_Delete{
 		Chunk:   uint64(chunk),
 		Version: uint64(version),
 	})
-	return err
+	err = callError(p.ctx, err)
+	if err != nil {
+		return err
+	}
+	return errorFromFields(result.Error, result.ErrorCode, apis.Version(result.CurrentVersion), "")
+}
+
+func (p *proxyTwirpAsFrontend) DeleteIncomplete(chunk apis.ChunkNum) error {
+	result, err := p.server.DeleteIncomplete(p.ctx, &twirp.Frontend_DeleteIncomplete{
+		Chunk: uint64(chunk),
+	})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return err
+	}
+	return errorFromFields(result.Error, result.ErrorCode, apis.Version(result.CurrentVersion), "")
+}
+
+func (p *proxyTwirpAsFrontend) AcquireWriteLease(chunk apis.ChunkNum) (apis.LeaseID, error) {
+	result, err := p.server.AcquireWriteLease(p.ctx, &twirp.Frontend_AcquireWriteLease{
+		Chunk: uint64(chunk),
+	})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return apis.NoLease, err
+	}
+	return apis.LeaseID(result.Lease), nil
+}
+
+func (p *proxyTwirpAsFrontend) RenewWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error {
+	_, err := p.server.RenewWriteLease(p.ctx, &twirp.Frontend_WriteLease{
+		Chunk: uint64(chunk),
+		Lease: uint64(lease),
+	})
+	return callError(p.ctx, err)
+}
+
+func (p *proxyTwirpAsFrontend) ReleaseWriteLease(chunk apis.ChunkNum, lease apis.LeaseID) error {
+	_, err := p.server.ReleaseWriteLease(p.ctx, &twirp.Frontend_WriteLease{
+		Chunk: uint64(chunk),
+		Lease: uint64(lease),
+	})
+	return callError(p.ctx, err)
+}
+
+func (p *proxyTwirpAsFrontend) CommitLeasedWrite(chunk apis.ChunkNum, lease apis.LeaseID, hash apis.CommitHash) (apis.Version, error) {
+	result, err := p.server.CommitLeasedWrite(p.ctx, &twirp.Frontend_CommitLeasedWrite{
+		Chunk: uint64(chunk),
+		Lease: uint64(lease),
+		Hash:  string(hash),
+	})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return 0, err
+	}
+	return apis.Version(result.Version), nil
 }
@@ -1,9 +1,13 @@
 package rpc
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 	"zircon/apis"
 	"zircon/apis/mocks"
 )
@@ -81,6 +85,22 @@ func TestFrontend_New_Error(t *testing.T) {
 	assert.Contains(t, err.Error(), "frontend error 3")
 }
 
+func TestFrontend_AllocateChunks(t *testing.T) {
+	mocked, teardown, server := beginFrontendTest(t)
+	defer teardown()
+
+	mocked.On("AllocateChunks", 3).Return([]apis.ChunkNum{170, 171, 172}, nil)
+	mocked.On("AllocateChunks", 0).Return(nil, errors.New("frontend error 8"))
+
+	chunks, err := server.AllocateChunks(3)
+	assert.NoError(t, err)
+	assert.Equal(t, []apis.ChunkNum{170, 171, 172}, chunks)
+
+	_, err = server.AllocateChunks(0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "frontend error 8")
+}
+
 func TestFrontend_Delete(t *testing.T) {
 	mocked, teardown, server := beginFrontendTest(t)
 	defer teardown()
@@ -95,3 +115,74 @@ func TestFrontend_Delete(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "frontend error 4")
 }
+
+func TestFrontend_TypedErrors(t *testing.T) {
+	mocked, teardown, server := beginFrontendTest(t)
+	defer teardown()
+
+	mocked.On("CommitWrite", apis.ChunkNum(170), apis.Version(3), apis.CommitHash("hash")).
+		Return(apis.Version(5), fmt.Errorf("frontend error 5: %w", apis.VersionStaleError{Current: 5}))
+	mocked.On("Delete", apis.ChunkNum(170), apis.Version(3)).
+		Return(fmt.Errorf("frontend error 6: %w", apis.VersionStaleError{Current: 5}))
+	mocked.On("ReadMetadataEntry", apis.ChunkNum(171)).
+		Return(apis.Version(0), nil, fmt.Errorf("frontend error 7: %w", apis.ErrBeingDeleted))
+
+	version, err := server.CommitWrite(170, 3, "hash")
+	var stale apis.VersionStaleError
+	if assert.True(t, errors.As(err, &stale)) {
+		assert.Equal(t, apis.Version(5), stale.Current)
+	}
+	assert.Equal(t, apis.Version(5), version)
+	assert.Contains(t, err.Error(), "frontend error 5")
+
+	err = server.Delete(170, 3)
+	stale = apis.VersionStaleError{}
+	if assert.True(t, errors.As(err, &stale)) {
+		assert.Equal(t, apis.Version(5), stale.Current)
+	}
+	assert.Contains(t, err.Error(), "frontend error 6")
+
+	_, _, err = server.ReadMetadataEntry(171)
+	assert.True(t, errors.Is(err, apis.ErrBeingDeleted))
+	assert.Contains(t, err.Error(), "frontend error 7")
+}
+
+// A Frontend that reports each context its requests are bound to.
+type contextualFrontend struct {
+	*mocks.Frontend
+	bound chan context.Context
+}
+
+func (c *contextualFrontend) WithContext(ctx context.Context) apis.Frontend {
+	c.bound <- ctx
+	return c
+}
+
+func TestFrontend_ContextPropagates(t *testing.T) {
+	mocked := &contextualFrontend{Frontend: new(mocks.Frontend), bound: make(chan context.Context, 1)}
+	mocked.On("New").After(500*time.Millisecond).Return(apis.ChunkNum(559), nil)
+	teardown, address, err := PublishFrontend(mocked, ":0")
+	require.NoError(t, err)
+	defer teardown(true)
+	cache := NewConnectionCache()
+	defer cache.CloseAll()
+	server, err := cache.SubscribeFrontend(address)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = FrontendWithContext(ctx, server).New()
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+
+	// the server learns that the client gave up, so that any RPCs it makes for the request can be abandoned too
+	select {
+	case serverCtx := <-mocked.bound:
+		select {
+		case <-serverCtx.Done():
+		case <-time.After(time.Second):
+			t.Error("request context was not cancelled on the server")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request was not bound to a context on the server")
+	}
+}
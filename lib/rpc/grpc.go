@@ -0,0 +1,783 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"zircon/apis"
+	"zircon/rpc/twirp"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	// registers gzip, so that servers accept it
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Which protocol a cluster's servers and clients use to talk to one another. As with TLS, every server and client in a
+// cluster must agree on it.
+type Transport string
+
+const (
+	// twirp over HTTP/1.1. This is the default when no transport is configured.
+	TwirpTransport Transport = "twirp"
+	// gRPC over HTTP/2, for deployments that want its flow control or already run infrastructure built for it, such as
+	// load balancers and proxies.
+	GRPCTransport Transport = "grpc"
+)
+
+// Fails unless the transport is one that this package can use. The empty transport means TwirpTransport.
+func (t Transport) Validate() error {
+	switch t {
+	case "", TwirpTransport, GRPCTransport:
+		return nil
+	default:
+		return fmt.Errorf("unknown transport %q; expected %q or %q", string(t), TwirpTransport, GRPCTransport)
+	}
+}
+
+// Fails unless 'compression' can be used with the transport.
+func (t Transport) CheckCompression(compression Compression) error {
+	if err := compression.Validate(); err != nil {
+		return err
+	}
+	if t == GRPCTransport && compression != NoCompression && compression != GzipCompression {
+		return fmt.Errorf("compression %q is not supported over gRPC; only %q is", string(compression), GzipCompression)
+	}
+	return nil
+}
+
+// Explanation of the gRPC transport:
+//     The services in rpc/twirp are plain protobuf services, so build.sh compiles them into gRPC stubs as well, and the
+//     rest of this package is shared between the two transports. A gRPC server method has the same signature as the
+//     corresponding twirp handler method, so the proxyXAsTwirp types are registered with a grpc.Server as they are.
+//     On the client side, the grpcXClient types adapt the generated gRPC clients to the twirp interfaces, so that the
+//     proxyTwirpAsX types can be used unchanged. Errors are coded into their messages the same way for both (see
+//     errors.go); a unary interceptor strips gRPC's own prefix off of them, and marks calls that never reached the
+//     server as apis.ErrUnreachable.
+//     Some things differ from twirp. Chunk data is always sent inside messages, because gRPC applies flow control to
+//     large messages itself, so stream.go is not used. Deadlines are passed along by gRPC instead of the budget header,
+//     and capabilities as metadata instead of in a header of their own.
+//     Timeouts.Call is not enforced, since gRPC doesn't tell when a response starts to arrive. Of the compressions, only
+//     gzip is built into gRPC, so it is the only one that can be used over it. The liveness, readiness, and metrics
+//     endpoints are only served over twirp.
+
+// The largest message either end accepts, which has to hold a whole chunk and the fields that go with it.
+const grpcMaxMessageSize = 2 * apis.MaxChunkSize
+
+// Like PublishChunkserverWithTLS, but uses 'transport' instead of always twirp.
+func PublishChunkserverWithTransport(server apis.Chunkserver, address apis.ServerAddress, config *tls.Config, transport Transport) (func(kill bool) error, apis.ServerAddress, error) {
+	return PublishChunkserverWithOptions(server, address, ServerOptions{TLS: config, Transport: transport})
+}
+
+// Like PublishFrontendWithTLS, but uses 'transport' instead of always twirp.
+func PublishFrontendWithTransport(server apis.Frontend, address apis.ServerAddress, config *tls.Config, transport Transport) (func(kill bool) error, apis.ServerAddress, error) {
+	return PublishFrontendWithOptions(server, address, ServerOptions{TLS: config, Transport: transport})
+}
+
+// Like PublishMetadataCacheWithTLS, but uses 'transport' instead of always twirp.
+func PublishMetadataCacheWithTransport(server apis.MetadataCache, address apis.ServerAddress, config *tls.Config, transport Transport) (func(kill bool) error, apis.ServerAddress, error) {
+	return PublishMetadataCacheWithOptions(server, address, ServerOptions{TLS: config, Transport: transport})
+}
+
+// Like PublishSyncServerWithTLS, but uses 'transport' instead of always twirp.
+func PublishSyncServerWithTransport(server apis.SyncServer, address apis.ServerAddress, config *tls.Config, transport Transport) (func(kill bool) error, apis.ServerAddress, error) {
+	return PublishSyncServerWithOptions(server, address, ServerOptions{TLS: config, Transport: transport})
+}
+
+func publishGRPCChunkserver(server apis.Chunkserver, address apis.ServerAddress, options ServerOptions) (func(kill bool) error, apis.ServerAddress, error) {
+	return launchGRPC(address, "chunkserver", options, func(s *grpc.Server) {
+		twirp.RegisterChunkserverServer(s, &proxyChunkserverAsTwirp{server: server, guard: options.guard()})
+	})
+}
+
+func publishGRPCFrontend(server apis.Frontend, address apis.ServerAddress, options ServerOptions) (func(kill bool) error, apis.ServerAddress, error) {
+	return launchGRPC(address, "frontend", options, func(s *grpc.Server) {
+		twirp.RegisterFrontendServer(s, &proxyFrontendAsTwirp{server: server, key: options.CapabilityKey})
+	})
+}
+
+func publishGRPCMetadataCache(server apis.MetadataCache, address apis.ServerAddress, options ServerOptions) (func(kill bool) error, apis.ServerAddress, error) {
+	return launchGRPC(address, "metadatacache", options, func(s *grpc.Server) {
+		twirp.RegisterMetadataCacheServer(s, &proxyMetadataCacheAsTwirp{server: server, guard: options.guard()})
+	})
+}
+
+func publishGRPCSyncServer(server apis.SyncServer, address apis.ServerAddress, options ServerOptions) (func(kill bool) error, apis.ServerAddress, error) {
+	return launchGRPC(address, "syncserver", options, func(s *grpc.Server) {
+		twirp.RegisterSyncServerServer(s, &proxySyncServerAsTwirp{server: server})
+	})
+}
+
+// Like LaunchEmbeddedHTTPWithTLS, but serves the gRPC services that 'register' adds to the server, which has the given
+// role.
+func launchGRPC(address apis.ServerAddress, role string, options ServerOptions, register func(s *grpc.Server)) (func(kill bool) error, apis.ServerAddress, error) {
+	listener, err := net.Listen("tcp", string(address))
+	if err != nil {
+		return nil, "", err
+	}
+	serverOptions := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(grpcMaxMessageSize),
+		grpc.MaxSendMsgSize(grpcMaxMessageSize),
+		// lets clients ping as often as their health checks call for, even between calls
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: time.Second, PermitWithoutStream: true}),
+	}
+	if options.TLS != nil {
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(options.TLS)))
+	}
+	serverOptions = append(serverOptions, grpc.UnaryInterceptor(grpcServerInterceptor(role, options)))
+	grpcServer := grpc.NewServer(serverOptions...)
+	register(grpcServer)
+
+	termErr := make(chan error, 1)
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				termErr <- fmt.Errorf("panic: %v", err)
+			}
+		}()
+		err := grpcServer.Serve(listener)
+		if err == grpc.ErrServerStopped {
+			err = nil
+		}
+		termErr <- err
+	}()
+
+	teardown := func(kill bool) error {
+		if kill {
+			// lets calls in progress finish, and closes the listener
+			grpcServer.GracefulStop()
+		}
+		return <-termErr
+	}
+	return teardown, apis.ServerAddress(listener.Addr().String()), nil
+}
+
+// Like NewConnectionCacheWithOptions, for GRPCTransport.
+func newGRPCCache(options ConnectionOptions) *grpcCache {
+	return &grpcCache{
+		limit:          options.Limit,
+		config:         options.TLS,
+		compression:    options.Compression,
+		timeouts:       options.Timeouts.withDefaults(),
+		retry:          options.Retry.withDefaults(),
+		breakers:       newCircuitBreakers(options.Breaker),
+		health:         options.Health.withDefaults(),
+		pool:           options.Pool.withDefaults(),
+		interceptors:   options.Interceptors,
+		conns:          map[apis.ServerAddress]*grpc.ClientConn{},
+		chunkservers:   map[apis.ServerAddress]apis.Chunkserver{},
+		frontends:      map[apis.ServerAddress]apis.Frontend{},
+		metadatacaches: map[apis.ServerAddress]apis.MetadataCache{},
+		syncservers:    map[apis.ServerAddress]apis.SyncServer{},
+	}
+}
+
+// A ConnectionCache that holds one gRPC connection to each server.
+type grpcCache struct {
+	limit        InFlightLimit
+	config       *tls.Config
+	compression  Compression
+	timeouts     Timeouts
+	retry        RetryPolicy
+	breakers     *circuitBreakers
+	health       HealthCheck
+	pool         PoolOptions
+	interceptors interceptorChain
+
+	mu             sync.Mutex
+	closed         bool
+	conns          map[apis.ServerAddress]*grpc.ClientConn
+	chunkservers   map[apis.ServerAddress]apis.Chunkserver
+	frontends      map[apis.ServerAddress]apis.Frontend
+	metadatacaches map[apis.ServerAddress]apis.MetadataCache
+	syncservers    map[apis.ServerAddress]apis.SyncServer
+	// calls in progress, which CloseAll waits for
+	inFlight sync.WaitGroup
+}
+
+// Returns the connection to an address, opening it if there isn't one yet. Must be called with mu held.
+func (c *grpcCache) connect(address apis.ServerAddress) (*grpc.ClientConn, error) {
+	if c.closed {
+		return nil, errors.New("attempt to use closed connection cache")
+	}
+	if conn, found := c.conns[address]; found {
+		return conn, nil
+	}
+	calls := []grpc.CallOption{grpc.MaxCallRecvMsgSize(grpcMaxMessageSize), grpc.MaxCallSendMsgSize(grpcMaxMessageSize)}
+	if c.compression == GzipCompression {
+		// servers respond with the same compression
+		calls = append(calls, grpc.UseCompressor(gzip.Name))
+	}
+	dialer := &net.Dialer{Timeout: c.timeouts.Connect, KeepAlive: c.pool.KeepAlive}
+	options := []grpc.DialOption{
+		grpc.WithDefaultCallOptions(calls...),
+		grpc.WithUnaryInterceptor(grpcClientInterceptor(c.interceptors, address, c.intercept(address))),
+		grpc.WithContextDialer(func(ctx context.Context, target string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", target)
+		}),
+	}
+	if c.health.Interval > 0 {
+		// gRPC's own pings stand in for health checks, and it reconnects by itself once a server answers again
+		options = append(options, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                c.health.Interval,
+			Timeout:             c.health.Timeout,
+			PermitWithoutStream: true,
+		}))
+	}
+	if c.config != nil {
+		options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(c.config)))
+	} else {
+		options = append(options, grpc.WithInsecure())
+	}
+	// doesn't wait for the connection to be made; calls made before it is fail or wait as gRPC decides
+	conn, err := grpc.Dial(string(address), options...)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[address] = conn
+	return conn, nil
+}
+
+// Enforces the in-flight limit on the calls made to 'address', keeps count of them for CloseAll, refuses calls without
+// enough deadline budget left, presents capabilities, retries and breaks circuits as the twirp transport does, and
+// converts the errors of calls that fail into the form that callError expects.
+func (c *grpcCache) intercept(address apis.ServerAddress) grpc.UnaryClientInterceptor {
+	var slots chan struct{}
+	if c.limit.PerPeer > 0 {
+		slots = make(chan struct{}, c.limit.PerPeer)
+	}
+	return func(ctx context.Context, method string, request, reply interface{}, conn *grpc.ClientConn, invoker grpc.UnaryInvoker, options ...grpc.CallOption) error {
+		if err := CheckBudget(ctx); err != nil {
+			return err
+		}
+		if capability := presentedCapability(ctx); capability != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(capabilityHeader), string(capability))
+		}
+		parent := ctx
+		ctx, cancel := c.timeouts.bound(ctx)
+		defer cancel()
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return errors.New("attempt to use closed connection cache")
+		}
+		c.inFlight.Add(1)
+		c.mu.Unlock()
+		defer c.inFlight.Done()
+
+		if slots != nil {
+			if c.limit.FailFast {
+				select {
+				case slots <- struct{}{}:
+				default:
+					return fmt.Errorf("%d requests already in progress to %s: %w", c.limit.PerPeer, address, apis.ErrBusy)
+				}
+			} else {
+				select {
+				case slots <- struct{}{}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			defer func() {
+				<-slots
+			}()
+		}
+		attempts := 1
+		if idempotent(method) {
+			attempts = c.retry.Attempts
+		}
+		for attempt := 1; ; attempt++ {
+			err := c.attempt(ctx, address, func() error {
+				return invoker(ctx, method, request, reply, conn, options...)
+			})
+			if attempt >= attempts || !grpcUnreached(ctx, err) || !c.retry.wait(ctx, attempt) {
+				if err != nil && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+					return fmt.Errorf("%s: call did not finish within %v: %w", budgetExhausted, c.timeouts.Total, context.DeadlineExceeded)
+				}
+				return err
+			}
+		}
+	}
+}
+
+// Makes one attempt at a call, subject to the server's circuit.
+func (c *grpcCache) attempt(ctx context.Context, address apis.ServerAddress, invoke func() error) error {
+	if err := c.breakers.allow(string(address)); err != nil {
+		return err
+	}
+	err := grpcError(invoke())
+	c.breakers.record(string(address), err, grpcUnreached(ctx, err))
+	return err
+}
+
+// Like unreachedFailure, for the errors returned by grpcError.
+func grpcUnreached(ctx context.Context, err error) bool {
+	var open circuitOpenError
+	return ctx.Err() == nil && errors.Is(err, apis.ErrUnreachable) && !errors.As(err, &open)
+}
+
+// Undoes what gRPC does to the errors returned by handlers, so that what's left is what the handler returned, or marks
+// the error as apis.ErrUnreachable if the call never reached the server.
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch s.Code() {
+	case codes.Unavailable:
+		return remoteError{message: err.Error(), cause: apis.ErrUnreachable}
+	case codes.Unknown:
+		return errors.New(s.Message())
+	default:
+		return err
+	}
+}
+
+// Passes every call made through 'next' through 'interceptors' first.
+func grpcClientInterceptor(interceptors interceptorChain, address apis.ServerAddress, next grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+	if len(interceptors) == 0 {
+		return next
+	}
+	return func(ctx context.Context, method string, request, reply interface{}, conn *grpc.ClientConn, invoker grpc.UnaryInvoker, options ...grpc.CallOption) error {
+		call, ok := rpcCall(method)
+		if !ok {
+			return next(ctx, method, request, reply, conn, invoker, options...)
+		}
+		call.Peer = string(address)
+		call.Metadata = map[string]string{}
+		var err error
+		called := false
+		refused := interceptors.run(ctx, &call, func(ctx context.Context) error {
+			called = true
+			for key, value := range call.Metadata {
+				ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(metadataPrefix+key), value)
+			}
+			err = next(ctx, method, request, reply, conn, invoker, options...)
+			return decodeError(err)
+		})
+		if !called {
+			return refused
+		}
+		return err
+	}
+}
+
+// Recovers from panics in, logs, and passes through admission control and the interceptors every call that a gRPC
+// server handles, as the twirp middleware does (see ServerOptions.wrap). gRPC has already read each request in by then,
+// so admission control can't keep refused calls' data from being read, only from being held on to.
+func grpcServerInterceptor(role string, options ServerOptions) grpc.UnaryServerInterceptor {
+	chain := interceptorChain(options.Interceptors)
+	admission := newAdmission(options.Admission)
+	return func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (response interface{}, err error) {
+		call, ok := rpcCall(info.FullMethod)
+		if !ok {
+			call = Call{Method: info.FullMethod}
+		}
+		call.Server = true
+		var state *tls.ConnectionState
+		if p, ok := peer.FromContext(ctx); ok {
+			call.Peer = p.Addr.String()
+			if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+				state = &info.State
+			}
+		}
+		ctx = ContextWithCaller(ctx, peerPrincipal(state))
+		ctx = ContextWithCallerAddress(ctx, call.Peer)
+		call.Metadata = map[string]string{}
+		incoming, _ := metadata.FromIncomingContext(ctx)
+		if presented := incoming.Get(capabilityHeader); len(presented) > 0 {
+			ctx = contextWithPresented(ctx, Capability(presented[0]))
+		}
+		prefix := strings.ToLower(metadataPrefix)
+		for key, values := range incoming {
+			if strings.HasPrefix(key, prefix) && len(values) > 0 {
+				call.Metadata[key[len(prefix):]] = values[0]
+			}
+		}
+		if options.AccessLog != nil {
+			start := time.Now()
+			defer func() {
+				logAccess(options.AccessLog, role, call, status.Code(err).String(), time.Since(start),
+					messageSize(request), messageSize(response), decodeError(err))
+			}()
+		}
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				response, err = nil, panicError(options.Logger, role, call, recovered)
+			}
+		}()
+
+		if admission != nil && carriesWrite(call) {
+			release, refused := admission.admit(ctx, messageSize(request))
+			if refused != nil {
+				return nil, encodeError(refused)
+			}
+			defer release()
+		}
+		called := false
+		refused := chain.run(ctx, &call, func(ctx context.Context) error {
+			called = true
+			response, err = handler(ctx, request)
+			return decodeError(err)
+		})
+		if !called {
+			return nil, encodeError(refused)
+		}
+		return response, err
+	}
+}
+
+// The encoded size of a request or response, or zero if there isn't one.
+func messageSize(message interface{}) int64 {
+	if message, ok := message.(proto.Message); ok {
+		return int64(proto.Size(message))
+	}
+	return 0
+}
+
+func (c *grpcCache) SubscribeChunkserver(address apis.ServerAddress) (apis.Chunkserver, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if existing, found := c.chunkservers[address]; found && !c.closed {
+		return existing, nil
+	}
+	conn, err := c.connect(address)
+	if err != nil {
+		return nil, err
+	}
+	// no stream, since chunk data always goes in messages
+	proxy := &proxyTwirpAsChunkserver{
+		server: grpcChunkserverClient{twirp.NewChunkserverClient(conn)},
+		ctx:    context.Background(),
+	}
+	c.chunkservers[address] = proxy
+	return proxy, nil
+}
+
+func (c *grpcCache) SubscribeFrontend(address apis.ServerAddress) (apis.Frontend, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if existing, found := c.frontends[address]; found && !c.closed {
+		return existing, nil
+	}
+	conn, err := c.connect(address)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &proxyTwirpAsFrontend{server: grpcFrontendClient{twirp.NewFrontendClient(conn)}, ctx: context.Background()}
+	c.frontends[address] = proxy
+	return proxy, nil
+}
+
+func (c *grpcCache) SubscribeMetadataCache(address apis.ServerAddress) (apis.MetadataCache, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if existing, found := c.metadatacaches[address]; found && !c.closed {
+		return existing, nil
+	}
+	conn, err := c.connect(address)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &proxyTwirpAsMetadataCache{server: grpcMetadataCacheClient{twirp.NewMetadataCacheClient(conn)}, ctx: context.Background()}
+	c.metadatacaches[address] = proxy
+	return proxy, nil
+}
+
+func (c *grpcCache) SubscribeSyncServer(address apis.ServerAddress) (apis.SyncServer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if existing, found := c.syncservers[address]; found && !c.closed {
+		return existing, nil
+	}
+	conn, err := c.connect(address)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &proxyTwirpAsSyncServer{server: grpcSyncServerClient{twirp.NewSyncServerClient(conn)}, ctx: context.Background()}
+	c.syncservers[address] = proxy
+	return proxy, nil
+}
+
+// Waits for the connection to each server to be ready, for up to PreconnectTimeout.
+func (c *grpcCache) Preconnect(addresses []apis.ServerAddress) error {
+	c.mu.Lock()
+	conns := make([]*grpc.ClientConn, len(addresses))
+	for i, address := range addresses {
+		conn, err := c.connect(address)
+		if err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		conns[i] = conn
+	}
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), PreconnectTimeout)
+	defer cancel()
+	failures := make(chan error, len(conns))
+	for i, conn := range conns {
+		go func(address apis.ServerAddress, conn *grpc.ClientConn) {
+			for state := conn.GetState(); state != connectivity.Ready; state = conn.GetState() {
+				if !conn.WaitForStateChange(ctx, state) {
+					failures <- fmt.Errorf("cannot preconnect to %s: %v: %w", address, ctx.Err(), apis.ErrUnreachable)
+					return
+				}
+			}
+			failures <- nil
+		}(addresses[i], conn)
+	}
+	var first error
+	failed := 0
+	for range conns {
+		if err := <-failures; err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not reach %d of %d servers; first failure: %w", failed, len(addresses), first)
+	}
+	return nil
+}
+
+func (c *grpcCache) CloseAll() {
+	c.mu.Lock()
+	c.closed = true
+	conns := c.conns
+	c.conns = map[apis.ServerAddress]*grpc.ClientConn{}
+	c.mu.Unlock()
+
+	c.inFlight.Wait()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+// The generated gRPC clients take call options that the twirp interfaces don't, so these adapt them.
+
+type grpcChunkserverClient struct {
+	client twirp.ChunkserverClient
+}
+
+func (g grpcChunkserverClient) StartWriteReplicated(ctx context.Context, in *twirp.Chunkserver_StartWriteReplicated) (*twirp.Nothing, error) {
+	return g.client.StartWriteReplicated(ctx, in)
+}
+
+func (g grpcChunkserverClient) Replicate(ctx context.Context, in *twirp.Chunkserver_Replicate) (*twirp.Nothing, error) {
+	return g.client.Replicate(ctx, in)
+}
+
+func (g grpcChunkserverClient) Read(ctx context.Context, in *twirp.Chunkserver_Read) (*twirp.Chunkserver_Read_Result, error) {
+	return g.client.Read(ctx, in)
+}
+
+func (g grpcChunkserverClient) ReadVersion(ctx context.Context, in *twirp.Chunkserver_ReadVersion) (*twirp.Chunkserver_ReadVersion_Result, error) {
+	return g.client.ReadVersion(ctx, in)
+}
+
+func (g grpcChunkserverClient) ReadWithChecksum(ctx context.Context, in *twirp.Chunkserver_Read) (*twirp.Chunkserver_ReadWithChecksum_Result, error) {
+	return g.client.ReadWithChecksum(ctx, in)
+}
+
+func (g grpcChunkserverClient) StartWrite(ctx context.Context, in *twirp.Chunkserver_StartWrite) (*twirp.Nothing, error) {
+	return g.client.StartWrite(ctx, in)
+}
+
+func (g grpcChunkserverClient) CommitWrite(ctx context.Context, in *twirp.Chunkserver_CommitWrite) (*twirp.Nothing, error) {
+	return g.client.CommitWrite(ctx, in)
+}
+
+func (g grpcChunkserverClient) StartAppend(ctx context.Context, in *twirp.Chunkserver_StartAppend) (*twirp.Nothing, error) {
+	return g.client.StartAppend(ctx, in)
+}
+
+func (g grpcChunkserverClient) CommitAppend(ctx context.Context, in *twirp.Chunkserver_CommitWrite) (*twirp.Chunkserver_CommitAppend_Result, error) {
+	return g.client.CommitAppend(ctx, in)
+}
+
+func (g grpcChunkserverClient) UpdateLatestVersion(ctx context.Context, in *twirp.Chunkserver_UpdateLatestVersion) (*twirp.Nothing, error) {
+	return g.client.UpdateLatestVersion(ctx, in)
+}
+
+func (g grpcChunkserverClient) Add(ctx context.Context, in *twirp.Chunkserver_Add) (*twirp.Nothing, error) {
+	return g.client.Add(ctx, in)
+}
+
+func (g grpcChunkserverClient) Delete(ctx context.Context, in *twirp.Chunkserver_Delete) (*twirp.Nothing, error) {
+	return g.client.Delete(ctx, in)
+}
+
+func (g grpcChunkserverClient) Undelete(ctx context.Context, in *twirp.Chunkserver_Undelete) (*twirp.Nothing, error) {
+	return g.client.Undelete(ctx, in)
+}
+
+func (g grpcChunkserverClient) Pin(ctx context.Context, in *twirp.Chunkserver_Pin) (*twirp.Nothing, error) {
+	return g.client.Pin(ctx, in)
+}
+
+func (g grpcChunkserverClient) Unpin(ctx context.Context, in *twirp.Chunkserver_Pin) (*twirp.Nothing, error) {
+	return g.client.Unpin(ctx, in)
+}
+
+func (g grpcChunkserverClient) ListAllChunks(ctx context.Context, in *twirp.Nothing) (*twirp.Chunkserver_ListAllChunks_Result, error) {
+	return g.client.ListAllChunks(ctx, in)
+}
+
+func (g grpcChunkserverClient) DigestChunks(ctx context.Context, in *twirp.Chunkserver_DigestChunks) (*twirp.Chunkserver_DigestChunks_Result, error) {
+	return g.client.DigestChunks(ctx, in)
+}
+
+type grpcFrontendClient struct {
+	client twirp.FrontendClient
+}
+
+func (g grpcFrontendClient) ReadMetadataEntry(ctx context.Context, in *twirp.Frontend_ReadMetadataEntry) (*twirp.Frontend_ReadMetadataEntry_Result, error) {
+	return g.client.ReadMetadataEntry(ctx, in)
+}
+
+func (g grpcFrontendClient) ReadFullMetadataEntry(ctx context.Context, in *twirp.Frontend_ReadFullMetadataEntry) (*twirp.Frontend_ReadFullMetadataEntry_Result, error) {
+	return g.client.ReadFullMetadataEntry(ctx, in)
+}
+
+func (g grpcFrontendClient) CommitWrite(ctx context.Context, in *twirp.Frontend_CommitWrite) (*twirp.Frontend_CommitWrite_Result, error) {
+	return g.client.CommitWrite(ctx, in)
+}
+
+func (g grpcFrontendClient) CommitAppend(ctx context.Context, in *twirp.Frontend_CommitAppend) (*twirp.Frontend_CommitAppend_Result, error) {
+	return g.client.CommitAppend(ctx, in)
+}
+
+func (g grpcFrontendClient) New(ctx context.Context, in *twirp.Frontend_New) (*twirp.Frontend_New_Result, error) {
+	return g.client.New(ctx, in)
+}
+
+func (g grpcFrontendClient) NewWithOptions(ctx context.Context, in *twirp.Frontend_NewWithOptions) (*twirp.Frontend_New_Result, error) {
+	return g.client.NewWithOptions(ctx, in)
+}
+
+func (g grpcFrontendClient) AllocateChunks(ctx context.Context, in *twirp.Frontend_AllocateChunks) (*twirp.Frontend_AllocateChunks_Result, error) {
+	return g.client.AllocateChunks(ctx, in)
+}
+
+func (g grpcFrontendClient) Delete(ctx context.Context, in *twirp.Frontend_Delete) (*twirp.Frontend_Delete_Result, error) {
+	return g.client.Delete(ctx, in)
+}
+
+func (g grpcFrontendClient) DeleteIncomplete(ctx context.Context, in *twirp.Frontend_DeleteIncomplete) (*twirp.Frontend_Delete_Result, error) {
+	return g.client.DeleteIncomplete(ctx, in)
+}
+
+func (g grpcFrontendClient) AcquireWriteLease(ctx context.Context, in *twirp.Frontend_AcquireWriteLease) (*twirp.Frontend_AcquireWriteLease_Result, error) {
+	return g.client.AcquireWriteLease(ctx, in)
+}
+
+func (g grpcFrontendClient) RenewWriteLease(ctx context.Context, in *twirp.Frontend_WriteLease) (*twirp.Frontend_WriteLease_Result, error) {
+	return g.client.RenewWriteLease(ctx, in)
+}
+
+func (g grpcFrontendClient) ReleaseWriteLease(ctx context.Context, in *twirp.Frontend_WriteLease) (*twirp.Frontend_WriteLease_Result, error) {
+	return g.client.ReleaseWriteLease(ctx, in)
+}
+
+func (g grpcFrontendClient) CommitLeasedWrite(ctx context.Context, in *twirp.Frontend_CommitLeasedWrite) (*twirp.Frontend_CommitLeasedWrite_Result, error) {
+	return g.client.CommitLeasedWrite(ctx, in)
+}
+
+type grpcMetadataCacheClient struct {
+	client twirp.MetadataCacheClient
+}
+
+func (g grpcMetadataCacheClient) NewEntry(ctx context.Context, in *twirp.MetadataCache_NewEntry) (*twirp.MetadataCache_NewEntry_Result, error) {
+	return g.client.NewEntry(ctx, in)
+}
+
+func (g grpcMetadataCacheClient) ReadEntry(ctx context.Context, in *twirp.MetadataCache_ReadEntry) (*twirp.MetadataCache_ReadEntry_Result, error) {
+	return g.client.ReadEntry(ctx, in)
+}
+
+func (g grpcMetadataCacheClient) UpdateEntry(ctx context.Context, in *twirp.MetadataCache_UpdateEntry) (*twirp.MetadataCache_UpdateEntry_Result, error) {
+	return g.client.UpdateEntry(ctx, in)
+}
+
+func (g grpcMetadataCacheClient) DeleteEntry(ctx context.Context, in *twirp.MetadataCache_DeleteEntry) (*twirp.MetadataCache_DeleteEntry_Result, error) {
+	return g.client.DeleteEntry(ctx, in)
+}
+
+func (g grpcMetadataCacheClient) AcceptHandoff(ctx context.Context, in *twirp.MetadataCache_AcceptHandoff) (*twirp.MetadataCache_AcceptHandoff_Result, error) {
+	return g.client.AcceptHandoff(ctx, in)
+}
+
+func (g grpcMetadataCacheClient) Stats(ctx context.Context, in *twirp.MetadataCache_Stats) (*twirp.MetadataCache_Stats_Result, error) {
+	return g.client.Stats(ctx, in)
+}
+
+func (g grpcMetadataCacheClient) BatchReadEntry(ctx context.Context, in *twirp.MetadataCache_BatchReadEntry) (*twirp.MetadataCache_Batch_Result, error) {
+	return g.client.BatchReadEntry(ctx, in)
+}
+
+func (g grpcMetadataCacheClient) BatchUpdateEntry(ctx context.Context, in *twirp.MetadataCache_BatchUpdateEntry) (*twirp.MetadataCache_Batch_Result, error) {
+	return g.client.BatchUpdateEntry(ctx, in)
+}
+
+type grpcSyncServerClient struct {
+	client twirp.SyncServerClient
+}
+
+func (g grpcSyncServerClient) StartSync(ctx context.Context, in *twirp.SyncServer_Uint64) (*twirp.SyncServer_Uint64, error) {
+	return g.client.StartSync(ctx, in)
+}
+
+func (g grpcSyncServerClient) UpgradeSync(ctx context.Context, in *twirp.SyncServer_Uint64) (*twirp.SyncServer_Uint64, error) {
+	return g.client.UpgradeSync(ctx, in)
+}
+
+func (g grpcSyncServerClient) ReleaseSync(ctx context.Context, in *twirp.SyncServer_Uint64) (*twirp.SyncServer_Nothing, error) {
+	return g.client.ReleaseSync(ctx, in)
+}
+
+func (g grpcSyncServerClient) ConfirmSync(ctx context.Context, in *twirp.SyncServer_Uint64) (*twirp.SyncServer_Bool, error) {
+	return g.client.ConfirmSync(ctx, in)
+}
+
+func (g grpcSyncServerClient) AwaitRelease(ctx context.Context, in *twirp.SyncServer_AwaitRelease) (*twirp.SyncServer_Uint64, error) {
+	return g.client.AwaitRelease(ctx, in)
+}
+
+func (g grpcSyncServerClient) AcquireLock(ctx context.Context, in *twirp.SyncServer_AcquireLock) (*twirp.SyncServer_Uint64, error) {
+	return g.client.AcquireLock(ctx, in)
+}
+
+func (g grpcSyncServerClient) RenewLock(ctx context.Context, in *twirp.SyncServer_Uint64) (*twirp.SyncServer_Nothing, error) {
+	return g.client.RenewLock(ctx, in)
+}
+
+func (g grpcSyncServerClient) ReleaseLock(ctx context.Context, in *twirp.SyncServer_Uint64) (*twirp.SyncServer_Nothing, error) {
+	return g.client.ReleaseLock(ctx, in)
+}
+
+func (g grpcSyncServerClient) GetFSRoot(ctx context.Context, in *twirp.SyncServer_Nothing) (*twirp.SyncServer_Uint64, error) {
+	return g.client.GetFSRoot(ctx, in)
+}
@@ -0,0 +1,74 @@
+package rpc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"zircon/apis"
+	"zircon/apis/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tests that calls made over gRPC return what the server returned, including typed errors, and that a server that has
+// gone away is reported as unreachable.
+func TestGRPCTransport(t *testing.T) {
+	mocked := new(mocks.Frontend)
+	mocked.On("New").Return(apis.ChunkNum(73), nil)
+	mocked.On("Delete", apis.ChunkNum(73), apis.Version(2)).Return(fmt.Errorf("no such chunk: %w", apis.ErrNotFound))
+	teardown, address, err := PublishFrontendWithTransport(mocked, "127.0.0.1:0", nil, GRPCTransport)
+	require.NoError(t, err)
+
+	cache := NewConnectionCacheWithOptions(ConnectionOptions{Transport: GRPCTransport})
+	defer cache.CloseAll()
+	require.NoError(t, cache.Preconnect([]apis.ServerAddress{address}))
+	frontend, err := cache.SubscribeFrontend(address)
+	require.NoError(t, err)
+
+	chunk, err := frontend.New()
+	assert.NoError(t, err)
+	assert.Equal(t, apis.ChunkNum(73), chunk)
+
+	err = frontend.Delete(73, 2)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+	assert.Contains(t, err.Error(), "no such chunk")
+
+	assert.NoError(t, teardown(true))
+	_, err = frontend.New()
+	assert.True(t, errors.Is(err, apis.ErrUnreachable))
+
+	mocked.AssertExpectations(t)
+}
+
+// Tests that chunk data too large for a single twirp message still reaches a client over gRPC, which has no separate
+// streaming path.
+func TestGRPCTransport_LargeRead(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), apis.MaxChunkSize/16)
+	mocked := new(mocks.Chunkserver)
+	mocked.On("Read", apis.ChunkNum(5), uint32(0), uint32(apis.MaxChunkSize), apis.Version(1)).Return(data, apis.Version(3), nil)
+	teardown, address, err := PublishChunkserverWithTransport(mocked, "127.0.0.1:0", nil, GRPCTransport)
+	require.NoError(t, err)
+	defer teardown(true)
+
+	cache := NewConnectionCacheWithOptions(ConnectionOptions{Transport: GRPCTransport})
+	defer cache.CloseAll()
+	server, err := cache.SubscribeChunkserver(address)
+	require.NoError(t, err)
+
+	read, version, err := server.Read(5, 0, apis.MaxChunkSize, 1)
+	require.NoError(t, err)
+	assert.Equal(t, apis.Version(3), version)
+	assert.Equal(t, data, read)
+
+	mocked.AssertExpectations(t)
+}
+
+// Tests that the transport named in a configuration is checked.
+func TestTransportValidate(t *testing.T) {
+	assert.NoError(t, Transport("").Validate())
+	assert.NoError(t, TwirpTransport.Validate())
+	assert.NoError(t, GRPCTransport.Validate())
+	assert.Error(t, Transport("carrier-pigeon").Validate())
+}
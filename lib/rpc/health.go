@@ -0,0 +1,49 @@
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"zircon/apis"
+)
+
+// The paths that every published server answers liveness and readiness probes on, alongside its twirp handler.
+// Liveness only says that the server is running; readiness also checks the things it depends on, if the server is an
+// apis.HealthChecker, and responds with 503 Service Unavailable if any of them isn't usable. Both respond with an
+// apis.HealthReport as JSON.
+const LivenessPath = "/healthz"
+const ReadinessPath = "/readyz"
+
+// Serves the liveness and readiness endpoints for 'server', and passes every other request on to 'handler'.
+func withHealth(handler http.Handler, role string, server interface{}) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.HandleFunc(LivenessPath, func(writer http.ResponseWriter, request *http.Request) {
+		writeHealth(writer, apis.HealthReport{Status: apis.HealthOK, Role: role})
+	})
+	mux.HandleFunc(ReadinessPath, func(writer http.ResponseWriter, request *http.Request) {
+		report := apis.HealthReport{Status: apis.HealthOK, Role: role}
+		if checker, ok := server.(apis.HealthChecker); ok {
+			report.Dependencies = checker.CheckHealth()
+		}
+		for _, dependency := range report.Dependencies {
+			if !dependency.Healthy {
+				report.Status = apis.HealthUnavailable
+			}
+		}
+		writeHealth(writer, report)
+	})
+	return mux
+}
+
+func writeHealth(writer http.ResponseWriter, report apis.HealthReport) {
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if report.Status != apis.HealthOK {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = writer.Write(encoded)
+}
@@ -0,0 +1,79 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"zircon/apis"
+	"zircon/apis/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A chunkserver whose storage can be made to fail its health check.
+type checkedChunkserver struct {
+	*mocks.Chunkserver
+	mu         sync.Mutex
+	storageErr error
+}
+
+func (c *checkedChunkserver) CheckHealth() []apis.DependencyStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return []apis.DependencyStatus{apis.CheckDependency("storage", c.storageErr)}
+}
+
+func getHealth(t *testing.T, address apis.ServerAddress, path string) (int, apis.HealthReport) {
+	response, err := http.Get("http://" + string(address) + path)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	var report apis.HealthReport
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&report))
+	return response.StatusCode, report
+}
+
+// Tests that a published chunkserver reports itself as live regardless of its dependencies, and as ready only while
+// they are all healthy.
+func TestHealthEndpoints(t *testing.T) {
+	server := &checkedChunkserver{Chunkserver: new(mocks.Chunkserver)}
+	teardown, address, err := PublishChunkserver(server, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer teardown(true)
+
+	code, report := getHealth(t, address, LivenessPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, apis.HealthReport{Status: apis.HealthOK, Role: "chunkserver"}, report)
+
+	code, report = getHealth(t, address, ReadinessPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, apis.HealthOK, report.Status)
+	assert.Equal(t, []apis.DependencyStatus{{Name: "storage", Healthy: true}}, report.Dependencies)
+
+	server.mu.Lock()
+	server.storageErr = errors.New("disk unplugged")
+	server.mu.Unlock()
+
+	code, report = getHealth(t, address, ReadinessPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, apis.HealthUnavailable, report.Status)
+	assert.Equal(t, []apis.DependencyStatus{{Name: "storage", Error: "disk unplugged"}}, report.Dependencies)
+
+	code, report = getHealth(t, address, LivenessPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, apis.HealthOK, report.Status)
+}
+
+// Tests that a server that can't check its dependencies is ready as soon as it is running.
+func TestReadinessWithoutChecks(t *testing.T) {
+	teardown, address, err := PublishFrontend(new(mocks.Frontend), "127.0.0.1:0")
+	require.NoError(t, err)
+	defer teardown(true)
+
+	code, report := getHealth(t, address, ReadinessPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, apis.HealthReport{Status: apis.HealthOK, Role: "frontend"}, report)
+}
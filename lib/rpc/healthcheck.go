@@ -0,0 +1,148 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+	"zircon/apis"
+)
+
+// How a connection cache checks on the servers it has subscribed to between calls.
+type HealthCheck struct {
+	// How often each server is pinged. Zero takes the default, and negative means servers are never pinged.
+	Interval time.Duration `yaml:"interval"`
+	// How long a ping waits for the server to answer before the server is taken to be dead.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// How a connection cache keeps its connections open. Zero fields take their defaults.
+type PoolOptions struct {
+	// How often TCP keepalive probes are sent on idle connections, so that the operating system notices peers that have
+	// gone away without closing them. Negative turns them off.
+	KeepAlive time.Duration `yaml:"keep-alive"`
+	// The most idle connections kept open, in all and to any one server.
+	MaxIdleConns        int `yaml:"max-idle-conns"`
+	MaxIdleConnsPerHost int `yaml:"max-idle-conns-per-host"`
+	// How long an idle connection is kept open before it is closed.
+	IdleConnTimeout time.Duration `yaml:"idle-conn-timeout"`
+}
+
+// Explanation of health checking:
+//     Without it, a server that dies is only found out about by the next call to it, which may have to wait for its
+//     Timeouts to run out, and connections to it stay in the pool until they are next used. Instead, every
+//     HealthCheck.Interval, the cache pings the LivenessPath of each server that it has a subscription to. When a
+//     server doesn't answer, every connection to it is closed, and its circuit (see BreakerPolicy) is opened, so that
+//     calls fail fast until it is either pinged successfully, which closes the circuit again, or the circuit's cooldown
+//     lets a call through to try it. Pings don't count against the in-flight limit and aren't refused by an open
+//     circuit, so that they can tell when a server comes back.
+
+// The health check of connection caches created without one given.
+var DefaultHealthCheck = HealthCheck{
+	Interval: 10 * time.Second,
+	Timeout:  2 * time.Second,
+}
+
+// The pool options of connection caches created without any given.
+var DefaultPoolOptions = PoolOptions{
+	KeepAlive:           30 * time.Second,
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// Fills in the fields left as zero from DefaultHealthCheck.
+func (h HealthCheck) withDefaults() HealthCheck {
+	if h.Interval == 0 {
+		h.Interval = DefaultHealthCheck.Interval
+	}
+	if h.Timeout == 0 {
+		h.Timeout = DefaultHealthCheck.Timeout
+	}
+	return h
+}
+
+// Fills in the fields left as zero from DefaultPoolOptions.
+func (p PoolOptions) withDefaults() PoolOptions {
+	if p.KeepAlive == 0 {
+		p.KeepAlive = DefaultPoolOptions.KeepAlive
+	}
+	if p.MaxIdleConns == 0 {
+		p.MaxIdleConns = DefaultPoolOptions.MaxIdleConns
+	}
+	if p.MaxIdleConnsPerHost == 0 {
+		p.MaxIdleConnsPerHost = DefaultPoolOptions.MaxIdleConnsPerHost
+	}
+	if p.IdleConnTimeout == 0 {
+		p.IdleConnTimeout = DefaultPoolOptions.IdleConnTimeout
+	}
+	return p
+}
+
+// Pings the subscribed servers every interval, until stop is closed. Closes done once it has stopped.
+func (c *conncache) checkHealth(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(c.health.Interval):
+		}
+		var wg sync.WaitGroup
+		for _, address := range c.subscribed() {
+			wg.Add(1)
+			go func(address apis.ServerAddress) {
+				defer wg.Done()
+				c.ping(address)
+			}(address)
+		}
+		wg.Wait()
+	}
+}
+
+// Lists every address with a subscription of any kind.
+func (c *conncache) subscribed() []apis.ServerAddress {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	found := map[apis.ServerAddress]bool{}
+	for address := range c.chunkservers {
+		found[address] = true
+	}
+	for address := range c.frontends {
+		found[address] = true
+	}
+	for address := range c.metadatacaches {
+		found[address] = true
+	}
+	for address := range c.syncservers {
+		found[address] = true
+	}
+	var addresses []apis.ServerAddress
+	for address := range found {
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+// Pings one server, and evicts its connections and opens its circuit if it doesn't answer. Any answer at all counts,
+// since it shows that the server is there.
+func (c *conncache) ping(address apis.ServerAddress) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.health.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL(address, c.client)+LivenessPath, nil)
+	if err != nil {
+		return
+	}
+	// straight to the pool, past the in-flight limit and circuit breaking
+	response, err := c.transport.transport.RoundTrip(request)
+	if err != nil {
+		c.transport.evict(string(address))
+		c.breakers.trip(string(address))
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	_ = response.Body.Close()
+	c.breakers.record(string(address), nil, false)
+}
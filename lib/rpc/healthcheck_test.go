@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"zircon/apis"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tests that a server that stops answering has its connections evicted and its circuit opened by the health checks,
+// and that its circuit closes again once it answers.
+func TestHealthCheckEvicts(t *testing.T) {
+	var hung int32
+	release := make(chan struct{})
+	defer close(release)
+	health := withHealth(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.NotFound(writer, request)
+	}), "frontend", nil)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if atomic.LoadInt32(&hung) != 0 {
+			select {
+			case <-release:
+			case <-request.Context().Done():
+			}
+			return
+		}
+		health.ServeHTTP(writer, request)
+	}))
+	defer server.Close()
+	address := apis.ServerAddress(strings.TrimPrefix(server.URL, "http://"))
+
+	cache := NewConnectionCacheWithOptions(ConnectionOptions{
+		Health:  HealthCheck{Interval: 20 * time.Millisecond, Timeout: 100 * time.Millisecond},
+		Breaker: BreakerPolicy{Failures: 5, Cooldown: time.Minute},
+	}).(*conncache)
+	defer cache.CloseAll()
+	// stands in for a subscription, which is all that health checks look at
+	cache.mu.Lock()
+	cache.frontends[address] = nil
+	cache.mu.Unlock()
+	openConns := func() int {
+		cache.transport.mu.Lock()
+		defer cache.transport.mu.Unlock()
+		return len(cache.transport.open[string(address)])
+	}
+
+	response, err := cache.client.Get(server.URL + LivenessPath)
+	require.NoError(t, err)
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	require.NoError(t, response.Body.Close())
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, openConns() > 0)
+	assert.NoError(t, cache.breakers.allow(string(address)))
+
+	atomic.StoreInt32(&hung, 1)
+	time.Sleep(300 * time.Millisecond)
+	err = cache.breakers.allow(string(address))
+	assert.True(t, errors.Is(err, apis.ErrUnreachable))
+
+	atomic.StoreInt32(&hung, 0)
+	time.Sleep(300 * time.Millisecond)
+	assert.NoError(t, cache.breakers.allow(string(address)))
+}
+
+// Tests that the connections to one address can be evicted without affecting those to others.
+func TestEvict(t *testing.T) {
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
+	server1 := httptest.NewServer(handler)
+	defer server1.Close()
+	server2 := httptest.NewServer(handler)
+	defer server2.Close()
+
+	cache := NewConnectionCacheWithOptions(ConnectionOptions{Health: HealthCheck{Interval: -1}}).(*conncache)
+	defer cache.CloseAll()
+	for _, url := range []string{server1.URL, server2.URL} {
+		response, err := cache.client.Get(url)
+		require.NoError(t, err)
+		require.NoError(t, response.Body.Close())
+	}
+	host1 := strings.TrimPrefix(server1.URL, "http://")
+	host2 := strings.TrimPrefix(server2.URL, "http://")
+
+	cache.transport.evict(host1)
+	cache.transport.mu.Lock()
+	assert.Len(t, cache.transport.open[host1], 0)
+	assert.Len(t, cache.transport.open[host2], 1)
+	cache.transport.mu.Unlock()
+}
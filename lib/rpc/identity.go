@@ -0,0 +1,110 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+	"zircon/apis"
+)
+
+type callerKey struct{}
+
+// Returns a context recording that the call it belongs to was made by 'principal'. Published servers do this for every
+// call they handle, with the principal of the certificate that the client presented, so this is only needed by servers
+// that identify their callers some other way, and by tests.
+func ContextWithCaller(ctx context.Context, principal apis.Principal) context.Context {
+	return context.WithValue(ctx, callerKey{}, principal)
+}
+
+// Returns who made the call that ctx belongs to, and whether it was handled as an RPC at all; calls made within the
+// same process have no caller. Callers that didn't present a certificate that the server verified are apis.Anonymous.
+// See apis.ACL.
+func CallerPrincipal(ctx context.Context) (apis.Principal, bool) {
+	principal, ok := ctx.Value(callerKey{}).(apis.Principal)
+	return principal, ok
+}
+
+type callerAddressKey struct{}
+
+// Returns a context recording that the call it belongs to came from 'address'. Published servers do this for every
+// call they handle, alongside ContextWithCaller.
+func ContextWithCallerAddress(ctx context.Context, address string) context.Context {
+	return context.WithValue(ctx, callerAddressKey{}, address)
+}
+
+// Returns the address that the call that ctx belongs to came from, or "" if it wasn't handled as an RPC.
+func CallerAddress(ctx context.Context) string {
+	address, _ := ctx.Value(callerAddressKey{}).(string)
+	return address
+}
+
+// Returns the principal of the client on the other end of a TLS connection, going by the common name of its
+// certificate, or apis.Anonymous unless the certificate was verified, which servers only do with VerifyClients set.
+func peerPrincipal(state *tls.ConnectionState) apis.Principal {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return apis.Anonymous
+	}
+	name := state.VerifiedChains[0][0].Subject.CommonName
+	if name == "" {
+		return apis.Anonymous
+	}
+	return apis.PrincipalNamed(name)
+}
+
+// Records the caller of every request that 'handler' serves in the request's context, and its address, along with the
+// capability that it presents, if any.
+func withCaller(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := ContextWithCaller(request.Context(), peerPrincipal(request.TLS))
+		ctx = ContextWithCallerAddress(ctx, request.RemoteAddr)
+		ctx = contextWithPresented(ctx, Capability(request.Header.Get(capabilityHeader)))
+		handler.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// Decides which calls a chunkserver or metadata cache takes, going by who made them. The zero value takes every call.
+type guard struct {
+	// see ServerOptions.Cluster and ServerOptions.CapabilityKey
+	cluster []apis.Principal
+	key     []byte
+}
+
+func (o ServerOptions) guard() guard {
+	return guard{cluster: o.Cluster, key: o.CapabilityKey}
+}
+
+// Fails with an error matching apis.ErrPermissionDenied unless the call that ctx belongs to was made by one of the
+// cluster's servers, or from within this process.
+func (g guard) checkCluster(ctx context.Context) error {
+	principal, ok := CallerPrincipal(ctx)
+	if len(g.cluster) == 0 || !ok {
+		return nil
+	}
+	for _, member := range g.cluster {
+		if principal == member {
+			return nil
+		}
+	}
+	return fmt.Errorf("[identity.go/CLU] caller %016x is not one of the cluster's servers: %w", uint64(principal),
+		apis.ErrPermissionDenied)
+}
+
+// Like checkCluster, but also lets through calls that present a capability for 'chunk' that was issued to their caller.
+// See Capability.
+func (g guard) checkDirect(ctx context.Context, chunk apis.ChunkNum) error {
+	err := g.checkCluster(ctx)
+	if err == nil {
+		return nil
+	}
+	presented := presentedCapability(ctx)
+	if presented == "" {
+		return err
+	}
+	principal, _ := CallerPrincipal(ctx)
+	if err := presented.check(g.key, chunk, principal, time.Now()); err != nil {
+		return fmt.Errorf("[identity.go/CAP] %v: %w", err, apis.ErrPermissionDenied)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"zircon/apis"
+)
+
+// A single RPC, as seen by an Interceptor.
+type Call struct {
+	// The service and method called, such as "Chunkserver" and "Read". Streamed transfers are reported as the methods
+	// that they stand in for, which are Read and StartWrite.
+	Service string
+	Method  string
+	// The other end of the call: the address of the server on clients, and that of the client on servers.
+	Peer string
+	// Whether the call is being handled rather than made.
+	Server bool
+	// Passed along with the call from clients to servers. A client's interceptors can add to it before the call is
+	// made, and a server's interceptors see what arrived, such as a token for authentication or the ID of a trace. Keys
+	// are not case-sensitive, and servers see them in lower case.
+	Metadata map[string]string
+}
+
+// Observes, and can refuse, the calls that a connection cache makes or a published server handles.
+type Interceptor interface {
+	// Called before the call is made or handled. The context returned is used for the rest of the call, and is passed
+	// to After. If an error is returned, the call fails with it instead of going ahead.
+	Before(ctx context.Context, call *Call) (context.Context, error)
+	// Called once the call has finished, with how long it took since it was intercepted and the error it failed with,
+	// if any. Only called if Before was called and didn't fail, and, on servers, if the call didn't panic.
+	After(ctx context.Context, call *Call, elapsed time.Duration, err error)
+}
+
+// Explanation of interceptors:
+//     Interceptors are given in ConnectionOptions for clients and in ServerOptions for servers, and work the same way
+//     over both transports. Each call passes through the interceptors' Before methods in the order given, and then
+//     their After methods in reverse order, so that the first interceptor sees the whole of the call.
+//     On clients, interceptors see each call once, however many times it is retried, and the error they see is the one
+//     that the caller gets, such as one matching apis.ErrUnreachable. On servers, they see the error that the handler
+//     returned. Either way, calls count as failed only if the RPC itself failed: methods such as Chunkserver.Read that
+//     return an error alongside their results, in the same message, succeed as far as interceptors can tell.
+//     Only RPCs are intercepted. The health and metrics endpoints, health checks, and Preconnect are not.
+
+// The header, or gRPC metadata key, prefix that carries each entry of Call.Metadata.
+const metadataPrefix = "Zircon-Meta-"
+
+type interceptorChain []Interceptor
+
+// Passes a call through the chain around 'do', which is skipped if an interceptor refuses the call. Returns the error
+// from the interceptor that refused it, or else the error that 'do' returned.
+func (chain interceptorChain) run(ctx context.Context, call *Call, do func(ctx context.Context) error) error {
+	start := time.Now()
+	ran := 0
+	var err error
+	for ran < len(chain) {
+		var next context.Context
+		next, err = chain[ran].Before(ctx, call)
+		if err != nil {
+			break
+		}
+		ctx = next
+		ran++
+	}
+	if err == nil {
+		err = do(ctx)
+	}
+	for i := ran - 1; i >= 0; i-- {
+		chain[i].After(ctx, call, time.Since(start), err)
+	}
+	return err
+}
+
+// Works out which call a request is for from the path it was sent to, or returns false if it isn't an RPC. Both twirp's
+// paths, such as /twirp/zircon.rpc.twirp.Chunkserver/Read, and gRPC's, which are the same without the prefix, are
+// understood.
+func rpcCall(path string) (Call, bool) {
+	switch path {
+	case ReadStreamPath:
+		return Call{Service: "Chunkserver", Method: "Read"}, true
+	case WriteStreamPath:
+		return Call{Service: "Chunkserver", Method: "StartWrite"}, true
+	}
+	path = strings.TrimPrefix(path, "/twirp")
+	slash := strings.LastIndexByte(path, '/')
+	if !strings.HasPrefix(path, "/zircon.rpc.twirp.") || slash <= 0 || slash == len(path)-1 {
+		return Call{}, false
+	}
+	return Call{Service: path[len("/zircon.rpc.twirp."):slash], Method: path[slash+1:]}, true
+}
+
+// Tags an error that a client's interceptor refused a call with, so that the caller gets it back as it was, instead of
+// it being taken for a failure to reach the server.
+func refusedError(err error) error {
+	if code, _, _ := errorFields(err); code != codeNone {
+		return encodeError(err)
+	}
+	return errors.New(errorCodeTag + "0/0/ " + err.Error())
+}
+
+// Reconstructs the error that a response to the request at 'path' reports, given as much of its body as was kept, or
+// returns nil if the response is a success.
+func responseError(path string, code int, header http.Header, body []byte) error {
+	if code < http.StatusBadRequest {
+		return nil
+	}
+	if path == ReadStreamPath || path == WriteStreamPath {
+		version, _ := strconv.ParseUint(header.Get(versionHeader), 10, 64)
+		return streamErrorFromBody(code, header, body, apis.Version(version))
+	}
+	var twirpError struct {
+		Message string `json:"msg"`
+	}
+	if err := json.Unmarshal(body, &twirpError); err != nil || twirpError.Message == "" {
+		return fmt.Errorf("call failed with status %d", code)
+	}
+	return decodeError(errors.New(twirpError.Message))
+}
+
+// Passes every RPC sent through a ConnectionCache's client through its interceptors.
+type interceptingTransport struct {
+	transport    http.RoundTripper
+	interceptors interceptorChain
+}
+
+func (t interceptingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	call, ok := rpcCall(request.URL.Path)
+	if !ok {
+		return t.transport.RoundTrip(request)
+	}
+	call.Peer = request.URL.Host
+	call.Metadata = map[string]string{}
+	var response *http.Response
+	var err error
+	called := false
+	refused := t.interceptors.run(request.Context(), &call, func(ctx context.Context) error {
+		called = true
+		// the request is the caller's, so the metadata goes on a copy
+		request = request.Clone(ctx)
+		for key, value := range call.Metadata {
+			request.Header.Set(metadataPrefix+key, value)
+		}
+		response, err = t.transport.RoundTrip(request)
+		if err != nil {
+			return streamCallError(ctx, err)
+		}
+		return peekResponseError(request.URL.Path, response)
+	})
+	if !called {
+		return nil, refusedError(refused)
+	}
+	return response, err
+}
+
+// Like responseError, for a response on its way to the client. What is read of the body is put back, so that the
+// caller can read the error for itself.
+func peekResponseError(path string, response *http.Response) error {
+	if response.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	peeked, err := ioutil.ReadAll(io.LimitReader(response.Body, maxStreamErrorSize))
+	response.Body = peekedBody{Reader: io.MultiReader(bytes.NewReader(peeked), response.Body), Closer: response.Body}
+	if err != nil {
+		return fmt.Errorf("call failed with status %d, and could not read why: %v", response.StatusCode, err)
+	}
+	return responseError(path, response.StatusCode, response.Header, peeked)
+}
+
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Passes every RPC that 'handler' serves through 'interceptors', and refuses those that they refuse.
+func withInterceptors(handler http.Handler, interceptors []Interceptor) http.Handler {
+	if len(interceptors) == 0 {
+		return handler
+	}
+	chain := interceptorChain(interceptors)
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		call, ok := rpcCall(request.URL.Path)
+		if !ok {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		call.Peer = request.RemoteAddr
+		call.Server = true
+		call.Metadata = map[string]string{}
+		for name, values := range request.Header {
+			if strings.HasPrefix(name, metadataPrefix) && len(values) > 0 {
+				call.Metadata[strings.ToLower(name[len(metadataPrefix):])] = values[0]
+			}
+		}
+		called := false
+		recorder := &errorRecorder{ResponseWriter: writer, code: http.StatusOK}
+		refused := chain.run(request.Context(), &call, func(ctx context.Context) error {
+			called = true
+			handler.ServeHTTP(recorder, request.WithContext(ctx))
+			return responseError(request.URL.Path, recorder.code, recorder.Header(), recorder.body.Bytes())
+		})
+		if !called {
+			writeCallError(writer, request.URL.Path, refused)
+		}
+	})
+}
+
+// Responds to a call with 'err' in place of its handler, such as when an interceptor refuses it, in the form that the
+// client expects for the call.
+func writeCallError(writer http.ResponseWriter, path string, err error) {
+	if path == ReadStreamPath || path == WriteStreamPath {
+		writeStreamError(writer, err)
+		return
+	}
+	encoded, merr := json.Marshal(map[string]string{"code": "internal", "msg": encodeError(err).Error()})
+	if merr != nil {
+		http.Error(writer, merr.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusInternalServerError)
+	_, _ = writer.Write(encoded)
+}
+
+// Remembers the status code of a response as it is written, how long its body is, and the start of its body if it
+// reports an error.
+type errorRecorder struct {
+	http.ResponseWriter
+	code    int
+	written int64
+	body    bytes.Buffer
+}
+
+func (e *errorRecorder) WriteHeader(code int) {
+	e.code = code
+	e.ResponseWriter.WriteHeader(code)
+}
+
+func (e *errorRecorder) Write(data []byte) (int, error) {
+	if e.code >= http.StatusBadRequest && e.body.Len() < maxStreamErrorSize {
+		keep := data
+		if len(keep) > maxStreamErrorSize-e.body.Len() {
+			keep = keep[:maxStreamErrorSize-e.body.Len()]
+		}
+		e.body.Write(keep)
+	}
+	n, err := e.ResponseWriter.Write(data)
+	e.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,172 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/apis/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Records the calls it sees, and adds or checks a token in their metadata.
+type tokenInterceptor struct {
+	token string
+
+	mu     sync.Mutex
+	calls  []Call
+	errors []error
+}
+
+func (t *tokenInterceptor) Before(ctx context.Context, call *Call) (context.Context, error) {
+	if !call.Server {
+		call.Metadata["Token"] = t.token
+	} else if call.Metadata["token"] != t.token {
+		return nil, errors.New("permission denied: wrong token")
+	}
+	return ctx, nil
+}
+
+func (t *tokenInterceptor) After(ctx context.Context, call *Call, elapsed time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.calls = append(t.calls, *call)
+	t.errors = append(t.errors, err)
+}
+
+// Waits for up to a second for 'count' calls to have finished, since servers may only finish a call after the client
+// has its response, and returns those that have.
+func (t *tokenInterceptor) seen(count int) ([]Call, []error) {
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		t.mu.Lock()
+		if len(t.calls) >= count || time.Since(start) > time.Second {
+			defer t.mu.Unlock()
+			return append([]Call(nil), t.calls...), append([]error(nil), t.errors...)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Tests that interceptors see each call on both ends, with its method, peer, metadata and error, over both transports.
+func TestInterceptors(t *testing.T) {
+	for _, transport := range []Transport{TwirpTransport, GRPCTransport} {
+		t.Run(string(transport), func(t *testing.T) {
+			mocked := new(mocks.Frontend)
+			mocked.On("New").Return(apis.ChunkNum(73), nil)
+			mocked.On("Delete", apis.ChunkNum(73), apis.Version(2)).Return(fmt.Errorf("no such chunk: %w", apis.ErrNotFound))
+			server := &tokenInterceptor{token: "secret"}
+			teardown, address, err := PublishFrontendWithOptions(mocked, "127.0.0.1:0", ServerOptions{
+				Transport:    transport,
+				Interceptors: []Interceptor{server},
+			})
+			require.NoError(t, err)
+			defer teardown(true)
+
+			client := &tokenInterceptor{token: "secret"}
+			cache := NewConnectionCacheWithOptions(ConnectionOptions{Transport: transport, Interceptors: []Interceptor{client}})
+			defer cache.CloseAll()
+			frontend, err := cache.SubscribeFrontend(address)
+			require.NoError(t, err)
+
+			chunk, err := frontend.New()
+			assert.NoError(t, err)
+			assert.Equal(t, apis.ChunkNum(73), chunk)
+			err = frontend.Delete(73, 2)
+			assert.True(t, errors.Is(err, apis.ErrNotFound))
+
+			calls, errs := client.seen(2)
+			require.Len(t, calls, 2)
+			assert.Equal(t, "Frontend", calls[0].Service)
+			assert.Equal(t, "New", calls[0].Method)
+			assert.Equal(t, string(address), calls[0].Peer)
+			assert.False(t, calls[0].Server)
+			assert.NoError(t, errs[0])
+			assert.Equal(t, "Delete", calls[1].Method)
+			assert.True(t, errors.Is(errs[1], apis.ErrNotFound))
+
+			calls, errs = server.seen(2)
+			require.Len(t, calls, 2)
+			assert.Equal(t, "New", calls[0].Method)
+			assert.True(t, calls[0].Server)
+			assert.NotEmpty(t, calls[0].Peer)
+			assert.Equal(t, "secret", calls[0].Metadata["token"])
+			assert.True(t, errors.Is(errs[1], apis.ErrNotFound))
+
+			mocked.AssertExpectations(t)
+		})
+	}
+}
+
+// Tests that a call refused by an interceptor, on either end, fails with the interceptor's error without reaching the
+// server, and without being taken for a failure to reach it.
+func TestInterceptorsRefuse(t *testing.T) {
+	for _, transport := range []Transport{TwirpTransport, GRPCTransport} {
+		t.Run(string(transport), func(t *testing.T) {
+			mocked := new(mocks.Frontend)
+			teardown, address, err := PublishFrontendWithOptions(mocked, "127.0.0.1:0", ServerOptions{
+				Transport:    transport,
+				Interceptors: []Interceptor{&tokenInterceptor{token: "secret"}},
+			})
+			require.NoError(t, err)
+			defer teardown(true)
+
+			cache := NewConnectionCacheWithOptions(ConnectionOptions{
+				Transport:    transport,
+				Interceptors: []Interceptor{&tokenInterceptor{token: "guess"}},
+			})
+			defer cache.CloseAll()
+			frontend, err := cache.SubscribeFrontend(address)
+			require.NoError(t, err)
+			_, err = frontend.New()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "permission denied")
+			assert.False(t, errors.Is(err, apis.ErrUnreachable))
+
+			refusing := &refusingInterceptor{err: fmt.Errorf("too many calls: %w", apis.ErrBusy)}
+			cache = NewConnectionCacheWithOptions(ConnectionOptions{Transport: transport, Interceptors: []Interceptor{refusing}})
+			defer cache.CloseAll()
+			frontend, err = cache.SubscribeFrontend(address)
+			require.NoError(t, err)
+			_, err = frontend.New()
+			assert.True(t, errors.Is(err, apis.ErrBusy))
+			assert.Contains(t, err.Error(), "too many calls")
+
+			mocked.AssertExpectations(t)
+		})
+	}
+}
+
+type refusingInterceptor struct {
+	err error
+}
+
+func (r *refusingInterceptor) Before(ctx context.Context, call *Call) (context.Context, error) {
+	return nil, r.err
+}
+
+func (r *refusingInterceptor) After(ctx context.Context, call *Call, elapsed time.Duration, err error) {
+	panic("After should not be called for refused calls")
+}
+
+// Tests that the calls that requests are for are worked out from their paths.
+func TestRPCCall(t *testing.T) {
+	call, ok := rpcCall("/twirp/zircon.rpc.twirp.MetadataCache/ReadEntry")
+	assert.True(t, ok)
+	assert.Equal(t, Call{Service: "MetadataCache", Method: "ReadEntry"}, call)
+	call, ok = rpcCall("/zircon.rpc.twirp.Chunkserver/Read")
+	assert.True(t, ok)
+	assert.Equal(t, Call{Service: "Chunkserver", Method: "Read"}, call)
+	call, ok = rpcCall(WriteStreamPath)
+	assert.True(t, ok)
+	assert.Equal(t, Call{Service: "Chunkserver", Method: "StartWrite"}, call)
+
+	for _, path := range []string{LivenessPath, MetricsPath, "/", "/twirp/zircon.rpc.twirp.Frontend/"} {
+		_, ok = rpcCall(path)
+		assert.False(t, ok, path)
+	}
+}
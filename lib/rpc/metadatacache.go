@@ -2,7 +2,8 @@ package rpc
 
 import (
 	"context"
-	"errors"
+	"crypto/tls"
+	"fmt"
 	"net/http"
 	"zircon/apis"
 	"zircon/rpc/twirp"
@@ -10,26 +11,102 @@ import (
 
 // Connects to an RPC handler for a MetadataCache on a certain address.
 func UncachedSubscribeMetadataCache(address apis.ServerAddress, client *http.Client) (apis.MetadataCache, error) {
-	saddr := "http://" + string(address)
-	tserve := twirp.NewMetadataCacheProtobufClient(saddr, client)
+	saddr := serverURL(address, client)
+	tserve := twirp.NewMetadataCacheProtobufClient(saddr, budgetClient{client})
 
-	return &proxyTwirpAsMetadataCache{server: tserve}, nil
+	return &proxyTwirpAsMetadataCache{server: tserve, ctx: context.Background()}, nil
 }
 
-// Starts serving an RPC handler for a MetadataCache on a certain address. Runs forever.
+// Implemented by MetadataCaches that make RPCs of their own, such as to forward requests to the cache that owns an
+// entry, so that those RPCs can be bound to a caller's context too.
+type ContextualMetadataCache interface {
+	apis.MetadataCache
+	WithContext(ctx context.Context) apis.MetadataCache
+}
+
+// Rebinds a MetadataCache obtained from this package so that its RPCs carry ctx, allowing callers to impose deadlines and
+// cancellation on the underlying transport. A ContextualMetadataCache is rebound through WithContext. Other
+// implementations are returned unchanged.
+func MetadataCacheWithContext(ctx context.Context, server apis.MetadataCache) apis.MetadataCache {
+	if proxy, ok := server.(*proxyTwirpAsMetadataCache); ok {
+		return &proxyTwirpAsMetadataCache{server: proxy.server, ctx: ctx}
+	}
+	if contextual, ok := server.(ContextualMetadataCache); ok {
+		return contextual.WithContext(ctx)
+	}
+	return server
+}
+
+// Starts serving an RPC handler for a MetadataCache on a certain address, along with the endpoints at LivenessPath,
+// ReadinessPath and MetricsPath. Runs forever.
 func PublishMetadataCache(server apis.MetadataCache, address apis.ServerAddress) (func(kill bool) error, apis.ServerAddress, error) {
-	tserve := twirp.NewMetadataCacheServer(&proxyMetadataCacheAsTwirp{server: server}, nil)
-	return LaunchEmbeddedHTTP(tserve, address)
+	return PublishMetadataCacheWithTLS(server, address, nil)
+}
+
+// Like PublishMetadataCache, but serves over TLS with 'config', unless it is nil. See TLSConfiguration.
+func PublishMetadataCacheWithTLS(server apis.MetadataCache, address apis.ServerAddress, config *tls.Config) (func(kill bool) error, apis.ServerAddress, error) {
+	return PublishMetadataCacheWithOptions(server, address, ServerOptions{TLS: config})
+}
+
+// Like PublishMetadataCacheWithTLS, but takes all of the options at once, including those that can't be chosen any
+// other way.
+func PublishMetadataCacheWithOptions(server apis.MetadataCache, address apis.ServerAddress, options ServerOptions) (func(kill bool) error, apis.ServerAddress, error) {
+	if options.Transport == GRPCTransport {
+		return publishGRPCMetadataCache(server, address, options)
+	}
+	tserve := twirp.NewMetadataCacheServer(&proxyMetadataCacheAsTwirp{server: server, guard: options.guard()}, nil)
+	handler := options.wrap(tserve, "metadatacache")
+	return LaunchEmbeddedHTTPWithTLS(withMetrics(withHealth(handler, "metadatacache", server), "metadatacache", server), address, options.TLS)
+}
+
+func entryToTwirp(entry apis.MetadataEntry) *twirp.MetadataEntry {
+	owner, allowed, mode := aclToTwirp(entry.ACL)
+	return &twirp.MetadataEntry{
+		MostRecentVersion:   uint64(entry.MostRecentVersion),
+		LastConsumedVersion: uint64(entry.LastConsumedVersion),
+		ServerIDs:           IDArrayToIntArray(entry.Replicas),
+		LaggingServerIDs:    IDArrayToIntArray(entry.Lagging),
+		AclOwner:            owner,
+		AclAllowed:          allowed,
+		AclMode:             mode,
+		LeaseHolder:         uint64(entry.Lease.Holder),
+		LeaseExpiry:         entry.Lease.Expiry,
+		ReplicationFactor:   uint32(entry.ReplicationFactor),
+	}
+}
+
+func entryFromTwirp(entry *twirp.MetadataEntry) apis.MetadataEntry {
+	result := apis.MetadataEntry{
+		MostRecentVersion:   apis.Version(entry.MostRecentVersion),
+		LastConsumedVersion: apis.Version(entry.LastConsumedVersion),
+		Replicas:            IntArrayToIDArray(entry.ServerIDs),
+		ACL:                 aclFromTwirp(entry.AclOwner, entry.AclAllowed, entry.AclMode),
+		Lease: apis.WriteLease{
+			Holder: apis.LeaseID(entry.LeaseHolder),
+			Expiry: entry.LeaseExpiry,
+		},
+		ReplicationFactor: uint8(entry.ReplicationFactor),
+	}
+	// almost all entries have no lagging replicas, so keep those as nil
+	if len(entry.LaggingServerIDs) > 0 {
+		result.Lagging = IntArrayToIDArray(entry.LaggingServerIDs)
+	}
+	return result
 }
 
 type proxyMetadataCacheAsTwirp struct {
 	server apis.MetadataCache
+	// anyone permitted to reach the cache can read entries, but only the cluster's servers can change them
+	guard guard
 }
 
 func (p *proxyMetadataCacheAsTwirp) NewEntry(ctx context.Context, request *twirp.MetadataCache_NewEntry) (*twirp.MetadataCache_NewEntry_Result, error) {
-	chunk, err := p.server.NewEntry()
+	if err := p.guard.checkCluster(ctx); err != nil {
+		return nil, encodeError(err)
+	}
+	chunk, err := MetadataCacheWithContext(ctx, p.server).NewEntry()
 	if err != nil {
-		return nil, err
+		return nil, encodeError(err)
 	}
 	return &twirp.MetadataCache_NewEntry_Result{
 		Chunk: uint64(chunk),
@@ -37,69 +114,177 @@ func (p *proxyMetadataCacheAsTwirp) NewEntry(ctx context.Context, request *twirp
 }
 
 func (p *proxyMetadataCacheAsTwirp) ReadEntry(ctx context.Context, request *twirp.MetadataCache_ReadEntry) (*twirp.MetadataCache_ReadEntry_Result, error) {
-	entry, owner, err := p.server.ReadEntry(apis.ChunkNum(request.Chunk))
+	entry, owner, err := MetadataCacheWithContext(ctx, p.server).ReadEntry(apis.ChunkNum(request.Chunk))
 	if err != nil {
-		if owner == "" {
-			return nil, err
-		}
+		code, _, _ := errorFields(err)
 		return &twirp.MetadataCache_ReadEntry_Result{
-			Owner:    string(owner),
-			OwnerErr: err.Error(),
+			Owner:     string(owner),
+			Error:     err.Error(),
+			ErrorCode: code,
 		}, nil
 	}
 	return &twirp.MetadataCache_ReadEntry_Result{
-		Entry: &twirp.MetadataEntry{
-			MostRecentVersion:   uint64(entry.MostRecentVersion),
-			LastConsumedVersion: uint64(entry.LastConsumedVersion),
-			ServerIDs:           IDArrayToIntArray(entry.Replicas),
-		},
+		Entry: entryToTwirp(entry),
 	}, nil
 }
 
 func (p *proxyMetadataCacheAsTwirp) UpdateEntry(ctx context.Context, request *twirp.MetadataCache_UpdateEntry) (*twirp.MetadataCache_UpdateEntry_Result, error) {
-	owner, err := p.server.UpdateEntry(apis.ChunkNum(request.Chunk), apis.MetadataEntry{
-		MostRecentVersion:   apis.Version(request.PreviousEntry.MostRecentVersion),
-		LastConsumedVersion: apis.Version(request.PreviousEntry.LastConsumedVersion),
-		Replicas:            IntArrayToIDArray(request.PreviousEntry.ServerIDs),
-	}, apis.MetadataEntry{
-		MostRecentVersion:   apis.Version(request.NewEntry.MostRecentVersion),
-		LastConsumedVersion: apis.Version(request.NewEntry.LastConsumedVersion),
-		Replicas:            IntArrayToIDArray(request.NewEntry.ServerIDs),
-	})
-	if owner != "" {
+	if err := p.guard.checkCluster(ctx); err != nil {
+		code, _, _ := errorFields(err)
+		return &twirp.MetadataCache_UpdateEntry_Result{
+			Error:     err.Error(),
+			ErrorCode: code,
+		}, nil
+	}
+	owner, err := MetadataCacheWithContext(ctx, p.server).UpdateEntry(apis.ChunkNum(request.Chunk), entryFromTwirp(request.PreviousEntry),
+		entryFromTwirp(request.NewEntry))
+	if err != nil {
+		code, _, _ := errorFields(err)
 		return &twirp.MetadataCache_UpdateEntry_Result{
-			Owner:    string(owner),
-			OwnerErr: err.Error(),
+			Owner:     string(owner),
+			Error:     err.Error(),
+			ErrorCode: code,
 		}, nil
 	}
-	return &twirp.MetadataCache_UpdateEntry_Result{
-		Owner: string(owner),
-	}, err
+	return &twirp.MetadataCache_UpdateEntry_Result{}, nil
 }
 
 func (p *proxyMetadataCacheAsTwirp) DeleteEntry(ctx context.Context, request *twirp.MetadataCache_DeleteEntry) (*twirp.MetadataCache_DeleteEntry_Result, error) {
-	owner, err := p.server.DeleteEntry(apis.ChunkNum(request.Chunk), apis.MetadataEntry{
-		MostRecentVersion:   apis.Version(request.PreviousEntry.MostRecentVersion),
-		LastConsumedVersion: apis.Version(request.PreviousEntry.LastConsumedVersion),
-		Replicas:            IntArrayToIDArray(request.PreviousEntry.ServerIDs),
-	})
-	if owner != "" {
+	if err := p.guard.checkCluster(ctx); err != nil {
+		code, _, _ := errorFields(err)
 		return &twirp.MetadataCache_DeleteEntry_Result{
-			Owner:    string(owner),
-			OwnerErr: err.Error(),
+			Error:     err.Error(),
+			ErrorCode: code,
 		}, nil
 	}
-	return &twirp.MetadataCache_DeleteEntry_Result{
-		Owner: string(owner),
-	}, err
+	owner, err := MetadataCacheWithContext(ctx, p.server).DeleteEntry(apis.ChunkNum(request.Chunk), entryFromTwirp(request.PreviousEntry))
+	if err != nil {
+		code, _, _ := errorFields(err)
+		return &twirp.MetadataCache_DeleteEntry_Result{
+			Owner:     string(owner),
+			Error:     err.Error(),
+			ErrorCode: code,
+		}, nil
+	}
+	return &twirp.MetadataCache_DeleteEntry_Result{}, nil
+}
+
+func (p *proxyMetadataCacheAsTwirp) AcceptHandoff(ctx context.Context, request *twirp.MetadataCache_AcceptHandoff) (*twirp.MetadataCache_AcceptHandoff_Result, error) {
+	if err := p.guard.checkCluster(ctx); err != nil {
+		code, _, _ := errorFields(err)
+		return &twirp.MetadataCache_AcceptHandoff_Result{
+			Error:     err.Error(),
+			ErrorCode: code,
+		}, nil
+	}
+	err := MetadataCacheWithContext(ctx, p.server).AcceptHandoff(apis.MetadataID(request.Block), apis.ServerName(request.From))
+	if err != nil {
+		code, _, _ := errorFields(err)
+		return &twirp.MetadataCache_AcceptHandoff_Result{
+			Error:     err.Error(),
+			ErrorCode: code,
+		}, nil
+	}
+	return &twirp.MetadataCache_AcceptHandoff_Result{}, nil
+}
+
+func (p *proxyMetadataCacheAsTwirp) Stats(ctx context.Context, request *twirp.MetadataCache_Stats) (*twirp.MetadataCache_Stats_Result, error) {
+	stats, err := MetadataCacheWithContext(ctx, p.server).Stats()
+	if err != nil {
+		code, _, _ := errorFields(err)
+		return &twirp.MetadataCache_Stats_Result{
+			Error:     err.Error(),
+			ErrorCode: code,
+		}, nil
+	}
+	return &twirp.MetadataCache_Stats_Result{
+		Hits:             stats.Hits,
+		Misses:           stats.Misses,
+		Redirects:        stats.Redirects,
+		LeaseExpirations: stats.LeaseExpirations,
+		OwnedBlocks:      stats.OwnedBlocks,
+		OwnedEntries:     stats.OwnedEntries,
+	}, nil
+}
+
+func (p *proxyMetadataCacheAsTwirp) BatchReadEntry(ctx context.Context, request *twirp.MetadataCache_BatchReadEntry) (*twirp.MetadataCache_Batch_Result, error) {
+	chunks := make([]apis.ChunkNum, len(request.Chunks))
+	for i, chunk := range request.Chunks {
+		chunks[i] = apis.ChunkNum(chunk)
+	}
+	results, err := MetadataCacheWithContext(ctx, p.server).BatchReadEntry(chunks)
+	return batchResultToTwirp(results, err), nil
+}
+
+func (p *proxyMetadataCacheAsTwirp) BatchUpdateEntry(ctx context.Context, request *twirp.MetadataCache_BatchUpdateEntry) (*twirp.MetadataCache_Batch_Result, error) {
+	if err := p.guard.checkCluster(ctx); err != nil {
+		return batchResultToTwirp(nil, err), nil
+	}
+	updates := make([]apis.EntryUpdate, len(request.Updates))
+	for i, update := range request.Updates {
+		updates[i] = apis.EntryUpdate{
+			Chunk:    apis.ChunkNum(update.Chunk),
+			Previous: entryFromTwirp(update.PreviousEntry),
+			Next:     entryFromTwirp(update.NewEntry),
+		}
+	}
+	results, err := MetadataCacheWithContext(ctx, p.server).BatchUpdateEntry(updates)
+	return batchResultToTwirp(results, err), nil
+}
+
+func batchResultToTwirp(results []apis.EntryResult, err error) *twirp.MetadataCache_Batch_Result {
+	if err != nil {
+		code, _, _ := errorFields(err)
+		return &twirp.MetadataCache_Batch_Result{
+			Error:     err.Error(),
+			ErrorCode: code,
+		}
+	}
+	converted := make([]*twirp.MetadataCache_EntryResult, len(results))
+	for i, result := range results {
+		if result.Err != nil {
+			code, _, _ := errorFields(result.Err)
+			converted[i] = &twirp.MetadataCache_EntryResult{
+				Owner:     string(result.Owner),
+				Error:     result.Err.Error(),
+				ErrorCode: code,
+			}
+		} else {
+			converted[i] = &twirp.MetadataCache_EntryResult{
+				Entry: entryToTwirp(result.Entry),
+			}
+		}
+	}
+	return &twirp.MetadataCache_Batch_Result{Results: converted}
+}
+
+func batchResultFromTwirp(result *twirp.MetadataCache_Batch_Result, expected int) ([]apis.EntryResult, error) {
+	if result.Error != "" {
+		return nil, errorFromFields(result.Error, result.ErrorCode, 0, "")
+	}
+	if len(result.Results) != expected {
+		return nil, fmt.Errorf("expected %d results from batch, but got %d", expected, len(result.Results))
+	}
+	results := make([]apis.EntryResult, len(result.Results))
+	for i, r := range result.Results {
+		if r.Error != "" {
+			owner := apis.ServerName(r.Owner)
+			results[i] = apis.EntryResult{Owner: owner, Err: errorFromFields(r.Error, r.ErrorCode, 0, owner)}
+		} else if r.Entry != nil {
+			results[i] = apis.EntryResult{Entry: entryFromTwirp(r.Entry)}
+		}
+	}
+	return results, nil
 }
 
 type proxyTwirpAsMetadataCache struct {
 	server twirp.MetadataCache
+	ctx    context.Context
 }
 
 func (p *proxyTwirpAsMetadataCache) NewEntry() (apis.ChunkNum, error) {
-	result, err := p.server.NewEntry(context.Background(), &twirp.MetadataCache_NewEntry{})
+	result, err := p.server.NewEntry(p.ctx, &twirp.MetadataCache_NewEntry{})
+	err = callError(p.ctx, err)
 	if err != nil {
 		return 0, err
 	}
@@ -107,53 +292,110 @@ func (p *proxyTwirpAsMetadataCache) NewEntry() (apis.ChunkNum, error) {
 }
 
 func (p *proxyTwirpAsMetadataCache) ReadEntry(chunk apis.ChunkNum) (apis.MetadataEntry, apis.ServerName, error) {
-	result, err := p.server.ReadEntry(context.Background(), &twirp.MetadataCache_ReadEntry{
+	result, err := p.server.ReadEntry(p.ctx, &twirp.MetadataCache_ReadEntry{
 		Chunk: uint64(chunk),
 	})
+	err = callError(p.ctx, err)
 	if err != nil {
 		return apis.MetadataEntry{}, "", err
 	}
-	if result.Owner != "" {
-		return apis.MetadataEntry{}, apis.ServerName(result.Owner), errors.New(result.OwnerErr)
+	if result.Error != "" {
+		owner := apis.ServerName(result.Owner)
+		return apis.MetadataEntry{}, owner, errorFromFields(result.Error, result.ErrorCode, 0, owner)
 	}
-	return apis.MetadataEntry{
-		MostRecentVersion:   apis.Version(result.Entry.MostRecentVersion),
-		LastConsumedVersion: apis.Version(result.Entry.LastConsumedVersion),
-		Replicas:            IntArrayToIDArray(result.Entry.ServerIDs),
-	}, "", nil
+	return entryFromTwirp(result.Entry), "", nil
 }
 
 func (p *proxyTwirpAsMetadataCache) UpdateEntry(chunk apis.ChunkNum, previousEntry apis.MetadataEntry, newEntry apis.MetadataEntry) (apis.ServerName, error) {
-	result, err := p.server.UpdateEntry(context.Background(), &twirp.MetadataCache_UpdateEntry{
-		Chunk: uint64(chunk),
-		PreviousEntry: &twirp.MetadataEntry{
-			MostRecentVersion:   uint64(previousEntry.MostRecentVersion),
-			LastConsumedVersion: uint64(previousEntry.LastConsumedVersion),
-			ServerIDs:           IDArrayToIntArray(previousEntry.Replicas),
-		},
-		NewEntry: &twirp.MetadataEntry{
-			MostRecentVersion:   uint64(newEntry.MostRecentVersion),
-			LastConsumedVersion: uint64(newEntry.LastConsumedVersion),
-			ServerIDs:           IDArrayToIntArray(newEntry.Replicas),
-		},
+	result, err := p.server.UpdateEntry(p.ctx, &twirp.MetadataCache_UpdateEntry{
+		Chunk:         uint64(chunk),
+		PreviousEntry: entryToTwirp(previousEntry),
+		NewEntry:      entryToTwirp(newEntry),
 	})
-	if result.Owner != "" {
-		return apis.ServerName(result.Owner), errors.New(result.OwnerErr)
+	err = callError(p.ctx, err)
+	if err != nil {
+		return "", err
+	}
+	if result.Error != "" {
+		owner := apis.ServerName(result.Owner)
+		return owner, errorFromFields(result.Error, result.ErrorCode, 0, owner)
 	}
-	return "", err
+	return "", nil
 }
 
 func (p *proxyTwirpAsMetadataCache) DeleteEntry(chunk apis.ChunkNum, previous apis.MetadataEntry) (apis.ServerName, error) {
-	result, err := p.server.DeleteEntry(context.Background(), &twirp.MetadataCache_DeleteEntry{
-		Chunk: uint64(chunk),
-		PreviousEntry: &twirp.MetadataEntry{
-			LastConsumedVersion: uint64(previous.LastConsumedVersion),
-			MostRecentVersion:   uint64(previous.MostRecentVersion),
-			ServerIDs:           IDArrayToIntArray(previous.Replicas),
-		},
+	result, err := p.server.DeleteEntry(p.ctx, &twirp.MetadataCache_DeleteEntry{
+		Chunk:         uint64(chunk),
+		PreviousEntry: entryToTwirp(previous),
+	})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return "", err
+	}
+	if result.Error != "" {
+		owner := apis.ServerName(result.Owner)
+		return owner, errorFromFields(result.Error, result.ErrorCode, 0, owner)
+	}
+	return "", nil
+}
+
+func (p *proxyTwirpAsMetadataCache) AcceptHandoff(block apis.MetadataID, from apis.ServerName) error {
+	result, err := p.server.AcceptHandoff(p.ctx, &twirp.MetadataCache_AcceptHandoff{
+		Block: uint64(block),
+		From:  string(from),
 	})
-	if result.Owner != "" {
-		return apis.ServerName(result.Owner), errors.New(result.OwnerErr)
+	err = callError(p.ctx, err)
+	if err != nil {
+		return err
+	}
+	return errorFromFields(result.Error, result.ErrorCode, 0, "")
+}
+
+func (p *proxyTwirpAsMetadataCache) Stats() (apis.MetadataCacheStats, error) {
+	result, err := p.server.Stats(p.ctx, &twirp.MetadataCache_Stats{})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return apis.MetadataCacheStats{}, err
+	}
+	if result.Error != "" {
+		return apis.MetadataCacheStats{}, errorFromFields(result.Error, result.ErrorCode, 0, "")
+	}
+	return apis.MetadataCacheStats{
+		Hits:             result.Hits,
+		Misses:           result.Misses,
+		Redirects:        result.Redirects,
+		LeaseExpirations: result.LeaseExpirations,
+		OwnedBlocks:      result.OwnedBlocks,
+		OwnedEntries:     result.OwnedEntries,
+	}, nil
+}
+
+func (p *proxyTwirpAsMetadataCache) BatchReadEntry(chunks []apis.ChunkNum) ([]apis.EntryResult, error) {
+	request := &twirp.MetadataCache_BatchReadEntry{Chunks: make([]uint64, len(chunks))}
+	for i, chunk := range chunks {
+		request.Chunks[i] = uint64(chunk)
+	}
+	result, err := p.server.BatchReadEntry(p.ctx, request)
+	err = callError(p.ctx, err)
+	if err != nil {
+		return nil, err
+	}
+	return batchResultFromTwirp(result, len(chunks))
+}
+
+func (p *proxyTwirpAsMetadataCache) BatchUpdateEntry(updates []apis.EntryUpdate) ([]apis.EntryResult, error) {
+	request := &twirp.MetadataCache_BatchUpdateEntry{Updates: make([]*twirp.MetadataCache_UpdateEntry, len(updates))}
+	for i, update := range updates {
+		request.Updates[i] = &twirp.MetadataCache_UpdateEntry{
+			Chunk:         uint64(update.Chunk),
+			PreviousEntry: entryToTwirp(update.Previous),
+			NewEntry:      entryToTwirp(update.Next),
+		}
+	}
+	result, err := p.server.BatchUpdateEntry(p.ctx, request)
+	err = callError(p.ctx, err)
+	if err != nil {
+		return nil, err
 	}
-	return apis.ServerName(result.Owner), err
+	return batchResultFromTwirp(result, len(updates))
 }
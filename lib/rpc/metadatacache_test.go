@@ -1,9 +1,12 @@
 package rpc
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 	"zircon/apis"
 	"zircon/apis/mocks"
 )
@@ -159,3 +162,132 @@ func TestMetadataCache_DeleteEntry(t *testing.T) {
 	assert.Equal(t, apis.ServerName(""), owner)
 	assert.Contains(t, err.Error(), "metadatacache error 4b")
 }
+
+func TestMetadataCache_Deadline(t *testing.T) {
+	mocked, teardown, server := beginMetadataCacheTest(t)
+	defer teardown()
+
+	mocked.On("NewEntry").After(500 * time.Millisecond).Return(apis.ChunkNum(559), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := MetadataCacheWithContext(ctx, server).NewEntry()
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestMetadataCache_TypedErrors(t *testing.T) {
+	mocked, teardown, server := beginMetadataCacheTest(t)
+	defer teardown()
+
+	mocked.On("ReadEntry", apis.ChunkNum(2)).Return(apis.MetadataEntry{}, apis.ServerName("owner"),
+		apis.ErrOwnerRedirect{Owner: "owner"})
+	mocked.On("ReadEntry", apis.ChunkNum(3)).Return(apis.MetadataEntry{}, apis.ServerName(""),
+		fmt.Errorf("metadatacache error 5: %w", apis.ErrNotFound))
+	mocked.On("DeleteEntry", apis.ChunkNum(3), apis.MetadataEntry{Replicas: []apis.ServerID{}}).
+		Return(apis.ServerName(""), fmt.Errorf("metadatacache error 6: %w", apis.ErrVersionStale))
+
+	_, owner, err := server.ReadEntry(2)
+	var redirect apis.ErrOwnerRedirect
+	if assert.True(t, errors.As(err, &redirect)) {
+		assert.Equal(t, apis.ServerName("owner"), redirect.Owner)
+	}
+	assert.Equal(t, apis.ServerName("owner"), owner)
+
+	_, owner, err = server.ReadEntry(3)
+	assert.True(t, errors.Is(err, apis.ErrNotFound))
+	assert.Equal(t, apis.ServerName(""), owner)
+	assert.Contains(t, err.Error(), "metadatacache error 5")
+
+	owner, err = server.DeleteEntry(3, apis.MetadataEntry{Replicas: []apis.ServerID{}})
+	assert.True(t, errors.Is(err, apis.ErrVersionStale))
+	assert.Equal(t, apis.ServerName(""), owner)
+}
+
+func TestMetadataCache_AcceptHandoff(t *testing.T) {
+	mocked, teardown, server := beginMetadataCacheTest(t)
+	defer teardown()
+
+	mocked.On("AcceptHandoff", apis.MetadataID(17), apis.ServerName("mc0")).Return(nil)
+	mocked.On("AcceptHandoff", apis.MetadataID(18), apis.ServerName("mc0")).
+		Return(errors.New("metadatacache error 7"))
+
+	assert.NoError(t, server.AcceptHandoff(17, "mc0"))
+	err := server.AcceptHandoff(18, "mc0")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "metadatacache error 7")
+}
+
+func TestMetadataCache_Stats(t *testing.T) {
+	mocked, teardown, server := beginMetadataCacheTest(t)
+	defer teardown()
+
+	stats := apis.MetadataCacheStats{
+		Hits:             100,
+		Misses:           7,
+		Redirects:        3,
+		LeaseExpirations: 1,
+		OwnedBlocks:      2,
+		OwnedEntries:     45,
+	}
+	mocked.On("Stats").Return(stats, nil).Once()
+	mocked.On("Stats").Return(apis.MetadataCacheStats{}, errors.New("metadatacache error 8")).Once()
+
+	result, err := server.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, stats, result)
+
+	_, err = server.Stats()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "metadatacache error 8")
+}
+
+func TestMetadataCache_Batches(t *testing.T) {
+	mocked, teardown, server := beginMetadataCacheTest(t)
+	defer teardown()
+
+	entry := apis.MetadataEntry{
+		MostRecentVersion:   903,
+		LastConsumedVersion: 913,
+		Replicas:            []apis.ServerID{60, 2},
+	}
+	mocked.On("BatchReadEntry", []apis.ChunkNum{10, 11, 12}).Return([]apis.EntryResult{
+		{Entry: entry},
+		{Owner: "owner", Err: apis.ErrOwnerRedirect{Owner: "owner"}},
+		{Err: fmt.Errorf("metadatacache error 9: %w", apis.ErrNotFound)},
+	}, nil)
+	mocked.On("BatchReadEntry", []apis.ChunkNum{13}).Return(nil, errors.New("metadatacache error 10"))
+	mocked.On("BatchUpdateEntry", []apis.EntryUpdate{
+		{Chunk: 10, Previous: entry, Next: apis.MetadataEntry{Replicas: []apis.ServerID{}}},
+		{Chunk: 11, Previous: apis.MetadataEntry{Replicas: []apis.ServerID{}}, Next: entry},
+	}).Return([]apis.EntryResult{
+		{},
+		{Err: fmt.Errorf("metadatacache error 11: %w", apis.ErrVersionStale)},
+	}, nil)
+
+	results, err := server.BatchReadEntry([]apis.ChunkNum{10, 11, 12})
+	assert.NoError(t, err)
+	if assert.Equal(t, 3, len(results)) {
+		assert.NoError(t, results[0].Err)
+		assert.Equal(t, entry, results[0].Entry)
+		var redirect apis.ErrOwnerRedirect
+		assert.True(t, errors.As(results[1].Err, &redirect))
+		assert.Equal(t, apis.ServerName("owner"), results[1].Owner)
+		assert.True(t, errors.Is(results[2].Err, apis.ErrNotFound))
+		assert.Contains(t, results[2].Err.Error(), "metadatacache error 9")
+	}
+
+	_, err = server.BatchReadEntry([]apis.ChunkNum{13})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "metadatacache error 10")
+
+	results, err = server.BatchUpdateEntry([]apis.EntryUpdate{
+		{Chunk: 10, Previous: entry, Next: apis.MetadataEntry{}},
+		{Chunk: 11, Previous: apis.MetadataEntry{}, Next: entry},
+	})
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(results)) {
+		assert.NoError(t, results[0].Err)
+		assert.True(t, errors.Is(results[1].Err, apis.ErrVersionStale))
+	}
+}
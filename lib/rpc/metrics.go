@@ -0,0 +1,208 @@
+package rpc
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"zircon/apis"
+)
+
+// The path that every published server serves its metrics on, in the Prometheus text format. Every server reports how
+// many requests it has served and how long they took, for each RPC method; servers that are apis.MetricsReporters also
+// report on their own state. Every metric is labelled with the role of the server, such as "chunkserver", and with the
+// address it was scraped at, which names the server within a cluster.
+const MetricsPath = "/metrics"
+
+// The upper bounds, in seconds, of the buckets of the request latency histograms.
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	method string
+	code   int
+}
+
+type latencyHistogram struct {
+	// counts[i] is the number of requests that took no longer than latencyBuckets[i], and not included in counts[i-1]
+	counts []uint64
+	total  uint64
+	sum    float64
+}
+
+// The metrics collected about the requests served by a single published server.
+type requestMetrics struct {
+	role   string
+	server interface{}
+
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	latencies map[string]*latencyHistogram
+}
+
+// Serves the metrics for 'server' at MetricsPath, and collects them for every request passed on to 'handler'.
+func withMetrics(handler http.Handler, role string, server interface{}) http.Handler {
+	metrics := &requestMetrics{
+		role:      role,
+		server:    server,
+		requests:  map[requestKey]uint64{},
+		latencies: map[string]*latencyHistogram{},
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == MetricsPath {
+			metrics.serve(writer, request)
+			return
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: writer, code: http.StatusOK}
+		handler.ServeHTTP(recorder, request)
+		metrics.observe(methodName(request.URL.Path), recorder.code, time.Since(start))
+	})
+}
+
+// Names the RPC method that a request was for: the last element of the path for twirp requests, or the whole path for
+// the other endpoints, such as those for streamed transfers.
+func methodName(path string) string {
+	if strings.HasPrefix(path, "/twirp/") {
+		return path[strings.LastIndexByte(path, '/')+1:]
+	}
+	return path
+}
+
+// Remembers the status code of a response as it is written.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (m *requestMetrics) observe(method string, code int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{method: method, code: code}]++
+	histogram, found := m.latencies[method]
+	if !found {
+		histogram = &latencyHistogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[method] = histogram
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			histogram.counts[i]++
+			break
+		}
+	}
+	histogram.total++
+	histogram.sum += seconds
+}
+
+func (m *requestMetrics) serve(writer http.ResponseWriter, request *http.Request) {
+	constant := map[string]string{"role": m.role}
+	if local, ok := request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		constant["server"] = local.String()
+	}
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := &metricsWriter{writer: writer, constant: constant}
+
+	m.mu.Lock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+	out.family("zircon_rpc_requests_total", "counter", "The number of requests served, by RPC method and HTTP status code.")
+	for _, key := range keys {
+		labels := map[string]string{"method": key.method, "code": strconv.Itoa(key.code)}
+		out.sample("zircon_rpc_requests_total", labels, float64(m.requests[key]))
+	}
+	methods := make([]string, 0, len(m.latencies))
+	for method := range m.latencies {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	out.family("zircon_rpc_request_duration_seconds", "histogram", "How long requests took to serve, by RPC method.")
+	for _, method := range methods {
+		histogram := m.latencies[method]
+		cumulative := uint64(0)
+		for i, bound := range latencyBuckets {
+			cumulative += histogram.counts[i]
+			labels := map[string]string{"method": method, "le": strconv.FormatFloat(bound, 'g', -1, 64)}
+			out.sample("zircon_rpc_request_duration_seconds_bucket", labels, float64(cumulative))
+		}
+		out.sample("zircon_rpc_request_duration_seconds_bucket", map[string]string{"method": method, "le": "+Inf"}, float64(histogram.total))
+		out.sample("zircon_rpc_request_duration_seconds_sum", map[string]string{"method": method}, histogram.sum)
+		out.sample("zircon_rpc_request_duration_seconds_count", map[string]string{"method": method}, float64(histogram.total))
+	}
+	m.mu.Unlock()
+
+	// the server's own measurements are taken without holding mu, since they may take a while to gather
+	if reporter, ok := m.server.(apis.MetricsReporter); ok {
+		measurements := reporter.ReportMetrics()
+		sort.SliceStable(measurements, func(i, j int) bool {
+			return measurements[i].Name < measurements[j].Name
+		})
+		for i, measurement := range measurements {
+			if i == 0 || measurements[i-1].Name != measurement.Name {
+				out.family(measurement.Name, "gauge", measurement.Help)
+			}
+			out.sample(measurement.Name, measurement.Labels, measurement.Value)
+		}
+	}
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Writes metrics in the Prometheus text format, adding the constant labels to every sample. Once a write fails, the
+// rest are skipped, since the scraper has gone away.
+type metricsWriter struct {
+	writer   io.Writer
+	constant map[string]string
+	err      error
+}
+
+func (w *metricsWriter) family(name string, kind string, help string) {
+	w.printf("# HELP %s %s\n", name, helpEscaper.Replace(help))
+	w.printf("# TYPE %s %s\n", name, kind)
+}
+
+func (w *metricsWriter) sample(name string, labels map[string]string, value float64) {
+	names := make([]string, 0, len(labels)+len(w.constant))
+	for label := range w.constant {
+		if _, overridden := labels[label]; !overridden {
+			names = append(names, label)
+		}
+	}
+	for label := range labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, label := range names {
+		value, found := labels[label]
+		if !found {
+			value = w.constant[label]
+		}
+		pairs[i] = label + `="` + labelEscaper.Replace(value) + `"`
+	}
+	w.printf("%s{%s} %s\n", name, strings.Join(pairs, ","), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (w *metricsWriter) printf(format string, args ...interface{}) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.writer, format, args...)
+	}
+}
@@ -0,0 +1,66 @@
+package rpc
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"zircon/apis"
+	"zircon/apis/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A frontend that reports a single measurement about itself.
+type reportingFrontend struct {
+	*mocks.Frontend
+}
+
+func (r reportingFrontend) ReportMetrics() []apis.Measurement {
+	return []apis.Measurement{{
+		Name:   "zircon_test_widgets",
+		Help:   "The number of widgets.",
+		Labels: map[string]string{"color": `"blue"`},
+		Value:  3,
+	}}
+}
+
+func getMetrics(t *testing.T, address apis.ServerAddress) string {
+	response, err := http.Get("http://" + string(address) + MetricsPath)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	body, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+// Tests that a published server counts and times the requests it serves, and reports its own measurements, all
+// labelled with its role and address.
+func TestMetricsEndpoint(t *testing.T) {
+	teardown, address, err := PublishFrontend(reportingFrontend{new(mocks.Frontend)}, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer teardown(true)
+
+	for i := 0; i < 2; i++ {
+		response, err := http.Get("http://" + string(address) + LivenessPath)
+		require.NoError(t, err)
+		response.Body.Close()
+	}
+	response, err := http.Get("http://" + string(address) + "/twirp/zircon.rpc.twirp.Frontend/Missing")
+	require.NoError(t, err)
+	response.Body.Close()
+
+	metrics := getMetrics(t, address)
+	server := `role="frontend",server="` + string(address) + `"`
+	assert.Contains(t, metrics, "# TYPE zircon_rpc_requests_total counter\n")
+	assert.Contains(t, metrics, `zircon_rpc_requests_total{code="200",method="/healthz",`+server+"} 2\n")
+	assert.Contains(t, metrics, `zircon_rpc_requests_total{code="404",method="Missing",`+server+"} 1\n")
+	assert.Contains(t, metrics, "# TYPE zircon_rpc_request_duration_seconds histogram\n")
+	assert.Contains(t, metrics, `zircon_rpc_request_duration_seconds_bucket{le="+Inf",method="/healthz",`+server+"} 2\n")
+	assert.Contains(t, metrics, `zircon_rpc_request_duration_seconds_count{method="/healthz",`+server+"} 2\n")
+	assert.Contains(t, metrics, "# HELP zircon_test_widgets The number of widgets.\n# TYPE zircon_test_widgets gauge\n")
+	assert.Contains(t, metrics, `zircon_test_widgets{color="\"blue\"",`+server+"} 3\n")
+	// scrapes themselves aren't counted
+	assert.NotContains(t, metrics, MetricsPath+`"`)
+}
@@ -0,0 +1,145 @@
+package rpc
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+	"zircon/apis"
+)
+
+// Explanation of panic recovery and access logs:
+//     Every published server recovers from panics in its handlers and interceptors, over either transport. The call
+//     that panicked fails with an error that says so, which the client gets back as it would any other error, and the
+//     panic is reported to ServerOptions.Logger at ERROR, along with its stack. Without this, a panic over twirp would
+//     cut off the connection, which clients would take for the server being unreachable, and a panic over gRPC would
+//     bring down the whole process. If the response had already started when the panic happened, it can only be cut
+//     off, so it is.
+//     If ServerOptions.AccessLog is set, every call is logged to it at INFO once it finishes, as a line of space-separated
+//     key=value pairs, with the values quoted where needed:
+//         rpc role=chunkserver method=Chunkserver.Read peer=10.0.0.7:51422 status=200 duration=1.2ms
+//             request_bytes=48 response_bytes=65571 outcome=ok
+//     The status is the HTTP status code over twirp, or the gRPC code over gRPC. Sizes are those of the messages or
+//     chunk data, before any compression. A call that failed has outcome=error, and the error's message as error=.
+//     As with interceptors, only RPCs are logged.
+
+// Recovers from panics in 'handler', responding to the call that panicked with an error instead.
+func withRecovery(handler http.Handler, role string, logger apis.Logger) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		tracker := &headerTracker{ResponseWriter: writer}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			call, ok := rpcCall(request.URL.Path)
+			if !ok {
+				call = Call{Method: request.URL.Path}
+			}
+			err := panicError(logger, role, call, recovered)
+			if tracker.wroteHeader {
+				// too late to say why, so the client is cut off instead
+				panic(http.ErrAbortHandler)
+			}
+			if ok {
+				writeCallError(writer, request.URL.Path, err)
+			} else {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+			}
+		}()
+		handler.ServeHTTP(tracker, request)
+	})
+}
+
+// Reports a panic recovered from while serving 'call', and returns the error that the call fails with instead.
+func panicError(logger apis.Logger, role string, call Call, recovered interface{}) error {
+	if logger == nil {
+		logger = apis.NoopLogger
+	}
+	logger.Logf(apis.ERROR, "%s panicked while serving %s: %v\n%s", role, callName(call), recovered, debug.Stack())
+	return fmt.Errorf("%s panicked while serving %s: %v", role, callName(call), recovered)
+}
+
+// Names a call as its service and method, such as "Chunkserver.Read", or by its method alone if it has no service.
+func callName(call Call) string {
+	if call.Service == "" {
+		return call.Method
+	}
+	return call.Service + "." + call.Method
+}
+
+// Remembers whether the response has been started.
+type headerTracker struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (h *headerTracker) WriteHeader(code int) {
+	h.wroteHeader = true
+	h.ResponseWriter.WriteHeader(code)
+}
+
+func (h *headerTracker) Write(data []byte) (int, error) {
+	h.wroteHeader = true
+	return h.ResponseWriter.Write(data)
+}
+
+// Logs every RPC that 'handler' serves to 'logger', unless it is nil.
+func withAccessLog(handler http.Handler, role string, logger apis.Logger) http.Handler {
+	if logger == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		call, ok := rpcCall(request.URL.Path)
+		if !ok {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		call.Peer = request.RemoteAddr
+		start := time.Now()
+		body := &countingBody{ReadCloser: request.Body}
+		request.Body = body
+		recorder := &errorRecorder{ResponseWriter: writer, code: http.StatusOK}
+		handler.ServeHTTP(recorder, request)
+		logAccess(logger, role, call, strconv.Itoa(recorder.code), time.Since(start), body.read, recorder.written,
+			responseError(request.URL.Path, recorder.code, recorder.Header(), recorder.body.Bytes()))
+	})
+}
+
+// Counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (c *countingBody) Read(data []byte) (int, error) {
+	n, err := c.ReadCloser.Read(data)
+	c.read += int64(n)
+	return n, err
+}
+
+// Logs one line about a call that has finished.
+func logAccess(logger apis.Logger, role string, call Call, status string, elapsed time.Duration, requestBytes int64, responseBytes int64, err error) {
+	line := fmt.Sprintf("rpc role=%s method=%s peer=%s status=%s duration=%v request_bytes=%d response_bytes=%d",
+		logValue(role), logValue(callName(call)), logValue(call.Peer), logValue(status), elapsed, requestBytes, responseBytes)
+	if err != nil {
+		line += " outcome=error error=" + logValue(err.Error())
+	} else {
+		line += " outcome=ok"
+	}
+	logger.Logf(apis.INFO, "%s", line)
+}
+
+// Quotes a value in a log line if it would otherwise be ambiguous.
+func logValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\r\n\"=") {
+		return strconv.Quote(value)
+	}
+	return value
+}
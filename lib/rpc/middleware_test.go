@@ -0,0 +1,122 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/apis/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// Collects the messages logged at each level.
+type capturingLogger struct {
+	mu       sync.Mutex
+	messages map[apis.LogLevel][]string
+}
+
+func (l *capturingLogger) Logf(level apis.LogLevel, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages[level] = append(l.messages[level], fmt.Sprintf(format, args...))
+}
+
+// Waits for up to a second for 'count' messages to be logged at 'level', since servers may only finish a call after
+// the client has its response, and returns those that have been.
+func (l *capturingLogger) get(level apis.LogLevel, count int) []string {
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		l.mu.Lock()
+		if len(l.messages[level]) >= count || time.Since(start) > time.Second {
+			defer l.mu.Unlock()
+			return append([]string(nil), l.messages[level]...)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Tests that a handler that panics fails only its own call, with an error that says so, and that the panic is logged.
+func TestRecovery(t *testing.T) {
+	for _, transport := range []Transport{TwirpTransport, GRPCTransport} {
+		t.Run(string(transport), func(t *testing.T) {
+			mocked := new(mocks.Frontend)
+			mocked.On("New").Run(func(mock.Arguments) {
+				panic("the unexpected happened")
+			}).Return(apis.ChunkNum(0), nil)
+			mocked.On("Delete", apis.ChunkNum(73), apis.Version(2)).Return(nil)
+			logger := &capturingLogger{messages: map[apis.LogLevel][]string{}}
+			teardown, address, err := PublishFrontendWithOptions(mocked, "127.0.0.1:0", ServerOptions{Transport: transport, Logger: logger})
+			require.NoError(t, err)
+			defer teardown(true)
+
+			cache := NewConnectionCacheWithOptions(ConnectionOptions{Transport: transport})
+			defer cache.CloseAll()
+			frontend, err := cache.SubscribeFrontend(address)
+			require.NoError(t, err)
+
+			_, err = frontend.New()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "frontend panicked while serving Frontend.New: the unexpected happened")
+			assert.False(t, errors.Is(err, apis.ErrUnreachable))
+			assert.NoError(t, frontend.Delete(73, 2))
+
+			logged := logger.get(apis.ERROR, 1)
+			require.Len(t, logged, 1)
+			assert.Contains(t, logged[0], "the unexpected happened")
+			// with the stack
+			assert.Contains(t, logged[0], "goroutine")
+
+			mocked.AssertExpectations(t)
+		})
+	}
+}
+
+// Tests that every call is logged once it finishes, with its method, outcome, and sizes.
+func TestAccessLog(t *testing.T) {
+	for _, transport := range []Transport{TwirpTransport, GRPCTransport} {
+		t.Run(string(transport), func(t *testing.T) {
+			mocked := new(mocks.Frontend)
+			mocked.On("New").Return(apis.ChunkNum(73), nil)
+			mocked.On("Delete", apis.ChunkNum(73), apis.Version(2)).Return(fmt.Errorf("no such chunk: %w", apis.ErrNotFound))
+			logger := &capturingLogger{messages: map[apis.LogLevel][]string{}}
+			teardown, address, err := PublishFrontendWithOptions(mocked, "127.0.0.1:0", ServerOptions{Transport: transport, AccessLog: logger})
+			require.NoError(t, err)
+			defer teardown(true)
+
+			cache := NewConnectionCacheWithOptions(ConnectionOptions{Transport: transport})
+			defer cache.CloseAll()
+			require.NoError(t, cache.Preconnect([]apis.ServerAddress{address}))
+			frontend, err := cache.SubscribeFrontend(address)
+			require.NoError(t, err)
+			_, err = frontend.New()
+			require.NoError(t, err)
+			assert.Error(t, frontend.Delete(73, 2))
+
+			// Preconnect isn't logged, since it isn't an RPC
+			logged := logger.get(apis.INFO, 2)
+			require.Len(t, logged, 2)
+			assert.True(t, strings.HasPrefix(logged[0], "rpc role=frontend method=Frontend.New peer=127.0.0.1:"))
+			assert.Contains(t, logged[0], " response_bytes=")
+			assert.NotContains(t, logged[0], " response_bytes=0 ")
+			assert.True(t, strings.HasSuffix(logged[0], " outcome=ok"))
+			assert.Contains(t, logged[1], "method=Frontend.Delete")
+			assert.True(t, strings.HasSuffix(logged[1], ` outcome=error error="no such chunk: not found"`), logged[1])
+
+			mocked.AssertExpectations(t)
+		})
+	}
+}
+
+// Tests that values in access logs are quoted only when they need to be.
+func TestLogValue(t *testing.T) {
+	assert.Equal(t, "Chunkserver.Read", logValue("Chunkserver.Read"))
+	assert.Equal(t, `""`, logValue(""))
+	assert.Equal(t, `"no such chunk"`, logValue("no such chunk"))
+	assert.Equal(t, `"a=b"`, logValue("a=b"))
+	assert.Equal(t, `"say \"hi\""`, logValue(`say "hi"`))
+}
@@ -50,6 +50,20 @@ func (mc *MockCache) SubscribeSyncServer(address apis.ServerAddress) (apis.SyncS
 	}
 }
 
+// There is nothing to connect to, so this only checks that each address is known.
+func (mc *MockCache) Preconnect(addresses []apis.ServerAddress) error {
+	for _, address := range addresses {
+		_, cs := mc.Chunkservers[address]
+		_, fe := mc.Frontends[address]
+		_, mdc := mc.MetadataCaches[address]
+		_, ss := mc.SyncServers[address]
+		if !cs && !fe && !mdc && !ss {
+			return fmt.Errorf("no such server: %s", address)
+		}
+	}
+	return nil
+}
+
 func (mc *MockCache) CloseAll() {
 	// don't bother doing anything
 }
@@ -0,0 +1,267 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Explanation of the OTLP exporter:
+//     Spans are sent to collectors as OTLP over HTTP, encoded as JSON rather than protobuf. The exporters that come with
+//     OpenTelemetry depend on a much newer gRPC than the one that etcd's client is built against, so instead of taking
+//     them on, spans are encoded here, which needs nothing beyond the SDK. Collectors accept both encodings at the same
+//     /v1/traces path, telling them apart by the content type.
+
+// The path that OTLP/HTTP collectors accept traces at.
+const otlpTracesPath = "/v1/traces"
+
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+// Sends spans to the OTLP/HTTP collector at 'endpoint', a host and port, over HTTPS unless 'insecure' is set.
+func newOTLPExporter(endpoint string, insecure bool) sdktrace.SpanExporter {
+	scheme := "https"
+	if insecure {
+		scheme = "http"
+	}
+	return &otlpExporter{url: scheme + "://" + endpoint + otlpTracesPath, client: &http.Client{}}
+}
+
+// The ExportTraceServiceRequest message, and those it contains, in the JSON encoding of OTLP. IDs are hex rather than
+// base64, enums are numbers, and 64-bit integers are strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        string         `json:"startTimeUnixNano"`
+	End          string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Events       []otlpEvent    `json:"events,omitempty"`
+	Status       otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	Time       string         `json:"timeUnixNano"`
+	Name       string         `json:"name"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	String *string         `json:"stringValue,omitempty"`
+	Bool   *bool           `json:"boolValue,omitempty"`
+	Int    *string         `json:"intValue,omitempty"`
+	Double *float64        `json:"doubleValue,omitempty"`
+	Array  *otlpArrayValue `json:"arrayValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpValue `json:"values"`
+}
+
+func otlpString(s string) otlpValue {
+	return otlpValue{String: &s}
+}
+
+func otlpInt(i int64) otlpValue {
+	s := strconv.FormatInt(i, 10)
+	return otlpValue{Int: &s}
+}
+
+func otlpAttributeValue(value attribute.Value) otlpValue {
+	switch value.Type() {
+	case attribute.BOOL:
+		b := value.AsBool()
+		return otlpValue{Bool: &b}
+	case attribute.INT64:
+		return otlpInt(value.AsInt64())
+	case attribute.FLOAT64:
+		f := value.AsFloat64()
+		return otlpValue{Double: &f}
+	case attribute.BOOLSLICE:
+		var values []otlpValue
+		for _, b := range value.AsBoolSlice() {
+			b := b
+			values = append(values, otlpValue{Bool: &b})
+		}
+		return otlpValue{Array: &otlpArrayValue{Values: values}}
+	case attribute.INT64SLICE:
+		var values []otlpValue
+		for _, i := range value.AsInt64Slice() {
+			values = append(values, otlpInt(i))
+		}
+		return otlpValue{Array: &otlpArrayValue{Values: values}}
+	case attribute.FLOAT64SLICE:
+		var values []otlpValue
+		for _, f := range value.AsFloat64Slice() {
+			f := f
+			values = append(values, otlpValue{Double: &f})
+		}
+		return otlpValue{Array: &otlpArrayValue{Values: values}}
+	case attribute.STRINGSLICE:
+		var values []otlpValue
+		for _, s := range value.AsStringSlice() {
+			values = append(values, otlpString(s))
+		}
+		return otlpValue{Array: &otlpArrayValue{Values: values}}
+	default:
+		return otlpString(value.Emit())
+	}
+}
+
+func otlpAttributes(attributes []attribute.KeyValue) []otlpKeyValue {
+	var result []otlpKeyValue
+	for _, kv := range attributes {
+		result = append(result, otlpKeyValue{Key: string(kv.Key), Value: otlpAttributeValue(kv.Value)})
+	}
+	return result
+}
+
+// OTLP numbers its status codes differently from the SDK: unset is 0, OK is 1, and error is 2.
+func otlpStatusCode(code codes.Code) int {
+	switch code {
+	case codes.Ok:
+		return 1
+	case codes.Error:
+		return 2
+	default:
+		return 0
+	}
+}
+
+func otlpNanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func encodeSpan(span sdktrace.ReadOnlySpan) otlpSpan {
+	encoded := otlpSpan{
+		TraceID: span.SpanContext().TraceID().String(),
+		SpanID:  span.SpanContext().SpanID().String(),
+		Name:    span.Name(),
+		// SpanKind is numbered the same way in both
+		Kind:       int(span.SpanKind()),
+		Start:      otlpNanos(span.StartTime()),
+		End:        otlpNanos(span.EndTime()),
+		Attributes: otlpAttributes(span.Attributes()),
+		Status:     otlpStatus{Code: otlpStatusCode(span.Status().Code), Message: span.Status().Description},
+	}
+	if span.Parent().HasSpanID() {
+		encoded.ParentSpanID = span.Parent().SpanID().String()
+	}
+	for _, event := range span.Events() {
+		encoded.Events = append(encoded.Events, otlpEvent{
+			Time:       otlpNanos(event.Time),
+			Name:       event.Name,
+			Attributes: otlpAttributes(event.Attributes),
+		})
+	}
+	return encoded
+}
+
+// Groups 'spans' by the resource that recorded them, and then by the instrumentation that did, as OTLP expects.
+func encodeSpans(spans []sdktrace.ReadOnlySpan) otlpRequest {
+	var request otlpRequest
+	resources := map[string]int{}
+	scopes := map[string]int{}
+	for _, span := range spans {
+		resourceKey := span.Resource().Encoded(attribute.DefaultEncoder())
+		r, found := resources[resourceKey]
+		if !found {
+			r = len(request.ResourceSpans)
+			resources[resourceKey] = r
+			request.ResourceSpans = append(request.ResourceSpans, otlpResourceSpans{
+				Resource: otlpResource{Attributes: otlpAttributes(span.Resource().Attributes())},
+			})
+		}
+		scope := span.InstrumentationScope()
+		scopeKey := fmt.Sprintf("%s\x00%s\x00%s", resourceKey, scope.Name, scope.Version)
+		s, found := scopes[scopeKey]
+		if !found {
+			s = len(request.ResourceSpans[r].ScopeSpans)
+			scopes[scopeKey] = s
+			request.ResourceSpans[r].ScopeSpans = append(request.ResourceSpans[r].ScopeSpans, otlpScopeSpans{
+				Scope: otlpScope{Name: scope.Name, Version: scope.Version},
+			})
+		}
+		scopeSpans := &request.ResourceSpans[r].ScopeSpans[s]
+		scopeSpans.Spans = append(scopeSpans.Spans, encodeSpan(span))
+	}
+	return request
+}
+
+func (e *otlpExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(encodeSpans(spans))
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := e.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("cannot send spans to %s: %v", e.url, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("collector at %s refused spans: %s: %s", e.url, response.Status, bytes.TrimSpace(body))
+	}
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	return nil
+}
+
+func (e *otlpExporter) Shutdown(ctx context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
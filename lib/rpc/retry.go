@@ -0,0 +1,278 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"zircon/apis"
+)
+
+// How calls that can safely be made more than once are retried when they fail to reach their server.
+type RetryPolicy struct {
+	// How many times such a call is tried in all, counting the first attempt. Zero takes the default, and one or less
+	// means calls are never retried.
+	Attempts int `yaml:"attempts"`
+	// How long to wait before the first retry, doubling with each one after that, up to MaxBackoff. The actual wait is
+	// randomized to between half of this and all of it, so that clients that failed together don't retry together.
+	InitialBackoff time.Duration `yaml:"initial-backoff"`
+	MaxBackoff     time.Duration `yaml:"max-backoff"`
+}
+
+// How a connection cache stops sending requests to a server that keeps failing to respond.
+type BreakerPolicy struct {
+	// How many calls in a row have to fail to reach a server before its circuit opens. Zero takes the default, and
+	// negative means circuits never open.
+	Failures int `yaml:"failures"`
+	// How long a circuit stays open. Once this has passed, a single call is let through to try the server again, which
+	// closes the circuit if it succeeds, or opens it again if it doesn't.
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// Explanation of retries and circuit breaking:
+//     Only calls that read, and so have the same effect no matter how many times they are made, are retried: see
+//     idempotentMethods. They are retried only when they failed without any response from the server, since any
+//     response, even an error, means that the server handled the call. Retries happen within the call's deadline (see
+//     Timeouts), so they never make a call take longer than it could have anyway.
+//     Each server has a circuit, which opens once enough calls in a row fail to reach it. While it is open, calls to
+//     the server fail right away with an error matching apis.ErrUnreachable, instead of each waiting to time out, so that
+//     callers move on to other replicas or servers quickly. Calls refused by an open circuit are not retried.
+
+// The retry policy of connection caches created without one given.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:       3,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     time.Second,
+}
+
+// The breaker policy of connection caches created without one given.
+var DefaultBreakerPolicy = BreakerPolicy{
+	Failures: 5,
+	Cooldown: 2 * time.Second,
+}
+
+// Fills in the fields left as zero from DefaultRetryPolicy.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.Attempts == 0 {
+		p.Attempts = DefaultRetryPolicy.Attempts
+	}
+	if p.InitialBackoff == 0 {
+		p.InitialBackoff = DefaultRetryPolicy.InitialBackoff
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = DefaultRetryPolicy.MaxBackoff
+	}
+	return p
+}
+
+// Fills in the fields left as zero from DefaultBreakerPolicy.
+func (p BreakerPolicy) withDefaults() BreakerPolicy {
+	if p.Failures == 0 {
+		p.Failures = DefaultBreakerPolicy.Failures
+	}
+	if p.Cooldown == 0 {
+		p.Cooldown = DefaultBreakerPolicy.Cooldown
+	}
+	return p
+}
+
+// Waits before the retry that follows 'attempt' failed attempts. Returns false if ctx ends first.
+func (p RetryPolicy) wait(ctx context.Context, attempt int) bool {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	select {
+	case <-time.After(backoff):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// The methods of each service that can safely be retried, since they only read.
+var idempotentMethods = map[string][]string{
+	"Chunkserver":   {"Read", "ReadVersion", "ReadWithChecksum", "ListAllChunks", "DigestChunks"},
+	"Frontend":      {"ReadMetadataEntry", "ReadFullMetadataEntry"},
+	"MetadataCache": {"ReadEntry", "BatchReadEntry", "Stats"},
+	"SyncServer":    {"GetFSRoot"},
+}
+
+// The paths of the idempotent methods, which are the same for twirp, under its prefix, and gRPC.
+var idempotentPaths = func() []string {
+	var paths []string
+	for service, methods := range idempotentMethods {
+		for _, method := range methods {
+			paths = append(paths, ".rpc.twirp."+service+"/"+method)
+		}
+	}
+	return paths
+}()
+
+// Whether a call to the method at 'path' can be retried.
+func idempotent(path string) bool {
+	if path == ReadStreamPath {
+		return true
+	}
+	for _, suffix := range idempotentPaths {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returned instead of making a call to a server whose circuit is open.
+type circuitOpenError struct {
+	server string
+}
+
+func (e circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit to %s is open after repeated failures to reach it", e.server)
+}
+
+func (e circuitOpenError) Unwrap() error {
+	return apis.ErrUnreachable
+}
+
+// Whether a failed call that never got a response should count against its server, and be retried if idempotent. Calls
+// that were cancelled or ran out of time, or that were refused before being sent, don't.
+func unreachedFailure(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	var open circuitOpenError
+	if errors.As(err, &open) {
+		return false
+	}
+	message := err.Error()
+	return !strings.Contains(message, errorCodeTag) && !strings.Contains(message, budgetExhausted)
+}
+
+// The circuits of every server that a connection cache has called.
+type circuitBreakers struct {
+	policy BreakerPolicy
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	// failed calls in a row
+	failures int
+	// when the circuit closes again, if it is open
+	openUntil time.Time
+	// whether a call is already trying the server after the circuit's cooldown
+	probing bool
+}
+
+func newCircuitBreakers(policy BreakerPolicy) *circuitBreakers {
+	return &circuitBreakers{policy: policy.withDefaults(), circuits: map[string]*circuit{}}
+}
+
+// Fails if the server's circuit is open; otherwise, the call can go ahead, and its outcome must be passed to record.
+func (b *circuitBreakers) allow(server string) error {
+	if b.policy.Failures < 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, found := b.circuits[server]
+	if !found || c.openUntil.IsZero() {
+		return nil
+	}
+	if time.Now().Before(c.openUntil) || c.probing {
+		return circuitOpenError{server: server}
+	}
+	c.probing = true
+	return nil
+}
+
+// Opens the server's circuit right away, such as when a health check finds that it is dead.
+func (b *circuitBreakers) trip(server string) {
+	if b.policy.Failures < 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.circuits[server] = &circuit{failures: b.policy.Failures, openUntil: time.Now().Add(b.policy.Cooldown)}
+}
+
+// Counts the outcome of a call against the server's circuit, given whether it failed to reach the server. Calls that
+// neither succeeded nor failed to reach the server don't count either way.
+func (b *circuitBreakers) record(server string, err error, unreached bool) {
+	if b.policy.Failures < 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, found := b.circuits[server]
+	switch {
+	case err == nil:
+		delete(b.circuits, server)
+	case unreached:
+		if !found {
+			c = &circuit{}
+			b.circuits[server] = c
+		}
+		c.failures++
+		if c.probing || c.failures >= b.policy.Failures {
+			c.openUntil = time.Now().Add(b.policy.Cooldown)
+			c.probing = false
+		}
+	case found:
+		// lets another call try the server instead
+		c.probing = false
+	}
+}
+
+// Retries idempotent requests and applies circuit breaking to every request sent through a ConnectionCache.
+type retryTransport struct {
+	transport http.RoundTripper
+	policy    RetryPolicy
+	breakers  *circuitBreakers
+}
+
+func (r *retryTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	ctx := request.Context()
+	attempts := 1
+	hasBody := request.Body != nil && request.Body != http.NoBody
+	if idempotent(request.URL.Path) && (!hasBody || request.GetBody != nil) {
+		attempts = r.policy.Attempts
+	}
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			// the request is the caller's, so each retry is sent as a copy with a fresh body
+			request = request.Clone(ctx)
+			if hasBody {
+				body, err := request.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				request.Body = body
+			}
+		}
+		response, err := r.attempt(request)
+		if attempt >= attempts || !unreachedFailure(ctx, err) || !r.policy.wait(ctx, attempt) {
+			return response, err
+		}
+	}
+}
+
+func (r *retryTransport) attempt(request *http.Request) (*http.Response, error) {
+	server := request.URL.Host
+	if err := r.breakers.allow(server); err != nil {
+		return nil, err
+	}
+	response, err := r.transport.RoundTrip(request)
+	r.breakers.record(server, err, unreachedFailure(request.Context(), err))
+	return response, err
+}
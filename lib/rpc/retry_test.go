@@ -0,0 +1,106 @@
+package rpc
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+	"zircon/apis"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A transport that fails a set number of requests as if their server couldn't be reached, and then succeeds.
+type flakyTransport struct {
+	failures int
+	calls    int
+}
+
+func (f *flakyTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: request}, nil
+}
+
+func newRetryTestTransport(flaky *flakyTransport, breaker BreakerPolicy) *retryTransport {
+	return &retryTransport{
+		transport: flaky,
+		policy:    RetryPolicy{Attempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond},
+		breakers:  newCircuitBreakers(breaker),
+	}
+}
+
+// Tests that only idempotent calls are retried, and no more times than the policy allows.
+func TestRetryIdempotent(t *testing.T) {
+	call := func(transport *retryTransport, method string) error {
+		request, err := http.NewRequest(http.MethodPost, "http://cs-address/twirp/zircon.rpc.twirp.Chunkserver/"+method, http.NoBody)
+		require.NoError(t, err)
+		_, err = transport.RoundTrip(request)
+		return err
+	}
+
+	flaky := &flakyTransport{failures: 2}
+	assert.NoError(t, call(newRetryTestTransport(flaky, BreakerPolicy{Failures: -1}), "Read"))
+	assert.Equal(t, 3, flaky.calls)
+
+	flaky = &flakyTransport{failures: 3}
+	assert.Error(t, call(newRetryTestTransport(flaky, BreakerPolicy{Failures: -1}), "ListAllChunks"))
+	assert.Equal(t, 3, flaky.calls)
+
+	flaky = &flakyTransport{failures: 1}
+	assert.Error(t, call(newRetryTestTransport(flaky, BreakerPolicy{Failures: -1}), "StartWrite"))
+	assert.Equal(t, 1, flaky.calls)
+
+	assert.True(t, idempotent("/twirp/zircon.rpc.twirp.MetadataCache/ReadEntry"))
+	assert.True(t, idempotent("/zircon.rpc.twirp.MetadataCache/ReadEntry"))
+	assert.True(t, idempotent(ReadStreamPath))
+	assert.False(t, idempotent("/twirp/zircon.rpc.twirp.MetadataCache/UpdateEntry"))
+	assert.False(t, idempotent(WriteStreamPath))
+}
+
+// Tests that a server's circuit opens after enough failures in a row, refuses calls without sending them while open,
+// and closes again once a call after the cooldown succeeds.
+func TestCircuitBreaker(t *testing.T) {
+	flaky := &flakyTransport{failures: 2}
+	transport := newRetryTestTransport(flaky, BreakerPolicy{Failures: 2, Cooldown: 50 * time.Millisecond})
+	call := func() error {
+		request, err := http.NewRequest(http.MethodPost, "http://fe-address/twirp/zircon.rpc.twirp.Frontend/New", http.NoBody)
+		require.NoError(t, err)
+		_, err = transport.RoundTrip(request)
+		return err
+	}
+
+	assert.Error(t, call())
+	assert.Error(t, call())
+	err := call()
+	assert.True(t, errors.Is(err, apis.ErrUnreachable))
+	assert.Equal(t, 2, flaky.calls)
+
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, call())
+	assert.NoError(t, call())
+	assert.Equal(t, 4, flaky.calls)
+}
+
+// Tests that a failed call after the cooldown opens the circuit again straight away.
+func TestCircuitBreakerReopens(t *testing.T) {
+	breakers := newCircuitBreakers(BreakerPolicy{Failures: 3, Cooldown: 50 * time.Millisecond})
+	unreachable := errors.New("connection refused")
+	for i := 0; i < 3; i++ {
+		require.NoError(t, breakers.allow("cs-address"))
+		breakers.record("cs-address", unreachable, true)
+	}
+	assert.Error(t, breakers.allow("cs-address"))
+
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, breakers.allow("cs-address"))
+	// only one call is let through to try the server
+	assert.Error(t, breakers.allow("cs-address"))
+	breakers.record("cs-address", unreachable, true)
+	assert.Error(t, breakers.allow("cs-address"))
+	// other servers are unaffected
+	assert.NoError(t, breakers.allow("fe-address"))
+}
@@ -0,0 +1,278 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"zircon/apis"
+)
+
+// Chunk data of at least StreamThreshold bytes is sent between a client and a chunkserver as the raw body of a plain
+// HTTP request or response, rather than inside a twirp message. Building and parsing a protobuf message holding the
+// whole payload would need extra copies of it on both ends; instead, the data is written straight out of the sender's
+// buffer and read straight into a single buffer on the receiving end, a piece at a time, so that memory use stays at
+// one copy of the payload on each side. Reads and StartWrites of less data than this still use twirp.
+const StreamThreshold = 64 * 1024
+
+// The paths that every published chunkserver serves streamed reads and writes on, alongside its twirp handler.
+const ReadStreamPath = "/stream/read"
+const WriteStreamPath = "/stream/write"
+
+// The headers that carry the results that accompany streamed data. The error message itself is the body of the
+// response, since it isn't limited to what can go in a header.
+const versionHeader = "Zircon-Version"
+const errorCodeHeader = "Zircon-Error-Code"
+
+// The header that carries the checksum of the streamed data, on both reads and writes, as twirp messages do for the
+// data they hold.
+const checksumHeader = "Zircon-Checksum"
+
+// The longest error message that is read back from a failed streamed request.
+const maxStreamErrorSize = 64 * 1024
+
+// Serves streamed reads and writes for 'server' to the callers that 'guard' lets make them, and passes every other
+// request on to 'handler'.
+func withStreams(handler http.Handler, server apis.Chunkserver, guard guard) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.HandleFunc(ReadStreamPath, func(writer http.ResponseWriter, request *http.Request) {
+		serveReadStream(server, guard, writer, request)
+	})
+	mux.HandleFunc(WriteStreamPath, func(writer http.ResponseWriter, request *http.Request) {
+		serveWriteStream(server, guard, writer, request)
+	})
+	return mux
+}
+
+// Parses the named parameters of a streamed request, which are all unsigned integers.
+func streamParams(request *http.Request, names ...string) ([]uint64, error) {
+	query := request.URL.Query()
+	values := make([]uint64, len(names))
+	for i, name := range names {
+		value, err := strconv.ParseUint(query.Get(name), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter %s: %v", name, err)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func serveReadStream(server apis.Chunkserver, guard guard, writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "streamed reads must use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	params, err := streamParams(request, "chunk", "offset", "length", "version")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := guard.checkDirect(request.Context(), apis.ChunkNum(params[0])); err != nil {
+		writeStreamError(writer, err)
+		return
+	}
+	data, version, err := server.Read(apis.ChunkNum(params[0]), uint32(params[1]), uint32(params[2]), apis.Version(params[3]))
+	// as with twirp, a stale version is carried by the version of the result
+	writer.Header().Set(versionHeader, strconv.FormatUint(uint64(version), 10))
+	if err != nil {
+		writeStreamError(writer, err)
+		return
+	}
+	writer.Header().Set(checksumHeader, formatChecksum(data))
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	_, _ = writer.Write(data)
+}
+
+func serveWriteStream(server apis.Chunkserver, guard guard, writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "streamed writes must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	params, err := streamParams(request, "chunk", "offset")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// refused before the data is read in, so that callers who may not write can't make the chunkserver hold any of it
+	if err := guard.checkDirect(request.Context(), apis.ChunkNum(params[0])); err != nil {
+		writeStreamError(writer, err)
+		return
+	}
+	data, err := readStreamBody(request.Body, request.ContentLength, apis.MaxChunkSize)
+	if err == nil {
+		err = checkStreamed(data, request.Header)
+	}
+	if err != nil {
+		writeStreamError(writer, err)
+		return
+	}
+	err = server.StartWrite(apis.ChunkNum(params[0]), uint32(params[1]), data)
+	if err != nil {
+		_, version, _ := errorFields(err)
+		writer.Header().Set(versionHeader, strconv.FormatUint(uint64(version), 10))
+		writeStreamError(writer, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// Reads the whole of a streamed body into a single buffer of at most 'limit' bytes. When the length is known in advance,
+// the buffer is allocated at that size right away rather than grown as the data arrives.
+func readStreamBody(body io.Reader, length int64, limit int64) ([]byte, error) {
+	if length > limit {
+		return nil, fmt.Errorf("streamed body of %d bytes exceeds %d bytes: %w", length, limit, apis.ErrChunkTooLarge)
+	}
+	if length >= 0 {
+		data := make([]byte, length)
+		if _, err := io.ReadFull(body, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("streamed body exceeds %d bytes: %w", limit, apis.ErrChunkTooLarge)
+	}
+	return data, nil
+}
+
+func formatChecksum(data []byte) string {
+	return strconv.FormatUint(uint64(apis.CalculateChecksum(data)), 10)
+}
+
+// Checks that streamed data matches the checksum in the headers it came with.
+func checkStreamed(data []byte, header http.Header) error {
+	checksum, err := strconv.ParseUint(header.Get(checksumHeader), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid %s header in streamed data: %v", checksumHeader, err)
+	}
+	return checkReceived(data, uint32(checksum))
+}
+
+func writeStreamError(writer http.ResponseWriter, err error) {
+	code, version, _ := errorFields(err)
+	writer.Header().Set(errorCodeHeader, strconv.FormatUint(uint64(code), 10))
+	// calls refused before they were handled carry what else their error needs, such as how long to wait before
+	// retrying, in the same header that handled calls carry their version in
+	if writer.Header().Get(versionHeader) == "" {
+		writer.Header().Set(versionHeader, strconv.FormatUint(uint64(version), 10))
+	}
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writer.WriteHeader(http.StatusInternalServerError)
+	_, _ = io.WriteString(writer, err.Error())
+}
+
+// Makes streamed reads and writes to a single chunkserver.
+type streamClient struct {
+	address apis.ServerAddress
+	client  *http.Client
+}
+
+func (s streamClient) url(path string, params url.Values) string {
+	return serverURL(s.address, s.client) + path + "?" + params.Encode()
+}
+
+func (s streamClient) read(ctx context.Context, chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, error) {
+	params := url.Values{}
+	params.Set("chunk", strconv.FormatUint(uint64(chunk), 10))
+	params.Set("offset", strconv.FormatUint(uint64(offset), 10))
+	params.Set("length", strconv.FormatUint(uint64(length), 10))
+	params.Set("version", strconv.FormatUint(uint64(minimum), 10))
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url(ReadStreamPath, params), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	response, err := budgetClient{s.client}.Do(request)
+	if err != nil {
+		return nil, 0, streamCallError(ctx, err)
+	}
+	defer response.Body.Close()
+	version, verr := strconv.ParseUint(response.Header.Get(versionHeader), 10, 64)
+	if response.StatusCode != http.StatusOK {
+		return nil, apis.Version(version), streamResponseError(response, apis.Version(version))
+	}
+	if verr != nil {
+		return nil, 0, fmt.Errorf("invalid %s header in streamed read: %v", versionHeader, verr)
+	}
+	data, err := readStreamBody(response.Body, response.ContentLength, int64(length))
+	if err != nil {
+		return nil, 0, contextError(ctx, err)
+	}
+	if err := checkStreamed(data, response.Header); err != nil {
+		return nil, 0, err
+	}
+	return data, apis.Version(version), nil
+}
+
+func (s streamClient) startWrite(ctx context.Context, chunk apis.ChunkNum, offset uint32, data []byte) error {
+	params := url.Values{}
+	params.Set("chunk", strconv.FormatUint(uint64(chunk), 10))
+	params.Set("offset", strconv.FormatUint(uint64(offset), 10))
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url(WriteStreamPath, params), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set(checksumHeader, formatChecksum(data))
+	response, err := budgetClient{s.client}.Do(request)
+	if err != nil {
+		return streamCallError(ctx, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		version, _ := strconv.ParseUint(response.Header.Get(versionHeader), 10, 64)
+		return streamResponseError(response, apis.Version(version))
+	}
+	return nil
+}
+
+// Reconstructs the error that a chunkserver responded to a streamed request with.
+func streamResponseError(response *http.Response, version apis.Version) error {
+	message, err := ioutil.ReadAll(io.LimitReader(response.Body, maxStreamErrorSize))
+	if err != nil {
+		return fmt.Errorf("streamed request failed with status %d, and could not read why: %v", response.StatusCode, err)
+	}
+	return streamErrorFromBody(response.StatusCode, response.Header, message, version)
+}
+
+// Like streamResponseError, once the body of the response has been read.
+func streamErrorFromBody(status int, header http.Header, message []byte, version apis.Version) error {
+	text := strings.TrimSpace(string(message))
+	if text == "" {
+		text = fmt.Sprintf("streamed request failed with status %d", status)
+	}
+	code, err := strconv.ParseUint(header.Get(errorCodeHeader), 10, 32)
+	if err != nil {
+		// rejected before reaching the chunkserver, such as for a bad parameter
+		return errors.New(text)
+	}
+	return errorFromFields(text, uint32(code), version, "")
+}
+
+// Like callError, for streamed requests that never got a response.
+func streamCallError(ctx context.Context, err error) error {
+	err = contextError(ctx, err)
+	if ctx.Err() != nil {
+		return err
+	}
+	if strings.Contains(err.Error(), budgetExhausted) {
+		return remoteError{message: err.Error(), cause: context.DeadlineExceeded}
+	}
+	if strings.Contains(err.Error(), errorCodeTag) {
+		// refused by the connection cache, which coded why
+		return decodeError(err)
+	}
+	return remoteError{message: err.Error(), cause: apis.ErrUnreachable}
+}
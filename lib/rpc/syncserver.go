@@ -2,6 +2,7 @@ package rpc
 
 import (
 	"context"
+	"crypto/tls"
 	"net/http"
 	"zircon/apis"
 	"zircon/rpc/twirp"
@@ -9,16 +10,52 @@ import (
 
 // Connects to an RPC handler for a SyncServer on a certain address.
 func UncachedSubscribeSyncServer(address apis.ServerAddress, client *http.Client) (apis.SyncServer, error) {
-	saddr := "http://" + string(address)
-	tserve := twirp.NewSyncServerProtobufClient(saddr, client)
+	saddr := serverURL(address, client)
+	tserve := twirp.NewSyncServerProtobufClient(saddr, budgetClient{client})
 
-	return &proxyTwirpAsSyncServer{server: tserve}, nil
+	return &proxyTwirpAsSyncServer{server: tserve, ctx: context.Background()}, nil
 }
 
-// Starts serving an RPC handler for a SyncServer on a certain address. Runs forever.
+// Implemented by SyncServers that make RPCs of their own, or that wait on something, such as for a release in
+// AwaitRelease, so that they can be bound to a caller's context too.
+type ContextualSyncServer interface {
+	apis.SyncServer
+	WithContext(ctx context.Context) apis.SyncServer
+}
+
+// Rebinds a SyncServer obtained from this package so that its RPCs carry ctx, allowing callers to impose deadlines and
+// cancellation on the underlying transport. A ContextualSyncServer is rebound through WithContext. Other
+// implementations are returned unchanged.
+func SyncServerWithContext(ctx context.Context, server apis.SyncServer) apis.SyncServer {
+	if proxy, ok := server.(*proxyTwirpAsSyncServer); ok {
+		return &proxyTwirpAsSyncServer{server: proxy.server, ctx: ctx}
+	}
+	if contextual, ok := server.(ContextualSyncServer); ok {
+		return contextual.WithContext(ctx)
+	}
+	return server
+}
+
+// Starts serving an RPC handler for a SyncServer on a certain address, along with the endpoints at LivenessPath,
+// ReadinessPath and MetricsPath. Runs forever.
 func PublishSyncServer(server apis.SyncServer, address apis.ServerAddress) (func(kill bool) error, apis.ServerAddress, error) {
+	return PublishSyncServerWithTLS(server, address, nil)
+}
+
+// Like PublishSyncServer, but serves over TLS with 'config', unless it is nil. See TLSConfiguration.
+func PublishSyncServerWithTLS(server apis.SyncServer, address apis.ServerAddress, config *tls.Config) (func(kill bool) error, apis.ServerAddress, error) {
+	return PublishSyncServerWithOptions(server, address, ServerOptions{TLS: config})
+}
+
+// Like PublishSyncServerWithTLS, but takes all of the options at once, including those that can't be chosen any
+// other way.
+func PublishSyncServerWithOptions(server apis.SyncServer, address apis.ServerAddress, options ServerOptions) (func(kill bool) error, apis.ServerAddress, error) {
+	if options.Transport == GRPCTransport {
+		return publishGRPCSyncServer(server, address, options)
+	}
 	tserve := twirp.NewSyncServerServer(&proxySyncServerAsTwirp{server: server}, nil)
-	return LaunchEmbeddedHTTP(tserve, address)
+	handler := options.wrap(tserve, "syncserver")
+	return LaunchEmbeddedHTTPWithTLS(withMetrics(withHealth(handler, "syncserver", server), "syncserver", server), address, options.TLS)
 }
 
 type proxySyncServerAsTwirp struct {
@@ -26,53 +63,87 @@ type proxySyncServerAsTwirp struct {
 }
 
 func (p *proxySyncServerAsTwirp) StartSync(ctx context.Context, request *twirp.SyncServer_Uint64) (*twirp.SyncServer_Uint64, error) {
-	syncid, err := p.server.StartSync(apis.ChunkNum(request.Value))
+	syncid, err := SyncServerWithContext(ctx, p.server).StartSync(apis.ChunkNum(request.Value))
 	if err != nil {
-		return nil, err
+		return nil, encodeError(err)
 	}
 	return &twirp.SyncServer_Uint64{Value: uint64(syncid)}, nil
 }
 
 func (p *proxySyncServerAsTwirp) UpgradeSync(ctx context.Context, request *twirp.SyncServer_Uint64) (*twirp.SyncServer_Uint64, error) {
-	syncid, err := p.server.UpgradeSync(apis.SyncID(request.Value))
+	syncid, err := SyncServerWithContext(ctx, p.server).UpgradeSync(apis.SyncID(request.Value))
 	if err != nil {
-		return nil, err
+		return nil, encodeError(err)
 	}
 	return &twirp.SyncServer_Uint64{Value: uint64(syncid)}, nil
 }
 
 func (p *proxySyncServerAsTwirp) ReleaseSync(ctx context.Context, request *twirp.SyncServer_Uint64) (*twirp.SyncServer_Nothing, error) {
-	err := p.server.ReleaseSync(apis.SyncID(request.Value))
+	err := SyncServerWithContext(ctx, p.server).ReleaseSync(apis.SyncID(request.Value))
 	if err != nil {
-		return nil, err
+		return nil, encodeError(err)
 	}
 	return &twirp.SyncServer_Nothing{}, nil
 }
 
 func (p *proxySyncServerAsTwirp) ConfirmSync(ctx context.Context, request *twirp.SyncServer_Uint64) (*twirp.SyncServer_Bool, error) {
-	write, err := p.server.ConfirmSync(apis.SyncID(request.Value))
+	write, err := SyncServerWithContext(ctx, p.server).ConfirmSync(apis.SyncID(request.Value))
 	if err != nil {
-		return nil, err
+		return nil, encodeError(err)
 	}
 	return &twirp.SyncServer_Bool{Value: write}, nil
 }
 
+func (p *proxySyncServerAsTwirp) AwaitRelease(ctx context.Context, request *twirp.SyncServer_AwaitRelease) (*twirp.SyncServer_Uint64, error) {
+	revision, err := SyncServerWithContext(ctx, p.server).AwaitRelease(apis.ChunkNum(request.Chunk), apis.SyncRevision(request.Seen))
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &twirp.SyncServer_Uint64{Value: uint64(revision)}, nil
+}
+
+func (p *proxySyncServerAsTwirp) AcquireLock(ctx context.Context, request *twirp.SyncServer_AcquireLock) (*twirp.SyncServer_Uint64, error) {
+	lock, err := SyncServerWithContext(ctx, p.server).AcquireLock(apis.ChunkNum(request.Chunk), request.Exclusive)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &twirp.SyncServer_Uint64{Value: uint64(lock)}, nil
+}
+
+func (p *proxySyncServerAsTwirp) RenewLock(ctx context.Context, request *twirp.SyncServer_Uint64) (*twirp.SyncServer_Nothing, error) {
+	err := SyncServerWithContext(ctx, p.server).RenewLock(apis.LockID(request.Value))
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &twirp.SyncServer_Nothing{}, nil
+}
+
+func (p *proxySyncServerAsTwirp) ReleaseLock(ctx context.Context, request *twirp.SyncServer_Uint64) (*twirp.SyncServer_Nothing, error) {
+	err := SyncServerWithContext(ctx, p.server).ReleaseLock(apis.LockID(request.Value))
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &twirp.SyncServer_Nothing{}, nil
+}
+
 func (p *proxySyncServerAsTwirp) GetFSRoot(ctx context.Context, request *twirp.SyncServer_Nothing) (*twirp.SyncServer_Uint64, error) {
-	chunk, err := p.server.GetFSRoot()
+	chunk, err := SyncServerWithContext(ctx, p.server).GetFSRoot()
 	if err != nil {
-		return nil, err
+		return nil, encodeError(err)
 	}
 	return &twirp.SyncServer_Uint64{Value: uint64(chunk)}, nil
 }
 
 type proxyTwirpAsSyncServer struct {
 	server twirp.SyncServer
+	ctx    context.Context
 }
 
 func (p *proxyTwirpAsSyncServer) StartSync(chunk apis.ChunkNum) (apis.SyncID, error) {
-	result, err := p.server.StartSync(context.Background(), &twirp.SyncServer_Uint64{
+	result, err := p.server.StartSync(p.ctx, &twirp.SyncServer_Uint64{
 		Value: uint64(chunk),
 	})
+	err = callError(p.ctx, err)
 	if err != nil {
 		return 0, err
 	}
@@ -80,9 +151,10 @@ func (p *proxyTwirpAsSyncServer) StartSync(chunk apis.ChunkNum) (apis.SyncID, er
 }
 
 func (p *proxyTwirpAsSyncServer) UpgradeSync(s apis.SyncID) (apis.SyncID, error) {
-	result, err := p.server.UpgradeSync(context.Background(), &twirp.SyncServer_Uint64{
+	result, err := p.server.UpgradeSync(p.ctx, &twirp.SyncServer_Uint64{
 		Value: uint64(s),
 	})
+	err = callError(p.ctx, err)
 	if err != nil {
 		return 0, err
 	}
@@ -90,24 +162,64 @@ func (p *proxyTwirpAsSyncServer) UpgradeSync(s apis.SyncID) (apis.SyncID, error)
 }
 
 func (p *proxyTwirpAsSyncServer) ReleaseSync(s apis.SyncID) error {
-	_, err := p.server.ReleaseSync(context.Background(), &twirp.SyncServer_Uint64{
+	_, err := p.server.ReleaseSync(p.ctx, &twirp.SyncServer_Uint64{
 		Value: uint64(s),
 	})
-	return err
+	return callError(p.ctx, err)
 }
 
 func (p *proxyTwirpAsSyncServer) ConfirmSync(s apis.SyncID) (write bool, err error) {
-	result, err := p.server.ConfirmSync(context.Background(), &twirp.SyncServer_Uint64{
+	result, err := p.server.ConfirmSync(p.ctx, &twirp.SyncServer_Uint64{
 		Value: uint64(s),
 	})
+	err = callError(p.ctx, err)
 	if err != nil {
 		return false, err
 	}
 	return result.Value, nil
 }
 
+func (p *proxyTwirpAsSyncServer) AwaitRelease(chunk apis.ChunkNum, seen apis.SyncRevision) (apis.SyncRevision, error) {
+	result, err := p.server.AwaitRelease(p.ctx, &twirp.SyncServer_AwaitRelease{
+		Chunk: uint64(chunk),
+		Seen:  uint64(seen),
+	})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return 0, err
+	}
+	return apis.SyncRevision(result.Value), nil
+}
+
+func (p *proxyTwirpAsSyncServer) AcquireLock(chunk apis.ChunkNum, exclusive bool) (apis.LockID, error) {
+	result, err := p.server.AcquireLock(p.ctx, &twirp.SyncServer_AcquireLock{
+		Chunk:     uint64(chunk),
+		Exclusive: exclusive,
+	})
+	err = callError(p.ctx, err)
+	if err != nil {
+		return 0, err
+	}
+	return apis.LockID(result.Value), nil
+}
+
+func (p *proxyTwirpAsSyncServer) RenewLock(lock apis.LockID) error {
+	_, err := p.server.RenewLock(p.ctx, &twirp.SyncServer_Uint64{
+		Value: uint64(lock),
+	})
+	return callError(p.ctx, err)
+}
+
+func (p *proxyTwirpAsSyncServer) ReleaseLock(lock apis.LockID) error {
+	_, err := p.server.ReleaseLock(p.ctx, &twirp.SyncServer_Uint64{
+		Value: uint64(lock),
+	})
+	return callError(p.ctx, err)
+}
+
 func (p *proxyTwirpAsSyncServer) GetFSRoot() (apis.ChunkNum, error) {
-	result, err := p.server.GetFSRoot(context.Background(), &twirp.SyncServer_Nothing{})
+	result, err := p.server.GetFSRoot(p.ctx, &twirp.SyncServer_Nothing{})
+	err = callError(p.ctx, err)
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,63 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+	"zircon/apis"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A SyncServer whose AwaitRelease waits until the context it is bound to ends.
+type awaitingSyncServer struct {
+	apis.SyncServer
+	ctx context.Context
+	// closed once a call has seen its context end
+	canceled chan struct{}
+}
+
+func (s *awaitingSyncServer) WithContext(ctx context.Context) apis.SyncServer {
+	return &awaitingSyncServer{SyncServer: s.SyncServer, ctx: ctx, canceled: s.canceled}
+}
+
+func (s *awaitingSyncServer) AwaitRelease(chunk apis.ChunkNum, seen apis.SyncRevision) (apis.SyncRevision, error) {
+	select {
+	case <-s.ctx.Done():
+		close(s.canceled)
+		return 0, s.ctx.Err()
+	case <-time.After(5 * time.Second):
+		return seen + 1, nil
+	}
+}
+
+// Tests that cancelling a call cancels it on the client, and that the cancellation reaches the server handling it.
+func TestSyncServer_Cancel(t *testing.T) {
+	for _, transport := range []Transport{TwirpTransport, GRPCTransport} {
+		t.Run(string(transport), func(t *testing.T) {
+			awaiting := &awaitingSyncServer{ctx: context.Background(), canceled: make(chan struct{})}
+			teardown, address, err := PublishSyncServerWithOptions(awaiting, "127.0.0.1:0", ServerOptions{Transport: transport})
+			require.NoError(t, err)
+			defer teardown(true)
+			cache := NewConnectionCacheWithOptions(ConnectionOptions{Transport: transport})
+			defer cache.CloseAll()
+			server, err := cache.SubscribeSyncServer(address)
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				cancel()
+			}()
+			_, err = SyncServerWithContext(ctx, server).AwaitRelease(80, 3)
+			assert.Equal(t, context.Canceled, err)
+
+			select {
+			case <-awaiting.canceled:
+			case <-time.After(time.Second):
+				t.Error("the server never saw the call cancelled")
+			}
+		})
+	}
+}
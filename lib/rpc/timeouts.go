@@ -0,0 +1,141 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long the calls made through a ConnectionCache are allowed to take. A zero field takes its value from
+// DefaultTimeouts.
+type Timeouts struct {
+	// How long to wait for a connection to a server to be opened, including the TLS handshake.
+	Connect time.Duration `yaml:"connect"`
+	// How long a call waits for the server to start responding after sending its request, which catches servers that
+	// accept connections but then hang. Negative means there is no limit besides Total.
+	Call time.Duration `yaml:"call"`
+	// The longest that a call can take from start to finish, including the transfer of any chunk data in either
+	// direction.
+	Total time.Duration `yaml:"total"`
+}
+
+// Explanation of timeouts:
+//     A call's deadline is the earlier of its caller's deadline and Total from when it starts, and is passed along to
+//     the server with the budget header, so the calls that the server makes on its behalf are bounded by it too. Call
+//     is enforced on the client alone. A call that runs out of either fails with an error matching
+//     context.DeadlineExceeded, the same as one that ran out of its caller's budget, rather than apis.ErrUnreachable,
+//     since the server could be reached.
+
+// The timeouts of connection caches created without any given.
+var DefaultTimeouts = Timeouts{
+	Connect: 5 * time.Second,
+	// no separate limit, since some calls, such as SyncServer.AwaitRelease, legitimately wait a long time for a
+	// response
+	Call:  -1,
+	Total: 30 * time.Second,
+}
+
+// Fills in the fields left as zero from DefaultTimeouts.
+func (t Timeouts) withDefaults() Timeouts {
+	if t.Connect == 0 {
+		t.Connect = DefaultTimeouts.Connect
+	}
+	if t.Call == 0 {
+		t.Call = DefaultTimeouts.Call
+	}
+	if t.Total == 0 {
+		t.Total = DefaultTimeouts.Total
+	}
+	return t
+}
+
+// Bounds the context of a call by 'total' from when it starts. Returns the context and the function that releases it.
+func (t Timeouts) bound(ctx context.Context) (context.Context, context.CancelFunc) {
+	if t.Total <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, t.Total)
+}
+
+// Applies Timeouts.Call and Timeouts.Total to each request sent through a ConnectionCache.
+type deadlineTransport struct {
+	transport http.RoundTripper
+	timeouts  Timeouts
+}
+
+func (d deadlineTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	parent := request.Context()
+	ctx, cancel := d.timeouts.bound(parent)
+	// the request is the caller's, so it is only changed through a copy
+	request = request.Clone(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		request.Header.Set(budgetHeader, strconv.FormatInt(int64(time.Until(deadline)), 10))
+	}
+
+	var mu sync.Mutex
+	waiting, timedOut := true, false
+	if d.timeouts.Call > 0 {
+		timer := time.AfterFunc(d.timeouts.Call, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if waiting {
+				timedOut = true
+				cancel()
+			}
+		})
+		defer timer.Stop()
+	}
+	response, err := d.transport.RoundTrip(request)
+	mu.Lock()
+	waiting = false
+	called := timedOut
+	mu.Unlock()
+
+	if called {
+		if err == nil {
+			_ = response.Body.Close()
+		}
+		return nil, fmt.Errorf("%s: no response within %v: %w", budgetExhausted, d.timeouts.Call, context.DeadlineExceeded)
+	}
+	if err != nil {
+		cancel()
+		return nil, d.timeoutError(ctx, parent, err)
+	}
+	// the deadline applies until the response has been read
+	response.Body = &deadlineBody{ReadCloser: response.Body, transport: d, ctx: ctx, parent: parent, cancel: cancel}
+	return response, nil
+}
+
+// Replaces an error caused by running out of Total with one that says so, and otherwise leaves it alone.
+func (d deadlineTransport) timeoutError(ctx context.Context, parent context.Context, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+		return fmt.Errorf("%s: call did not finish within %v: %w", budgetExhausted, d.timeouts.Total, context.DeadlineExceeded)
+	}
+	return err
+}
+
+type deadlineBody struct {
+	io.ReadCloser
+	transport deadlineTransport
+	ctx       context.Context
+	parent    context.Context
+	cancel    context.CancelFunc
+}
+
+func (d *deadlineBody) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	if err != io.EOF {
+		err = d.transport.timeoutError(d.ctx, d.parent, err)
+	}
+	return n, err
+}
+
+func (d *deadlineBody) Close() error {
+	err := d.ReadCloser.Close()
+	d.cancel()
+	return err
+}
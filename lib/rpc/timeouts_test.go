@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tests that a server that never responds is given up on after Timeouts.Call, and one that stops partway through its
+// response after Timeouts.Total, both with errors that match context.DeadlineExceeded.
+func TestTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/partial" {
+			_, _ = writer.Write([]byte("the start of a response"))
+			writer.(http.Flusher).Flush()
+		}
+		select {
+		case <-release:
+		case <-request.Context().Done():
+		}
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: deadlineTransport{
+		transport: &http.Transport{},
+		timeouts:  Timeouts{Call: 100 * time.Millisecond, Total: 300 * time.Millisecond},
+	}}
+
+	start := time.Now()
+	_, err := client.Get(server.URL + "/hang")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < 250*time.Millisecond)
+
+	start = time.Now()
+	response, err := client.Get(server.URL + "/partial")
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(response.Body)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.NoError(t, response.Body.Close())
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 300*time.Millisecond && elapsed < time.Second)
+}
+
+// Tests that a call's deadline is the earlier of its caller's and Timeouts.Total, and that the server is given it.
+func TestTimeoutsPropagate(t *testing.T) {
+	remaining := make(chan time.Duration, 1)
+	server := httptest.NewServer(withBudget(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		deadline, ok := request.Context().Deadline()
+		require.True(t, ok)
+		remaining <- time.Until(deadline)
+	})))
+	defer server.Close()
+	client := &http.Client{Transport: deadlineTransport{
+		transport: &http.Transport{},
+		timeouts:  Timeouts{Total: time.Minute},
+	}}
+
+	call := func(ctx context.Context) time.Duration {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		require.NoError(t, err)
+		response, err := client.Do(request)
+		require.NoError(t, err)
+		assert.NoError(t, response.Body.Close())
+		return <-remaining
+	}
+
+	left := call(context.Background())
+	assert.True(t, left > 50*time.Second && left <= time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	left = call(ctx)
+	assert.True(t, left > 5*time.Second && left <= 10*time.Second)
+}
+
+// Tests that timeouts left as zero take their defaults.
+func TestTimeoutsDefaults(t *testing.T) {
+	assert.Equal(t, DefaultTimeouts, Timeouts{}.withDefaults())
+	assert.Equal(t, Timeouts{Connect: time.Second, Call: DefaultTimeouts.Call, Total: DefaultTimeouts.Total},
+		Timeouts{Connect: time.Second}.withDefaults())
+}
@@ -0,0 +1,122 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"zircon/apis"
+)
+
+// The TLS section of a server's or client's configuration. When it is left empty, RPCs are sent as plaintext, which is
+// only safe on a trusted network; every server and client in a cluster must agree on whether TLS is used.
+//
+// Servers present CertFile to the clients that connect to them, and clients that have a CertFile present it in turn,
+// which is what lets servers with VerifyClients set reject anyone outside the cluster. Certificates on either end are
+// checked against CAFile alone, rather than the system's trusted roots, so that only certificates issued for the
+// cluster are accepted. Since servers are addressed by IP, their certificates need IP address SANs.
+type TLSConfiguration struct {
+	// PEM files holding this process's certificate and its private key
+	CertFile string `yaml:"cert-file"`
+	KeyFile  string `yaml:"key-file"`
+	// a PEM file of the CA certificates that peers' certificates must be issued by
+	CAFile string `yaml:"ca-file"`
+	// whether a server requires every client to present a certificate issued by one of the CAs; unused by clients
+	VerifyClients bool `yaml:"verify-clients"`
+}
+
+// Whether any TLS settings were provided at all.
+func (c TLSConfiguration) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.CAFile != "" || c.VerifyClients
+}
+
+func (c TLSConfiguration) loadCAs() (*x509.CertPool, error) {
+	if c.CAFile == "" {
+		return nil, errors.New("no CA file specified")
+	}
+	pem, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+	}
+	return pool, nil
+}
+
+// Builds the TLS settings for a server to pass to a Publish...WithTLS function. Returns nil if TLS isn't enabled.
+func (c TLSConfiguration) ServerConfig() (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("[tls.go/LKP] %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.VerifyClients {
+		config.ClientCAs, err = c.loadCAs()
+		if err != nil {
+			return nil, fmt.Errorf("[tls.go/LCA] %w", err)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// Builds the TLS settings for a client to pass to NewConnectionCacheWithTLS. Returns nil if TLS isn't enabled.
+func (c TLSConfiguration) ClientConfig() (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	pool, err := c.loadCAs()
+	if err != nil {
+		return nil, fmt.Errorf("[tls.go/LCA] %w", err)
+	}
+	config := &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("[tls.go/LKP] %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// The base URL of a server: https if 'client' was set up with TLS, as by NewConnectionCacheWithTLS, and plain http
+// otherwise.
+func serverURL(address apis.ServerAddress, client *http.Client) string {
+	if client != nil && usesTLS(client.Transport) {
+		return "https://" + string(address)
+	}
+	return "http://" + string(address)
+}
+
+// Whether a transport, or the one it wraps, was set up with TLS.
+func usesTLS(transport http.RoundTripper) bool {
+	switch transport := transport.(type) {
+	case interceptingTransport:
+		return usesTLS(transport.transport)
+	case deadlineTransport:
+		return usesTLS(transport.transport)
+	case *retryTransport:
+		return usesTLS(transport.transport)
+	case *compressingTransport:
+		return usesTLS(transport.transport)
+	case *trackingTransport:
+		return transport.transport.TLSClientConfig != nil
+	case *http.Transport:
+		return transport.TLSClientConfig != nil
+	}
+	return false
+}
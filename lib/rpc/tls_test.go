@@ -0,0 +1,276 @@
+package rpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/apis/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A certificate authority that issues certificates for a test, writing each one out as a pair of PEM files.
+type testCA struct {
+	t           *testing.T
+	dir         string
+	name        string
+	key         *ecdsa.PrivateKey
+	certificate *x509.Certificate
+	serial      int64
+}
+
+func newTestCA(t *testing.T, dir string, name string) *testCA {
+	ca := &testCA{t: t, dir: dir, name: name, serial: 1}
+	var err error
+	ca.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(ca.serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &ca.key.PublicKey, ca.key)
+	require.NoError(t, err)
+	ca.certificate, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	ca.write(name+"-ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) write(filename string, kind string, der []byte) string {
+	path := filepath.Join(ca.dir, filename)
+	require.NoError(ca.t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600))
+	return path
+}
+
+func (ca *testCA) caFile() string {
+	return filepath.Join(ca.dir, ca.name+"-ca.pem")
+}
+
+// Issues a certificate for 127.0.0.1 that can be used by either a server or a client, and returns its configuration.
+func (ca *testCA) issue(name string) TLSConfiguration {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(ca.t, err)
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	require.NoError(ca.t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(ca.t, err)
+	return TLSConfiguration{
+		CertFile: ca.write(name+".pem", "CERTIFICATE", der),
+		KeyFile:  ca.write(name+"-key.pem", "EC PRIVATE KEY", keyDER),
+		CAFile:   ca.caFile(),
+	}
+}
+
+// Tests that with mutual TLS, a server only answers clients with a certificate from the cluster's CA, and that clients
+// only trust servers with a certificate from that same CA.
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, dir, "cluster")
+	other := newTestCA(t, dir, "other")
+
+	serverConfig := ca.issue("server")
+	serverConfig.VerifyClients = true
+	serverTLS, err := serverConfig.ServerConfig()
+	require.NoError(t, err)
+	mocked := new(mocks.Frontend)
+	mocked.On("New").Return(apis.ChunkNum(73), nil)
+	teardown, address, err := PublishFrontendWithTLS(mocked, "127.0.0.1:0", serverTLS)
+	require.NoError(t, err)
+	defer teardown(true)
+
+	newChunk := func(config TLSConfiguration) (apis.ChunkNum, error) {
+		clientTLS, err := config.ClientConfig()
+		require.NoError(t, err)
+		cache := NewConnectionCacheWithTLS(InFlightLimit{}, clientTLS)
+		defer cache.CloseAll()
+		frontend, err := cache.SubscribeFrontend(address)
+		require.NoError(t, err)
+		return frontend.New()
+	}
+
+	chunk, err := newChunk(ca.issue("client"))
+	assert.NoError(t, err)
+	assert.Equal(t, apis.ChunkNum(73), chunk)
+
+	// a client that trusts the cluster's CA, but has no certificate of its own
+	_, err = newChunk(TLSConfiguration{CAFile: ca.caFile()})
+	assert.Error(t, err)
+	// a client with a certificate from another CA, which also doesn't trust the server's certificate
+	_, err = newChunk(other.issue("stranger"))
+	assert.Error(t, err)
+	// a client that doesn't use TLS at all
+	cache := NewConnectionCache()
+	defer cache.CloseAll()
+	frontend, err := cache.SubscribeFrontend(address)
+	require.NoError(t, err)
+	_, err = frontend.New()
+	assert.Error(t, err)
+
+	mocked.AssertNumberOfCalls(t, "New", 1)
+}
+
+// A frontend that records the caller of every request it handles, as seen through WithContext.
+type callerFrontend struct {
+	*mocks.Frontend
+	callers chan apis.Principal
+}
+
+func (c callerFrontend) WithContext(ctx context.Context) apis.Frontend {
+	principal, ok := CallerPrincipal(ctx)
+	if !ok {
+		// not a request made through RPC, which can't happen here
+		principal = apis.PrincipalNamed("in-process")
+	}
+	c.callers <- principal
+	return c.Frontend
+}
+
+// Tests that a server sees the principal of a client's verified certificate as the caller of its requests, and that
+// clients whose certificates weren't verified are anonymous.
+func TestCallerPrincipal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, dir, "cluster")
+
+	_, ok := CallerPrincipal(context.Background())
+	assert.False(t, ok)
+
+	for _, verify := range []bool{true, false} {
+		serverConfig := ca.issue("server")
+		serverConfig.VerifyClients = verify
+		serverTLS, err := serverConfig.ServerConfig()
+		require.NoError(t, err)
+		mocked := callerFrontend{Frontend: new(mocks.Frontend), callers: make(chan apis.Principal, 1)}
+		mocked.On("New").Return(apis.ChunkNum(73), nil)
+		teardown, address, err := PublishFrontendWithTLS(mocked, "127.0.0.1:0", serverTLS)
+		require.NoError(t, err)
+
+		clientTLS, err := ca.issue("alice").ClientConfig()
+		require.NoError(t, err)
+		cache := NewConnectionCacheWithTLS(InFlightLimit{}, clientTLS)
+		frontend, err := cache.SubscribeFrontend(address)
+		require.NoError(t, err)
+		_, err = frontend.New()
+		assert.NoError(t, err)
+		if verify {
+			assert.Equal(t, apis.PrincipalNamed("alice"), <-mocked.callers)
+		} else {
+			assert.Equal(t, apis.Anonymous, <-mocked.callers)
+		}
+		cache.CloseAll()
+		teardown(true)
+	}
+}
+
+// Tests that an empty configuration leaves TLS off, and that a client can't be configured without knowing which CA to
+// trust.
+func TestTLSConfiguration(t *testing.T) {
+	server, err := TLSConfiguration{}.ServerConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, server)
+	client, err := TLSConfiguration{}.ClientConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, client)
+
+	_, err = TLSConfiguration{CertFile: "cert.pem", KeyFile: "key.pem"}.ClientConfig()
+	assert.Error(t, err)
+}
+
+// Tests that a chunkserver published with a cluster only takes calls from the cluster's servers, and from other callers
+// only reads of the chunks that a frontend issued them capabilities for.
+func TestChunkserverCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, dir, "cluster")
+	key := []byte("shared by the cluster")
+
+	serverConfig := ca.issue("chunkserver")
+	serverConfig.VerifyClients = true
+	serverTLS, err := serverConfig.ServerConfig()
+	require.NoError(t, err)
+	mocked := new(mocks.Chunkserver)
+	mocked.On("Read", apis.ChunkNum(7), uint32(0), uint32(4), apis.AnyVersion).Return([]byte("data"), apis.Version(3), nil)
+	mocked.On("Delete", apis.ChunkNum(7), apis.Version(3)).Return(nil)
+	teardown, address, err := PublishChunkserverWithOptions(mocked, "127.0.0.1:0", ServerOptions{
+		TLS:           serverTLS,
+		Cluster:       []apis.Principal{apis.PrincipalNamed("frontend")},
+		CapabilityKey: key,
+	})
+	require.NoError(t, err)
+	defer teardown(true)
+
+	subscribe := func(name string) apis.Chunkserver {
+		clientTLS, err := ca.issue(name).ClientConfig()
+		require.NoError(t, err)
+		cache := NewConnectionCacheWithTLS(InFlightLimit{}, clientTLS)
+		t.Cleanup(cache.CloseAll)
+		server, err := cache.SubscribeChunkserver(address)
+		require.NoError(t, err)
+		return server
+	}
+
+	mallory := subscribe("mallory")
+	_, _, err = mallory.Read(7, 0, 4, apis.AnyVersion)
+	assert.True(t, errors.Is(err, apis.ErrPermissionDenied), "read without a capability: %v", err)
+	err = mallory.Delete(7, 3)
+	assert.True(t, errors.Is(err, apis.ErrPermissionDenied), "delete: %v", err)
+
+	// a capability issued to mallory only lets them read the chunk it was issued for, and nothing else
+	ctx := ContextWithCapabilities(context.Background())
+	collectCapability(ctx, 7, issueCapability(key, 7, apis.PrincipalNamed("mallory"), time.Now().Add(CapabilityLifetime)))
+	collectCapability(ctx, 8, issueCapability(key, 7, apis.PrincipalNamed("mallory"), time.Now().Add(CapabilityLifetime)))
+	data, version, err := ChunkserverWithContext(ctx, mallory).Read(7, 0, 4, apis.AnyVersion)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	assert.Equal(t, apis.Version(3), version)
+	_, _, err = ChunkserverWithContext(ctx, mallory).Read(8, 0, 4, apis.AnyVersion)
+	assert.True(t, errors.Is(err, apis.ErrPermissionDenied), "read of another chunk: %v", err)
+	err = ChunkserverWithContext(ctx, mallory).Delete(7, 3)
+	assert.True(t, errors.Is(err, apis.ErrPermissionDenied), "delete with a capability: %v", err)
+
+	// nor can anyone else use it
+	eve := subscribe("eve")
+	_, _, err = ChunkserverWithContext(ctx, eve).Read(7, 0, 4, apis.AnyVersion)
+	assert.True(t, errors.Is(err, apis.ErrPermissionDenied), "read with someone else's capability: %v", err)
+
+	frontend := subscribe("frontend")
+	_, _, err = frontend.Read(7, 0, 4, apis.AnyVersion)
+	assert.NoError(t, err)
+	assert.NoError(t, frontend.Delete(7, 3))
+
+	mocked.AssertNumberOfCalls(t, "Read", 2)
+	mocked.AssertNumberOfCalls(t, "Delete", 1)
+}
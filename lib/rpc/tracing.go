@@ -0,0 +1,110 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Explanation of tracing:
+//     Calls are traced with OpenTelemetry by giving TracingInterceptor to both the ConnectionOptions of clients and the
+//     ServerOptions of servers. Each call made is recorded as a client span, as a child of whatever span is in the
+//     context it was made under, and the trace is passed along with the call in its metadata, in the W3C traceparent
+//     format. The server picks the trace back up and records its side of the call as a server span, and since servers
+//     make their own calls under the context of the call they are handling, the calls they make join the same trace.
+//     So a write traced by the client (see control.ClientOptions.Tracing) shows the lookup, the data being staged on
+//     each replica in turn, and the commit through the frontend, down to its UpdateEntry on the metadata cache.
+//     Spans are sent over OTLP/HTTP to the collector given in TracingConfiguration; see the explanation in otlp.go.
+//     Whether a trace is recorded is decided when it starts, and every call that joins it follows that decision, so
+//     traces are never recorded in part.
+//     As with interceptors in general, a client's span ends once the response starts to arrive, so a streamed read's
+//     span doesn't include the time taken to receive the rest of its data.
+
+// The name of the instrumentation that records spans for calls.
+const tracerName = "zircon/rpc"
+
+// Where the spans recorded by a client or server are sent. The zero value sends them nowhere.
+type TracingConfiguration struct {
+	// The host and port of an OTLP/HTTP collector, such as "localhost:4318". Nothing is traced if this is empty.
+	Endpoint string `yaml:"endpoint"`
+	// Whether the collector is reached over plain HTTP rather than HTTPS.
+	Insecure bool `yaml:"insecure"`
+	// The fraction of traces started here that are recorded, from 0 to 1; zero means all of them. Calls that join a
+	// trace started elsewhere are recorded if it was.
+	SampleRatio float64 `yaml:"sample-ratio"`
+}
+
+// Whether any spans are sent anywhere.
+func (config TracingConfiguration) Enabled() bool {
+	return config.Endpoint != ""
+}
+
+// Sets up the exporting of spans recorded in a process that names itself 'service', such as "zircon-client" or
+// "frontend". If tracing isn't enabled, the provider returned records nothing. The function returned sends any spans
+// not yet sent, and stops sending them.
+func (config TracingConfiguration) TracerProvider(service string) (trace.TracerProvider, func() error, error) {
+	if !config.Enabled() {
+		return noop.NewTracerProvider(), func() error { return nil }, nil
+	}
+	exporter := newOTLPExporter(config.Endpoint, config.Insecure)
+	ratio := config.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service))),
+	)
+	return provider, func() error {
+		return provider.Shutdown(context.Background())
+	}, nil
+}
+
+// Records a span for each call that it sees with a tracer from 'provider', and carries traces from clients to servers;
+// see the explanation above.
+func TracingInterceptor(provider trace.TracerProvider) Interceptor {
+	return tracingInterceptor{tracer: provider.Tracer(tracerName)}
+}
+
+type tracingInterceptor struct {
+	tracer trace.Tracer
+}
+
+// Traces are carried in the W3C format, whose keys are already in lower case, as servers see them.
+var tracePropagator = propagation.TraceContext{}
+
+func (t tracingInterceptor) Before(ctx context.Context, call *Call) (context.Context, error) {
+	kind := trace.SpanKindClient
+	if call.Server {
+		kind = trace.SpanKindServer
+		ctx = tracePropagator.Extract(ctx, propagation.MapCarrier(call.Metadata))
+	}
+	ctx, _ = t.tracer.Start(ctx, callName(*call), trace.WithSpanKind(kind), trace.WithAttributes(
+		semconv.RPCSystemKey.String("zircon"),
+		semconv.RPCService(call.Service),
+		semconv.RPCMethod(call.Method),
+		attribute.String("zircon.peer", call.Peer),
+	))
+	if !call.Server {
+		tracePropagator.Inject(ctx, propagation.MapCarrier(call.Metadata))
+	}
+	return ctx, nil
+}
+
+func (t tracingInterceptor) After(ctx context.Context, call *Call, elapsed time.Duration, err error) {
+	span := trace.SpanFromContext(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
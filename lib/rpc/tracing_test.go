@@ -0,0 +1,172 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/apis/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Finds the span called 'name' among those recorded, waiting for up to a second for it to end, since servers may only
+// finish a call after the client has its response.
+func endedSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		for _, span := range recorder.Ended() {
+			if span.Name() == name {
+				return span
+			}
+		}
+	}
+	require.Fail(t, "no span called "+name)
+	return nil
+}
+
+// Tests that a call made under a trace is recorded on both ends as part of that trace, over both transports.
+func TestTracingInterceptor(t *testing.T) {
+	for _, transport := range []Transport{TwirpTransport, GRPCTransport} {
+		t.Run(string(transport), func(t *testing.T) {
+			mocked := new(mocks.Frontend)
+			mocked.On("New").Return(apis.ChunkNum(73), nil)
+			mocked.On("Delete", apis.ChunkNum(73), apis.Version(2)).Return(fmt.Errorf("no such chunk: %w", apis.ErrNotFound))
+			serverSpans := tracetest.NewSpanRecorder()
+			teardown, address, err := PublishFrontendWithOptions(mocked, "127.0.0.1:0", ServerOptions{
+				Transport:    transport,
+				Interceptors: []Interceptor{TracingInterceptor(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(serverSpans)))},
+			})
+			require.NoError(t, err)
+			defer teardown(true)
+
+			clientSpans := tracetest.NewSpanRecorder()
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(clientSpans))
+			cache := NewConnectionCacheWithOptions(ConnectionOptions{
+				Transport:    transport,
+				Interceptors: []Interceptor{TracingInterceptor(provider)},
+			})
+			defer cache.CloseAll()
+			frontend, err := cache.SubscribeFrontend(address)
+			require.NoError(t, err)
+
+			ctx, root := provider.Tracer("test").Start(context.Background(), "root")
+			_, err = FrontendWithContext(ctx, frontend).New()
+			require.NoError(t, err)
+			err = FrontendWithContext(ctx, frontend).Delete(73, 2)
+			assert.True(t, errors.Is(err, apis.ErrNotFound))
+			root.End()
+
+			client := endedSpan(t, clientSpans, "Frontend.New")
+			assert.Equal(t, trace.SpanKindClient, client.SpanKind())
+			assert.Equal(t, root.SpanContext().TraceID(), client.SpanContext().TraceID())
+			assert.Equal(t, root.SpanContext().SpanID(), client.Parent().SpanID())
+			server := endedSpan(t, serverSpans, "Frontend.New")
+			assert.Equal(t, trace.SpanKindServer, server.SpanKind())
+			assert.Equal(t, root.SpanContext().TraceID(), server.SpanContext().TraceID())
+			assert.Equal(t, client.SpanContext().SpanID(), server.Parent().SpanID())
+			assert.True(t, server.Parent().IsRemote())
+			assert.Equal(t, codes.Unset, server.Status().Code)
+
+			client = endedSpan(t, clientSpans, "Frontend.Delete")
+			assert.Equal(t, codes.Error, client.Status().Code)
+			assert.Contains(t, client.Status().Description, "no such chunk")
+			server = endedSpan(t, serverSpans, "Frontend.Delete")
+			assert.Equal(t, codes.Error, server.Status().Code)
+			assert.Equal(t, client.SpanContext().SpanID(), server.Parent().SpanID())
+
+			mocked.AssertExpectations(t)
+		})
+	}
+}
+
+// Tests that nothing is set up to be sent anywhere unless an endpoint is given, and that spans are sent to the
+// collector that is.
+func TestTracingConfiguration(t *testing.T) {
+	provider, shutdown, err := TracingConfiguration{}.TracerProvider("test")
+	require.NoError(t, err)
+	_, span := provider.Tracer("test").Start(context.Background(), "unrecorded")
+	assert.False(t, span.IsRecording())
+	span.End()
+	assert.NoError(t, shutdown())
+
+	var mu sync.Mutex
+	var received []otlpRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request otlpRequest
+		if r.URL.Path != otlpTracesPath || r.Header.Get("Content-Type") != "application/json" ||
+			json.NewDecoder(r.Body).Decode(&request) != nil {
+			http.Error(w, "bad export", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, request)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	config := TracingConfiguration{Endpoint: strings.TrimPrefix(collector.URL, "http://"), Insecure: true, SampleRatio: 1}
+	assert.True(t, config.Enabled())
+	provider, shutdown, err = config.TracerProvider("test-service")
+	require.NoError(t, err)
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "parent")
+	_, span = provider.Tracer("test").Start(ctx, "recorded", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("zircon.peer", "10.0.0.7:4410"), attribute.Int("zircon.chunk", 73)))
+	assert.True(t, span.IsRecording())
+	span.SetStatus(codes.Error, "no such chunk")
+	span.End()
+	parent.End()
+	// sends the spans still waiting to be batched
+	assert.NoError(t, shutdown())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received, 1)
+	require.Len(t, received[0].ResourceSpans, 1)
+	resource := received[0].ResourceSpans[0]
+	assert.Contains(t, resource.Resource.Attributes, otlpKeyValue{Key: "service.name", Value: otlpString("test-service")})
+	require.Len(t, resource.ScopeSpans, 1)
+	assert.Equal(t, "test", resource.ScopeSpans[0].Scope.Name)
+	spans := resource.ScopeSpans[0].Spans
+	require.Len(t, spans, 2)
+	recorded, root := spans[0], spans[1]
+	assert.Equal(t, "recorded", recorded.Name)
+	assert.Equal(t, parent.SpanContext().TraceID().String(), recorded.TraceID)
+	assert.Equal(t, parent.SpanContext().SpanID().String(), recorded.ParentSpanID)
+	assert.Equal(t, "", root.ParentSpanID)
+	assert.Equal(t, 3, recorded.Kind)
+	assert.Equal(t, otlpStatus{Code: 2, Message: "no such chunk"}, recorded.Status)
+	assert.Equal(t, []otlpKeyValue{
+		{Key: "zircon.peer", Value: otlpString("10.0.0.7:4410")},
+		{Key: "zircon.chunk", Value: otlpInt(73)},
+	}, recorded.Attributes)
+}
+
+// Tests that spans a collector refuses are reported as failing to be sent.
+func TestOTLPExporter_Refused(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "over quota", http.StatusTooManyRequests)
+	}))
+	defer collector.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	_, span := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test").Start(context.Background(), "refused")
+	span.End()
+	exporter := newOTLPExporter(strings.TrimPrefix(collector.URL, "http://"), true)
+	err := exporter.ExportSpans(context.Background(), recorder.Ended())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "over quota")
+	assert.NoError(t, exporter.ExportSpans(context.Background(), nil))
+}
@@ -0,0 +1,394 @@
+package services
+
+import (
+	"sync"
+	"time"
+	"zircon/apis"
+	"zircon/chunkupdate"
+	"zircon/metadatacache"
+	"zircon/rpc"
+)
+
+// How often anti-entropy goes over every chunk.
+const AntiEntropyFreq = time.Minute
+
+// The least time anti-entropy leaves between two repairs, so that a cluster with many diverged replicas isn't flooded
+// with replication traffic all at once.
+const AntiEntropyRepairGap = 100 * time.Millisecond
+
+// Explanation of the anti-entropy service:
+//     Quorum writes and their catch-up leave replicas behind when they fail partway, and a replica can also lose a chunk
+//     outright. Anti-entropy is the safety net under both. For each metadata block, it asks every replica of the
+//     block's chunks for a digest of its copies (see Chunkserver.DigestChunks), and compares them against the chunks'
+//     metadata entries and against each other:
+//         - a replica that holds MostRecentVersion but doesn't serve it, because it missed UpdateLatestVersion, is
+//           switched over to it with UpdateLatestVersion;
+//         - a replica that doesn't hold MostRecentVersion at all, because it missed CommitWrite, has its copy replaced
+//           by replicating it from one that does;
+//         - a replica that serves MostRecentVersion, but whose checksum differs from the one most replicas agree on, has
+//           its copy replaced in the same way. If no checksum is held by more replicas than any other, there is no
+//           telling which is right, so the chunk is only reported;
+//         - a replica that no longer holds the chunk at all is dropped from the entry.
+//     Like the replicator, it only looks at the metadata blocks that its metadata cache holds the lease on, so the lease
+//     elects exactly one server to look after each chunk.
+func AntiEntropyService(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache) (cancel func() error, err error) {
+	ae := NewAntiEntropy(etcd, localCache, rpcCache, apis.NoopLogger)
+	ae.Start(AntiEntropyFreq)
+	return func() error {
+		ae.Stop()
+		return nil
+	}, nil
+}
+
+// How far replicas have drifted from their metadata entries, totalled over every pass so far.
+type AntiEntropyStats struct {
+	Passes int
+	// Replicas whose versions were compared with their entries.
+	Checked int
+	// Replicas found to be behind MostRecentVersion, and how many of those were brought up to date.
+	Behind   int
+	Repaired int
+	// Replicas found to hold MostRecentVersion without serving it, and replicas found serving it with different data
+	// than most of the others; those that were fixed are counted in Repaired as well.
+	Unpublished int
+	Diverged    int
+	// Replicas found to no longer hold their chunk, which were dropped from its entry.
+	Removed int
+	// Repairs and removals that were attempted but failed; they are tried again on the next pass.
+	Failed int
+}
+
+type AntiEntropy struct {
+	etcd       apis.EtcdInterface
+	localCache apis.MetadataCache
+	rpcCache   rpc.ConnectionCache
+	logger     apis.Logger
+	repairGap  time.Duration
+
+	mu         sync.Mutex
+	stats      AntiEntropyStats
+	lastRepair time.Time
+
+	periodic
+}
+
+// Prepares anti-entropy without starting it, so that passes can be run on demand with Pass, or periodically with Start.
+func NewAntiEntropy(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache, logger apis.Logger) *AntiEntropy {
+	return &AntiEntropy{
+		etcd:       etcd,
+		localCache: localCache,
+		rpcCache:   rpcCache,
+		logger:     logger,
+		repairGap:  AntiEntropyRepairGap,
+	}
+}
+
+// Repairs replicas every 'interval' on a background goroutine, until Stop is called.
+func (ae *AntiEntropy) Start(interval time.Duration) {
+	ae.start(interval, ae.Pass, ae.logger, "Error during anti-entropy pass")
+}
+
+func (ae *AntiEntropy) Stats() AntiEntropyStats {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+	return ae.stats
+}
+
+func (ae *AntiEntropy) count(update func(stats *AntiEntropyStats)) {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+	update(&ae.stats)
+}
+
+// Checks every chunk whose metadata block this server holds the lease on once, and repairs what it can.
+func (ae *AntiEntropy) Pass() error {
+	metachunks, err := ae.etcd.ListAllMetaIDs()
+	if err != nil {
+		return err
+	}
+	before := ae.Stats()
+	for _, metachunk := range metachunks {
+		entries := map[apis.ChunkNum]apis.MetadataEntry{}
+		for i := 0; i < 1<<apis.EntriesPerBlock; i++ {
+			chunk := metadatacache.EntryAndBlockToChunkNum(metachunk, uint32(i))
+			entry, owner, err := ae.localCache.ReadEntry(chunk)
+			if owner != apis.NoRedirect {
+				// another server holds the lease on this block, and takes care of it instead
+				break
+			}
+			if err != nil {
+				continue
+			}
+			entries[chunk] = entry
+		}
+		held := ae.digestReplicas(entries)
+		for chunk, entry := range entries {
+			ae.checkChunk(chunk, entry, held)
+		}
+	}
+	ae.count(func(stats *AntiEntropyStats) {
+		stats.Passes++
+	})
+	after := ae.Stats()
+	ae.logger.Logf(apis.INFO, "Anti-entropy pass checked %d replicas: %d behind (%d repaired), %d removed, %d failed",
+		after.Checked-before.Checked, after.Behind-before.Behind, after.Repaired-before.Repaired,
+		after.Removed-before.Removed, after.Failed-before.Failed)
+	return nil
+}
+
+// Asks each chunkserver that is a replica of any of 'entries' for digests of the chunks it is a replica of, in one
+// request per chunkserver. Chunkservers that can't be reached are left out, so that their replicas are neither repaired
+// nor removed until they can be asked.
+func (ae *AntiEntropy) digestReplicas(entries map[apis.ChunkNum]apis.MetadataEntry) map[apis.ServerID]map[apis.ChunkNum]apis.ChunkDigest {
+	chunksOn := make(map[apis.ServerID][]apis.ChunkNum)
+	for chunk, entry := range entries {
+		for _, id := range entry.Replicas {
+			chunksOn[id] = append(chunksOn[id], chunk)
+		}
+	}
+	held := make(map[apis.ServerID]map[apis.ChunkNum]apis.ChunkDigest)
+	for id, chunks := range chunksOn {
+		cs, err := ae.idToCS(id)
+		if err != nil {
+			ae.logger.Logf(apis.WARN, "Server %d threw error: %v while digesting its chunks", id, err)
+			continue
+		}
+		list, err := cs.DigestChunks(chunks)
+		if err != nil {
+			ae.logger.Logf(apis.WARN, "Server %d threw error: %v while digesting its chunks", id, err)
+			continue
+		}
+		digests := make(map[apis.ChunkNum]apis.ChunkDigest)
+		for _, digest := range list {
+			digests[digest.Chunk] = digest
+		}
+		held[id] = digests
+	}
+	return held
+}
+
+func (ae *AntiEntropy) checkChunk(chunk apis.ChunkNum, entry apis.MetadataEntry, held map[apis.ServerID]map[apis.ChunkNum]apis.ChunkDigest) {
+	if entry.MostRecentVersion > entry.LastConsumedVersion {
+		// being deleted
+		return
+	}
+	var current, unpublished, behind, missing []apis.ServerID
+	checksums := make(map[apis.ServerID]apis.Checksum)
+	for _, id := range entry.Replicas {
+		digests, reachable := held[id]
+		if !reachable {
+			continue
+		}
+		ae.count(func(stats *AntiEntropyStats) {
+			stats.Checked++
+		})
+		digest, found := digests[chunk]
+		holds := false
+		for _, version := range digest.Versions {
+			holds = holds || version == entry.MostRecentVersion
+		}
+		if !found {
+			missing = append(missing, id)
+		} else if digest.Latest == entry.MostRecentVersion {
+			current = append(current, id)
+			checksums[id] = digest.Checksum
+		} else if holds && digest.Latest < entry.MostRecentVersion {
+			unpublished = append(unpublished, id)
+		} else {
+			behind = append(behind, id)
+		}
+	}
+	current, diverged := ae.splitDiverged(chunk, current, checksums)
+	if len(unpublished) == 0 && len(behind) == 0 && len(diverged) == 0 && len(missing) == 0 {
+		return
+	}
+
+	var repaired []apis.ServerID
+	for _, id := range unpublished {
+		ae.count(func(stats *AntiEntropyStats) {
+			stats.Unpublished++
+		})
+		ae.waitForRepairSlot()
+		if err := ae.publishReplica(chunk, entry.MostRecentVersion, held[id][chunk].Latest, id); err != nil {
+			ae.logger.Logf(apis.WARN, "Could not switch chunk %d on Server #%d over to version %d: %v", chunk, id, entry.MostRecentVersion, err)
+			ae.count(func(stats *AntiEntropyStats) {
+				stats.Failed++
+			})
+			continue
+		}
+		ae.logger.Logf(apis.INFO, "Switched chunk %d on Server #%d over to version %d", chunk, id, entry.MostRecentVersion)
+		ae.count(func(stats *AntiEntropyStats) {
+			stats.Repaired++
+		})
+		repaired = append(repaired, id)
+	}
+
+	ae.count(func(stats *AntiEntropyStats) {
+		stats.Diverged += len(diverged)
+	})
+	if len(current) == 0 {
+		if len(behind) > 0 || len(diverged) > 0 {
+			ae.logger.Logf(apis.ERROR, "No replica of chunk %d can be trusted to hold version %d; cannot repair it", chunk, entry.MostRecentVersion)
+		}
+	} else if source, err := ae.idToCS(current[0]); err != nil {
+		ae.logger.Logf(apis.WARN, "Could not connect to Server #%d to repair chunk %d: %v", current[0], chunk, err)
+	} else {
+		for _, id := range append(append([]apis.ServerID{}, behind...), diverged...) {
+			replaced := containsID(diverged, id)
+			if !replaced {
+				ae.count(func(stats *AntiEntropyStats) {
+					stats.Behind++
+				})
+			}
+			ae.waitForRepairSlot()
+			if err := ae.repairReplica(chunk, entry.MostRecentVersion, source, id, replaced); err != nil {
+				ae.logger.Logf(apis.WARN, "Could not repair chunk %d on Server #%d: %v", chunk, id, err)
+				ae.count(func(stats *AntiEntropyStats) {
+					stats.Failed++
+				})
+				continue
+			}
+			ae.logger.Logf(apis.INFO, "Repaired chunk %d on Server #%d from Server #%d", chunk, id, current[0])
+			ae.count(func(stats *AntiEntropyStats) {
+				stats.Repaired++
+			})
+			repaired = append(repaired, id)
+		}
+	}
+
+	// a replica that was repaired now holds the latest version, even if the entry says it's lagging
+	next := apis.MetadataEntry{
+		MostRecentVersion:   entry.MostRecentVersion,
+		LastConsumedVersion: entry.LastConsumedVersion,
+		ACL:                 entry.ACL,
+		ReplicationFactor:   entry.ReplicationFactor,
+	}
+	for _, id := range entry.Replicas {
+		if !containsID(missing, id) {
+			next.Replicas = append(next.Replicas, id)
+		}
+	}
+	for _, id := range entry.Lagging {
+		if !containsID(missing, id) && !containsID(repaired, id) {
+			next.Lagging = append(next.Lagging, id)
+		}
+	}
+	if next.Equals(entry) {
+		return
+	}
+	if len(missing) > 0 {
+		ae.waitForRepairSlot()
+	}
+	if _, err := ae.localCache.UpdateEntry(chunk, entry, next); err != nil {
+		// most likely a write changed the entry in the meantime; the next pass will see the new one
+		ae.logger.Logf(apis.WARN, "Could not update the entry of chunk %d after repairing it: %v", chunk, err)
+		ae.count(func(stats *AntiEntropyStats) {
+			stats.Failed += len(missing)
+		})
+		return
+	}
+	for _, id := range missing {
+		ae.logger.Logf(apis.INFO, "Removed Server #%d from the replicas of chunk %d, since it no longer holds it", id, chunk)
+	}
+	ae.count(func(stats *AntiEntropyStats) {
+		stats.Removed += len(missing)
+	})
+}
+
+// Separates the replicas that serve a chunk's most recent version into those whose checksum is the one held by the most
+// of them, and those whose checksum differs from it. If no checksum is held by more replicas than any other, none of
+// them can be trusted over the others, so they are all left out of both.
+func (ae *AntiEntropy) splitDiverged(chunk apis.ChunkNum, current []apis.ServerID, checksums map[apis.ServerID]apis.Checksum) (agreeing []apis.ServerID, diverged []apis.ServerID) {
+	votes := make(map[apis.Checksum]int)
+	for _, id := range current {
+		votes[checksums[id]]++
+	}
+	if len(votes) <= 1 {
+		return current, nil
+	}
+	var majority apis.Checksum
+	best, tied := 0, false
+	for checksum, count := range votes {
+		if count > best {
+			majority, best, tied = checksum, count, false
+		} else if count == best {
+			tied = true
+		}
+	}
+	if tied {
+		ae.logger.Logf(apis.ERROR, "Replicas %v of chunk %d disagree on its contents, with no majority", current, chunk)
+		return nil, nil
+	}
+	for _, id := range current {
+		if checksums[id] == majority {
+			agreeing = append(agreeing, id)
+		} else {
+			diverged = append(diverged, id)
+		}
+	}
+	return agreeing, diverged
+}
+
+// Has a replica that holds 'version' of a chunk, but serves 'latest', serve 'version' instead.
+func (ae *AntiEntropy) publishReplica(chunk apis.ChunkNum, version apis.Version, latest apis.Version, id apis.ServerID) error {
+	target, err := ae.idToCS(id)
+	if err != nil {
+		return err
+	}
+	return target.UpdateLatestVersion(chunk, latest, version)
+}
+
+// Replaces a replica's copy of a chunk with 'version' from 'source'. The replica is asked directly which version it
+// serves first, in case it caught up since it was digested; unless 'diverged' is set, in which case it serves 'version'
+// already, but with the wrong data.
+func (ae *AntiEntropy) repairReplica(chunk apis.ChunkNum, version apis.Version, source apis.Chunkserver, id apis.ServerID, diverged bool) error {
+	address, err := chunkupdate.AddressForChunkserver(ae.etcd, id)
+	if err != nil {
+		return err
+	}
+	target, err := ae.rpcCache.SubscribeChunkserver(address)
+	if err != nil {
+		return err
+	}
+	_, stale, err := target.Read(chunk, 0, 0, apis.AnyVersion)
+	if err != nil {
+		return err
+	}
+	if stale > version || (stale == version && !diverged) {
+		return nil
+	}
+	// Add refuses to replace a chunk that already exists, so the stale copy has to go first
+	if err := target.Delete(chunk, stale); err != nil {
+		return err
+	}
+	return source.Replicate(chunk, address, version)
+}
+
+// Blocks until at least the repair gap has passed since the last repair.
+func (ae *AntiEntropy) waitForRepairSlot() {
+	ae.mu.Lock()
+	wait := ae.repairGap - time.Since(ae.lastRepair)
+	if wait < 0 {
+		wait = 0
+	}
+	ae.lastRepair = time.Now().Add(wait)
+	ae.mu.Unlock()
+	time.Sleep(wait)
+}
+
+func (ae *AntiEntropy) idToCS(id apis.ServerID) (apis.Chunkserver, error) {
+	addr, err := chunkupdate.AddressForChunkserver(ae.etcd, id)
+	if err != nil {
+		return nil, err
+	}
+	return ae.rpcCache.SubscribeChunkserver(addr)
+}
+
+func containsID(ids []apis.ServerID, id apis.ServerID) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
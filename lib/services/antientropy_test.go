@@ -0,0 +1,232 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"zircon/apis"
+	"zircon/chunkserver"
+	"zircon/client/control"
+	"zircon/etcd"
+	"zircon/frontend"
+	"zircon/metadatacache"
+	"zircon/rpc"
+	"zircon/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tests that one anti-entropy pass brings a replica that fell behind back up to the latest version, and drops a
+// replica that lost its copy of a chunk from the metadata, while leaving consistent chunks alone.
+func TestAntiEntropyConverges(t *testing.T) {
+	cache := &rpc.MockCache{
+		Frontends:    map[apis.ServerAddress]apis.Frontend{},
+		Chunkservers: map[apis.ServerAddress]apis.Chunkserver{},
+	}
+	etcds, teardown1 := etcd.PrepareSubscribeForTesting(t)
+	var teardowns util.MultiTeardown
+	teardowns.Add(teardown1)
+	defer teardowns.TeardownReverse()
+
+	var chunkservers []apis.Chunkserver
+	var ids []apis.ServerID
+	for i := 0; i < 3; i++ {
+		name := apis.ServerName(fmt.Sprintf("cs%d", i))
+		address := apis.ServerAddress(fmt.Sprintf("cs-address-%d", i))
+
+		cs, _, csTeardown := chunkserver.NewTestChunkserver(t, cache)
+		teardowns.Add(csTeardown)
+		cache.Chunkservers[address] = cs
+		chunkservers = append(chunkservers, cs)
+
+		etcdN, etcdClientTeardown := etcds(name)
+		teardowns.Add(etcdClientTeardown)
+		require.NoError(t, etcdN.UpdateAddress(address, apis.CHUNKSERVER))
+		id, err := etcdN.GetIDByName(name)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	etcd0, teardown2 := etcds("fe0")
+	teardowns.Add(teardown2)
+	fe, err := frontend.ConstructFrontendWithOptions(etcd0, cache, frontend.FrontendOptions{Replicas: 3})
+	require.NoError(t, err)
+	mdc0, err := metadatacache.NewCache(cache, etcd0)
+	require.NoError(t, err)
+	teardowns.Add(func() {
+		assert.NoError(t, mdc0.Close())
+	})
+	cache.MetadataCaches = map[apis.ServerAddress]apis.MetadataCache{
+		"mdc-address-0": mdc0,
+	}
+	require.NoError(t, etcd0.UpdateAddress("mdc-address-0", apis.METADATACACHE))
+
+	client, err := control.ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer client.Close()
+
+	behind, err := client.New()
+	require.NoError(t, err)
+	ver1, err := client.Write(behind, 0, apis.AnyVersion, []byte("hello, world!"))
+	require.NoError(t, err)
+	ver2, err := client.Write(behind, 7, ver1, []byte("there!"))
+	require.NoError(t, err)
+	lost, err := client.New()
+	require.NoError(t, err)
+	lostVer, err := client.Write(lost, 0, apis.AnyVersion, []byte("goodbye"))
+	require.NoError(t, err)
+	intact, err := client.New()
+	require.NoError(t, err)
+	_, err = client.Write(intact, 0, apis.AnyVersion, []byte("untouched"))
+	require.NoError(t, err)
+
+	before, _, err := mdc0.ReadEntry(lost)
+	require.NoError(t, err)
+	var kept []apis.ServerID
+	for _, id := range before.Replicas {
+		if id != ids[2] {
+			kept = append(kept, id)
+		}
+	}
+
+	// corrupt cs1 so that it serves the first version again, and have cs2 lose its copy entirely
+	require.NoError(t, chunkservers[1].Delete(behind, ver2))
+	require.NoError(t, chunkservers[1].Add(behind, []byte("hello, world!"), ver1))
+	require.NoError(t, chunkservers[2].Delete(lost, lostVer))
+
+	ae := NewAntiEntropy(etcd0, mdc0, cache, apis.NoopLogger)
+	ae.repairGap = 0
+	require.NoError(t, ae.Pass())
+
+	stats := ae.Stats()
+	assert.Equal(t, 1, stats.Passes)
+	assert.Equal(t, 1, stats.Behind)
+	assert.Equal(t, 1, stats.Repaired)
+	assert.Equal(t, 1, stats.Removed)
+	assert.Equal(t, 0, stats.Failed)
+
+	data, version, err := chunkservers[1].Read(behind, 0, 13, apis.AnyVersion)
+	require.NoError(t, err)
+	assert.Equal(t, ver2, version)
+	assert.Equal(t, "hello, there!", string(data))
+
+	entry, _, err := mdc0.ReadEntry(lost)
+	require.NoError(t, err)
+	assert.Equal(t, kept, entry.Replicas)
+	data, _, err = client.Read(lost, 0, 7)
+	require.NoError(t, err)
+	assert.Equal(t, "goodbye", string(data))
+
+	entry, _, err = mdc0.ReadEntry(intact)
+	require.NoError(t, err)
+	assert.Len(t, entry.Replicas, 3)
+
+	// once converged, another pass should find nothing left to do
+	require.NoError(t, ae.Pass())
+	again := ae.Stats()
+	assert.Equal(t, 2, again.Passes)
+	assert.Equal(t, stats.Behind, again.Behind)
+	assert.Equal(t, stats.Removed, again.Removed)
+}
+
+// Tests that anti-entropy tells from digests which replica missed an UpdateLatestVersion, and which serves the latest
+// version with different data than the others, and fixes both.
+func TestAntiEntropyDigests(t *testing.T) {
+	cache := &rpc.MockCache{
+		Frontends:    map[apis.ServerAddress]apis.Frontend{},
+		Chunkservers: map[apis.ServerAddress]apis.Chunkserver{},
+	}
+	etcds, teardown1 := etcd.PrepareSubscribeForTesting(t)
+	var teardowns util.MultiTeardown
+	teardowns.Add(teardown1)
+	defer teardowns.TeardownReverse()
+
+	var chunkservers []apis.Chunkserver
+	for i := 0; i < 3; i++ {
+		name := apis.ServerName(fmt.Sprintf("cs%d", i))
+		address := apis.ServerAddress(fmt.Sprintf("cs-address-%d", i))
+
+		cs, _, csTeardown := chunkserver.NewTestChunkserver(t, cache)
+		teardowns.Add(csTeardown)
+		cache.Chunkservers[address] = cs
+		chunkservers = append(chunkservers, cs)
+
+		etcdN, etcdClientTeardown := etcds(name)
+		teardowns.Add(etcdClientTeardown)
+		require.NoError(t, etcdN.UpdateAddress(address, apis.CHUNKSERVER))
+	}
+
+	etcd0, teardown2 := etcds("fe0")
+	teardowns.Add(teardown2)
+	fe, err := frontend.ConstructFrontendWithOptions(etcd0, cache, frontend.FrontendOptions{Replicas: 3})
+	require.NoError(t, err)
+	mdc0, err := metadatacache.NewCache(cache, etcd0)
+	require.NoError(t, err)
+	teardowns.Add(func() {
+		assert.NoError(t, mdc0.Close())
+	})
+	cache.MetadataCaches = map[apis.ServerAddress]apis.MetadataCache{
+		"mdc-address-0": mdc0,
+	}
+	require.NoError(t, etcd0.UpdateAddress("mdc-address-0", apis.METADATACACHE))
+
+	client, err := control.ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer client.Close()
+
+	unpublished, err := client.New()
+	require.NoError(t, err)
+	_, err = client.Write(unpublished, 0, apis.AnyVersion, []byte("hello, world!"))
+	require.NoError(t, err)
+	diverged, err := client.New()
+	require.NoError(t, err)
+	divergedVer, err := client.Write(diverged, 0, apis.AnyVersion, []byte("untouched"))
+	require.NoError(t, err)
+
+	// write a new version of the first chunk by hand, and leave cs0 serving the old one
+	entry, _, err := mdc0.ReadEntry(unpublished)
+	require.NoError(t, err)
+	oldVer, newVer := entry.MostRecentVersion, entry.LastConsumedVersion+1
+	data := []byte("there!")
+	for i, cs := range chunkservers {
+		require.NoError(t, cs.StartWrite(unpublished, 7, data))
+		require.NoError(t, cs.CommitWrite(unpublished, apis.CalculateCommitHash(7, data), oldVer, newVer))
+		if i != 0 {
+			require.NoError(t, cs.UpdateLatestVersion(unpublished, oldVer, newVer))
+		}
+	}
+	next := entry
+	next.MostRecentVersion, next.LastConsumedVersion = newVer, newVer
+	_, err = mdc0.UpdateEntry(unpublished, entry, next)
+	require.NoError(t, err)
+
+	// and damage cs2's copy of the second chunk without changing its version
+	require.NoError(t, chunkservers[2].Delete(diverged, divergedVer))
+	require.NoError(t, chunkservers[2].Add(diverged, []byte("tampered"), divergedVer))
+
+	ae := NewAntiEntropy(etcd0, mdc0, cache, apis.NoopLogger)
+	ae.repairGap = 0
+	require.NoError(t, ae.Pass())
+
+	stats := ae.Stats()
+	assert.Equal(t, 1, stats.Unpublished)
+	assert.Equal(t, 1, stats.Diverged)
+	assert.Equal(t, 0, stats.Behind)
+	assert.Equal(t, 2, stats.Repaired)
+	assert.Equal(t, 0, stats.Failed)
+
+	read, version, err := chunkservers[0].Read(unpublished, 0, 13, apis.AnyVersion)
+	require.NoError(t, err)
+	assert.Equal(t, newVer, version)
+	assert.Equal(t, "hello, there!", string(read))
+	read, version, err = chunkservers[2].Read(diverged, 0, 9, apis.AnyVersion)
+	require.NoError(t, err)
+	assert.Equal(t, divergedVer, version)
+	assert.Equal(t, "untouched", string(read))
+
+	require.NoError(t, ae.Pass())
+	again := ae.Stats()
+	assert.Equal(t, stats.Repaired, again.Repaired)
+	assert.Equal(t, stats.Unpublished, again.Unpublished)
+	assert.Equal(t, stats.Diverged, again.Diverged)
+}
@@ -1,238 +1,286 @@
 package services
 
 import (
-	"errors"
-	"fmt"
-	"log"
+	"sort"
+	"sync"
 	"time"
 	"zircon/apis"
 	"zircon/chunkupdate"
 	"zircon/rpc"
 )
 
-const MaxUint = ^uint(0)
-const MaxInt = int(MaxUint >> 1)
-
 // The chunk server with the most chunks should have at most maxChunkRatio times
 // more chunks than the one with the least chunks
 const maxChunkRatio = 2
 
-// Replicaiton Frequency in seconds
-const BalancingFreq = 5
+// The fullest chunkserver should have at most this much more of its storage in use than the emptiest, as fractions of
+// their storage, for chunkservers that report how large their storage is.
+const RebalanceThreshold = 0.1
 
-// TODO This whole thing
-func LoadBalancerService(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache) (cancel func() error, err error) {
-	cancel = func() error {
-		return nil
-	}
+// How often the rebalancer looks for chunkservers to move replicas between.
+const BalancingFreq = time.Minute
 
-	return cancel, nil
+// Limits on how quickly the rebalancer moves replicas, so that it doesn't crowd out the cluster's own reads and writes.
+type RebalanceThrottle struct {
+	// The most replicas moved in a single pass. The rest of the imbalance is left for later passes.
+	MaxMovesPerPass int
+	// How long to wait after each move before starting the next.
+	MovePause time.Duration
 }
 
-type balancer struct {
-	etcd       apis.EtcdInterface
-	localCache apis.MetadataCache
-	rpcCache   rpc.ConnectionCache
-	stop       bool
+// Moves about one replica a second, and at most 64 in each pass.
+var DefaultRebalanceThrottle = RebalanceThrottle{
+	MaxMovesPerPass: 64,
+	MovePause:       time.Second,
 }
 
-func (bal *balancer) Start() error {
-	go func() {
-		for !bal.stop {
-			bal.balance()
-
-			time.Sleep(BalancingFreq * time.Second)
-		}
-	}()
-
-	return nil
+// Explanation of the rebalancer:
+//     Placement spreads new replicas by how full each chunkserver is (see chunkupdate/placement.go), but does nothing
+//     for replicas that were already placed, such as when a chunkserver is added to a cluster that is already full. The
+//     rebalancer periodically compares the chunkservers: by the fraction of their storage in use, where both report
+//     how large their storage is, and otherwise by how many chunks they hold. While a chunkserver is fuller than
+//     another by more than RebalanceThreshold, or holds more than maxChunkRatio times as many chunks, it moves replicas
+//     off of it, each to whichever of the emptier servers the placement policy chooses, so that failure domains are
+//     still respected. Moves are made the same way as the drain service makes them (see relocateReplica), and are
+//     limited by a RebalanceThrottle. Like garbage collection, it only moves chunks whose metadata blocks its metadata
+//     cache holds the lease on, and it leaves draining chunkservers to the drain service.
+func LoadBalancerService(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache, placement chunkupdate.PlacementPolicy) (cancel func() error, err error) {
+	rb := NewRebalancer(etcd, localCache, rpcCache, placement, DefaultRebalanceThrottle, apis.NoopLogger)
+	rb.Start(BalancingFreq)
+	return func() error {
+		rb.Stop()
+		return nil
+	}, nil
 }
 
-func (bal *balancer) Stop() error {
-	bal.stop = true
-	return nil
-}
+type Rebalancer struct {
+	etcd       apis.EtcdInterface
+	localCache apis.MetadataCache
+	rpcCache   rpc.ConnectionCache
+	placement  chunkupdate.PlacementPolicy
+	throttle   RebalanceThrottle
+	logger     apis.Logger
 
-// TODO Balancer currently assumes each node to have the same amount of storage,
-// ability to handle load, e.g. Poss. change this to allow balancing of unequal nodes
-func (bal *balancer) balance() error {
-	// Generate a list of valid chunk refences per chunkserver
-	validChunks, err := bal.genValidChunks()
-	if err != nil {
-		return err
-	}
+	// held for the duration of a pass
+	mu sync.Mutex
 
-	// Find the chunkserver with the most elements and the one with the least
-	maxID, max := maxChunkserver(validChunks)
-	minID, min := minChunkserver(validChunks)
-	for max > 0 && max > min*2 {
-		// Transfer a chunk from the maximal chunkserver to the minimal chunkserver
-		err := bal.transferSomeChunk(maxID, minID, validChunks)
-		if err != nil {
-			return err
-		}
+	periodic
+}
 
-		maxID, max = maxChunkserver(validChunks)
-		minID, min = minChunkserver(validChunks)
+// Prepares the rebalancer without starting it, so that passes can be run on demand with Pass, or periodically with
+// Start. Replicas are moved with 'placement', which should match the policy the frontends use, no faster than
+// 'throttle' allows.
+func NewRebalancer(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache, placement chunkupdate.PlacementPolicy, throttle RebalanceThrottle, logger apis.Logger) *Rebalancer {
+	return &Rebalancer{
+		etcd:       etcd,
+		localCache: localCache,
+		rpcCache:   rpcCache,
+		placement:  placement,
+		throttle:   throttle,
+		logger:     logger,
 	}
+}
 
-	return nil
+// Rebalances every 'interval' on a background goroutine, until Stop is called.
+func (rb *Rebalancer) Start(interval time.Duration) {
+	rb.start(interval, rb.Pass, rb.logger, "Error while rebalancing")
 }
 
-// Transfer a chunk from one chunkserver to another
-// In the case of failure, this method *should* result of duplication
-// of data, not loss of data
-func (bal *balancer) transferSomeChunk(
-	src apis.ServerID, dst apis.ServerID, chunks map[apis.ServerID]map[apis.ChunkVersion]bool) error {
+// What the rebalancer knows about a chunkserver.
+type serverLoad struct {
+	id       apis.ServerID
+	capacity apis.ServerCapacity
+	// the chunks that the chunkserver holds, and could still be moved off of it during this pass
+	chunks []apis.ChunkVersion
+	// how many chunks the chunkserver holds, including those that can't be moved
+	count int
+}
 
-	// Choose the mapping from the src chunkserver
-	cvs, ok := chunks[src]
-	if !ok {
-		return errors.New("List of chunks does not contain source server")
-	}
-	// Grab some chunknum from the source to move
-	var curCV apis.ChunkVersion
-	var chunknum apis.ChunkNum
-	chunknum = 0
-	for cv, _ := range cvs {
-		curCV = cv
-		chunknum = cv.Chunk
-	}
-	if chunknum == 0 {
-		return errors.New("Chunklist for that source server was zero")
+// Reports whether 'l' is enough fuller than 'other' that replicas should be moved from it to 'other'.
+func (l *serverLoad) overloaded(other *serverLoad) bool {
+	if l.capacity.Known() && other.capacity.Known() {
+		return l.capacity.UsedFraction()-other.capacity.UsedFraction() > RebalanceThreshold
 	}
+	// a difference of one chunk can't be evened out by moving one
+	return l.count > maxChunkRatio*other.count && l.count-other.count > 1
+}
 
-	entry, owner, err := bal.localCache.ReadEntry(chunknum)
-	if owner != apis.NoRedirect {
-		return fmt.Errorf("Metadata for this server currently leased by %v", owner)
-	} else if err != nil {
-		return err
+// Accounts for a replica having been moved from 'l' to 'other', assuming that it was as large as the average chunk
+// on 'l'.
+func (l *serverLoad) moved(other *serverLoad) {
+	if l.capacity.Known() && l.count > 0 {
+		size := (l.capacity.TotalBytes - l.capacity.FreeBytes) / uint64(l.count)
+		l.capacity.FreeBytes += size
+		if other.capacity.Known() {
+			if other.capacity.FreeBytes > size {
+				other.capacity.FreeBytes -= size
+			} else {
+				other.capacity.FreeBytes = 0
+			}
+		}
 	}
+	l.count--
+	other.count++
+}
 
-	csSrc, err := bal.idToCS(src)
-	if err != nil {
-		return err
-	}
-	dstAddr, err := chunkupdate.AddressForChunkserver(bal.etcd, dst)
-	if err != nil {
-		return err
-	}
+// Moves replicas from fuller chunkservers to emptier ones until none is overloaded compared to another, no more replicas
+// can be moved, or the throttle's limit on moves is reached. A pass that is waiting between moves when Stop is called
+// stops there.
+func (rb *Rebalancer) Pass() error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
 
-	// If this current function is halted, one of the replications
-	// *should* be garbage collected.
-	err = csSrc.Replicate(chunknum, dstAddr, entry.MostRecentVersion)
+	loads, err := rb.measure()
 	if err != nil {
 		return err
 	}
-
-	// Find index of source in replicas
-	replicas := []apis.ServerID{}
-	replicas = append(replicas, entry.Replicas...)
-
-	repI := -1
-	for i, id := range replicas {
-		if src == id {
-			repI = i
+	moved := 0
+	for moved < rb.throttle.MaxMovesPerPass {
+		if moved > 0 {
+			select {
+			case <-rb.stop:
+				return nil
+			case <-time.After(rb.throttle.MovePause):
+			}
+		}
+		// fullest first, so that the worst imbalance is dealt with first
+		sort.Slice(loads, func(i, j int) bool {
+			if loads[i].capacity.Known() && loads[j].capacity.Known() {
+				return loads[i].capacity.UsedFraction() > loads[j].capacity.UsedFraction()
+			}
+			return loads[i].count > loads[j].count
+		})
+		progress := false
+		for _, source := range loads {
+			var targets []*serverLoad
+			for _, target := range loads {
+				if source.overloaded(target) {
+					targets = append(targets, target)
+				}
+			}
+			if len(targets) == 0 {
+				continue
+			}
+			if rb.moveOne(source, targets) {
+				progress = true
+				break
+			}
+		}
+		if !progress {
 			break
 		}
+		moved++
 	}
-	if repI == -1 {
-		return fmt.Errorf("Source server %d could not be found in list of replicas for chunk %v", src, chunknum)
-	}
-
-	// Remove the src from the list of replicas and add the dst
-	replicas = append(replicas[:repI], replicas[repI+1:]...)
-	replicas = append(replicas, dst)
-
-	owner, err = bal.localCache.UpdateEntry(chunknum, entry, apis.MetadataEntry{
-		MostRecentVersion:   entry.MostRecentVersion,
-		LastConsumedVersion: entry.LastConsumedVersion,
-		Replicas:            replicas,
-	})
-
-	if owner != apis.NoRedirect {
-		return fmt.Errorf("Cannot update metadata for chunk %d as server %d has a lease on it.", chunknum, owner)
-	} else if err != nil {
-		return err
-	}
-
-	// Finally, reflect the chunk move in the mapping of chunks provided
-	delete(chunks[src], curCV)
-	chunks[dst][curCV] = true
-
+	rb.logger.Logf(apis.INFO, "Rebalancing moved %d replicas", moved)
 	return nil
 }
 
-// Generate a mapping of chunkserver to valid chunks that it currently contains
-// This mapping would not contain the chunkservers or its chunks for any chunkserver that is down,
-// and would not contain any chunks that the chunkserver somehow lost or has designated as invalid
-// TODO Use abstraction magic to genericize this
-func (bal *balancer) genValidChunks() (map[apis.ServerID]map[apis.ChunkVersion]bool, error) {
-	chunkservers, err := chunkupdate.ListChunkservers(bal.etcd)
+// Finds out how full each chunkserver that isn't draining is, and which chunks it holds.
+func (rb *Rebalancer) measure() ([]*serverLoad, error) {
+	chunkservers, err := chunkupdate.ListChunkservers(rb.etcd)
 	if err != nil {
 		return nil, err
 	}
-
-	// Map to chunk version, as a previous version of a chunk doesn't count for our replication goals
-	chunks := make(map[apis.ServerID]map[apis.ChunkVersion]bool)
-	for _, chunkserver := range chunkservers {
-		// TODO Make sure this times out if the target is down
-		cs, err := bal.idToCS(chunkserver)
+	candidates, err := chunkupdate.CandidatesFor(rb.etcd, chunkservers)
+	if err != nil {
+		return nil, err
+	}
+	var loads []*serverLoad
+	for _, candidate := range candidates {
+		if candidate.Draining {
+			continue
+		}
+		cs, err := chunkserverByID(rb.etcd, rb.rpcCache, candidate.ID)
 		if err != nil {
-			log.Printf("Server %s threw error: %v while constructing list of valid chunks", chunkserver, err)
+			rb.logger.Logf(apis.WARN, "Server %d threw error: %v while listing its chunks for rebalancing", candidate.ID, err)
 			continue
 		}
-
-		// This assumes chunkserver to return only its valid chunks
-		cvs, err := cs.ListAllChunks()
+		versions, err := cs.ListAllChunks()
 		if err != nil {
-			log.Printf("Server %s threw error: %v while constructing list of valid chunks", chunkserver, err)
+			rb.logger.Logf(apis.WARN, "Server %d threw error: %v while listing its chunks for rebalancing", candidate.ID, err)
 			continue
 		}
-		// Doing this as map instead of a list for faster lookup
-		cvsMap := make(map[apis.ChunkVersion]bool)
-		for _, cv := range cvs {
-			cvsMap[cv] = true
+		// only the latest version of each chunk, since older ones are moved along with it
+		latest := map[apis.ChunkNum]apis.Version{}
+		for _, cv := range versions {
+			if cv.Version > latest[cv.Chunk] {
+				latest[cv.Chunk] = cv.Version
+			}
 		}
-		chunks[chunkserver] = cvsMap
-	}
-
-	return chunks, nil
-}
-
-// Given a chunkserver id, return a connection to that chunkserver
-func (bal *balancer) idToCS(id apis.ServerID) (apis.Chunkserver, error) {
-	addr, err := chunkupdate.AddressForChunkserver(bal.etcd, id)
-	if err != nil {
-		return nil, err
-	}
-
-	return bal.rpcCache.SubscribeChunkserver(addr)
-}
-
-func minChunkserver(chunks map[apis.ServerID]map[apis.ChunkVersion]bool) (minID apis.ServerID, min int) {
-	// TODO Fix this hack
-	minID = 0
-	min = MaxInt
-	for serverID, chunkMap := range chunks {
-		if len(chunkMap) < min {
-			min = len(chunkMap)
-			minID = serverID
+		chunks := make([]apis.ChunkVersion, 0, len(latest))
+		for chunk, version := range latest {
+			chunks = append(chunks, apis.ChunkVersion{Chunk: chunk, Version: version})
 		}
+		loads = append(loads, &serverLoad{
+			id:       candidate.ID,
+			capacity: candidate.Capacity,
+			chunks:   chunks,
+			count:    len(chunks),
+		})
 	}
-
-	return minID, min
+	return loads, nil
 }
 
-func maxChunkserver(chunks map[apis.ServerID]map[apis.ChunkVersion]bool) (maxID apis.ServerID, max int) {
-	maxID = 0
-	max = 0
-	for serverID, chunkMap := range chunks {
-		if len(chunkMap) > max {
-			max = len(chunkMap)
-			maxID = serverID
+// Moves one replica from 'source' to one of 'targets', chosen by the placement policy from those that don't already
+// hold the chunk. Chunks that turn out not to be movable, because another metadata cache holds the lease on them,
+// 'source' doesn't hold their most recent version, or no target can take them, are dropped from 'source' for the rest
+// of the pass. Returns false if no chunk could be moved.
+func (rb *Rebalancer) moveOne(source *serverLoad, targets []*serverLoad) bool {
+	for len(source.chunks) > 0 {
+		cv := source.chunks[0]
+		source.chunks = source.chunks[1:]
+
+		entry, owner, err := rb.localCache.ReadEntry(cv.Chunk)
+		if owner != apis.NoRedirect || err != nil || entry.MostRecentVersion != cv.Version {
+			continue
+		}
+		if upToDateReplica(entry, source.id) != source.id {
+			continue
+		}
+		holding := map[apis.ServerID]bool{}
+		var others []apis.ServerID
+		for _, id := range entry.Replicas {
+			holding[id] = true
+			if id != source.id {
+				others = append(others, id)
+			}
+		}
+		if !holding[source.id] {
+			continue
+		}
+		var avail []apis.ServerID
+		byID := map[apis.ServerID]*serverLoad{}
+		for _, target := range targets {
+			if !holding[target.id] {
+				avail = append(avail, target.id)
+				byID[target.id] = target
+			}
+		}
+		if len(avail) == 0 {
+			continue
+		}
+		existing, err := chunkupdate.CandidatesFor(rb.etcd, others)
+		if err != nil {
+			rb.logger.Logf(apis.WARN, "Could not look up the replicas of chunk %d: %v", cv.Chunk, err)
+			continue
+		}
+		candidates, err := chunkupdate.CandidatesFor(rb.etcd, avail)
+		if err != nil {
+			rb.logger.Logf(apis.WARN, "Could not look up servers to move chunk %d to: %v", cv.Chunk, err)
+			continue
 		}
+		chosen, err := chunkupdate.Place(rb.placement, 1, existing, candidates)
+		if err != nil {
+			continue
+		}
+		_, err = relocateReplica(rb.etcd, rb.localCache, rb.rpcCache, rb.logger, cv.Chunk, entry, source.id, chosen[0], source.id)
+		if err != nil {
+			rb.logger.Logf(apis.WARN, "Could not move chunk %d from Server #%d to Server #%d: %v", cv.Chunk, source.id, chosen[0], err)
+			continue
+		}
+		rb.logger.Logf(apis.INFO, "Moved chunk %d from Server #%d to Server #%d", cv.Chunk, source.id, chosen[0])
+		source.moved(byID[chosen[0]])
+		return true
 	}
-
-	return maxID, max
+	return false
 }
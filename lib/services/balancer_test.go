@@ -1 +1,107 @@
 package services
+
+import (
+	"fmt"
+	"testing"
+	"zircon/apis"
+	"zircon/chunkserver"
+	"zircon/chunkupdate"
+	"zircon/client/control"
+	"zircon/etcd"
+	"zircon/frontend"
+	"zircon/metadatacache"
+	"zircon/rpc"
+	"zircon/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tests that the rebalancer moves replicas onto a chunkserver added to a cluster that already holds data, no faster than
+// its throttle allows, and without losing any data.
+func TestRebalance(t *testing.T) {
+	cache := &rpc.MockCache{
+		Frontends:    map[apis.ServerAddress]apis.Frontend{},
+		Chunkservers: map[apis.ServerAddress]apis.Chunkserver{},
+	}
+	etcds, teardown1 := etcd.PrepareSubscribeForTesting(t)
+	var teardowns util.MultiTeardown
+	teardowns.Add(teardown1)
+	defer teardowns.TeardownReverse()
+
+	var chunkservers []apis.Chunkserver
+	var csEtcds []apis.EtcdInterface
+	for i := 0; i < 3; i++ {
+		cs, _, csTeardown := chunkserver.NewTestChunkserver(t, cache)
+		teardowns.Add(csTeardown)
+		chunkservers = append(chunkservers, cs)
+
+		etcdN, etcdClientTeardown := etcds(apis.ServerName(fmt.Sprintf("cs%d", i)))
+		teardowns.Add(etcdClientTeardown)
+		csEtcds = append(csEtcds, etcdN)
+	}
+	join := func(i int) {
+		address := apis.ServerAddress(fmt.Sprintf("cs-address-%d", i))
+		cache.Chunkservers[address] = chunkservers[i]
+		require.NoError(t, csEtcds[i].UpdateAddress(address, apis.CHUNKSERVER))
+	}
+	join(0)
+	join(1)
+
+	etcd0, teardown2 := etcds("fe0")
+	teardowns.Add(teardown2)
+	fe, err := frontend.ConstructFrontend(etcd0, cache)
+	require.NoError(t, err)
+	mdc0, err := metadatacache.NewCache(cache, etcd0)
+	require.NoError(t, err)
+	teardowns.Add(func() {
+		assert.NoError(t, mdc0.Close())
+	})
+	cache.MetadataCaches = map[apis.ServerAddress]apis.MetadataCache{
+		"mdc-address-0": mdc0,
+	}
+	require.NoError(t, etcd0.UpdateAddress("mdc-address-0", apis.METADATACACHE))
+
+	client, err := control.ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// with two replicas each, every chunk is on both cs0 and cs1
+	var chunks []apis.ChunkNum
+	for i := 0; i < 8; i++ {
+		chunk, err := client.New()
+		require.NoError(t, err)
+		_, err = client.Write(chunk, 0, apis.AnyVersion, []byte(fmt.Sprintf("chunk %d", i)))
+		require.NoError(t, err)
+		chunks = append(chunks, chunk)
+	}
+	join(2)
+	held := func() int {
+		versions, err := chunkservers[2].ListAllChunks()
+		require.NoError(t, err)
+		return len(versions)
+	}
+	require.Equal(t, 0, held())
+
+	require.NoError(t, NewRebalancer(etcd0, mdc0, cache, chunkupdate.DomainPlacement, RebalanceThrottle{MaxMovesPerPass: 1}, apis.NoopLogger).Pass())
+	assert.Equal(t, 1, held())
+
+	rb := NewRebalancer(etcd0, mdc0, cache, chunkupdate.DomainPlacement, RebalanceThrottle{MaxMovesPerPass: 100}, apis.NoopLogger)
+	require.NoError(t, rb.Pass())
+	// 16 replicas on three servers, with none holding more than twice as many as another
+	assert.True(t, held() >= 4, "only %d replicas on the new server", held())
+	for i, chunk := range chunks {
+		entry, _, err := fe.ReadFullMetadataEntry(chunk)
+		require.NoError(t, err)
+		require.Len(t, entry.Replicas, 2)
+		assert.NotEqual(t, entry.Replicas[0], entry.Replicas[1])
+		data, _, err := client.Read(chunk, 0, 7)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("chunk %d", i), string(data))
+	}
+
+	// already balanced, so another pass leaves everything where it is
+	before := held()
+	require.NoError(t, rb.Pass())
+	assert.Equal(t, before, held())
+}
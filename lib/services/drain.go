@@ -0,0 +1,203 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"zircon/apis"
+	"zircon/chunkupdate"
+	"zircon/metadatacache"
+	"zircon/rpc"
+)
+
+// How often the drain service looks for replicas to move off of draining chunkservers.
+const DrainFreq = 10 * time.Second
+
+// Explanation of the drain service:
+//     An operator retires a chunkserver by marking it as draining in etcd, with SetDraining. From then on, placement
+//     leaves it out (see chunkupdate.Place), so it gets no new replicas, and the drain service moves the ones it already
+//     holds elsewhere: for each chunk whose metadata entry lists a draining server, it copies the chunk to a server
+//     chosen by the placement policy, swaps that server into the entry in place of the draining one, and only then
+//     deletes the chunk from the draining server, so that the chunk is never on fewer replicas than it should be. Like
+//     garbage collection, it only looks at the metadata blocks that its metadata cache holds the lease on.
+//     A move that races with a write to the chunk fails to update the entry, and is tried again on the next pass.
+//     Chunks that have never been written to have nothing to copy, and are left to be written, and then moved, or to be
+//     deleted by garbage collection.
+//     DrainProgress reports how many chunks a draining server still holds; once that reaches zero, it can be shut down
+//     and removed from the cluster.
+func DrainService(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache, placement chunkupdate.PlacementPolicy) (cancel func() error, err error) {
+	d := NewDrainer(etcd, localCache, rpcCache, placement, apis.NoopLogger)
+	d.Start(DrainFreq)
+	return func() error {
+		d.Stop()
+		return nil
+	}, nil
+}
+
+type Drainer struct {
+	etcd       apis.EtcdInterface
+	localCache apis.MetadataCache
+	rpcCache   rpc.ConnectionCache
+	placement  chunkupdate.PlacementPolicy
+	logger     apis.Logger
+
+	// held for the duration of a pass
+	mu sync.Mutex
+
+	periodic
+}
+
+// Prepares the drain service without starting it, so that passes can be run on demand with Pass, or periodically with
+// Start. Replacement replicas are placed with 'placement', which should match the policy the frontends use.
+func NewDrainer(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache, placement chunkupdate.PlacementPolicy, logger apis.Logger) *Drainer {
+	return &Drainer{
+		etcd:       etcd,
+		localCache: localCache,
+		rpcCache:   rpcCache,
+		placement:  placement,
+		logger:     logger,
+	}
+}
+
+// Drains chunkservers every 'interval' on a background goroutine, until Stop is called.
+func (d *Drainer) Start(interval time.Duration) {
+	d.start(interval, d.Pass, d.logger, "Error while draining chunkservers")
+}
+
+// Looks over every chunk whose metadata block this server holds the lease on once, and moves each of its replicas
+// that is on a draining chunkserver to another chunkserver. Moves that fail are logged and left for the next pass.
+func (d *Drainer) Pass() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	names, err := d.etcd.ListDraining()
+	if err != nil {
+		return err
+	}
+	draining := map[apis.ServerID]bool{}
+	for _, name := range names {
+		id, err := d.etcd.GetIDByName(name)
+		if err != nil {
+			// marked as draining without ever having joined, so it holds nothing to move
+			d.logger.Logf(apis.DEBUG, "Draining server %s has no ID: %v", name, err)
+			continue
+		}
+		draining[id] = true
+	}
+	if len(draining) == 0 {
+		return nil
+	}
+	chunkservers, err := chunkupdate.ListChunkservers(d.etcd)
+	if err != nil {
+		return err
+	}
+	metachunks, err := d.etcd.ListAllMetaIDs()
+	if err != nil {
+		return err
+	}
+	moved, failed := 0, 0
+	for _, metachunk := range metachunks {
+		for i := 0; i < 1<<apis.EntriesPerBlock; i++ {
+			chunk := metadatacache.EntryAndBlockToChunkNum(metachunk, uint32(i))
+			entry, owner, err := d.localCache.ReadEntry(chunk)
+			if owner != apis.NoRedirect {
+				// another server holds the lease on this block, and takes care of it instead
+				break
+			}
+			if err != nil || entry.MostRecentVersion == 0 {
+				continue
+			}
+			for _, replica := range append([]apis.ServerID{}, entry.Replicas...) {
+				if !draining[replica] {
+					continue
+				}
+				entry, err = d.move(chunk, entry, replica, chunkservers)
+				if err != nil {
+					d.logger.Logf(apis.WARN, "Could not move chunk %d off of draining server #%d: %v", chunk, replica, err)
+					failed++
+					break
+				}
+				d.logger.Logf(apis.INFO, "Moved chunk %d off of draining server #%d", chunk, replica)
+				moved++
+			}
+		}
+	}
+	d.logger.Logf(apis.INFO, "Draining moved %d replicas, and could not move %d more", moved, failed)
+	return nil
+}
+
+// Copies a chunk from one of its up-to-date replicas to a chunkserver chosen by the placement policy, and replaces the
+// draining server 'from' with it in the chunk's metadata entry; see relocateReplica. Returns the entry as updated.
+func (d *Drainer) move(chunk apis.ChunkNum, entry apis.MetadataEntry, from apis.ServerID, chunkservers []apis.ServerID) (apis.MetadataEntry, error) {
+	// copy from the draining server itself if it is up to date, to keep the load off of the servers that are staying
+	source := upToDateReplica(entry, from)
+	if source == 0 {
+		return entry, fmt.Errorf("no replica has version %d", entry.MostRecentVersion)
+	}
+	holding := map[apis.ServerID]bool{}
+	var others []apis.ServerID
+	for _, id := range entry.Replicas {
+		holding[id] = true
+		if id != from {
+			others = append(others, id)
+		}
+	}
+	var avail []apis.ServerID
+	for _, id := range chunkservers {
+		if !holding[id] {
+			avail = append(avail, id)
+		}
+	}
+	existing, err := chunkupdate.CandidatesFor(d.etcd, others)
+	if err != nil {
+		return entry, err
+	}
+	candidates, err := chunkupdate.CandidatesFor(d.etcd, avail)
+	if err != nil {
+		return entry, err
+	}
+	chosen, err := chunkupdate.Place(d.placement, 1, existing, candidates)
+	if err != nil {
+		return entry, err
+	}
+	return relocateReplica(d.etcd, d.localCache, d.rpcCache, d.logger, chunk, entry, from, chosen[0], source)
+}
+
+// How far along the drain of a chunkserver is.
+type DrainStatus struct {
+	// Whether the chunkserver is marked as draining.
+	Draining bool
+	// How many chunks the chunkserver still holds a replica of. Once a draining chunkserver holds none, it can be
+	// retired.
+	Remaining int
+}
+
+// Reports whether a chunkserver is draining, and how many chunks it still holds, by asking it directly.
+func DrainProgress(etcd apis.EtcdInterface, rpcCache rpc.ConnectionCache, name apis.ServerName) (DrainStatus, error) {
+	var status DrainStatus
+	draining, err := etcd.ListDraining()
+	if err != nil {
+		return status, err
+	}
+	for _, candidate := range draining {
+		status.Draining = status.Draining || candidate == name
+	}
+	address, err := etcd.GetAddress(name, apis.CHUNKSERVER)
+	if err != nil {
+		return status, err
+	}
+	cs, err := rpcCache.SubscribeChunkserver(address)
+	if err != nil {
+		return status, err
+	}
+	versions, err := cs.ListAllChunks()
+	if err != nil {
+		return status, err
+	}
+	chunks := map[apis.ChunkNum]bool{}
+	for _, cv := range versions {
+		chunks[cv.Chunk] = true
+	}
+	status.Remaining = len(chunks)
+	return status, nil
+}
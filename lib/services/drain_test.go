@@ -0,0 +1,102 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"zircon/apis"
+	"zircon/chunkserver"
+	"zircon/chunkupdate"
+	"zircon/client/control"
+	"zircon/etcd"
+	"zircon/frontend"
+	"zircon/metadatacache"
+	"zircon/rpc"
+	"zircon/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tests that draining a chunkserver moves every replica it holds to the other chunkservers, without losing any data,
+// and that no new replicas are placed on it in the meantime.
+func TestDrain(t *testing.T) {
+	cache := &rpc.MockCache{
+		Frontends:    map[apis.ServerAddress]apis.Frontend{},
+		Chunkservers: map[apis.ServerAddress]apis.Chunkserver{},
+	}
+	etcds, teardown1 := etcd.PrepareSubscribeForTesting(t)
+	var teardowns util.MultiTeardown
+	teardowns.Add(teardown1)
+	defer teardowns.TeardownReverse()
+
+	for i := 0; i < 3; i++ {
+		name := apis.ServerName(fmt.Sprintf("cs%d", i))
+		address := apis.ServerAddress(fmt.Sprintf("cs-address-%d", i))
+
+		cs, _, csTeardown := chunkserver.NewTestChunkserver(t, cache)
+		teardowns.Add(csTeardown)
+		cache.Chunkservers[address] = cs
+
+		etcdN, etcdClientTeardown := etcds(name)
+		teardowns.Add(etcdClientTeardown)
+		require.NoError(t, etcdN.UpdateAddress(address, apis.CHUNKSERVER))
+	}
+
+	etcd0, teardown2 := etcds("fe0")
+	teardowns.Add(teardown2)
+	fe, err := frontend.ConstructFrontend(etcd0, cache)
+	require.NoError(t, err)
+	mdc0, err := metadatacache.NewCache(cache, etcd0)
+	require.NoError(t, err)
+	teardowns.Add(func() {
+		assert.NoError(t, mdc0.Close())
+	})
+	cache.MetadataCaches = map[apis.ServerAddress]apis.MetadataCache{
+		"mdc-address-0": mdc0,
+	}
+	require.NoError(t, etcd0.UpdateAddress("mdc-address-0", apis.METADATACACHE))
+
+	client, err := control.ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var chunks []apis.ChunkNum
+	for i := 0; i < 6; i++ {
+		chunk, err := client.New()
+		require.NoError(t, err)
+		_, err = client.Write(chunk, 0, apis.AnyVersion, []byte(fmt.Sprintf("chunk %d", i)))
+		require.NoError(t, err)
+		chunks = append(chunks, chunk)
+	}
+	status, err := DrainProgress(etcd0, cache, "cs0")
+	require.NoError(t, err)
+	assert.False(t, status.Draining)
+	// with two replicas each on three chunkservers, cs0 is all but certain to hold some of them
+	require.True(t, status.Remaining > 0)
+
+	require.NoError(t, etcd0.SetDraining("cs0", true))
+	cs0, err := etcd0.GetIDByName("cs0")
+	require.NoError(t, err)
+	// new chunks go to the other two
+	for i := 0; i < 5; i++ {
+		chunk, err := client.New()
+		require.NoError(t, err)
+		entry, _, err := fe.ReadFullMetadataEntry(chunk)
+		require.NoError(t, err)
+		assert.NotContains(t, entry.Replicas, cs0)
+	}
+
+	require.NoError(t, NewDrainer(etcd0, mdc0, cache, chunkupdate.DomainPlacement, apis.NoopLogger).Pass())
+	status, err = DrainProgress(etcd0, cache, "cs0")
+	require.NoError(t, err)
+	assert.Equal(t, DrainStatus{Draining: true, Remaining: 0}, status)
+	for i, chunk := range chunks {
+		entry, _, err := fe.ReadFullMetadataEntry(chunk)
+		require.NoError(t, err)
+		assert.Len(t, entry.Replicas, 2)
+		assert.NotContains(t, entry.Replicas, cs0)
+		data, _, err := client.Read(chunk, 0, 7)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("chunk %d", i), string(data))
+	}
+}
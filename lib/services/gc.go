@@ -1,19 +1,143 @@
 package services
 
 import (
+	"errors"
+	"sync"
+	"time"
 	"zircon/apis"
+	"zircon/chunkupdate"
+	"zircon/metadatacache"
 	"zircon/rpc"
 )
 
+// How long a chunk allocated by New can go without being written to before garbage collection deletes it. Clients
+// delete the chunks they never wrote to when they are closed, so this only matters for clients that went away without
+// being closed; it has to be long enough that no client that is still running takes this long to write a new chunk.
+const IncompleteChunkLease = 10 * time.Minute
+
+// How often garbage collection looks for incomplete chunks.
+const IncompleteRemovalFreq = time.Minute
+
 // Explanation of the garbage collection service:
 //     The garbage collection service goes through and finds chunkservers that only have old versions of chunks, such as
 //     if a write was performed during a network partition or while a server was down, and then deletes these old and
 //     useless chunks.
-// TODO This whole thing
+//     It also deletes incomplete chunks: those that were allocated by New, but were never written to before their
+//     client went away, and so hold on to their chunk numbers and replicas for nothing. Like anti-entropy, it only
+//     looks at the metadata blocks that its metadata cache holds the lease on.
+// TODO Deleting old versions of chunks
 func GCService(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache) (cancel func() error, err error) {
-	cancel = func() error {
+	ir := NewIncompleteRemoval(etcd, localCache, rpcCache, apis.NoopLogger)
+	ir.Start(IncompleteRemovalFreq)
+	return func() error {
+		ir.Stop()
 		return nil
+	}, nil
+}
+
+type IncompleteRemoval struct {
+	etcd       apis.EtcdInterface
+	localCache apis.MetadataCache
+	updater    chunkupdate.Updater
+	logger     apis.Logger
+	lease      time.Duration
+
+	mu sync.Mutex
+	// when each chunk was first seen to be incomplete, for those that still were on the last pass
+	seen map[apis.ChunkNum]time.Time
+
+	periodic
+}
+
+// Prepares incomplete chunk removal without starting it, so that passes can be run on demand with Pass, or
+// periodically with Start.
+func NewIncompleteRemoval(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache, logger apis.Logger) *IncompleteRemoval {
+	return &IncompleteRemoval{
+		etcd:       etcd,
+		localCache: localCache,
+		updater:    chunkupdate.NewUpdater(rpcCache, etcd, localMetadata{localCache}),
+		logger:     logger,
+		lease:      IncompleteChunkLease,
+		seen:       map[apis.ChunkNum]time.Time{},
 	}
+}
+
+// Removes incomplete chunks every 'interval' on a background goroutine, until Stop is called.
+func (ir *IncompleteRemoval) Start(interval time.Duration) {
+	ir.start(interval, ir.Pass, ir.logger, "Error during incomplete chunk removal")
+}
+
+// Looks over every chunk whose metadata block this server holds the lease on once, and deletes those that have been
+// incomplete for at least IncompleteChunkLease. A chunk is only known to have been incomplete since the first pass
+// that saw it so, so it is deleted on the first pass after the lease runs out from then.
+func (ir *IncompleteRemoval) Pass() error {
+	metachunks, err := ir.etcd.ListAllMetaIDs()
+	if err != nil {
+		return err
+	}
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	now := time.Now()
+	seen := map[apis.ChunkNum]time.Time{}
+	removed := 0
+	for _, metachunk := range metachunks {
+		for i := 0; i < 1<<apis.EntriesPerBlock; i++ {
+			chunk := metadatacache.EntryAndBlockToChunkNum(metachunk, uint32(i))
+			entry, owner, err := ir.localCache.ReadEntry(chunk)
+			if owner != apis.NoRedirect {
+				// another server holds the lease on this block, and takes care of it instead
+				break
+			}
+			if err != nil || entry.MostRecentVersion != 0 || entry.LastConsumedVersion != 0 {
+				continue
+			}
+			since, found := ir.seen[chunk]
+			if !found {
+				since = now
+			}
+			if now.Sub(since) < ir.lease {
+				seen[chunk] = since
+				continue
+			}
+			err = ir.updater.DeleteIncomplete(chunk)
+			if errors.Is(err, apis.ErrVersionStale) {
+				// written to since it was read
+				continue
+			} else if err != nil {
+				ir.logger.Logf(apis.WARN, "Could not delete incomplete chunk %d: %v", chunk, err)
+				seen[chunk] = since
+				continue
+			}
+			ir.logger.Logf(apis.INFO, "Deleted chunk %d, which was left unwritten since at least %v", chunk, since)
+			removed++
+		}
+	}
+	ir.seen = seen
+	ir.logger.Logf(apis.INFO, "Incomplete chunk removal deleted %d chunks, and is waiting on %d more", removed, len(seen))
+	return nil
+}
+
+// Lets an Updater reach the metadata through the local metadata cache, which holds the lease on every block that
+// garbage collection looks at.
+type localMetadata struct {
+	cache apis.MetadataCache
+}
+
+func (l localMetadata) NewEntry() (apis.ChunkNum, error) {
+	return l.cache.NewEntry()
+}
+
+func (l localMetadata) ReadEntry(chunk apis.ChunkNum) (apis.MetadataEntry, error) {
+	entry, _, err := l.cache.ReadEntry(chunk)
+	return entry, err
+}
+
+func (l localMetadata) UpdateEntry(chunk apis.ChunkNum, previous apis.MetadataEntry, next apis.MetadataEntry) error {
+	_, err := l.cache.UpdateEntry(chunk, previous, next)
+	return err
+}
 
-	return cancel, nil
+func (l localMetadata) DeleteEntry(chunk apis.ChunkNum, previous apis.MetadataEntry) error {
+	_, err := l.cache.DeleteEntry(chunk, previous)
+	return err
 }
@@ -0,0 +1,96 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"zircon/apis"
+	"zircon/chunkserver"
+	"zircon/client/control"
+	"zircon/etcd"
+	"zircon/frontend"
+	"zircon/metadatacache"
+	"zircon/rpc"
+	"zircon/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tests that a chunk that was allocated but never written to is deleted once its lease runs out, along with its
+// replicas, while chunks that were written to are left alone.
+func TestIncompleteRemoval(t *testing.T) {
+	cache := &rpc.MockCache{
+		Frontends:    map[apis.ServerAddress]apis.Frontend{},
+		Chunkservers: map[apis.ServerAddress]apis.Chunkserver{},
+	}
+	etcds, teardown1 := etcd.PrepareSubscribeForTesting(t)
+	var teardowns util.MultiTeardown
+	teardowns.Add(teardown1)
+	defer teardowns.TeardownReverse()
+
+	var chunkservers []apis.Chunkserver
+	for i := 0; i < 3; i++ {
+		name := apis.ServerName(fmt.Sprintf("cs%d", i))
+		address := apis.ServerAddress(fmt.Sprintf("cs-address-%d", i))
+
+		cs, _, csTeardown := chunkserver.NewTestChunkserver(t, cache)
+		teardowns.Add(csTeardown)
+		cache.Chunkservers[address] = cs
+		chunkservers = append(chunkservers, cs)
+
+		etcdN, etcdClientTeardown := etcds(name)
+		teardowns.Add(etcdClientTeardown)
+		require.NoError(t, etcdN.UpdateAddress(address, apis.CHUNKSERVER))
+	}
+
+	etcd0, teardown2 := etcds("fe0")
+	teardowns.Add(teardown2)
+	fe, err := frontend.ConstructFrontend(etcd0, cache)
+	require.NoError(t, err)
+	mdc0, err := metadatacache.NewCache(cache, etcd0)
+	require.NoError(t, err)
+	teardowns.Add(func() {
+		assert.NoError(t, mdc0.Close())
+	})
+	cache.MetadataCaches = map[apis.ServerAddress]apis.MetadataCache{
+		"mdc-address-0": mdc0,
+	}
+	require.NoError(t, etcd0.UpdateAddress("mdc-address-0", apis.METADATACACHE))
+
+	client, err := control.ConstructClient(fe, cache)
+	require.NoError(t, err)
+
+	abandoned, err := client.New()
+	require.NoError(t, err)
+	written, err := client.New()
+	require.NoError(t, err)
+	ver, err := client.Write(written, 0, apis.AnyVersion, []byte("keep me"))
+	require.NoError(t, err)
+
+	ir := NewIncompleteRemoval(etcd0, mdc0, cache, apis.NoopLogger)
+	// the lease hasn't run out yet
+	require.NoError(t, ir.Pass())
+	_, _, err = mdc0.ReadEntry(abandoned)
+	assert.NoError(t, err)
+
+	ir.lease = 0
+	require.NoError(t, ir.Pass())
+	_, _, err = mdc0.ReadEntry(abandoned)
+	assert.True(t, errors.Is(err, apis.ErrChunkDeleted), "unexpected error: %v", err)
+	for _, cs := range chunkservers {
+		chunks, err := cs.ListAllChunks()
+		require.NoError(t, err)
+		for _, cv := range chunks {
+			assert.NotEqual(t, abandoned, cv.Chunk)
+		}
+	}
+
+	data, version, err := client.Read(written, 0, 7)
+	require.NoError(t, err)
+	assert.Equal(t, ver, version)
+	assert.Equal(t, "keep me", string(data))
+
+	// the client finds that the chunk it never wrote to is already gone
+	assert.NoError(t, client.Close())
+}
@@ -1,15 +1,268 @@
 package services
 
 import (
+	"errors"
+	"sync"
+	"time"
 	"zircon/apis"
+	"zircon/chunkupdate"
+	"zircon/metadatacache"
 	"zircon/rpc"
 )
 
-// TODO This whole thing
-func RecoveryService(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache) (cancel func() error, err error) {
-	cancel = func() error {
+// How often the recovery service looks for chunks with fewer healthy replicas than they should have.
+const RecoveryFreq = 10 * time.Second
+
+// Explanation of the recovery service:
+//     When a chunkserver dies, or its disk fails, the chunks it held are left with fewer replicas than their replication
+//     factor, and nothing else adds any back. The recovery service works from metadata and chunkserver liveness alone,
+//     which makes it cheaper than the replicator, which asks every chunkserver for every chunk it holds. A replica is
+//     unhealthy if its chunkserver is down (see EtcdInterface.Heartbeat) or no longer registered, and a chunk needs
+//     recovery if it has any unhealthy replicas, or fewer healthy ones than its replication factor, which is what
+//     anti-entropy leaves behind when it drops a replica whose disk lost the chunk. For each such chunk, it copies the
+//     chunk from a healthy replica that holds its most recent version, with Chunkserver.Replicate, to chunkservers chosen
+//     by the placement policy, and then swaps them into the chunk's metadata entry in place of the unhealthy replicas.
+//     Unhealthy replicas stay in the entry until replacements have been made, so that a chunk with no healthy
+//     up-to-date replica left is only reported, in case its chunkservers come back. Like garbage collection, it only
+//     looks at the metadata blocks that its metadata cache holds the lease on.
+func RecoveryService(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache, placement chunkupdate.PlacementPolicy) (cancel func() error, err error) {
+	r := NewRecovery(etcd, localCache, rpcCache, placement, apis.NoopLogger)
+	r.Start(RecoveryFreq)
+	return func() error {
+		r.Stop()
 		return nil
+	}, nil
+}
+
+// What the recovery service has found and done, totalled over every pass so far.
+type RecoveryStats struct {
+	Passes int
+	// Chunks found with unhealthy replicas, or too few healthy ones.
+	NeedingRecovery int
+	// Replicas copied to new chunkservers and recorded in their chunks' entries.
+	Restored int
+	// Unhealthy replicas dropped from their chunks' entries.
+	Dropped int
+	// Chunks with no healthy replica holding their most recent version, which can't be recovered from.
+	Unrecoverable int
+	// Chunks that could not be recovered this time, such as because no chunkserver could take another replica; they
+	// are tried again on the next pass.
+	Failed int
+}
+
+type Recovery struct {
+	etcd       apis.EtcdInterface
+	localCache apis.MetadataCache
+	rpcCache   rpc.ConnectionCache
+	placement  chunkupdate.PlacementPolicy
+	logger     apis.Logger
+
+	// held for the duration of a pass
+	passMu sync.Mutex
+
+	mu    sync.Mutex
+	stats RecoveryStats
+
+	periodic
+}
+
+// Prepares the recovery service without starting it, so that passes can be run on demand with Pass, or periodically
+// with Start. Replacement replicas are placed with 'placement', which should match the policy the frontends use.
+func NewRecovery(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache, placement chunkupdate.PlacementPolicy, logger apis.Logger) *Recovery {
+	return &Recovery{
+		etcd:       etcd,
+		localCache: localCache,
+		rpcCache:   rpcCache,
+		placement:  placement,
+		logger:     logger,
+	}
+}
+
+// Looks for chunks to recover every 'interval' on a background goroutine, until Stop is called.
+func (r *Recovery) Start(interval time.Duration) {
+	r.start(interval, r.Pass, r.logger, "Error during recovery pass")
+}
+
+func (r *Recovery) Stats() RecoveryStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+func (r *Recovery) count(update func(stats *RecoveryStats)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	update(&r.stats)
+}
+
+// Checks every chunk whose metadata block this server holds the lease on once, and restores the replicas of each one
+// that needs recovery, as far as it can.
+func (r *Recovery) Pass() error {
+	r.passMu.Lock()
+	defer r.passMu.Unlock()
+
+	live, err := chunkupdate.ListLiveChunkservers(r.etcd)
+	if err != nil {
+		return err
+	}
+	metachunks, err := r.etcd.ListAllMetaIDs()
+	if err != nil {
+		return err
+	}
+	before := r.Stats()
+	for _, metachunk := range metachunks {
+		for i := 0; i < 1<<apis.EntriesPerBlock; i++ {
+			chunk := metadatacache.EntryAndBlockToChunkNum(metachunk, uint32(i))
+			entry, owner, err := r.localCache.ReadEntry(chunk)
+			if owner != apis.NoRedirect {
+				// another server holds the lease on this block, and takes care of it instead
+				break
+			}
+			// chunks that have never been written to have nothing on any chunkserver to recover
+			if err != nil || entry.MostRecentVersion == 0 {
+				continue
+			}
+			r.checkChunk(chunk, entry, live)
+		}
+	}
+	r.count(func(stats *RecoveryStats) {
+		stats.Passes++
+	})
+	after := r.Stats()
+	r.logger.Logf(apis.INFO, "Recovery found %d chunks needing recovery, and restored %d replicas",
+		after.NeedingRecovery-before.NeedingRecovery, after.Restored-before.Restored)
+	return nil
+}
+
+// Restores the replicas of one chunk if it needs recovery, given the chunkservers that are live.
+func (r *Recovery) checkChunk(chunk apis.ChunkNum, entry apis.MetadataEntry, live []apis.ServerID) {
+	healthy := map[apis.ServerID]bool{}
+	for _, id := range live {
+		healthy[id] = true
+	}
+	var good, bad []apis.ServerID
+	holding := map[apis.ServerID]bool{}
+	for _, id := range entry.Replicas {
+		holding[id] = true
+		if healthy[id] {
+			good = append(good, id)
+		} else {
+			bad = append(bad, id)
+		}
+	}
+	target := MinReplicas
+	if entry.ReplicationFactor > 0 {
+		target = int(entry.ReplicationFactor)
+	}
+	if len(bad) == 0 && len(good) >= target {
+		return
+	}
+	r.count(func(stats *RecoveryStats) {
+		stats.NeedingRecovery++
+	})
+
+	lagging := map[apis.ServerID]bool{}
+	for _, id := range entry.Lagging {
+		lagging[id] = true
+	}
+	var source apis.ServerID
+	for _, id := range good {
+		if !lagging[id] {
+			source = id
+			break
+		}
+	}
+	if source == 0 {
+		r.logger.Logf(apis.ERROR, "Chunk %d has no healthy replica of version %d to recover from", chunk, entry.MostRecentVersion)
+		r.count(func(stats *RecoveryStats) {
+			stats.Unrecoverable++
+		})
+		return
+	}
+
+	added, err := r.restore(chunk, entry, source, good, live, holding, target-len(good))
+	if err == nil && len(added) == 0 && len(good) < target {
+		err = errors.New("no chunkserver could take another replica")
+	}
+	if err != nil {
+		r.logger.Logf(apis.WARN, "Could not recover chunk %d: %v", chunk, err)
+		r.count(func(stats *RecoveryStats) {
+			stats.Failed++
+		})
+		return
+	}
+
+	next := entry
+	next.Replicas = append(append([]apis.ServerID{}, good...), added...)
+	next.Lagging = nil
+	for _, id := range entry.Lagging {
+		if healthy[id] {
+			next.Lagging = append(next.Lagging, id)
+		}
+	}
+	owner, err := r.localCache.UpdateEntry(chunk, entry, next)
+	if err == nil && owner != apis.NoRedirect {
+		err = errors.New("lost the lease on the chunk's metadata block")
+	}
+	if err != nil {
+		// the copies are left for garbage collection, and the chunk is looked at again on the next pass
+		r.logger.Logf(apis.WARN, "Could not record the recovered replicas of chunk %d: %v", chunk, err)
+		r.count(func(stats *RecoveryStats) {
+			stats.Failed++
+		})
+		return
 	}
+	r.logger.Logf(apis.INFO, "Recovered chunk %d onto %v in place of %v", chunk, added, bad)
+	r.count(func(stats *RecoveryStats) {
+		stats.Restored += len(added)
+		stats.Dropped += len(bad)
+	})
+}
 
-	return cancel, nil
+// Copies a chunk from 'source' to up to 'count' live chunkservers that don't already hold it, chosen by the placement
+// policy given the healthy replicas in 'good'. Returns the chunkservers that it was copied to.
+func (r *Recovery) restore(chunk apis.ChunkNum, entry apis.MetadataEntry, source apis.ServerID, good []apis.ServerID,
+	live []apis.ServerID, holding map[apis.ServerID]bool, count int) ([]apis.ServerID, error) {
+	var avail []apis.ServerID
+	for _, id := range live {
+		if !holding[id] {
+			avail = append(avail, id)
+		}
+	}
+	if count > len(avail) {
+		r.logger.Logf(apis.WARN, "Not enough live chunkservers to fully recover chunk %d", chunk)
+		count = len(avail)
+	}
+	if count <= 0 {
+		return nil, nil
+	}
+	existing, err := chunkupdate.CandidatesFor(r.etcd, good)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := chunkupdate.CandidatesFor(r.etcd, avail)
+	if err != nil {
+		return nil, err
+	}
+	chosen, err := chunkupdate.Place(r.placement, count, existing, candidates)
+	if err != nil {
+		return nil, err
+	}
+	sourceCS, err := chunkserverByID(r.etcd, r.rpcCache, source)
+	if err != nil {
+		return nil, err
+	}
+	var added []apis.ServerID
+	for _, to := range chosen {
+		address, err := chunkupdate.AddressForChunkserver(r.etcd, to)
+		if err == nil {
+			err = sourceCS.Replicate(chunk, address, entry.MostRecentVersion)
+		}
+		if err != nil {
+			r.logger.Logf(apis.WARN, "When recovering chunk %d from Server #%d to Server #%d: %v", chunk, source, to, err)
+			continue
+		}
+		added = append(added, to)
+	}
+	return added, nil
 }
@@ -1 +1,118 @@
 package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver"
+	"zircon/chunkupdate"
+	"zircon/client/control"
+	"zircon/etcd"
+	"zircon/frontend"
+	"zircon/metadatacache"
+	"zircon/rpc"
+	"zircon/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tests that once a chunkserver stops sending heartbeats, recovery replaces each of its replicas with one on a live
+// chunkserver, without losing any data.
+func TestRecovery(t *testing.T) {
+	cache := &rpc.MockCache{
+		Frontends:    map[apis.ServerAddress]apis.Frontend{},
+		Chunkservers: map[apis.ServerAddress]apis.Chunkserver{},
+	}
+	etcds, teardown1 := etcd.PrepareSubscribeForTesting(t)
+	var teardowns util.MultiTeardown
+	teardowns.Add(teardown1)
+	defer teardowns.TeardownReverse()
+
+	var stopHeartbeats []func()
+	for i := 0; i < 3; i++ {
+		name := apis.ServerName(fmt.Sprintf("cs%d", i))
+		address := apis.ServerAddress(fmt.Sprintf("cs-address-%d", i))
+
+		cs, _, csTeardown := chunkserver.NewTestChunkserver(t, cache)
+		teardowns.Add(csTeardown)
+		cache.Chunkservers[address] = cs
+
+		etcdN, etcdClientTeardown := etcds(name)
+		teardowns.Add(etcdClientTeardown)
+		require.NoError(t, etcdN.UpdateAddress(address, apis.CHUNKSERVER))
+		stop, err := chunkserver.StartHeartbeats(etcdN, time.Second, apis.NoopLogger)
+		require.NoError(t, err)
+		stopHeartbeats = append(stopHeartbeats, stop)
+	}
+	teardowns.Add(stopHeartbeats[1], stopHeartbeats[2])
+
+	etcd0, teardown2 := etcds("fe0")
+	teardowns.Add(teardown2)
+	fe, err := frontend.ConstructFrontend(etcd0, cache)
+	require.NoError(t, err)
+	mdc0, err := metadatacache.NewCache(cache, etcd0)
+	require.NoError(t, err)
+	teardowns.Add(func() {
+		assert.NoError(t, mdc0.Close())
+	})
+	cache.MetadataCaches = map[apis.ServerAddress]apis.MetadataCache{
+		"mdc-address-0": mdc0,
+	}
+	require.NoError(t, etcd0.UpdateAddress("mdc-address-0", apis.METADATACACHE))
+
+	client, err := control.ConstructClient(fe, cache)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var chunks []apis.ChunkNum
+	for i := 0; i < 6; i++ {
+		chunk, err := client.New()
+		require.NoError(t, err)
+		_, err = client.Write(chunk, 0, apis.AnyVersion, []byte(fmt.Sprintf("chunk %d", i)))
+		require.NoError(t, err)
+		chunks = append(chunks, chunk)
+	}
+	cs0, err := etcd0.GetIDByName("cs0")
+	require.NoError(t, err)
+	onCS0 := 0
+	for _, chunk := range chunks {
+		entry, _, err := fe.ReadFullMetadataEntry(chunk)
+		require.NoError(t, err)
+		for _, id := range entry.Replicas {
+			if id == cs0 {
+				onCS0++
+			}
+		}
+	}
+	// with two replicas each on three chunkservers, cs0 is all but certain to hold some of them
+	require.True(t, onCS0 > 0)
+
+	recovery := NewRecovery(etcd0, mdc0, cache, chunkupdate.DomainPlacement, apis.NoopLogger)
+	// nothing is wrong yet
+	require.NoError(t, recovery.Pass())
+	assert.Equal(t, RecoveryStats{Passes: 1}, recovery.Stats())
+
+	// cs0 dies, and stays down past its liveness timeout
+	stopHeartbeats[0]()
+	delete(cache.Chunkservers, "cs-address-0")
+	time.Sleep(time.Second * 5 / 2)
+
+	require.NoError(t, recovery.Pass())
+	assert.Equal(t, RecoveryStats{
+		Passes:          2,
+		NeedingRecovery: onCS0,
+		Restored:        onCS0,
+		Dropped:         onCS0,
+	}, recovery.Stats())
+	for i, chunk := range chunks {
+		entry, _, err := fe.ReadFullMetadataEntry(chunk)
+		require.NoError(t, err)
+		assert.Len(t, entry.Replicas, 2)
+		assert.NotContains(t, entry.Replicas, cs0)
+		data, _, err := client.Read(chunk, 0, 7)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("chunk %d", i), string(data))
+	}
+}
@@ -2,7 +2,6 @@ package services
 
 import (
 	"fmt"
-	"log"
 	"time"
 	"zircon/apis"
 	"zircon/chunkupdate"
@@ -10,6 +9,7 @@ import (
 	"zircon/rpc"
 )
 
+// How many replicas a chunk is kept on if its metadata entry doesn't record a replication factor of its own.
 const MinReplicas int = 2
 
 // Replicaiton Frequency in seconds
@@ -18,12 +18,22 @@ const ReplicationFreq = 5
 // Explanation of the replication service:
 //     Every chunk in the cluster should be replicated to at least two servers, preferably three.
 //     The replication service goes through, counts valid replicas, and replicates new ones as necessary.
+//     Replicas on chunkservers that have stopped sending heartbeats (see EtcdInterface.Heartbeat) don't count as valid,
+//     so once a chunkserver has been down for its liveness timeout, its chunks are re-replicated elsewhere, and it is
+//     dropped from their metadata entries.
 //         (TODO: have chunkservers periodically check their disk checksums)
-func ReplicatorService(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache) (cancel func() error, err error) {
+func ReplicatorService(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache, placement chunkupdate.PlacementPolicy) (cancel func() error, err error) {
+	return LoggingReplicatorService(etcd, localCache, rpcCache, placement, apis.NoopLogger)
+}
+
+// Like ReplicatorService, but reports each chunk it replicates, and any it can't, to 'logger'.
+func LoggingReplicatorService(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache, placement chunkupdate.PlacementPolicy, logger apis.Logger) (cancel func() error, err error) {
 	rpl := replicator{
 		etcd:       etcd,
 		localCache: localCache,
 		rpcCache:   rpcCache,
+		placement:  placement,
+		logger:     logger,
 	}
 
 	cancel = func() error {
@@ -43,6 +53,8 @@ type replicator struct {
 	etcd       apis.EtcdInterface
 	localCache apis.MetadataCache
 	rpcCache   rpc.ConnectionCache
+	placement  chunkupdate.PlacementPolicy
+	logger     apis.Logger
 	stop       bool
 }
 
@@ -51,7 +63,7 @@ func (rpl *replicator) Start() error {
 		for !rpl.stop {
 			err := rpl.replicate()
 			if err != nil {
-				log.Printf("Error replicating: %v", err)
+				rpl.logger.Logf(apis.ERROR, "Error replicating: %v", err)
 			}
 
 			time.Sleep(ReplicationFreq * time.Second)
@@ -87,13 +99,15 @@ func (rpl *replicator) replicate() error {
 		for i := 0; i < 1<<apis.EntriesPerBlock; i++ {
 			chunkID := metadatacache.EntryAndBlockToChunkNum(metachunk, uint32(i))
 			// TODO Make this distinguish between the entry just not being there and a critical err
-			entry, owner, err := rpl.localCache.ReadEntry(chunkID)
+			var entry apis.MetadataEntry
+			entry, owner, err = rpl.localCache.ReadEntry(chunkID)
 			if owner != apis.NoRedirect {
-				log.Printf("Server %s has lease on metachunk %d. Skipping over it.", owner, metachunk)
+				rpl.logger.Logf(apis.DEBUG, "Server %s has lease on metachunk %d. Skipping over it.", owner, metachunk)
 				break
 			}
 
-			if err == nil {
+			// chunks that have never been written to have nothing on any chunkserver to replicate
+			if err == nil && entry.MostRecentVersion > 0 {
 				entries[chunkID] = entry
 			}
 		}
@@ -101,7 +115,7 @@ func (rpl *replicator) replicate() error {
 		// Check for valid replication of data chunks
 		if owner != apis.NoRedirect {
 			continue
-		} else if len(entries) == 0 {
+		} else if len(entries) > 0 {
 			rpl.replicateChunks(entries, validChunks)
 		}
 	}
@@ -113,7 +127,7 @@ func (rpl *replicator) replicate() error {
 // This mapping would not contain the chunkservers or its chunks for any chunkserver that is down,
 // and would not contain any chunks that the chunkserver somehow lost or has designated as invalid
 func (rpl *replicator) genValidChunks() (map[apis.ServerID]map[apis.ChunkVersion]bool, error) {
-	chunkservers, err := chunkupdate.ListChunkservers(rpl.etcd)
+	chunkservers, err := chunkupdate.ListLiveChunkservers(rpl.etcd)
 	if err != nil {
 		return nil, err
 	}
@@ -124,14 +138,14 @@ func (rpl *replicator) genValidChunks() (map[apis.ServerID]map[apis.ChunkVersion
 		// TODO Make sure this times out if the target is down
 		cs, err := rpl.idToCS(chunkserver)
 		if err != nil {
-			log.Printf("Server %s threw error: %v while constructing list of valid chunks", chunkserver, err)
+			rpl.logger.Logf(apis.WARN, "Server %d threw error: %v while constructing list of valid chunks", chunkserver, err)
 			continue
 		}
 
 		// This assumes chunkserver to return only its valid chunks
 		cvs, err := cs.ListAllChunks()
 		if err != nil {
-			log.Printf("Server %s threw error: %v while constructing list of valid chunks", chunkserver, err)
+			rpl.logger.Logf(apis.WARN, "Server %d threw error: %v while constructing list of valid chunks", chunkserver, err)
 			continue
 		}
 		// Doing this as map instead of a list for faster lookup
@@ -148,7 +162,7 @@ func (rpl *replicator) genValidChunks() (map[apis.ServerID]map[apis.ChunkVersion
 // Given a list of entries and a list of valid ChunkVersions per chunkserver,
 // ensure than each chunk is replicated to an appropriate number of healthy servers
 // 1. Replace any chunk references that are not in our list of valid chunk references
-// 2. Make sure that the replication of each chunk is at least minReplication
+// 2. Make sure that the replication of each chunk is at least its replication factor, or MinReplicas without one
 // 3. Replace chunk references that somehow are not up-to-date with the current version
 func (rpl *replicator) replicateChunks(entries map[apis.ChunkNum]apis.MetadataEntry, validChunks map[apis.ServerID]map[apis.ChunkVersion]bool) {
 	for chunk, entry := range entries {
@@ -162,22 +176,18 @@ func (rpl *replicator) replicateChunks(entries map[apis.ChunkNum]apis.MetadataEn
 		validReplicas := []apis.ServerID{}
 		invalidReplicas := []apis.ServerID{}
 		for _, serverID := range entry.Replicas {
-			serverChunks, ok := validChunks[serverID]
-			if !ok {
-				invalidReplicas = append(invalidReplicas, serverID)
-			}
-			_, ok = serverChunks[cv]
-			if ok {
+			// servers that are down aren't in validChunks at all, so none of their replicas count
+			if validChunks[serverID][cv] {
 				validReplicas = append(validReplicas, serverID)
 			} else {
-				invalidReplicas = append(validReplicas, serverID)
+				invalidReplicas = append(invalidReplicas, serverID)
 			}
 		}
 
 		// If all references are invalid, log that fact and be sad
 		if len(validReplicas) == 0 {
 			// TODO Maybe try to recover with a previous version
-			log.Printf("Chunk %d not present on any available server. Could not be replicated", chunk)
+			rpl.logger.Logf(apis.ERROR, "Chunk %d not present on any available server. Could not be replicated", chunk)
 			continue
 		}
 
@@ -187,29 +197,41 @@ func (rpl *replicator) replicateChunks(entries map[apis.ChunkNum]apis.MetadataEn
 		// TODO Poss. do something better than just using the keys from the server to valid chunks mapping
 		availServers := []apis.ServerID{}
 		for id, _ := range validChunks {
-			if id != source {
+			holding := false
+			for _, replica := range validReplicas {
+				holding = holding || replica == id
+			}
+			if !holding {
 				availServers = append(availServers, id)
 			}
 		}
 
 		var nReplicas int
-		// Assure that the chunk is replicated at least MinReplica times
-		if len(validReplicas)+len(invalidReplicas) < MinReplicas {
-			nReplicas = MinReplicas - len(validReplicas)
+		// Assure that the chunk is replicated at least as many times as it was allocated with
+		target := MinReplicas
+		if entry.ReplicationFactor > 0 {
+			target = int(entry.ReplicationFactor)
+		}
+		if len(validReplicas)+len(invalidReplicas) < target {
+			nReplicas = target - len(validReplicas)
 		} else {
 			nReplicas = len(invalidReplicas)
 		}
+		if nReplicas == 0 {
+			continue
+		}
 
-		err := rpl.replicateChunk(chunk, entry, source, availServers, nReplicas)
+		err := rpl.replicateChunk(chunk, entry, source, validReplicas, availServers, nReplicas)
 		if err != nil {
-			log.Printf("Replicating chunk %d from Server #%d threw err: %v", chunk, source, err)
+			rpl.logger.Logf(apis.WARN, "Replicating chunk %d from Server #%d threw err: %v", chunk, source, err)
 			continue
 		}
 	}
 }
 
-// Replicate a given chunk from the source server to N of the servers given in availServer where N is nReplications
-func (rpl *replicator) replicateChunk(chunk apis.ChunkNum, entry apis.MetadataEntry, source apis.ServerID, availServers []apis.ServerID, nReplications int) error {
+// Replicate a given chunk from the source server to N of the servers given in availServer where N is nReplications.
+// The servers are chosen by the placement policy, given the servers that still hold valid replicas.
+func (rpl *replicator) replicateChunk(chunk apis.ChunkNum, entry apis.MetadataEntry, source apis.ServerID, validReplicas []apis.ServerID, availServers []apis.ServerID, nReplications int) error {
 	if nReplications < 0 {
 		return fmt.Errorf("Replication factor is %d, less than 0", nReplications)
 	}
@@ -221,16 +243,25 @@ func (rpl *replicator) replicateChunk(chunk apis.ChunkNum, entry apis.MetadataEn
 
 	// Relying on chunk balancer to fix bad allocations patterns from this
 	// TODO Possibly regenerate the pool of available chunkservers to choose from or limit to ones with space for new chunks
+	if nReplications > len(availServers) {
+		rpl.logger.Logf(apis.WARN, "Not enough available servers to fully replicate %d", chunk)
+		nReplications = len(availServers)
+	}
+	existing, err := chunkupdate.CandidatesFor(rpl.etcd, validReplicas)
+	if err != nil {
+		return err
+	}
+	candidates, err := chunkupdate.CandidatesFor(rpl.etcd, availServers)
+	if err != nil {
+		return err
+	}
+	chosen, err := chunkupdate.Place(rpl.placement, nReplications, existing, candidates)
+	if err != nil {
+		return err
+	}
 
 	newReplicas := []apis.ServerID{}
-	for 0 < nReplications {
-		if len(availServers) == 0 {
-			log.Printf("Ran out of available servers for replication while replicating %d", chunk)
-			break
-		}
-
-		repServer := availServers[0]
-		availServers = availServers[1:]
+	for _, repServer := range chosen {
 		repName, err := rpl.etcd.GetNameByID(repServer)
 		if err != nil {
 			return err
@@ -244,20 +275,26 @@ func (rpl *replicator) replicateChunk(chunk apis.ChunkNum, entry apis.MetadataEn
 		// TODO Is this the right way to handle these versions
 		err = sourceCS.Replicate(chunk, repAddress, entry.MostRecentVersion)
 		if err != nil {
-			log.Printf("When replicating chunk %d from Server #%d to Server #%d: %v", chunk, source, repServer)
+			rpl.logger.Logf(apis.WARN, "When replicating chunk %d from Server #%d to Server #%d: %v", chunk, source, repServer, err)
 			continue
 		}
 
+		rpl.logger.Logf(apis.INFO, "Replicated chunk %d from Server #%d to Server #%d", chunk, source, repServer)
 		newReplicas = append(newReplicas, repServer)
-		nReplications -= 1
 	}
 
-	// Update the metadata entry with the new replicas
-	_, err = rpl.localCache.UpdateEntry(chunk, entry, apis.MetadataEntry{
-		MostRecentVersion:   entry.MostRecentVersion,
-		LastConsumedVersion: entry.LastConsumedVersion,
-		Replicas:            append(newReplicas, source),
-	})
+	// Update the metadata entry with the new replicas, in place of the invalid ones
+	updated := entry
+	updated.Replicas = append(newReplicas, validReplicas...)
+	updated.Lagging = nil
+	for _, lagging := range entry.Lagging {
+		for _, valid := range validReplicas {
+			if lagging == valid {
+				updated.Lagging = append(updated.Lagging, lagging)
+			}
+		}
+	}
+	_, err = rpl.localCache.UpdateEntry(chunk, entry, updated)
 
 	return err
 }
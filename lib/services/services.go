@@ -2,23 +2,25 @@ package services
 
 import (
 	"zircon/apis"
+	"zircon/chunkupdate"
 	"zircon/rpc"
 )
 
-// Launches cluster services, such as replication and garbage collection.
-func StartServices(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache) (cancel func() error, err error) {
+// Launches cluster services, such as replication, recovery, garbage collection, and draining. Replicas are placed with
+// 'placement', which should match the policy the frontends use.
+func StartServices(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache, placement chunkupdate.PlacementPolicy) (cancel func() error, err error) {
 
 	// TODO Currently return early on errors, but maybe it's better to still start the other services
 	// TODO Clean this up with a list of service function pointers that take the same arguments
-	repCancel, err := ReplicatorService(etcd, localCache, rpcCache)
+	repCancel, err := ReplicatorService(etcd, localCache, rpcCache, placement)
 	if err != nil {
 		return nil, err
 	}
-	lbCancel, err := LoadBalancerService(etcd, localCache, rpcCache)
+	lbCancel, err := LoadBalancerService(etcd, localCache, rpcCache, placement)
 	if err != nil {
 		return nil, err
 	}
-	rcCancel, err := RecoveryService(etcd, localCache, rpcCache)
+	rcCancel, err := RecoveryService(etcd, localCache, rpcCache, placement)
 	if err != nil {
 		return nil, err
 	}
@@ -26,12 +28,22 @@ func StartServices(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCa
 	if err != nil {
 		return nil, err
 	}
+	aeCancel, err := AntiEntropyService(etcd, localCache, rpcCache)
+	if err != nil {
+		return nil, err
+	}
+	drCancel, err := DrainService(etcd, localCache, rpcCache, placement)
+	if err != nil {
+		return nil, err
+	}
 
 	cancel = func() error {
 		repErr := repCancel()
 		lbErr := lbCancel()
 		rcErr := rcCancel()
 		gcErr := gcCancel()
+		aeErr := aeCancel()
+		drErr := drCancel()
 
 		// TODO Combine errors together
 		if repErr != nil {
@@ -46,6 +58,12 @@ func StartServices(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCa
 		if gcErr != nil {
 			return gcErr
 		}
+		if aeErr != nil {
+			return aeErr
+		}
+		if drErr != nil {
+			return drErr
+		}
 
 		return nil
 	}
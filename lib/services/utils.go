@@ -1 +1,126 @@
 package services
+
+import (
+	"errors"
+	"time"
+	"zircon/apis"
+	"zircon/chunkupdate"
+	"zircon/rpc"
+)
+
+// The background goroutine of a service that runs passes periodically, which can also be run one at a time on demand.
+// Services embed it, which gives them Stop.
+type periodic struct {
+	// closed by Stop; passes that wait along the way can also stop early on it
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Runs 'pass' every 'interval' on a background goroutine, until Stop is called, and reports the errors it fails with
+// to 'logger', after 'failure'.
+func (p *periodic) start(interval time.Duration, pass func() error, logger apis.Logger, failure string) {
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(interval):
+			}
+			if err := pass(); err != nil {
+				logger.Logf(apis.ERROR, "%s: %v", failure, err)
+			}
+		}
+	}()
+}
+
+// Stops the background goroutine started by Start, and waits for any pass in progress to finish.
+func (p *periodic) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+// Given a chunkserver id, return a connection to that chunkserver
+func chunkserverByID(etcd apis.EtcdInterface, rpcCache rpc.ConnectionCache, id apis.ServerID) (apis.Chunkserver, error) {
+	addr, err := chunkupdate.AddressForChunkserver(etcd, id)
+	if err != nil {
+		return nil, err
+	}
+	return rpcCache.SubscribeChunkserver(addr)
+}
+
+// Chooses a replica of a chunk to copy it from: 'preferred', if it holds the chunk's most recent version, or else any
+// other replica that does. Returns 0 if none of them do.
+func upToDateReplica(entry apis.MetadataEntry, preferred apis.ServerID) apis.ServerID {
+	lagging := map[apis.ServerID]bool{}
+	for _, id := range entry.Lagging {
+		lagging[id] = true
+	}
+	if !lagging[preferred] {
+		for _, id := range entry.Replicas {
+			if id == preferred {
+				return id
+			}
+		}
+	}
+	for _, id := range entry.Replicas {
+		if !lagging[id] {
+			return id
+		}
+	}
+	return 0
+}
+
+// Moves a chunk's replica from chunkserver 'from' to chunkserver 'to': copies the chunk to 'to' from 'source', which
+// must hold its most recent version, swaps 'to' into the chunk's metadata entry in place of 'from', and only then
+// deletes the chunk from 'from', so that the chunk is never on fewer replicas than it should be. Returns the entry as
+// updated. If the entry changed after it was read, such as by a write, nothing is swapped, and the copy is left for
+// garbage collection.
+func relocateReplica(etcd apis.EtcdInterface, localCache apis.MetadataCache, rpcCache rpc.ConnectionCache, logger apis.Logger,
+	chunk apis.ChunkNum, entry apis.MetadataEntry, from apis.ServerID, to apis.ServerID, source apis.ServerID) (apis.MetadataEntry, error) {
+	address, err := chunkupdate.AddressForChunkserver(etcd, to)
+	if err != nil {
+		return entry, err
+	}
+	sourceCS, err := chunkserverByID(etcd, rpcCache, source)
+	if err != nil {
+		return entry, err
+	}
+	if err := sourceCS.Replicate(chunk, address, entry.MostRecentVersion); err != nil {
+		return entry, err
+	}
+
+	next := entry
+	next.Replicas = make([]apis.ServerID, len(entry.Replicas))
+	for i, id := range entry.Replicas {
+		if id == from {
+			id = to
+		}
+		next.Replicas[i] = id
+	}
+	next.Lagging = nil
+	for _, id := range entry.Lagging {
+		if id != from {
+			next.Lagging = append(next.Lagging, id)
+		}
+	}
+	owner, err := localCache.UpdateEntry(chunk, entry, next)
+	if err == nil && owner != apis.NoRedirect {
+		err = errors.New("lost the lease on the chunk's metadata block")
+	}
+	if err != nil {
+		return entry, err
+	}
+
+	fromCS, err := chunkserverByID(etcd, rpcCache, from)
+	if err == nil {
+		err = fromCS.Delete(chunk, entry.MostRecentVersion)
+	}
+	if err != nil {
+		// the entry no longer refers to it, so anti-entropy and garbage collection get to it eventually
+		logger.Logf(apis.WARN, "Could not delete chunk %d from server #%d after moving it: %v", chunk, from, err)
+	}
+	return next, nil
+}
@@ -1,15 +1,25 @@
 package util
 
+// Collects the teardown functions for a set of resources, so that they can all be torn down together.
 type MultiTeardown struct {
 	teardowns []func()
 }
 
+// Runs every teardown function, in the order they were added.
 func (m *MultiTeardown) Teardown() {
 	for _, teardown := range m.teardowns {
 		teardown()
 	}
 }
 
+// Runs every teardown function, starting with the most recently added. When each resource is added after the resources
+// it uses, this stops everything that might still be calling a resource before that resource goes away.
+func (m *MultiTeardown) TeardownReverse() {
+	for i := len(m.teardowns) - 1; i >= 0; i-- {
+		m.teardowns[i]()
+	}
+}
+
 func (m *MultiTeardown) Add(teardowns ...func()) {
 	m.teardowns = append(m.teardowns, teardowns...)
 }